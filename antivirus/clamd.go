@@ -0,0 +1,153 @@
+package antivirus
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/t2bot/matrix-media-repo/common/config"
+)
+
+const chunkSize = 64 * 1024
+
+// sizeLimitReply is sent by clamd when the stream is larger than its StreamMaxLength setting.
+const sizeLimitReply = "INSTREAM size limit exceeded"
+
+// ErrStreamTooLarge is returned when the upload is larger than clamd is configured to scan.
+var ErrStreamTooLarge = errors.New("upload is larger than clamd's StreamMaxLength")
+
+type ScanResult struct {
+	Infected  bool
+	Signature string
+}
+
+func IsEnabled() bool {
+	return config.Get().Antivirus.Enabled
+}
+
+func timeout() time.Duration {
+	return time.Duration(config.Get().Antivirus.TimeoutSeconds) * time.Second
+}
+
+// extendDeadline gives the connection another full timeout. The timeout applies to each step of the scan rather
+// than the whole scan, so large uploads which stream slowly don't fail part way through.
+func extendDeadline(conn net.Conn) error {
+	if t := timeout(); t > 0 {
+		return conn.SetDeadline(time.Now().Add(t))
+	}
+	return nil
+}
+
+func dial() (net.Conn, error) {
+	conf := config.Get().Antivirus
+	u, err := url.Parse(conf.Address)
+	if err != nil {
+		return nil, errors.New("invalid clamd address: " + err.Error())
+	}
+	timeout := timeout()
+
+	var conn net.Conn
+	switch u.Scheme {
+	case "tcp":
+		conn, err = net.DialTimeout("tcp", u.Host, timeout)
+	case "unix":
+		conn, err = net.DialTimeout("unix", u.Path, timeout)
+	default:
+		return nil, errors.New("unsupported clamd address scheme: " + u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = extendDeadline(conn); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Scan streams the reader to clamd using the INSTREAM command and returns the verdict. The reader is not
+// drained if the scan fails part way through.
+func Scan(r io.Reader) (*ScanResult, error) {
+	conn, err := dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if _, err = conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, chunkSize)
+	sizeBuf := make([]byte, 4)
+	for {
+		n, readErr := r.Read(buf)
+		if n > 0 {
+			if err = extendDeadline(conn); err != nil {
+				return nil, err
+			}
+			binary.BigEndian.PutUint32(sizeBuf, uint32(n))
+			if _, err = conn.Write(sizeBuf); err != nil {
+				return nil, writeError(conn, err)
+			}
+			if _, err = conn.Write(buf[:n]); err != nil {
+				return nil, writeError(conn, err)
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return nil, readErr
+		}
+	}
+
+	if err = extendDeadline(conn); err != nil {
+		return nil, err
+	}
+	binary.BigEndian.PutUint32(sizeBuf, 0)
+	if _, err = conn.Write(sizeBuf); err != nil {
+		return nil, writeError(conn, err)
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString('\x00')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	return parseReply(reply)
+}
+
+// writeError checks whether clamd stopped reading because the stream hit its size limit, which it reports before
+// closing the connection. Otherwise, the write error is returned as-is.
+func writeError(conn net.Conn, err error) error {
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	reply, _ := bufio.NewReader(conn).ReadString('\x00')
+	if strings.Contains(reply, sizeLimitReply) {
+		return ErrStreamTooLarge
+	}
+	return err
+}
+
+// parseReply interprets replies like `stream: OK` and `stream: Eicar-Signature FOUND`.
+func parseReply(reply string) (*ScanResult, error) {
+	reply = strings.TrimSpace(strings.TrimRight(reply, "\x00"))
+	if strings.Contains(reply, sizeLimitReply) {
+		return nil, ErrStreamTooLarge
+	}
+	_, verdict, found := strings.Cut(reply, ": ")
+	if !found {
+		return nil, errors.New("unexpected reply from clamd: " + reply)
+	}
+	if verdict == "OK" {
+		return &ScanResult{Infected: false}, nil
+	}
+	if signature, found := strings.CutSuffix(verdict, " FOUND"); found {
+		return &ScanResult{Infected: true, Signature: signature}, nil
+	}
+	return nil, errors.New("clamd failed to scan: " + verdict)
+}
@@ -7,6 +7,7 @@ import (
 
 	"github.com/t2bot/matrix-media-repo/common/rcontext"
 	"github.com/t2bot/matrix-media-repo/matrix"
+	"github.com/t2bot/matrix-media-repo/restrictions"
 	"github.com/t2bot/matrix-media-repo/util"
 )
 
@@ -23,12 +24,29 @@ type ServerInfo struct {
 type AuthContext struct {
 	User   UserInfo
 	Server ServerInfo
+
+	// GalleryRoomId is the room a verified gallery token grants access to, if any.
+	GalleryRoomId string
+	// GalleryTokenId identifies the gallery token, if any.
+	GalleryTokenId string
 }
 
 func (a AuthContext) IsAuthenticated() bool {
 	return a.User.UserId != "" || a.Server.ServerName != ""
 }
 
+// Requester describes the authenticated party for room access checks.
+func (a AuthContext) Requester() *restrictions.Requester {
+	return &restrictions.Requester{
+		UserId:      a.User.UserId,
+		AccessToken: a.User.AccessToken,
+		ServerName:  a.Server.ServerName,
+		IsShared:    a.User.IsShared,
+
+		GalleryRoomId: a.GalleryRoomId,
+	}
+}
+
 func GetRequestUserAdminStatus(r *http.Request, rctx rcontext.RequestContext, user UserInfo) (bool, bool) {
 	isGlobalAdmin := util.IsGlobalAdmin(user.UserId) || user.IsShared
 	isLocalAdmin, err := matrix.IsUserAdmin(rctx, r.Host, user.AccessToken, r.RemoteAddr)
@@ -0,0 +1,50 @@
+package _apimeta
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/t2bot/matrix-media-repo/database"
+)
+
+// MediaETag builds the strong ETag for a piece of media from its SHA256 hash.
+func MediaETag(sha256hash string) string {
+	return "\"" + sha256hash + "\""
+}
+
+// ThumbnailETag builds the strong ETag for a thumbnail. Thumbnails don't record a hash of their contents, so
+// the tag is derived from the parameters and creation time which identify the stored thumbnail.
+func ThumbnailETag(thumbnail *database.DbThumbnail) string {
+	key := fmt.Sprintf("%s/%s?w=%d&h=%d&m=%s&a=%t&f=%s&ts=%d", thumbnail.Origin, thumbnail.MediaId, thumbnail.Width, thumbnail.Height, thumbnail.Method, thumbnail.Animated, thumbnail.Format, thumbnail.CreationTs)
+	hash := sha256.Sum256([]byte(key))
+	return "\"" + hex.EncodeToString(hash[:]) + "\""
+}
+
+// IsNotModified evaluates the request's If-None-Match and If-Modified-Since headers against the media. As per
+// RFC 9110, If-Modified-Since is only considered when If-None-Match is absent.
+func IsNotModified(r *http.Request, etag string, lastModifiedTs int64) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, candidate := range strings.Split(inm, ",") {
+			candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+			if candidate == "*" || candidate == etag {
+				return true
+			}
+		}
+		return false
+	}
+
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" && lastModifiedTs > 0 {
+		since, err := http.ParseTime(ims)
+		if err != nil {
+			return false
+		}
+		// HTTP dates only have second precision
+		return !time.UnixMilli(lastModifiedTs).Truncate(time.Second).After(since)
+	}
+
+	return false
+}
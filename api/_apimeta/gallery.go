@@ -0,0 +1,27 @@
+package _apimeta
+
+import (
+	"net/http"
+
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/restrictions"
+)
+
+// GalleryTokenParam is the query string parameter used to pass a gallery token with download and thumbnail requests.
+const GalleryTokenParam = "io.t2bot.gallery_token"
+
+// ApplyGalleryToken verifies the request's gallery token, if there is one, and grants the auth context access to the
+// token's room.
+func ApplyGalleryToken(ctx rcontext.RequestContext, r *http.Request, auth AuthContext) (AuthContext, error) {
+	token := r.URL.Query().Get(GalleryTokenParam)
+	if token == "" {
+		return auth, nil
+	}
+	gallery, err := restrictions.VerifyGalleryToken(ctx, token)
+	if err != nil {
+		return auth, err
+	}
+	auth.GalleryRoomId = gallery.RoomId
+	auth.GalleryTokenId = gallery.Id
+	return auth, nil
+}
@@ -0,0 +1,44 @@
+package _apimeta
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/restrictions"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+// GetRequestRoomIds returns the de-duplicated room IDs supplied by repeated `room_id` query parameters, followed by
+// any additional room IDs the caller has already parsed from the request. The user must be joined to each room,
+// unless they are a repository administrator or using shared secret auth. Returns an error wrapping
+// common.ErrNotJoinedToRoom if they are not.
+func GetRequestRoomIds(r *http.Request, rctx rcontext.RequestContext, user UserInfo, additional []string) ([]string, error) {
+	roomIds := make([]string, 0)
+	for _, roomId := range append(r.URL.Query()["room_id"], additional...) {
+		if !strings.HasPrefix(roomId, "!") {
+			return nil, errors.New("invalid room ID: " + roomId)
+		}
+		if !util.ArrayContains(roomIds, roomId) {
+			roomIds = append(roomIds, roomId)
+		}
+	}
+
+	if len(roomIds) == 0 || util.IsGlobalAdmin(user.UserId) || user.IsShared {
+		return roomIds, nil
+	}
+	requester := restrictions.Requester{UserId: user.UserId, AccessToken: user.AccessToken}
+	for _, roomId := range roomIds {
+		joined, err := restrictions.IsJoined(rctx, requester, roomId)
+		if err != nil {
+			return nil, fmt.Errorf("unable to check membership of %s: %w", roomId, err)
+		}
+		if !joined {
+			return nil, fmt.Errorf("%w: %s", common.ErrNotJoinedToRoom, roomId)
+		}
+	}
+	return roomIds, nil
+}
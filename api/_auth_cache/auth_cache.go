@@ -7,14 +7,17 @@ import (
 	"sync"
 	"time"
 
+	"github.com/getsentry/sentry-go"
 	"github.com/patrickmn/go-cache"
 	"github.com/t2bot/matrix-media-repo/common/rcontext"
 	"github.com/t2bot/matrix-media-repo/matrix"
+	"github.com/t2bot/matrix-media-repo/notifier"
 )
 
 var tokenCache = cache.New(cache.NoExpiration, 30*time.Second)
 var rwLock = &sync.RWMutex{}
 var regexCache = make(map[string]*regexp.Regexp)
+var subscribeOnce = &sync.Once{}
 
 type cachedToken struct {
 	userId string
@@ -49,6 +52,7 @@ func InvalidateToken(ctx rcontext.RequestContext, accessToken string, appservice
 	tokenCache.Delete(cacheKey(accessToken, appserviceUserId))
 	tokenCache.Delete(cacheKey(accessToken, ""))
 	rwLock.Unlock()
+	broadcastLogout(ctx)
 	return nil
 }
 
@@ -67,9 +71,33 @@ func InvalidateAllTokens(ctx rcontext.RequestContext, accessToken string, appser
 	// It's safer to flush the whole cache instead of iterating over thousands of tokens
 	tokenCache.Flush()
 	rwLock.Unlock()
+	broadcastLogout(ctx)
 	return nil
 }
 
+// broadcastLogout tells other media repo instances to flush their access token caches. The tokens themselves aren't
+// shared with other instances, so they have to flush everything.
+func broadcastLogout(ctx rcontext.RequestContext) {
+	if err := notifier.Invalidate(ctx, notifier.Invalidation{Kind: notifier.InvalidateAccessTokens}); err != nil {
+		ctx.Log.Warn("Non-fatal error broadcasting logout: ", err)
+		sentry.CaptureException(err)
+	}
+}
+
+func subscribeToLogouts() {
+	ch := notifier.SubscribeToInvalidations()
+	if ch == nil {
+		return
+	}
+	go func() {
+		for invalidation := range ch {
+			if invalidation.Kind == notifier.InvalidateAccessTokens {
+				FlushCache()
+			}
+		}
+	}()
+}
+
 func GetUserId(ctx rcontext.RequestContext, accessToken string, appserviceUserId string) (string, error) {
 	if ctx.Request == nil {
 		ctx.Log.Warn("Tried to get user ID for access token without a valid request reference")
@@ -81,6 +109,8 @@ func GetUserId(ctx rcontext.RequestContext, accessToken string, appserviceUserId
 		return "", matrix.ErrInvalidToken
 	}
 
+	subscribeOnce.Do(subscribeToLogouts)
+
 	if ctx.Config.AccessTokens.MaxCacheTimeSeconds <= 0 {
 		ctx.Log.Warn("Access token cache is disabled for this host")
 		return checkTokenWithHomeserver(ctx, accessToken, appserviceUserId, false)
@@ -14,6 +14,14 @@ type DownloadResponse struct {
 	SizeBytes         int64
 	Data              io.ReadCloser
 	TargetDisposition string
+	ETag              string
+	LastModifiedTs    int64
+	Vary              string
+}
+
+type NotModifiedResponse struct {
+	ETag           string
+	LastModifiedTs int64
 }
 
 type StreamDataResponse struct {
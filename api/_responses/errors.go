@@ -1,6 +1,10 @@
 package _responses
 
-import "github.com/t2bot/matrix-media-repo/common"
+import (
+	"time"
+
+	"github.com/t2bot/matrix-media-repo/common"
+)
 
 type ErrorResponse struct {
 	Code         string `json:"errcode"`
@@ -24,6 +28,20 @@ func RateLimitReached() *ErrorResponse {
 	return &ErrorResponse{common.ErrCodeRateLimitExceeded, "Rate Limited", common.ErrCodeRateLimitExceeded}
 }
 
+// RateLimitedResponse is a rate limit error which tells the client when to try again. It is sent with a
+// Retry-After header.
+type RateLimitedResponse struct {
+	ErrorResponse
+	RetryAfterMs int64 `json:"retry_after_ms"`
+}
+
+func RateLimitedFor(retryAfter time.Duration) *RateLimitedResponse {
+	return &RateLimitedResponse{
+		ErrorResponse: *RateLimitReached(),
+		RetryAfterMs:  retryAfter.Milliseconds(),
+	}
+}
+
 func NotFoundError() *ErrorResponse {
 	return &ErrorResponse{common.ErrCodeNotFound, "Not found", common.ErrCodeNotFound}
 }
@@ -52,6 +70,10 @@ func BadRequest(message string) *ErrorResponse {
 	return &ErrorResponse{common.ErrCodeUnknown, message, common.ErrCodeBadRequest}
 }
 
+func Forbidden(message string) *ErrorResponse {
+	return &ErrorResponse{common.ErrCodeForbidden, message, common.ErrCodeForbidden}
+}
+
 func QuotaExceeded() *ErrorResponse {
 	return &ErrorResponse{common.ErrCodeForbidden, "Quota Exceeded", common.ErrCodeQuotaExceeded}
 }
@@ -59,3 +81,27 @@ func QuotaExceeded() *ErrorResponse {
 func NotYetUploaded() *ErrorResponse {
 	return &ErrorResponse{common.ErrCodeNotYetUploaded, "Media not yet uploaded", common.ErrCodeNotYetUploaded}
 }
+
+func MediaTooLargeToScan() *ErrorResponse {
+	return &ErrorResponse{common.ErrCodeTooLarge, "The upload is too large to be scanned for viruses", common.ErrCodeMediaTooLarge}
+}
+
+func MediaInfected() *ErrorResponse {
+	return &ErrorResponse{common.ErrCodeForbidden, "The upload was rejected because it contains a virus", common.ErrCodeForbidden}
+}
+
+func InsufficientStorage() *ErrorResponse {
+	return &ErrorResponse{common.ErrCodeResourceLimitExceeded, "The server is low on disk space and cannot accept new media", common.ErrCodeInsufficientStorage}
+}
+
+func IdempotencyKeyInUse() *ErrorResponse {
+	return &ErrorResponse{common.ErrCodeUnknown, "Another upload with this idempotency key is in progress. Retry once it has finished.", common.ErrCodeIdempotencyKeyInUse}
+}
+
+func AttestationRequired() *ErrorResponse {
+	return &ErrorResponse{common.ErrCodeForbidden, "An attestation is required for uploads this large", common.ErrCodeForbidden}
+}
+
+func InvalidAttestation() *ErrorResponse {
+	return &ErrorResponse{common.ErrCodeForbidden, "The upload attestation is invalid or has expired", common.ErrCodeForbidden}
+}
@@ -7,3 +7,10 @@ type RedirectResponse struct {
 func Redirect(url string) *RedirectResponse {
 	return &RedirectResponse{ToUrl: url}
 }
+
+// WriteTierResponse hands the request to the write tier, for download instances which can't complete it themselves.
+type WriteTierResponse struct{}
+
+func ForwardToWriteTier() *WriteTierResponse {
+	return &WriteTierResponse{}
+}
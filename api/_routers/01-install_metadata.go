@@ -3,22 +3,25 @@ package _routers
 import (
 	"context"
 	"net/http"
+	"regexp"
 	"strconv"
+	"sync/atomic"
 
 	"github.com/sirupsen/logrus"
 	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
 	"github.com/t2bot/matrix-media-repo/util"
 )
 
+// requestIdRegex limits the request IDs accepted from the X-Request-Id header to something safe to log and echo.
+var requestIdRegex = regexp.MustCompile("^[a-zA-Z0-9._:-]{1,128}$")
+
 type RequestCounter struct {
-	lastId uint64
+	lastId atomic.Uint64
 }
 
 func (c *RequestCounter) NextId() string {
-	strId := strconv.FormatUint(c.lastId, 10)
-	c.lastId = c.lastId + 1
-
-	return "REQ-" + strId
+	return "REQ-" + strconv.FormatUint(c.lastId.Add(1)-1, 10)
 }
 
 type InstallMetadataRouter struct {
@@ -38,7 +41,13 @@ func NewInstallMetadataRouter(ignoreHost bool, actionName string, counter *Reque
 }
 
 func (i *InstallMetadataRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	requestId := i.counter.NextId()
+	// Reuse the ID given by a reverse proxy (if any) so log lines can be correlated across services
+	requestId := r.Header.Get("X-Request-Id")
+	if !requestIdRegex.MatchString(requestId) {
+		requestId = i.counter.NextId()
+	}
+	w.Header().Set("X-Request-Id", requestId)
+
 	logger := logrus.WithFields(logrus.Fields{
 		"method":        r.Method,
 		"host":          r.Host,
@@ -57,6 +66,7 @@ func (i *InstallMetadataRouter) ServeHTTP(w http.ResponseWriter, r *http.Request
 	ctx = context.WithValue(ctx, common.ContextAction, i.actionName)
 	ctx = context.WithValue(ctx, common.ContextIgnoreHost, i.ignoreHost)
 	ctx = context.WithValue(ctx, common.ContextLogger, logger)
+	ctx = context.WithValue(ctx, common.ContextAccessLog, &rcontext.AccessLogEntry{})
 	r = r.WithContext(ctx)
 
 	if i.next != nil {
@@ -88,6 +98,14 @@ func GetLogger(r *http.Request) *logrus.Entry {
 	return x
 }
 
+func GetAccessLogEntry(r *http.Request) *rcontext.AccessLogEntry {
+	x, ok := r.Context().Value(common.ContextAccessLog).(*rcontext.AccessLogEntry)
+	if !ok {
+		return &rcontext.AccessLogEntry{}
+	}
+	return x
+}
+
 func GetRequestDuration(r *http.Request) float64 {
 	x, ok := r.Context().Value(common.ContextRequestStartTime).(int64)
 	if !ok {
@@ -0,0 +1,20 @@
+package _routers
+
+import (
+	"net/http"
+
+	"github.com/t2bot/matrix-media-repo/api/_responses"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+)
+
+// RequireWriteTier forwards the request to the write tier if this instance only serves downloads. This happens
+// before any other checks, as the write tier does its own.
+func RequireWriteTier(generator GeneratorFn) GeneratorFn {
+	return func(r *http.Request, ctx rcontext.RequestContext) interface{} {
+		if config.Get().Deployment.IsDownloadsOnly() {
+			return _responses.ForwardToWriteTier()
+		}
+		return generator(r, ctx)
+	}
+}
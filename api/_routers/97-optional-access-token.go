@@ -27,6 +27,7 @@ func OptionalAccessToken(generator GeneratorWithUserFn) GeneratorFn {
 		}
 		if config.Get().SharedSecret.Enabled && accessToken == config.Get().SharedSecret.Token {
 			ctx = ctx.LogWithFields(logrus.Fields{"sharedSecretAuth": true})
+			ctx.AccessLog().UserId = "@sharedsecret"
 			return generator(r, ctx, _apimeta.UserInfo{
 				UserId:      "@sharedsecret",
 				AccessToken: accessToken,
@@ -47,6 +48,7 @@ func OptionalAccessToken(generator GeneratorWithUserFn) GeneratorFn {
 		}
 
 		ctx = ctx.LogWithFields(logrus.Fields{"authUserId": userId})
+		ctx.AccessLog().UserId = userId
 		return generator(r, ctx, _apimeta.UserInfo{
 			UserId:      userId,
 			AccessToken: accessToken,
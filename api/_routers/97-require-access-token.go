@@ -30,6 +30,7 @@ func RequireAccessToken(generator GeneratorWithUserFn) GeneratorFn {
 		}
 		if config.Get().SharedSecret.Enabled && accessToken == config.Get().SharedSecret.Token {
 			ctx = ctx.LogWithFields(logrus.Fields{"sharedSecretAuth": true})
+			ctx.AccessLog().UserId = "@sharedsecret"
 			return generator(r, ctx, _apimeta.UserInfo{
 				UserId:      "@sharedsecret",
 				AccessToken: accessToken,
@@ -51,6 +52,7 @@ func RequireAccessToken(generator GeneratorWithUserFn) GeneratorFn {
 		}
 
 		ctx = ctx.LogWithFields(logrus.Fields{"authUserId": userId})
+		ctx.AccessLog().UserId = userId
 		return generator(r, ctx, _apimeta.UserInfo{
 			UserId:      userId,
 			AccessToken: accessToken,
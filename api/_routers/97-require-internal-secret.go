@@ -0,0 +1,36 @@
+package _routers
+
+import (
+	"crypto/subtle"
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-media-repo/api/_responses"
+	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+)
+
+func RequireInternalSecret(generator GeneratorFn) GeneratorFn {
+	return func(r *http.Request, ctx rcontext.RequestContext) interface{} {
+		internalConf := config.Get().InternalApi
+		if !internalConf.Enabled || internalConf.Secret == "" {
+			return _responses.NotFoundError()
+		}
+
+		secret := r.Header.Get(internalConf.HeaderName)
+		if secret == "" {
+			return &_responses.ErrorResponse{
+				Code:         common.ErrCodeMissingToken,
+				Message:      "no internal secret provided (required)",
+				InternalCode: common.ErrCodeMissingToken,
+			}
+		}
+		if subtle.ConstantTimeCompare([]byte(secret), []byte(internalConf.Secret)) != 1 {
+			return _responses.AuthFailed()
+		}
+
+		ctx = ctx.LogWithFields(logrus.Fields{"internalAuth": true})
+		return generator(r, ctx)
+	}
+}
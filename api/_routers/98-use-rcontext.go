@@ -9,15 +9,16 @@ import (
 	"io"
 	"mime"
 	"net/http"
-	"net/url"
+	"os"
 	"strconv"
 	"strings"
+	"time"
 
-	"github.com/alioygur/is"
 	"github.com/getsentry/sentry-go"
 	"github.com/t2bot/gotd-contrib/http_range"
 	"github.com/t2bot/matrix-media-repo/api/_responses"
 	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/config"
 	"github.com/t2bot/matrix-media-repo/common/rcontext"
 	"github.com/t2bot/matrix-media-repo/util"
 	"github.com/t2bot/matrix-media-repo/util/readers"
@@ -62,7 +63,15 @@ func (c *RContextRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		res = wrappedRes.Payload
 	}
 
+	// The write tier sets its own headers, so forward before setting any
+	if _, isForward := res.(*_responses.WriteTierResponse); isForward {
+		log.Infof("Replying with result: %T <%s>", res, config.Get().Deployment.WriteUrl)
+		r = forwardToWriteTier(w, r)
+		return // we're done here
+	}
+
 	headers := w.Header()
+	setSecurityHeaders(headers, rctx.Config.Downloads.SecurityHeaders)
 
 	// Check for redirection early
 	if redirect, isRedirect := res.(*_responses.RedirectResponse); isRedirect {
@@ -72,6 +81,17 @@ func (c *RContextRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return // we're done here
 	}
 
+	// Conditional requests which matched don't get a body
+	if notModified, isNotModified := res.(*_responses.NotModifiedResponse); isNotModified {
+		log.Infof("Replying with result: %T <%s>", res, notModified.ETag)
+		if shouldCache {
+			headers.Set("Cache-Control", "private, max-age=259200") // 3 days
+		}
+		setValidatorHeaders(headers, notModified.ETag, notModified.LastModifiedTs)
+		r = writeStatusCode(w, r, http.StatusNotModified)
+		return // we're done here
+	}
+
 	// Check for HTML response and reply accordingly
 	if htmlRes, isHtml := res.(*_responses.HtmlResponse); isHtml {
 		log.Infof("Replying with result: %T <%d chars of html>", res, len(htmlRes.HTML))
@@ -87,7 +107,9 @@ func (c *RContextRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		headers.Set("X-Content-Security-Policy", "")
 
 		r = writeStatusCode(w, r, http.StatusOK)
-		if _, err := w.Write([]byte(htmlRes.HTML)); err != nil {
+		written, err := w.Write([]byte(htmlRes.HTML))
+		rctx.AccessLog().BytesSent = int64(written)
+		if err != nil {
 			panic(errors.New("error sending HtmlResponse: " + err.Error()))
 		}
 		return // don't continue
@@ -97,13 +119,16 @@ func (c *RContextRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	proposedStatusCode := http.StatusOK
 	var stream io.ReadCloser
 	expectedBytes := int64(0)
+	thinProxy := false
+	headOnly := false
 	var contentType string
 beforeParseDownload:
 	log.Infof("Replying with result: %T %+v", res, res)
 	if downloadRes, isDownload := res.(*_responses.DownloadResponse); isDownload {
 		var ranges []http_range.Range
 		var err error
-		if downloadRes.SizeBytes > 0 {
+		// Range requests are only defined for GET, so HEAD requests describe the whole file
+		if downloadRes.SizeBytes > 0 && r.Method != http.MethodHead {
 			ranges, err = http_range.ParseRange(r.Header.Get("Range"), downloadRes.SizeBytes, rctx.Config.Downloads.DefaultRangeChunkSizeBytes)
 			if errors.Is(err, http_range.ErrInvalid) {
 				proposedStatusCode = http.StatusRequestedRangeNotSatisfiable
@@ -135,6 +160,10 @@ beforeParseDownload:
 		if downloadRes.SizeBytes > 0 {
 			headers.Set("Accept-Ranges", "bytes")
 		}
+		setValidatorHeaders(headers, downloadRes.ETag, downloadRes.LastModifiedTs)
+		if downloadRes.Vary != "" {
+			headers.Set("Vary", downloadRes.Vary)
+		}
 
 		disposition := downloadRes.TargetDisposition
 		if disposition == "" {
@@ -146,7 +175,7 @@ beforeParseDownload:
 				disposition = "attachment"
 			}
 		}
-		fname := downloadRes.Filename
+		fname := util.SanitizeFilename(downloadRes.Filename, rctx.Config.Downloads.MaxFilenameLength)
 		if fname == "" {
 			exts, err := mime.ExtensionsByType(contentType)
 			if err != nil {
@@ -160,16 +189,13 @@ beforeParseDownload:
 			}
 			fname = "file" + ext
 		}
-		if is.ASCII(fname) {
-			headers.Set("Content-Disposition", disposition+"; filename="+url.QueryEscape(fname))
-		} else {
-			headers.Set("Content-Disposition", disposition+"; filename*=utf-8''"+url.QueryEscape(fname))
-		}
+		headers.Set("Content-Disposition", util.ContentDisposition(disposition, fname))
 
 		stream = downloadRes.Data
+		thinProxy = rctx.Config.Downloads.ThinProxy.Enabled && rctx.Config.Downloads.ThinProxy.BufferSizeBytes > 0
 		if len(ranges) > 0 {
+			target := ranges[0] // we only use the first range (validated up above)
 			if rsc, ok := stream.(io.ReadSeekCloser); ok {
-				target := ranges[0] // we only use the first range (validated up above)
 				if _, err = rsc.Seek(target.Start, io.SeekStart); err != nil {
 					rctx.Log.Warn("Non-fatal error seeking for Range request: ", err)
 					sentry.CaptureException(err)
@@ -181,10 +207,46 @@ beforeParseDownload:
 					})
 					expectedBytes = target.Length
 				}
+			} else {
+				// The stream can't seek (remote media which is still being downloaded, for example), so skip
+				// ahead by reading. The client still only receives the range it asked for.
+				if _, err = io.CopyN(io.Discard, stream, target.Start); err != nil {
+					rctx.Log.Warn("Error skipping to start of Range request: ", err)
+					sentry.CaptureException(err)
+					_ = stream.Close()
+					stream = nil
+					headers.Del("Accept-Ranges")
+					headers.Del("Cache-Control")
+					headers.Del("Content-Disposition")
+					res = _responses.InternalServerError("Unexpected error reading media")
+					goto beforeParseDownload // reprocess `res`
+				}
+				headers.Set("Content-Range", target.ContentRange(downloadRes.SizeBytes))
+				proposedStatusCode = http.StatusPartialContent
+				original := stream
+				stream = readers.NewCancelCloser(io.NopCloser(io.LimitReader(original, target.Length)), func() {
+					_ = original.Close()
+				})
+				expectedBytes = target.Length
+			}
+		}
+
+		if r.Method == http.MethodHead {
+			// Send the headers as though we were going to stream the media, but without the body
+			if stream != nil {
+				_ = stream.Close()
+				stream = nil
 			}
+			headOnly = true
 		}
 	}
 
+	// Rate limited responses carry their own status code and retry hint
+	if limitRes, isLimited := res.(*_responses.RateLimitedResponse); isLimited {
+		proposedStatusCode = http.StatusTooManyRequests
+		headers.Set("Retry-After", strconv.FormatInt((limitRes.RetryAfterMs+999)/1000, 10))
+	}
+
 	// Try to find a suitable error code, if one is needed
 	if errRes, isError := res.(_responses.ErrorResponse); isError {
 		res = &errRes // just fix it
@@ -215,9 +277,18 @@ beforeParseDownload:
 		case common.ErrCodeCannotOverwrite:
 			proposedStatusCode = http.StatusConflict
 			break
+		case common.ErrCodeIdempotencyKeyInUse:
+			proposedStatusCode = http.StatusConflict
+			break
 		case common.ErrCodeNotYetUploaded:
 			proposedStatusCode = http.StatusGatewayTimeout
 			break
+		case common.ErrCodeInsufficientStorage:
+			proposedStatusCode = http.StatusInsufficientStorage
+			break
+		case common.ErrCodeRateLimitExceeded:
+			proposedStatusCode = http.StatusTooManyRequests
+			break
 		default: // Treat as unknown (a generic server error)
 			proposedStatusCode = http.StatusInternalServerError
 			break
@@ -225,7 +296,7 @@ beforeParseDownload:
 	}
 
 	// Prepare a stream if one isn't set, and assume JSON
-	if stream == nil {
+	if stream == nil && !headOnly {
 		contentType = "application/json"
 		b, err := json.Marshal(res)
 		if err != nil {
@@ -253,9 +324,36 @@ beforeParseDownload:
 	}
 
 	r = writeStatusCode(w, r, proposedStatusCode)
+	if headOnly {
+		return // nothing more to send
+	}
 
 	defer stream.Close()
-	written, err := io.Copy(w, stream)
+	var dst io.Writer = w
+	slowClients := rctx.Config.Downloads.SlowClients
+	if slowClients.WriteTimeoutSeconds > 0 || slowClients.MinBytesPerSecond > 0 {
+		scw := newSlowClientWriter(w, slowClients)
+		defer scw.Close()
+		dst = scw
+	}
+	// Stop reading as soon as the client goes away, so the deferred close can abort the datastore's download
+	src := readers.NewContextReader(r.Context(), stream)
+	var written int64
+	if thinProxy {
+		written, err = readers.CopyWithBackpressure(dst, src, rctx.Config.Downloads.ThinProxy.BufferSizeBytes)
+	} else {
+		written, err = io.Copy(dst, src)
+	}
+	rctx.AccessLog().BytesSent = written
+	if errors.Is(err, errClientTooSlow) || errors.Is(err, os.ErrDeadlineExceeded) {
+		// Abort the response so the connection is closed rather than left waiting on the client
+		rctx.Log.Infof("Disconnecting slow client after %d bytes: %s", written, err)
+		panic(http.ErrAbortHandler)
+	}
+	if err != nil && r.Context().Err() != nil {
+		rctx.Log.Debugf("Client disconnected after %d bytes: %s", written, err)
+		return
+	}
 	if err != nil {
 		panic(err) // blow up this request
 	}
@@ -264,6 +362,15 @@ beforeParseDownload:
 	}
 }
 
+func setValidatorHeaders(headers http.Header, etag string, lastModifiedTs int64) {
+	if etag != "" {
+		headers.Set("ETag", etag)
+	}
+	if lastModifiedTs > 0 {
+		headers.Set("Last-Modified", time.UnixMilli(lastModifiedTs).UTC().Format(http.TimeFormat))
+	}
+}
+
 func GetStatusCode(r *http.Request) int {
 	x, ok := r.Context().Value(common.ContextStatusCode).(int)
 	if !ok {
@@ -274,5 +381,9 @@ func GetStatusCode(r *http.Request) int {
 
 func writeStatusCode(w http.ResponseWriter, r *http.Request, statusCode int) *http.Request {
 	w.WriteHeader(statusCode)
+	return withStatusCode(r, statusCode)
+}
+
+func withStatusCode(r *http.Request, statusCode int) *http.Request {
 	return r.WithContext(context.WithValue(r.Context(), common.ContextStatusCode, statusCode))
 }
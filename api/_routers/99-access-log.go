@@ -0,0 +1,50 @@
+package _routers
+
+import (
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/logging"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+type AccessLogRouter struct {
+	next http.Handler
+}
+
+func NewAccessLogRouter(next http.Handler) *AccessLogRouter {
+	return &AccessLogRouter{next: next}
+}
+
+func (a *AccessLogRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if logger := logging.AccessLog(); logger != nil {
+		entry := GetAccessLogEntry(r)
+		mxc := entry.MxcUri
+		if mxc == "" {
+			if server, mediaId := GetParam("server", r), GetParam("mediaId", r); server != "" && mediaId != "" {
+				mxc = util.MxcUri(server, mediaId)
+			}
+		}
+		requestId, _ := r.Context().Value(common.ContextRequestId).(string)
+		logger.WithFields(logrus.Fields{
+			"requestId":  requestId,
+			"method":     r.Method,
+			"host":       r.Host,
+			"path":       r.URL.Path,
+			"action":     GetActionName(r),
+			"mxc":        mxc,
+			"userId":     entry.UserId,
+			"status":     GetStatusCode(r),
+			"bytesSent":  entry.BytesSent,
+			"durationMs": int64(GetRequestDuration(r) * 1000),
+			"cacheHit":   entry.CacheHit,
+			"remoteAddr": r.RemoteAddr,
+			"userAgent":  r.UserAgent(),
+		}).Info("request")
+	}
+
+	if a.next != nil {
+		a.next.ServeHTTP(w, r)
+	}
+}
@@ -0,0 +1,25 @@
+package _routers
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/t2bot/matrix-media-repo/common/config"
+)
+
+// setSecurityHeaders applies the domain's configured security headers. Headers configured as empty strings are
+// not sent.
+func setSecurityHeaders(headers http.Header, cfg config.SecurityHeadersConfig) {
+	if cfg.ContentSecurityPolicy != "" {
+		headers.Set("Content-Security-Policy", cfg.ContentSecurityPolicy)
+		if strings.Contains(cfg.ContentSecurityPolicy, "sandbox") {
+			headers.Set("X-Content-Security-Policy", "sandbox;") // for older browsers
+		}
+	}
+	if cfg.ContentTypeOptions != "" {
+		headers.Set("X-Content-Type-Options", cfg.ContentTypeOptions)
+	}
+	if cfg.CrossOriginResourcePolicy != "" {
+		headers.Set("Cross-Origin-Resource-Policy", cfg.CrossOriginResourcePolicy)
+	}
+}
@@ -0,0 +1,69 @@
+package _routers
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/t2bot/matrix-media-repo/common/config"
+)
+
+var errClientTooSlow = errors.New("client is downloading too slowly")
+
+// slowClientWriter enforces a per-write timeout and a minimum average throughput on a response. Throughput is measured
+// over the time spent blocked writing to the client only, so a slow datastore doesn't count against the client. It
+// implements http.Flusher so it can be used for streamed responses.
+type slowClientWriter struct {
+	w            http.ResponseWriter
+	rc           *http.ResponseController
+	writeTimeout time.Duration
+	minBps       int64
+	grace        time.Duration
+	blocked      time.Duration
+	written      int64
+}
+
+func newSlowClientWriter(w http.ResponseWriter, conf config.SlowClientsConfig) *slowClientWriter {
+	return &slowClientWriter{
+		w:            w,
+		rc:           http.NewResponseController(w),
+		writeTimeout: time.Duration(conf.WriteTimeoutSeconds) * time.Second,
+		minBps:       conf.MinBytesPerSecond,
+		grace:        time.Duration(conf.GraceSeconds) * time.Second,
+	}
+}
+
+func (s *slowClientWriter) Write(p []byte) (int, error) {
+	if s.writeTimeout > 0 {
+		if err := s.rc.SetWriteDeadline(time.Now().Add(s.writeTimeout)); err != nil && !errors.Is(err, http.ErrNotSupported) {
+			return 0, err
+		}
+	}
+	start := time.Now()
+	n, err := s.w.Write(p)
+	s.blocked += time.Since(start)
+	s.written += int64(n)
+	if err != nil {
+		return n, err
+	}
+	if s.minBps > 0 {
+		if s.blocked > s.grace && float64(s.written)/s.blocked.Seconds() < float64(s.minBps) {
+			return n, errClientTooSlow
+		}
+	}
+	return n, nil
+}
+
+func (s *slowClientWriter) Flush() {
+	_ = s.rc.Flush()
+}
+
+// Close removes the write deadline so it doesn't affect later requests on the same connection.
+func (s *slowClientWriter) Close() error {
+	if s.writeTimeout > 0 {
+		if err := s.rc.SetWriteDeadline(time.Time{}); err != nil && !errors.Is(err, http.ErrNotSupported) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package _routers
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sync"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/t2bot/matrix-media-repo/common/config"
+)
+
+var writeTierLock = &sync.Mutex{}
+var writeTierUrl string
+var writeTierProxy *httputil.ReverseProxy
+
+func getWriteTierProxy() (*httputil.ReverseProxy, error) {
+	writeTierLock.Lock()
+	defer writeTierLock.Unlock()
+
+	rawUrl := config.Get().Deployment.WriteUrl
+	if writeTierProxy != nil && writeTierUrl == rawUrl {
+		return writeTierProxy, nil
+	}
+	if rawUrl == "" {
+		return nil, errors.New("no write tier is configured")
+	}
+	target, err := url.Parse(rawUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	director := proxy.Director
+	proxy.Director = func(r *http.Request) {
+		// Handlers may have rewritten the query string (federation downloads, for example), but the write tier needs
+		// the original to verify request signatures.
+		if original, err := url.ParseRequestURI(r.RequestURI); err == nil {
+			r.URL.Path = original.Path
+			r.URL.RawPath = original.RawPath
+			r.URL.RawQuery = original.RawQuery
+		}
+		host := r.Host
+		director(r)
+		r.Host = host // the write tier picks the domain config from the Host header too
+	}
+	writeTierUrl = rawUrl
+	writeTierProxy = proxy
+	return proxy, nil
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	statusCode int
+}
+
+func (s *statusRecorder) WriteHeader(statusCode int) {
+	s.statusCode = statusCode
+	s.ResponseWriter.WriteHeader(statusCode)
+}
+
+// forwardToWriteTier proxies the request to the write tier, returning the request with the status code the write tier
+// replied with.
+func forwardToWriteTier(w http.ResponseWriter, r *http.Request) *http.Request {
+	proxy, err := getWriteTierProxy()
+	if err != nil {
+		GetLogger(r).Error("Unable to forward request to the write tier: ", err)
+		sentry.CaptureException(err)
+		return writeStatusCode(w, r, http.StatusBadGateway)
+	}
+	recorder := &statusRecorder{ResponseWriter: w, statusCode: http.StatusOK}
+	proxy.ServeHTTP(recorder, r)
+	return withStatusCode(r, recorder.statusCode)
+}
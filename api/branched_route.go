@@ -33,7 +33,7 @@ func branchedRoute(branches []branch) http.Handler {
 		params := strings.Split(catchAll, "/")
 		for _, b := range sbranches {
 			if b.segments[0][0] == ':' || b.segments[0] == params[0] {
-				if len(b.segments) != len(params) {
+				if len(b.segments) != len(params) || !staticSegmentsMatch(b.segments, params) {
 					continue
 				}
 				for i, s := range b.segments {
@@ -48,3 +48,12 @@ func branchedRoute(branches []branch) http.Handler {
 		notFoundFn(w, r)
 	})
 }
+
+func staticSegmentsMatch(segments []string, params []string) bool {
+	for i, s := range segments {
+		if s[0] != ':' && s != params[i] {
+			return false
+		}
+	}
+	return true
+}
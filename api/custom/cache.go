@@ -0,0 +1,162 @@
+package custom
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-media-repo/api/_apimeta"
+	"github.com/t2bot/matrix-media-repo/api/_responses"
+	"github.com/t2bot/matrix-media-repo/api/_routers"
+	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/redislib"
+	"github.com/t2bot/matrix-media-repo/tasks/task_runner"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+type CachedMediaEntry struct {
+	Sha256Hash string   `json:"sha256_hash"`
+	SizeBytes  int64    `json:"size_bytes"`
+	AgeSeconds int64    `json:"age_seconds"`
+	MxcUris    []string `json:"mxc_uris"`
+}
+
+type CachedMediaResponse struct {
+	Enabled bool                `json:"enabled"`
+	Entries []*CachedMediaEntry `json:"entries"`
+}
+
+func ListCachedMedia(r *http.Request, rctx rcontext.RequestContext, user _apimeta.UserInfo) interface{} {
+	limit := 1000
+	if qs := r.URL.Query(); len(qs["limit"]) > 0 {
+		val, err := strconv.Atoi(qs.Get("limit"))
+		if err != nil || val <= 0 {
+			return _responses.BadRequest("Query parameter 'limit' must be a positive integer")
+		}
+		limit = val
+	}
+
+	response := &CachedMediaResponse{
+		Enabled: config.Get().Redis.Enabled,
+		Entries: make([]*CachedMediaEntry, 0),
+	}
+
+	cached, err := redislib.ListMedia(rctx, limit)
+	if err != nil {
+		rctx.Log.Error("Error listing cached media: ", err)
+		sentry.CaptureException(err)
+		return _responses.InternalServerError("failed to list cached media")
+	}
+
+	mediaDb := database.GetInstance().Media.Prepare(rctx)
+	for _, c := range cached {
+		records, err := mediaDb.GetByHash(c.Sha256Hash)
+		if err != nil {
+			rctx.Log.Error("Error getting media for cached hash: ", err)
+			sentry.CaptureException(err)
+			return _responses.InternalServerError("failed to get media records")
+		}
+		entry := &CachedMediaEntry{
+			Sha256Hash: c.Sha256Hash,
+			SizeBytes:  c.SizeBytes,
+			AgeSeconds: c.AgeSeconds,
+			MxcUris:    make([]string, 0, len(records)),
+		}
+		for _, m := range records {
+			entry.MxcUris = append(entry.MxcUris, util.MxcUri(m.Origin, m.MediaId))
+		}
+		response.Entries = append(response.Entries, entry)
+	}
+
+	return &_responses.DoNotCacheResponse{Payload: response}
+}
+
+func EvictCachedMedia(r *http.Request, rctx rcontext.RequestContext, user _apimeta.UserInfo) interface{} {
+	origin := _routers.GetParam("server", r)
+	mediaId := _routers.GetParam("mediaId", r)
+
+	if !_routers.ServerNameRegex.MatchString(origin) {
+		return _responses.BadRequest("invalid origin")
+	}
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"origin":  origin,
+		"mediaId": mediaId,
+	})
+
+	media, err := database.GetInstance().Media.Prepare(rctx).GetById(origin, mediaId)
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return _responses.InternalServerError("failed to get media record")
+	}
+	if media == nil {
+		return _responses.NotFoundError()
+	}
+
+	// The cache is keyed by hash, so this also evicts any other media with the same content
+	if err = redislib.DeleteMedia(rctx, media.Sha256Hash); err != nil {
+		rctx.Log.Error("Error evicting cached media: ", err)
+		sentry.CaptureException(err)
+		return _responses.InternalServerError("failed to evict media from the cache")
+	}
+
+	return &_responses.DoNotCacheResponse{Payload: map[string]interface{}{"sha256_hash": media.Sha256Hash}}
+}
+
+func RefreshRemoteMedia(r *http.Request, rctx rcontext.RequestContext, user _apimeta.UserInfo) interface{} {
+	origin := _routers.GetParam("server", r)
+	mediaId := _routers.GetParam("mediaId", r)
+
+	if !_routers.ServerNameRegex.MatchString(origin) {
+		return _responses.BadRequest("invalid origin")
+	}
+	if util.IsServerOurs(origin) {
+		return _responses.BadRequest("local media cannot be refreshed")
+	}
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"origin":  origin,
+		"mediaId": mediaId,
+	})
+
+	media, err := database.GetInstance().Media.Prepare(rctx).GetById(origin, mediaId)
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return _responses.InternalServerError("failed to get media record")
+	}
+	if media == nil {
+		return _responses.NotFoundError()
+	}
+	if media.Quarantined {
+		return _responses.BadRequest("quarantined media cannot be refreshed")
+	}
+
+	refreshed, err := task_runner.RefreshRemoteMedia(rctx, media)
+	if err != nil {
+		if errors.Is(err, common.ErrMediaNotFound) {
+			return _responses.NotFoundError()
+		} else if errors.Is(err, common.ErrOriginUnavailable) {
+			return _responses.BadGatewayError("remote server is unavailable")
+		} else if errors.Is(err, common.ErrMediaQuarantined) {
+			return _responses.BadRequest("the refreshed media was quarantined")
+		}
+		rctx.Log.Error("Error refreshing media: ", err)
+		sentry.CaptureException(err)
+		return _responses.BadGatewayError("failed to refresh media from the remote server")
+	}
+
+	return &_responses.DoNotCacheResponse{Payload: map[string]interface{}{
+		"previous_sha256_hash": media.Sha256Hash,
+		"sha256_hash":          refreshed.Sha256Hash,
+		"size_bytes":           refreshed.SizeBytes,
+		"content_type":         refreshed.ContentType,
+		"changed":              media.Sha256Hash != refreshed.Sha256Hash,
+	}}
+}
@@ -0,0 +1,22 @@
+package custom
+
+import (
+	"net/http"
+
+	"github.com/t2bot/matrix-media-repo/api/_apimeta"
+	"github.com/t2bot/matrix-media-repo/api/_responses"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+)
+
+type ConfigReloadResponse struct {
+	Reloaded bool `json:"reloaded"`
+}
+
+func ReloadConfig(r *http.Request, rctx rcontext.RequestContext, user _apimeta.UserInfo) interface{} {
+	rctx.Log.Info("Config reload requested by ", user.UserId)
+	if err := config.Reload(); err != nil {
+		return _responses.InternalServerError("failed to reload config")
+	}
+	return &_responses.DoNotCacheResponse{Payload: &ConfigReloadResponse{Reloaded: true}}
+}
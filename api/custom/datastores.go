@@ -6,8 +6,10 @@ import (
 	"github.com/t2bot/matrix-media-repo/api/_responses"
 	"github.com/t2bot/matrix-media-repo/api/_routers"
 	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/database"
 	"github.com/t2bot/matrix-media-repo/datastores"
 	"github.com/t2bot/matrix-media-repo/tasks"
+	"github.com/t2bot/matrix-media-repo/tasks/task_runner"
 
 	"net/http"
 	"strconv"
@@ -40,6 +42,25 @@ func GetDatastores(r *http.Request, rctx rcontext.RequestContext, user _apimeta.
 	return &_responses.DoNotCacheResponse{Payload: response}
 }
 
+func GetDatastoreHealth(r *http.Request, rctx rcontext.RequestContext, user _apimeta.UserInfo) interface{} {
+	datastoreId := _routers.GetParam("datastoreId", r)
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"datastoreId": datastoreId,
+	})
+
+	ds, ok := datastores.Get(rctx, datastoreId)
+	if !ok {
+		return _responses.NotFoundError()
+	}
+
+	status := datastores.CheckHealth(rctx, ds)
+	if !status.Healthy {
+		rctx.Log.Warn("Datastore health check failed: ", status.Error)
+	}
+	return &_responses.DoNotCacheResponse{Payload: status}
+}
+
 func MigrateBetweenDatastores(r *http.Request, rctx rcontext.RequestContext, user _apimeta.UserInfo) interface{} {
 	beforeTsStr := r.URL.Query().Get("before_ts")
 	beforeTs := util.NowMillis()
@@ -51,26 +72,46 @@ func MigrateBetweenDatastores(r *http.Request, rctx rcontext.RequestContext, use
 		}
 	}
 
-	sourceDsId := _routers.GetParam("sourceDsId", r)
-	targetDsId := _routers.GetParam("targetDsId", r)
+	params := task_runner.DatastoreMigrateParams{
+		SourceDsId: _routers.GetParam("sourceDsId", r),
+		TargetDsId: _routers.GetParam("targetDsId", r),
+		BeforeTs:   beforeTs,
+		UserId:     r.URL.Query().Get("user_id"),
+	}
+	for name, target := range map[string]*int64{
+		"min_size_bytes":       &params.MinSizeBytes,
+		"max_size_bytes":       &params.MaxSizeBytes,
+		"max_bytes_per_second": &params.MaxBytesPerSecond,
+	} {
+		if val := r.URL.Query().Get(name); val != "" {
+			if *target, err = strconv.ParseInt(val, 10, 64); err != nil || *target < 0 {
+				return _responses.BadRequest("Error parsing " + name)
+			}
+		}
+	}
 
 	rctx = rctx.LogWithFields(logrus.Fields{
 		"beforeTs":   beforeTs,
-		"sourceDsId": sourceDsId,
-		"targetDsId": targetDsId,
+		"sourceDsId": params.SourceDsId,
+		"targetDsId": params.TargetDsId,
+		"userId":     params.UserId,
 	})
 
-	if sourceDsId == targetDsId {
+	if params.SourceDsId == params.TargetDsId {
 		return _responses.BadRequest("Source and target datastore cannot be the same")
 	}
-	if _, ok := datastores.Get(rctx, sourceDsId); !ok {
+	if _, ok := datastores.Get(rctx, params.SourceDsId); !ok {
 		return _responses.BadRequest("Source datastore does not appear to exist")
 	}
-	if _, ok := datastores.Get(rctx, targetDsId); !ok {
+	if _, ok := datastores.Get(rctx, params.TargetDsId); !ok {
 		return _responses.BadRequest("Target datastore does not appear to exist")
 	}
 
-	estimate, err := datastores.SizeOfDsIdWithAge(rctx, sourceDsId, beforeTs)
+	estimate, err := datastores.SizeOfDsIdWithFilter(rctx, params.SourceDsId, beforeTs, database.DatastoreObjectFilter{
+		UserId:       params.UserId,
+		MinSizeBytes: params.MinSizeBytes,
+		MaxSizeBytes: params.MaxSizeBytes,
+	})
 	if err != nil {
 		rctx.Log.Error(err)
 		sentry.CaptureException(err)
@@ -78,7 +119,7 @@ func MigrateBetweenDatastores(r *http.Request, rctx rcontext.RequestContext, use
 	}
 
 	rctx.Log.Infof("User %s has started a datastore media transfer", user.UserId)
-	task, err := tasks.RunDatastoreMigration(rctx, sourceDsId, targetDsId, beforeTs)
+	task, err := tasks.RunDatastoreMigration(rctx, params)
 	if err != nil {
 		rctx.Log.Error(err)
 		sentry.CaptureException(err)
@@ -119,3 +160,51 @@ func GetDatastoreStorageEstimate(r *http.Request, rctx rcontext.RequestContext,
 	}
 	return &_responses.DoNotCacheResponse{Payload: result}
 }
+
+type MediaLocation struct {
+	DatastoreId string `json:"datastore_id"`
+	Location    string `json:"location"`
+	DirectUrl   string `json:"direct_url,omitempty"`
+	PublicUrl   string `json:"public_url,omitempty"`
+}
+
+func GetMediaLocation(r *http.Request, rctx rcontext.RequestContext, user _apimeta.UserInfo) interface{} {
+	origin := _routers.GetParam("server", r)
+	mediaId := _routers.GetParam("mediaId", r)
+
+	if !_routers.ServerNameRegex.MatchString(origin) {
+		return _responses.BadRequest("invalid origin")
+	}
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"origin":  origin,
+		"mediaId": mediaId,
+	})
+
+	media, err := database.GetInstance().Media.Prepare(rctx).GetById(origin, mediaId)
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return _responses.InternalServerError("failed to get media record")
+	}
+	if media == nil {
+		return _responses.NotFoundError()
+	}
+
+	response := &MediaLocation{
+		DatastoreId: media.DatastoreId,
+		Location:    media.Location,
+	}
+	if ds, ok := datastores.Get(rctx, media.DatastoreId); ok {
+		if response.DirectUrl, err = datastores.BuildS3Url(ds, media.Location, datastores.S3UrlDirect); err == nil {
+			response.PublicUrl, err = datastores.BuildS3Url(ds, media.Location, datastores.S3UrlPublic)
+		}
+		if err != nil {
+			rctx.Log.Error(err)
+			sentry.CaptureException(err)
+			return _responses.InternalServerError("failed to build media URL")
+		}
+	}
+
+	return &_responses.DoNotCacheResponse{Payload: response}
+}
@@ -2,13 +2,16 @@ package custom
 
 import (
 	"bytes"
+	"io"
 	"net/http"
+	"sort"
 	"strconv"
 
 	"github.com/getsentry/sentry-go"
 	"github.com/t2bot/matrix-media-repo/api/_apimeta"
 	"github.com/t2bot/matrix-media-repo/api/_responses"
 	"github.com/t2bot/matrix-media-repo/api/_routers"
+	"github.com/t2bot/matrix-media-repo/archival/v2archive"
 	"github.com/t2bot/matrix-media-repo/database"
 	"github.com/t2bot/matrix-media-repo/datastores"
 	"github.com/t2bot/matrix-media-repo/tasks"
@@ -72,6 +75,66 @@ func ExportUserData(r *http.Request, rctx rcontext.RequestContext, user _apimeta
 	}}
 }
 
+// ExportRoomData starts an export of the media referenced by a room.
+func ExportRoomData(r *http.Request, rctx rcontext.RequestContext, user _apimeta.UserInfo) interface{} {
+	if !rctx.Config.Archiving.Enabled {
+		return _responses.BadRequest("archiving is not enabled")
+	}
+
+	s3urls := r.URL.Query().Get("s3_urls") != "false"
+
+	roomId := _routers.GetParam("roomId", r)
+	if roomId == "" || roomId[0] != '!' {
+		return _responses.BadRequest("invalid room ID")
+	}
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"exportRoomId": roomId,
+		"s3urls":       s3urls,
+	})
+	task, exportId, err := tasks.RunRoomExport(rctx, roomId, s3urls)
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return _responses.InternalServerError("fatal error starting export")
+	}
+
+	return &_responses.DoNotCacheResponse{Payload: &ExportStarted{
+		TaskID:   task.TaskId,
+		ExportID: exportId,
+	}}
+}
+
+// ExportOwnData starts an export of the requesting user's own media.
+func ExportOwnData(r *http.Request, rctx rcontext.RequestContext, user _apimeta.UserInfo) interface{} {
+	if !rctx.Config.Archiving.Enabled {
+		return _responses.BadRequest("archiving is not enabled")
+	}
+
+	isAdmin := util.IsGlobalAdmin(user.UserId) || user.IsShared
+	if !rctx.Config.Archiving.SelfService && !isAdmin {
+		return _responses.AuthFailed()
+	}
+
+	s3urls := r.URL.Query().Get("s3_urls") != "false"
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"exportUserId": user.UserId,
+		"s3urls":       s3urls,
+	})
+	task, exportId, err := tasks.RunUserExport(rctx, user.UserId, s3urls)
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return _responses.InternalServerError("fatal error starting export")
+	}
+
+	return &_responses.DoNotCacheResponse{Payload: &ExportStarted{
+		TaskID:   task.TaskId,
+		ExportID: exportId,
+	}}
+}
+
 func ExportServerData(r *http.Request, rctx rcontext.RequestContext, user _apimeta.UserInfo) interface{} {
 	if !rctx.Config.Archiving.Enabled {
 		return _responses.BadRequest("archiving is not enabled")
@@ -292,6 +355,65 @@ func DownloadExportPart(r *http.Request, rctx rcontext.RequestContext, user _api
 	}
 }
 
+// DownloadExport streams every part of an export as a single tar (gzipped) or zip archive.
+func DownloadExport(r *http.Request, rctx rcontext.RequestContext, user _apimeta.UserInfo) interface{} {
+	if !rctx.Config.Archiving.Enabled {
+		return _responses.BadRequest("archiving is not enabled")
+	}
+
+	exportId := _routers.GetParam("exportId", r)
+
+	if !_routers.ServerNameRegex.MatchString(exportId) {
+		return _responses.BadRequest("invalid export ID")
+	}
+
+	format := v2archive.CombinedTarGz
+	if f := r.URL.Query().Get("format"); f != "" {
+		format = v2archive.CombinedFormat(f)
+		if format != v2archive.CombinedTarGz && format != v2archive.CombinedZip {
+			return _responses.BadRequest("format must be tar or zip")
+		}
+	}
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"exportId": exportId,
+		"format":   format,
+	})
+
+	partsDb := database.GetInstance().ExportParts.Prepare(rctx)
+	parts, err := partsDb.GetForExport(exportId)
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return _responses.InternalServerError("failed to get export parts")
+	}
+	if len(parts) == 0 {
+		return _responses.NotFoundError()
+	}
+	sort.Slice(parts, func(i int, j int) bool {
+		return parts[i].PartNum < parts[j].PartNum
+	})
+
+	pr, pw := io.Pipe()
+	go func() {
+		if err := v2archive.WriteCombined(rctx, parts, format, pw); err != nil {
+			rctx.Log.Error("Error writing combined export: ", err)
+			sentry.CaptureException(err)
+			_ = pw.CloseWithError(err)
+		} else {
+			_ = pw.Close()
+		}
+	}()
+
+	return &_responses.DownloadResponse{
+		ContentType:       format.ContentType(),
+		SizeBytes:         0,
+		Data:              pr,
+		Filename:          "export-" + exportId + format.Extension(),
+		TargetDisposition: "attachment",
+	}
+}
+
 func DeleteExport(r *http.Request, rctx rcontext.RequestContext, user _apimeta.UserInfo) interface{} {
 	if !rctx.Config.Archiving.Enabled {
 		return _responses.BadRequest("archiving is not enabled")
@@ -1,6 +1,7 @@
 package custom
 
 import (
+	"encoding/json"
 	"errors"
 	"net/http"
 
@@ -11,6 +12,7 @@ import (
 	"github.com/t2bot/matrix-media-repo/common"
 	"github.com/t2bot/matrix-media-repo/tasks"
 	"github.com/t2bot/matrix-media-repo/tasks/task_runner"
+	"github.com/t2bot/matrix-media-repo/util"
 	"github.com/t2bot/matrix-media-repo/util/ids"
 
 	"github.com/t2bot/matrix-media-repo/common/rcontext"
@@ -102,3 +104,38 @@ func StopImport(r *http.Request, rctx rcontext.RequestContext, user _apimeta.Use
 
 	return &_responses.DoNotCacheResponse{Payload: &_responses.EmptyResponse{}}
 }
+
+type SynapseImportStarted struct {
+	TaskID int `json:"task_id"`
+}
+
+func StartSynapseImport(r *http.Request, rctx rcontext.RequestContext, user _apimeta.UserInfo) interface{} {
+	defer r.Body.Close()
+	params := task_runner.ImportSynapseMediaStoreParams{}
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&params); err != nil {
+		return _responses.BadRequest("failed to read import parameters")
+	}
+
+	if params.ServerName == "" || params.MediaStorePath == "" {
+		return _responses.BadRequest("server_name and media_store_path are required")
+	}
+	if !util.IsServerOurs(params.ServerName) {
+		return _responses.BadRequest("server_name is not configured in the media repo")
+	}
+	if ids.GetMachineId() != tasks.ExecutingMachineId {
+		return _responses.BadRequest("media store import can only be done on the background tasks worker")
+	}
+
+	rctx.Log.Infof("User %s has started an import of the Synapse media store at %s", user.UserId, params.MediaStorePath)
+	task, err := tasks.RunSynapseMediaStoreImport(rctx, params)
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return _responses.InternalServerError("fatal error starting import")
+	}
+
+	return &_responses.DoNotCacheResponse{Payload: &SynapseImportStarted{
+		TaskID: task.TaskId,
+	}}
+}
@@ -12,6 +12,7 @@ import (
 	"github.com/t2bot/matrix-media-repo/common/rcontext"
 	"github.com/t2bot/matrix-media-repo/database"
 	"github.com/t2bot/matrix-media-repo/matrix"
+	"github.com/t2bot/matrix-media-repo/pipelines/_steps/download"
 	"github.com/t2bot/matrix-media-repo/util"
 )
 
@@ -123,6 +124,7 @@ func SetAttributes(r *http.Request, rctx rcontext.RequestContext, user _apimeta.
 			sentry.CaptureException(err)
 			return _responses.InternalServerError("failed to update attributes: purpose")
 		}
+		download.InvalidateMedia(rctx, origin, mediaId, "")
 	}
 
 	return &_responses.DoNotCacheResponse{Payload: newAttrs}
@@ -0,0 +1,83 @@
+package custom
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-media-repo/api/_responses"
+	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/restrictions"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+type MembershipChangedRequest struct {
+	RoomId string `json:"room_id"`
+	UserId string `json:"user_id"`
+}
+
+type appserviceTransaction struct {
+	Events []struct {
+		Type     string  `json:"type"`
+		RoomId   string  `json:"room_id"`
+		StateKey *string `json:"state_key"`
+	} `json:"events"`
+}
+
+// HandleMembershipChanged drops cached memberships for the user (or the whole room, if no user is given), so the
+// next download checks with the homeserver again.
+func HandleMembershipChanged(r *http.Request, rctx rcontext.RequestContext) interface{} {
+	params := &MembershipChangedRequest{}
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&params); err != nil {
+		return _responses.BadRequest("invalid request")
+	}
+	if params.RoomId == "" {
+		return _responses.BadRequest("missing room_id")
+	}
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"roomId": params.RoomId,
+		"userId": params.UserId,
+	})
+	restrictions.InvalidateMembership(rctx, params.RoomId, params.UserId)
+
+	return &_responses.DoNotCacheResponse{Payload: &_responses.EmptyResponse{}}
+}
+
+// HandleAppserviceTransaction receives events from the homeserver when the media repo is registered as an appservice,
+// and drops cached memberships for users whose membership changed.
+func HandleAppserviceTransaction(r *http.Request, rctx rcontext.RequestContext) interface{} {
+	hsToken := rctx.Config.Downloads.RoomAccess.AppserviceHsToken
+	if hsToken == "" {
+		return _responses.NotFoundError()
+	}
+	token := util.GetAccessTokenFromRequest(r)
+	if token == "" {
+		return &_responses.ErrorResponse{
+			Code:         common.ErrCodeMissingToken,
+			Message:      "no token provided (required)",
+			InternalCode: common.ErrCodeMissingToken,
+		}
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(hsToken)) != 1 {
+		return _responses.AuthFailed()
+	}
+
+	txn := &appserviceTransaction{}
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&txn); err != nil {
+		return _responses.BadRequest("invalid transaction")
+	}
+
+	for _, ev := range txn.Events {
+		if ev.Type != "m.room.member" || ev.StateKey == nil || ev.RoomId == "" {
+			continue
+		}
+		restrictions.InvalidateMembership(rctx, ev.RoomId, *ev.StateKey)
+	}
+
+	return &_responses.DoNotCacheResponse{Payload: &_responses.EmptyResponse{}}
+}
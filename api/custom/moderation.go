@@ -0,0 +1,95 @@
+package custom
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-media-repo/api/_apimeta"
+	"github.com/t2bot/matrix-media-repo/api/_responses"
+	"github.com/t2bot/matrix-media-repo/api/_routers"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+type ModerationDecision struct {
+	MxcUri     string `json:"mxc"`
+	Sha256Hash string `json:"sha256"`
+	Policy     string `json:"policy"`
+	Action     string `json:"action"`
+	Reason     string `json:"reason"`
+	Attempts   int    `json:"attempts"`
+	DecidedTs  int64  `json:"decided_ts"`
+}
+
+type ModerationDecisionsResponse struct {
+	Decisions []*ModerationDecision `json:"decisions"`
+}
+
+func GetMediaModerationDecisions(r *http.Request, rctx rcontext.RequestContext, user _apimeta.UserInfo) interface{} {
+	server := _routers.GetParam("server", r)
+	mediaId := _routers.GetParam("mediaId", r)
+
+	if !_routers.ServerNameRegex.MatchString(server) {
+		return _responses.BadRequest("invalid server ID")
+	}
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"server":  server,
+		"mediaId": mediaId,
+	})
+
+	records, err := database.GetInstance().ModerationLog.Prepare(rctx).GetForMedia(server, mediaId)
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return _responses.InternalServerError("failed to get moderation decisions")
+	}
+	return &_responses.DoNotCacheResponse{Payload: toModerationDecisionsResponse(records)}
+}
+
+func ListModerationDecisions(r *http.Request, rctx rcontext.RequestContext, user _apimeta.UserInfo) interface{} {
+	limit := 1000
+	sinceTs := int64(0)
+	qs := r.URL.Query()
+	if len(qs["limit"]) > 0 {
+		val, err := strconv.Atoi(qs.Get("limit"))
+		if err != nil || val <= 0 {
+			return _responses.BadRequest("Query parameter 'limit' must be a positive integer")
+		}
+		limit = val
+	}
+	if len(qs["since_ts"]) > 0 {
+		val, err := strconv.ParseInt(qs.Get("since_ts"), 10, 64)
+		if err != nil || val < 0 {
+			return _responses.BadRequest("Query parameter 'since_ts' must be a timestamp")
+		}
+		sinceTs = val
+	}
+
+	records, err := database.GetInstance().ModerationLog.Prepare(rctx).GetSince(sinceTs, limit)
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return _responses.InternalServerError("failed to get moderation decisions")
+	}
+	return &_responses.DoNotCacheResponse{Payload: toModerationDecisionsResponse(records)}
+}
+
+func toModerationDecisionsResponse(records []*database.DbModerationDecision) *ModerationDecisionsResponse {
+	decisions := make([]*ModerationDecision, 0, len(records))
+	for _, record := range records {
+		decisions = append(decisions, &ModerationDecision{
+			MxcUri:     util.MxcUri(record.Origin, record.MediaId),
+			Sha256Hash: record.Sha256Hash,
+			Policy:     record.Policy,
+			Action:     record.Action,
+			Reason:     record.Reason,
+			Attempts:   record.Attempts,
+			DecidedTs:  record.DecidedTs,
+		})
+	}
+	return &ModerationDecisionsResponse{Decisions: decisions}
+}
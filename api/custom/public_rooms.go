@@ -0,0 +1,114 @@
+package custom
+
+import (
+	"net/http"
+	"slices"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-media-repo/api/_apimeta"
+	"github.com/t2bot/matrix-media-repo/api/_responses"
+	"github.com/t2bot/matrix-media-repo/api/_routers"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/restrictions"
+)
+
+type PublicRoomStatus struct {
+	RoomId     string `json:"room_id"`
+	Public     bool   `json:"public"`
+	FromConfig bool   `json:"from_config"`
+	SetBy      string `json:"set_by,omitempty"`
+	CreationTs int64  `json:"creation_ts,omitempty"`
+}
+
+type PublicRoomsList struct {
+	Rooms []*PublicRoomStatus `json:"rooms"`
+}
+
+func GetPublicRooms(r *http.Request, rctx rcontext.RequestContext, user _apimeta.UserInfo) interface{} {
+	records, err := database.GetInstance().PublicRooms.Prepare(rctx).GetAll()
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return _responses.InternalServerError("failed to get public rooms")
+	}
+
+	rooms := make([]*PublicRoomStatus, 0)
+	for _, roomId := range rctx.Config.Downloads.PublicRooms {
+		rooms = append(rooms, &PublicRoomStatus{RoomId: roomId, Public: true, FromConfig: true})
+	}
+	for _, record := range records {
+		if slices.Contains(rctx.Config.Downloads.PublicRooms, record.RoomId) {
+			continue
+		}
+		rooms = append(rooms, &PublicRoomStatus{
+			RoomId:     record.RoomId,
+			Public:     true,
+			SetBy:      record.SetBy,
+			CreationTs: record.CreationTs,
+		})
+	}
+
+	return &_responses.DoNotCacheResponse{Payload: &PublicRoomsList{Rooms: rooms}}
+}
+
+func GetPublicRoom(r *http.Request, rctx rcontext.RequestContext, user _apimeta.UserInfo) interface{} {
+	roomId := _routers.GetParam("roomId", r)
+	if roomId == "" || roomId[0] != '!' {
+		return _responses.BadRequest("invalid room ID")
+	}
+
+	status, err := getPublicRoomStatus(rctx, roomId)
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return _responses.InternalServerError("failed to get public room status")
+	}
+	return &_responses.DoNotCacheResponse{Payload: status}
+}
+
+func SetPublicRoom(r *http.Request, rctx rcontext.RequestContext, user _apimeta.UserInfo) interface{} {
+	roomId := _routers.GetParam("roomId", r)
+	if roomId == "" || roomId[0] != '!' {
+		return _responses.BadRequest("invalid room ID")
+	}
+	public := r.Method != http.MethodDelete
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"roomId": roomId,
+		"public": public,
+	})
+	rctx.Log.Infof("User %s is changing the public status of a room", user.UserId)
+
+	if err := restrictions.SetRoomPublic(rctx, roomId, user.UserId, public); err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return _responses.InternalServerError("failed to change public room status")
+	}
+
+	status, err := getPublicRoomStatus(rctx, roomId)
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return _responses.InternalServerError("failed to get public room status")
+	}
+	return &_responses.DoNotCacheResponse{Payload: status}
+}
+
+func getPublicRoomStatus(rctx rcontext.RequestContext, roomId string) (*PublicRoomStatus, error) {
+	status := &PublicRoomStatus{
+		RoomId:     roomId,
+		FromConfig: slices.Contains(rctx.Config.Downloads.PublicRooms, roomId),
+	}
+	record, err := database.GetInstance().PublicRooms.Prepare(rctx).Get(roomId)
+	if err != nil {
+		return nil, err
+	}
+	if record != nil {
+		status.SetBy = record.SetBy
+		status.CreationTs = record.CreationTs
+	}
+	status.Public = status.FromConfig || record != nil
+	return status, nil
+}
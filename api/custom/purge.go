@@ -14,6 +14,7 @@ import (
 
 	"github.com/sirupsen/logrus"
 	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/config"
 	"github.com/t2bot/matrix-media-repo/common/rcontext"
 	"github.com/t2bot/matrix-media-repo/matrix"
 	"github.com/t2bot/matrix-media-repo/util"
@@ -48,6 +49,50 @@ func PurgeRemoteMedia(r *http.Request, rctx rcontext.RequestContext, user _apime
 	return &_responses.DoNotCacheResponse{Payload: &MediaPurgedResponse{NumRemoved: removed}}
 }
 
+func PurgeUnusedRemoteMedia(r *http.Request, rctx rcontext.RequestContext, user _apimeta.UserInfo) interface{} {
+	var err error
+	days := int64(config.Get().Downloads.ExpireNotAccessedDays)
+	daysStr := r.URL.Query().Get("days")
+	if daysStr != "" {
+		days, err = strconv.ParseInt(daysStr, 10, 64)
+		if err != nil {
+			return _responses.BadRequest("Error parsing days: " + err.Error())
+		}
+	}
+	if days <= 0 {
+		return _responses.BadRequest("days must be greater than zero")
+	}
+
+	dryRun := false
+	dryRunStr := r.URL.Query().Get("dry_run")
+	if dryRunStr != "" {
+		dryRun, err = strconv.ParseBool(dryRunStr)
+		if err != nil {
+			return _responses.BadRequest("Error parsing dry_run: " + err.Error())
+		}
+	}
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"days":    days,
+		"dry_run": dryRun,
+	})
+
+	accessedBeforeTs := util.NowMillis() - days*24*60*60*1000
+	report, err := task_runner.PurgeRemoteMediaNotAccessedSince(rctx, accessedBeforeTs, dryRun)
+	if err != nil {
+		rctx.Log.Error("Error purging unused remote media: ", err)
+		sentry.CaptureException(err)
+		return _responses.InternalServerError("Error purging remote media")
+	}
+
+	return &_responses.DoNotCacheResponse{Payload: map[string]interface{}{
+		"purged":                   !dryRun,
+		"affected":                 report.Affected,
+		"freed_bytes":              report.FreedBytes,
+		"freed_bytes_by_datastore": report.FreedBytesByDatastore,
+	}}
+}
+
 func PurgeIndividualRecord(r *http.Request, rctx rcontext.RequestContext, user _apimeta.UserInfo) interface{} {
 	authCtx, _, _ := getPurgeAuthContext(rctx, r, user)
 
@@ -254,34 +299,52 @@ func PurgeRoomMedia(r *http.Request, rctx rcontext.RequestContext, user _apimeta
 		}
 	}
 
+	dryRun := false
+	dryRunStr := r.URL.Query().Get("dry_run")
+	if dryRunStr != "" {
+		dryRun, err = strconv.ParseBool(dryRunStr)
+		if err != nil {
+			return _responses.BadRequest("Error parsing dry_run: " + err.Error())
+		}
+	}
+
 	roomId := _routers.GetParam("roomId", r)
 
 	rctx = rctx.LogWithFields(logrus.Fields{
 		"roomId":   roomId,
 		"beforeTs": beforeTs,
+		"dryRun":   dryRun,
 	})
 
-	allMedia, err := matrix.ListMedia(rctx, r.Host, user.AccessToken, roomId, r.RemoteAddr)
+	// Media referenced by the room is known locally, so start there and then add whatever the homeserver knows about
+	references, err := database.GetInstance().MediaReferences.Prepare(rctx).GetForRoom(roomId)
 	if err != nil {
-		rctx.Log.Error("Error while listing media in the room: ", err)
+		rctx.Log.Error("Error while listing media references for the room: ", err)
 		sentry.CaptureException(err)
 		return _responses.InternalServerError("error retrieving media in room")
 	}
+	allMxcs := make([]string, 0, len(references))
+	for _, ref := range references {
+		allMxcs = append(allMxcs, util.MxcUri(ref.Origin, ref.MediaId))
+	}
+
+	allMedia, err := matrix.ListMedia(rctx, r.Host, user.AccessToken, roomId, r.RemoteAddr)
+	if err != nil {
+		rctx.Log.Warn("Non-fatal error while listing media in the room from the homeserver: ", err)
+		sentry.CaptureException(err)
+	} else {
+		allMxcs = append(allMxcs, allMedia.LocalMxcs...)
+		allMxcs = append(allMxcs, allMedia.RemoteMxcs...)
+	}
 
+	seen := make(map[string]bool)
 	mxcs := make([]string, 0)
-	if !isGlobalAdmin {
-		for _, mxc := range allMedia.LocalMxcs {
-			domain, _, err := util.SplitMxc(mxc)
-			if err != nil {
-				continue
-			}
-			if domain != r.Host {
-				continue
-			}
-			mxcs = append(mxcs, mxc)
+	for _, mxc := range allMxcs {
+		if seen[mxc] {
+			continue
 		}
-
-		for _, mxc := range allMedia.RemoteMxcs {
+		seen[mxc] = true
+		if !isGlobalAdmin {
 			domain, _, err := util.SplitMxc(mxc)
 			if err != nil {
 				continue
@@ -289,16 +352,13 @@ func PurgeRoomMedia(r *http.Request, rctx rcontext.RequestContext, user _apimeta
 			if domain != r.Host {
 				continue
 			}
-			mxcs = append(mxcs, mxc)
 		}
-	} else {
-		mxcs = append(mxcs, allMedia.LocalMxcs...)
-		mxcs = append(mxcs, allMedia.RemoteMxcs...)
+		mxcs = append(mxcs, mxc)
 	}
 
-	mxcs2, err := task_runner.PurgeMedia(rctx, authCtx, []*task_runner.QuarantineThis{{
+	mxcs2, freedBytes, err := task_runner.PurgeMediaWithReport(rctx, authCtx, []*task_runner.QuarantineThis{{
 		MxcUris: mxcs,
-	}})
+	}}, dryRun)
 	if err != nil {
 		if errors.Is(err, common.ErrWrongUser) {
 			return _responses.AuthFailed()
@@ -308,7 +368,11 @@ func PurgeRoomMedia(r *http.Request, rctx rcontext.RequestContext, user _apimeta
 		return _responses.InternalServerError("unexpected error")
 	}
 
-	return &_responses.DoNotCacheResponse{Payload: map[string]interface{}{"purged": true, "affected": mxcs2}}
+	return &_responses.DoNotCacheResponse{Payload: map[string]interface{}{
+		"purged":      !dryRun,
+		"affected":    mxcs2,
+		"freed_bytes": freedBytes,
+	}}
 }
 
 func PurgeDomainMedia(r *http.Request, rctx rcontext.RequestContext, user _apimeta.UserInfo) interface{} {
@@ -375,3 +439,48 @@ func getPurgeAuthContext(ctx rcontext.RequestContext, r *http.Request, user _api
 	}
 	return &task_runner.PurgeAuthContext{UploaderUserId: user.UserId}, false, false
 }
+
+func PurgeUnreferencedMedia(r *http.Request, rctx rcontext.RequestContext, user _apimeta.UserInfo) interface{} {
+	var err error
+	beforeTs := util.NowMillis() - int64(config.Get().References.PurgeUnreferencedAfterHours*60*60*1000)
+	beforeTsStr := r.URL.Query().Get("before_ts")
+	if beforeTsStr != "" {
+		beforeTs, err = strconv.ParseInt(beforeTsStr, 10, 64)
+		if err != nil {
+			return _responses.BadRequest("Error parsing before_ts: " + err.Error())
+		}
+	}
+
+	dryRun := true
+	dryRunStr := r.URL.Query().Get("dry_run")
+	if dryRunStr != "" {
+		dryRun, err = strconv.ParseBool(dryRunStr)
+		if err != nil {
+			return _responses.BadRequest("Error parsing dry_run: " + err.Error())
+		}
+	}
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"before_ts": beforeTs,
+		"dry_run":   dryRun,
+	})
+
+	if dryRun {
+		mxcs, err := task_runner.ListPurgeableUnreferencedMedia(rctx, beforeTs)
+		if err != nil {
+			rctx.Log.Error(err)
+			sentry.CaptureException(err)
+			return _responses.InternalServerError("unexpected error")
+		}
+		return &_responses.DoNotCacheResponse{Payload: map[string]interface{}{"purged": false, "affected": mxcs}}
+	}
+
+	removed, err := task_runner.PurgeUnreferencedMediaBefore(rctx, beforeTs)
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return _responses.InternalServerError("unexpected error")
+	}
+
+	return &_responses.DoNotCacheResponse{Payload: &MediaPurgedResponse{NumRemoved: removed}}
+}
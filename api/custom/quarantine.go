@@ -46,7 +46,7 @@ func QuarantineRoomMedia(r *http.Request, rctx rcontext.RequestContext, user _ap
 		mxcs = append(mxcs, allMedia.RemoteMxcs...)
 	}
 
-	return performQuarantineRequest(rctx, r.Host, allowOtherHosts, &task_runner.QuarantineThis{
+	return performQuarantineRequest(r, rctx, user, allowOtherHosts, &task_runner.QuarantineThis{
 		MxcUris: mxcs,
 	})
 }
@@ -83,7 +83,7 @@ func QuarantineUserMedia(r *http.Request, rctx rcontext.RequestContext, user _ap
 		return _responses.InternalServerError("error retrieving media for user")
 	}
 
-	return performQuarantineRequest(rctx, r.Host, allowOtherHosts, &task_runner.QuarantineThis{
+	return performQuarantineRequest(r, rctx, user, allowOtherHosts, &task_runner.QuarantineThis{
 		DbMedia: userMedia,
 	})
 }
@@ -117,7 +117,7 @@ func QuarantineDomainMedia(r *http.Request, rctx rcontext.RequestContext, user _
 		return _responses.InternalServerError("error retrieving media for server")
 	}
 
-	return performQuarantineRequest(rctx, r.Host, allowOtherHosts, &task_runner.QuarantineThis{
+	return performQuarantineRequest(r, rctx, user, allowOtherHosts, &task_runner.QuarantineThis{
 		DbMedia: domainMedia,
 	})
 }
@@ -145,7 +145,7 @@ func QuarantineMedia(r *http.Request, rctx rcontext.RequestContext, user _apimet
 		return _responses.BadRequest("unable to quarantine media on other homeservers")
 	}
 
-	return performQuarantineRequest(rctx, r.Host, allowOtherHosts, &task_runner.QuarantineThis{
+	return performQuarantineRequest(r, rctx, user, allowOtherHosts, &task_runner.QuarantineThis{
 		Single: &task_runner.QuarantineRecord{
 			Origin:  server,
 			MediaId: mediaId,
@@ -153,11 +153,13 @@ func QuarantineMedia(r *http.Request, rctx rcontext.RequestContext, user _apimet
 	})
 }
 
-func performQuarantineRequest(ctx rcontext.RequestContext, host string, allowOtherHosts bool, toQuarantine *task_runner.QuarantineThis) interface{} {
-	lockedHost := host
+func performQuarantineRequest(r *http.Request, ctx rcontext.RequestContext, user _apimeta.UserInfo, allowOtherHosts bool, toQuarantine *task_runner.QuarantineThis) interface{} {
+	lockedHost := r.Host
 	if allowOtherHosts {
 		lockedHost = ""
 	}
+	toQuarantine.Actor = user.UserId
+	toQuarantine.Reason = r.URL.Query().Get("reason")
 
 	total, err := task_runner.QuarantineMedia(ctx, lockedHost, toQuarantine)
 	if err != nil {
@@ -0,0 +1,266 @@
+package custom
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-media-repo/api/_apimeta"
+	"github.com/t2bot/matrix-media-repo/api/_responses"
+	"github.com/t2bot/matrix-media-repo/api/_routers"
+	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/tasks/task_runner"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+type QuarantineAction struct {
+	Action   string `json:"action"`
+	Reason   string `json:"reason"`
+	Actor    string `json:"actor,omitempty"`
+	ActionTs int64  `json:"action_ts"`
+}
+
+type QuarantinedMediaInfo struct {
+	MxcUri      string            `json:"mxc"`
+	UploadedBy  string            `json:"uploaded_by"`
+	ContentType string            `json:"content_type"`
+	SizeBytes   int64             `json:"size_bytes"`
+	Sha256Hash  string            `json:"sha256"`
+	CreationTs  int64             `json:"created_ts"`
+	RoomIds     []string          `json:"room_ids"`
+	LastAction  *QuarantineAction `json:"last_action,omitempty"`
+}
+
+type QuarantineReviewResponse struct {
+	Media     []*QuarantinedMediaInfo `json:"media"`
+	Total     int                     `json:"total"`
+	NextToken int                     `json:"next_token,omitempty"`
+}
+
+type QuarantineHistoryResponse struct {
+	Actions []*QuarantineAction `json:"actions"`
+}
+
+func ListQuarantinedMedia(r *http.Request, rctx rcontext.RequestContext, user _apimeta.UserInfo) interface{} {
+	canQuarantine, allowOtherHosts, isLocalAdmin := getQuarantineRequestInfo(r, rctx, user)
+	if !canQuarantine {
+		return _responses.AuthFailed()
+	}
+
+	var err error
+	qs := r.URL.Query()
+	start := 0
+	if len(qs["from"]) > 0 {
+		start, err = strconv.Atoi(qs.Get("from"))
+		if err != nil || start < 0 {
+			return _responses.BadRequest("Query parameter 'from' must be a non-negative integer")
+		}
+	}
+	limit := 50
+	if len(qs["limit"]) > 0 {
+		limit, err = strconv.Atoi(qs.Get("limit"))
+		if err != nil || limit <= 0 {
+			return _responses.BadRequest("Query parameter 'limit' must be a positive integer")
+		}
+	}
+	if limit > 100 {
+		limit = 100
+	}
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"from":       start,
+		"limit":      limit,
+		"localAdmin": isLocalAdmin,
+	})
+
+	mediaDb := database.GetInstance().Media.Prepare(rctx)
+	var records []*database.DbMedia
+	if allowOtherHosts {
+		records, err = mediaDb.GetByQuarantine()
+	} else {
+		records, err = mediaDb.GetByOriginQuarantine(r.Host)
+	}
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return _responses.InternalServerError("error fetching media records")
+	}
+
+	// Newest first, so the most recent quarantines are reviewed first
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].CreationTs > records[j].CreationTs
+	})
+
+	resp := &QuarantineReviewResponse{
+		Media: make([]*QuarantinedMediaInfo, 0),
+		Total: len(records),
+	}
+	if start >= len(records) {
+		return &_responses.DoNotCacheResponse{Payload: resp}
+	}
+	end := min(start+limit, len(records))
+	if end < len(records) {
+		resp.NextToken = end
+	}
+
+	refsDb := database.GetInstance().MediaReferences.Prepare(rctx)
+	actionsDb := database.GetInstance().QuarantineLog.Prepare(rctx)
+	for _, record := range records[start:end] {
+		refs, err := refsDb.GetForMedia(record.Origin, record.MediaId)
+		if err != nil {
+			rctx.Log.Error(err)
+			sentry.CaptureException(err)
+			return _responses.InternalServerError("error fetching media references")
+		}
+		lastAction, err := actionsDb.GetLatestForMedia(record.Origin, record.MediaId)
+		if err != nil {
+			rctx.Log.Error(err)
+			sentry.CaptureException(err)
+			return _responses.InternalServerError("error fetching quarantine history")
+		}
+
+		roomIds := make([]string, 0)
+		for _, ref := range refs {
+			if !util.ArrayContains(roomIds, ref.RoomId) {
+				roomIds = append(roomIds, ref.RoomId)
+			}
+		}
+		resp.Media = append(resp.Media, &QuarantinedMediaInfo{
+			MxcUri:      util.MxcUri(record.Origin, record.MediaId),
+			UploadedBy:  record.UserId,
+			ContentType: record.ContentType,
+			SizeBytes:   record.SizeBytes,
+			Sha256Hash:  record.Sha256Hash,
+			CreationTs:  record.CreationTs,
+			RoomIds:     roomIds,
+			LastAction:  toQuarantineAction(lastAction),
+		})
+	}
+
+	return &_responses.DoNotCacheResponse{Payload: resp}
+}
+
+func GetQuarantineHistory(r *http.Request, rctx rcontext.RequestContext, user _apimeta.UserInfo) interface{} {
+	record, _, errResp := getQuarantineReviewRecord(r, rctx, user, false)
+	if errResp != nil {
+		return errResp
+	}
+
+	actions, err := database.GetInstance().QuarantineLog.Prepare(rctx).GetForMedia(record.Origin, record.MediaId)
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return _responses.InternalServerError("error fetching quarantine history")
+	}
+
+	resp := &QuarantineHistoryResponse{Actions: make([]*QuarantineAction, 0, len(actions))}
+	for _, action := range actions {
+		resp.Actions = append(resp.Actions, toQuarantineAction(action))
+	}
+	return &_responses.DoNotCacheResponse{Payload: resp}
+}
+
+func ApproveQuarantinedMedia(r *http.Request, rctx rcontext.RequestContext, user _apimeta.UserInfo) interface{} {
+	record, allowOtherHosts, errResp := getQuarantineReviewRecord(r, rctx, user, true)
+	if errResp != nil {
+		return errResp
+	}
+
+	lockedHost := r.Host
+	if allowOtherHosts {
+		lockedHost = ""
+	}
+	total, err := task_runner.UnquarantineMedia(rctx, lockedHost, &task_runner.QuarantineThis{
+		DbMedia: []*database.DbMedia{record},
+		Actor:   user.UserId,
+		Reason:  r.URL.Query().Get("reason"),
+	})
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return _responses.InternalServerError("error approving media")
+	}
+
+	return &_responses.DoNotCacheResponse{Payload: map[string]interface{}{"num_approved": total}}
+}
+
+func PurgeQuarantinedMedia(r *http.Request, rctx rcontext.RequestContext, user _apimeta.UserInfo) interface{} {
+	record, allowOtherHosts, errResp := getQuarantineReviewRecord(r, rctx, user, true)
+	if errResp != nil {
+		return errResp
+	}
+
+	authCtx := &task_runner.PurgeAuthContext{SourceOrigin: r.Host}
+	if allowOtherHosts {
+		authCtx = &task_runner.PurgeAuthContext{}
+	}
+	mxcs, err := task_runner.PurgeMedia(rctx, authCtx, []*task_runner.QuarantineThis{{
+		DbMedia: []*database.DbMedia{record},
+	}})
+	if err != nil {
+		if errors.Is(err, common.ErrWrongUser) {
+			return _responses.AuthFailed()
+		}
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return _responses.InternalServerError("unexpected error")
+	}
+	task_runner.RecordQuarantineAction(rctx, record, task_runner.QuarantineActionPurge, user.UserId, r.URL.Query().Get("reason"))
+
+	return &_responses.DoNotCacheResponse{Payload: map[string]interface{}{"purged": true, "affected": mxcs}}
+}
+
+// getQuarantineReviewRecord returns the media record targeted by the request and whether the user may act on other
+// hosts, or an error response if the user can't review it. When mustBeQuarantined is set, media which isn't
+// quarantined is treated as not found.
+func getQuarantineReviewRecord(r *http.Request, rctx rcontext.RequestContext, user _apimeta.UserInfo, mustBeQuarantined bool) (*database.DbMedia, bool, interface{}) {
+	canQuarantine, allowOtherHosts, isLocalAdmin := getQuarantineRequestInfo(r, rctx, user)
+	if !canQuarantine {
+		return nil, false, _responses.AuthFailed()
+	}
+
+	server := _routers.GetParam("server", r)
+	mediaId := _routers.GetParam("mediaId", r)
+
+	if !_routers.ServerNameRegex.MatchString(server) {
+		return nil, false, _responses.BadRequest("invalid server ID")
+	}
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"server":     server,
+		"mediaId":    mediaId,
+		"localAdmin": isLocalAdmin,
+	})
+
+	if !allowOtherHosts && r.Host != server {
+		return nil, false, _responses.BadRequest("unable to review media on other homeservers")
+	}
+
+	record, err := database.GetInstance().Media.Prepare(rctx).GetById(server, mediaId)
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return nil, false, _responses.InternalServerError("error fetching media record")
+	}
+	if record == nil || (mustBeQuarantined && !record.Quarantined) {
+		return nil, false, _responses.NotFoundError()
+	}
+	return record, allowOtherHosts, nil
+}
+
+func toQuarantineAction(record *database.DbQuarantineAction) *QuarantineAction {
+	if record == nil {
+		return nil
+	}
+	return &QuarantineAction{
+		Action:   record.Action,
+		Reason:   record.Reason,
+		Actor:    record.Actor,
+		ActionTs: record.ActionTs,
+	}
+}
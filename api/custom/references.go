@@ -0,0 +1,180 @@
+package custom
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-media-repo/api/_apimeta"
+	"github.com/t2bot/matrix-media-repo/api/_responses"
+	"github.com/t2bot/matrix-media-repo/api/_routers"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/references"
+	"github.com/t2bot/matrix-media-repo/tasks"
+	"github.com/t2bot/matrix-media-repo/tasks/task_runner"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+type ReferenceRequest struct {
+	RoomId  string `json:"room_id"`
+	EventId string `json:"event_id"`
+}
+
+type RedactionRequest struct {
+	RoomId  string   `json:"room_id"`
+	EventId string   `json:"event_id"`
+	MxcUris []string `json:"mxc_uris"`
+}
+
+type RoomForgottenRequest struct {
+	RoomId string `json:"room_id"`
+}
+
+type ReferenceRepairStarted struct {
+	TaskID int `json:"task_id"`
+}
+
+func AddReference(r *http.Request, rctx rcontext.RequestContext) interface{} {
+	origin := _routers.GetParam("server", r)
+	mediaId := _routers.GetParam("mediaId", r)
+
+	if !_routers.ServerNameRegex.MatchString(origin) {
+		return _responses.BadRequest("invalid origin")
+	}
+
+	params := &ReferenceRequest{}
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&params); err != nil {
+		return _responses.BadRequest("invalid reference")
+	}
+	if params.RoomId == "" {
+		return _responses.BadRequest("missing room_id")
+	}
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"origin":  origin,
+		"mediaId": mediaId,
+		"roomId":  params.RoomId,
+		"eventId": params.EventId,
+	})
+
+	if err := references.AddMediaReference(rctx, origin, mediaId, params.RoomId, params.EventId); err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return _responses.InternalServerError("failed to add reference")
+	}
+
+	return &_responses.DoNotCacheResponse{Payload: &_responses.EmptyResponse{}}
+}
+
+func HandleRedaction(r *http.Request, rctx rcontext.RequestContext) interface{} {
+	params := &RedactionRequest{}
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&params); err != nil {
+		return _responses.BadRequest("invalid redaction")
+	}
+	if params.RoomId == "" || params.EventId == "" {
+		return _responses.BadRequest("missing room_id or event_id")
+	}
+	for _, mxc := range params.MxcUris {
+		if _, _, err := util.SplitMxc(mxc); err != nil {
+			return _responses.BadRequest("invalid mxc uri: " + mxc)
+		}
+	}
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"roomId":  params.RoomId,
+		"eventId": params.EventId,
+	})
+
+	quarantine := config.Get().InternalApi.RedactionAction == config.RedactionQuarantine
+	mxcs, err := task_runner.PurgeRedactedMedia(rctx, params.RoomId, params.EventId, params.MxcUris, quarantine)
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return _responses.InternalServerError("unexpected error handling redaction")
+	}
+
+	return &_responses.DoNotCacheResponse{Payload: map[string]interface{}{"affected": mxcs, "quarantined": quarantine}}
+}
+
+func HandleRoomForgotten(r *http.Request, rctx rcontext.RequestContext) interface{} {
+	params := &RoomForgottenRequest{}
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&params); err != nil {
+		return _responses.BadRequest("invalid request")
+	}
+	if params.RoomId == "" {
+		return _responses.BadRequest("missing room_id")
+	}
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"roomId": params.RoomId,
+	})
+
+	mxcs, err := references.RemoveRoom(rctx, params.RoomId)
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return _responses.InternalServerError("failed to remove room references")
+	}
+
+	return &_responses.DoNotCacheResponse{Payload: map[string]interface{}{"unreferenced": mxcs}}
+}
+
+// PublishRoomManifest publishes the room's media manifest immediately, regardless of whether it has changed.
+func PublishRoomManifest(r *http.Request, rctx rcontext.RequestContext, user _apimeta.UserInfo) interface{} {
+	if !config.Get().RoomManifests.Enabled {
+		return _responses.BadRequest("room manifests are not enabled")
+	}
+
+	roomId := _routers.GetParam("roomId", r)
+	if roomId == "" || roomId[0] != '!' {
+		return _responses.BadRequest("invalid room ID")
+	}
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"roomId": roomId,
+	})
+
+	manifest, _, err := references.PublishRoomManifest(rctx, roomId, false)
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return _responses.InternalServerError("failed to publish room manifest")
+	}
+
+	return &_responses.DoNotCacheResponse{Payload: manifest}
+}
+
+// RepairReferences starts a background task to find and repair references which don't agree with the stored media.
+func RepairReferences(r *http.Request, rctx rcontext.RequestContext, user _apimeta.UserInfo) interface{} {
+	defer r.Body.Close()
+	params := task_runner.RepairReferencesParams{}
+	if r.ContentLength != 0 {
+		decoder := json.NewDecoder(r.Body)
+		if err := decoder.Decode(&params); err != nil && !errors.Is(err, io.EOF) {
+			return _responses.BadRequest("failed to read repair parameters")
+		}
+	}
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"dryRun":           params.DryRun,
+		"flagUnreferenced": params.FlagUnreferenced,
+	})
+	rctx.Log.Infof("User %s has started a reference integrity repair", user.UserId)
+	task, err := tasks.RunReferenceRepair(rctx, params)
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return _responses.InternalServerError("fatal error starting reference repair")
+	}
+
+	return &_responses.DoNotCacheResponse{Payload: &ReferenceRepairStarted{
+		TaskID: task.TaskId,
+	}}
+}
@@ -0,0 +1,185 @@
+package custom
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-media-repo/api/_apimeta"
+	"github.com/t2bot/matrix-media-repo/api/_responses"
+	"github.com/t2bot/matrix-media-repo/api/_routers"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/datastores"
+	"github.com/t2bot/matrix-media-repo/tasks/task_runner"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+// replicationSettleMs holds back the newest media from replicas. Records are created before they are committed, so
+// without it a replica could move past a record which was about to appear.
+const replicationSettleMs = 10000
+
+// replicationPosition identifies the last media record and change a replica has seen. It is handed out as an opaque
+// token.
+type replicationPosition struct {
+	CreationTs int64  `json:"ts"`
+	Origin     string `json:"origin"`
+	MediaId    string `json:"media_id"`
+	StreamId   int64  `json:"stream_id,omitempty"`
+}
+
+func (p *replicationPosition) encode() (string, error) {
+	b, err := json.Marshal(p)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func decodeReplicationPosition(token string) (*replicationPosition, error) {
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, err
+	}
+	p := &replicationPosition{}
+	if err = json.Unmarshal(b, p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func ListReplicationMedia(r *http.Request, rctx rcontext.RequestContext, user _apimeta.UserInfo) interface{} {
+	var err error
+	qs := r.URL.Query()
+	position := &replicationPosition{CreationTs: -1}
+	if since := qs.Get("since"); since != "" {
+		position, err = decodeReplicationPosition(since)
+		if err != nil {
+			return _responses.BadRequest("Query parameter 'since' is not a valid token")
+		}
+	}
+	limit := 100
+	if len(qs["limit"]) > 0 {
+		limit, err = strconv.Atoi(qs.Get("limit"))
+		if err != nil || limit <= 0 {
+			return _responses.BadRequest("Query parameter 'limit' must be a positive integer")
+		}
+	}
+	limit = min(limit, task_runner.MaxReplicationBatchSize)
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"sinceTs": position.CreationTs,
+		"limit":   limit,
+	})
+
+	settledTs := util.NowMillis() - replicationSettleMs
+	db := database.GetInstance().Media.Prepare(rctx)
+	records, err := db.GetForReplication(util.GetOurDomains(), position.CreationTs, position.Origin, position.MediaId, settledTs, int64(limit))
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return _responses.InternalServerError("failed to list media")
+	}
+	changes, err := database.GetInstance().ReplicationLog.Prepare(rctx).GetSince(util.GetOurDomains(), position.StreamId, int64(limit))
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return _responses.InternalServerError("failed to list changes")
+	}
+
+	batch := &task_runner.ReplicationBatch{
+		Media:     make([]*task_runner.ReplicationMedia, 0, len(records)),
+		Events:    make([]*task_runner.ReplicationEvent, 0, len(changes)),
+		NextBatch: qs.Get("since"),
+	}
+	for _, record := range records {
+		batch.Media = append(batch.Media, task_runner.NewReplicationMedia(record))
+	}
+	for _, change := range changes {
+		if change.CreationTs >= settledTs {
+			break // hold back the rest, as with media, so a change which is still being committed isn't skipped
+		}
+		event := &task_runner.ReplicationEvent{
+			Type:    change.EventType,
+			Origin:  change.Origin,
+			MediaId: change.MediaId,
+			RoomId:  change.RoomId,
+			EventId: change.EventId,
+		}
+		if change.EventType == database.ReplicationEventMediaUnquarantined {
+			record, err := db.GetById(change.Origin, change.MediaId)
+			if err != nil {
+				rctx.Log.Error(err)
+				sentry.CaptureException(err)
+				return _responses.InternalServerError("failed to get media record")
+			}
+			if record != nil && !record.Quarantined {
+				event.Media = task_runner.NewReplicationMedia(record)
+			}
+		}
+		batch.Events = append(batch.Events, event)
+		position.StreamId = change.StreamId
+	}
+	if len(records) > 0 {
+		last := records[len(records)-1]
+		position.CreationTs = last.CreationTs
+		position.Origin = last.Origin
+		position.MediaId = last.MediaId
+	}
+	if len(batch.Media) > 0 || len(batch.Events) > 0 {
+		if batch.NextBatch, err = position.encode(); err != nil {
+			rctx.Log.Error(err)
+			sentry.CaptureException(err)
+			return _responses.InternalServerError("failed to create next batch token")
+		}
+	}
+
+	return &_responses.DoNotCacheResponse{Payload: batch}
+}
+
+func DownloadReplicationMedia(r *http.Request, rctx rcontext.RequestContext, user _apimeta.UserInfo) interface{} {
+	server := _routers.GetParam("server", r)
+	mediaId := _routers.GetParam("mediaId", r)
+
+	if !_routers.ServerNameRegex.MatchString(server) {
+		return _responses.BadRequest("invalid server ID")
+	}
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"server":  server,
+		"mediaId": mediaId,
+	})
+
+	record, err := database.GetInstance().Media.Prepare(rctx).GetById(server, mediaId)
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return _responses.InternalServerError("failed to get media record")
+	}
+	if record == nil {
+		return _responses.NotFoundError()
+	}
+
+	dsConf, ok := datastores.Get(rctx, record.DatastoreId)
+	if !ok {
+		sentry.CaptureMessage("failed to locate datastore")
+		return _responses.InternalServerError("failed to locate datastore")
+	}
+	s, err := datastores.Download(rctx, dsConf, record.Location)
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return _responses.InternalServerError("failed to start download")
+	}
+
+	return &_responses.DownloadResponse{
+		ContentType:       record.ContentType,
+		SizeBytes:         record.SizeBytes,
+		Data:              s,
+		Filename:          record.UploadName,
+		TargetDisposition: "attachment",
+	}
+}
@@ -0,0 +1,210 @@
+package custom
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/t2bot/matrix-media-repo/api/_apimeta"
+	"github.com/t2bot/matrix-media-repo/api/_responses"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+const storageReportDay = int64(24 * 60 * 60 * 1000)
+
+// storageReportAges are the age buckets used by the storage report, newest first. Media older than the last
+// bucket's limit is reported as "over_1y".
+var storageReportAges = []struct {
+	Name   string
+	MaxAge int64
+}{
+	{"under_7d", 7 * storageReportDay},
+	{"7d_to_30d", 30 * storageReportDay},
+	{"30d_to_90d", 90 * storageReportDay},
+	{"90d_to_1y", 365 * storageReportDay},
+}
+
+type StorageReportUsage struct {
+	Count     int64 `json:"count"`
+	SizeBytes int64 `json:"size_bytes"`
+}
+
+type StorageReportEntry struct {
+	Local  *StorageReportUsage `json:"local"`
+	Remote *StorageReportUsage `json:"remote"`
+}
+
+type StorageReportResponse struct {
+	GeneratedTs int64                                     `json:"generated_ts"`
+	Categories  map[string]map[string]*StorageReportEntry `json:"categories"`
+	Total       *StorageReportEntry                       `json:"total"`
+}
+
+func newStorageReportEntry() *StorageReportEntry {
+	return &StorageReportEntry{Local: &StorageReportUsage{}, Remote: &StorageReportUsage{}}
+}
+
+func (e *StorageReportEntry) add(row *database.DbStorageReportRow) {
+	usage := e.Remote
+	if row.IsLocal {
+		usage = e.Local
+	}
+	usage.Count += row.Count
+	usage.SizeBytes += row.SizeBytes
+}
+
+func GetStorageReport(r *http.Request, rctx rcontext.RequestContext, user _apimeta.UserInfo) interface{} {
+	now := util.NowMillis()
+	thresholds := [4]int64{}
+	for i, age := range storageReportAges {
+		thresholds[i] = now - age.MaxAge
+	}
+
+	rows, err := database.GetInstance().MetadataView.Prepare(rctx).StorageReport(util.GetOurDomains(), thresholds)
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return _responses.InternalServerError("Unexpected error generating storage report")
+	}
+
+	ageNames := make([]string, 0, len(storageReportAges)+1)
+	for _, age := range storageReportAges {
+		ageNames = append(ageNames, age.Name)
+	}
+	ageNames = append(ageNames, "over_1y")
+
+	// Every combination is included, even if empty, so the report has a predictable shape
+	categories := make(map[string]map[string]*StorageReportEntry)
+	for _, category := range []string{"images", "video", "audio", "other"} {
+		categories[category] = make(map[string]*StorageReportEntry)
+		for _, age := range ageNames {
+			categories[category][age] = newStorageReportEntry()
+		}
+	}
+	total := newStorageReportEntry()
+	for _, row := range rows {
+		categories[row.Category][ageNames[row.AgeBucket]].add(row)
+		total.add(row)
+	}
+
+	return &_responses.DoNotCacheResponse{Payload: &StorageReportResponse{
+		GeneratedTs: now,
+		Categories:  categories,
+		Total:       total,
+	}}
+}
+
+// RetentionRule is one rule of a candidate retention policy. Media matching any rule in the policy would be
+// removed by it.
+type RetentionRule struct {
+	Origin             string   `json:"origin"` // "local", "remote" (default), or "any"
+	MaxAgeDays         int64    `json:"max_age_days"`
+	NotAccessedDays    int64    `json:"not_accessed_days,omitempty"`
+	ContentTypes       []string `json:"content_types,omitempty"` // may end with "*", like "video/*"
+	MinSizeBytes       int64    `json:"min_size_bytes,omitempty"`
+	IncludeQuarantined bool     `json:"include_quarantined,omitempty"`
+}
+
+type RetentionPolicy struct {
+	Rules []*RetentionRule `json:"rules"`
+}
+
+type RetentionEstimateResponse struct {
+	GeneratedTs int64                 `json:"generated_ts"`
+	Rules       []*StorageReportUsage `json:"rules"`
+	Total       *StorageReportUsage   `json:"total"`
+}
+
+func EstimateRetentionPolicy(r *http.Request, rctx rcontext.RequestContext, user _apimeta.UserInfo) interface{} {
+	policy := &RetentionPolicy{}
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&policy); err != nil {
+		return _responses.BadRequest("invalid retention policy")
+	}
+	if len(policy.Rules) == 0 {
+		return _responses.BadRequest("retention policy has no rules")
+	}
+	for i, rule := range policy.Rules {
+		if err := validateRetentionRule(rule); err != nil {
+			return _responses.BadRequest(fmt.Sprintf("rule %d: %s", i, err.Error()))
+		}
+	}
+
+	now := util.NowMillis()
+	metadataDb := database.GetInstance().MetadataView.Prepare(rctx)
+	response := &RetentionEstimateResponse{
+		GeneratedTs: now,
+		Rules:       make([]*StorageReportUsage, len(policy.Rules)),
+		Total:       &StorageReportUsage{},
+	}
+	seen := make(map[string]bool)
+	for i, rule := range policy.Rules {
+		accessedBeforeTs := int64(math.MaxInt64)
+		if rule.NotAccessedDays > 0 {
+			accessedBeforeTs = now - rule.NotAccessedDays*storageReportDay
+		}
+		patterns := make([]string, 0, len(rule.ContentTypes))
+		for _, contentType := range rule.ContentTypes {
+			patterns = append(patterns, contentTypeToLikePattern(contentType))
+		}
+
+		records, err := metadataDb.RetentionCandidates(util.GetOurDomains(), rule.Origin, now-rule.MaxAgeDays*storageReportDay, accessedBeforeTs, patterns, rule.MinSizeBytes, rule.IncludeQuarantined)
+		if err != nil {
+			rctx.Log.Error(err)
+			sentry.CaptureException(err)
+			return _responses.InternalServerError("Unexpected error estimating retention policy")
+		}
+
+		usage := &StorageReportUsage{}
+		for _, record := range records {
+			usage.Count++
+			usage.SizeBytes += record.SizeBytes
+
+			// Media matching several rules is only counted once in the total
+			mxc := util.MxcUri(record.Origin, record.MediaId)
+			if !seen[mxc] {
+				seen[mxc] = true
+				response.Total.Count++
+				response.Total.SizeBytes += record.SizeBytes
+			}
+		}
+		response.Rules[i] = usage
+	}
+
+	return &_responses.DoNotCacheResponse{Payload: response}
+}
+
+func validateRetentionRule(rule *RetentionRule) error {
+	if rule == nil {
+		return errors.New("rule is empty")
+	}
+	if rule.Origin == "" {
+		rule.Origin = "remote"
+	}
+	if rule.Origin != "local" && rule.Origin != "remote" && rule.Origin != "any" {
+		return errors.New("origin must be one of local, remote, or any")
+	}
+	if rule.MaxAgeDays <= 0 {
+		return errors.New("max_age_days must be greater than zero")
+	}
+	if rule.NotAccessedDays < 0 || rule.MinSizeBytes < 0 {
+		return errors.New("not_accessed_days and min_size_bytes cannot be negative")
+	}
+	return nil
+}
+
+// contentTypeToLikePattern converts a content type (optionally ending with a "*" wildcard) to a SQL LIKE pattern.
+func contentTypeToLikePattern(contentType string) string {
+	prefix, wildcard := strings.CutSuffix(contentType, "*")
+	pattern := strings.NewReplacer("\\", "\\\\", "%", "\\%", "_", "\\_").Replace(prefix)
+	if wildcard {
+		pattern += "%"
+	}
+	return pattern
+}
@@ -3,11 +3,15 @@ package custom
 import (
 	"encoding/json"
 	"net/http"
+	"strconv"
 
 	"github.com/getsentry/sentry-go"
+	"github.com/sirupsen/logrus"
 	"github.com/t2bot/matrix-media-repo/api/_apimeta"
 	"github.com/t2bot/matrix-media-repo/api/_responses"
+	"github.com/t2bot/matrix-media-repo/api/_routers"
 	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/util"
 
 	"github.com/t2bot/matrix-media-repo/common/rcontext"
 )
@@ -72,3 +76,120 @@ func SetUserQuota(r *http.Request, rctx rcontext.RequestContext, user _apimeta.U
 
 	return &_responses.DoNotCacheResponse{Payload: &_responses.EmptyResponse{}}
 }
+
+type UserMediaEntry struct {
+	MxcUri      string `json:"mxc_uri"`
+	SizeBytes   int64  `json:"size_bytes"`
+	ContentType string `json:"content_type"`
+	UploadName  string `json:"upload_name"`
+	CreatedTs   int64  `json:"created_ts"`
+	DatastoreId string `json:"datastore_id"`
+	Sha256Hash  string `json:"sha256_hash"`
+	Quarantined bool   `json:"quarantined"`
+}
+
+type UserMediaResponse struct {
+	Media     []*UserMediaEntry `json:"media"`
+	NextToken int64             `json:"next_token,omitempty"`
+	Total     int64             `json:"total"`
+}
+
+func ListUserMedia(r *http.Request, rctx rcontext.RequestContext, user _apimeta.UserInfo) interface{} {
+	qs := r.URL.Query()
+	var err error
+
+	userId := _routers.GetParam("userId", r)
+	_, userDomain, err := util.SplitUserId(userId)
+	if err != nil {
+		return _responses.BadRequest("invalid user ID")
+	}
+
+	isGlobalAdmin, isLocalAdmin := _apimeta.GetRequestUserAdminStatus(r, rctx, user)
+	if !isGlobalAdmin && (userDomain != r.Host || !isLocalAdmin) {
+		return _responses.AuthFailed()
+	}
+
+	orderBy := database.UserMediaOrderBy(qs.Get("order_by"))
+	if len(qs["order_by"]) == 0 {
+		orderBy = database.DefaultUserMediaOrderBy
+	}
+	if !database.IsUserMediaOrderBy(orderBy) {
+		return _responses.BadRequest("Query parameter 'order_by' must be one of ['creation_ts', 'size_bytes']")
+	}
+
+	var start int64 = 0
+	if len(qs["from"]) > 0 {
+		start, err = strconv.ParseInt(qs.Get("from"), 10, 64)
+		if err != nil || start < 0 {
+			return _responses.BadRequest("Query parameter 'from' must be a non-negative integer")
+		}
+	}
+
+	var limit int64 = 100
+	if len(qs["limit"]) > 0 {
+		limit, err = strconv.ParseInt(qs.Get("limit"), 10, 64)
+		if err != nil || limit < 0 {
+			return _responses.BadRequest("Query parameter 'limit' must be a non-negative integer")
+		}
+	}
+	if limit > 500 {
+		limit = 500
+	}
+
+	isAscendingOrder := true
+	if len(qs["dir"]) > 0 {
+		direction := qs.Get("dir")
+		if direction == "b" {
+			isAscendingOrder = false
+		} else if direction != "f" {
+			return _responses.BadRequest("Query parameter 'dir' must be one of ['f', 'b']")
+		}
+	}
+
+	filter := database.UserMediaFilter{
+		ContentTypePrefix: qs.Get("content_type"),
+		DatastoreId:       qs.Get("datastore_id"),
+	}
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"userId":           userId,
+		"order_by":         orderBy,
+		"from":             start,
+		"limit":            limit,
+		"content_type":     filter.ContentTypePrefix,
+		"datastore_id":     filter.DatastoreId,
+		"isAscendingOrder": isAscendingOrder,
+	})
+
+	db := database.GetInstance().MetadataView.Prepare(rctx)
+	records, totalCount, err := db.UserMediaPage(userId, orderBy, start, limit, filter, isAscendingOrder)
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return _responses.InternalServerError("Failed to get media for user")
+	}
+
+	result := &UserMediaResponse{
+		Media:     make([]*UserMediaEntry, 0),
+		NextToken: 0, // invoke omitEmpty by default
+		Total:     totalCount,
+	}
+	for _, record := range records {
+		result.Media = append(result.Media, &UserMediaEntry{
+			MxcUri:      util.MxcUri(record.Origin, record.MediaId),
+			SizeBytes:   record.SizeBytes,
+			ContentType: record.ContentType,
+			UploadName:  record.UploadName,
+			CreatedTs:   record.CreationTs,
+			DatastoreId: record.DatastoreId,
+			Sha256Hash:  record.Sha256Hash,
+			Quarantined: record.Quarantined,
+		})
+	}
+
+	if (start + int64(len(records))) < totalCount {
+		result.NextToken = start + int64(len(records))
+	}
+
+	return &_responses.DoNotCacheResponse{Payload: result}
+}
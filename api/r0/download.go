@@ -10,7 +10,10 @@ import (
 	"github.com/t2bot/matrix-media-repo/api/_responses"
 	"github.com/t2bot/matrix-media-repo/api/_routers"
 	"github.com/t2bot/matrix-media-repo/datastores"
+	"github.com/t2bot/matrix-media-repo/pipelines/pipeline_convert"
 	"github.com/t2bot/matrix-media-repo/pipelines/pipeline_download"
+	"github.com/t2bot/matrix-media-repo/restrictions"
+	"github.com/t2bot/matrix-media-repo/thumbnailing"
 	"github.com/t2bot/matrix-media-repo/util"
 
 	"github.com/sirupsen/logrus"
@@ -57,6 +60,33 @@ func DownloadMedia(r *http.Request, rctx rcontext.RequestContext, auth _apimeta.
 		return _responses.BadRequest("timeout_ms does not appear to be an integer")
 	}
 
+	format := r.URL.Query().Get("format")
+	if format != "" {
+		if !util.ArrayContains(thumbnailing.ConversionFormats, format) {
+			return _responses.BadRequest("format must be one of jpeg, png, webp, or avif")
+		}
+		if !rctx.Config.Downloads.Conversion.Enabled || !util.ArrayContains(rctx.Config.Downloads.Conversion.Formats, format) {
+			return _responses.BadRequest("conversion to " + format + " is not enabled")
+		}
+	}
+
+	auth, err = _apimeta.ApplyGalleryToken(rctx, r, auth)
+	if err != nil {
+		if !restrictions.IsRejectedGalleryToken(err) {
+			rctx.Log.Error("Error checking gallery token: ", err)
+			sentry.CaptureException(err)
+			return _responses.InternalServerError("Unexpected Error")
+		}
+		return _responses.ErrorResponse{
+			Code:         common.ErrCodeForbidden,
+			Message:      "invalid, expired, or revoked gallery token",
+			InternalCode: common.ErrCodeForbidden,
+		}
+	}
+	if shouldWatermark(auth) {
+		canRedirect = false // we need the bytes to watermark them
+	}
+
 	recordOnly := false
 	if r.Method == http.MethodHead {
 		rctx.Log.Debug("HEAD request received - changing parameters")
@@ -72,6 +102,8 @@ func DownloadMedia(r *http.Request, rctx rcontext.RequestContext, auth _apimeta.
 		"allowRedirect":  canRedirect,
 		"authUserId":     auth.User.UserId,
 		"authServerName": auth.Server.ServerName,
+		"galleryRoomId":  auth.GalleryRoomId,
+		"format":         format,
 	})
 
 	if auth.User.UserId != "" {
@@ -81,12 +113,52 @@ func DownloadMedia(r *http.Request, rctx rcontext.RequestContext, auth _apimeta.
 		}
 	}
 
+	// Converted media is served from its own stored copy
+	if format != "" {
+		res := downloadConverted(r, rctx, auth, server, mediaId, filename, format, pipeline_convert.ConvertOpts{
+			DownloadOpts: pipeline_download.DownloadOpts{
+				FetchRemoteIfNeeded: downloadRemote,
+				BlockForReadUntil:   blockFor,
+				CanRedirect:         canRedirect,
+				AuthProvided:        auth.IsAuthenticated(),
+				Requester:           auth.Requester(),
+			},
+			Format: format,
+		})
+		if res != nil {
+			return res
+		}
+		// else the media is already in the requested format, so continue with a regular download
+	}
+
+	// Answer conditional requests from the record alone, without touching the datastore
+	if !shouldWatermark(auth) && (r.Header.Get("If-None-Match") != "" || r.Header.Get("If-Modified-Since") != "") {
+		media, _, err := pipeline_download.Execute(rctx, server, mediaId, pipeline_download.DownloadOpts{
+			FetchRemoteIfNeeded: false,
+			BlockForReadUntil:   blockFor,
+			RecordOnly:          true,
+			AuthProvided:        auth.IsAuthenticated(),
+			Requester:           auth.Requester(),
+		})
+		// Errors are ignored here: the full download below reports them properly
+		if err == nil && media != nil {
+			etag := _apimeta.MediaETag(media.Sha256Hash)
+			if _apimeta.IsNotModified(r, etag, media.CreationTs) {
+				return &_responses.NotModifiedResponse{
+					ETag:           etag,
+					LastModifiedTs: media.CreationTs,
+				}
+			}
+		}
+	}
+
 	media, stream, err := pipeline_download.Execute(rctx, server, mediaId, pipeline_download.DownloadOpts{
 		FetchRemoteIfNeeded: downloadRemote,
 		BlockForReadUntil:   blockFor,
 		CanRedirect:         canRedirect,
 		RecordOnly:          recordOnly,
 		AuthProvided:        auth.IsAuthenticated(),
+		Requester:           auth.Requester(),
 	})
 	if err != nil {
 		var redirect datastores.RedirectError
@@ -98,6 +170,8 @@ func DownloadMedia(r *http.Request, rctx rcontext.RequestContext, auth _apimeta.
 				Message:      "authentication is required to download this media",
 				InternalCode: common.ErrCodeUnauthorized,
 			}
+		} else if errors.Is(err, common.ErrRestrictedRoomMembership) {
+			return _responses.NotFoundError() // We lie for security
 		} else if errors.Is(err, common.ErrMediaTooLarge) {
 			return _responses.RequestTooLarge()
 		} else if errors.Is(err, common.ErrRateLimitExceeded) {
@@ -111,6 +185,10 @@ func DownloadMedia(r *http.Request, rctx rcontext.RequestContext, auth _apimeta.
 			}
 		} else if errors.Is(err, common.ErrMediaNotYetUploaded) {
 			return _responses.NotYetUploaded()
+		} else if errors.Is(err, common.ErrOriginUnavailable) {
+			return _responses.BadGatewayError("remote server is unavailable")
+		} else if errors.Is(err, common.ErrReadOnlyInstance) {
+			return _responses.ForwardToWriteTier()
 		} else if errors.As(err, &redirect) {
 			return _responses.Redirect(redirect.RedirectUrl)
 		}
@@ -123,11 +201,13 @@ func DownloadMedia(r *http.Request, rctx rcontext.RequestContext, auth _apimeta.
 		filename = media.UploadName
 	}
 
-	return &_responses.DownloadResponse{
+	return watermarkResponse(rctx, auth, &_responses.DownloadResponse{
 		ContentType:       media.ContentType,
 		Filename:          filename,
 		SizeBytes:         media.SizeBytes,
 		Data:              stream,
 		TargetDisposition: "infer",
-	}
+		ETag:              _apimeta.MediaETag(media.Sha256Hash),
+		LastModifiedTs:    media.CreationTs,
+	})
 }
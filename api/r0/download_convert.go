@@ -0,0 +1,81 @@
+package r0
+
+import (
+	"errors"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/t2bot/matrix-media-repo/api/_apimeta"
+	"github.com/t2bot/matrix-media-repo/api/_responses"
+	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/datastores"
+	"github.com/t2bot/matrix-media-repo/pipelines/pipeline_convert"
+	"github.com/t2bot/matrix-media-repo/thumbnailing"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+// downloadConverted serves the media converted to the requested format. Returns nil if the media is already in that
+// format, and should be downloaded as normal.
+func downloadConverted(r *http.Request, rctx rcontext.RequestContext, auth _apimeta.AuthContext, server string, mediaId string, filename string, format string, opts pipeline_convert.ConvertOpts) interface{} {
+	conversion, stream, err := pipeline_convert.Execute(rctx, server, mediaId, opts)
+	if err != nil {
+		var redirect datastores.RedirectError
+		if errors.Is(err, pipeline_convert.ErrAlreadyInFormat) {
+			return nil
+		} else if errors.Is(err, common.ErrMediaNotFound) {
+			return _responses.NotFoundError()
+		} else if errors.Is(err, common.ErrRestrictedAuth) {
+			return _responses.ErrorResponse{
+				Code:         common.ErrCodeNotFound,
+				Message:      "authentication is required to download this media",
+				InternalCode: common.ErrCodeUnauthorized,
+			}
+		} else if errors.Is(err, common.ErrRestrictedRoomMembership) {
+			return _responses.NotFoundError() // We lie for security
+		} else if errors.Is(err, common.ErrMediaTooLarge) {
+			return _responses.RequestTooLarge()
+		} else if errors.Is(err, common.ErrRateLimitExceeded) {
+			return _responses.RateLimitReached()
+		} else if errors.Is(err, common.ErrMediaQuarantined) {
+			return _responses.NotFoundError() // We lie for security
+		} else if errors.Is(err, common.ErrMediaNotYetUploaded) {
+			return _responses.NotYetUploaded()
+		} else if errors.Is(err, common.ErrOriginUnavailable) {
+			return _responses.BadGatewayError("remote server is unavailable")
+		} else if errors.Is(err, common.ErrReadOnlyInstance) {
+			return _responses.ForwardToWriteTier()
+		} else if errors.Is(err, thumbnailing.ErrUnsupported) {
+			return _responses.BadRequest("media cannot be converted to " + format)
+		} else if errors.As(err, &redirect) {
+			return _responses.Redirect(redirect.RedirectUrl)
+		}
+		rctx.Log.Error("Unexpected error converting media: ", err)
+		sentry.CaptureException(err)
+		return _responses.InternalServerError("Unexpected Error")
+	}
+
+	etag := _apimeta.ThumbnailETag(conversion)
+	if !shouldWatermark(auth) && _apimeta.IsNotModified(r, etag, conversion.CreationTs) {
+		_ = stream.Close()
+		return &_responses.NotModifiedResponse{
+			ETag:           etag,
+			LastModifiedTs: conversion.CreationTs,
+		}
+	}
+
+	if filename != "" {
+		filename = strings.TrimSuffix(filename, path.Ext(filename)) + util.ExtensionForContentType(conversion.ContentType)
+	}
+	return watermarkResponse(rctx, auth, &_responses.DownloadResponse{
+		ContentType:       conversion.ContentType,
+		Filename:          filename,
+		SizeBytes:         conversion.SizeBytes,
+		Data:              stream,
+		TargetDisposition: "infer",
+		ETag:              etag,
+		LastModifiedTs:    conversion.CreationTs,
+	})
+}
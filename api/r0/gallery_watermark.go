@@ -0,0 +1,43 @@
+package r0
+
+import (
+	"bytes"
+	"errors"
+	"io"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/t2bot/matrix-media-repo/api/_apimeta"
+	"github.com/t2bot/matrix-media-repo/api/_responses"
+	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/thumbnailing"
+)
+
+// shouldWatermark returns true if media served to the auth context needs the gallery token's watermark.
+func shouldWatermark(auth _apimeta.AuthContext) bool {
+	return auth.GalleryTokenId != "" && config.Get().GalleryLinks.Watermark.Enabled
+}
+
+// watermarkResponse stamps the gallery token's ID onto the response's image, if it has one. Failures are not
+// served unmarked: the response is replaced with an error instead.
+func watermarkResponse(rctx rcontext.RequestContext, auth _apimeta.AuthContext, res *_responses.DownloadResponse) interface{} {
+	if !shouldWatermark(auth) || res.Data == nil || !thumbnailing.CanWatermark(res.ContentType) {
+		return res
+	}
+
+	b, err := thumbnailing.Watermark(rctx, res.Data, res.ContentType, auth.GalleryTokenId, config.Get().GalleryLinks.Watermark.Opacity)
+	if err != nil {
+		if errors.Is(err, common.ErrMediaTooLarge) {
+			return _responses.RequestTooLarge()
+		}
+		rctx.Log.Error("Error watermarking media: ", err)
+		sentry.CaptureException(err)
+		return _responses.InternalServerError("Unexpected Error")
+	}
+
+	res.Data = io.NopCloser(bytes.NewReader(b))
+	res.SizeBytes = int64(len(b))
+	res.ETag = "" // the watermark differs per token
+	return res
+}
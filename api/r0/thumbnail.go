@@ -4,6 +4,7 @@ import (
 	"errors"
 	"net/http"
 	"strconv"
+	"strings"
 
 	"github.com/getsentry/sentry-go"
 	"github.com/t2bot/matrix-media-repo/api/_apimeta"
@@ -13,6 +14,8 @@ import (
 	"github.com/t2bot/matrix-media-repo/datastores"
 	"github.com/t2bot/matrix-media-repo/pipelines/pipeline_download"
 	"github.com/t2bot/matrix-media-repo/pipelines/pipeline_thumbnail"
+	"github.com/t2bot/matrix-media-repo/restrictions"
+	"github.com/t2bot/matrix-media-repo/thumbnailing"
 	"github.com/t2bot/matrix-media-repo/util"
 
 	"github.com/sirupsen/logrus"
@@ -58,6 +61,23 @@ func ThumbnailMedia(r *http.Request, rctx rcontext.RequestContext, auth _apimeta
 		return _responses.BadRequest("timeout_ms does not appear to be an integer")
 	}
 
+	auth, err = _apimeta.ApplyGalleryToken(rctx, r, auth)
+	if err != nil {
+		if !restrictions.IsRejectedGalleryToken(err) {
+			rctx.Log.Error("Error checking gallery token: ", err)
+			sentry.CaptureException(err)
+			return _responses.InternalServerError("Unexpected Error")
+		}
+		return _responses.ErrorResponse{
+			Code:         common.ErrCodeForbidden,
+			Message:      "invalid, expired, or revoked gallery token",
+			InternalCode: common.ErrCodeForbidden,
+		}
+	}
+	if shouldWatermark(auth) {
+		canRedirect = false // we need the bytes to watermark them
+	}
+
 	rctx = rctx.LogWithFields(logrus.Fields{
 		"mediaId":        mediaId,
 		"server":         server,
@@ -65,6 +85,7 @@ func ThumbnailMedia(r *http.Request, rctx rcontext.RequestContext, auth _apimeta
 		"allowRedirect":  canRedirect,
 		"authUserId":     auth.User.UserId,
 		"authServerName": auth.Server.ServerName,
+		"galleryRoomId":  auth.GalleryRoomId,
 	})
 
 	if auth.User.UserId != "" {
@@ -115,11 +136,26 @@ func ThumbnailMedia(r *http.Request, rctx rcontext.RequestContext, auth _apimeta
 		method = "scale"
 	}
 
+	format := thumbnailing.FormatNative
+	negotiated := false
+	if formatStr := r.URL.Query().Get("format"); formatStr != "" {
+		if formatStr != thumbnailing.FormatWebP && formatStr != thumbnailing.FormatAvif && formatStr != "native" {
+			return _responses.BadRequest("format must be one of native, webp, or avif")
+		}
+		if formatStr != "native" && thumbnailing.IsFormatEnabled(rctx, formatStr) {
+			format = formatStr
+		}
+	} else {
+		format = negotiateThumbnailFormat(rctx, r.Header.Get("Accept"))
+		negotiated = true
+	}
+
 	rctx = rctx.LogWithFields(logrus.Fields{
 		"requestedWidth":    width,
 		"requestedHeight":   height,
 		"requestedMethod":   method,
 		"requestedAnimated": animated,
+		"requestedFormat":   format,
 	})
 
 	if width <= 0 || height <= 0 {
@@ -133,11 +169,13 @@ func ThumbnailMedia(r *http.Request, rctx rcontext.RequestContext, auth _apimeta
 			RecordOnly:          false, // overridden
 			CanRedirect:         canRedirect,
 			AuthProvided:        auth.IsAuthenticated(),
+			Requester:           auth.Requester(),
 		},
 		Width:    width,
 		Height:   height,
 		Method:   method,
 		Animated: animated,
+		Format:   format,
 	})
 	if err != nil {
 		var redirect datastores.RedirectError
@@ -149,6 +187,8 @@ func ThumbnailMedia(r *http.Request, rctx rcontext.RequestContext, auth _apimeta
 				Message:      "authentication is required to download this media",
 				InternalCode: common.ErrCodeUnauthorized,
 			}
+		} else if errors.Is(err, common.ErrRestrictedRoomMembership) {
+			return _responses.NotFoundError() // We lie for security
 		} else if errors.Is(err, common.ErrMediaTooLarge) {
 			return _responses.RequestTooLarge()
 		} else if errors.Is(err, common.ErrRateLimitExceeded) {
@@ -162,6 +202,12 @@ func ThumbnailMedia(r *http.Request, rctx rcontext.RequestContext, auth _apimeta
 			}
 		} else if errors.Is(err, common.ErrMediaNotYetUploaded) {
 			return _responses.NotYetUploaded()
+		} else if errors.Is(err, common.ErrOriginUnavailable) {
+			return _responses.BadGatewayError("remote server is unavailable")
+		} else if errors.Is(err, common.ErrReadOnlyInstance) {
+			return _responses.ForwardToWriteTier()
+		} else if errors.Is(err, thumbnailing.ErrUnsupported) {
+			return _responses.BadRequest("media cannot be thumbnailed")
 		} else if errors.Is(err, common.ErrMediaDimensionsTooSmall) {
 			if stream == nil {
 				return _responses.NotFoundError() // something went wrong so just 404 the thumbnail
@@ -175,13 +221,13 @@ func ThumbnailMedia(r *http.Request, rctx rcontext.RequestContext, auth _apimeta
 				sentry.CaptureException(err)
 				return _responses.InternalServerError("Unexpected Error")
 			} else {
-				return &_responses.DownloadResponse{
+				return watermarkResponse(rctx, auth, &_responses.DownloadResponse{
 					ContentType:       record.ContentType,
 					Filename:          record.UploadName,
 					SizeBytes:         record.SizeBytes,
 					Data:              stream,
 					TargetDisposition: "infer",
-				}
+				})
 			}
 		} else if errors.As(err, &redirect) {
 			return _responses.Redirect(redirect.RedirectUrl)
@@ -191,11 +237,44 @@ func ThumbnailMedia(r *http.Request, rctx rcontext.RequestContext, auth _apimeta
 		return _responses.InternalServerError("Unexpected Error")
 	}
 
-	return &_responses.DownloadResponse{
+	vary := ""
+	if negotiated {
+		vary = "Accept"
+	}
+	return watermarkResponse(rctx, auth, &_responses.DownloadResponse{
 		ContentType:       thumbnail.ContentType,
 		Filename:          "thumbnail" + util.ExtensionForContentType(thumbnail.ContentType),
 		SizeBytes:         thumbnail.SizeBytes,
 		Data:              stream,
 		TargetDisposition: "infer",
+		ETag:              _apimeta.ThumbnailETag(thumbnail),
+		LastModifiedTs:    thumbnail.CreationTs,
+		Vary:              vary,
+	})
+}
+
+// negotiateThumbnailFormat picks the preferred enabled output format from an Accept header. Only
+// explicitly listed types are considered: wildcards are treated as a request for the native format.
+func negotiateThumbnailFormat(rctx rcontext.RequestContext, accept string) string {
+	accepted := make(map[string]bool)
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		mediaType := strings.ToLower(strings.TrimSpace(params[0]))
+		rejected := false
+		for _, param := range params[1:] {
+			if q, ok := strings.CutPrefix(strings.TrimSpace(param), "q="); ok {
+				if val, err := strconv.ParseFloat(q, 64); err == nil && val <= 0 {
+					rejected = true
+				}
+			}
+		}
+		accepted[mediaType] = !rejected
+	}
+
+	for _, format := range []string{thumbnailing.FormatAvif, thumbnailing.FormatWebP} {
+		if accepted[thumbnailing.FormatContentType(format)] && thumbnailing.IsFormatEnabled(rctx, format) {
+			return format
+		}
 	}
+	return thumbnailing.FormatNative
 }
@@ -3,7 +3,6 @@ package r0
 import (
 	"errors"
 	"net/http"
-	"path/filepath"
 
 	"github.com/getsentry/sentry-go"
 	"github.com/sirupsen/logrus"
@@ -12,13 +11,17 @@ import (
 	"github.com/t2bot/matrix-media-repo/api/_routers"
 	"github.com/t2bot/matrix-media-repo/common"
 	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/limits"
+	"github.com/t2bot/matrix-media-repo/pipelines/_steps/upload"
 	"github.com/t2bot/matrix-media-repo/pipelines/pipeline_upload"
+	"github.com/t2bot/matrix-media-repo/preferences"
 )
 
 func UploadMediaAsync(r *http.Request, rctx rcontext.RequestContext, user _apimeta.UserInfo) interface{} {
 	server := _routers.GetParam("server", r)
 	mediaId := _routers.GetParam("mediaId", r)
-	filename := filepath.Base(r.URL.Query().Get("filename"))
+	filename := r.URL.Query().Get("filename") // sanitized by the upload pipeline
 
 	rctx = rctx.LogWithFields(logrus.Fields{
 		"mediaId":  mediaId,
@@ -39,16 +42,64 @@ func UploadMediaAsync(r *http.Request, rctx rcontext.RequestContext, user _apime
 		contentType = "application/octet-stream" // binary
 	}
 
+	if r.URL.Query().Get("purpose") == string(database.PurposeEmoji) {
+		rctx = upload.FlagEmoji(rctx)
+	}
+
+	// The upload pipeline applies the user's stored preferences, so make sure they're current
+	preferences.Refresh(rctx, user.UserId, user.AccessToken)
+
+	rctx, attestationRes := checkUploadAttestation(rctx, r, user)
+	if attestationRes != nil {
+		return attestationRes
+	}
+
 	// Early sizing constraints (reject requests which claim to be too large/small)
 	if sizeRes := uploadRequestSizeCheck(rctx, r); sizeRes != nil {
 		return sizeRes
 	}
+	if limitRes := uploadRateLimitCheck(rctx, r, user, r.ContentLength); limitRes != nil {
+		return limitRes
+	}
+
+	roomIds, err := _apimeta.GetRequestRoomIds(r, rctx, user, nil)
+	if errors.Is(err, common.ErrNotJoinedToRoom) {
+		return _responses.Forbidden(err.Error())
+	} else if err != nil {
+		return _responses.BadRequest(err.Error())
+	}
 
 	// Actually upload
-	_, err := pipeline_upload.ExecutePut(rctx, server, mediaId, r.Body, contentType, filename, user.UserId)
+	media, err := pipeline_upload.ExecutePut(rctx, server, mediaId, r.Body, contentType, filename, user.UserId, roomIds)
 	if err != nil {
 		if errors.Is(err, common.ErrQuotaExceeded) {
 			return _responses.QuotaExceeded()
+		} else if errors.Is(err, common.ErrInsufficientStorage) {
+			return _responses.InsufficientStorage()
+		} else if errors.Is(err, common.ErrAttestationRequired) {
+			return _responses.AttestationRequired()
+		} else if errors.Is(err, common.ErrRateLimitExceeded) {
+			var limitErr *limits.RateLimitError
+			if errors.As(err, &limitErr) {
+				return _responses.RateLimitedFor(limitErr.RetryAfter)
+			}
+			return _responses.RateLimitReached()
+		} else if errors.Is(err, common.ErrMediaInfected) {
+			return _responses.MediaInfected()
+		} else if errors.Is(err, common.ErrMediaTooLargeToScan) {
+			return _responses.MediaTooLargeToScan()
+		} else if errors.Is(err, common.ErrMediaScanFailed) {
+			rctx.Log.Error("Error scanning media: ", err)
+			sentry.CaptureException(err)
+			return _responses.InternalServerError("The upload could not be scanned for viruses.")
+		} else if errors.Is(err, common.ErrMediaHashCheckFailed) {
+			rctx.Log.Error("Error checking media against hash lists: ", err)
+			sentry.CaptureException(err)
+			return _responses.InternalServerError("The upload could not be checked against hash lists.")
+		} else if errors.Is(err, common.ErrMediaNotPersisted) {
+			rctx.Log.Error("Error persisting media: ", err)
+			sentry.CaptureException(err)
+			return _responses.InternalServerError("Failed to save the upload. No media or references were recorded.")
 		} else if errors.Is(err, common.ErrAlreadyUploaded) {
 			return &_responses.ErrorResponse{
 				Code:         common.ErrCodeCannotOverwrite,
@@ -73,7 +124,8 @@ func UploadMediaAsync(r *http.Request, rctx rcontext.RequestContext, user _apime
 		return _responses.InternalServerError("Unexpected Error")
 	}
 
-	return &MediaUploadedResponse{
-		//ContentUri: util.MxcUri(media.Origin, media.MediaId), // This endpoint doesn't return a URI
-	}
+	res := NewMediaUploadedResponse(media)
+	res.ContentUri = "" // This endpoint doesn't return a URI
+	addBlurhash(r, rctx, media, res)
+	return res
 }
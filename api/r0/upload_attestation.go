@@ -0,0 +1,36 @@
+package r0
+
+import (
+	"net/http"
+
+	"github.com/t2bot/matrix-media-repo/api/_apimeta"
+	"github.com/t2bot/matrix-media-repo/api/_responses"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/pipelines/_steps/upload"
+)
+
+// attestationHeader carries the signed attestation for large uploads.
+const attestationHeader = "X-Upload-Attestation"
+
+// checkUploadAttestation verifies the attestation sent with the upload (if any), and flags the context so the upload
+// pipeline checks the attestation against the upload's actual size. Uploads which claim to be larger than their
+// attestation allows are refused before their body is read.
+func checkUploadAttestation(rctx rcontext.RequestContext, r *http.Request, user _apimeta.UserInfo) (rcontext.RequestContext, *_responses.ErrorResponse) {
+	if !rctx.Config.Uploads.Attestation.Enabled {
+		return rctx, nil
+	}
+
+	var attestation *upload.Attestation
+	if token := r.Header.Get(attestationHeader); token != "" {
+		var err error
+		if attestation, err = upload.VerifyAttestation(rctx, token, user.UserId); err != nil {
+			rctx.Log.Info("Refusing upload with invalid attestation: ", err)
+			return rctx, _responses.InvalidAttestation()
+		}
+	}
+	rctx = upload.FlagAttestation(rctx, attestation)
+	if err := upload.CheckAttestation(rctx, r.ContentLength, ""); err != nil {
+		return rctx, _responses.AttestationRequired()
+	}
+	return rctx, nil
+}
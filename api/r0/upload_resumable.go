@@ -0,0 +1,169 @@
+package r0
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-media-repo/api/_apimeta"
+	"github.com/t2bot/matrix-media-repo/api/_responses"
+	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/pipelines/_steps/upload"
+)
+
+type UploadProgressResponse struct {
+	ReceivedBytes int64 `json:"received_bytes"`
+	TotalBytes    int64 `json:"total_bytes"`
+}
+
+func uploadResumable(r *http.Request, rctx rcontext.RequestContext, user _apimeta.UserInfo, idempotencyKey string, contentRange string, contentType string, filename string, roomIds []string) interface{} {
+	offset := int64(0)
+	totalBytes := r.ContentLength
+	if contentRange != "" {
+		start, total, err := parseContentRange(contentRange)
+		if err != nil {
+			return _responses.BadRequest(err.Error())
+		}
+		if start < 0 {
+			// Status query: report what we have so far
+			record, err := upload.GetPartialUpload(rctx, user.UserId, idempotencyKey)
+			if err != nil {
+				rctx.Log.Error("Error looking up partial upload: ", err)
+				sentry.CaptureException(err)
+				return _responses.InternalServerError("Unexpected Error")
+			}
+			if record == nil {
+				return partialUploadNotFound()
+			}
+			return &_responses.DoNotCacheResponse{Payload: &UploadProgressResponse{
+				ReceivedBytes: record.ReceivedBytes,
+				TotalBytes:    record.TotalBytes,
+			}}
+		}
+		offset = start
+		totalBytes = total
+	}
+
+	if !upload.IsResumableUpload(rctx, idempotencyKey, totalBytes) {
+		return _responses.BadRequest("Resumable uploads are not available for this upload")
+	}
+	if sizeRes := uploadTotalSizeCheck(rctx, totalBytes); sizeRes != nil {
+		return sizeRes
+	}
+	if err := upload.CheckAttestation(rctx, totalBytes, ""); err != nil {
+		return _responses.AttestationRequired()
+	}
+	if limitRes := uploadRateLimitCheck(rctx, r, user, totalBytes); limitRes != nil {
+		return limitRes
+	}
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"resumeOffset": offset,
+		"totalBytes":   totalBytes,
+	})
+
+	record, err := upload.ReceivePartialUpload(rctx, user.UserId, idempotencyKey, contentType, filename, r.Body, offset, totalBytes)
+	if err != nil {
+		if errors.Is(err, common.ErrPartialUploadNotFound) {
+			return partialUploadNotFound()
+		} else if errors.Is(err, common.ErrPartialUploadInProgress) {
+			return _responses.IdempotencyKeyInUse()
+		} else if errors.Is(err, common.ErrPartialUploadLimit) {
+			return _responses.ErrorResponse{
+				Code:         common.ErrCodeResourceLimitExceeded,
+				Message:      "Too many unfinished resumable uploads. Finish or abandon an existing upload first.",
+				InternalCode: common.ErrCodeForbidden,
+			}
+		} else if errors.Is(err, common.ErrInsufficientStorage) {
+			return _responses.InsufficientStorage()
+		} else if errors.Is(err, common.ErrPartialUploadOffset) {
+			return _responses.BadRequest(fmt.Sprintf("Upload must continue from byte %d of %d", record.ReceivedBytes, record.TotalBytes))
+		} else if record != nil {
+			rctx.Log.Warnf("Upload interrupted after %d of %d bytes; it can be resumed: %s", record.ReceivedBytes, record.TotalBytes, err)
+			return _responses.BadRequest(fmt.Sprintf("Upload interrupted after %d of %d bytes", record.ReceivedBytes, record.TotalBytes))
+		}
+		rctx.Log.Error("Error receiving partial upload: ", err)
+		sentry.CaptureException(err)
+		return _responses.InternalServerError("Unexpected Error")
+	}
+
+	if record.ReceivedBytes < record.TotalBytes {
+		return &_responses.DoNotCacheResponse{Payload: &UploadProgressResponse{
+			ReceivedBytes: record.ReceivedBytes,
+			TotalBytes:    record.TotalBytes,
+		}}
+	}
+
+	f, err := upload.OpenPartialUpload(record)
+	if err != nil {
+		rctx.Log.Error("Error opening partial upload: ", err)
+		sentry.CaptureException(err)
+		return _responses.InternalServerError("Unexpected Error")
+	}
+	res := finishSyncUpload(r, rctx, user, idempotencyKey, f, record.ContentType, record.UploadName, roomIds)
+	if _, ok := res.(*MediaUploadedResponse); ok {
+		if err = upload.DeletePartialUpload(rctx, record); err != nil {
+			rctx.Log.Warn("Non-fatal error deleting completed partial upload: ", err)
+			sentry.CaptureException(err)
+		}
+	}
+	return res
+}
+
+// parseContentRange parses `bytes <start>-<end>/<total>` and `bytes */<total>`. The start is -1 for the
+// latter form, which asks for the upload's progress.
+func parseContentRange(header string) (int64, int64, error) {
+	spec, found := strings.CutPrefix(header, "bytes ")
+	if !found {
+		return 0, 0, errors.New("content-range must be in bytes")
+	}
+	rangeStr, totalStr, found := strings.Cut(spec, "/")
+	if !found {
+		return 0, 0, errors.New("content-range is missing a total size")
+	}
+	total, err := strconv.ParseInt(totalStr, 10, 64)
+	if err != nil || total <= 0 {
+		return 0, 0, errors.New("content-range has an invalid total size")
+	}
+	if rangeStr == "*" {
+		return -1, total, nil
+	}
+	startStr, endStr, found := strings.Cut(rangeStr, "-")
+	if !found {
+		return 0, 0, errors.New("content-range has an invalid range")
+	}
+	start, err := strconv.ParseInt(startStr, 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, errors.New("content-range has an invalid start")
+	}
+	end, err := strconv.ParseInt(endStr, 10, 64)
+	if err != nil || end < start || end >= total {
+		return 0, 0, errors.New("content-range has an invalid end")
+	}
+	return start, total, nil
+}
+
+func uploadTotalSizeCheck(rctx rcontext.RequestContext, totalBytes int64) *_responses.ErrorResponse {
+	maxSize := rctx.Config.Uploads.MaxSizeBytes
+	minSize := rctx.Config.Uploads.MinSizeBytes
+	if maxSize > 0 && maxSize < totalBytes {
+		return _responses.RequestTooLarge()
+	}
+	if minSize > 0 && minSize > totalBytes {
+		return _responses.RequestTooSmall()
+	}
+	return nil
+}
+
+func partialUploadNotFound() *_responses.ErrorResponse {
+	return &_responses.ErrorResponse{
+		Code:         common.ErrCodeNotFound,
+		Message:      "No partial upload exists for this idempotency key. Restart the upload.",
+		InternalCode: common.ErrCodeNotFound,
+	}
+}
@@ -2,8 +2,8 @@ package r0
 
 import (
 	"errors"
+	"io"
 	"net/http"
-	"path/filepath"
 	"strconv"
 
 	"github.com/getsentry/sentry-go"
@@ -12,17 +12,39 @@ import (
 	"github.com/t2bot/matrix-media-repo/api/_responses"
 	"github.com/t2bot/matrix-media-repo/common"
 	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
 	"github.com/t2bot/matrix-media-repo/datastores"
+	"github.com/t2bot/matrix-media-repo/limits"
+	"github.com/t2bot/matrix-media-repo/pipelines/_steps/download"
+	"github.com/t2bot/matrix-media-repo/pipelines/_steps/upload"
 	"github.com/t2bot/matrix-media-repo/pipelines/pipeline_upload"
+	"github.com/t2bot/matrix-media-repo/preferences"
+	"github.com/t2bot/matrix-media-repo/thumbnailing"
 	"github.com/t2bot/matrix-media-repo/util"
 )
 
 type MediaUploadedResponse struct {
 	ContentUri string `json:"content_uri,omitempty"`
+
+	// Vendored metadata about the media, as the server sees it
+	ContentType string `json:"io.t2bot.content_type,omitempty"`
+	SizeBytes   int64  `json:"io.t2bot.size,omitempty"`
+	Sha256      string `json:"io.t2bot.sha256,omitempty"`
+	Blurhash    string `json:"xyz.amorgan.blurhash,omitempty"`
+}
+
+// NewMediaUploadedResponse describes the uploaded media, including the server's view of its content type and size.
+func NewMediaUploadedResponse(media *database.DbMedia) *MediaUploadedResponse {
+	return &MediaUploadedResponse{
+		ContentUri:  util.MxcUri(media.Origin, media.MediaId),
+		ContentType: media.ContentType,
+		SizeBytes:   media.SizeBytes,
+		Sha256:      media.Sha256Hash,
+	}
 }
 
 func UploadMediaSync(r *http.Request, rctx rcontext.RequestContext, user _apimeta.UserInfo) interface{} {
-	filename := filepath.Base(r.URL.Query().Get("filename"))
+	filename := r.URL.Query().Get("filename") // sanitized by the upload pipeline
 
 	rctx = rctx.LogWithFields(logrus.Fields{
 		"filename": filename,
@@ -33,25 +55,159 @@ func UploadMediaSync(r *http.Request, rctx rcontext.RequestContext, user _apimet
 		contentType = "application/octet-stream" // binary
 	}
 
+	roomIds, err := _apimeta.GetRequestRoomIds(r, rctx, user, nil)
+	if errors.Is(err, common.ErrNotJoinedToRoom) {
+		return _responses.Forbidden(err.Error())
+	} else if err != nil {
+		return _responses.BadRequest(err.Error())
+	}
+
+	if r.URL.Query().Get("purpose") == string(database.PurposeEmoji) {
+		rctx = upload.FlagEmoji(rctx)
+	}
+
+	// The upload pipeline applies the user's stored preferences, so make sure they're current
+	preferences.Refresh(rctx, user.UserId, user.AccessToken)
+
+	rctx, attestationRes := checkUploadAttestation(rctx, r, user)
+	if attestationRes != nil {
+		return attestationRes
+	}
+
+	idempotencyKey := r.Header.Get("Idempotency-Key")
+	if idempotencyKey != "" {
+		rctx = rctx.LogWithFields(logrus.Fields{"idempotencyKey": idempotencyKey})
+		existing, err := upload.FindIdempotentMedia(rctx, user.UserId, idempotencyKey)
+		if err != nil {
+			rctx.Log.Error("Error looking up idempotency key: ", err)
+			sentry.CaptureException(err)
+			return _responses.InternalServerError("Unexpected Error")
+		}
+		if existing != nil {
+			rctx.Log.Info("Returning previously uploaded media for idempotency key")
+			return NewMediaUploadedResponse(existing)
+		}
+
+		contentRange := r.Header.Get("Content-Range")
+		if contentRange != "" || upload.IsResumableUpload(rctx, idempotencyKey, r.ContentLength) {
+			return uploadResumable(r, rctx, user, idempotencyKey, contentRange, contentType, filename, roomIds)
+		}
+	}
+
 	// Early sizing constraints (reject requests which claim to be too large/small)
 	if sizeRes := uploadRequestSizeCheck(rctx, r); sizeRes != nil {
 		return sizeRes
 	}
+	if limitRes := uploadRateLimitCheck(rctx, r, user, r.ContentLength); limitRes != nil {
+		return limitRes
+	}
+
+	return finishSyncUpload(r, rctx, user, idempotencyKey, r.Body, contentType, filename, roomIds)
+}
+
+func finishSyncUpload(r *http.Request, rctx rcontext.RequestContext, user _apimeta.UserInfo, idempotencyKey string, body io.ReadCloser, contentType string, filename string, roomIds []string) interface{} {
+	// Claim the idempotency key first so concurrent retries don't both store the media
+	if idempotencyKey != "" {
+		reserved, existing, err := upload.ReserveIdempotencyKey(rctx, user.UserId, idempotencyKey)
+		if err != nil {
+			body.Close()
+			rctx.Log.Error("Error reserving idempotency key: ", err)
+			sentry.CaptureException(err)
+			return _responses.InternalServerError("Unexpected Error")
+		}
+		if existing != nil {
+			body.Close()
+			rctx.Log.Info("Returning previously uploaded media for idempotency key")
+			return NewMediaUploadedResponse(existing)
+		}
+		if !reserved {
+			body.Close()
+			return _responses.IdempotencyKeyInUse()
+		}
+		defer upload.HoldIdempotencyKey(rctx, user.UserId, idempotencyKey)()
+	}
 
 	// Actually upload
-	media, err := pipeline_upload.Execute(rctx, r.Host, "", r.Body, contentType, filename, user.UserId, datastores.LocalMediaKind)
+	media, err := pipeline_upload.Execute(rctx, r.Host, "", body, contentType, filename, user.UserId, datastores.LocalMediaKind, roomIds)
 	if err != nil {
+		upload.ReleaseIdempotencyKey(rctx, user.UserId, idempotencyKey)
 		if errors.Is(err, common.ErrQuotaExceeded) {
 			return _responses.QuotaExceeded()
+		} else if errors.Is(err, common.ErrInsufficientStorage) {
+			return _responses.InsufficientStorage()
+		} else if errors.Is(err, common.ErrAttestationRequired) {
+			return _responses.AttestationRequired()
+		} else if errors.Is(err, common.ErrRateLimitExceeded) {
+			var limitErr *limits.RateLimitError
+			if errors.As(err, &limitErr) {
+				return _responses.RateLimitedFor(limitErr.RetryAfter)
+			}
+			return _responses.RateLimitReached()
+		} else if errors.Is(err, common.ErrMediaInfected) {
+			return _responses.MediaInfected()
+		} else if errors.Is(err, common.ErrMediaTooLargeToScan) {
+			return _responses.MediaTooLargeToScan()
+		} else if errors.Is(err, common.ErrMediaScanFailed) {
+			rctx.Log.Error("Error scanning media: ", err)
+			sentry.CaptureException(err)
+			return _responses.InternalServerError("The upload could not be scanned for viruses.")
+		} else if errors.Is(err, common.ErrMediaHashCheckFailed) {
+			rctx.Log.Error("Error checking media against hash lists: ", err)
+			sentry.CaptureException(err)
+			return _responses.InternalServerError("The upload could not be checked against hash lists.")
+		} else if errors.Is(err, common.ErrMediaNotPersisted) {
+			rctx.Log.Error("Error persisting media: ", err)
+			sentry.CaptureException(err)
+			return _responses.InternalServerError("Failed to save the upload. No media or references were recorded.")
 		}
 		rctx.Log.Error("Unexpected error uploading media: ", err)
 		sentry.CaptureException(err)
 		return _responses.InternalServerError("Unexpected Error")
 	}
 
-	return &MediaUploadedResponse{
-		ContentUri: util.MxcUri(media.Origin, media.MediaId),
+	if idempotencyKey != "" {
+		if err = upload.RecordIdempotencyKey(rctx, user.UserId, idempotencyKey, media); err != nil {
+			rctx.Log.Error("Error recording idempotency key: ", err)
+			sentry.CaptureException(err)
+			return _responses.InternalServerError("Unexpected Error")
+		}
 	}
+
+	rctx.AccessLog().MxcUri = util.MxcUri(media.Origin, media.MediaId)
+	res := NewMediaUploadedResponse(media)
+	addBlurhash(r, rctx, media, res)
+	return res
+}
+
+// addBlurhash populates the response's blurhash if the client asked for one. Failing to generate a blurhash does not
+// fail the upload.
+func addBlurhash(r *http.Request, rctx rcontext.RequestContext, media *database.DbMedia, res *MediaUploadedResponse) {
+	if !rctx.Config.Features.MSC2448Blurhash.Enabled {
+		return
+	}
+	if generate, _ := strconv.ParseBool(r.URL.Query().Get("xyz.amorgan.generate_blurhash")); !generate {
+		return
+	}
+	if !thumbnailing.IsSupported(media.ContentType) {
+		return
+	}
+
+	// Read back what was stored so async uploads (which may have landed anywhere) are treated the same as sync ones
+	stream, err := download.OpenStream(rctx, media.Locatable)
+	if err != nil {
+		rctx.Log.Warn("Non-fatal error opening media for blurhash: ", err)
+		sentry.CaptureException(err)
+		return
+	}
+	hash, err := thumbnailing.GenerateBlurhash(stream, media.ContentType, media.SizeBytes, rctx)
+	if err != nil {
+		if !errors.Is(err, thumbnailing.ErrUnsupported) && !errors.Is(err, common.ErrMediaTooLarge) {
+			rctx.Log.Warn("Non-fatal error generating blurhash: ", err)
+			sentry.CaptureException(err)
+		}
+		return
+	}
+	res.Blurhash = hash
 }
 
 func uploadRequestSizeCheck(rctx rcontext.RequestContext, r *http.Request) *_responses.ErrorResponse {
@@ -80,3 +236,20 @@ func uploadRequestSizeCheck(rctx rcontext.RequestContext, r *http.Request) *_res
 	}
 	return nil
 }
+
+// uploadRateLimitCheck rejects requests which would exceed the upload rate limits before their body is read. The
+// upload is only counted once the upload pipeline knows its size. For resumable uploads, declaredBytes is the total
+// size from the Content-Range header rather than the size of this request's body.
+func uploadRateLimitCheck(rctx rcontext.RequestContext, r *http.Request, user _apimeta.UserInfo, declaredBytes int64) interface{} {
+	err := limits.CheckUploadStart(rctx, user.UserId, r.Host, declaredBytes)
+	if err == nil {
+		return nil
+	}
+	var limitErr *limits.RateLimitError
+	if errors.As(err, &limitErr) {
+		return _responses.RateLimitedFor(limitErr.RetryAfter)
+	}
+	rctx.Log.Error("Error checking upload rate limits: ", err)
+	sentry.CaptureException(err)
+	return _responses.InternalServerError("Unexpected Error")
+}
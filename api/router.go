@@ -55,6 +55,14 @@ func finishCorsFn(w http.ResponseWriter, r *http.Request) {
 }
 
 func panicFn(w http.ResponseWriter, r *http.Request, i interface{}) {
+	if i == http.ErrAbortHandler {
+		// The response was deliberately cut short: let net/http drop the connection without reporting an error
+		if hub := sentry.GetHubFromContext(r.Context()); hub != nil {
+			hub.BindClient(nil)
+		}
+		panic(i)
+	}
+
 	logrus.Errorf("Panic received on %s %s: %s", r.Method, util.GetLogSafeUrl(r), i)
 
 	//goland:noinspection GoTypeAssertionOnErrors
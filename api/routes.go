@@ -36,7 +36,7 @@ func buildRoutes() http.Handler {
 	downloadRoute := makeRoute(_routers.OptionalAccessToken(r0.DownloadMediaUser), "download", counter)
 	register([]string{"GET", "HEAD"}, PrefixMedia, "download/:server/:mediaId/:filename", mxSpecV3Transition, router, downloadRoute)
 	register([]string{"GET", "HEAD"}, PrefixMedia, "download/:server/:mediaId", mxSpecV3Transition, router, downloadRoute)
-	register([]string{"GET"}, PrefixMedia, "thumbnail/:server/:mediaId", mxSpecV3Transition, router, makeRoute(_routers.OptionalAccessToken(r0.ThumbnailMediaUser), "thumbnail", counter))
+	register([]string{"GET", "HEAD"}, PrefixMedia, "thumbnail/:server/:mediaId", mxSpecV3Transition, router, makeRoute(_routers.OptionalAccessToken(r0.ThumbnailMediaUser), "thumbnail", counter))
 	previewUrlRoute := makeRoute(_routers.RequireAccessToken(r0.PreviewUrl), "url_preview", counter)
 	register([]string{"GET"}, PrefixMedia, "preview_url", mxSpecV3TransitionCS, router, previewUrlRoute)
 	register([]string{"GET"}, PrefixMedia, "identicon/*seed", mxR0, router, makeRoute(_routers.OptionalAccessToken(r0.Identicon), "identicon", counter))
@@ -49,18 +49,32 @@ func buildRoutes() http.Handler {
 	register([]string{"GET"}, PrefixClient, "media/preview_url", mxV1, router, previewUrlRoute)
 	register([]string{"GET"}, PrefixClient, "media/config", mxV1, router, configRoute)
 	authedDownloadRoute := makeRoute(_routers.RequireAccessToken(v1.ClientDownloadMedia), "download", counter)
-	register([]string{"GET"}, PrefixClient, "media/download/:server/:mediaId/:filename", mxV1, router, authedDownloadRoute)
-	register([]string{"GET"}, PrefixClient, "media/download/:server/:mediaId", mxV1, router, authedDownloadRoute)
-	register([]string{"GET"}, PrefixClient, "media/thumbnail/:server/:mediaId", mxV1, router, makeRoute(_routers.RequireAccessToken(v1.ClientThumbnailMedia), "thumbnail", counter))
+	register([]string{"GET", "HEAD"}, PrefixClient, "media/download/:server/:mediaId/:filename", mxV1, router, authedDownloadRoute)
+	register([]string{"GET", "HEAD"}, PrefixClient, "media/download/:server/:mediaId", mxV1, router, authedDownloadRoute)
+	register([]string{"GET", "HEAD"}, PrefixClient, "media/thumbnail/:server/:mediaId", mxV1, router, makeRoute(_routers.RequireAccessToken(v1.ClientThumbnailMedia), "thumbnail", counter))
 	register([]string{"GET"}, PrefixFederation, "media/download/:mediaId", mxV1, router, makeRoute(_routers.RequireServerAuth(v1.FederationDownloadMedia), "download", counter))
 	register([]string{"GET"}, PrefixFederation, "media/thumbnail/:mediaId", mxV1, router, makeRoute(_routers.RequireServerAuth(v1.FederationThumbnailMedia), "thumbnail", counter))
 
 	// Custom features
 	register([]string{"GET"}, PrefixMedia, "local_copy/:server/:mediaId", mxUnstable, router, makeRoute(_routers.RequireAccessToken(unstable.LocalCopy), "local_copy", counter))
+	register([]string{"POST"}, PrefixMedia, "clone/:server/:mediaId", mxUnstable, router, makeRoute(_routers.RequireAccessToken(unstable.CloneMedia), "clone_media", counter))
+	register([]string{"POST"}, PrefixMedia, "external", mxUnstable, router, makeRoute(_routers.RequireAccessToken(unstable.RegisterExternalMedia), "external_media", counter))
 	register([]string{"GET"}, PrefixMedia, "info/:server/:mediaId", mxUnstable, router, makeRoute(_routers.RequireAccessToken(unstable.MediaInfo), "info", counter))
 	purgeOneRoute := makeRoute(_routers.RequireAccessToken(custom.PurgeIndividualRecord), "purge_individual_media", counter)
 	register([]string{"DELETE"}, PrefixMedia, "download/:server/:mediaId", mxUnstable, router, purgeOneRoute)
 	register([]string{"GET"}, PrefixMedia, "usage", msc4034, router, makeRoute(_routers.RequireAccessToken(unstable.PublicUsage), "usage", counter))
+	register([]string{"GET"}, PrefixMedia, "usage", mxUnstable, router, makeRoute(_routers.RequireAccessToken(unstable.GetUsage), "unstable_usage", counter))
+	getReferencesRoute := makeRoute(_routers.RequireAccessToken(unstable.GetMediaReferences), "get_media_references", counter)
+	deleteReferenceRoute := makeRoute(_routers.RequireAccessToken(unstable.DeleteMediaReference), "delete_media_reference", counter)
+	register([]string{"GET"}, PrefixMedia, "reference/:server/:mediaId", mxUnstable, router, getReferencesRoute)
+	register([]string{"DELETE"}, PrefixMedia, "reference/:server/:mediaId", mxUnstable, router, deleteReferenceRoute)
+	register([]string{"GET"}, PrefixMedia, "media/:server/:mediaId/references", mxUnstable, router, getReferencesRoute)
+	register([]string{"DELETE"}, PrefixMedia, "media/:server/:mediaId/reference", mxUnstable, router, deleteReferenceRoute)
+	register([]string{"POST"}, PrefixMedia, "room/:roomId/gallery_link", mxUnstable, router, makeRoute(_routers.RequireAccessToken(unstable.CreateGalleryLink), "create_gallery_link", counter))
+	register([]string{"DELETE"}, PrefixMedia, "room/:roomId/gallery_link/:tokenId", mxUnstable, router, makeRoute(_routers.RequireAccessToken(unstable.RevokeGalleryLink), "revoke_gallery_link", counter))
+	register([]string{"GET"}, PrefixMedia, "gallery", mxUnstable, router, makeRoute(unstable.GetGallery, "get_gallery", counter))
+	register([]string{"GET"}, PrefixMedia, "preferences", mxUnstable, router, makeRoute(_routers.RequireAccessToken(unstable.GetPreferences), "get_preferences", counter))
+	register([]string{"PUT"}, PrefixMedia, "preferences", mxUnstable, router, makeRoute(_routers.RequireAccessToken(unstable.SetPreferences), "set_preferences", counter))
 
 	// Custom and top-level features
 	router.Handler("GET", fmt.Sprintf("%s/version", PrefixMedia), makeRoute(_routers.OptionalAccessToken(custom.GetVersion), "get_version", counter))
@@ -68,6 +82,9 @@ func buildRoutes() http.Handler {
 	router.Handler("GET", "/healthz", healthzRoute)
 	router.Handler("HEAD", "/healthz", healthzRoute)
 
+	// Membership changes pushed by the homeserver when the media repo is registered as an appservice
+	router.Handler("PUT", "/_matrix/app/v1/transactions/:txnId", makeRoute(custom.HandleAppserviceTransaction, "appservice_transaction", counter))
+
 	// Register the Synapse admin API endpoints we're compatible with
 	synUserStatsRoute := makeRoute(_routers.RequireAccessToken(custom.SynGetUsersMediaStats), "users_usage_stats", counter)
 	register([]string{"GET"}, synapse.PrefixAdminApi, "statistics/users/media", mxV1, router, synUserStatsRoute)
@@ -76,7 +93,9 @@ func buildRoutes() http.Handler {
 	purgeRemoteRoute := makeRoute(_routers.RequireRepoAdmin(custom.PurgeRemoteMedia), "purge_remote_media", counter)
 	purgeBranch := branchedRoute([]branch{
 		{"remote", purgeRemoteRoute},
+		{"remote/not_accessed", makeRoute(_routers.RequireRepoAdmin(custom.PurgeUnusedRemoteMedia), "purge_unused_remote_media", counter)},
 		{"old", makeRoute(_routers.RequireRepoAdmin(custom.PurgeOldMedia), "purge_old_media", counter)},
+		{"unreferenced", makeRoute(_routers.RequireRepoAdmin(custom.PurgeUnreferencedMedia), "purge_unreferenced_media", counter)},
 		{"quarantined", makeRoute(_routers.RequireAccessToken(custom.PurgeQuarantined), "purge_quarantined", counter)},
 		{"user/:userId", makeRoute(_routers.RequireAccessToken(custom.PurgeUserMedia), "purge_user_media", counter)},
 		{"room/:roomId", makeRoute(_routers.RequireAccessToken(custom.PurgeRoomMedia), "purge_room_media", counter)},
@@ -92,46 +111,99 @@ func buildRoutes() http.Handler {
 		{"user/:userId", makeRoute(_routers.RequireAccessToken(custom.QuarantineUserMedia), "quarantine_user", counter)},
 		{"server/:serverName", makeRoute(_routers.RequireAccessToken(custom.QuarantineDomainMedia), "quarantine_domain", counter)},
 		{":server/:mediaId", makeRoute(_routers.RequireAccessToken(custom.QuarantineMedia), "quarantine_media", counter)},
+		{":server/:mediaId/approve", makeRoute(_routers.RequireAccessToken(custom.ApproveQuarantinedMedia), "approve_quarantined_media", counter)},
+		{":server/:mediaId/purge", makeRoute(_routers.RequireAccessToken(custom.PurgeQuarantinedMedia), "purge_quarantined_media", counter)},
 	})
 	register([]string{"POST"}, PrefixMedia, "admin/quarantine/*branch", mxUnstable, router, quarantineBranch)
+	quarantineReviewBranch := branchedRoute([]branch{
+		{"review", makeRoute(_routers.RequireAccessToken(custom.ListQuarantinedMedia), "list_quarantined_media", counter)},
+		{":server/:mediaId/history", makeRoute(_routers.RequireAccessToken(custom.GetQuarantineHistory), "get_quarantine_history", counter)},
+	})
+	register([]string{"GET"}, PrefixMedia, "admin/quarantine/*branch", mxUnstable, router, quarantineReviewBranch)
 	register([]string{"POST"}, PrefixClient, "admin/quarantine_media/:roomId", mxUnstable, router, quarantineRoomRoute) // synapse compat
 	register([]string{"GET"}, PrefixMedia, "admin/datastores/:datastoreId/size_estimate", mxUnstable, router, makeRoute(_routers.RequireRepoAdmin(custom.GetDatastoreStorageEstimate), "get_storage_estimate", counter))
+	register([]string{"GET"}, PrefixMedia, "admin/datastores/:datastoreId/health", mxUnstable, router, makeRoute(_routers.RequireRepoAdmin(custom.GetDatastoreHealth), "get_datastore_health", counter))
 	register([]string{"POST"}, PrefixMedia, "admin/datastores/:sourceDsId/transfer_to/:targetDsId", mxUnstable, router, makeRoute(_routers.RequireRepoAdmin(custom.MigrateBetweenDatastores), "datastore_transfer", counter))
 	register([]string{"GET"}, PrefixMedia, "admin/datastores", mxUnstable, router, makeRoute(_routers.RequireRepoAdmin(custom.GetDatastores), "list_datastores", counter))
+	register([]string{"POST"}, PrefixMedia, "admin/config/reload", mxUnstable, router, makeRoute(_routers.RequireRepoAdmin(custom.ReloadConfig), "reload_config", counter))
 	register([]string{"GET"}, PrefixMedia, "admin/federation/test/:serverName", mxUnstable, router, makeRoute(_routers.RequireRepoAdmin(custom.GetFederationInfo), "federation_test", counter))
 	register([]string{"GET"}, PrefixMedia, "admin/usage/:serverName", mxUnstable, router, makeRoute(_routers.RequireRepoAdmin(custom.GetDomainUsage), "domain_usage", counter))
 	register([]string{"GET"}, PrefixMedia, "admin/usage/:serverName/users", mxUnstable, router, makeRoute(_routers.RequireRepoAdmin(custom.GetUserUsage), "user_usage", counter))
 	register([]string{"GET"}, PrefixMedia, "admin/usage/:serverName/users-stats", mxUnstable, router, synUserStatsRoute)
 	register([]string{"GET"}, PrefixMedia, "admin/usage/:serverName/uploads", mxUnstable, router, makeRoute(_routers.RequireRepoAdmin(custom.GetUploadsUsage), "uploads_usage", counter))
+	register([]string{"GET"}, PrefixMedia, "admin/reports/storage", mxUnstable, router, makeRoute(_routers.RequireRepoAdmin(custom.GetStorageReport), "storage_report", counter))
+	register([]string{"POST"}, PrefixMedia, "admin/reports/retention_estimate", mxUnstable, router, makeRoute(_routers.RequireRepoAdmin(custom.EstimateRetentionPolicy), "retention_estimate", counter))
 	tasksBranch := branchedRoute([]branch{
 		{"all", makeRoute(_routers.RequireRepoAdmin(custom.ListAllTasks), "list_all_background_tasks", counter)},
 		{"unfinished", makeRoute(_routers.RequireRepoAdmin(custom.ListUnfinishedTasks), "list_unfinished_background_tasks", counter)},
 		{":taskId", makeRoute(_routers.RequireRepoAdmin(custom.GetTask), "get_background_task", counter)},
 	})
 	register([]string{"GET"}, PrefixMedia, "admin/tasks/*branch", mxUnstable, router, tasksBranch)
-	register([]string{"GET"}, PrefixMedia, "admin/users/quota", mxUnstable, router, makeRoute(_routers.RequireRepoAdmin(custom.GetUserQuota), "get_user_quota", counter))
+	usersBranch := branchedRoute([]branch{
+		{"quota", makeRoute(_routers.RequireRepoAdmin(custom.GetUserQuota), "get_user_quota", counter)},
+		{":userId/media", makeRoute(_routers.RequireAccessToken(custom.ListUserMedia), "list_user_media", counter)},
+	})
+	register([]string{"GET"}, PrefixMedia, "admin/users/*branch", mxUnstable, router, usersBranch)
 	register([]string{"PUT"}, PrefixMedia, "admin/users/quota", mxUnstable, router, makeRoute(_routers.RequireRepoAdmin(custom.SetUserQuota), "set_user_quota", counter))
 	register([]string{"POST"}, PrefixMedia, "admin/user/:userId/export", mxUnstable, router, makeRoute(_routers.RequireAccessToken(custom.ExportUserData), "export_user_data", counter))
+	register([]string{"POST"}, PrefixMedia, "export", mxUnstable, router, makeRoute(_routers.RequireAccessToken(custom.ExportOwnData), "export_own_data", counter))
 	register([]string{"POST"}, PrefixMedia, "admin/server/:serverName/export", mxUnstable, router, makeRoute(_routers.RequireAccessToken(custom.ExportServerData), "export_server_data", counter))
+	register([]string{"POST"}, PrefixMedia, "admin/room/:roomId/export", mxUnstable, router, makeRoute(_routers.RequireRepoAdmin(custom.ExportRoomData), "export_room_data", counter))
+	register([]string{"POST"}, PrefixMedia, "admin/references/repair", mxUnstable, router, makeRoute(_routers.RequireRepoAdmin(custom.RepairReferences), "repair_references", counter))
+	register([]string{"POST"}, PrefixMedia, "admin/room/:roomId/manifest", mxUnstable, router, makeRoute(_routers.RequireRepoAdmin(custom.PublishRoomManifest), "publish_room_manifest", counter))
+	register([]string{"GET"}, PrefixMedia, "admin/public_rooms", mxUnstable, router, makeRoute(_routers.RequireRepoAdmin(custom.GetPublicRooms), "get_public_rooms", counter))
+	register([]string{"GET"}, PrefixMedia, "admin/room/:roomId/public", mxUnstable, router, makeRoute(_routers.RequireRepoAdmin(custom.GetPublicRoom), "get_public_room", counter))
+	register([]string{"PUT", "DELETE"}, PrefixMedia, "admin/room/:roomId/public", mxUnstable, router, makeRoute(_routers.RequireRepoAdmin(custom.SetPublicRoom), "set_public_room", counter))
 	register([]string{"GET"}, PrefixMedia, "admin/export/:exportId/view", mxUnstable, router, makeRoute(_routers.OptionalAccessToken(custom.ViewExport), "view_export", counter))
 	register([]string{"GET"}, PrefixMedia, "admin/export/:exportId/metadata", mxUnstable, router, makeRoute(_routers.OptionalAccessToken(custom.GetExportMetadata), "get_export_metadata", counter))
 	register([]string{"GET"}, PrefixMedia, "admin/export/:exportId/part/:partId", mxUnstable, router, makeRoute(_routers.OptionalAccessToken(custom.DownloadExportPart), "download_export_part", counter))
+	register([]string{"GET"}, PrefixMedia, "admin/export/:exportId/download", mxUnstable, router, makeRoute(_routers.OptionalAccessToken(custom.DownloadExport), "download_export", counter))
 	register([]string{"DELETE"}, PrefixMedia, "admin/export/:exportId", mxUnstable, router, makeRoute(_routers.OptionalAccessToken(custom.DeleteExport), "delete_export", counter))
 	register([]string{"POST"}, PrefixMedia, "admin/import", mxUnstable, router, makeRoute(_routers.RequireRepoAdmin(custom.StartImport), "start_import", counter))
 	register([]string{"POST"}, PrefixMedia, "admin/import/:importId/part", mxUnstable, router, makeRoute(_routers.RequireRepoAdmin(custom.AppendToImport), "append_to_import", counter))
 	register([]string{"POST"}, PrefixMedia, "admin/import/:importId/close", mxUnstable, router, makeRoute(_routers.RequireRepoAdmin(custom.StopImport), "stop_import", counter))
+	register([]string{"POST"}, PrefixMedia, "admin/synapse/import", mxUnstable, router, makeRoute(_routers.RequireRepoAdmin(custom.StartSynapseImport), "start_synapse_import", counter))
+	register([]string{"GET"}, PrefixMedia, "admin/cache/media", mxUnstable, router, makeRoute(_routers.RequireRepoAdmin(custom.ListCachedMedia), "list_cached_media", counter))
+	register([]string{"DELETE"}, PrefixMedia, "admin/cache/media/:server/:mediaId", mxUnstable, router, makeRoute(_routers.RequireRepoAdmin(custom.EvictCachedMedia), "evict_cached_media", counter))
+	register([]string{"POST"}, PrefixMedia, "admin/media/:server/:mediaId/refresh", mxUnstable, router, makeRoute(_routers.RequireRepoAdmin(custom.RefreshRemoteMedia), "refresh_remote_media", counter))
+	register([]string{"GET"}, PrefixMedia, "admin/media/:server/:mediaId/location", mxUnstable, router, makeRoute(_routers.RequireRepoAdmin(custom.GetMediaLocation), "get_media_location", counter))
 	register([]string{"GET"}, PrefixMedia, "admin/media/:server/:mediaId/attributes", mxUnstable, router, makeRoute(_routers.RequireAccessToken(custom.GetAttributes), "get_media_attributes", counter))
 	register([]string{"POST"}, PrefixMedia, "admin/media/:server/:mediaId/attributes", mxUnstable, router, makeRoute(_routers.RequireAccessToken(custom.SetAttributes), "set_media_attributes", counter))
+	register([]string{"GET"}, PrefixMedia, "admin/media/:server/:mediaId/moderation", mxUnstable, router, makeRoute(_routers.RequireRepoAdmin(custom.GetMediaModerationDecisions), "get_media_moderation", counter))
+	register([]string{"GET"}, PrefixMedia, "admin/moderation/decisions", mxUnstable, router, makeRoute(_routers.RequireRepoAdmin(custom.ListModerationDecisions), "list_moderation_decisions", counter))
+	register([]string{"GET"}, PrefixMedia, "admin/replication/media", mxUnstable, router, makeRoute(_routers.RequireRepoAdmin(custom.ListReplicationMedia), "list_replication_media", counter))
+	register([]string{"GET"}, PrefixMedia, "admin/replication/media/:server/:mediaId/content", mxUnstable, router, makeRoute(_routers.RequireRepoAdmin(custom.DownloadReplicationMedia), "download_replication_media", counter))
+
+	// Internal routes are authorized by the homeserver's shared secret rather than an access token
+	register([]string{"POST"}, PrefixMedia, "internal/reference/:server/:mediaId", mxUnstable, router, makeRoute(_routers.RequireInternalSecret(custom.AddReference), "internal_add_reference", counter))
+	register([]string{"POST"}, PrefixMedia, "internal/redaction", mxUnstable, router, makeRoute(_routers.RequireInternalSecret(custom.HandleRedaction), "internal_redaction", counter))
+	register([]string{"POST"}, PrefixMedia, "internal/room_forgotten", mxUnstable, router, makeRoute(_routers.RequireInternalSecret(custom.HandleRoomForgotten), "internal_room_forgotten", counter))
+	register([]string{"POST"}, PrefixMedia, "internal/membership", mxUnstable, router, makeRoute(_routers.RequireInternalSecret(custom.HandleMembershipChanged), "internal_membership_changed", counter))
 
 	return router
 }
 
+// downloadTierRoutes are the routes served by instances with the "downloads" deployment role. Everything else is
+// forwarded to the write tier.
+var downloadTierRoutes = map[string]bool{
+	"download":        true,
+	"thumbnail":       true,
+	"identicon":       true,
+	"config":          true,
+	"client_versions": true,
+	"get_version":     true,
+	"healthz":         true,
+}
+
 func makeRoute(generator _routers.GeneratorFn, name string, counter *_routers.RequestCounter) http.Handler {
+	if !downloadTierRoutes[name] {
+		generator = _routers.RequireWriteTier(generator)
+	}
 	return _routers.NewInstallMetadataRouter(name == "healthz", name, counter,
 		_routers.NewInstallHeadersRouter(
 			_routers.NewHostRouter(
 				_routers.NewMetricsRequestRouter(
-					_routers.NewRContextRouter(generator, _routers.NewMetricsResponseRouter(nil)),
+					_routers.NewRContextRouter(generator, _routers.NewMetricsResponseRouter(_routers.NewAccessLogRouter(nil))),
 				),
 			),
 		))
@@ -0,0 +1,102 @@
+package unstable
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-media-repo/api/_apimeta"
+	"github.com/t2bot/matrix-media-repo/api/_responses"
+	"github.com/t2bot/matrix-media-repo/api/_routers"
+	"github.com/t2bot/matrix-media-repo/api/r0"
+	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/limits"
+	"github.com/t2bot/matrix-media-repo/pipelines/pipeline_download"
+	"github.com/t2bot/matrix-media-repo/pipelines/pipeline_upload"
+	"github.com/t2bot/matrix-media-repo/restrictions"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+func CloneMedia(r *http.Request, rctx rcontext.RequestContext, user _apimeta.UserInfo) interface{} {
+	server := _routers.GetParam("server", r)
+	mediaId := _routers.GetParam("mediaId", r)
+	allowRemote := r.URL.Query().Get("allow_remote")
+
+	if !_routers.ServerNameRegex.MatchString(server) {
+		return _responses.BadRequest("invalid server ID")
+	}
+
+	downloadRemote := true
+	if allowRemote != "" {
+		parsedFlag, err := strconv.ParseBool(allowRemote)
+		if err != nil {
+			return _responses.BadRequest("allow_remote flag does not appear to be a boolean")
+		}
+		downloadRemote = parsedFlag
+	}
+
+	roomIds, err := _apimeta.GetRequestRoomIds(r, rctx, user, nil)
+	if errors.Is(err, common.ErrNotJoinedToRoom) {
+		return _responses.Forbidden(err.Error())
+	} else if err != nil {
+		return _responses.BadRequest(err.Error())
+	}
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"mediaId":     mediaId,
+		"server":      server,
+		"allowRemote": downloadRemote,
+	})
+
+	if !util.IsGlobalAdmin(user.UserId) && util.IsHostIgnored(server) {
+		rctx.Log.Warn("Request blocked due to domain being ignored.")
+		return _responses.MediaBlocked()
+	}
+
+	// Only the record is needed: the clone shares the source's stored object
+	source, _, err := pipeline_download.Execute(rctx, server, mediaId, pipeline_download.DownloadOpts{
+		FetchRemoteIfNeeded: downloadRemote,
+		BlockForReadUntil:   30 * time.Second,
+		RecordOnly:          true,
+		AuthProvided:        true,
+		Requester:           &restrictions.Requester{UserId: user.UserId, AccessToken: user.AccessToken, IsShared: user.IsShared},
+	})
+	if err != nil {
+		if errors.Is(err, common.ErrMediaNotFound) || errors.Is(err, common.ErrRestrictedRoomMembership) || errors.Is(err, common.ErrMediaQuarantined) {
+			return _responses.NotFoundError() // We lie for security
+		} else if errors.Is(err, common.ErrMediaTooLarge) {
+			return _responses.RequestTooLarge()
+		} else if errors.Is(err, common.ErrMediaNotYetUploaded) {
+			return _responses.NotYetUploaded()
+		} else if errors.Is(err, common.ErrOriginUnavailable) {
+			return _responses.BadGatewayError("remote server is unavailable")
+		}
+		rctx.Log.Error("Unexpected error locating media: ", err)
+		sentry.CaptureException(err)
+		return _responses.InternalServerError("Unexpected Error")
+	}
+
+	record, err := pipeline_upload.ExecuteClone(rctx, r.Host, source, user.UserId, roomIds)
+	if err != nil {
+		if errors.Is(err, common.ErrMediaQuarantined) {
+			return _responses.NotFoundError() // We lie for security
+		} else if errors.Is(err, common.ErrQuotaExceeded) {
+			return _responses.QuotaExceeded()
+		} else if errors.Is(err, common.ErrRateLimitExceeded) {
+			var limitErr *limits.RateLimitError
+			if errors.As(err, &limitErr) {
+				return _responses.RateLimitedFor(limitErr.RetryAfter)
+			}
+			return _responses.RateLimitReached()
+		}
+		rctx.Log.Error("Unexpected error cloning media: ", err)
+		sentry.CaptureException(err)
+		return _responses.InternalServerError("Unexpected Error")
+	}
+
+	return r0.NewMediaUploadedResponse(record)
+}
@@ -0,0 +1,69 @@
+package unstable
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-media-repo/api/_apimeta"
+	"github.com/t2bot/matrix-media-repo/api/_responses"
+	"github.com/t2bot/matrix-media-repo/api/r0"
+	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/pipelines/_steps/upload"
+	"github.com/t2bot/matrix-media-repo/pipelines/pipeline_upload"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+type ExternalMediaRequest struct {
+	Url         string   `json:"url"`
+	ContentType string   `json:"content_type,omitempty"`
+	FileName    string   `json:"filename,omitempty"`
+	RoomIds     []string `json:"room_ids,omitempty"`
+}
+
+func RegisterExternalMedia(r *http.Request, rctx rcontext.RequestContext, user _apimeta.UserInfo) interface{} {
+	if !upload.CanRegisterExternal(rctx, user.UserId) {
+		return _responses.AuthFailed()
+	}
+
+	params := &ExternalMediaRequest{}
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&params); err != nil {
+		return _responses.BadRequest("invalid request body")
+	}
+	if params.Url == "" {
+		return _responses.BadRequest("url is required")
+	}
+	externalUrl, err := url.Parse(params.Url)
+	if err != nil || !externalUrl.IsAbs() {
+		return _responses.BadRequest("url is not valid")
+	}
+	roomIds, err := _apimeta.GetRequestRoomIds(r, rctx, user, params.RoomIds)
+	if errors.Is(err, common.ErrNotJoinedToRoom) {
+		return _responses.Forbidden(err.Error())
+	} else if err != nil {
+		return _responses.BadRequest(err.Error())
+	}
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"externalHost": externalUrl.Hostname(),
+	})
+
+	record, err := pipeline_upload.ExecuteExternal(rctx, r.Host, user.UserId, externalUrl, params.ContentType, params.FileName, roomIds)
+	if err != nil {
+		if errors.Is(err, common.ErrHostNotAllowed) {
+			return _responses.BadRequest("media cannot be fetched from that url")
+		}
+		rctx.Log.Error("Unexpected error registering external media: ", err)
+		sentry.CaptureException(err)
+		return _responses.InternalServerError("Unexpected Error")
+	}
+
+	return &r0.MediaUploadedResponse{
+		ContentUri: util.MxcUri(record.Origin, record.MediaId),
+	}
+}
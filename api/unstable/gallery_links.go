@@ -0,0 +1,184 @@
+package unstable
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-media-repo/api/_apimeta"
+	"github.com/t2bot/matrix-media-repo/api/_responses"
+	"github.com/t2bot/matrix-media-repo/api/_routers"
+	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/matrix"
+	"github.com/t2bot/matrix-media-repo/references"
+	"github.com/t2bot/matrix-media-repo/restrictions"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+type CreateGalleryLinkRequest struct {
+	Hours int `json:"hours"`
+}
+
+type GalleryLinkResponse struct {
+	RoomId    string `json:"room_id"`
+	Token     string `json:"token"`
+	TokenId   string `json:"token_id"`
+	ExpiresTs int64  `json:"expires_ts"`
+}
+
+// CreateGalleryLink mints a gallery token for the room, if the user is a moderator of it.
+func CreateGalleryLink(r *http.Request, rctx rcontext.RequestContext, user _apimeta.UserInfo) interface{} {
+	conf := config.Get().GalleryLinks
+	if !conf.Enabled || conf.Secret == "" {
+		return _responses.BadRequest("gallery links are not enabled")
+	}
+
+	roomId := _routers.GetParam("roomId", r)
+	if roomId == "" || roomId[0] != '!' {
+		return _responses.BadRequest("invalid room ID")
+	}
+
+	defer r.Body.Close()
+	params := &CreateGalleryLinkRequest{}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(params); err != nil && !errors.Is(err, io.EOF) {
+			return _responses.BadRequest("invalid request")
+		}
+	}
+	if params.Hours <= 0 {
+		params.Hours = 24
+	}
+	if conf.MaxHours > 0 && params.Hours > conf.MaxHours {
+		return _responses.BadRequest("hours exceeds the maximum lifetime of gallery links")
+	}
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"roomId": roomId,
+		"hours":  params.Hours,
+	})
+
+	if res := checkGalleryModerator(r, rctx, user, roomId); res != nil {
+		return res
+	}
+
+	expiresTs := util.NowMillis() + (time.Duration(params.Hours) * time.Hour).Milliseconds()
+	gallery := &restrictions.GalleryToken{
+		RoomId:    roomId,
+		IssuedBy:  user.UserId,
+		ExpiresTs: expiresTs,
+	}
+	token, err := restrictions.MintGalleryToken(rctx, gallery)
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return _responses.InternalServerError("failed to create gallery link")
+	}
+	rctx.Log.Infof("User %s created gallery link %s for the room", user.UserId, gallery.Id)
+
+	return &_responses.DoNotCacheResponse{Payload: &GalleryLinkResponse{
+		RoomId:    roomId,
+		Token:     token,
+		TokenId:   gallery.Id,
+		ExpiresTs: expiresTs,
+	}}
+}
+
+// RevokeGalleryLink stops one of the room's gallery tokens from granting access, if the user is a moderator of the
+// room.
+func RevokeGalleryLink(r *http.Request, rctx rcontext.RequestContext, user _apimeta.UserInfo) interface{} {
+	conf := config.Get().GalleryLinks
+	if !conf.Enabled || conf.Secret == "" {
+		return _responses.BadRequest("gallery links are not enabled")
+	}
+
+	roomId := _routers.GetParam("roomId", r)
+	tokenId := _routers.GetParam("tokenId", r)
+	if roomId == "" || roomId[0] != '!' {
+		return _responses.BadRequest("invalid room ID")
+	}
+	if tokenId == "" {
+		return _responses.BadRequest("invalid token ID")
+	}
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"roomId":  roomId,
+		"tokenId": tokenId,
+	})
+
+	if res := checkGalleryModerator(r, rctx, user, roomId); res != nil {
+		return res
+	}
+
+	revoked, err := restrictions.RevokeGalleryToken(rctx, roomId, tokenId)
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return _responses.InternalServerError("failed to revoke gallery link")
+	}
+	if !revoked {
+		return _responses.NotFoundError()
+	}
+	rctx.Log.Infof("User %s revoked gallery link %s for the room", user.UserId, tokenId)
+	return &_responses.DoNotCacheResponse{Payload: &_responses.EmptyResponse{}}
+}
+
+// checkGalleryModerator returns an error response if the user may not manage the room's gallery links.
+func checkGalleryModerator(r *http.Request, rctx rcontext.RequestContext, user _apimeta.UserInfo, roomId string) interface{} {
+	if util.IsGlobalAdmin(user.UserId) || user.IsShared {
+		return nil
+	}
+
+	powerLevels := &matrix.PowerLevelsContent{}
+	err := matrix.GetStateEvent(rctx, r.Host, user.AccessToken, r.RemoteAddr, roomId, "m.room.power_levels", "", powerLevels)
+	if err != nil {
+		rctx.Log.Debug("Error getting power levels: ", err)
+		return _responses.ErrorResponse{
+			Code:         common.ErrCodeForbidden,
+			Message:      "unable to check your power level in the room",
+			InternalCode: common.ErrCodeForbidden,
+		}
+	}
+	if powerLevels.UserLevel(user.UserId) < config.Get().GalleryLinks.MinPowerLevel {
+		return _responses.ErrorResponse{
+			Code:         common.ErrCodeForbidden,
+			Message:      "you are not a moderator of this room",
+			InternalCode: common.ErrCodeForbidden,
+		}
+	}
+	return nil
+}
+
+// GetGallery lists the media which a gallery token grants access to. No other authentication is required.
+func GetGallery(r *http.Request, rctx rcontext.RequestContext) interface{} {
+	gallery, err := restrictions.VerifyGalleryToken(rctx, r.URL.Query().Get(_apimeta.GalleryTokenParam))
+	if err != nil {
+		if !restrictions.IsRejectedGalleryToken(err) {
+			rctx.Log.Error("Error checking gallery token: ", err)
+			sentry.CaptureException(err)
+			return _responses.InternalServerError("Unexpected Error")
+		}
+		return _responses.ErrorResponse{
+			Code:         common.ErrCodeForbidden,
+			Message:      "invalid, expired, or revoked gallery token",
+			InternalCode: common.ErrCodeForbidden,
+		}
+	}
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"roomId": gallery.RoomId,
+	})
+
+	manifest, err := references.BuildRoomManifest(rctx, gallery.RoomId)
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return _responses.InternalServerError("failed to list gallery media")
+	}
+	return &_responses.DoNotCacheResponse{Payload: manifest}
+}
@@ -17,6 +17,7 @@ import (
 	"github.com/t2bot/matrix-media-repo/common/rcontext"
 	"github.com/t2bot/matrix-media-repo/database"
 	"github.com/t2bot/matrix-media-repo/pipelines/pipeline_download"
+	"github.com/t2bot/matrix-media-repo/restrictions"
 	"github.com/t2bot/matrix-media-repo/thumbnailing"
 	"github.com/t2bot/matrix-media-repo/thumbnailing/i"
 	"github.com/t2bot/matrix-media-repo/util"
@@ -32,6 +33,13 @@ type mediaInfoThumbnail struct {
 	Ready       bool   `json:"ready"`
 	ContentType string `json:"content_type,omitempty"`
 	SizeBytes   int64  `json:"size,omitempty"`
+	Passthrough bool   `json:"passthrough,omitempty"`
+}
+
+type mediaInfoScan struct {
+	ScannedTs int64  `json:"scanned_ts"`
+	Infected  bool   `json:"infected"`
+	Signature string `json:"signature,omitempty"`
 }
 
 type MediaInfoResponse struct {
@@ -46,6 +54,8 @@ type MediaInfoResponse struct {
 	NumTotalSamples int                   `json:"num_total_samples,omitempty"`
 	KeySamples      [][2]float64          `json:"key_samples,omitempty"`
 	NumChannels     int                   `json:"num_channels,omitempty"`
+	Antivirus       *mediaInfoScan        `json:"antivirus,omitempty"`
+	NsfwScore       *float64              `json:"nsfw_score,omitempty"`
 }
 
 func MediaInfo(r *http.Request, rctx rcontext.RequestContext, user _apimeta.UserInfo) interface{} {
@@ -81,10 +91,11 @@ func MediaInfo(r *http.Request, rctx rcontext.RequestContext, user _apimeta.User
 		FetchRemoteIfNeeded: downloadRemote,
 		BlockForReadUntil:   30 * time.Second,
 		RecordOnly:          false,
+		Requester:           &restrictions.Requester{UserId: user.UserId, AccessToken: user.AccessToken, IsShared: user.IsShared},
 	})
 	// Error handling copied from download endpoint
 	if err != nil {
-		if errors.Is(err, common.ErrMediaNotFound) {
+		if errors.Is(err, common.ErrMediaNotFound) || errors.Is(err, common.ErrRestrictedRoomMembership) {
 			return _responses.NotFoundError()
 		} else if errors.Is(err, common.ErrMediaTooLarge) {
 			return _responses.RequestTooLarge()
@@ -97,6 +108,8 @@ func MediaInfo(r *http.Request, rctx rcontext.RequestContext, user _apimeta.User
 			}
 		} else if errors.Is(err, common.ErrMediaNotYetUploaded) {
 			return _responses.NotYetUploaded()
+		} else if errors.Is(err, common.ErrOriginUnavailable) {
+			return _responses.BadGatewayError("remote server is unavailable")
 		}
 		rctx.Log.Error("Unexpected error locating media: ", err)
 		sentry.CaptureException(err)
@@ -149,10 +162,34 @@ func MediaInfo(r *http.Request, rctx rcontext.RequestContext, user _apimeta.User
 				Ready:       true,
 				ContentType: thumb.ContentType,
 				SizeBytes:   thumb.SizeBytes,
+				Passthrough: thumb.Passthrough,
 			})
 		}
 		response.Thumbnails = infoThumbs
 	}
 
+	if util.IsGlobalAdmin(user.UserId) {
+		scan, err := database.GetInstance().MediaScans.Prepare(rctx).Get(record.Sha256Hash)
+		if err != nil {
+			rctx.Log.Error("Unexpected error locating media scan result: ", err)
+			sentry.CaptureException(err)
+			return _responses.InternalServerError("Unexpected Error")
+		}
+		if scan != nil {
+			response.Antivirus = &mediaInfoScan{
+				ScannedTs: scan.ScannedTs,
+				Infected:  scan.Infected,
+				Signature: scan.Signature,
+			}
+		}
+
+		response.NsfwScore, err = database.GetInstance().Media.Prepare(rctx).GetNsfwScore(record.Origin, record.MediaId)
+		if err != nil {
+			rctx.Log.Error("Unexpected error locating NSFW score: ", err)
+			sentry.CaptureException(err)
+			return _responses.InternalServerError("Unexpected Error")
+		}
+	}
+
 	return response
 }
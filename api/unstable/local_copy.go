@@ -15,8 +15,10 @@ import (
 	"github.com/t2bot/matrix-media-repo/common"
 	"github.com/t2bot/matrix-media-repo/common/rcontext"
 	"github.com/t2bot/matrix-media-repo/datastores"
+	"github.com/t2bot/matrix-media-repo/limits"
 	"github.com/t2bot/matrix-media-repo/pipelines/pipeline_download"
 	"github.com/t2bot/matrix-media-repo/pipelines/pipeline_upload"
+	"github.com/t2bot/matrix-media-repo/restrictions"
 	"github.com/t2bot/matrix-media-repo/util"
 )
 
@@ -61,10 +63,11 @@ func LocalCopy(r *http.Request, rctx rcontext.RequestContext, user _apimeta.User
 		FetchRemoteIfNeeded: downloadRemote,
 		BlockForReadUntil:   30 * time.Second,
 		RecordOnly:          false,
+		Requester:           &restrictions.Requester{UserId: user.UserId, AccessToken: user.AccessToken, IsShared: user.IsShared},
 	})
 	// Error handling copied from download endpoint
 	if err != nil {
-		if errors.Is(err, common.ErrMediaNotFound) {
+		if errors.Is(err, common.ErrMediaNotFound) || errors.Is(err, common.ErrRestrictedRoomMembership) {
 			return _responses.NotFoundError()
 		} else if errors.Is(err, common.ErrMediaTooLarge) {
 			return _responses.RequestTooLarge()
@@ -77,24 +80,44 @@ func LocalCopy(r *http.Request, rctx rcontext.RequestContext, user _apimeta.User
 			}
 		} else if errors.Is(err, common.ErrMediaNotYetUploaded) {
 			return _responses.NotYetUploaded()
+		} else if errors.Is(err, common.ErrOriginUnavailable) {
+			return _responses.BadGatewayError("remote server is unavailable")
 		}
 		rctx.Log.Error("Unexpected error locating media: ", err)
 		sentry.CaptureException(err)
 		return _responses.InternalServerError("Unexpected Error")
 	}
 
-	record, err = pipeline_upload.Execute(rctx, server, mediaId, stream, record.ContentType, record.UploadName, user.UserId, datastores.LocalMediaKind)
+	record, err = pipeline_upload.Execute(rctx, server, mediaId, stream, record.ContentType, record.UploadName, user.UserId, datastores.LocalMediaKind, nil)
 	// Error handling copied from upload(sync) endpoint
 	if err != nil {
 		if errors.Is(err, common.ErrQuotaExceeded) {
 			return _responses.QuotaExceeded()
+		} else if errors.Is(err, common.ErrInsufficientStorage) {
+			return _responses.InsufficientStorage()
+		} else if errors.Is(err, common.ErrRateLimitExceeded) {
+			var limitErr *limits.RateLimitError
+			if errors.As(err, &limitErr) {
+				return _responses.RateLimitedFor(limitErr.RetryAfter)
+			}
+			return _responses.RateLimitReached()
+		} else if errors.Is(err, common.ErrMediaInfected) {
+			return _responses.MediaInfected()
+		} else if errors.Is(err, common.ErrMediaTooLargeToScan) {
+			return _responses.MediaTooLargeToScan()
+		} else if errors.Is(err, common.ErrMediaScanFailed) {
+			rctx.Log.Error("Error scanning media: ", err)
+			sentry.CaptureException(err)
+			return _responses.InternalServerError("The upload could not be scanned for viruses.")
+		} else if errors.Is(err, common.ErrMediaHashCheckFailed) {
+			rctx.Log.Error("Error checking media against hash lists: ", err)
+			sentry.CaptureException(err)
+			return _responses.InternalServerError("The upload could not be checked against hash lists.")
 		}
 		rctx.Log.Error("Unexpected error uploading media: ", err)
 		sentry.CaptureException(err)
 		return _responses.InternalServerError("Unexpected Error")
 	}
 
-	return &r0.MediaUploadedResponse{
-		ContentUri: util.MxcUri(record.Origin, record.MediaId),
-	}
+	return r0.NewMediaUploadedResponse(record)
 }
@@ -0,0 +1,56 @@
+package unstable
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/t2bot/matrix-media-repo/api/_apimeta"
+	"github.com/t2bot/matrix-media-repo/api/_responses"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/preferences"
+)
+
+func GetPreferences(r *http.Request, rctx rcontext.RequestContext, user _apimeta.UserInfo) interface{} {
+	if !preferences.IsEnabled() {
+		return _responses.NotFoundError()
+	}
+
+	preferences.Refresh(rctx, user.UserId, user.AccessToken)
+	prefs, err := preferences.Get(rctx, user.UserId)
+	if err != nil {
+		rctx.Log.Error("Error getting preferences: ", err)
+		sentry.CaptureException(err)
+		return _responses.InternalServerError("Unexpected Error")
+	}
+	return prefs
+}
+
+func SetPreferences(r *http.Request, rctx rcontext.RequestContext, user _apimeta.UserInfo) interface{} {
+	if !preferences.IsEnabled() {
+		return _responses.NotFoundError()
+	}
+
+	// Fields missing from the request keep their current values
+	prefs, err := preferences.Get(rctx, user.UserId)
+	if err != nil {
+		rctx.Log.Error("Error getting preferences: ", err)
+		sentry.CaptureException(err)
+		return _responses.InternalServerError("Unexpected Error")
+	}
+	decoder := json.NewDecoder(r.Body)
+	if err = decoder.Decode(prefs); err != nil {
+		return _responses.BadRequest("invalid request body")
+	}
+
+	if err = preferences.Set(rctx, user.UserId, user.AccessToken, prefs); err != nil {
+		if errors.Is(err, preferences.ErrInvalidVisibility) {
+			return _responses.BadRequest(err.Error())
+		}
+		rctx.Log.Error("Error setting preferences: ", err)
+		sentry.CaptureException(err)
+		return _responses.InternalServerError("Unexpected Error")
+	}
+	return prefs
+}
@@ -10,28 +10,77 @@ import (
 )
 
 type PublicUsageResponse struct {
-	StorageUsed  int64 `json:"org.matrix.msc4034.storage.used,omitempty"`
-	StorageFiles int64 `json:"org.matrix.msc4034.storage.files,omitempty"`
+	StorageUsed     int64 `json:"org.matrix.msc4034.storage.used,omitempty"`
+	StorageFiles    int64 `json:"org.matrix.msc4034.storage.files,omitempty"`
+	StorageSize     int64 `json:"org.matrix.msc4034.storage.size,omitempty"`
+	StorageMaxFiles int64 `json:"org.matrix.msc4034.storage.max_files,omitempty"`
+}
+
+type UsageQuota struct {
+	MaxBytes *int64 `json:"max_bytes"`
+	MaxFiles *int64 `json:"max_files"`
+}
+
+type UsageResponse struct {
+	StorageUsed  int64       `json:"storage_used"`
+	StorageFiles int64       `json:"storage_files"`
+	Quota        *UsageQuota `json:"quota"`
 }
 
 func PublicUsage(r *http.Request, rctx rcontext.RequestContext, user _apimeta.UserInfo) interface{} {
-	storageUsed := int64(0)
-	current, err := quota.Current(rctx, user.UserId, quota.MaxBytes)
+	usage := getUsage(rctx, user.UserId)
+	res := &PublicUsageResponse{
+		StorageUsed:  usage.StorageUsed,
+		StorageFiles: usage.StorageFiles,
+	}
+	if usage.Quota.MaxBytes != nil {
+		res.StorageSize = *usage.Quota.MaxBytes
+	}
+	if usage.Quota.MaxFiles != nil {
+		res.StorageMaxFiles = *usage.Quota.MaxFiles
+	}
+	return res
+}
+
+func GetUsage(r *http.Request, rctx rcontext.RequestContext, user _apimeta.UserInfo) interface{} {
+	return getUsage(rctx, user.UserId)
+}
+
+func getUsage(rctx rcontext.RequestContext, userId string) *UsageResponse {
+	res := &UsageResponse{Quota: &UsageQuota{}}
+
+	current, err := quota.Current(rctx, userId, quota.MaxBytes)
 	if err != nil {
 		rctx.Log.Warn("Non-fatal error getting per-user quota usage (max bytes @ now): ", err)
 		sentry.CaptureException(err)
 	} else {
-		storageUsed = current
+		res.StorageUsed = current
 	}
 
-	fileCount, err := quota.Current(rctx, user.UserId, quota.MaxCount)
+	fileCount, err := quota.Current(rctx, userId, quota.MaxCount)
 	if err != nil {
 		rctx.Log.Warn("Non-fatal error getting per-user quota usage (files count @ now): ", err)
 		sentry.CaptureException(err)
+	} else {
+		res.StorageFiles = fileCount
+	}
+
+	// Quotas which aren't set (or are unlimited) are left as null
+	maxBytes, err := quota.Limit(rctx, userId, quota.MaxBytes)
+	if err != nil {
+		rctx.Log.Warn("Non-fatal error getting per-user quota limit (max bytes): ", err)
+		sentry.CaptureException(err)
+	} else if maxBytes >= 0 {
+		res.Quota.MaxBytes = &maxBytes
 	}
 
-	return &PublicUsageResponse{
-		StorageUsed:  storageUsed,
-		StorageFiles: fileCount,
+	maxFiles, err := quota.Limit(rctx, userId, quota.MaxCount)
+	if err != nil {
+		rctx.Log.Warn("Non-fatal error getting per-user quota limit (max files): ", err)
+		sentry.CaptureException(err)
+	} else if maxFiles > 0 {
+		res.Quota.MaxFiles = &maxFiles
 	}
+
+	return res
 }
@@ -0,0 +1,149 @@
+package unstable
+
+import (
+	"net/http"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-media-repo/api/_apimeta"
+	"github.com/t2bot/matrix-media-repo/api/_responses"
+	"github.com/t2bot/matrix-media-repo/api/_routers"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/matrix"
+	"github.com/t2bot/matrix-media-repo/references"
+	"github.com/t2bot/matrix-media-repo/restrictions"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+type referencingRoom struct {
+	RoomId   string   `json:"room_id"`
+	EventIds []string `json:"event_ids"`
+}
+
+type MediaReferencesResponse struct {
+	Rooms []*referencingRoom `json:"rooms"`
+}
+
+// canManageReferences returns true if the user may see or change the media's references. When roomId is set, the
+// change only affects that room, so anyone joined to or moderating the room may make it, and nobody else (including
+// the uploader) may.
+func canManageReferences(rctx rcontext.RequestContext, r *http.Request, media *database.DbMedia, origin string, roomId string, user _apimeta.UserInfo) bool {
+	if util.IsGlobalAdmin(user.UserId) || user.IsShared {
+		return true
+	}
+	if roomId != "" {
+		return isRoomMemberOrModerator(rctx, r, roomId, user)
+	}
+	if media != nil && media.UserId == user.UserId {
+		return true
+	}
+
+	isLocalAdmin, err := matrix.IsUserAdmin(rctx, origin, user.AccessToken, r.RemoteAddr)
+	return err == nil && isLocalAdmin && util.IsServerOurs(origin)
+}
+
+func isRoomMemberOrModerator(rctx rcontext.RequestContext, r *http.Request, roomId string, user _apimeta.UserInfo) bool {
+	joined, err := restrictions.IsJoined(rctx, restrictions.Requester{UserId: user.UserId, AccessToken: user.AccessToken}, roomId)
+	if err != nil {
+		rctx.Log.Debug("Error checking room membership: ", err)
+	} else if joined {
+		return true
+	}
+
+	powerLevels := &matrix.PowerLevelsContent{}
+	err = matrix.GetStateEvent(rctx, r.Host, user.AccessToken, r.RemoteAddr, roomId, "m.room.power_levels", "", powerLevels)
+	if err != nil {
+		rctx.Log.Debug("Error getting power levels: ", err)
+		return false
+	}
+	return powerLevels.CanRedact(user.UserId)
+}
+
+func GetMediaReferences(r *http.Request, rctx rcontext.RequestContext, user _apimeta.UserInfo) interface{} {
+	server := _routers.GetParam("server", r)
+	mediaId := _routers.GetParam("mediaId", r)
+
+	if !_routers.ServerNameRegex.MatchString(server) {
+		return _responses.BadRequest("invalid server ID")
+	}
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"server":  server,
+		"mediaId": mediaId,
+	})
+
+	media, err := database.GetInstance().Media.Prepare(rctx).GetById(server, mediaId)
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return _responses.InternalServerError("failed to get media record")
+	}
+	if !canManageReferences(rctx, r, media, server, "", user) {
+		return _responses.AuthFailed()
+	}
+
+	refs, err := database.GetInstance().MediaReferences.Prepare(rctx).GetForMedia(server, mediaId)
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return _responses.InternalServerError("failed to get references")
+	}
+
+	rooms := make([]*referencingRoom, 0)
+	byRoomId := make(map[string]*referencingRoom)
+	for _, ref := range refs {
+		room, ok := byRoomId[ref.RoomId]
+		if !ok {
+			room = &referencingRoom{RoomId: ref.RoomId, EventIds: make([]string, 0)}
+			byRoomId[ref.RoomId] = room
+			rooms = append(rooms, room)
+		}
+		if ref.EventId != "" {
+			room.EventIds = append(room.EventIds, ref.EventId)
+		}
+	}
+
+	return &_responses.DoNotCacheResponse{Payload: &MediaReferencesResponse{Rooms: rooms}}
+}
+
+func DeleteMediaReference(r *http.Request, rctx rcontext.RequestContext, user _apimeta.UserInfo) interface{} {
+	server := _routers.GetParam("server", r)
+	mediaId := _routers.GetParam("mediaId", r)
+	roomId := r.URL.Query().Get("room_id")
+
+	if !_routers.ServerNameRegex.MatchString(server) {
+		return _responses.BadRequest("invalid server ID")
+	}
+	if roomId == "" {
+		return _responses.BadRequest("missing room_id")
+	}
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"server":  server,
+		"mediaId": mediaId,
+		"roomId":  roomId,
+	})
+
+	media, err := database.GetInstance().Media.Prepare(rctx).GetById(server, mediaId)
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return _responses.InternalServerError("failed to get media record")
+	}
+	if !canManageReferences(rctx, r, media, server, roomId, user) {
+		return _responses.AuthFailed()
+	}
+
+	removed, err := references.RemoveMediaReference(rctx, server, mediaId, roomId)
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return _responses.InternalServerError("failed to remove reference")
+	}
+	if !removed {
+		return _responses.NotFoundError()
+	}
+
+	return &_responses.DoNotCacheResponse{Payload: &_responses.EmptyResponse{}}
+}
@@ -1,11 +1,15 @@
 package v1
 
 import (
+	"encoding/json"
+	"errors"
+	"io"
 	"net/http"
 
 	"github.com/getsentry/sentry-go"
 	"github.com/t2bot/matrix-media-repo/api/_apimeta"
 	"github.com/t2bot/matrix-media-repo/api/_responses"
+	"github.com/t2bot/matrix-media-repo/common"
 	"github.com/t2bot/matrix-media-repo/common/rcontext"
 	"github.com/t2bot/matrix-media-repo/pipelines/pipeline_create"
 	"github.com/t2bot/matrix-media-repo/util"
@@ -16,8 +20,24 @@ type MediaCreatedResponse struct {
 	ExpiresTs  int64  `json:"unused_expires_at"`
 }
 
+type CreateMediaRequest struct {
+	RoomIds []string `json:"room_ids,omitempty"`
+}
+
 func CreateMedia(r *http.Request, rctx rcontext.RequestContext, user _apimeta.UserInfo) interface{} {
-	id, err := pipeline_create.Execute(rctx, r.Host, user.UserId, pipeline_create.DefaultExpirationTime)
+	params := &CreateMediaRequest{}
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&params); err != nil && !errors.Is(err, io.EOF) {
+		return _responses.BadRequest("invalid request body")
+	}
+	roomIds, err := _apimeta.GetRequestRoomIds(r, rctx, user, params.RoomIds)
+	if errors.Is(err, common.ErrNotJoinedToRoom) {
+		return _responses.Forbidden(err.Error())
+	} else if err != nil {
+		return _responses.BadRequest(err.Error())
+	}
+
+	id, err := pipeline_create.Execute(rctx, r.Host, user.UserId, pipeline_create.DefaultExpirationTime, roomIds)
 	if err != nil {
 		rctx.Log.Error("Unexpected error creating media ID:", err)
 		sentry.CaptureException(err)
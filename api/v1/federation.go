@@ -0,0 +1,43 @@
+package v1
+
+import (
+	"bytes"
+
+	"github.com/t2bot/matrix-media-repo/api/_responses"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/util/ids"
+	"github.com/t2bot/matrix-media-repo/util/readers"
+)
+
+// asFederationResponse wraps a download or redirect response in the multipart/mixed format used by the
+// federation media API. Other responses (errors, mostly) are returned as-is.
+func asFederationResponse(rctx rcontext.RequestContext, res interface{}) interface{} {
+	var mediaPart *readers.MultipartPart
+	if dl, ok := res.(*_responses.DownloadResponse); ok {
+		mediaPart = &readers.MultipartPart{ContentType: dl.ContentType, FileName: dl.Filename, Reader: dl.Data}
+	} else if rd, ok := res.(*_responses.RedirectResponse); ok {
+		mediaPart = &readers.MultipartPart{Location: rd.ToUrl}
+	} else {
+		return res
+	}
+
+	boundary, err := ids.NewUniqueId()
+	if err != nil {
+		rctx.Log.Error("Error generating boundary on response: ", err)
+		if mediaPart.Reader != nil {
+			_ = mediaPart.Reader.Close()
+		}
+		return _responses.InternalServerError("unable to generate boundary")
+	}
+	return &_responses.DownloadResponse{
+		ContentType: "multipart/mixed; boundary=" + boundary,
+		Filename:    "",
+		SizeBytes:   0,
+		Data: readers.NewMultipartReader(
+			boundary,
+			&readers.MultipartPart{ContentType: "application/json", Reader: readers.MakeCloser(bytes.NewReader([]byte("{}")))},
+			mediaPart,
+		),
+		TargetDisposition: "attachment",
+	}
+}
@@ -37,8 +37,9 @@ func Init() *sync.WaitGroup {
 		handler = tollbooth.LimitHandler(limits.GetRequestLimiter(), handler)
 	}
 
-	// Note: we bind Sentry here to ensure we capture *everything*
-	sentryHandler := sentryhttp.New(sentryhttp.Options{})
+	// Note: we bind Sentry here to ensure we capture *everything*. Panics are re-raised so http.ErrAbortHandler still
+	// closes the connection.
+	sentryHandler := sentryhttp.New(sentryhttp.Options{Repanic: true})
 	srv = &http.Server{Addr: address, Handler: sentryHandler.Handle(handler)}
 	reload = false
 
@@ -71,11 +72,18 @@ func Reload() {
 }
 
 func Stop() {
-	if srv != nil {
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	if s := srv; s != nil {
+		grace := time.Duration(config.Get().General.ShutdownGraceSeconds) * time.Second
+		ctx, cancel := context.WithTimeout(context.Background(), grace)
 		defer cancel()
-		if err := srv.Shutdown(ctx); err != nil {
-			panic(err)
+		if err := s.Shutdown(ctx); err != nil {
+			if !errors.Is(err, context.DeadlineExceeded) {
+				panic(err)
+			}
+			logrus.Warnf("Requests were still running after %s - closing their connections", grace)
+			if err = s.Close(); err != nil {
+				panic(err)
+			}
 		}
 	}
 }
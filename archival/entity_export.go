@@ -13,12 +13,45 @@ import (
 	"github.com/t2bot/matrix-media-repo/util"
 )
 
+// ErrExportInterrupted is returned by ExportEntityDataResumable when the export was stopped before it finished.
+var ErrExportInterrupted = errors.New("export interrupted")
+
+// ExportCheckpointer allows an export to be stopped and later resumed from the last part it persisted.
+type ExportCheckpointer struct {
+	// State is where to resume the export from. Nil starts from the beginning.
+	State *v2archive.ArchiveState
+	// Save is called with the export's state after each part is persisted.
+	Save func(state *v2archive.ArchiveState)
+	// Interrupted is checked between media items. When it returns true, the export stops without being finished.
+	Interrupted func() bool
+}
+
 func ExportEntityData(ctx rcontext.RequestContext, exportId string, entityId string, exportS3Urls bool, writeFn v2archive.PartPersister) error {
-	archiver, err := v2archive.NewWriter(ctx, exportId, entityId, ctx.Config.Archiving.TargetBytesPerPart, writeFn)
+	return ExportEntityDataResumable(ctx, exportId, entityId, exportS3Urls, writeFn, &ExportCheckpointer{})
+}
+
+func ExportEntityDataResumable(ctx rcontext.RequestContext, exportId string, entityId string, exportS3Urls bool, writeFn v2archive.PartPersister, checkpointer *ExportCheckpointer) error {
+	var archiver *v2archive.ArchiveWriter
+	var err error
+	if checkpointer.State != nil {
+		ctx.Log.Infof("Resuming export after part %d", checkpointer.State.Part)
+		archiver, err = v2archive.ResumeWriter(ctx, exportId, entityId, ctx.Config.Archiving.TargetBytesPerPart, writeFn, checkpointer.State)
+	} else {
+		archiver, err = v2archive.NewWriter(ctx, exportId, entityId, ctx.Config.Archiving.TargetBytesPerPart, writeFn)
+	}
 	if err != nil {
 		return err
 	}
+	if checkpointer.Save != nil {
+		archiver.OnPartWritten(checkpointer.Save)
+	}
+	interrupted := false
 	defer func(archiver *v2archive.ArchiveWriter) {
+		if interrupted {
+			ctx.Log.Debug("Abandoning current export part")
+			archiver.Abort()
+			return
+		}
 		ctx.Log.Debug("Finishing export archive")
 		_ = archiver.Finish()
 	}(archiver)
@@ -29,6 +62,8 @@ func ExportEntityData(ctx rcontext.RequestContext, exportId string, entityId str
 	var records []*database.DbMedia
 	if entityId[0] == '@' {
 		records, err = db.GetByUserId(entityId)
+	} else if entityId[0] == '!' {
+		records, err = getRoomMedia(ctx, entityId)
 	} else {
 		records, err = db.GetByOrigin(entityId)
 	}
@@ -38,6 +73,14 @@ func ExportEntityData(ctx rcontext.RequestContext, exportId string, entityId str
 
 	ctx.Log.Infof("Exporting %d media records", len(records))
 	for _, media := range records {
+		if checkpointer.Interrupted != nil && checkpointer.Interrupted() {
+			interrupted = true
+			return ErrExportInterrupted
+		}
+		if archiver.Contains(media.Origin, media.MediaId) {
+			continue // exported before being resumed
+		}
+
 		mxc := util.MxcUri(media.Origin, media.MediaId)
 		ctx.Log.Debugf("Downloading %s", mxc)
 		_, s, err := pipeline_download.Execute(ctx, media.Origin, media.MediaId, pipeline_download.DownloadOpts{
@@ -86,3 +129,29 @@ func ExportEntityData(ctx rcontext.RequestContext, exportId string, entityId str
 
 	return nil
 }
+
+// getRoomMedia returns the media records referenced by a room, once each.
+func getRoomMedia(ctx rcontext.RequestContext, roomId string) ([]*database.DbMedia, error) {
+	refs, err := database.GetInstance().MediaReferences.Prepare(ctx).GetForRoom(roomId)
+	if err != nil {
+		return nil, err
+	}
+	db := database.GetInstance().Media.Prepare(ctx)
+	records := make([]*database.DbMedia, 0)
+	seen := make(map[string]bool)
+	for _, ref := range refs {
+		mxc := util.MxcUri(ref.Origin, ref.MediaId)
+		if seen[mxc] {
+			continue
+		}
+		seen[mxc] = true
+		record, err := db.GetById(ref.Origin, ref.MediaId)
+		if err != nil {
+			return nil, err
+		}
+		if record != nil {
+			records = append(records, record)
+		}
+	}
+	return records, nil
+}
@@ -0,0 +1,96 @@
+package v2archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"io"
+
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/datastores"
+)
+
+type CombinedFormat string
+
+const (
+	CombinedTarGz CombinedFormat = "tar"
+	CombinedZip   CombinedFormat = "zip"
+)
+
+var ErrUnknownFormat = errors.New("unknown archive format")
+
+// ContentType returns the MIME type of an archive in the format.
+func (f CombinedFormat) ContentType() string {
+	if f == CombinedZip {
+		return "application/zip"
+	}
+	return "application/gzip"
+}
+
+// Extension returns the file extension, including the dot, of an archive in the format.
+func (f CombinedFormat) Extension() string {
+	if f == CombinedZip {
+		return ".zip"
+	}
+	return ".tar.gz"
+}
+
+// WriteCombined streams all the parts of an export into a single archive. Parts are read one at a time, so the
+// export is never held in memory or on disk as a whole.
+func WriteCombined(ctx rcontext.RequestContext, parts []*database.DbExportPart, format CombinedFormat, w io.Writer) error {
+	var putFn archiveWorkFn
+	var closeFn func() error
+	switch format {
+	case CombinedTarGz:
+		archiver := gzip.NewWriter(w)
+		tarFile := tar.NewWriter(archiver)
+		putFn = func(header *tar.Header, f io.Reader) error {
+			if err := tarFile.WriteHeader(header); err != nil {
+				return err
+			}
+			_, err := io.Copy(tarFile, f)
+			return err
+		}
+		closeFn = func() error {
+			return errors.Join(tarFile.Close(), archiver.Close())
+		}
+	case CombinedZip:
+		zipFile := zip.NewWriter(w)
+		putFn = func(header *tar.Header, f io.Reader) error {
+			dest, err := zipFile.CreateHeader(&zip.FileHeader{
+				Name:     header.Name,
+				Method:   zip.Deflate,
+				Modified: header.ModTime,
+			})
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(dest, f)
+			return err
+		}
+		closeFn = zipFile.Close
+	default:
+		return ErrUnknownFormat
+	}
+
+	for _, part := range parts {
+		ctx.Log.Debugf("Adding part %d (%s) to combined archive", part.PartNum, part.FileName)
+		dsConf, ok := datastores.Get(ctx, part.DatastoreId)
+		if !ok {
+			return errors.New("unable to locate datastore for export part")
+		}
+		stream, err := datastores.Download(ctx, dsConf, part.Location)
+		if err != nil {
+			return err
+		}
+		err = readArchive(stream, putFn)
+		_ = stream.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return closeFn()
+}
@@ -3,15 +3,21 @@ package v2archive
 import (
 	"archive/tar"
 	"compress/gzip"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
+	"os"
 
 	"github.com/t2bot/matrix-media-repo/common/rcontext"
 	"github.com/t2bot/matrix-media-repo/database"
 	"github.com/t2bot/matrix-media-repo/datastores"
 	"github.com/t2bot/matrix-media-repo/pipelines/pipeline_upload"
 	"github.com/t2bot/matrix-media-repo/util"
+	"github.com/t2bot/matrix-media-repo/util/readers"
 )
 
 type ProcessOpts struct {
@@ -26,17 +32,34 @@ type ArchiveReader struct {
 	manifest        *Manifest
 	uploaded        map[string]bool
 	fileNamesToMxcs map[string][]string
+
+	trustedKeys   map[string]ed25519.PublicKey
+	requireSigned bool
+	signed        bool
 }
 
 func NewReader(ctx rcontext.RequestContext) *ArchiveReader {
+	trustedKeys, err := parseTrustedKeys(ctx.Config.Archiving.TrustedKeys)
+	if err != nil {
+		ctx.Log.Error("Ignoring trusted archive keys: ", err)
+		trustedKeys = make(map[string]ed25519.PublicKey)
+	}
 	return &ArchiveReader{
 		ctx:             ctx,
 		manifest:        nil,
 		uploaded:        make(map[string]bool),
 		fileNamesToMxcs: make(map[string][]string),
+		trustedKeys:     trustedKeys,
+		requireSigned:   ctx.Config.Archiving.RequireSignedImports,
 	}
 }
 
+// IsSigned returns true if the archive's manifest is signed by a trusted key. The contents of each file are checked
+// against the manifest when importing from a signed archive.
+func (r *ArchiveReader) IsSigned() bool {
+	return r.signed
+}
+
 type archiveWorkFn = func(header *tar.Header, f io.Reader) error
 
 func readArchive(file io.ReadCloser, workFn archiveWorkFn) error {
@@ -101,45 +124,61 @@ func (r *ArchiveReader) TryGetManifestFrom(file io.ReadCloser) (bool, error) {
 		return false, errors.New("manifest already discovered")
 	}
 
+	var manifestBytes []byte
+	var signature *ManifestSignature
 	err := readArchive(file, func(header *tar.Header, f io.Reader) error {
+		var err error
 		if header.Name == "manifest.json" {
-			manifest := &Manifest{}
-			decoder := json.NewDecoder(f)
-			err := decoder.Decode(&manifest)
-			if err != nil {
-				return err
-			}
-			if manifest.Version == ManifestVersionV1 {
-				manifest.EntityId = manifest.UserId
-				manifest.Version = ManifestVersionV2
-				r.ctx.Log.Debug("Upgraded manifest to v2")
-			}
-			if manifest.Version != ManifestVersionV2 {
-				// We only support the one version for now.
-				return errors.New("unsupported manifest version")
-			}
-			if manifest.EntityId == "" {
-				return errors.New("invalid manifest: no entity")
-			}
-			if manifest.Media == nil {
-				return errors.New("invalid manifest: no media")
-			}
-			r.ctx.Log.Infof("Using manifest for %s (v%d) created %d", manifest.EntityId, manifest.Version, manifest.CreatedTs)
-			r.manifest = manifest
+			manifestBytes, err = io.ReadAll(f)
+		} else if header.Name == manifestSignatureFileName {
+			signature = &ManifestSignature{}
+			err = json.NewDecoder(f).Decode(signature)
+		}
+		return err
+	})
+	if err != nil || manifestBytes == nil {
+		return false, err
+	}
 
-			for k, v := range r.manifest.Media {
-				r.uploaded[k] = false
-				if _, ok := r.fileNamesToMxcs[v.ArchivedName]; !ok {
-					r.fileNamesToMxcs[v.ArchivedName] = make([]string, 0)
-				}
-				r.fileNamesToMxcs[v.ArchivedName] = append(r.fileNamesToMxcs[v.ArchivedName], k)
-			}
+	signed := verifyManifest(r.trustedKeys, manifestBytes, signature)
+	if signed {
+		r.ctx.Log.Infof("Manifest is signed by trusted key %s", signature.KeyId)
+	} else if r.requireSigned {
+		return false, ErrUntrustedArchive
+	}
 
-			return nil
+	manifest := &Manifest{}
+	if err = json.Unmarshal(manifestBytes, manifest); err != nil {
+		return false, err
+	}
+	if manifest.Version == ManifestVersionV1 {
+		manifest.EntityId = manifest.UserId
+		manifest.Version = ManifestVersionV2
+		r.ctx.Log.Debug("Upgraded manifest to v2")
+	}
+	if manifest.Version != ManifestVersionV2 {
+		// We only support the one version for now.
+		return false, errors.New("unsupported manifest version")
+	}
+	if manifest.EntityId == "" {
+		return false, errors.New("invalid manifest: no entity")
+	}
+	if manifest.Media == nil {
+		return false, errors.New("invalid manifest: no media")
+	}
+	r.ctx.Log.Infof("Using manifest for %s (v%d) created %d", manifest.EntityId, manifest.Version, manifest.CreatedTs)
+	r.manifest = manifest
+	r.signed = signed
+
+	for k, v := range r.manifest.Media {
+		r.uploaded[k] = false
+		if _, ok := r.fileNamesToMxcs[v.ArchivedName]; !ok {
+			r.fileNamesToMxcs[v.ArchivedName] = make([]string, 0)
 		}
-		return nil
-	})
-	return r.HasManifest(), err
+		r.fileNamesToMxcs[v.ArchivedName] = append(r.fileNamesToMxcs[v.ArchivedName], k)
+	}
+
+	return r.HasManifest(), nil
 }
 
 func (r *ArchiveReader) ProcessS3Files(opts ProcessOpts) error {
@@ -228,7 +267,7 @@ func (r *ArchiveReader) importFileFromStream(fileName string, f io.ReadCloser, o
 				r.ctx.Log.Warnf("Found media uploaded by %s but locked to %s - skipping file", metadata.Uploader, opts.LockedEntityId)
 				continue
 			}
-			if opts.LockedEntityId[0] != '@' && metadata.Origin != opts.LockedEntityId {
+			if opts.LockedEntityId[0] != '@' && opts.LockedEntityId[0] != '!' && metadata.Origin != opts.LockedEntityId {
 				r.ctx.Log.Warnf("Found media uploaded by server %s but locked to %s - skipping file", metadata.Origin, opts.LockedEntityId)
 				continue
 			}
@@ -257,6 +296,9 @@ func (r *ArchiveReader) importFileFromStream(fileName string, f io.ReadCloser, o
 		}
 
 		serverName := r.manifest.EntityId
+		if serverName[0] == '!' {
+			serverName = metadata.Origin // room exports span many servers
+		}
 		userId := metadata.Uploader
 		if userId != "" {
 			if userId[0] != '@' {
@@ -276,8 +318,17 @@ func (r *ArchiveReader) importFileFromStream(fileName string, f io.ReadCloser, o
 			kind = datastores.RemoteMediaKind
 		}
 
+		if r.signed {
+			verified, err := verifyFileHash(f, metadata.Sha256)
+			if err != nil {
+				return errors.Join(fmt.Errorf("%s does not match the signed manifest", mxc), err)
+			}
+			defer verified.Close()
+			f = verified
+		}
+
 		r.ctx.Log.Debugf("Importing file %s as kind %s", mxc, kind)
-		if _, err = pipeline_upload.Execute(r.ctx, metadata.Origin, metadata.MediaId, f, metadata.ContentType, metadata.FileName, metadata.Uploader, kind); err != nil {
+		if _, err = pipeline_upload.Execute(r.ctx, metadata.Origin, metadata.MediaId, f, metadata.ContentType, metadata.FileName, metadata.Uploader, kind, nil); err != nil {
 			return err
 		}
 		r.uploaded[mxc] = true
@@ -285,3 +336,28 @@ func (r *ArchiveReader) importFileFromStream(fileName string, f io.ReadCloser, o
 
 	return nil
 }
+
+// verifyFileHash copies the file to a temporary location, returning a reader for the copy if its SHA256 hash matches.
+func verifyFileHash(f io.Reader, expectedSha256 string) (io.ReadCloser, error) {
+	tempFile, err := os.CreateTemp(os.TempDir(), "mmr-import")
+	if err != nil {
+		return nil, err
+	}
+	hasher := sha256.New()
+	if _, err = io.Copy(io.MultiWriter(tempFile, hasher), f); err != nil {
+		_ = tempFile.Close()
+		_ = os.Remove(tempFile.Name())
+		return nil, err
+	}
+	if hex.EncodeToString(hasher.Sum(nil)) != expectedSha256 {
+		_ = tempFile.Close()
+		_ = os.Remove(tempFile.Name())
+		return nil, errors.New("hash mismatch")
+	}
+	if _, err = tempFile.Seek(0, io.SeekStart); err != nil {
+		_ = tempFile.Close()
+		_ = os.Remove(tempFile.Name())
+		return nil, err
+	}
+	return readers.NewTempFileCloser("", tempFile.Name(), tempFile), nil
+}
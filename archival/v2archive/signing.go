@@ -0,0 +1,70 @@
+package v2archive
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/t2bot/matrix-media-repo/homeserver_interop"
+	"github.com/t2bot/matrix-media-repo/homeserver_interop/mmr"
+)
+
+const manifestSignatureFileName = "manifest.sig"
+
+// ErrUntrustedArchive is returned when an archive must be signed by a trusted key, but isn't.
+var ErrUntrustedArchive = errors.New("archive is not signed by a trusted key")
+
+// ManifestSignature is an ed25519 signature over the exact bytes of an archive's manifest.json
+type ManifestSignature struct {
+	KeyId     string `json:"key_id"`
+	Signature string `json:"signature"` // unpadded base64
+}
+
+func loadSigningKey(path string) (*homeserver_interop.SigningKey, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return mmr.DecodeSigningKey(f)
+}
+
+func signManifest(key *homeserver_interop.SigningKey, manifest []byte) *ManifestSignature {
+	return &ManifestSignature{
+		KeyId:     "ed25519:" + key.KeyVersion,
+		Signature: base64.RawStdEncoding.EncodeToString(ed25519.Sign(key.PrivateKey, manifest)),
+	}
+}
+
+// parseTrustedKeys decodes a map of key ID to unpadded base64 ed25519 public key.
+func parseTrustedKeys(keys map[string]string) (map[string]ed25519.PublicKey, error) {
+	parsed := make(map[string]ed25519.PublicKey)
+	for keyId, b64 := range keys {
+		b, err := base64.RawStdEncoding.DecodeString(b64)
+		if err != nil {
+			return nil, errors.Join(fmt.Errorf("bad base64 for trusted archive key '%s'", keyId), err)
+		}
+		if len(b) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("trusted archive key '%s' is not an ed25519 public key", keyId)
+		}
+		parsed[keyId] = b
+	}
+	return parsed, nil
+}
+
+func verifyManifest(trusted map[string]ed25519.PublicKey, manifest []byte, sig *ManifestSignature) bool {
+	if sig == nil {
+		return false
+	}
+	key, ok := trusted[sig.KeyId]
+	if !ok {
+		return false
+	}
+	b, err := base64.RawStdEncoding.DecodeString(sig.Signature)
+	if err != nil {
+		return false
+	}
+	return ed25519.Verify(key, manifest, b)
+}
@@ -2,6 +2,7 @@ package v2archive
 
 import (
 	"archive/tar"
+	"bytes"
 	"compress/gzip"
 	"crypto/sha256"
 	"encoding/hex"
@@ -10,12 +11,14 @@ import (
 	"html"
 	"io"
 	"os"
+	"sort"
 	"time"
 
 	"github.com/dustin/go-humanize"
 	"github.com/gabriel-vasile/mimetype"
 	"github.com/sirupsen/logrus"
 	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/homeserver_interop"
 	"github.com/t2bot/matrix-media-repo/templating"
 	"github.com/t2bot/matrix-media-repo/util"
 	"github.com/t2bot/matrix-media-repo/util/readers"
@@ -33,6 +36,13 @@ type MediaInfo struct {
 
 type PartPersister func(part int, fileName string, data io.ReadCloser) error
 
+// ArchiveState is the progress of an ArchiveWriter as of the last part it wrote. An archive can be resumed from this
+// state with ResumeWriter.
+type ArchiveState struct {
+	Part  int                        `json:"part"`
+	Media map[string]*ManifestRecord `json:"media"`
+}
+
 type ArchiveWriter struct {
 	ctx rcontext.RequestContext
 
@@ -42,6 +52,8 @@ type ArchiveWriter struct {
 	mediaManifest map[string]*ManifestRecord
 	partSize      int64
 	writeFn       PartPersister
+	partWrittenFn func(state *ArchiveState)
+	signingKey    *homeserver_interop.SigningKey
 
 	// state machine variables
 	currentPart     int
@@ -70,10 +82,57 @@ func NewWriter(ctx rcontext.RequestContext, exportId string, entity string, part
 		writeFn:       writeFn,
 		currentPart:   0,
 	}
+	if ctx.Config.Archiving.SigningKeyPath != "" {
+		key, err := loadSigningKey(ctx.Config.Archiving.SigningKeyPath)
+		if err != nil {
+			return nil, err
+		}
+		archiver.signingKey = key
+	}
 	err := archiver.beginTar()
 	return archiver, err
 }
 
+// ResumeWriter creates an ArchiveWriter which continues after the last part written in the given state. Media added
+// after that part was written must be appended again.
+func ResumeWriter(ctx rcontext.RequestContext, exportId string, entity string, partSize int64, writeFn PartPersister, state *ArchiveState) (*ArchiveWriter, error) {
+	archiver, err := NewWriter(ctx, exportId, entity, partSize, writeFn)
+	if err != nil {
+		return nil, err
+	}
+	archiver.currentPart = state.Part + 1
+
+	mxcs := make([]string, 0, len(state.Media))
+	for mxc := range state.Media {
+		mxcs = append(mxcs, mxc)
+	}
+	sort.Slice(mxcs, func(i, j int) bool {
+		a := state.Media[mxcs[i]]
+		b := state.Media[mxcs[j]]
+		if a.CreatedTs != b.CreatedTs {
+			return a.CreatedTs < b.CreatedTs
+		}
+		return mxcs[i] < mxcs[j]
+	})
+	for _, mxc := range mxcs {
+		archiver.mediaManifest[mxc] = state.Media[mxc]
+		archiver.appendIndex(state.Media[mxc])
+	}
+
+	return archiver, nil
+}
+
+// OnPartWritten sets a function to call with the writer's state after each media part is persisted.
+func (w *ArchiveWriter) OnPartWritten(fn func(state *ArchiveState)) {
+	w.partWrittenFn = fn
+}
+
+// Contains returns true if the media has already been appended to the archive.
+func (w *ArchiveWriter) Contains(origin string, mediaId string) bool {
+	_, ok := w.mediaManifest[util.MxcUri(origin, mediaId)]
+	return ok
+}
+
 func (w *ArchiveWriter) rotateTar() error {
 	if w.currentPart > 0 {
 		if err := w.writeTar(); err != nil {
@@ -137,7 +196,17 @@ func (w *ArchiveWriter) writeTar() error {
 	closerStack := readers.NewCancelCloser(pr, func() {
 		_ = readers.NewTempFileCloser("", f.Name(), f).Close()
 	})
-	return w.writeFn(w.currentPart, fname+".tgz", closerStack)
+	if err = w.writeFn(w.currentPart, fname+".tgz", closerStack); err != nil {
+		return err
+	}
+	if w.partWrittenFn != nil && !w.writingManifest {
+		media := make(map[string]*ManifestRecord, len(w.mediaManifest))
+		for k, v := range w.mediaManifest {
+			media[k] = v
+		}
+		w.partWrittenFn(&ArchiveState{Part: w.currentPart, Media: media})
+	}
+	return nil
 }
 
 // AppendMedia / returns (sha256hash, error)
@@ -156,7 +225,7 @@ func (w *ArchiveWriter) AppendMedia(file io.ReadCloser, info MediaInfo) (string,
 	if err != nil {
 		return "", err
 	}
-	w.mediaManifest[util.MxcUri(info.Origin, info.MediaId)] = &ManifestRecord{
+	record := &ManifestRecord{
 		FileName:     info.FileName,
 		ArchivedName: internalName,
 		SizeBytes:    size,
@@ -168,20 +237,8 @@ func (w *ArchiveWriter) AppendMedia(file io.ReadCloser, info MediaInfo) (string,
 		CreatedTs:    info.CreationTs,
 		Uploader:     info.UserId,
 	}
-	w.index.Media = append(w.index.Media, &templating.ExportIndexMediaModel{
-		ExportID:        w.exportId,
-		ArchivedName:    internalName,
-		FileName:        html.EscapeString(info.FileName),
-		Origin:          info.Origin,
-		MediaID:         info.MediaId,
-		SizeBytes:       size,
-		SizeBytesHuman:  humanize.Bytes(uint64(size)),
-		UploadTs:        info.CreationTs,
-		UploadDateHuman: createTime.UTC().Format(time.UnixDate),
-		Sha256Hash:      sha256hash,
-		ContentType:     info.ContentType,
-		Uploader:        info.UserId,
-	})
+	w.mediaManifest[util.MxcUri(info.Origin, info.MediaId)] = record
+	w.appendIndex(record)
 
 	if w.currentSize >= w.partSize {
 		return sha256hash, w.rotateTar()
@@ -190,6 +247,23 @@ func (w *ArchiveWriter) AppendMedia(file io.ReadCloser, info MediaInfo) (string,
 	return sha256hash, nil
 }
 
+func (w *ArchiveWriter) appendIndex(record *ManifestRecord) {
+	w.index.Media = append(w.index.Media, &templating.ExportIndexMediaModel{
+		ExportID:        w.exportId,
+		ArchivedName:    record.ArchivedName,
+		FileName:        html.EscapeString(record.FileName),
+		Origin:          record.Origin,
+		MediaID:         record.MediaId,
+		SizeBytes:       record.SizeBytes,
+		SizeBytesHuman:  humanize.Bytes(uint64(record.SizeBytes)),
+		UploadTs:        record.CreatedTs,
+		UploadDateHuman: util.FromMillis(record.CreatedTs).UTC().Format(time.UnixDate),
+		Sha256Hash:      record.Sha256,
+		ContentType:     record.ContentType,
+		Uploader:        record.Uploader,
+	})
+}
+
 func (w *ArchiveWriter) putFile(r io.Reader, name string, creationTime time.Time) (int64, string, error) {
 	f, err := os.CreateTemp(os.TempDir(), "mmr-archive-put")
 	if err != nil {
@@ -232,6 +306,13 @@ func (w *ArchiveWriter) putFile(r io.Reader, name string, creationTime time.Time
 	return i2, hex.EncodeToString(hasher.Sum(nil)), nil
 }
 
+// Abort discards the part being written without persisting it.
+func (w *ArchiveWriter) Abort() {
+	_ = w.currentTar.Close()
+	_ = w.currentTempFile.Close()
+	_ = os.Remove(w.currentTempFile.Name())
+}
+
 func (w *ArchiveWriter) Finish() error {
 	if err := w.rotateTar(); err != nil {
 		return err
@@ -245,25 +326,29 @@ func (w *ArchiveWriter) Finish() error {
 		CreatedTs: util.NowMillis(),
 		Media:     w.mediaManifest,
 	}
-	pr, pw := io.Pipe()
-	jenc := json.NewEncoder(pw)
-	go func() {
-		if err := jenc.Encode(manifest); err != nil {
-			_ = pw.CloseWithError(err)
-		} else {
-			_ = pw.Close()
-		}
-	}()
-	if _, _, err := w.putFile(pr, "manifest.json", time.Now()); err != nil {
+	manifestBytes, err := json.Marshal(manifest)
+	if err != nil {
 		return err
 	}
+	if _, _, err = w.putFile(bytes.NewReader(manifestBytes), "manifest.json", time.Now()); err != nil {
+		return err
+	}
+	if w.signingKey != nil {
+		sigBytes, err := json.Marshal(signManifest(w.signingKey, manifestBytes))
+		if err != nil {
+			return err
+		}
+		if _, _, err = w.putFile(bytes.NewReader(sigBytes), manifestSignatureFileName, time.Now()); err != nil {
+			return err
+		}
+	}
 
 	t, err := templating.GetTemplate("export_index")
 	if err != nil {
 		return err
 	}
 
-	pr, pw = io.Pipe()
+	pr, pw := io.Pipe()
 	go func() {
 		if err := t.Execute(pw, w.index); err != nil {
 			_ = pw.CloseWithError(err)
@@ -0,0 +1,220 @@
+package _common
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/datastores"
+)
+
+const BackupManifestVersion = 1
+const BackupManifestFile = "manifest.json"
+const BackupDatabaseFile = "database.dump"
+const BackupObjectsFile = "objects.jsonl"
+
+type BackupDatastore struct {
+	Id   string `json:"id"`
+	Type string `json:"type"`
+	Uri  string `json:"uri"`
+}
+
+type BackupManifest struct {
+	Version          int               `json:"version"`
+	CreatedTs        int64             `json:"created_ts"`
+	MediaRepoVersion string            `json:"media_repo_version"`
+	DatabaseFile     string            `json:"database_file"`
+	DatabaseSha256   string            `json:"database_sha256"`
+	ObjectsFile      string            `json:"objects_file"`
+	ObjectCount      int64             `json:"object_count"`
+	ObjectBytes      int64             `json:"object_bytes"`
+	Datastores       []BackupDatastore `json:"datastores"`
+}
+
+type BackupObject struct {
+	DatastoreId string `json:"datastore_id"`
+	Location    string `json:"location"`
+	Sha256Hash  string `json:"sha256_hash"`
+	SizeBytes   int64  `json:"size_bytes"`
+	Kind        string `json:"kind"`
+}
+
+func WriteBackupManifest(dir string, manifest *BackupManifest) error {
+	b, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path.Join(dir, BackupManifestFile), b, 0600)
+}
+
+func ReadBackupManifest(dir string) (*BackupManifest, error) {
+	b, err := os.ReadFile(path.Join(dir, BackupManifestFile))
+	if err != nil {
+		return nil, err
+	}
+	manifest := &BackupManifest{}
+	if err = json.Unmarshal(b, manifest); err != nil {
+		return nil, err
+	}
+	if manifest.Version != BackupManifestVersion {
+		return nil, fmt.Errorf("unsupported backup manifest version %d", manifest.Version)
+	}
+	return manifest, nil
+}
+
+// ReadBackupObjects reads the object list of a backup, calling fn for each object.
+func ReadBackupObjects(dir string, manifest *BackupManifest, fn func(obj *BackupObject) error) error {
+	f, err := os.Open(path.Join(dir, manifest.ObjectsFile))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		obj := &BackupObject{}
+		if err = json.Unmarshal(scanner.Bytes(), obj); err != nil {
+			return err
+		}
+		if err = fn(obj); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// HashFile returns the hex-encoded SHA-256 hash of the file.
+func HashFile(fileName string) (string, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hasher := sha256.New()
+	if _, err = io.Copy(hasher, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// RunPostgresTool runs one of the PostgreSQL client programs (pg_dump, pg_restore), passing its output through.
+func RunPostgresTool(program string, args ...string) error {
+	logrus.Debugf("Running %s %v", program, args)
+	cmd := exec.Command(program, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s failed: %w", program, err)
+	}
+	return nil
+}
+
+var ErrObjectMissing = errors.New("object missing from datastore")
+var ErrObjectHashMismatch = errors.New("object does not match its recorded hash")
+
+// VerifyObject checks that the object can be read from its datastore. If deep is true, the whole object is read
+// and compared against its recorded hash.
+func VerifyObject(ctx rcontext.RequestContext, obj *BackupObject, deep bool) error {
+	ds, ok := datastores.Get(ctx, obj.DatastoreId)
+	if !ok {
+		return fmt.Errorf("datastore %s is not configured", obj.DatastoreId)
+	}
+	f, err := datastores.Download(ctx, ds, obj.Location)
+	if err != nil {
+		return errors.Join(ErrObjectMissing, err)
+	}
+	defer f.Close()
+
+	if !deep {
+		// Some datastores don't fetch anything until the first read
+		if _, err = f.Read(make([]byte, 1)); err != nil && !errors.Is(err, io.EOF) {
+			return errors.Join(ErrObjectMissing, err)
+		}
+		return nil
+	}
+
+	hasher := sha256.New()
+	if _, err = io.Copy(hasher, f); err != nil {
+		return errors.Join(ErrObjectMissing, err)
+	}
+	if hex.EncodeToString(hasher.Sum(nil)) != obj.Sha256Hash {
+		return ErrObjectHashMismatch
+	}
+	return nil
+}
+
+// VerifyBackupObjects verifies every object in the backup with the given concurrency, returning the objects
+// which failed verification.
+func VerifyBackupObjects(ctx rcontext.RequestContext, dir string, manifest *BackupManifest, deep bool, concurrency int) ([]*BackupObject, error) {
+	failed := make([]*BackupObject, 0)
+	failedLock := &sync.Mutex{}
+	checked := int64(0)
+
+	ch := make(chan *BackupObject)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < max(1, concurrency); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for obj := range ch {
+				if err := VerifyObject(ctx, obj, deep); err != nil {
+					logrus.Warnf("%s/%s: %v", obj.DatastoreId, obj.Location, err)
+					failedLock.Lock()
+					failed = append(failed, obj)
+					failedLock.Unlock()
+				}
+			}
+		}()
+	}
+
+	err := ReadBackupObjects(dir, manifest, func(obj *BackupObject) error {
+		ch <- obj
+		checked++
+		if checked%1000 == 0 {
+			logrus.Infof("Verified %d/%d objects", checked, manifest.ObjectCount)
+		}
+		return nil
+	})
+	close(ch)
+	wg.Wait()
+	return failed, err
+}
+
+// WriteFailedObjects writes the objects which failed verification to a file, one JSON object per line.
+func WriteFailedObjects(fileName string, objects []*BackupObject) error {
+	f, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	encoder := json.NewEncoder(f)
+	for _, obj := range objects {
+		if err = encoder.Encode(obj); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ToBackupObject converts a database record to its representation in a backup.
+func ToBackupObject(obj *database.DbDatastoreObject) *BackupObject {
+	return &BackupObject{
+		DatastoreId: obj.DatastoreId,
+		Location:    obj.Location,
+		Sha256Hash:  obj.Sha256Hash,
+		SizeBytes:   obj.SizeBytes,
+		Kind:        obj.Kind,
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-media-repo/cmd/archival/_common"
+	"github.com/t2bot/matrix-media-repo/common/assets"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/logging"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/common/runtime"
+	"github.com/t2bot/matrix-media-repo/common/version"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/datastores"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+func main() {
+	configPath := flag.String("config", "media-repo.yaml", "The path to the configuration")
+	migrationsPath := flag.String("migrations", config.DefaultMigrationsPath, "The absolute path for the migrations folder")
+	outputDir := flag.String("output", "", "The directory to write the backup to. Defaults to ./mmr-backup-<timestamp>")
+	pgDump := flag.String("pgDump", "pg_dump", "The pg_dump program to use. Must be at least the same major version as the database server.")
+	pgRestore := flag.String("pgRestore", "pg_restore", "The pg_restore program to use for checking the database dump can be read.")
+	verifyObjects := flag.Bool("verifyObjects", false, "If set, every object in the datastores is read back and checked against its recorded hash. Otherwise objects are only checked to exist.")
+	skipObjectCheck := flag.Bool("skipObjectCheck", false, "If set, objects are not checked at all. Useful when the datastores are backed up separately after this runs.")
+	concurrency := flag.Int("concurrency", 4, "The number of objects to check at the same time")
+	flag.Parse()
+
+	// Override config path with config for Docker users
+	configEnv := os.Getenv("REPO_CONFIG")
+	if configEnv != "" {
+		configPath = &configEnv
+	}
+
+	config.Runtime.IsImportProcess = true // prevents us from creating media by accident
+	config.Path = *configPath
+
+	defer assets.Cleanup()
+	assets.SetupMigrations(*migrationsPath)
+
+	var err error
+	err = logging.Setup(
+		config.Get().General.LogDirectory,
+		config.Get().General.LogColors,
+		config.Get().General.JsonLogs,
+		config.Get().General.LogLevel,
+	)
+	if err != nil {
+		panic(err)
+	}
+
+	if config.Get().Database.Sqlite != "" {
+		logrus.Fatal("Only PostgreSQL databases can be backed up with this tool. For SQLite, stop the media repo and copy the database file instead.")
+	}
+
+	// Limited runtime because we don't need *everything*
+	logrus.Info("Starting up...")
+	version.Print(true)
+	runtime.LoadDatabase()
+	runtime.LoadDatastores()
+
+	ctx := rcontext.Initial()
+	if *outputDir == "" {
+		*outputDir = fmt.Sprintf("./mmr-backup-%s", time.Now().UTC().Format("20060102-150405"))
+	}
+	if err = os.MkdirAll(*outputDir, 0700); err != nil {
+		logrus.Fatal(err)
+	}
+	logrus.Info("Writing backup to ", *outputDir)
+
+	manifest := &_common.BackupManifest{
+		Version:          _common.BackupManifestVersion,
+		CreatedTs:        util.NowMillis(),
+		MediaRepoVersion: version.Version,
+		DatabaseFile:     _common.BackupDatabaseFile,
+		ObjectsFile:      _common.BackupObjectsFile,
+		Datastores:       make([]_common.BackupDatastore, 0),
+	}
+	for _, ds := range config.UniqueDatastores() {
+		uri, err := datastores.GetUri(ds)
+		if err != nil {
+			logrus.Warnf("Unable to describe datastore %s: %v", ds.Id, err)
+		}
+		manifest.Datastores = append(manifest.Datastores, _common.BackupDatastore{Id: ds.Id, Type: ds.Type, Uri: uri})
+	}
+
+	// List the objects first: anything uploaded after this point is in the database dump, but not the manifest,
+	// which is better than the other way around.
+	logrus.Info("Listing datastore objects...")
+	objects, err := database.GetInstance().MetadataView.Prepare(ctx).DatastoreObjects()
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	f, err := os.Create(path.Join(*outputDir, manifest.ObjectsFile))
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	encoder := json.NewEncoder(f)
+	for _, obj := range objects {
+		if err = encoder.Encode(_common.ToBackupObject(obj)); err != nil {
+			logrus.Fatal(err)
+		}
+		manifest.ObjectCount++
+		manifest.ObjectBytes += obj.SizeBytes
+	}
+	if err = f.Close(); err != nil {
+		logrus.Fatal(err)
+	}
+	logrus.Infof("Listed %d objects (%d bytes)", manifest.ObjectCount, manifest.ObjectBytes)
+
+	logrus.Info("Dumping database...")
+	dbFile := path.Join(*outputDir, manifest.DatabaseFile)
+	if err = _common.RunPostgresTool(*pgDump, "--format=custom", "--no-owner", "--file="+dbFile, "--dbname="+config.Get().Database.Postgres); err != nil {
+		logrus.Fatal(err)
+	}
+	if manifest.DatabaseSha256, err = _common.HashFile(dbFile); err != nil {
+		logrus.Fatal(err)
+	}
+
+	logrus.Info("Checking the database dump can be read...")
+	if err = _common.RunPostgresTool(*pgRestore, "--list", dbFile); err != nil {
+		logrus.Fatal(err)
+	}
+
+	if err = _common.WriteBackupManifest(*outputDir, manifest); err != nil {
+		logrus.Fatal(err)
+	}
+
+	if !*skipObjectCheck {
+		logrus.Info("Checking datastore objects...")
+		failed, err := _common.VerifyBackupObjects(ctx, *outputDir, manifest, *verifyObjects, *concurrency)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		if len(failed) > 0 {
+			failedFile := path.Join(*outputDir, "failed-objects.jsonl")
+			if err = _common.WriteFailedObjects(failedFile, failed); err != nil {
+				logrus.Fatal(err)
+			}
+			logrus.Fatalf("%d objects failed verification and would not be restorable. See %s for the list.", len(failed), failedFile)
+		}
+	}
+
+	logrus.Infof("Backup complete. Back up the contents of the datastores (%d objects) alongside %s to be able to restore.", manifest.ObjectCount, *outputDir)
+}
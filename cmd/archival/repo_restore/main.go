@@ -0,0 +1,108 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path"
+
+	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-media-repo/cmd/archival/_common"
+	"github.com/t2bot/matrix-media-repo/common/assets"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/logging"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/common/runtime"
+	"github.com/t2bot/matrix-media-repo/common/version"
+)
+
+func main() {
+	configPath := flag.String("config", "media-repo.yaml", "The path to the configuration")
+	migrationsPath := flag.String("migrations", config.DefaultMigrationsPath, "The absolute path for the migrations folder")
+	inputDir := flag.String("input", "", "The backup directory to restore, as written by repo_backup")
+	pgRestore := flag.String("pgRestore", "pg_restore", "The pg_restore program to use. Must be at least the same major version as the pg_dump which made the backup.")
+	force := flag.Bool("force", false, "If set, any existing media repo tables in the database are dropped and replaced by the backup. Otherwise the database must be empty.")
+	verifyObjects := flag.Bool("verifyObjects", false, "If set, every object in the datastores is read back and checked against its recorded hash. Otherwise objects are only checked to exist.")
+	skipObjectCheck := flag.Bool("skipObjectCheck", false, "If set, objects are not checked at all.")
+	concurrency := flag.Int("concurrency", 4, "The number of objects to check at the same time")
+	flag.Parse()
+
+	// Override config path with config for Docker users
+	configEnv := os.Getenv("REPO_CONFIG")
+	if configEnv != "" {
+		configPath = &configEnv
+	}
+
+	config.Runtime.IsImportProcess = true // prevents us from creating media by accident
+	config.Path = *configPath
+
+	defer assets.Cleanup()
+	assets.SetupMigrations(*migrationsPath)
+
+	var err error
+	err = logging.Setup(
+		config.Get().General.LogDirectory,
+		config.Get().General.LogColors,
+		config.Get().General.JsonLogs,
+		config.Get().General.LogLevel,
+	)
+	if err != nil {
+		panic(err)
+	}
+
+	if config.Get().Database.Sqlite != "" {
+		logrus.Fatal("Only PostgreSQL databases can be restored with this tool.")
+	}
+
+	logrus.Info("Starting up...")
+	version.Print(true)
+
+	if *inputDir == "" {
+		logrus.Fatalf("A backup directory is required. Try '%s -help' for information.", os.Args[0])
+	}
+	manifest, err := _common.ReadBackupManifest(*inputDir)
+	if err != nil {
+		logrus.Fatal("Error reading backup manifest: ", err)
+	}
+	logrus.Infof("Backup was made by media repo version %s and lists %d objects (%d bytes)", manifest.MediaRepoVersion, manifest.ObjectCount, manifest.ObjectBytes)
+
+	dbFile := path.Join(*inputDir, manifest.DatabaseFile)
+	if hash, err := _common.HashFile(dbFile); err != nil {
+		logrus.Fatal(err)
+	} else if hash != manifest.DatabaseSha256 {
+		logrus.Fatal("The database dump does not match the hash in the backup manifest - the backup may be corrupt")
+	}
+
+	// Restore before connecting, otherwise the migrations would create the tables we're about to restore
+	logrus.Info("Restoring database...")
+	args := []string{"--no-owner", "--single-transaction", "--exit-on-error", "--dbname=" + config.Get().Database.Postgres}
+	if *force {
+		args = append(args, "--clean", "--if-exists")
+	}
+	if err = _common.RunPostgresTool(*pgRestore, append(args, dbFile)...); err != nil {
+		if !*force {
+			logrus.Error("If the database already has media repo tables in it, use -force to replace them")
+		}
+		logrus.Fatal(err)
+	}
+
+	// Loading the database applies any migrations newer than the backup
+	runtime.LoadDatabase()
+	runtime.LoadDatastores()
+
+	if !*skipObjectCheck {
+		logrus.Info("Checking datastore objects...")
+		failed, err := _common.VerifyBackupObjects(rcontext.Initial(), *inputDir, manifest, *verifyObjects, *concurrency)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		if len(failed) > 0 {
+			failedFile := path.Join(*inputDir, "missing-objects.jsonl")
+			if err = _common.WriteFailedObjects(failedFile, failed); err != nil {
+				logrus.Fatal(err)
+			}
+			logrus.Fatalf("The database was restored, but %d objects are missing or damaged. Restore them to the datastores, or purge the affected media. See %s for the list.", len(failed), failedFile)
+		}
+	}
+
+	logrus.Info("Restore complete")
+}
@@ -107,7 +107,7 @@ func doWork(ctx rcontext.RequestContext, record *MediaMetadata, serverName strin
 			panic(err)
 		}
 
-		dbRecord, err = pipeline_upload.Execute(ctx, serverName, record.MediaId, body, record.ContentType, record.FileName, record.UploaderUserId, datastores.LocalMediaKind)
+		dbRecord, err = pipeline_upload.Execute(ctx, serverName, record.MediaId, body, record.ContentType, record.FileName, record.UploaderUserId, datastores.LocalMediaKind, nil)
 		if err != nil {
 			panic(err)
 		}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-media-repo/common/assets"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/import_cmdline"
+	"github.com/t2bot/matrix-media-repo/common/logging"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/common/runtime"
+	"github.com/t2bot/matrix-media-repo/tasks/task_runner"
+	"github.com/t2bot/matrix-media-repo/util/ids"
+	"golang.org/x/term"
+)
+
+func main() {
+	configPath := flag.String("config", "media-repo.yaml", "The path to the configuration")
+	migrationsPath := flag.String("migrations", config.DefaultMigrationsPath, "The absolute path for the migrations folder")
+	mediaStorePath := flag.String("mediaDirectory", "./media_store", "The media_store_path for Synapse.")
+	serverName := flag.String("serverName", "localhost", "The name of your homeserver (eg: matrix.org).")
+	postgresHost := flag.String("dbHost", "", "The hostname for your Synapse PostgreSQL database. Optional: when set, upload names, content types, and uploaders are read from Synapse.")
+	postgresPort := flag.Int("dbPort", 5432, "The port for your Synapse PostgreSQL database.")
+	postgresUsername := flag.String("dbUsername", "synapse", "The username for your Synapse PostgreSQL database.")
+	postgresPassword := flag.String("dbPassword", "", "The password for your Synapse PostgreSQL database. Can be omitted to be prompted when run.")
+	postgresDatabase := flag.String("dbName", "synapse", "The name of your Synapse PostgreSQL database.")
+	flag.Parse()
+
+	// Override config path with config for Docker users
+	configEnv := os.Getenv("REPO_CONFIG")
+	if configEnv != "" {
+		configPath = &configEnv
+	}
+
+	config.Runtime.IsImportProcess = true // prevents us from creating media by accident
+	config.Path = *configPath
+
+	defer assets.Cleanup()
+	assets.SetupMigrations(*migrationsPath)
+
+	if ids.GetMachineId() == 0 {
+		import_cmdline.AskMachineId()
+	}
+
+	params := task_runner.ImportSynapseMediaStoreParams{
+		ServerName:     *serverName,
+		MediaStorePath: *mediaStorePath,
+	}
+	if *postgresHost != "" {
+		var realPsqlPassword string
+		if *postgresPassword == "" {
+			if !term.IsTerminal(int(os.Stdin.Fd())) {
+				fmt.Println("Sorry, your terminal does not support reading passwords. Please supply a -dbPassword or use a different terminal.")
+				os.Exit(1)
+				return
+			}
+			fmt.Printf("Postgres password: ")
+			pass, err := term.ReadPassword(int(os.Stdin.Fd()))
+			if err != nil {
+				panic(err)
+			}
+			realPsqlPassword = string(pass[:])
+		} else {
+			realPsqlPassword = *postgresPassword
+		}
+		params.SynapseDatabase = "postgres://" + *postgresUsername + ":" + realPsqlPassword + "@" + *postgresHost + ":" + strconv.Itoa(*postgresPort) + "/" + *postgresDatabase + "?sslmode=disable"
+	}
+
+	err := logging.Setup(
+		config.Get().General.LogDirectory,
+		config.Get().General.LogColors,
+		config.Get().General.JsonLogs,
+		config.Get().General.LogLevel,
+	)
+	if err != nil {
+		panic(err)
+	}
+
+	logrus.Info("Starting up...")
+	runtime.RunStartupSequence()
+
+	logrus.Info("Importing media store...")
+	progress := &task_runner.SynapseImportProgress{}
+	if err = task_runner.ImportFromSynapseMediaStore(rcontext.Initial(), params, progress, nil, nil); err != nil {
+		logrus.Errorf("Import stopped after %s (%d imported, %d skipped)", progress.LastMediaId, progress.Imported, progress.Skipped)
+		panic(err)
+	}
+	logrus.Info("Import complete.")
+}
@@ -29,6 +29,7 @@ func main() {
 	}
 
 	appendFn(readDir(*migrationsPath, "migrations"))
+	appendFn(readDir(path.Join(*migrationsPath, "sqlite"), "migrations/sqlite"))
 	appendFn(readDir(*templatesPath, "templates"))
 	appendFn(readDir(*assetsPath, "assets"))
 
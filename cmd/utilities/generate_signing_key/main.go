@@ -1,6 +1,8 @@
 package main
 
 import (
+	"crypto/ed25519"
+	"encoding/base64"
 	"flag"
 	"os"
 
@@ -29,6 +31,8 @@ func main() {
 	}
 
 	logrus.Infof("Key ID will be 'ed25519:%s'", key.KeyVersion)
+	publicKey := ed25519.NewKeyFromSeed(key.PrivateKey.Seed()).Public().(ed25519.PublicKey)
+	logrus.Infof("Public key will be '%s'", base64.RawStdEncoding.EncodeToString(publicKey))
 
 	_common.EncodeSigningKeys([]*homeserver_interop.SigningKey{key}, *outputFormat, *outputFile)
 }
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-media-repo/common/version"
+)
+
+const (
+	opUpload    = "upload"
+	opDownload  = "download"
+	opThumbnail = "thumbnail"
+)
+
+type weighted[T any] struct {
+	value  T
+	weight int
+}
+
+type distribution[T any] struct {
+	choices []weighted[T]
+	total   int
+}
+
+func (d *distribution[T]) pick(r *rand.Rand) T {
+	n := r.Intn(d.total)
+	for _, c := range d.choices {
+		if n < c.weight {
+			return c.value
+		}
+		n -= c.weight
+	}
+	return d.choices[len(d.choices)-1].value
+}
+
+// parseDistribution parses a comma-separated list of `value:weight` pairs. Weights default to 1.
+func parseDistribution[T any](spec string, parseValue func(string) (T, error)) (*distribution[T], error) {
+	d := &distribution[T]{choices: make([]weighted[T], 0)}
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		valueStr, weightStr, hasWeight := strings.Cut(part, ":")
+		if strings.Contains(weightStr, ":") {
+			return nil, fmt.Errorf("invalid distribution entry '%s'", part)
+		}
+		weight := 1
+		if hasWeight {
+			var err error
+			weight, err = strconv.Atoi(weightStr)
+			if err != nil || weight < 0 {
+				return nil, fmt.Errorf("invalid weight in distribution entry '%s'", part)
+			}
+		}
+		value, err := parseValue(valueStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value in distribution entry '%s': %w", part, err)
+		}
+		d.choices = append(d.choices, weighted[T]{value: value, weight: weight})
+		d.total += weight
+	}
+	if d.total <= 0 {
+		return nil, errors.New("distribution must have at least one entry with a positive weight")
+	}
+	return d, nil
+}
+
+type result struct {
+	op       string
+	duration time.Duration
+	bytes    int64
+	err      error
+}
+
+type client struct {
+	baseUrl     string
+	hostname    string
+	accessToken string
+	http        *http.Client
+}
+
+func (c *client) do(method string, path string, query url.Values, contentType string, body io.Reader) (*http.Response, error) {
+	u := c.baseUrl + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	if c.hostname != "" {
+		req.Host = c.hostname
+	}
+	req.Header.Set("User-Agent", "matrix-media-repo load_test")
+	req.Header.Set("Authorization", "Bearer "+c.accessToken)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	res, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(res.Body)
+		_ = res.Body.Close()
+		return nil, fmt.Errorf("%s %s: status %d: %s", method, path, res.StatusCode, strings.TrimSpace(string(b)))
+	}
+	return res, nil
+}
+
+func (c *client) upload(fileName string, contentType string, data []byte) (string, error) {
+	res, err := c.do(http.MethodPost, "/_matrix/media/v3/upload", url.Values{"filename": []string{fileName}}, contentType, bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	uploadRes := &struct {
+		ContentUri string `json:"content_uri"`
+	}{}
+	if err = json.NewDecoder(res.Body).Decode(uploadRes); err != nil {
+		return "", err
+	}
+	if !strings.HasPrefix(uploadRes.ContentUri, "mxc://") {
+		return "", fmt.Errorf("unexpected content_uri '%s'", uploadRes.ContentUri)
+	}
+	return strings.TrimPrefix(uploadRes.ContentUri, "mxc://"), nil
+}
+
+// fetch downloads the whole response body, returning the number of bytes read.
+func (c *client) fetch(path string, query url.Values) (int64, error) {
+	res, err := c.do(http.MethodGet, path, query, "", nil)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	return io.Copy(io.Discard, res.Body)
+}
+
+// generateMedia makes roughly sizeBytes of media of the given content type. Images are real (noisy, so they
+// don't compress well) images, while everything else is random bytes.
+func generateMedia(r *rand.Rand, contentType string, sizeBytes uint64) ([]byte, string, error) {
+	switch contentType {
+	case "image/png", "image/jpeg":
+		// Noise is barely compressible: PNG stores ~3 bytes per pixel, and high quality JPEG a bit less.
+		side := int(math.Max(1, math.Sqrt(float64(sizeBytes)/3)))
+		img := image.NewRGBA(image.Rect(0, 0, side, side))
+		for i := 0; i < len(img.Pix); i += 4 {
+			img.Pix[i] = uint8(r.Intn(256))
+			img.Pix[i+1] = uint8(r.Intn(256))
+			img.Pix[i+2] = uint8(r.Intn(256))
+			img.Pix[i+3] = 0xff
+		}
+		buf := &bytes.Buffer{}
+		if contentType == "image/png" {
+			err := png.Encode(buf, img)
+			return buf.Bytes(), "png", err
+		}
+		err := jpeg.Encode(buf, img, &jpeg.Options{Quality: 95})
+		return buf.Bytes(), "jpg", err
+	default:
+		b := make([]byte, sizeBytes)
+		_, _ = r.Read(b)
+		ext := "bin"
+		if _, sub, ok := strings.Cut(contentType, "/"); ok && sub != "" && sub != "octet-stream" {
+			ext = sub
+		}
+		return b, ext, nil
+	}
+}
+
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+	return sorted[max(0, min(i, len(sorted)-1))]
+}
+
+func main() {
+	serverUrl := flag.String("server", "http://localhost:8000", "The base URL of the deployment to test. Requests go to the client-server API paths under this URL.")
+	hostname := flag.String("hostname", "", "When set, the Host header to send with requests. Useful when -server points directly at the media repo.")
+	accessToken := flag.String("accessToken", "", "The access token of the user to upload and download media as. This user's quota and rate limits apply.")
+	uploads := flag.Int("uploads", 100, "The number of media items to upload.")
+	downloadsPerUpload := flag.Int("downloadsPerUpload", 5, "The number of times each uploaded item is downloaded.")
+	thumbnails := flag.Bool("thumbnails", true, "Whether to also request a thumbnail of each uploaded image after each download.")
+	concurrency := flag.Int("concurrency", 8, "The number of uploads (and their downloads) to run at the same time.")
+	sizesSpec := flag.String("sizes", "16KiB:40,512KiB:40,5MiB:15,50MiB:5", "The distribution of upload sizes, as a comma-separated list of size:weight pairs.")
+	typesSpec := flag.String("types", "image/png:40,image/jpeg:30,video/mp4:10,application/octet-stream:20", "The distribution of upload content types, as a comma-separated list of type:weight pairs. Only PNG and JPEG are generated as real media, so only those can be thumbnailed.")
+	seed := flag.Int64("seed", 0, "The random seed for generating media. Zero uses the current time.")
+	timeoutSeconds := flag.Int("timeout", 120, "The timeout, in seconds, for each request.")
+	flag.Parse()
+
+	version.SetDefaults()
+	version.Print(true)
+
+	if *accessToken == "" {
+		logrus.Fatalf("An access token is required. Try '%s -help' for information.", os.Args[0])
+	}
+	if *uploads <= 0 || *concurrency <= 0 || *downloadsPerUpload < 0 {
+		logrus.Fatal("-uploads and -concurrency must be positive, and -downloadsPerUpload must not be negative")
+	}
+	sizes, err := parseDistribution(*sizesSpec, humanize.ParseBytes)
+	if err != nil {
+		logrus.Fatal("Error parsing -sizes: ", err)
+	}
+	types, err := parseDistribution(*typesSpec, func(s string) (string, error) {
+		if !strings.Contains(s, "/") {
+			return "", errors.New("not a content type")
+		}
+		return s, nil
+	})
+	if err != nil {
+		logrus.Fatal("Error parsing -types: ", err)
+	}
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+	logrus.Infof("Using seed %d", *seed)
+
+	c := &client{
+		baseUrl:     strings.TrimSuffix(*serverUrl, "/"),
+		hostname:    *hostname,
+		accessToken: *accessToken,
+		http:        &http.Client{Timeout: time.Duration(*timeoutSeconds) * time.Second},
+	}
+
+	results := make(chan result)
+	jobs := make(chan int64)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < *concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for jobSeed := range jobs {
+				r := rand.New(rand.NewSource(jobSeed))
+				contentType := types.pick(r)
+				data, ext, err := generateMedia(r, contentType, sizes.pick(r))
+				if err != nil {
+					logrus.Fatal("Error generating media: ", err)
+				}
+
+				start := time.Now()
+				mxc, err := c.upload(fmt.Sprintf("load_test_%d.%s", jobSeed, ext), contentType, data)
+				results <- result{op: opUpload, duration: time.Since(start), bytes: int64(len(data)), err: err}
+				if err != nil {
+					continue
+				}
+
+				for j := 0; j < *downloadsPerUpload; j++ {
+					start = time.Now()
+					n, err := c.fetch("/_matrix/client/v1/media/download/"+mxc, nil)
+					results <- result{op: opDownload, duration: time.Since(start), bytes: n, err: err}
+
+					if *thumbnails && (contentType == "image/png" || contentType == "image/jpeg") {
+						start = time.Now()
+						n, err = c.fetch("/_matrix/client/v1/media/thumbnail/"+mxc, url.Values{
+							"width":  []string{"320"},
+							"height": []string{"240"},
+							"method": []string{"scale"},
+						})
+						results <- result{op: opThumbnail, duration: time.Since(start), bytes: n, err: err}
+					}
+				}
+			}
+		}()
+	}
+	go func() {
+		r := rand.New(rand.NewSource(*seed))
+		for i := 0; i < *uploads; i++ {
+			jobs <- r.Int63()
+		}
+		close(jobs)
+		wg.Wait()
+		close(results)
+	}()
+
+	logrus.Infof("Running %d uploads with %d downloads each, %d at a time", *uploads, *downloadsPerUpload, *concurrency)
+	started := time.Now()
+	durations := make(map[string][]time.Duration)
+	errorCounts := make(map[string]int)
+	byteCounts := make(map[string]int64)
+	completedUploads := 0
+	for res := range results {
+		if res.err != nil {
+			errorCounts[res.op]++
+			logrus.Warnf("%s failed: %v", res.op, res.err)
+			continue
+		}
+		durations[res.op] = append(durations[res.op], res.duration)
+		byteCounts[res.op] += res.bytes
+		if res.op == opUpload {
+			completedUploads++
+			if completedUploads%max(1, *uploads/10) == 0 {
+				logrus.Infof("%d/%d uploads complete", completedUploads, *uploads)
+			}
+		}
+	}
+	elapsed := time.Since(started)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	_, _ = fmt.Fprintln(w, "operation\tok\terrors\tp50\tp90\tp95\tp99\tmax\ttransferred\tthroughput\t")
+	for _, op := range []string{opUpload, opDownload, opThumbnail} {
+		d := durations[op]
+		if len(d) == 0 && errorCounts[op] == 0 {
+			continue
+		}
+		sort.Slice(d, func(i, j int) bool { return d[i] < d[j] })
+		_, _ = fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s/s\t\n",
+			op, len(d), errorCounts[op],
+			percentile(d, 50).Round(time.Millisecond),
+			percentile(d, 90).Round(time.Millisecond),
+			percentile(d, 95).Round(time.Millisecond),
+			percentile(d, 99).Round(time.Millisecond),
+			percentile(d, 100).Round(time.Millisecond),
+			humanize.IBytes(uint64(byteCounts[op])),
+			humanize.IBytes(uint64(float64(byteCounts[op])/elapsed.Seconds())),
+		)
+	}
+	_ = w.Flush()
+	fmt.Printf("Completed in %s\n", elapsed.Round(time.Millisecond))
+}
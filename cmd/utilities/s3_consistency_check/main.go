@@ -58,15 +58,11 @@ func main() {
 	if !ok {
 		panic(errors.New("datastore not found"))
 	}
-	if ds.Type != "s3" {
-		panic(errors.New("datastore is not an S3 datastore"))
-	}
-
 	mediaDb := database.GetInstance().Media.Prepare(ctx)
 	thumbsDb := database.GetInstance().Thumbnails.Prepare(ctx)
 
 	logrus.Info("Scanning datastore for unreferenced media")
-	ch, err := datastores.ListS3Files(ctx, ds)
+	ch, err := datastores.ListObjects(ctx, ds)
 	unreferenced := make([]string, 0)
 	totalBytes := int64(0)
 	if err != nil {
@@ -74,8 +70,11 @@ func main() {
 	}
 	var exists bool
 	for object := range ch {
-		logrus.Debugf("Checking %s against media tables", object.Key)
-		exists, err = mediaDb.LocationExists(ds.Id, object.Key)
+		if object.Err != nil {
+			panic(object.Err)
+		}
+		logrus.Debugf("Checking %s against media tables", object.Location)
+		exists, err = mediaDb.LocationExists(ds.Id, object.Location)
 		if err != nil {
 			panic(err)
 		}
@@ -83,7 +82,7 @@ func main() {
 			continue
 		}
 
-		exists, err = thumbsDb.LocationExists(ds.Id, object.Key)
+		exists, err = thumbsDb.LocationExists(ds.Id, object.Location)
 		if err != nil {
 			panic(err)
 		}
@@ -91,9 +90,9 @@ func main() {
 			continue
 		}
 
-		unreferenced = append(unreferenced, object.Key)
-		totalBytes += object.Size
-		logrus.Infof("%s is probably safe to delete (not referenced by this media repo config)", object.Key)
+		unreferenced = append(unreferenced, object.Location)
+		totalBytes += object.SizeBytes
+		logrus.Infof("%s is probably safe to delete (not referenced by this media repo config)", object.Location)
 	}
 
 	logrus.Infof("Found %d potentially removable objects in S3 (%d bytes | %s)", len(unreferenced), totalBytes, humanize.Bytes(uint64(totalBytes)))
@@ -17,6 +17,7 @@ import (
 	"github.com/t2bot/matrix-media-repo/common/logging"
 	"github.com/t2bot/matrix-media-repo/common/runtime"
 	"github.com/t2bot/matrix-media-repo/common/version"
+	"github.com/t2bot/matrix-media-repo/datastores"
 	"github.com/t2bot/matrix-media-repo/metrics"
 	"github.com/t2bot/matrix-media-repo/pgo_internal"
 	"github.com/t2bot/matrix-media-repo/tasks"
@@ -71,10 +72,18 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
+	if config.Get().General.AccessLog {
+		if err = logging.SetupAccessLog(config.Get().General.LogDirectory); err != nil {
+			panic(err)
+		}
+	}
 
 	logrus.Info("Starting up...")
 	runtime.RunStartupSequence()
 
+	logrus.Info("Testing datastores...")
+	datastores.StartSelfTests()
+
 	logrus.Info("Starting recurring tasks...")
 	tasks.StartAll()
 
@@ -85,6 +94,17 @@ func main() {
 	}(watcher)
 	setupReloads()
 
+	// Also reload the config on SIGHUP, for setups where the file watcher doesn't see changes (such as some
+	// container volume mounts)
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			logrus.Info("SIGHUP received - reloading config")
+			_ = config.Reload()
+		}
+	}()
+
 	logrus.Info("Starting media repository...")
 	if config.Get().PGO.Enabled {
 		pgo_internal.Enable(config.Get().PGO.SubmitUrl, config.Get().PGO.SubmitKey)
@@ -95,6 +115,7 @@ func main() {
 	// Set up a function to stop everything
 	stopAllButWeb := func() {
 		logrus.Info("Stopping reload watchers...")
+		signal.Stop(hup)
 		stopReloads()
 
 		logrus.Info("Stopping metrics...")
@@ -102,6 +123,9 @@ func main() {
 
 		logrus.Info("Stopping recurring tasks...")
 		tasks.StopAll()
+
+		logrus.Info("Stopping datastore self tests...")
+		datastores.StopSelfTests()
 	}
 
 	// Set up a listener for SIGINT
@@ -8,6 +8,7 @@ import (
 	"github.com/t2bot/matrix-media-repo/common/globals"
 	"github.com/t2bot/matrix-media-repo/common/runtime"
 	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/datastores"
 	"github.com/t2bot/matrix-media-repo/errcache"
 	"github.com/t2bot/matrix-media-repo/limits"
 	"github.com/t2bot/matrix-media-repo/matrix"
@@ -116,6 +117,7 @@ func reloadDatastoresOnChan(reloadChan chan bool) {
 			shouldReload := <-reloadChan
 			if shouldReload {
 				runtime.LoadDatastores()
+				datastores.StartSelfTests()
 			} else {
 				return // received stop
 			}
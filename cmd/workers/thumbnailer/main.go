@@ -0,0 +1,97 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-media-repo/common/assets"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/logging"
+	"github.com/t2bot/matrix-media-repo/common/runtime"
+	"github.com/t2bot/matrix-media-repo/common/version"
+	"github.com/t2bot/matrix-media-repo/pipelines/_steps/thumbnails"
+	"github.com/t2bot/matrix-media-repo/redislib"
+)
+
+func main() {
+	configPath := flag.String("config", "media-repo.yaml", "The path to the configuration")
+	migrationsPath := flag.String("migrations", config.DefaultMigrationsPath, "The absolute path for the migrations folder")
+	assetsPath := flag.String("assets", config.DefaultAssetsPath, "The absolute path for the assets folder")
+	concurrency := flag.Int("concurrency", 0, "The number of jobs to process at once. Defaults to thumbnailWorkers.concurrency from the config")
+	versionFlag := flag.Bool("version", false, "Prints the version and exits")
+	flag.Parse()
+
+	if *versionFlag {
+		version.Print(false)
+		return // exit 0
+	}
+
+	// Override config path with config for Docker users
+	configEnv := os.Getenv("REPO_CONFIG")
+	if configEnv != "" {
+		configPath = &configEnv
+	}
+
+	config.Path = *configPath
+	if config.Get().Sentry.Enabled {
+		logrus.Info("Setting up Sentry for debugging...")
+		err := sentry.Init(sentry.ClientOptions{
+			Dsn:         config.Get().Sentry.Dsn,
+			Environment: config.Get().Sentry.Environment,
+			Debug:       config.Get().Sentry.Debug,
+			Release:     fmt.Sprintf("%s-%s", version.Version, version.GitCommit),
+		})
+		if err != nil {
+			panic(err)
+		}
+	}
+	defer sentry.Flush(2 * time.Second)
+	defer sentry.Recover()
+
+	defer assets.Cleanup()
+	assets.SetupMigrations(*migrationsPath)
+	assets.SetupAssets(*assetsPath)
+
+	err := logging.Setup(
+		config.Get().General.LogDirectory,
+		config.Get().General.LogColors,
+		config.Get().General.JsonLogs,
+		config.Get().General.LogLevel,
+	)
+	if err != nil {
+		panic(err)
+	}
+
+	if !config.Get().Redis.Enabled {
+		logrus.Fatal("Redis must be enabled for thumbnail workers to receive jobs")
+	}
+
+	logrus.Info("Starting up...")
+	runtime.RunStartupSequence()
+
+	workers := *concurrency
+	if workers <= 0 {
+		workers = config.Get().ThumbnailWorkers.Concurrency
+	}
+
+	stop := make(chan struct{})
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		logrus.Warn("Stop signal received - finishing current jobs")
+		close(stop)
+	}()
+
+	logrus.Infof("Processing thumbnail jobs with %d workers...", workers)
+	thumbnails.ServeOffloadedJobs(workers, stop)
+
+	redislib.Stop()
+	logrus.Info("Goodbye!")
+}
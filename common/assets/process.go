@@ -99,7 +99,11 @@ func extractPrefixTo(pathName string, destination string) {
 			panic(err)
 		}
 
-		dest := path.Join(destination, filepath.Base(f))
+		// Keep subdirectories, such as the SQLite migrations
+		dest := path.Join(destination, strings.TrimPrefix(f, pathName))
+		if err = os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+			panic(err)
+		}
 		logrus.Debugf("Writing %s to %s", f, dest)
 		file, err := os.Create(dest)
 		if err != nil {
@@ -133,10 +133,12 @@ func reloadConfig() (*MainRepoConfig, map[string]*DomainRepoConfig, error) {
 		}
 
 		// Not a domain config - parse into regular config
-		err = yaml.Unmarshal(buffer, &cMap)
+		fileMap := make(map[string]interface{})
+		err = yaml.Unmarshal(buffer, &fileMap)
 		if err != nil {
 			return nil, nil, err
 		}
+		mergeYamlMaps(cMap, fileMap)
 	}
 
 	c := NewDefaultMainConfig()
@@ -144,10 +146,14 @@ func reloadConfig() (*MainRepoConfig, map[string]*DomainRepoConfig, error) {
 	if err != nil {
 		return nil, nil, err
 	}
+	if err = validateMainConfig(c); err != nil {
+		return nil, nil, err
+	}
 
 	// Start building domain configs
 	dMaps := make(map[string]map[string]interface{})
-	for _, d := range c.Homeservers {
+	rawHomeservers, _ := cMap["homeservers"].([]interface{})
+	for i, d := range c.Homeservers {
 		dc := DomainConfigFrom(c)
 		dc.Name = d.Name
 		dc.ClientServerApi = d.ClientServerApi
@@ -159,6 +165,15 @@ func reloadConfig() (*MainRepoConfig, map[string]*DomainRepoConfig, error) {
 		if err != nil {
 			return nil, nil, err
 		}
+
+		// Homeservers can override parts of the config inline, as an alternative to a per-domain config file
+		if i < len(rawHomeservers) {
+			if rawHs, ok := rawHomeservers[i].(map[string]interface{}); ok {
+				if overrides, ok := rawHs["overrides"].(map[string]interface{}); ok {
+					mergeYamlMaps(m, overrides)
+				}
+			}
+		}
 		dMaps[d.Name] = m
 	}
 	for hs, bs := range pendingDomainConfigs {
@@ -174,11 +189,12 @@ func reloadConfig() (*MainRepoConfig, map[string]*DomainRepoConfig, error) {
 		}
 
 		for _, b := range bs {
-			m := dMaps[hs]
-			err = yaml.Unmarshal(b, &m)
+			fileMap := make(map[string]interface{})
+			err = yaml.Unmarshal(b, &fileMap)
 			if err != nil {
 				return nil, nil, err
 			}
+			mergeYamlMaps(dMaps[hs], fileMap)
 		}
 	}
 	for hs, m := range dMaps {
@@ -196,6 +212,16 @@ func reloadConfig() (*MainRepoConfig, map[string]*DomainRepoConfig, error) {
 	return &c, domainConfs, nil
 }
 
+// validateMainConfig rejects values which would otherwise silently fall back to a destructive default.
+func validateMainConfig(c MainRepoConfig) error {
+	switch c.InternalApi.RedactionAction {
+	case RedactionPurge, RedactionQuarantine:
+	default:
+		return fmt.Errorf("unknown internalApi.redactionAction '%s' - expected '%s' or '%s'", c.InternalApi.RedactionAction, RedactionPurge, RedactionQuarantine)
+	}
+	return nil
+}
+
 func Get() *MainRepoConfig {
 	if instance == nil {
 		singletonLock.Do(func() {
@@ -22,6 +22,32 @@ func NewDefaultDomainConfig() DomainRepoConfig {
 			MaxSizeBytes:               104857600, // 100mb
 			FailureCacheMinutes:        15,
 			DefaultRangeChunkSizeBytes: 10485760, // 10mb
+			ThinProxy: ThinProxyConfig{
+				Enabled:         false,
+				BufferSizeBytes: 32768, // 32kb
+			},
+			SlowClients: SlowClientsConfig{
+				WriteTimeoutSeconds: 60,
+				MinBytesPerSecond:   0,
+				GraceSeconds:        30,
+			},
+			RoomAccess: RoomAccessConfig{
+				Enabled:                false,
+				AllowFederation:        false,
+				MembershipCacheSeconds: 60,
+				AppserviceHsToken:      "",
+			},
+			PublicRooms: []string{},
+			SecurityHeaders: SecurityHeadersConfig{
+				ContentSecurityPolicy:     "sandbox; default-src 'none'; script-src 'none'; plugin-types application/pdf; style-src 'unsafe-inline'; media-src 'self'; object-src 'self';",
+				ContentTypeOptions:        "nosniff",
+				CrossOriginResourcePolicy: "cross-origin",
+			},
+			MaxFilenameLength: 255,
+			Conversion: ConversionConfig{
+				Enabled: false,
+				Formats: []string{"jpeg", "png", "webp"},
+			},
 		},
 		UrlPreviews: UrlPreviewsConfig{
 			Enabled:          true,
@@ -58,6 +84,11 @@ func NewDefaultDomainConfig() DomainRepoConfig {
 			AllowAnimated:       true,
 			DefaultAnimated:     false,
 			StillFrame:          0.5,
+			PassthroughMaxBytes: 262144, // 256kb
+			Formats: ThumbnailFormats{
+				WebP: ThumbnailFormatConfig{Enabled: false, Quality: 80},
+				Avif: ThumbnailFormatConfig{Enabled: false, Quality: 50},
+			},
 			Sizes: []ThumbnailSize{
 				{32, 32},
 				{96, 96},
@@ -66,6 +97,8 @@ func NewDefaultDomainConfig() DomainRepoConfig {
 				{800, 600},
 			},
 			DynamicSizing: false,
+			SmartCrop:     false,
+			Backend:       "native",
 			Types: []string{
 				"image/jpeg",
 				"image/jpg",
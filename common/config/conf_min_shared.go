@@ -15,20 +15,66 @@ func NewDefaultMinimumRepoConfig() MinimumRepoConfig {
 	return MinimumRepoConfig{
 		DataStores: []DatastoreConfig{},
 		Archiving: ArchivingConfig{
-			Enabled:            true,
-			SelfService:        false,
-			TargetBytesPerPart: 209715200, // 200mb
+			Enabled:              true,
+			SelfService:          false,
+			TargetBytesPerPart:   209715200, // 200mb
+			SigningKeyPath:       "",
+			TrustedKeys:          map[string]string{},
+			RequireSignedImports: false,
 		},
 		Uploads: UploadsConfig{
 			MaxSizeBytes:         104857600, // 100mb
 			MinSizeBytes:         100,
 			ReportedMaxSizeBytes: 0,
 			MaxPending:           5,
-			MaxAgeSeconds:        1800, // 30 minutes
+			MaxAgeSeconds:        1800,  // 30 minutes
+			IdempotencySeconds:   86400, // 24 hours
+			ResumableMinBytes:    52428800,
+			MaxPartialUploads:    3,
+			MaxPartialBytes:      314572800, // 300mb
+			StripMetadata: StripMetadataConfig{
+				Enabled:     true,
+				ExemptUsers: []string{},
+			},
+			ExternalMedia: ExternalMediaConfig{
+				Enabled:      false,
+				AllowedUsers: []string{},
+				AllowedHosts: []string{},
+				DisallowedNetworks: []string{
+					"0.0.0.0/8",
+					"127.0.0.1/8",
+					"10.0.0.0/8",
+					"172.16.0.0/12",
+					"192.168.0.0/16",
+					"100.64.0.0/10",
+					"169.254.0.0/16",
+					"::1/128",
+					"fe80::/10",
+					"fc00::/7",
+				},
+				TimeoutSeconds: 30,
+			},
+			Attestation: AttestationConfig{
+				Enabled:            false,
+				MinBytes:           52428800, // 50mb
+				MaxLifetimeSeconds: 300,
+				TrustedKeys:        map[string]string{},
+			},
 			Quota: QuotasConfig{
 				Enabled:    false,
 				UserQuotas: []QuotaUserConfig{},
 			},
+			RateLimit: UploadRateLimits{
+				Enabled: false,
+				PerUser: UploadRateLimitConfig{
+					UploadsPerMinute: 0,
+					BytesPerHour:     0,
+				},
+				PerServer: UploadRateLimitConfig{
+					UploadsPerMinute: 0,
+					BytesPerHour:     0,
+				},
+			},
 		},
 		Identicons: IdenticonsConfig{
 			Enabled: true,
@@ -44,7 +90,11 @@ func NewDefaultMinimumRepoConfig() MinimumRepoConfig {
 			ClientServer: 30,
 			Federation:   120,
 		},
-		Features: FeatureConfig{},
+		Features: FeatureConfig{
+			MSC2448Blurhash: MSC2448Config{
+				Enabled: true,
+			},
+		},
 		AccessTokens: AccessTokenConfig{
 			MaxCacheTimeSeconds: 0,
 			UseAppservices:      false,
@@ -1,9 +1,12 @@
 package config
 
 type ArchivingConfig struct {
-	Enabled            bool  `yaml:"enabled"`
-	SelfService        bool  `yaml:"selfService"`
-	TargetBytesPerPart int64 `yaml:"targetBytesPerPart"`
+	Enabled              bool              `yaml:"enabled"`
+	SelfService          bool              `yaml:"selfService"`
+	TargetBytesPerPart   int64             `yaml:"targetBytesPerPart"`
+	SigningKeyPath       string            `yaml:"signingKeyPath"`
+	TrustedKeys          map[string]string `yaml:"trustedKeys"`
+	RequireSignedImports bool              `yaml:"requireSignedImports"`
 }
 
 type QuotaUserConfig struct {
@@ -19,12 +22,52 @@ type QuotasConfig struct {
 }
 
 type UploadsConfig struct {
-	MaxSizeBytes         int64        `yaml:"maxBytes"`
-	MinSizeBytes         int64        `yaml:"minBytes"`
-	ReportedMaxSizeBytes int64        `yaml:"reportedMaxBytes"`
-	MaxPending           int64        `yaml:"maxPending"`
-	MaxAgeSeconds        int64        `yaml:"maxAgeSeconds"`
-	Quota                QuotasConfig `yaml:"quotas"`
+	MaxSizeBytes         int64               `yaml:"maxBytes"`
+	MinSizeBytes         int64               `yaml:"minBytes"`
+	ReportedMaxSizeBytes int64               `yaml:"reportedMaxBytes"`
+	MaxPending           int64               `yaml:"maxPending"`
+	MaxAgeSeconds        int64               `yaml:"maxAgeSeconds"`
+	IdempotencySeconds   int64               `yaml:"idempotencyKeySeconds"`
+	ResumableMinBytes    int64               `yaml:"resumableMinBytes"`
+	MaxPartialUploads    int64               `yaml:"maxPartialUploadsPerUser"`
+	MaxPartialBytes      int64               `yaml:"maxPartialBytesPerUser"`
+	StripMetadata        StripMetadataConfig `yaml:"stripMetadata"`
+	ExternalMedia        ExternalMediaConfig `yaml:"externalMedia"`
+	Attestation          AttestationConfig   `yaml:"attestation"`
+	Quota                QuotasConfig        `yaml:"quotas"`
+	RateLimit            UploadRateLimits    `yaml:"rateLimit"`
+	DisabledStages       []string            `yaml:"disabledStages,flow"`
+}
+
+type UploadRateLimits struct {
+	Enabled   bool                  `yaml:"enabled"`
+	PerUser   UploadRateLimitConfig `yaml:"perUser"`
+	PerServer UploadRateLimitConfig `yaml:"perServer"`
+}
+
+type UploadRateLimitConfig struct {
+	UploadsPerMinute int64 `yaml:"uploadsPerMinute"`
+	BytesPerHour     int64 `yaml:"bytesPerHour"`
+}
+
+type AttestationConfig struct {
+	Enabled            bool              `yaml:"enabled"`
+	MinBytes           int64             `yaml:"minBytes"`
+	MaxLifetimeSeconds int64             `yaml:"maxLifetimeSeconds"`
+	TrustedKeys        map[string]string `yaml:"trustedKeys"`
+}
+
+type ExternalMediaConfig struct {
+	Enabled            bool     `yaml:"enabled"`
+	AllowedUsers       []string `yaml:"allowedUsers,flow"`
+	AllowedHosts       []string `yaml:"allowedHosts,flow"`
+	DisallowedNetworks []string `yaml:"disallowedNetworks,flow"`
+	TimeoutSeconds     int      `yaml:"timeoutSeconds"`
+}
+
+type StripMetadataConfig struct {
+	Enabled     bool     `yaml:"enabled"`
+	ExemptUsers []string `yaml:"exemptUsers,flow"`
 }
 
 type DatastoreConfig struct {
@@ -35,21 +78,72 @@ type DatastoreConfig struct {
 }
 
 type DownloadsConfig struct {
-	MaxSizeBytes               int64 `yaml:"maxBytes"`
-	FailureCacheMinutes        int   `yaml:"failureCacheMinutes"`
-	DefaultRangeChunkSizeBytes int64 `yaml:"defaultRangeChunkSizeBytes"`
+	MaxSizeBytes               int64                 `yaml:"maxBytes"`
+	FailureCacheMinutes        int                   `yaml:"failureCacheMinutes"`
+	DefaultRangeChunkSizeBytes int64                 `yaml:"defaultRangeChunkSizeBytes"`
+	ThinProxy                  ThinProxyConfig       `yaml:"thinProxy"`
+	SlowClients                SlowClientsConfig     `yaml:"slowClients"`
+	RoomAccess                 RoomAccessConfig      `yaml:"roomAccess"`
+	PublicRooms                []string              `yaml:"publicRooms,flow"`
+	SecurityHeaders            SecurityHeadersConfig `yaml:"securityHeaders"`
+	MaxFilenameLength          int                   `yaml:"maxFilenameLength"`
+	Conversion                 ConversionConfig      `yaml:"conversion"`
+	DisabledStages             []string              `yaml:"disabledStages,flow"`
+}
+
+type ConversionConfig struct {
+	Enabled bool     `yaml:"enabled"`
+	Formats []string `yaml:"formats,flow"`
+}
+
+type SecurityHeadersConfig struct {
+	ContentSecurityPolicy     string `yaml:"contentSecurityPolicy"`
+	ContentTypeOptions        string `yaml:"contentTypeOptions"`
+	CrossOriginResourcePolicy string `yaml:"crossOriginResourcePolicy"`
+}
+
+type RoomAccessConfig struct {
+	Enabled                bool   `yaml:"enabled"`
+	AllowFederation        bool   `yaml:"allowFederation"`
+	MembershipCacheSeconds int    `yaml:"membershipCacheSeconds"`
+	AppserviceHsToken      string `yaml:"appserviceHsToken"`
+}
+
+type SlowClientsConfig struct {
+	WriteTimeoutSeconds int   `yaml:"writeTimeoutSeconds"`
+	MinBytesPerSecond   int64 `yaml:"minBytesPerSecond"`
+	GraceSeconds        int   `yaml:"graceSeconds"`
+}
+
+type ThinProxyConfig struct {
+	Enabled         bool `yaml:"enabled"`
+	BufferSizeBytes int  `yaml:"bufferSizeBytes"`
 }
 
 type ThumbnailsConfig struct {
-	MaxSourceBytes      int64           `yaml:"maxSourceBytes"`
-	MaxPixels           int             `yaml:"maxPixels"`
-	Types               []string        `yaml:"types,flow"`
-	MaxAnimateSizeBytes int64           `yaml:"maxAnimateSizeBytes"`
-	Sizes               []ThumbnailSize `yaml:"sizes,flow"`
-	DynamicSizing       bool            `yaml:"dynamicSizing"`
-	AllowAnimated       bool            `yaml:"allowAnimated"`
-	DefaultAnimated     bool            `yaml:"defaultAnimated"`
-	StillFrame          float32         `yaml:"stillFrame"`
+	MaxSourceBytes      int64            `yaml:"maxSourceBytes"`
+	MaxPixels           int              `yaml:"maxPixels"`
+	Types               []string         `yaml:"types,flow"`
+	MaxAnimateSizeBytes int64            `yaml:"maxAnimateSizeBytes"`
+	Sizes               []ThumbnailSize  `yaml:"sizes,flow"`
+	DynamicSizing       bool             `yaml:"dynamicSizing"`
+	SmartCrop           bool             `yaml:"smartCrop"`
+	Backend             string           `yaml:"backend"`
+	AllowAnimated       bool             `yaml:"allowAnimated"`
+	DefaultAnimated     bool             `yaml:"defaultAnimated"`
+	StillFrame          float32          `yaml:"stillFrame"`
+	Formats             ThumbnailFormats `yaml:"formats"`
+	PassthroughMaxBytes int64            `yaml:"passthroughMaxBytes"`
+}
+
+type ThumbnailFormats struct {
+	WebP ThumbnailFormatConfig `yaml:"webp"`
+	Avif ThumbnailFormatConfig `yaml:"avif"`
+}
+
+type ThumbnailFormatConfig struct {
+	Enabled bool `yaml:"enabled"`
+	Quality int  `yaml:"quality"`
 }
 
 type ThumbnailSize struct {
@@ -91,6 +185,11 @@ type TimeoutsConfig struct {
 }
 
 type FeatureConfig struct {
+	MSC2448Blurhash MSC2448Config `yaml:"MSC2448"`
+}
+
+type MSC2448Config struct {
+	Enabled bool `yaml:"enabled"`
 }
 
 type AccessTokenConfig struct {
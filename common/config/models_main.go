@@ -6,10 +6,12 @@ type GeneralConfig struct {
 	LogDirectory               string `yaml:"logDirectory"`
 	LogColors                  bool   `yaml:"logColors"`
 	JsonLogs                   bool   `yaml:"jsonLogs"`
+	AccessLog                  bool   `yaml:"accessLog"`
 	LogLevel                   string `yaml:"logLevel"`
 	TrustAnyForward            bool   `yaml:"trustAnyForwardedAddress"`
 	UseForwardedHost           bool   `yaml:"useForwardedHost"`
 	FreezeUnauthenticatedMedia bool   `yaml:"freezeUnauthenticatedMedia"`
+	ShutdownGraceSeconds       int    `yaml:"shutdownGraceSeconds"`
 }
 
 type HomeserverConfig struct {
@@ -21,19 +23,44 @@ type HomeserverConfig struct {
 }
 
 type DatabaseConfig struct {
-	Postgres string        `yaml:"postgres"`
-	Pool     *DbPoolConfig `yaml:"pool"`
+	Postgres     string                `yaml:"postgres"`
+	Sqlite       string                `yaml:"sqlite"`
+	Pool         *DbPoolConfig         `yaml:"pool"`
+	ReadReplicas *DbReadReplicasConfig `yaml:"readReplicas"`
+}
+
+type DbReadReplicasConfig struct {
+	Postgres             []string `yaml:"postgres"`
+	MaxLagSeconds        int      `yaml:"maxLagSeconds"`
+	CheckIntervalSeconds int      `yaml:"checkIntervalSeconds"`
 }
 
 type DbPoolConfig struct {
-	MaxConnections int `yaml:"maxConnections"`
-	MaxIdle        int `yaml:"maxIdleConnections"`
+	MaxConnections     int `yaml:"maxConnections"`
+	MaxIdle            int `yaml:"maxIdleConnections"`
+	MaxLifetimeSeconds int `yaml:"maxLifetimeSeconds"`
+	MaxIdleTimeSeconds int `yaml:"maxIdleTimeSeconds"`
 }
 
 type MainDownloadsConfig struct {
-	DownloadsConfig `yaml:",inline"`
-	NumWorkers      int `yaml:"numWorkers"`
-	ExpireDays      int `yaml:"expireAfterDays"`
+	DownloadsConfig       `yaml:",inline"`
+	NumWorkers            int                  `yaml:"numWorkers"`
+	ExpireDays            int                  `yaml:"expireAfterDays"`
+	ExpireNotAccessedDays int                  `yaml:"expireNotAccessedDays"`
+	PerOriginCache        PerOriginCacheConfig `yaml:"perOriginCache"`
+}
+
+type PerOriginCacheConfig struct {
+	MaxBytes  int64            `yaml:"maxBytes"`
+	Overrides map[string]int64 `yaml:"overrides"`
+}
+
+// LimitFor returns the maximum number of cached bytes for the origin, or zero (or less) for no limit.
+func (c PerOriginCacheConfig) LimitFor(origin string) int64 {
+	if limit, ok := c.Overrides[origin]; ok {
+		return limit
+	}
+	return c.MaxBytes
 }
 
 type MainThumbnailsConfig struct {
@@ -76,9 +103,43 @@ type SharedSecretConfig struct {
 	Token   string `yaml:"token"`
 }
 
+const (
+	// RedactionPurge deletes media once its last reference is redacted.
+	RedactionPurge = "purge"
+	// RedactionQuarantine quarantines media once its last reference is redacted, keeping it around for review.
+	RedactionQuarantine = "quarantine"
+)
+
+type InternalApiConfig struct {
+	Enabled         bool   `yaml:"enabled"`
+	HeaderName      string `yaml:"headerName"`
+	Secret          string `yaml:"secret"`
+	RedactionAction string `yaml:"redactionAction"`
+}
+
+type ReferencesConfig struct {
+	PurgeUnreferencedAfterHours int `yaml:"purgeUnreferencedAfterHours"`
+}
+
+type AntivirusConfig struct {
+	Enabled        bool   `yaml:"enabled"`
+	Address        string `yaml:"address"`
+	TimeoutSeconds int    `yaml:"timeoutSeconds"`
+	InfectedAction string `yaml:"infectedAction"`
+	FailOpen       bool   `yaml:"failOpen"`
+}
+
 type FederationConfig struct {
-	BackoffAt    int      `yaml:"backoffAt"`
-	IgnoredHosts []string `yaml:"ignoredHosts,flow"`
+	BackoffAt     int                 `yaml:"backoffAt"`
+	IgnoredHosts  []string            `yaml:"ignoredHosts,flow"`
+	OriginBackoff OriginBackoffConfig `yaml:"originBackoff"`
+}
+
+type OriginBackoffConfig struct {
+	Enabled           bool `yaml:"enabled"`
+	FailureThreshold  int  `yaml:"failureThreshold"`
+	MinBackoffSeconds int  `yaml:"minBackoffSeconds"`
+	MaxBackoffSeconds int  `yaml:"maxBackoffSeconds"`
 }
 
 type PluginConfig struct {
@@ -113,3 +174,222 @@ type PGOConfig struct {
 	SubmitUrl string `yaml:"submitUrl"`
 	SubmitKey string `yaml:"submitKey"`
 }
+
+type EncryptionConfig struct {
+	Enabled      bool                  `yaml:"enabled"`
+	CurrentKeyId string                `yaml:"currentKeyId"`
+	Keys         []EncryptionKeyConfig `yaml:"keys,flow"`
+}
+
+type EncryptionKeyConfig struct {
+	Id  string `yaml:"id"`
+	Key string `yaml:"key"`
+}
+
+type HashBansConfig struct {
+	RemoteLists         []RemoteHashBanListConfig `yaml:"remoteLists,flow"`
+	FetchTimeoutSeconds int                       `yaml:"fetchTimeoutSeconds"`
+	QuarantineExisting  bool                      `yaml:"quarantineExisting"`
+}
+
+type RemoteHashBanListConfig struct {
+	Url       string `yaml:"url"`
+	KeyId     string `yaml:"keyId"`
+	PublicKey string `yaml:"publicKey"`
+}
+
+type PolicyRoomsConfig struct {
+	Enabled             bool     `yaml:"enabled"`
+	Homeserver          string   `yaml:"homeserver"`
+	AccessToken         string   `yaml:"accessToken"`
+	RoomIds             []string `yaml:"roomIds,flow"`
+	SyncIntervalMinutes int      `yaml:"syncIntervalMinutes"`
+}
+
+type RoomManifestsConfig struct {
+	Enabled             bool   `yaml:"enabled"`
+	Homeserver          string `yaml:"homeserver"`
+	AccessToken         string `yaml:"accessToken"`
+	EventType           string `yaml:"eventType"`
+	MaxStateEntries     int    `yaml:"maxStateEntries"`
+	WebhookUrl          string `yaml:"webhookUrl"`
+	WebhookSecret       string `yaml:"webhookSecret"`
+	TimeoutSeconds      int    `yaml:"timeoutSeconds"`
+	SyncIntervalMinutes int    `yaml:"syncIntervalMinutes"`
+}
+
+type TieringConfig struct {
+	Enabled            bool     `yaml:"enabled"`
+	ArchiveDatastoreId string   `yaml:"archiveDatastoreId"`
+	AfterDays          int      `yaml:"afterDays"`
+	FromDatastoreIds   []string `yaml:"fromDatastores,flow"`
+	RestoreOnAccess    bool     `yaml:"restoreOnAccess"`
+}
+
+type DiskWatermarksConfig struct {
+	Enabled              bool    `yaml:"enabled"`
+	SoftPercent          float64 `yaml:"softPercent"`
+	HardPercent          float64 `yaml:"hardPercent"`
+	CheckIntervalSeconds int     `yaml:"checkIntervalSeconds"`
+}
+
+type DatastoreSelfTestConfig struct {
+	Enabled         bool `yaml:"enabled"`
+	IntervalMinutes int  `yaml:"intervalMinutes"`
+}
+
+type EmojiConfig struct {
+	Enabled      bool                   `yaml:"enabled"`
+	MaxBytes     int64                  `yaml:"maxBytes"`
+	ContentTypes []string               `yaml:"contentTypes,flow"`
+	MemoryCache  EmojiMemoryCacheConfig `yaml:"memoryCache"`
+}
+
+type EmojiMemoryCacheConfig struct {
+	MaxBytes   int64 `yaml:"maxBytes"`
+	TtlMinutes int   `yaml:"ttlMinutes"`
+}
+
+type EventStreamConfig struct {
+	Enabled   bool                   `yaml:"enabled"`
+	Broker    string                 `yaml:"broker"`
+	Topic     string                 `yaml:"topic"`
+	QueueSize int                    `yaml:"queueSize"`
+	Nats      NatsEventStreamConfig  `yaml:"nats"`
+	Kafka     KafkaEventStreamConfig `yaml:"kafka"`
+}
+
+type NatsEventStreamConfig struct {
+	Url      string `yaml:"url"`
+	Token    string `yaml:"token"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+type KafkaEventStreamConfig struct {
+	RestProxyUrl   string `yaml:"restProxyUrl"`
+	Username       string `yaml:"username"`
+	Password       string `yaml:"password"`
+	TimeoutSeconds int    `yaml:"timeoutSeconds"`
+}
+
+type WebhooksConfig struct {
+	QueueSize      int                     `yaml:"queueSize"`
+	TimeoutSeconds int                     `yaml:"timeoutSeconds"`
+	MaxAttempts    int                     `yaml:"maxAttempts"`
+	Endpoints      []WebhookEndpointConfig `yaml:"endpoints"`
+}
+
+type WebhookEndpointConfig struct {
+	Url    string   `yaml:"url"`
+	Secret string   `yaml:"secret"`
+	Events []string `yaml:"events,flow"`
+}
+
+type ModerationConfig struct {
+	Enabled           bool   `yaml:"enabled"`
+	Url               string `yaml:"url"`
+	Secret            string `yaml:"secret"`
+	TimeoutSeconds    int    `yaml:"timeoutSeconds"`
+	CheckRemoteMedia  bool   `yaml:"checkRemoteMedia"`
+	SendThumbnail     bool   `yaml:"sendThumbnail"`
+	MaxAttempts       int    `yaml:"maxAttempts"`
+	RetryDelaySeconds int    `yaml:"retryDelaySeconds"`
+	FailAction        string `yaml:"failAction"`
+}
+
+type GalleryLinksConfig struct {
+	Enabled       bool                   `yaml:"enabled"`
+	Secret        string                 `yaml:"secret"`
+	MaxHours      int                    `yaml:"maxHours"`
+	MinPowerLevel int                    `yaml:"minPowerLevel"`
+	Watermark     GalleryWatermarkConfig `yaml:"watermark"`
+}
+
+type GalleryWatermarkConfig struct {
+	Enabled bool    `yaml:"enabled"`
+	Opacity float64 `yaml:"opacity"`
+}
+
+type HashMatchingConfig struct {
+	Enabled            bool   `yaml:"enabled"`
+	ListPath           string `yaml:"listPath"`
+	ApiUrl             string `yaml:"apiUrl"`
+	ApiSecret          string `yaml:"apiSecret"`
+	TimeoutSeconds     int    `yaml:"timeoutSeconds"`
+	PdqMaxDistance     int    `yaml:"pdqMaxDistance"`
+	PdqMinQuality      int    `yaml:"pdqMinQuality"`
+	CheckRemoteMedia   bool   `yaml:"checkRemoteMedia"`
+	FailOpen           bool   `yaml:"failOpen"`
+	AlertWebhookUrl    string `yaml:"alertWebhookUrl"`
+	AlertWebhookSecret string `yaml:"alertWebhookSecret"`
+}
+
+type NsfwConfig struct {
+	Enabled             bool    `yaml:"enabled"`
+	ApiUrl              string  `yaml:"apiUrl"`
+	ApiSecret           string  `yaml:"apiSecret"`
+	TimeoutSeconds      int     `yaml:"timeoutSeconds"`
+	QuarantineThreshold float64 `yaml:"quarantineThreshold"`
+	CheckRemoteMedia    bool    `yaml:"checkRemoteMedia"`
+}
+
+type ThumbnailWorkersConfig struct {
+	Enabled        bool `yaml:"enabled"`
+	TimeoutSeconds int  `yaml:"timeoutSeconds"`
+	Concurrency    int  `yaml:"concurrency"`
+}
+
+type FfmpegConfig struct {
+	HwAccel        string   `yaml:"hwAccel"`
+	HwAccelDevice  string   `yaml:"hwAccelDevice"`
+	ExtraInputArgs []string `yaml:"extraInputArgs,flow"`
+}
+
+type FaultInjectionConfig struct {
+	Enabled     bool     `yaml:"enabled"`
+	Targets     []string `yaml:"targets,flow"`
+	LatencyMs   int      `yaml:"latencyMs"`
+	JitterMs    int      `yaml:"jitterMs"`
+	FailureRate float64  `yaml:"failureRate"`
+}
+
+type ReplicationConfig struct {
+	Enabled         bool   `yaml:"enabled"`
+	PrimaryUrl      string `yaml:"primaryUrl"`
+	AccessToken     string `yaml:"accessToken"`
+	IntervalSeconds int    `yaml:"intervalSeconds"`
+	BatchSize       int    `yaml:"batchSize"`
+	TimeoutSeconds  int    `yaml:"timeoutSeconds"`
+	KeepChangesDays int    `yaml:"keepChangesDays"`
+}
+
+const (
+	// RoleAll instances serve every route and run background tasks.
+	RoleAll = "all"
+	// RoleDownloads instances only serve downloads and thumbnails which already exist, and never write to the
+	// database. Anything else is forwarded to the write tier.
+	RoleDownloads = "downloads"
+)
+
+type DeploymentConfig struct {
+	Role     string `yaml:"role"`
+	WriteUrl string `yaml:"writeUrl"`
+}
+
+// IsDownloadsOnly returns true if this instance only serves downloads, leaving writes to the write tier.
+func (c DeploymentConfig) IsDownloadsOnly() bool {
+	return c.Role == RoleDownloads
+}
+
+type UserPreferencesCompressionConfig struct {
+	MaxDimension int `yaml:"maxDimension"`
+	Quality      int `yaml:"quality"`
+}
+
+type UserPreferencesConfig struct {
+	Enabled         bool                             `yaml:"enabled"`
+	AccountDataType string                           `yaml:"accountDataType"`
+	RefreshMinutes  int                              `yaml:"refreshMinutes"`
+	Compression     UserPreferencesCompressionConfig `yaml:"compression"`
+}
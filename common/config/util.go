@@ -24,3 +24,17 @@ func objToMapYaml(input interface{}) (map[string]interface{}, error) {
 	err = yaml.Unmarshal(encoded, &m)
 	return m, err
 }
+
+// mergeYamlMaps merges src over top of dst. Nested maps are merged key by key so that a partial section (such as
+// `uploads: {maxBytes: 1024}`) only overrides the keys it names. Any other value, including lists, is replaced.
+func mergeYamlMaps(dst map[string]interface{}, src map[string]interface{}) {
+	for k, v := range src {
+		if srcMap, ok := v.(map[string]interface{}); ok {
+			if dstMap, ok := dst[k].(map[string]interface{}); ok {
+				mergeYamlMaps(dstMap, srcMap)
+				continue
+			}
+		}
+		dst[k] = v
+	}
+}
@@ -1,6 +1,8 @@
 package config
 
 import (
+	"reflect"
+	"sync"
 	"time"
 
 	"github.com/bep/debounce"
@@ -31,7 +33,10 @@ func Watch() *fsnotify.Watcher {
 				if !ok {
 					return
 				}
-				debounced(onFileChanged)
+				debounced(func() {
+					logrus.Info("Config file change detected - reloading")
+					_ = Reload()
+				})
 			case err, ok := <-watcher.Errors:
 				if !ok {
 					return
@@ -44,15 +49,22 @@ func Watch() *fsnotify.Watcher {
 	return watcher
 }
 
-func onFileChanged() {
-	logrus.Info("Config file change detected - reloading")
+var reloadLock = &sync.Mutex{}
+
+// Reload reads the config from disk again and applies it to the running process, restarting the parts of the
+// media repo which can't pick up the changes on their own. If the config can't be read, the current config is
+// kept and the error is returned.
+func Reload() error {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
 	configNow := Get()
 	configNew, domainsNew, err := reloadConfig()
 	if err != nil {
 		logrus.Error("Error reloading configuration - ignoring")
 		logrus.Error(err)
 		sentry.CaptureException(err)
-		return
+		return err
 	}
 
 	logrus.Info("Applying reloaded config live")
@@ -68,11 +80,11 @@ func onFileChanged() {
 	logrus.Info("Reloading matrix caches")
 	globals.MatrixCachesReloadChan <- true
 
+	// Forwarding options are read on every request, so only a change to the listener needs a remount (which
+	// interrupts any requests still running after the shutdown grace period).
 	bindAddressChange := configNew.General.BindAddress != configNow.General.BindAddress
 	bindPortChange := configNew.General.Port != configNow.General.Port
-	forwardAddressChange := configNew.General.TrustAnyForward != configNow.General.TrustAnyForward
-	forwardedHostChange := configNew.General.UseForwardedHost != configNow.General.UseForwardedHost
-	if bindAddressChange || bindPortChange || forwardAddressChange || forwardedHostChange {
+	if bindAddressChange || bindPortChange {
 		logrus.Warn("Webserver configuration changed - remounting")
 		globals.WebReloadChan <- true
 	}
@@ -85,19 +97,25 @@ func onFileChanged() {
 		globals.MetricsReloadChan <- true
 	}
 
-	databaseChange := configNew.Database.Postgres != configNow.Database.Postgres
-	poolConnsChange := configNew.Database.Pool.MaxConnections != configNow.Database.Pool.MaxConnections
-	poolIdleChange := configNew.Database.Pool.MaxIdle != configNow.Database.Pool.MaxIdle
-	if databaseChange || poolConnsChange || poolIdleChange {
+	databaseChange := configNew.Database.Postgres != configNow.Database.Postgres ||
+		configNew.Database.Sqlite != configNow.Database.Sqlite
+	poolChange := !reflect.DeepEqual(configNew.Database.Pool, configNow.Database.Pool)
+	replicasChange := !reflect.DeepEqual(configNew.Database.ReadReplicas, configNow.Database.ReadReplicas)
+	if databaseChange || poolChange || replicasChange {
 		logrus.Warn("Database configuration changed - reconnecting")
 		globals.DatabaseReloadChan <- true
 	}
 
-	logChange := configNew.General.LogDirectory != configNow.General.LogDirectory
+	logChange := configNew.General.LogDirectory != configNow.General.LogDirectory ||
+		configNew.General.AccessLog != configNow.General.AccessLog
 	if logChange {
 		logrus.Warn("Log configuration changed - restart the media repo to apply changes")
 	}
 
+	if configNew.Deployment.Role != configNow.Deployment.Role {
+		logrus.Warn("Deployment role changed - restart the media repo to apply changes")
+	}
+
 	redisEnabledChange := configNew.Redis.Enabled != configNow.Redis.Enabled
 	redisShardsChange := hasRedisShardConfigChanged(configNew, configNow)
 	if redisEnabledChange || redisShardsChange {
@@ -129,6 +147,8 @@ func onFileChanged() {
 		logrus.Warn("PGO config changed - reloading")
 		globals.PGOReloadChan <- true
 	}
+
+	return nil
 }
 
 func hasRedisShardConfigChanged(configNew *MainRepoConfig, configNow *MainRepoConfig) bool {
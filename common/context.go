@@ -12,4 +12,5 @@ const (
 	ContextServerConfig     MmrContextKey = "mmr.serverConfig"
 	ContextDomainConfig     MmrContextKey = "mmr.domain_config"
 	ContextStatusCode       MmrContextKey = "mmr.status_code"
+	ContextAccessLog        MmrContextKey = "mmr.access_log"
 )
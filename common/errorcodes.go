@@ -17,3 +17,6 @@ const ErrCodeUnauthorized = "M_UNAUTHORIZED"
 const ErrCodeQuotaExceeded = "M_QUOTA_EXCEEDED"
 const ErrCodeCannotOverwrite = "M_CANNOT_OVERWRITE_MEDIA"
 const ErrCodeNotYetUploaded = "M_NOT_YET_UPLOADED"
+const ErrCodeResourceLimitExceeded = "M_RESOURCE_LIMIT_EXCEEDED"
+const ErrCodeInsufficientStorage = "M_INSUFFICIENT_STORAGE"
+const ErrCodeIdempotencyKeyInUse = "M_IDEMPOTENCY_KEY_IN_USE"
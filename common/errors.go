@@ -18,3 +18,19 @@ var ErrMediaNotYetUploaded = errors.New("media not yet uploaded")
 var ErrMediaDimensionsTooSmall = errors.New("media is too small dimensionally")
 var ErrRateLimitExceeded = errors.New("rate limit exceeded")
 var ErrRestrictedAuth = errors.New("authentication is required to download this media")
+var ErrRestrictedRoomMembership = errors.New("requester is not a member of a room referencing this media")
+var ErrNotJoinedToRoom = errors.New("not joined to the room")
+var ErrMediaNotPersisted = errors.New("media and its references could not be saved")
+var ErrPartialUploadNotFound = errors.New("partial upload not found")
+var ErrPartialUploadOffset = errors.New("partial upload offset does not match received bytes")
+var ErrPartialUploadLimit = errors.New("too many unfinished partial uploads")
+var ErrPartialUploadInProgress = errors.New("another request is already uploading with this idempotency key")
+var ErrMediaInfected = errors.New("media is infected")
+var ErrMediaScanFailed = errors.New("media could not be scanned for viruses")
+var ErrMediaTooLargeToScan = errors.New("media is too large to be scanned for viruses")
+var ErrMediaHashCheckFailed = errors.New("media could not be checked against hash lists")
+var ErrInsufficientStorage = errors.New("not enough disk space to accept new media")
+var ErrOriginUnavailable = errors.New("origin server is unavailable")
+var ErrReadOnlyInstance = errors.New("this instance only serves downloads")
+var ErrAttestationRequired = errors.New("an attestation is required for uploads this large")
+var ErrInvalidAttestation = errors.New("invalid upload attestation")
@@ -0,0 +1,48 @@
+package logging
+
+import (
+	"os"
+	"path"
+	"time"
+
+	"github.com/lestrrat/go-file-rotatelogs"
+	"github.com/sirupsen/logrus"
+)
+
+var accessLogger *logrus.Logger
+
+// SetupAccessLog enables the access log, writing one JSON line per request to access.log in the given directory.
+// If the directory is empty or "-", the access log is written to stdout instead.
+func SetupAccessLog(dir string) error {
+	logger := logrus.New()
+	logger.SetLevel(logrus.InfoLevel)
+	logger.SetFormatter(&utcFormatter{&logrus.JSONFormatter{
+		TimestampFormat:  "2006-01-02 15:04:05.000 Z07:00",
+		DisableTimestamp: false,
+	}})
+	logger.SetOutput(os.Stdout)
+
+	if dir != "" && dir != "-" {
+		_ = os.MkdirAll(dir, os.ModePerm)
+
+		logFile := path.Join(dir, "access.log")
+		writer, err := rotatelogs.New(
+			logFile+".%Y%m%d%H%M",
+			rotatelogs.WithLinkName(logFile),
+			rotatelogs.WithMaxAge((24*time.Hour)*14),  // keep for 14 days
+			rotatelogs.WithRotationTime(24*time.Hour), // rotate every 24 hours
+		)
+		if err != nil {
+			return err
+		}
+		logger.SetOutput(writer)
+	}
+
+	accessLogger = logger
+	return nil
+}
+
+// AccessLog returns the access logger, or nil if the access log is not enabled.
+func AccessLog() *logrus.Logger {
+	return accessLogger
+}
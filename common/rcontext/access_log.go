@@ -0,0 +1,35 @@
+package rcontext
+
+import (
+	"github.com/t2bot/matrix-media-repo/common"
+)
+
+// AccessLogEntry collects the details about a request which are only known partway through handling it, for the
+// access log line written once the response is sent.
+type AccessLogEntry struct {
+	UserId    string
+	MxcUri    string
+	BytesSent int64
+	CacheHit  bool
+}
+
+// AccessLog returns the access log entry for the request. Contexts which aren't for a request get a detached entry,
+// so callers don't need to check.
+func (c RequestContext) AccessLog() *AccessLogEntry {
+	if c.Context != nil {
+		if entry, ok := c.Context.Value(common.ContextAccessLog).(*AccessLogEntry); ok && entry != nil {
+			return entry
+		}
+	}
+	return &AccessLogEntry{}
+}
+
+// RequestId returns the ID of the request being handled, or an empty string for background contexts.
+func (c RequestContext) RequestId() string {
+	if c.Context != nil {
+		if id, ok := c.Context.Value(common.ContextRequestId).(string); ok {
+			return id
+		}
+	}
+	return ""
+}
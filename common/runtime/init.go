@@ -4,6 +4,7 @@ import (
 	"github.com/getsentry/sentry-go"
 	"github.com/t2bot/matrix-media-repo/database"
 	"github.com/t2bot/matrix-media-repo/datastores"
+	"github.com/t2bot/matrix-media-repo/encryption"
 	"github.com/t2bot/matrix-media-repo/errcache"
 	"github.com/t2bot/matrix-media-repo/pool"
 	"github.com/t2bot/matrix-media-repo/redislib"
@@ -21,8 +22,10 @@ func RunStartupSequence() {
 	CheckIdGenerator()
 	config.PrintDomainInfo()
 	config.CheckDeprecations()
+	CheckDeployment()
 	LoadDatabase()
 	LoadDatastores()
+	CheckEncryption()
 	plugins.ReloadPlugins()
 	pool.Init()
 	errcache.Init()
@@ -48,10 +51,14 @@ func LoadDatastores() {
 	for _, id := range storeIds {
 		dsMap[id] = false
 	}
+	fatal := false
 	for _, ds := range config.UniqueDatastores() {
 		dsMap[ds.Id] = true
+		if !datastores.IsRegistered(ds.Type) {
+			logrus.Errorf("Datastore %s has unknown type %s - please check your configuration and restart.", ds.Id, ds.Type)
+			fatal = true
+		}
 	}
-	fatal := false
 	for id, found := range dsMap {
 		if !found {
 			logrus.Errorf("No configured datastore for ID %s found - please check your configuration and restart.", id)
@@ -60,12 +67,40 @@ func LoadDatastores() {
 		}
 	}
 	if fatal {
-		logrus.Fatal("One or more datastores are not configured")
+		logrus.Fatal("One or more datastores are not configured correctly")
 	}
 
 	datastores.ResetS3Clients()
 }
 
+func CheckEncryption() {
+	if err := encryption.CheckConfig(); err != nil {
+		logrus.Fatal("Invalid encryption configuration: ", err)
+	}
+	if config.Get().Encryption.Enabled {
+		logrus.Infof("New media will be encrypted with key %s", config.Get().Encryption.CurrentKeyId)
+	}
+}
+
+func CheckDeployment() {
+	conf := config.Get().Deployment
+	switch conf.Role {
+	case config.RoleAll:
+		return
+	case config.RoleDownloads:
+		// Access times and cache invalidations are passed between tiers over Redis
+		if !config.Get().Redis.Enabled {
+			logrus.Fatal("Download instances require Redis to be enabled")
+		}
+		if conf.WriteUrl == "" {
+			logrus.Fatal("Download instances require a deployment.writeUrl to forward other requests to")
+		}
+		logrus.Infof("Only serving downloads - other requests will be forwarded to %s", conf.WriteUrl)
+	default:
+		logrus.Fatalf("Unknown deployment role '%s' - expected '%s' or '%s'", conf.Role, config.RoleAll, config.RoleDownloads)
+	}
+}
+
 func CheckIdGenerator() {
 	// Create a throwaway ID to ensure no errors
 	_, err := ids.NewUniqueId()
@@ -3,32 +3,54 @@ package database
 import (
 	"database/sql"
 	"errors"
+	"path"
 	"sync"
 
 	"github.com/DavidHuie/gomigrate"
 	"github.com/getsentry/sentry-go"
-	_ "github.com/lib/pq" // postgres driver
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
 	"github.com/t2bot/matrix-media-repo/common/config"
 	"github.com/t2bot/matrix-media-repo/common/logging"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
 )
 
 type Database struct {
-	conn            *sql.DB
-	Media           *mediaTableStatements
-	ExpiringMedia   *expiringMediaTableStatements
-	UserStats       *userStatsTableStatements
-	ReservedMedia   *reservedMediaTableStatements
-	MetadataView    *metadataVirtualTableStatements
-	HeldMedia       *heldMediaTableStatements
-	Thumbnails      *thumbnailsTableStatements
-	LastAccess      *lastAccessTableStatements
-	UrlPreviews     *urlPreviewsTableStatements
-	MediaAttributes *mediaAttributesTableStatements
-	Tasks           *tasksTableStatements
-	Exports         *exportsTableStatements
-	ExportParts     *exportPartsTableStatements
-	RestrictedMedia *restrictedMediaTableStatements
+	conn             *sql.DB
+	stats            prometheus.Collector
+	Media            *mediaTableStatements
+	ExpiringMedia    *expiringMediaTableStatements
+	UserStats        *userStatsTableStatements
+	ReservedMedia    *reservedMediaTableStatements
+	MetadataView     *metadataVirtualTableStatements
+	HeldMedia        *heldMediaTableStatements
+	Thumbnails       *thumbnailsTableStatements
+	LastAccess       *lastAccessTableStatements
+	UrlPreviews      *urlPreviewsTableStatements
+	MediaAttributes  *mediaAttributesTableStatements
+	Tasks            *tasksTableStatements
+	Exports          *exportsTableStatements
+	ExportParts      *exportPartsTableStatements
+	RestrictedMedia  *restrictedMediaTableStatements
+	MediaReferences  *mediaReferencesTableStatements
+	Unreferenced     *unreferencedMediaTableStatements
+	IdempotencyKeys  *idempotencyKeysTableStatements
+	UploadPartials   *uploadPartialsTableStatements
+	MediaScans       *mediaScansTableStatements
+	EncryptedObjects *encryptedObjectsTableStatements
+	BannedHashes     *bannedHashesTableStatements
+	AppliedPolicies  *appliedPolicyRulesTableStatements
+	ExternalMedia    *externalMediaTableStatements
+	PublicRooms      *publicRoomsTableStatements
+	ModerationQueue  *moderationQueueTableStatements
+	ModerationLog    *moderationDecisionsTableStatements
+	QuarantineLog    *quarantineActionsTableStatements
+	Replication      *replicationStateTableStatements
+	ReplicationLog   *replicationEventsTableStatements
+	UserPreferences  *userPreferencesTableStatements
+	GalleryLinks     *galleryLinksTableStatements
+
+	replicas *readReplicas
 }
 
 var instance *Database
@@ -37,11 +59,7 @@ var singleton = &sync.Once{}
 func GetInstance() *Database {
 	if instance == nil {
 		singleton.Do(func() {
-			if err := openDatabase(
-				config.Get().Database.Postgres,
-				config.Get().Database.Pool.MaxConnections,
-				config.Get().Database.Pool.MaxIdle,
-			); err != nil {
+			if err := openDatabase(config.Get().Database); err != nil {
 				logrus.Fatal("Failed to set up database: ", err)
 			}
 		})
@@ -51,7 +69,8 @@ func GetInstance() *Database {
 
 func Reload() {
 	if instance != nil {
-		if err := instance.conn.Close(); err != nil {
+		instance.replicas.close()
+		if err := closeConnection(instance.conn, instance.stats); err != nil {
 			logrus.Error(err)
 			sentry.CaptureException(err)
 		}
@@ -62,29 +81,59 @@ func Reload() {
 	GetInstance()
 }
 
+// WithTransaction runs fn within a database transaction. The transaction is committed if fn returns nil, and
+// rolled back otherwise.
+func (d *Database) WithTransaction(ctx rcontext.RequestContext, fn func(tx *sql.Tx) error) error {
+	tx, err := d.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err = fn(tx); err != nil {
+		if err2 := tx.Rollback(); err2 != nil {
+			ctx.Log.Warn("Error rolling back transaction: ", err2)
+			sentry.CaptureException(err2)
+		}
+		return err
+	}
+	return tx.Commit()
+}
+
 // GetAccessorForTests
 // Deprecated: For tests only.
 func GetAccessorForTests() *sql.DB {
 	return GetInstance().conn
 }
 
-func openDatabase(connectionString string, maxConns int, maxIdleConns int) error {
+func openDatabase(conf config.DatabaseConfig) error {
 	d := &Database{}
 	var err error
 
-	if d.conn, err = sql.Open("postgres", connectionString); err != nil {
-		return errors.New("error connecting to db: " + err.Error())
+	replicasConf := conf.ReadReplicas
+	migrationsPath := config.Runtime.MigrationsPath
+	var dialect gomigrate.Migratable = gomigrate.Postgres{}
+	if conf.Sqlite != "" {
+		if d.conn, d.stats, err = openSqliteConnection("primary", conf.Sqlite, conf.Pool); err != nil {
+			return err
+		}
+		dialect = gomigrate.Sqlite3{}
+		migrationsPath = path.Join(migrationsPath, sqliteMigrationsDir)
+		if replicasConf != nil && len(replicasConf.Postgres) > 0 {
+			logrus.Warn("Read replicas are not supported with SQLite - all queries will go to the SQLite database")
+		}
+		replicasConf = nil
+	} else if d.conn, d.stats, err = openConnection("primary", conf.Postgres, conf.Pool); err != nil {
+		return err
 	}
-	d.conn.SetMaxOpenConns(maxConns)
-	d.conn.SetMaxIdleConns(maxIdleConns)
 
-	// Run migrations
-	var migrator *gomigrate.Migrator
-	if migrator, err = gomigrate.NewMigratorWithLogger(d.conn, gomigrate.Postgres{}, config.Runtime.MigrationsPath, &logging.SendToDebugLogger{}); err != nil {
-		return errors.New("error setting up migrator: " + err.Error())
-	}
-	if err = migrator.Migrate(); err != nil {
-		return errors.New("error running migrations: " + err.Error())
+	// Run migrations. Download instances leave this to the write tier, as they may be connected to a read replica.
+	if !config.Get().Deployment.IsDownloadsOnly() {
+		var migrator *gomigrate.Migrator
+		if migrator, err = gomigrate.NewMigratorWithLogger(d.conn, dialect, migrationsPath, &logging.SendToDebugLogger{}); err != nil {
+			return errors.New("error setting up migrator: " + err.Error())
+		}
+		if err = migrator.Migrate(); err != nil {
+			return errors.New("error running migrations: " + err.Error())
+		}
 	}
 
 	// Prepare the table accessors
@@ -130,6 +179,62 @@ func openDatabase(connectionString string, maxConns int, maxIdleConns int) error
 	if d.RestrictedMedia, err = prepareRestrictedMediaTables(d.conn); err != nil {
 		return errors.New("failed to create restricted media table accessor: " + err.Error())
 	}
+	if d.MediaReferences, err = prepareMediaReferencesTables(d.conn); err != nil {
+		return errors.New("failed to create media references table accessor: " + err.Error())
+	}
+	if d.Unreferenced, err = prepareUnreferencedMediaTables(d.conn); err != nil {
+		return errors.New("failed to create unreferenced media table accessor: " + err.Error())
+	}
+	if d.IdempotencyKeys, err = prepareIdempotencyKeysTables(d.conn); err != nil {
+		return errors.New("failed to create idempotency keys table accessor: " + err.Error())
+	}
+	if d.UploadPartials, err = prepareUploadPartialsTables(d.conn); err != nil {
+		return errors.New("failed to create upload partials table accessor: " + err.Error())
+	}
+	if d.MediaScans, err = prepareMediaScansTables(d.conn); err != nil {
+		return errors.New("failed to create media scans table accessor: " + err.Error())
+	}
+	if d.EncryptedObjects, err = prepareEncryptedObjectsTables(d.conn); err != nil {
+		return errors.New("failed to create encrypted objects table accessor: " + err.Error())
+	}
+	if d.BannedHashes, err = prepareBannedHashesTables(d.conn); err != nil {
+		return errors.New("failed to create banned hashes table accessor: " + err.Error())
+	}
+	if d.AppliedPolicies, err = prepareAppliedPolicyRulesTables(d.conn); err != nil {
+		return errors.New("failed to create applied policy rules table accessor: " + err.Error())
+	}
+	if d.ExternalMedia, err = prepareExternalMediaTables(d.conn); err != nil {
+		return errors.New("failed to create external media table accessor: " + err.Error())
+	}
+	if d.PublicRooms, err = preparePublicRoomsTables(d.conn); err != nil {
+		return errors.New("failed to create public rooms table accessor: " + err.Error())
+	}
+	if d.ModerationQueue, err = prepareModerationQueueTables(d.conn); err != nil {
+		return errors.New("failed to create moderation queue table accessor: " + err.Error())
+	}
+	if d.ModerationLog, err = prepareModerationDecisionsTables(d.conn); err != nil {
+		return errors.New("failed to create moderation decisions table accessor: " + err.Error())
+	}
+	if d.QuarantineLog, err = prepareQuarantineActionsTables(d.conn); err != nil {
+		return errors.New("failed to create quarantine actions table accessor: " + err.Error())
+	}
+	if d.Replication, err = prepareReplicationStateTables(d.conn); err != nil {
+		return errors.New("failed to create replication state table accessor: " + err.Error())
+	}
+	if d.ReplicationLog, err = prepareReplicationEventsTables(d.conn); err != nil {
+		return errors.New("failed to create replication events table accessor: " + err.Error())
+	}
+	if d.UserPreferences, err = prepareUserPreferencesTables(d.conn); err != nil {
+		return errors.New("failed to create user preferences table accessor: " + err.Error())
+	}
+	if d.GalleryLinks, err = prepareGalleryLinksTables(d.conn); err != nil {
+		return errors.New("failed to create gallery links table accessor: " + err.Error())
+	}
+
+	// Lookups which can be served by read replicas are set up after the tables exist on the primary
+	d.replicas = openReadReplicas(replicasConf, conf.Pool)
+	d.Media.replicas = d.replicas
+	d.Thumbnails.replicas = d.replicas
 
 	instance = d
 	return nil
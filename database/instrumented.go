@@ -0,0 +1,175 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/metrics"
+)
+
+var storeRegex = regexp.MustCompile(`(?i)\b(?:FROM|INTO|UPDATE)\s+([a-z_]+)(?:\s|;|$)`)
+
+// queryStore returns the table a query is for, used to break down query latency.
+func queryStore(query string) string {
+	if m := storeRegex.FindStringSubmatch(query); m != nil {
+		return strings.ToLower(m[1])
+	}
+	return "other"
+}
+
+// pgConn is the set of optional driver interfaces implemented by lib/pq connections which database/sql makes use of.
+type pgConn interface {
+	driver.Conn
+	driver.ConnPrepareContext
+	driver.ConnBeginTx
+	driver.QueryerContext
+	driver.ExecerContext
+	driver.Pinger
+	driver.SessionResetter
+	driver.Validator
+}
+
+// driverStmt is the set of optional driver interfaces implemented by prepared statements which database/sql makes use of.
+type driverStmt interface {
+	driver.Stmt
+	driver.StmtExecContext
+	driver.StmtQueryContext
+}
+
+type instrumentedConnector struct {
+	*pq.Connector
+	pool string
+}
+
+type instrumentedConn struct {
+	pgConn
+	pool string
+}
+
+type instrumentedStmt struct {
+	driverStmt
+	pool  string
+	store string
+}
+
+// openConnection opens a connection pool to PostgreSQL which reports query latency and pool usage to Prometheus,
+// under the given pool name.
+func openConnection(pool string, connectionString string, poolConf *config.DbPoolConfig) (*sql.DB, prometheus.Collector, error) {
+	connector, err := pq.NewConnector(connectionString)
+	if err != nil {
+		return nil, nil, errors.New("error connecting to db: " + err.Error())
+	}
+	conn := sql.OpenDB(&instrumentedConnector{Connector: connector, pool: pool})
+	conn.SetMaxOpenConns(poolConf.MaxConnections)
+	conn.SetMaxIdleConns(poolConf.MaxIdle)
+	conn.SetConnMaxLifetime(time.Duration(poolConf.MaxLifetimeSeconds) * time.Second)
+	conn.SetConnMaxIdleTime(time.Duration(poolConf.MaxIdleTimeSeconds) * time.Second)
+
+	stats := collectors.NewDBStatsCollector(conn, pool)
+	if err = prometheus.Register(stats); err != nil {
+		logrus.Warnf("Unable to report database pool metrics for %s: %v", pool, err)
+		stats = nil
+	}
+	return conn, stats, nil
+}
+
+// closeConnection closes a connection pool opened by openConnection.
+func closeConnection(conn *sql.DB, stats prometheus.Collector) error {
+	if stats != nil {
+		prometheus.Unregister(stats)
+	}
+	return conn.Close()
+}
+
+func observeQuery(pool string, store string, start time.Time, err error) {
+	if errors.Is(err, driver.ErrSkip) {
+		return // database/sql will try again with a prepared statement, which is timed instead
+	}
+	metrics.DatabaseQueryTime.With(prometheus.Labels{"pool": pool, "store": store}).Observe(time.Since(start).Seconds())
+}
+
+func (c *instrumentedConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if pc, ok := conn.(pgConn); ok {
+		return &instrumentedConn{pgConn: pc, pool: c.pool}, nil
+	}
+	return conn, nil
+}
+
+func instrumentStmt(stmt driver.Stmt, pool string, query string) driver.Stmt {
+	if ds, ok := stmt.(driverStmt); ok {
+		return &instrumentedStmt{driverStmt: ds, pool: pool, store: queryStore(query)}
+	}
+	return stmt
+}
+
+func (c *instrumentedConn) Prepare(query string) (driver.Stmt, error) {
+	stmt, err := c.pgConn.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	return instrumentStmt(stmt, c.pool, query), nil
+}
+
+func (c *instrumentedConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	stmt, err := c.pgConn.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return instrumentStmt(stmt, c.pool, query), nil
+}
+
+func (c *instrumentedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	start := time.Now()
+	rows, err := c.pgConn.QueryContext(ctx, query, args)
+	observeQuery(c.pool, queryStore(query), start, err)
+	return rows, err
+}
+
+func (c *instrumentedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	start := time.Now()
+	res, err := c.pgConn.ExecContext(ctx, query, args)
+	observeQuery(c.pool, queryStore(query), start, err)
+	return res, err
+}
+
+func (s *instrumentedStmt) Exec(args []driver.Value) (driver.Result, error) {
+	start := time.Now()
+	res, err := s.driverStmt.Exec(args)
+	observeQuery(s.pool, s.store, start, err)
+	return res, err
+}
+
+func (s *instrumentedStmt) Query(args []driver.Value) (driver.Rows, error) {
+	start := time.Now()
+	rows, err := s.driverStmt.Query(args)
+	observeQuery(s.pool, s.store, start, err)
+	return rows, err
+}
+
+func (s *instrumentedStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	start := time.Now()
+	res, err := s.driverStmt.ExecContext(ctx, args)
+	observeQuery(s.pool, s.store, start, err)
+	return res, err
+}
+
+func (s *instrumentedStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	start := time.Now()
+	rows, err := s.driverStmt.QueryContext(ctx, args)
+	observeQuery(s.pool, s.store, start, err)
+	return rows, err
+}
@@ -15,10 +15,13 @@ func (a *AnonymousJson) Value() (driver.Value, error) {
 
 // Scan implements sql.Scanner
 func (a *AnonymousJson) Scan(value interface{}) error {
-	if b, ok := value.([]byte); !ok {
+	switch v := value.(type) {
+	case []byte:
+		return json.Unmarshal(v, &a)
+	case string: // SQLite returns text columns as strings
+		return json.Unmarshal([]byte(v), &a)
+	default:
 		return errors.New("failed to assert jsonb is bytes")
-	} else {
-		return json.Unmarshal(b, &a)
 	}
 }
 
@@ -0,0 +1,148 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/metrics"
+)
+
+// selectReplicationLag returns how far behind the primary a replica is, in seconds. A replica which has replayed
+// everything it received is not behind, even if nothing has been written for a while.
+const selectReplicationLag = "SELECT CASE WHEN NOT pg_is_in_recovery() OR pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() THEN 0 ELSE COALESCE(EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp()), 0) END;"
+
+type readReplica struct {
+	name       string
+	conn       *sql.DB
+	stats      prometheus.Collector
+	media      *mediaTableStatements
+	thumbnails *thumbnailsTableStatements
+	usable     *atomic.Bool
+}
+
+// readReplicas are the PostgreSQL replicas read-only lookups can be sent to. Replicas which are unreachable or too
+// far behind the primary are skipped until they catch up.
+type readReplicas struct {
+	replicas []*readReplica
+	next     *atomic.Uint64
+	stop     chan bool
+}
+
+func openReadReplicas(conf *config.DbReadReplicasConfig, poolConf *config.DbPoolConfig) *readReplicas {
+	r := &readReplicas{
+		replicas: make([]*readReplica, 0),
+		next:     &atomic.Uint64{},
+		stop:     make(chan bool),
+	}
+	if conf == nil || len(conf.Postgres) == 0 {
+		return r
+	}
+
+	for i, connectionString := range conf.Postgres {
+		replica, err := openReadReplica(strconv.Itoa(i), connectionString, poolConf)
+		if err != nil {
+			// The primary can serve everything, so a broken replica shouldn't stop startup
+			logrus.Errorf("Unable to use database read replica %d: %v", i, err)
+			sentry.CaptureException(err)
+			continue
+		}
+		r.replicas = append(r.replicas, replica)
+	}
+	if len(r.replicas) == 0 {
+		return r
+	}
+
+	r.checkLag(conf.MaxLagSeconds)
+	go func() {
+		ticker := time.NewTicker(time.Duration(max(1, conf.CheckIntervalSeconds)) * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-r.stop:
+				return
+			case <-ticker.C:
+				r.checkLag(conf.MaxLagSeconds)
+			}
+		}
+	}()
+
+	return r
+}
+
+func openReadReplica(name string, connectionString string, poolConf *config.DbPoolConfig) (*readReplica, error) {
+	var err error
+	replica := &readReplica{
+		name:   name,
+		usable: &atomic.Bool{},
+	}
+	if replica.conn, replica.stats, err = openConnection("replica_"+name, connectionString, poolConf); err != nil {
+		return nil, err
+	}
+
+	// Migrations are applied to the primary, and reach the replica through replication
+	if replica.media, err = prepareMediaTables(replica.conn); err != nil {
+		_ = closeConnection(replica.conn, replica.stats)
+		return nil, errors.New("failed to create media table accessor: " + err.Error())
+	}
+	if replica.thumbnails, err = prepareThumbnailsTables(replica.conn); err != nil {
+		_ = closeConnection(replica.conn, replica.stats)
+		return nil, errors.New("failed to create thumbnails table accessor: " + err.Error())
+	}
+	return replica, nil
+}
+
+func (r *readReplicas) checkLag(maxLagSeconds int) {
+	for _, replica := range r.replicas {
+		lag := float64(0)
+		if err := replica.conn.QueryRow(selectReplicationLag).Scan(&lag); err != nil {
+			if replica.usable.Swap(false) {
+				logrus.Warnf("Database read replica %s is unreachable, sending its reads to the primary: %v", replica.name, err)
+			}
+			continue
+		}
+		metrics.DatabaseReplicaLag.With(prometheus.Labels{"replica": replica.name}).Set(lag)
+		usable := maxLagSeconds <= 0 || lag <= float64(maxLagSeconds)
+		if replica.usable.Swap(usable) != usable {
+			if usable {
+				logrus.Infof("Database read replica %s is in use (%.1fs behind)", replica.name, lag)
+			} else {
+				logrus.Warnf("Database read replica %s is %.1fs behind, sending its reads to the primary", replica.name, lag)
+			}
+		}
+	}
+}
+
+// pick returns the next usable replica, or nil if reads should go to the primary.
+func (r *readReplicas) pick() *readReplica {
+	if r == nil || len(r.replicas) == 0 {
+		return nil
+	}
+	start := r.next.Add(1)
+	for i := 0; i < len(r.replicas); i++ {
+		replica := r.replicas[(start+uint64(i))%uint64(len(r.replicas))]
+		if replica.usable.Load() {
+			return replica
+		}
+	}
+	return nil
+}
+
+func (r *readReplicas) close() {
+	if r == nil {
+		return
+	}
+	close(r.stop)
+	for _, replica := range r.replicas {
+		if err := closeConnection(replica.conn, replica.stats); err != nil {
+			logrus.Error(err)
+			sentry.CaptureException(err)
+		}
+	}
+}
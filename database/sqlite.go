@@ -0,0 +1,230 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"modernc.org/sqlite"
+)
+
+// sqliteMigrationsDir is where the SQLite schema lives, relative to the (PostgreSQL) migrations path.
+const sqliteMigrationsDir = "sqlite"
+
+// sqliteRewrites translate the PostgreSQL-specific parts of the table statements into SQLite. Arrays are passed with
+// pq.Array as in PostgreSQL, and are handled by the functions registered in init.
+var sqliteRewrites = []struct {
+	pattern *regexp.Regexp
+	replace string
+}{
+	{regexp.MustCompile(`([a-z_.]+) = ANY\((\$\d+)\)`), "array_contains(${2}, ${1})"},
+	{regexp.MustCompile(`([a-z_.]+) <> ANY\((\$\d+)\)`), "array_any_ne(${2}, ${1})"},
+	{regexp.MustCompile(`([a-z_.]+) LIKE ANY\((\$\d+)\)`), "array_any_like(${2}, ${1})"},
+	{regexp.MustCompile(`LIKE (\$\d+)`), `LIKE ${1} ESCAPE '\'`},
+	{regexp.MustCompile(`(\$\d+)::text\[\]`), "${1}"},
+	{regexp.MustCompile(`COUNT\([a-z_]+\.\*\)`), "COUNT(*)"},
+}
+
+var sqliteQueries = &sync.Map{} // PostgreSQL query -> SQLite query
+
+// sqliteDriver is the driver registered by modernc.org/sqlite, which carries the functions registered in init.
+var sqliteDriver driver.Driver
+
+func init() {
+	sqlite.MustRegisterDeterministicScalarFunction("array_contains", 2, func(ctx *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+		return sqliteArrayAny(args, func(element string, value string) bool {
+			return element == value
+		})
+	})
+	sqlite.MustRegisterDeterministicScalarFunction("array_any_ne", 2, func(ctx *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+		return sqliteArrayAny(args, func(element string, value string) bool {
+			return element != value
+		})
+	})
+	sqlite.MustRegisterDeterministicScalarFunction("array_any_like", 2, func(ctx *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+		return sqliteArrayAny(args, func(element string, value string) bool {
+			return likePattern(element).MatchString(value)
+		})
+	})
+	sqlite.MustRegisterDeterministicScalarFunction("cardinality", 1, func(ctx *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+		arr, err := sqliteArray(args[0])
+		if err != nil {
+			return nil, err
+		}
+		return int64(len(arr)), nil
+	})
+
+	db, err := sql.Open("sqlite", "")
+	if err != nil {
+		panic(err)
+	}
+	sqliteDriver = db.Driver()
+	_ = db.Close()
+}
+
+func sqliteArray(val driver.Value) (pq.StringArray, error) {
+	arr := pq.StringArray{}
+	if err := arr.Scan(val); err != nil {
+		return nil, err
+	}
+	return arr, nil
+}
+
+// sqliteArrayAny implements PostgreSQL's `value op ANY(array)` for args of (array, value).
+func sqliteArrayAny(args []driver.Value, op func(element string, value string) bool) (driver.Value, error) {
+	if args[1] == nil {
+		return nil, nil
+	}
+	arr, err := sqliteArray(args[0])
+	if err != nil {
+		return nil, err
+	}
+	value, ok := args[1].(string)
+	if !ok {
+		return nil, errors.New("array comparisons are only supported for text")
+	}
+	for _, element := range arr {
+		if op(element, value) {
+			return int64(1), nil
+		}
+	}
+	return int64(0), nil
+}
+
+// likePattern converts a (case-sensitive) PostgreSQL LIKE pattern to a regular expression.
+func likePattern(pattern string) *regexp.Regexp {
+	sb := strings.Builder{}
+	sb.WriteString("(?s)^")
+	escaped := false
+	for _, r := range pattern {
+		switch {
+		case escaped:
+			sb.WriteString(regexp.QuoteMeta(string(r)))
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == '%':
+			sb.WriteString(".*")
+		case r == '_':
+			sb.WriteString(".")
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	sb.WriteString("$")
+	return regexp.MustCompile(sb.String())
+}
+
+// sqliteQuery returns the SQLite equivalent of the given table statement.
+func sqliteQuery(query string) string {
+	if val, ok := sqliteQueries.Load(query); ok {
+		return val.(string)
+	}
+	rewritten := query
+	for _, rewrite := range sqliteRewrites {
+		rewritten = rewrite.pattern.ReplaceAllString(rewritten, rewrite.replace)
+	}
+	sqliteQueries.Store(query, rewritten)
+	return rewritten
+}
+
+// sqliteConn is the set of driver interfaces implemented by modernc.org/sqlite connections which database/sql makes
+// use of.
+type sqliteConn interface {
+	driver.Conn
+	driver.ConnPrepareContext
+	driver.ConnBeginTx
+	driver.QueryerContext
+	driver.ExecerContext
+	driver.Pinger
+}
+
+type sqliteConnector struct {
+	dsn  string
+	pool string
+}
+
+type instrumentedSqliteConn struct {
+	sqliteConn
+	pool string
+}
+
+// openSqliteConnection opens a connection pool to the SQLite database at the given path, reporting to Prometheus in
+// the same way as openConnection. Queries are translated from PostgreSQL as they are prepared.
+func openSqliteConnection(pool string, path string, poolConf *config.DbPoolConfig) (*sql.DB, prometheus.Collector, error) {
+	if path == "" {
+		return nil, nil, errors.New("no sqlite database path given")
+	}
+	// Writes wait for each other rather than failing, and transactions take the write lock upfront so they can't
+	// deadlock while upgrading to it. LIKE is case-sensitive, as in PostgreSQL.
+	dsn := path + "?_pragma=busy_timeout(10000)&_pragma=journal_mode(WAL)&_pragma=case_sensitive_like(1)&_txlock=immediate"
+	conn := sql.OpenDB(&sqliteConnector{dsn: dsn, pool: pool})
+	conn.SetMaxOpenConns(poolConf.MaxConnections)
+	conn.SetMaxIdleConns(poolConf.MaxIdle)
+	conn.SetConnMaxLifetime(time.Duration(poolConf.MaxLifetimeSeconds) * time.Second)
+	conn.SetConnMaxIdleTime(time.Duration(poolConf.MaxIdleTimeSeconds) * time.Second)
+
+	stats := collectors.NewDBStatsCollector(conn, pool)
+	if err := prometheus.Register(stats); err != nil {
+		logrus.Warnf("Unable to report database pool metrics for %s: %v", pool, err)
+		stats = nil
+	}
+	return conn, stats, nil
+}
+
+func (c *sqliteConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := sqliteDriver.Open(c.dsn)
+	if err != nil {
+		return nil, errors.New("error opening sqlite database: " + err.Error())
+	}
+	sc, ok := conn.(sqliteConn)
+	if !ok {
+		_ = conn.Close()
+		return nil, errors.New("sqlite connection does not support contexts")
+	}
+	return &instrumentedSqliteConn{sqliteConn: sc, pool: c.pool}, nil
+}
+
+func (c *sqliteConnector) Driver() driver.Driver {
+	return sqliteDriver
+}
+
+func (c *instrumentedSqliteConn) Prepare(query string) (driver.Stmt, error) {
+	stmt, err := c.sqliteConn.Prepare(sqliteQuery(query))
+	if err != nil {
+		return nil, err
+	}
+	return instrumentStmt(stmt, c.pool, query), nil
+}
+
+func (c *instrumentedSqliteConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	stmt, err := c.sqliteConn.PrepareContext(ctx, sqliteQuery(query))
+	if err != nil {
+		return nil, err
+	}
+	return instrumentStmt(stmt, c.pool, query), nil
+}
+
+func (c *instrumentedSqliteConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	start := time.Now()
+	rows, err := c.sqliteConn.QueryContext(ctx, sqliteQuery(query), args)
+	observeQuery(c.pool, queryStore(query), start, err)
+	return rows, err
+}
+
+func (c *instrumentedSqliteConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	start := time.Now()
+	res, err := c.sqliteConn.ExecContext(ctx, sqliteQuery(query), args)
+	observeQuery(c.pool, queryStore(query), start, err)
+	return res, err
+}
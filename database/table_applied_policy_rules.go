@@ -0,0 +1,58 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+)
+
+const insertAppliedPolicyRule = "INSERT INTO applied_policy_rules (room_id, event_id, applied_ts) VALUES ($1, $2, $3) ON CONFLICT (room_id, event_id) DO NOTHING;"
+const selectAppliedPolicyRuleExists = "SELECT TRUE FROM applied_policy_rules WHERE room_id = $1 AND event_id = $2 LIMIT 1;"
+
+type appliedPolicyRulesTableStatements struct {
+	insertAppliedPolicyRule       *sql.Stmt
+	selectAppliedPolicyRuleExists *sql.Stmt
+}
+
+type appliedPolicyRulesTableWithContext struct {
+	statements *appliedPolicyRulesTableStatements
+	ctx        rcontext.RequestContext
+}
+
+func prepareAppliedPolicyRulesTables(db *sql.DB) (*appliedPolicyRulesTableStatements, error) {
+	var err error
+	var stmts = &appliedPolicyRulesTableStatements{}
+
+	if stmts.insertAppliedPolicyRule, err = db.Prepare(insertAppliedPolicyRule); err != nil {
+		return nil, errors.New("error preparing insertAppliedPolicyRule: " + err.Error())
+	}
+	if stmts.selectAppliedPolicyRuleExists, err = db.Prepare(selectAppliedPolicyRuleExists); err != nil {
+		return nil, errors.New("error preparing selectAppliedPolicyRuleExists: " + err.Error())
+	}
+
+	return stmts, nil
+}
+
+func (s *appliedPolicyRulesTableStatements) Prepare(ctx rcontext.RequestContext) *appliedPolicyRulesTableWithContext {
+	return &appliedPolicyRulesTableWithContext{
+		statements: s,
+		ctx:        ctx,
+	}
+}
+
+func (s *appliedPolicyRulesTableWithContext) Insert(roomId string, eventId string, appliedTs int64) error {
+	_, err := s.statements.insertAppliedPolicyRule.ExecContext(s.ctx, roomId, eventId, appliedTs)
+	return err
+}
+
+func (s *appliedPolicyRulesTableWithContext) IsApplied(roomId string, eventId string) (bool, error) {
+	row := s.statements.selectAppliedPolicyRuleExists.QueryRowContext(s.ctx, roomId, eventId)
+	val := false
+	err := row.Scan(&val)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = nil
+		val = false
+	}
+	return val, err
+}
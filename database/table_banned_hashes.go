@@ -0,0 +1,125 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/lib/pq"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+)
+
+type DbBannedHash struct {
+	Sha256Hash string
+	Source     string
+	Reason     string
+	BannedTs   int64
+}
+
+const insertBannedHash = "INSERT INTO banned_hashes (sha256_hash, source, reason, banned_ts) VALUES ($1, $2, $3, $4) ON CONFLICT (sha256_hash, source) DO UPDATE SET reason = $3;"
+const selectBannedHash = "SELECT sha256_hash, source, reason, banned_ts FROM banned_hashes WHERE sha256_hash = $1;"
+const selectBannedHashesBySource = "SELECT sha256_hash, source, reason, banned_ts FROM banned_hashes WHERE source = $1;"
+const deleteBannedHash = "DELETE FROM banned_hashes WHERE sha256_hash = $1 AND source = $2;"
+const deleteBannedHashesBySourceExcept = "DELETE FROM banned_hashes WHERE source = $1 AND NOT (sha256_hash = ANY($2));"
+
+type bannedHashesTableStatements struct {
+	insertBannedHash                 *sql.Stmt
+	selectBannedHash                 *sql.Stmt
+	selectBannedHashesBySource       *sql.Stmt
+	deleteBannedHash                 *sql.Stmt
+	deleteBannedHashesBySourceExcept *sql.Stmt
+}
+
+type bannedHashesTableWithContext struct {
+	statements *bannedHashesTableStatements
+	ctx        rcontext.RequestContext
+	tx         *sql.Tx
+}
+
+func prepareBannedHashesTables(db *sql.DB) (*bannedHashesTableStatements, error) {
+	var err error
+	var stmts = &bannedHashesTableStatements{}
+
+	if stmts.insertBannedHash, err = db.Prepare(insertBannedHash); err != nil {
+		return nil, errors.New("error preparing insertBannedHash: " + err.Error())
+	}
+	if stmts.selectBannedHash, err = db.Prepare(selectBannedHash); err != nil {
+		return nil, errors.New("error preparing selectBannedHash: " + err.Error())
+	}
+	if stmts.selectBannedHashesBySource, err = db.Prepare(selectBannedHashesBySource); err != nil {
+		return nil, errors.New("error preparing selectBannedHashesBySource: " + err.Error())
+	}
+	if stmts.deleteBannedHash, err = db.Prepare(deleteBannedHash); err != nil {
+		return nil, errors.New("error preparing deleteBannedHash: " + err.Error())
+	}
+	if stmts.deleteBannedHashesBySourceExcept, err = db.Prepare(deleteBannedHashesBySourceExcept); err != nil {
+		return nil, errors.New("error preparing deleteBannedHashesBySourceExcept: " + err.Error())
+	}
+
+	return stmts, nil
+}
+
+func (s *bannedHashesTableStatements) Prepare(ctx rcontext.RequestContext) *bannedHashesTableWithContext {
+	return &bannedHashesTableWithContext{
+		statements: s,
+		ctx:        ctx,
+	}
+}
+
+// PrepareTx is like Prepare, but runs all statements within the given transaction.
+func (s *bannedHashesTableStatements) PrepareTx(ctx rcontext.RequestContext, tx *sql.Tx) *bannedHashesTableWithContext {
+	return &bannedHashesTableWithContext{
+		statements: s,
+		ctx:        ctx,
+		tx:         tx,
+	}
+}
+
+func (s *bannedHashesTableWithContext) stmt(stmt *sql.Stmt) *sql.Stmt {
+	if s.tx != nil {
+		return s.tx.StmtContext(s.ctx, stmt)
+	}
+	return stmt
+}
+
+func (s *bannedHashesTableWithContext) scanRows(rows *sql.Rows, err error) ([]*DbBannedHash, error) {
+	results := make([]*DbBannedHash, 0)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return results, nil
+		}
+		return nil, err
+	}
+	for rows.Next() {
+		val := &DbBannedHash{}
+		if err = rows.Scan(&val.Sha256Hash, &val.Source, &val.Reason, &val.BannedTs); err != nil {
+			return nil, err
+		}
+		results = append(results, val)
+	}
+	return results, nil
+}
+
+func (s *bannedHashesTableWithContext) Insert(record *DbBannedHash) error {
+	_, err := s.stmt(s.statements.insertBannedHash).ExecContext(s.ctx, record.Sha256Hash, record.Source, record.Reason, record.BannedTs)
+	return err
+}
+
+// Get returns every ban of the hash, one per source. The returned slice is empty if the hash is not banned.
+func (s *bannedHashesTableWithContext) Get(sha256hash string) ([]*DbBannedHash, error) {
+	return s.scanRows(s.stmt(s.statements.selectBannedHash).QueryContext(s.ctx, sha256hash))
+}
+
+func (s *bannedHashesTableWithContext) GetBySource(source string) ([]*DbBannedHash, error) {
+	return s.scanRows(s.stmt(s.statements.selectBannedHashesBySource).QueryContext(s.ctx, source))
+}
+
+func (s *bannedHashesTableWithContext) Delete(sha256hash string, source string) error {
+	_, err := s.stmt(s.statements.deleteBannedHash).ExecContext(s.ctx, sha256hash, source)
+	return err
+}
+
+// DeleteBySourceExcept removes all bans from the source, other than those for the given hashes.
+func (s *bannedHashesTableWithContext) DeleteBySourceExcept(source string, keepHashes []string) error {
+	_, err := s.stmt(s.statements.deleteBannedHashesBySourceExcept).ExecContext(s.ctx, source, pq.Array(keepHashes))
+	return err
+}
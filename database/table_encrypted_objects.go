@@ -0,0 +1,70 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+)
+
+const insertEncryptedObject = "INSERT INTO encrypted_objects (datastore_id, location, key_id) VALUES ($1, $2, $3) ON CONFLICT (datastore_id, location) DO UPDATE SET key_id = $3;"
+const selectEncryptedObjectKeyId = "SELECT key_id FROM encrypted_objects WHERE datastore_id = $1 AND location = $2;"
+const deleteEncryptedObject = "DELETE FROM encrypted_objects WHERE datastore_id = $1 AND location = $2;"
+
+type encryptedObjectsTableStatements struct {
+	insertEncryptedObject      *sql.Stmt
+	selectEncryptedObjectKeyId *sql.Stmt
+	deleteEncryptedObject      *sql.Stmt
+}
+
+type encryptedObjectsTableWithContext struct {
+	statements *encryptedObjectsTableStatements
+	ctx        rcontext.RequestContext
+}
+
+func prepareEncryptedObjectsTables(db *sql.DB) (*encryptedObjectsTableStatements, error) {
+	var err error
+	var stmts = &encryptedObjectsTableStatements{}
+
+	if stmts.insertEncryptedObject, err = db.Prepare(insertEncryptedObject); err != nil {
+		return nil, errors.New("error preparing insertEncryptedObject: " + err.Error())
+	}
+	if stmts.selectEncryptedObjectKeyId, err = db.Prepare(selectEncryptedObjectKeyId); err != nil {
+		return nil, errors.New("error preparing selectEncryptedObjectKeyId: " + err.Error())
+	}
+	if stmts.deleteEncryptedObject, err = db.Prepare(deleteEncryptedObject); err != nil {
+		return nil, errors.New("error preparing deleteEncryptedObject: " + err.Error())
+	}
+
+	return stmts, nil
+}
+
+func (s *encryptedObjectsTableStatements) Prepare(ctx rcontext.RequestContext) *encryptedObjectsTableWithContext {
+	return &encryptedObjectsTableWithContext{
+		statements: s,
+		ctx:        ctx,
+	}
+}
+
+func (s *encryptedObjectsTableWithContext) Insert(datastoreId string, location string, keyId string) error {
+	_, err := s.statements.insertEncryptedObject.ExecContext(s.ctx, datastoreId, location, keyId)
+	return err
+}
+
+// GetKeyId returns the ID of the key the object was encrypted with, or an empty string if the object
+// is not encrypted.
+func (s *encryptedObjectsTableWithContext) GetKeyId(datastoreId string, location string) (string, error) {
+	row := s.statements.selectEncryptedObjectKeyId.QueryRowContext(s.ctx, datastoreId, location)
+	val := ""
+	err := row.Scan(&val)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = nil
+		val = ""
+	}
+	return val, err
+}
+
+func (s *encryptedObjectsTableWithContext) Delete(datastoreId string, location string) error {
+	_, err := s.statements.deleteEncryptedObject.ExecContext(s.ctx, datastoreId, location)
+	return err
+}
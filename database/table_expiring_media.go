@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"errors"
 
+	"github.com/lib/pq"
 	"github.com/t2bot/matrix-media-repo/common/rcontext"
 	"github.com/t2bot/matrix-media-repo/util"
 )
@@ -13,16 +14,20 @@ type DbExpiringMedia struct {
 	MediaId   string
 	UserId    string
 	ExpiresTs int64
+	RoomIds   []string
+	CreatedTs int64
 }
 
 func (r *DbExpiringMedia) IsExpired() bool {
 	return r.ExpiresTs < util.NowMillis()
 }
 
-const insertExpiringMedia = "INSERT INTO expiring_media (origin, media_id, user_id, expires_ts) VALUES ($1, $2, $3, $4);"
+const insertExpiringMedia = "INSERT INTO expiring_media (origin, media_id, user_id, expires_ts, room_ids, created_ts) VALUES ($1, $2, $3, $4, $5, $6);"
 const selectExpiringMediaByUserCount = "SELECT COUNT(*) FROM expiring_media WHERE user_id = $1 AND expires_ts >= $2;"
-const selectExpiringMediaById = "SELECT origin, media_id, user_id, expires_ts FROM expiring_media WHERE origin = $1 AND media_id = $2;"
+const selectExpiringMediaById = "SELECT origin, media_id, user_id, expires_ts, room_ids, created_ts FROM expiring_media WHERE origin = $1 AND media_id = $2;"
 const deleteExpiringMediaById = "DELETE FROM expiring_media WHERE origin = $1 AND media_id = $2;"
+const selectPendingExpiringMediaCountByOrigin = "SELECT origin, COUNT(*) FROM expiring_media WHERE expires_ts >= $1 GROUP BY origin;"
+const deleteExpiredExpiringMedia = "DELETE FROM expiring_media WHERE expires_ts < $1 RETURNING origin;"
 
 // Dev note: there is an UPDATE query in the Upload test suite.
 
@@ -31,11 +36,14 @@ type expiringMediaTableStatements struct {
 	selectExpiringMediaByUserCount *sql.Stmt
 	selectExpiringMediaById        *sql.Stmt
 	deleteExpiringMediaById        *sql.Stmt
+	selectPendingCountByOrigin     *sql.Stmt
+	deleteExpired                  *sql.Stmt
 }
 
 type expiringMediaTableWithContext struct {
 	statements *expiringMediaTableStatements
 	ctx        rcontext.RequestContext
+	tx         *sql.Tx
 }
 
 func prepareExpiringMediaTables(db *sql.DB) (*expiringMediaTableStatements, error) {
@@ -54,6 +62,12 @@ func prepareExpiringMediaTables(db *sql.DB) (*expiringMediaTableStatements, erro
 	if stmts.deleteExpiringMediaById, err = db.Prepare(deleteExpiringMediaById); err != nil {
 		return nil, errors.New("error preparing deleteExpiringMediaById: " + err.Error())
 	}
+	if stmts.selectPendingCountByOrigin, err = db.Prepare(selectPendingExpiringMediaCountByOrigin); err != nil {
+		return nil, errors.New("error preparing selectPendingExpiringMediaCountByOrigin: " + err.Error())
+	}
+	if stmts.deleteExpired, err = db.Prepare(deleteExpiredExpiringMedia); err != nil {
+		return nil, errors.New("error preparing deleteExpiredExpiringMedia: " + err.Error())
+	}
 
 	return stmts, nil
 }
@@ -65,13 +79,29 @@ func (s *expiringMediaTableStatements) Prepare(ctx rcontext.RequestContext) *exp
 	}
 }
 
-func (s *expiringMediaTableWithContext) Insert(origin string, mediaId string, userId string, expiresTs int64) error {
-	_, err := s.statements.insertExpiringMedia.ExecContext(s.ctx, origin, mediaId, userId, expiresTs)
+// PrepareTx is like Prepare, but runs all statements within the given transaction.
+func (s *expiringMediaTableStatements) PrepareTx(ctx rcontext.RequestContext, tx *sql.Tx) *expiringMediaTableWithContext {
+	return &expiringMediaTableWithContext{
+		statements: s,
+		ctx:        ctx,
+		tx:         tx,
+	}
+}
+
+func (s *expiringMediaTableWithContext) stmt(stmt *sql.Stmt) *sql.Stmt {
+	if s.tx != nil {
+		return s.tx.StmtContext(s.ctx, stmt)
+	}
+	return stmt
+}
+
+func (s *expiringMediaTableWithContext) Insert(origin string, mediaId string, userId string, expiresTs int64, roomIds []string) error {
+	_, err := s.stmt(s.statements.insertExpiringMedia).ExecContext(s.ctx, origin, mediaId, userId, expiresTs, pq.Array(roomIds), util.NowMillis())
 	return err
 }
 
 func (s *expiringMediaTableWithContext) ByUserCount(userId string) (int64, error) {
-	row := s.statements.selectExpiringMediaByUserCount.QueryRowContext(s.ctx, userId, util.NowMillis())
+	row := s.stmt(s.statements.selectExpiringMediaByUserCount).QueryRowContext(s.ctx, userId, util.NowMillis())
 	val := int64(0)
 	err := row.Scan(&val)
 	if errors.Is(err, sql.ErrNoRows) {
@@ -82,9 +112,9 @@ func (s *expiringMediaTableWithContext) ByUserCount(userId string) (int64, error
 }
 
 func (s *expiringMediaTableWithContext) Get(origin string, mediaId string) (*DbExpiringMedia, error) {
-	row := s.statements.selectExpiringMediaById.QueryRowContext(s.ctx, origin, mediaId)
+	row := s.stmt(s.statements.selectExpiringMediaById).QueryRowContext(s.ctx, origin, mediaId)
 	val := &DbExpiringMedia{}
-	err := row.Scan(&val.Origin, &val.MediaId, &val.UserId, &val.ExpiresTs)
+	err := row.Scan(&val.Origin, &val.MediaId, &val.UserId, &val.ExpiresTs, pq.Array(&val.RoomIds), &val.CreatedTs)
 	if errors.Is(err, sql.ErrNoRows) {
 		err = nil
 		val = nil
@@ -93,6 +123,43 @@ func (s *expiringMediaTableWithContext) Get(origin string, mediaId string) (*DbE
 }
 
 func (s *expiringMediaTableWithContext) Delete(origin string, mediaId string) error {
-	_, err := s.statements.deleteExpiringMediaById.ExecContext(s.ctx, origin, mediaId)
+	_, err := s.stmt(s.statements.deleteExpiringMediaById).ExecContext(s.ctx, origin, mediaId)
 	return err
 }
+
+// CountPendingByOrigin returns the number of unexpired records which have not been uploaded yet, keyed by origin.
+func (s *expiringMediaTableWithContext) CountPendingByOrigin() (map[string]int64, error) {
+	rows, err := s.stmt(s.statements.selectPendingCountByOrigin).QueryContext(s.ctx, util.NowMillis())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	results := make(map[string]int64)
+	for rows.Next() {
+		origin := ""
+		count := int64(0)
+		if err = rows.Scan(&origin, &count); err != nil {
+			return nil, err
+		}
+		results[origin] = count
+	}
+	return results, rows.Err()
+}
+
+// DeleteExpired removes the records which expired before being uploaded. Returns the number removed, keyed by origin.
+func (s *expiringMediaTableWithContext) DeleteExpired() (map[string]int64, error) {
+	rows, err := s.stmt(s.statements.deleteExpired).QueryContext(s.ctx, util.NowMillis())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	results := make(map[string]int64)
+	for rows.Next() {
+		origin := ""
+		if err = rows.Scan(&origin); err != nil {
+			return nil, err
+		}
+		results[origin]++
+	}
+	return results, rows.Err()
+}
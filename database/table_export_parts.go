@@ -16,10 +16,10 @@ type DbExportPart struct {
 	Location    string
 }
 
-const insertExportPart = "INSERT INTO export_parts (export_id, index, size_bytes, file_name, datastore_id, location) VALUES ($1, $2, $3, $4, $5, $6);"
+const insertExportPart = "INSERT INTO export_parts (export_id, \"index\", size_bytes, file_name, datastore_id, location) VALUES ($1, $2, $3, $4, $5, $6);"
 const deleteExportPartsById = "DELETE FROM export_parts WHERE export_id = $1;"
-const selectExportPartsById = "SELECT export_id, index, size_bytes, file_name, datastore_id, location FROM export_parts WHERE export_id = $1;"
-const selectExportPartById = "SELECT export_id, index, size_bytes, file_name, datastore_id, location FROM export_parts WHERE export_id = $1 AND index = $2;"
+const selectExportPartsById = "SELECT export_id, \"index\", size_bytes, file_name, datastore_id, location FROM export_parts WHERE export_id = $1;"
+const selectExportPartById = "SELECT export_id, \"index\", size_bytes, file_name, datastore_id, location FROM export_parts WHERE export_id = $1 AND \"index\" = $2;"
 
 type exportPartsTableStatements struct {
 	insertExportPart      *sql.Stmt
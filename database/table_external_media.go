@@ -0,0 +1,101 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/lib/pq"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+)
+
+type DbExternalMedia struct {
+	Origin      string
+	MediaId     string
+	UserId      string
+	Url         string
+	ContentType string
+	UploadName  string
+	RoomIds     []string
+	CreationTs  int64
+}
+
+const insertExternalMedia = "INSERT INTO external_media (origin, media_id, user_id, url, content_type, upload_name, room_ids, creation_ts) VALUES ($1, $2, $3, $4, $5, $6, $7, $8);"
+const selectExternalMediaById = "SELECT origin, media_id, user_id, url, content_type, upload_name, room_ids, creation_ts FROM external_media WHERE origin = $1 AND media_id = $2;"
+const deleteExternalMediaById = "DELETE FROM external_media WHERE origin = $1 AND media_id = $2;"
+
+type externalMediaTableStatements struct {
+	insertExternalMedia     *sql.Stmt
+	selectExternalMediaById *sql.Stmt
+	deleteExternalMediaById *sql.Stmt
+}
+
+type externalMediaTableWithContext struct {
+	statements *externalMediaTableStatements
+	ctx        rcontext.RequestContext
+	tx         *sql.Tx
+}
+
+func prepareExternalMediaTables(db *sql.DB) (*externalMediaTableStatements, error) {
+	var err error
+	var stmts = &externalMediaTableStatements{}
+
+	if stmts.insertExternalMedia, err = db.Prepare(insertExternalMedia); err != nil {
+		return nil, errors.New("error preparing insertExternalMedia: " + err.Error())
+	}
+	if stmts.selectExternalMediaById, err = db.Prepare(selectExternalMediaById); err != nil {
+		return nil, errors.New("error preparing selectExternalMediaById: " + err.Error())
+	}
+	if stmts.deleteExternalMediaById, err = db.Prepare(deleteExternalMediaById); err != nil {
+		return nil, errors.New("error preparing deleteExternalMediaById: " + err.Error())
+	}
+
+	return stmts, nil
+}
+
+func (s *externalMediaTableStatements) Prepare(ctx rcontext.RequestContext) *externalMediaTableWithContext {
+	return &externalMediaTableWithContext{
+		statements: s,
+		ctx:        ctx,
+	}
+}
+
+// PrepareTx is like Prepare, but runs all statements within the given transaction.
+func (s *externalMediaTableStatements) PrepareTx(ctx rcontext.RequestContext, tx *sql.Tx) *externalMediaTableWithContext {
+	return &externalMediaTableWithContext{
+		statements: s,
+		ctx:        ctx,
+		tx:         tx,
+	}
+}
+
+func (s *externalMediaTableWithContext) stmt(stmt *sql.Stmt) *sql.Stmt {
+	if s.tx != nil {
+		return s.tx.StmtContext(s.ctx, stmt)
+	}
+	return stmt
+}
+
+func (s *externalMediaTableWithContext) Insert(record *DbExternalMedia) error {
+	roomIds := record.RoomIds
+	if roomIds == nil {
+		roomIds = make([]string, 0)
+	}
+	_, err := s.stmt(s.statements.insertExternalMedia).ExecContext(s.ctx, record.Origin, record.MediaId, record.UserId, record.Url, record.ContentType, record.UploadName, pq.Array(roomIds), record.CreationTs)
+	return err
+}
+
+func (s *externalMediaTableWithContext) Get(origin string, mediaId string) (*DbExternalMedia, error) {
+	row := s.stmt(s.statements.selectExternalMediaById).QueryRowContext(s.ctx, origin, mediaId)
+	val := &DbExternalMedia{}
+	err := row.Scan(&val.Origin, &val.MediaId, &val.UserId, &val.Url, &val.ContentType, &val.UploadName, pq.Array(&val.RoomIds), &val.CreationTs)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = nil
+		val = nil
+	}
+	return val, err
+}
+
+func (s *externalMediaTableWithContext) Delete(origin string, mediaId string) error {
+	_, err := s.stmt(s.statements.deleteExternalMediaById).ExecContext(s.ctx, origin, mediaId)
+	return err
+}
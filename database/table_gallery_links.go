@@ -0,0 +1,94 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+)
+
+type DbGalleryLink struct {
+	TokenId    string
+	RoomId     string
+	IssuedBy   string
+	CreationTs int64
+	ExpiresTs  int64
+}
+
+const insertGalleryLink = "INSERT INTO gallery_links (token_id, room_id, issued_by, creation_ts, expires_ts) VALUES ($1, $2, $3, $4, $5);"
+const selectGalleryLinkById = "SELECT token_id, room_id, issued_by, creation_ts, expires_ts FROM gallery_links WHERE token_id = $1;"
+const deleteGalleryLink = "DELETE FROM gallery_links WHERE token_id = $1 AND room_id = $2;"
+const deleteExpiredGalleryLinks = "DELETE FROM gallery_links WHERE expires_ts <= $1;"
+
+type galleryLinksTableStatements struct {
+	insertGalleryLink         *sql.Stmt
+	selectGalleryLinkById     *sql.Stmt
+	deleteGalleryLink         *sql.Stmt
+	deleteExpiredGalleryLinks *sql.Stmt
+}
+
+type galleryLinksTableWithContext struct {
+	statements *galleryLinksTableStatements
+	ctx        rcontext.RequestContext
+}
+
+func prepareGalleryLinksTables(db *sql.DB) (*galleryLinksTableStatements, error) {
+	var err error
+	var stmts = &galleryLinksTableStatements{}
+
+	if stmts.insertGalleryLink, err = db.Prepare(insertGalleryLink); err != nil {
+		return nil, errors.New("error preparing insertGalleryLink: " + err.Error())
+	}
+	if stmts.selectGalleryLinkById, err = db.Prepare(selectGalleryLinkById); err != nil {
+		return nil, errors.New("error preparing selectGalleryLinkById: " + err.Error())
+	}
+	if stmts.deleteGalleryLink, err = db.Prepare(deleteGalleryLink); err != nil {
+		return nil, errors.New("error preparing deleteGalleryLink: " + err.Error())
+	}
+	if stmts.deleteExpiredGalleryLinks, err = db.Prepare(deleteExpiredGalleryLinks); err != nil {
+		return nil, errors.New("error preparing deleteExpiredGalleryLinks: " + err.Error())
+	}
+
+	return stmts, nil
+}
+
+func (s *galleryLinksTableStatements) Prepare(ctx rcontext.RequestContext) *galleryLinksTableWithContext {
+	return &galleryLinksTableWithContext{
+		statements: s,
+		ctx:        ctx,
+	}
+}
+
+func (s *galleryLinksTableWithContext) Insert(record *DbGalleryLink) error {
+	_, err := s.statements.insertGalleryLink.ExecContext(s.ctx, record.TokenId, record.RoomId, record.IssuedBy, record.CreationTs, record.ExpiresTs)
+	return err
+}
+
+func (s *galleryLinksTableWithContext) Get(tokenId string) (*DbGalleryLink, error) {
+	row := s.statements.selectGalleryLinkById.QueryRowContext(s.ctx, tokenId)
+	val := &DbGalleryLink{}
+	err := row.Scan(&val.TokenId, &val.RoomId, &val.IssuedBy, &val.CreationTs, &val.ExpiresTs)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = nil
+		val = nil
+	}
+	return val, err
+}
+
+// Delete removes the gallery link for the room, returning false if there was no such link.
+func (s *galleryLinksTableWithContext) Delete(tokenId string, roomId string) (bool, error) {
+	res, err := s.statements.deleteGalleryLink.ExecContext(s.ctx, tokenId, roomId)
+	if err != nil {
+		return false, err
+	}
+	count, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+func (s *galleryLinksTableWithContext) DeleteExpired(beforeTs int64) error {
+	_, err := s.statements.deleteExpiredGalleryLinks.ExecContext(s.ctx, beforeTs)
+	return err
+}
@@ -0,0 +1,131 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+type DbIdempotencyKey struct {
+	UserId    string
+	Key       string
+	Origin    string
+	MediaId   string
+	ExpiresTs int64
+}
+
+const reserveIdempotencyKey = "INSERT INTO upload_idempotency_keys (user_id, idempotency_key, origin, media_id, expires_ts) VALUES ($1, $2, '', '', $3) ON CONFLICT (user_id, idempotency_key) DO UPDATE SET origin = '', media_id = '', expires_ts = $3 WHERE upload_idempotency_keys.expires_ts < $4;"
+const renewPendingIdempotencyKey = "UPDATE upload_idempotency_keys SET expires_ts = $3 WHERE user_id = $1 AND idempotency_key = $2 AND media_id = '';"
+const updateIdempotencyKey = "UPDATE upload_idempotency_keys SET origin = $3, media_id = $4, expires_ts = $5 WHERE user_id = $1 AND idempotency_key = $2;"
+const deletePendingIdempotencyKey = "DELETE FROM upload_idempotency_keys WHERE user_id = $1 AND idempotency_key = $2 AND media_id = '';"
+const deleteIdempotencyKey = "DELETE FROM upload_idempotency_keys WHERE user_id = $1 AND idempotency_key = $2;"
+const selectIdempotencyKey = "SELECT user_id, idempotency_key, origin, media_id, expires_ts FROM upload_idempotency_keys WHERE user_id = $1 AND idempotency_key = $2 AND expires_ts >= $3;"
+const deleteExpiredIdempotencyKeys = "DELETE FROM upload_idempotency_keys WHERE expires_ts < $1;"
+
+type idempotencyKeysTableStatements struct {
+	reserveIdempotencyKey        *sql.Stmt
+	renewPendingIdempotencyKey   *sql.Stmt
+	updateIdempotencyKey         *sql.Stmt
+	deletePendingIdempotencyKey  *sql.Stmt
+	deleteIdempotencyKey         *sql.Stmt
+	selectIdempotencyKey         *sql.Stmt
+	deleteExpiredIdempotencyKeys *sql.Stmt
+}
+
+type idempotencyKeysTableWithContext struct {
+	statements *idempotencyKeysTableStatements
+	ctx        rcontext.RequestContext
+}
+
+func prepareIdempotencyKeysTables(db *sql.DB) (*idempotencyKeysTableStatements, error) {
+	var err error
+	var stmts = &idempotencyKeysTableStatements{}
+
+	if stmts.reserveIdempotencyKey, err = db.Prepare(reserveIdempotencyKey); err != nil {
+		return nil, errors.New("error preparing reserveIdempotencyKey: " + err.Error())
+	}
+	if stmts.renewPendingIdempotencyKey, err = db.Prepare(renewPendingIdempotencyKey); err != nil {
+		return nil, errors.New("error preparing renewPendingIdempotencyKey: " + err.Error())
+	}
+	if stmts.updateIdempotencyKey, err = db.Prepare(updateIdempotencyKey); err != nil {
+		return nil, errors.New("error preparing updateIdempotencyKey: " + err.Error())
+	}
+	if stmts.deletePendingIdempotencyKey, err = db.Prepare(deletePendingIdempotencyKey); err != nil {
+		return nil, errors.New("error preparing deletePendingIdempotencyKey: " + err.Error())
+	}
+	if stmts.deleteIdempotencyKey, err = db.Prepare(deleteIdempotencyKey); err != nil {
+		return nil, errors.New("error preparing deleteIdempotencyKey: " + err.Error())
+	}
+	if stmts.selectIdempotencyKey, err = db.Prepare(selectIdempotencyKey); err != nil {
+		return nil, errors.New("error preparing selectIdempotencyKey: " + err.Error())
+	}
+	if stmts.deleteExpiredIdempotencyKeys, err = db.Prepare(deleteExpiredIdempotencyKeys); err != nil {
+		return nil, errors.New("error preparing deleteExpiredIdempotencyKeys: " + err.Error())
+	}
+
+	return stmts, nil
+}
+
+func (s *idempotencyKeysTableStatements) Prepare(ctx rcontext.RequestContext) *idempotencyKeysTableWithContext {
+	return &idempotencyKeysTableWithContext{
+		statements: s,
+		ctx:        ctx,
+	}
+}
+
+// Reserve claims the key for an upload which hasn't finished yet, taking it over if the existing record has expired.
+// Returns false if another unexpired record holds the key.
+func (s *idempotencyKeysTableWithContext) Reserve(userId string, key string, expiresTs int64) (bool, error) {
+	res, err := s.statements.reserveIdempotencyKey.ExecContext(s.ctx, userId, key, expiresTs, util.NowMillis())
+	if err != nil {
+		return false, err
+	}
+	count, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// RenewPending extends the reservation of a key whose upload is still running. Keys which already point at media are
+// left alone.
+func (s *idempotencyKeysTableWithContext) RenewPending(userId string, key string, expiresTs int64) error {
+	_, err := s.statements.renewPendingIdempotencyKey.ExecContext(s.ctx, userId, key, expiresTs)
+	return err
+}
+
+// Update points a reserved key at the uploaded media.
+func (s *idempotencyKeysTableWithContext) Update(record *DbIdempotencyKey) error {
+	_, err := s.statements.updateIdempotencyKey.ExecContext(s.ctx, record.UserId, record.Key, record.Origin, record.MediaId, record.ExpiresTs)
+	return err
+}
+
+// DeletePending releases a reserved key whose upload failed. Keys which already point at media are left alone.
+func (s *idempotencyKeysTableWithContext) DeletePending(userId string, key string) error {
+	_, err := s.statements.deletePendingIdempotencyKey.ExecContext(s.ctx, userId, key)
+	return err
+}
+
+func (s *idempotencyKeysTableWithContext) Delete(userId string, key string) error {
+	_, err := s.statements.deleteIdempotencyKey.ExecContext(s.ctx, userId, key)
+	return err
+}
+
+// Get returns the unexpired record for the key, or nil if there isn't one.
+func (s *idempotencyKeysTableWithContext) Get(userId string, key string) (*DbIdempotencyKey, error) {
+	row := s.statements.selectIdempotencyKey.QueryRowContext(s.ctx, userId, key, util.NowMillis())
+	val := &DbIdempotencyKey{}
+	err := row.Scan(&val.UserId, &val.Key, &val.Origin, &val.MediaId, &val.ExpiresTs)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = nil
+		val = nil
+	}
+	return val, err
+}
+
+func (s *idempotencyKeysTableWithContext) DeleteExpired() error {
+	_, err := s.statements.deleteExpiredIdempotencyKeys.ExecContext(s.ctx, util.NowMillis())
+	return err
+}
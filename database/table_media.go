@@ -5,7 +5,9 @@ import (
 	"errors"
 
 	"github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/metrics"
 )
 
 type Locatable struct {
@@ -25,57 +27,77 @@ type DbMedia struct {
 	SizeBytes   int64
 	CreationTs  int64
 	Quarantined bool
+	// OriginalUploadName is the filename as supplied by the client, if it had to be sanitized into UploadName
+	OriginalUploadName string
 	//DatastoreId string
 	//Location    string
 }
 
 const selectDistinctMediaDatastoreIds = "SELECT DISTINCT datastore_id FROM media;"
 const selectMediaIsQuarantinedByHash = "SELECT quarantined FROM media WHERE quarantined = TRUE AND sha256_hash = $1;"
-const selectMediaByHash = "SELECT origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, creation_ts, quarantined, datastore_id, location FROM media WHERE sha256_hash = $1;"
-const insertMedia = "INSERT INTO media (origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, creation_ts, quarantined, datastore_id, location) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11);"
+const selectMediaByHash = "SELECT origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, creation_ts, quarantined, datastore_id, location, original_upload_name FROM media WHERE sha256_hash = $1;"
+const insertMedia = "INSERT INTO media (origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, creation_ts, quarantined, datastore_id, location, original_upload_name) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12);"
 const selectMediaExists = "SELECT TRUE FROM media WHERE origin = $1 AND media_id = $2 LIMIT 1;"
-const selectMediaById = "SELECT origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, creation_ts, quarantined, datastore_id, location FROM media WHERE origin = $1 AND media_id = $2;"
-const selectMediaByUserId = "SELECT origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, creation_ts, quarantined, datastore_id, location FROM media WHERE user_id = $1;"
-const selectOldMediaByUserId = "SELECT origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, creation_ts, quarantined, datastore_id, location FROM media WHERE user_id = $1 AND creation_ts < $2;"
-const selectMediaByOrigin = "SELECT origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, creation_ts, quarantined, datastore_id, location FROM media WHERE origin = $1;"
-const selectOldMediaByOrigin = "SELECT origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, creation_ts, quarantined, datastore_id, location FROM media WHERE origin = $1 AND creation_ts < $2;"
+const selectMediaById = "SELECT origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, creation_ts, quarantined, datastore_id, location, original_upload_name FROM media WHERE origin = $1 AND media_id = $2;"
+const selectMediaByUserId = "SELECT origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, creation_ts, quarantined, datastore_id, location, original_upload_name FROM media WHERE user_id = $1;"
+const selectMediaByUserIdPattern = "SELECT origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, creation_ts, quarantined, datastore_id, location, original_upload_name FROM media WHERE user_id LIKE $1;"
+const selectOldMediaByUserId = "SELECT origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, creation_ts, quarantined, datastore_id, location, original_upload_name FROM media WHERE user_id = $1 AND creation_ts < $2;"
+const selectMediaByOrigin = "SELECT origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, creation_ts, quarantined, datastore_id, location, original_upload_name FROM media WHERE origin = $1;"
+const selectOldMediaByOrigin = "SELECT origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, creation_ts, quarantined, datastore_id, location, original_upload_name FROM media WHERE origin = $1 AND creation_ts < $2;"
+const selectMediaByOriginLeastRecentlyAccessed = "SELECT m.origin, m.media_id, m.upload_name, m.content_type, m.user_id, m.sha256_hash, m.size_bytes, m.creation_ts, m.quarantined, m.datastore_id, m.location, m.original_upload_name FROM media AS m LEFT JOIN last_access AS a ON a.sha256_hash = m.sha256_hash WHERE m.origin = $1 AND m.quarantined = FALSE ORDER BY COALESCE(a.last_access_ts, m.creation_ts) ASC;"
+const selectRemoteMediaNotAccessedSince = "SELECT m.origin, m.media_id, m.upload_name, m.content_type, m.user_id, m.sha256_hash, m.size_bytes, m.creation_ts, m.quarantined, m.datastore_id, m.location, m.original_upload_name FROM media AS m LEFT JOIN last_access AS a ON a.sha256_hash = m.sha256_hash WHERE NOT (m.origin = ANY($1)) AND m.quarantined = FALSE AND COALESCE(a.last_access_ts, m.creation_ts) < $2;"
+const selectRemoteMediaByDatastoreLeastRecentlyAccessed = "SELECT m.origin, m.media_id, m.upload_name, m.content_type, m.user_id, m.sha256_hash, m.size_bytes, m.creation_ts, m.quarantined, m.datastore_id, m.location, m.original_upload_name FROM media AS m LEFT JOIN last_access AS a ON a.sha256_hash = m.sha256_hash WHERE m.datastore_id = $1 AND NOT (m.origin = ANY($2)) AND m.quarantined = FALSE ORDER BY COALESCE(a.last_access_ts, m.creation_ts) ASC LIMIT $3;"
 const selectMediaByLocationExists = "SELECT TRUE FROM media WHERE datastore_id = $1 AND location = $2 LIMIT 1;"
 const selectMediaByUserCount = "SELECT COUNT(*) FROM media WHERE user_id = $1;"
-const selectMediaByOriginAndUserIds = "SELECT origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, creation_ts, quarantined, datastore_id, location FROM media WHERE origin = $1 AND user_id = ANY($2);"
-const selectMediaByOriginAndIds = "SELECT origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, creation_ts, quarantined, datastore_id, location FROM media WHERE origin = $1 AND media_id = ANY($2);"
-const selectOldMediaExcludingDomains = "SELECT m.origin, m.media_id, m.upload_name, m.content_type, m.user_id, m.sha256_hash, m.size_bytes, m.creation_ts, m.quarantined, m.datastore_id, m.location FROM media AS m WHERE (m.origin <> ANY($1) OR CARDINALITY($1) = 0) AND m.creation_ts < $2 AND (SELECT COUNT(d.*) FROM media AS d WHERE d.sha256_hash = m.sha256_hash AND d.creation_ts >= $2) = 0 AND (SELECT COUNT(d.*) FROM media AS d WHERE d.sha256_hash = m.sha256_hash AND d.origin = ANY($1)) = 0;"
+const selectMediaByOriginAndUserIds = "SELECT origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, creation_ts, quarantined, datastore_id, location, original_upload_name FROM media WHERE origin = $1 AND user_id = ANY($2);"
+const selectMediaByOriginAndIds = "SELECT origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, creation_ts, quarantined, datastore_id, location, original_upload_name FROM media WHERE origin = $1 AND media_id = ANY($2);"
+const selectOldMediaExcludingDomains = "SELECT m.origin, m.media_id, m.upload_name, m.content_type, m.user_id, m.sha256_hash, m.size_bytes, m.creation_ts, m.quarantined, m.datastore_id, m.location, m.original_upload_name FROM media AS m WHERE (m.origin <> ANY($1) OR CARDINALITY($1) = 0) AND m.creation_ts < $2 AND (SELECT COUNT(d.*) FROM media AS d WHERE d.sha256_hash = m.sha256_hash AND d.creation_ts >= $2) = 0 AND (SELECT COUNT(d.*) FROM media AS d WHERE d.sha256_hash = m.sha256_hash AND d.origin = ANY($1)) = 0;"
 const deleteMedia = "DELETE FROM media WHERE origin = $1 AND media_id = $2;"
 const updateMediaLocation = "UPDATE media SET datastore_id = $3, location = $4 WHERE datastore_id = $1 AND location = $2;"
-const selectMediaByLocation = "SELECT origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, creation_ts, quarantined, datastore_id, location FROM media WHERE datastore_id = $1 AND location = $2;"
-const selectMediaByQuarantine = "SELECT origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, creation_ts, quarantined, datastore_id, location FROM media WHERE quarantined = TRUE;"
-const selectMediaByQuarantineAndOrigin = "SELECT origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, creation_ts, quarantined, datastore_id, location FROM media WHERE quarantined = TRUE AND origin = $1;"
+const selectMediaByLocation = "SELECT origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, creation_ts, quarantined, datastore_id, location, original_upload_name FROM media WHERE datastore_id = $1 AND location = $2;"
+const selectMediaByQuarantine = "SELECT origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, creation_ts, quarantined, datastore_id, location, original_upload_name FROM media WHERE quarantined = TRUE;"
+const selectMediaByQuarantineAndOrigin = "SELECT origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, creation_ts, quarantined, datastore_id, location, original_upload_name FROM media WHERE quarantined = TRUE AND origin = $1;"
+const updateMediaNsfwScore = "UPDATE media SET nsfw_score = $3 WHERE origin = $1 AND media_id = $2;"
+const selectMediaNsfwScore = "SELECT nsfw_score FROM media WHERE origin = $1 AND media_id = $2;"
+const selectMediaForReplication = "SELECT origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, creation_ts, quarantined, datastore_id, location, original_upload_name FROM media WHERE origin = ANY($1) AND (creation_ts, origin, media_id) > ($2, $3, $4) AND creation_ts < $5 ORDER BY creation_ts ASC, origin ASC, media_id ASC LIMIT $6;"
 
 type mediaTableStatements struct {
-	selectDistinctMediaDatastoreIds  *sql.Stmt
-	selectMediaIsQuarantinedByHash   *sql.Stmt
-	selectMediaByHash                *sql.Stmt
-	insertMedia                      *sql.Stmt
-	selectMediaExists                *sql.Stmt
-	selectMediaById                  *sql.Stmt
-	selectMediaByUserId              *sql.Stmt
-	selectOldMediaByUserId           *sql.Stmt
-	selectMediaByOrigin              *sql.Stmt
-	selectOldMediaByOrigin           *sql.Stmt
-	selectMediaByLocationExists      *sql.Stmt
-	selectMediaByUserCount           *sql.Stmt
-	selectMediaByOriginAndUserIds    *sql.Stmt
-	selectMediaByOriginAndIds        *sql.Stmt
-	selectOldMediaExcludingDomains   *sql.Stmt
-	deleteMedia                      *sql.Stmt
-	updateMediaLocation              *sql.Stmt
-	selectMediaByLocation            *sql.Stmt
-	selectMediaByQuarantine          *sql.Stmt
-	selectMediaByQuarantineAndOrigin *sql.Stmt
+	selectDistinctMediaDatastoreIds                   *sql.Stmt
+	selectMediaIsQuarantinedByHash                    *sql.Stmt
+	selectMediaByHash                                 *sql.Stmt
+	insertMedia                                       *sql.Stmt
+	selectMediaExists                                 *sql.Stmt
+	selectMediaById                                   *sql.Stmt
+	selectMediaByUserId                               *sql.Stmt
+	selectMediaByUserIdPattern                        *sql.Stmt
+	selectOldMediaByUserId                            *sql.Stmt
+	selectMediaByOrigin                               *sql.Stmt
+	selectOldMediaByOrigin                            *sql.Stmt
+	selectMediaByLocationExists                       *sql.Stmt
+	selectMediaByUserCount                            *sql.Stmt
+	selectMediaByOriginAndUserIds                     *sql.Stmt
+	selectMediaByOriginAndIds                         *sql.Stmt
+	selectOldMediaExcludingDomains                    *sql.Stmt
+	selectMediaByOriginLeastRecentlyAccessed          *sql.Stmt
+	selectRemoteMediaByDatastoreLeastRecentlyAccessed *sql.Stmt
+	selectRemoteMediaNotAccessedSince                 *sql.Stmt
+	deleteMedia                                       *sql.Stmt
+	updateMediaLocation                               *sql.Stmt
+	selectMediaByLocation                             *sql.Stmt
+	selectMediaByQuarantine                           *sql.Stmt
+	selectMediaByQuarantineAndOrigin                  *sql.Stmt
+	updateMediaNsfwScore                              *sql.Stmt
+	selectMediaNsfwScore                              *sql.Stmt
+	selectMediaForReplication                         *sql.Stmt
+
+	replicas *readReplicas
 }
 
 type MediaTableWithContext struct {
 	statements *mediaTableStatements
 	ctx        rcontext.RequestContext
+	tx         *sql.Tx
+	primary    *mediaTableStatements // set when reading from a replica
 }
 
 func prepareMediaTables(db *sql.DB) (*mediaTableStatements, error) {
@@ -103,6 +125,9 @@ func prepareMediaTables(db *sql.DB) (*mediaTableStatements, error) {
 	if stmts.selectMediaByUserId, err = db.Prepare(selectMediaByUserId); err != nil {
 		return nil, errors.New("error preparing selectMediaByUserId: " + err.Error())
 	}
+	if stmts.selectMediaByUserIdPattern, err = db.Prepare(selectMediaByUserIdPattern); err != nil {
+		return nil, errors.New("error preparing selectMediaByUserIdPattern: " + err.Error())
+	}
 	if stmts.selectOldMediaByUserId, err = db.Prepare(selectOldMediaByUserId); err != nil {
 		return nil, errors.New("error preparing selectOldMediaByUserId: " + err.Error())
 	}
@@ -127,6 +152,15 @@ func prepareMediaTables(db *sql.DB) (*mediaTableStatements, error) {
 	if stmts.selectOldMediaExcludingDomains, err = db.Prepare(selectOldMediaExcludingDomains); err != nil {
 		return nil, errors.New("error preparing selectOldMediaExcludingDomains: " + err.Error())
 	}
+	if stmts.selectMediaByOriginLeastRecentlyAccessed, err = db.Prepare(selectMediaByOriginLeastRecentlyAccessed); err != nil {
+		return nil, errors.New("error preparing selectMediaByOriginLeastRecentlyAccessed: " + err.Error())
+	}
+	if stmts.selectRemoteMediaByDatastoreLeastRecentlyAccessed, err = db.Prepare(selectRemoteMediaByDatastoreLeastRecentlyAccessed); err != nil {
+		return nil, errors.New("error preparing selectRemoteMediaByDatastoreLeastRecentlyAccessed: " + err.Error())
+	}
+	if stmts.selectRemoteMediaNotAccessedSince, err = db.Prepare(selectRemoteMediaNotAccessedSince); err != nil {
+		return nil, errors.New("error preparing selectRemoteMediaNotAccessedSince: " + err.Error())
+	}
 	if stmts.deleteMedia, err = db.Prepare(deleteMedia); err != nil {
 		return nil, errors.New("error preparing deleteMedia: " + err.Error())
 	}
@@ -142,6 +176,15 @@ func prepareMediaTables(db *sql.DB) (*mediaTableStatements, error) {
 	if stmts.selectMediaByQuarantineAndOrigin, err = db.Prepare(selectMediaByQuarantineAndOrigin); err != nil {
 		return nil, errors.New("error preparing selectMediaByQuarantineAndOrigin: " + err.Error())
 	}
+	if stmts.updateMediaNsfwScore, err = db.Prepare(updateMediaNsfwScore); err != nil {
+		return nil, errors.New("error preparing updateMediaNsfwScore: " + err.Error())
+	}
+	if stmts.selectMediaNsfwScore, err = db.Prepare(selectMediaNsfwScore); err != nil {
+		return nil, errors.New("error preparing selectMediaNsfwScore: " + err.Error())
+	}
+	if stmts.selectMediaForReplication, err = db.Prepare(selectMediaForReplication); err != nil {
+		return nil, errors.New("error preparing selectMediaForReplication: " + err.Error())
+	}
 
 	return stmts, nil
 }
@@ -153,9 +196,39 @@ func (s *mediaTableStatements) Prepare(ctx rcontext.RequestContext) *MediaTableW
 	}
 }
 
+// PrepareTx is like Prepare, but runs all statements within the given transaction.
+func (s *mediaTableStatements) PrepareTx(ctx rcontext.RequestContext, tx *sql.Tx) *MediaTableWithContext {
+	return &MediaTableWithContext{
+		statements: s,
+		ctx:        ctx,
+		tx:         tx,
+	}
+}
+
+// PrepareRead is like Prepare, but sends lookups to a database read replica when one is configured and keeping up.
+// Only use the result for reads. Lookups which fail or find nothing on the replica are retried on the primary, as
+// the record may not have been replicated yet.
+func (s *mediaTableStatements) PrepareRead(ctx rcontext.RequestContext) *MediaTableWithContext {
+	if replica := s.replicas.pick(); replica != nil {
+		return &MediaTableWithContext{
+			statements: replica.media,
+			ctx:        ctx,
+			primary:    s,
+		}
+	}
+	return s.Prepare(ctx)
+}
+
+func (s *MediaTableWithContext) stmt(stmt *sql.Stmt) *sql.Stmt {
+	if s.tx != nil {
+		return s.tx.StmtContext(s.ctx, stmt)
+	}
+	return stmt
+}
+
 func (s *MediaTableWithContext) GetDistinctDatastoreIds() ([]string, error) {
 	results := make([]string, 0)
-	rows, err := s.statements.selectDistinctMediaDatastoreIds.QueryContext(s.ctx)
+	rows, err := s.stmt(s.statements.selectDistinctMediaDatastoreIds).QueryContext(s.ctx)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return results, nil
@@ -176,7 +249,7 @@ func (s *MediaTableWithContext) GetDistinctDatastoreIds() ([]string, error) {
 
 func (s *MediaTableWithContext) IsHashQuarantined(sha256hash string) (bool, error) {
 	// TODO: https://github.com/t2bot/matrix-media-repo/issues/410
-	row := s.statements.selectMediaIsQuarantinedByHash.QueryRowContext(s.ctx, sha256hash)
+	row := s.stmt(s.statements.selectMediaIsQuarantinedByHash).QueryRowContext(s.ctx, sha256hash)
 	val := false
 	err := row.Scan(&val)
 	if errors.Is(err, sql.ErrNoRows) {
@@ -196,7 +269,7 @@ func (s *MediaTableWithContext) scanRows(rows *sql.Rows, err error) ([]*DbMedia,
 	}
 	for rows.Next() {
 		val := &DbMedia{Locatable: &Locatable{}}
-		if err = rows.Scan(&val.Origin, &val.MediaId, &val.UploadName, &val.ContentType, &val.UserId, &val.Sha256Hash, &val.SizeBytes, &val.CreationTs, &val.Quarantined, &val.DatastoreId, &val.Location); err != nil {
+		if err = rows.Scan(&val.Origin, &val.MediaId, &val.UploadName, &val.ContentType, &val.UserId, &val.Sha256Hash, &val.SizeBytes, &val.CreationTs, &val.Quarantined, &val.DatastoreId, &val.Location, &val.OriginalUploadName); err != nil {
 			return nil, err
 		}
 		results = append(results, val)
@@ -206,62 +279,95 @@ func (s *MediaTableWithContext) scanRows(rows *sql.Rows, err error) ([]*DbMedia,
 }
 
 func (s *MediaTableWithContext) GetByHash(sha256hash string) ([]*DbMedia, error) {
-	return s.scanRows(s.statements.selectMediaByHash.QueryContext(s.ctx, sha256hash))
+	return s.scanRows(s.stmt(s.statements.selectMediaByHash).QueryContext(s.ctx, sha256hash))
 }
 
 func (s *MediaTableWithContext) GetByUserId(userId string) ([]*DbMedia, error) {
-	return s.scanRows(s.statements.selectMediaByUserId.QueryContext(s.ctx, userId))
+	return s.scanRows(s.stmt(s.statements.selectMediaByUserId).QueryContext(s.ctx, userId))
+}
+
+// GetByUserIdPattern returns media uploaded by users matching the SQL LIKE pattern.
+func (s *MediaTableWithContext) GetByUserIdPattern(pattern string) ([]*DbMedia, error) {
+	return s.scanRows(s.stmt(s.statements.selectMediaByUserIdPattern).QueryContext(s.ctx, pattern))
 }
 
 func (s *MediaTableWithContext) GetOldByUserId(userId string, beforeTs int64) ([]*DbMedia, error) {
-	return s.scanRows(s.statements.selectOldMediaByUserId.QueryContext(s.ctx, userId, beforeTs))
+	return s.scanRows(s.stmt(s.statements.selectOldMediaByUserId).QueryContext(s.ctx, userId, beforeTs))
 }
 
 func (s *MediaTableWithContext) GetByOrigin(origin string) ([]*DbMedia, error) {
-	return s.scanRows(s.statements.selectMediaByOrigin.QueryContext(s.ctx, origin))
+	return s.scanRows(s.stmt(s.statements.selectMediaByOrigin).QueryContext(s.ctx, origin))
+}
+
+// GetByOriginLeastRecentlyAccessed returns the non-quarantined media for an origin, least recently accessed first.
+// Media which has never been accessed is ordered by its creation time.
+func (s *MediaTableWithContext) GetByOriginLeastRecentlyAccessed(origin string) ([]*DbMedia, error) {
+	return s.scanRows(s.stmt(s.statements.selectMediaByOriginLeastRecentlyAccessed).QueryContext(s.ctx, origin))
+}
+
+// GetRemoteLeastRecentlyAccessed returns up to limit non-quarantined media in the datastore which doesn't belong to
+// localDomains, least recently accessed first.
+func (s *MediaTableWithContext) GetRemoteLeastRecentlyAccessed(datastoreId string, localDomains []string, limit int64) ([]*DbMedia, error) {
+	return s.scanRows(s.stmt(s.statements.selectRemoteMediaByDatastoreLeastRecentlyAccessed).QueryContext(s.ctx, datastoreId, pq.Array(localDomains), limit))
+}
+
+// GetRemoteNotAccessedSince returns the non-quarantined media which doesn't belong to localDomains and hasn't been
+// accessed since accessedBeforeTs. Media which has never been accessed is judged by its creation time.
+func (s *MediaTableWithContext) GetRemoteNotAccessedSince(localDomains []string, accessedBeforeTs int64) ([]*DbMedia, error) {
+	return s.scanRows(s.stmt(s.statements.selectRemoteMediaNotAccessedSince).QueryContext(s.ctx, pq.Array(localDomains), accessedBeforeTs))
 }
 
 func (s *MediaTableWithContext) GetOldByOrigin(origin string, beforeTs int64) ([]*DbMedia, error) {
-	return s.scanRows(s.statements.selectOldMediaByOrigin.QueryContext(s.ctx, origin, beforeTs))
+	return s.scanRows(s.stmt(s.statements.selectOldMediaByOrigin).QueryContext(s.ctx, origin, beforeTs))
 }
 
 func (s *MediaTableWithContext) GetByOriginUsers(origin string, userIds []string) ([]*DbMedia, error) {
-	return s.scanRows(s.statements.selectMediaByOriginAndUserIds.QueryContext(s.ctx, origin, pq.Array(userIds)))
+	return s.scanRows(s.stmt(s.statements.selectMediaByOriginAndUserIds).QueryContext(s.ctx, origin, pq.Array(userIds)))
 }
 
 func (s *MediaTableWithContext) GetByIds(origin string, mediaIds []string) ([]*DbMedia, error) {
-	return s.scanRows(s.statements.selectMediaByOriginAndIds.QueryContext(s.ctx, origin, pq.Array(mediaIds)))
+	return s.scanRows(s.stmt(s.statements.selectMediaByOriginAndIds).QueryContext(s.ctx, origin, pq.Array(mediaIds)))
 }
 
 func (s *MediaTableWithContext) GetOldExcluding(origins []string, beforeTs int64) ([]*DbMedia, error) {
-	return s.scanRows(s.statements.selectOldMediaExcludingDomains.QueryContext(s.ctx, pq.Array(origins), beforeTs))
+	return s.scanRows(s.stmt(s.statements.selectOldMediaExcludingDomains).QueryContext(s.ctx, pq.Array(origins), beforeTs))
+}
+
+// GetForReplication returns up to limit media records from the given origins, in creation order, which come after
+// the record identified by afterTs, afterOrigin, and afterMediaId and were created before beforeTs.
+func (s *MediaTableWithContext) GetForReplication(origins []string, afterTs int64, afterOrigin string, afterMediaId string, beforeTs int64, limit int64) ([]*DbMedia, error) {
+	return s.scanRows(s.stmt(s.statements.selectMediaForReplication).QueryContext(s.ctx, pq.Array(origins), afterTs, afterOrigin, afterMediaId, beforeTs, limit))
 }
 
 func (s *MediaTableWithContext) GetByLocation(datastoreId string, location string) ([]*DbMedia, error) {
-	return s.scanRows(s.statements.selectMediaByLocation.QueryContext(s.ctx, datastoreId, location))
+	return s.scanRows(s.stmt(s.statements.selectMediaByLocation).QueryContext(s.ctx, datastoreId, location))
 }
 
 func (s *MediaTableWithContext) GetByQuarantine() ([]*DbMedia, error) {
-	return s.scanRows(s.statements.selectMediaByQuarantine.QueryContext(s.ctx))
+	return s.scanRows(s.stmt(s.statements.selectMediaByQuarantine).QueryContext(s.ctx))
 }
 
 func (s *MediaTableWithContext) GetByOriginQuarantine(origin string) ([]*DbMedia, error) {
-	return s.scanRows(s.statements.selectMediaByQuarantineAndOrigin.QueryContext(s.ctx, origin))
+	return s.scanRows(s.stmt(s.statements.selectMediaByQuarantineAndOrigin).QueryContext(s.ctx, origin))
 }
 
 func (s *MediaTableWithContext) GetById(origin string, mediaId string) (*DbMedia, error) {
-	row := s.statements.selectMediaById.QueryRowContext(s.ctx, origin, mediaId)
+	row := s.stmt(s.statements.selectMediaById).QueryRowContext(s.ctx, origin, mediaId)
 	val := &DbMedia{Locatable: &Locatable{}}
-	err := row.Scan(&val.Origin, &val.MediaId, &val.UploadName, &val.ContentType, &val.UserId, &val.Sha256Hash, &val.SizeBytes, &val.CreationTs, &val.Quarantined, &val.DatastoreId, &val.Location)
+	err := row.Scan(&val.Origin, &val.MediaId, &val.UploadName, &val.ContentType, &val.UserId, &val.Sha256Hash, &val.SizeBytes, &val.CreationTs, &val.Quarantined, &val.DatastoreId, &val.Location, &val.OriginalUploadName)
 	if errors.Is(err, sql.ErrNoRows) {
 		err = nil
 		val = nil
 	}
+	if s.primary != nil && (err != nil || val == nil) {
+		metrics.DatabaseReplicaFallbacks.With(prometheus.Labels{"table": "media"}).Inc()
+		return s.primary.Prepare(s.ctx).GetById(origin, mediaId)
+	}
 	return val, err
 }
 
 func (s *MediaTableWithContext) ByUserCount(userId string) (int64, error) {
-	row := s.statements.selectMediaByUserCount.QueryRowContext(s.ctx, userId)
+	row := s.stmt(s.statements.selectMediaByUserCount).QueryRowContext(s.ctx, userId)
 	val := int64(0)
 	err := row.Scan(&val)
 	if errors.Is(err, sql.ErrNoRows) {
@@ -272,7 +378,7 @@ func (s *MediaTableWithContext) ByUserCount(userId string) (int64, error) {
 }
 
 func (s *MediaTableWithContext) IdExists(origin string, mediaId string) (bool, error) {
-	row := s.statements.selectMediaExists.QueryRowContext(s.ctx, origin, mediaId)
+	row := s.stmt(s.statements.selectMediaExists).QueryRowContext(s.ctx, origin, mediaId)
 	val := false
 	err := row.Scan(&val)
 	if errors.Is(err, sql.ErrNoRows) {
@@ -283,7 +389,7 @@ func (s *MediaTableWithContext) IdExists(origin string, mediaId string) (bool, e
 }
 
 func (s *MediaTableWithContext) LocationExists(datastoreId string, location string) (bool, error) {
-	row := s.statements.selectMediaByLocationExists.QueryRowContext(s.ctx, datastoreId, location)
+	row := s.stmt(s.statements.selectMediaByLocationExists).QueryRowContext(s.ctx, datastoreId, location)
 	val := false
 	err := row.Scan(&val)
 	if errors.Is(err, sql.ErrNoRows) {
@@ -294,16 +400,36 @@ func (s *MediaTableWithContext) LocationExists(datastoreId string, location stri
 }
 
 func (s *MediaTableWithContext) Insert(record *DbMedia) error {
-	_, err := s.statements.insertMedia.ExecContext(s.ctx, record.Origin, record.MediaId, record.UploadName, record.ContentType, record.UserId, record.Sha256Hash, record.SizeBytes, record.CreationTs, record.Quarantined, record.DatastoreId, record.Location)
+	_, err := s.stmt(s.statements.insertMedia).ExecContext(s.ctx, record.Origin, record.MediaId, record.UploadName, record.ContentType, record.UserId, record.Sha256Hash, record.SizeBytes, record.CreationTs, record.Quarantined, record.DatastoreId, record.Location, record.OriginalUploadName)
 	return err
 }
 
 func (s *MediaTableWithContext) Delete(origin string, mediaId string) error {
-	_, err := s.statements.deleteMedia.ExecContext(s.ctx, origin, mediaId)
+	_, err := s.stmt(s.statements.deleteMedia).ExecContext(s.ctx, origin, mediaId)
 	return err
 }
 
+// SetNsfwScore records the NSFW classifier's score for the media, from 0 (safe) to 1 (explicit).
+func (s *MediaTableWithContext) SetNsfwScore(origin string, mediaId string, score float64) error {
+	_, err := s.stmt(s.statements.updateMediaNsfwScore).ExecContext(s.ctx, origin, mediaId, score)
+	return err
+}
+
+// GetNsfwScore returns the NSFW classifier's score for the media, or nil if it hasn't been classified.
+func (s *MediaTableWithContext) GetNsfwScore(origin string, mediaId string) (*float64, error) {
+	row := s.stmt(s.statements.selectMediaNsfwScore).QueryRowContext(s.ctx, origin, mediaId)
+	val := sql.NullFloat64{}
+	err := row.Scan(&val)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && !val.Valid) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &val.Float64, nil
+}
+
 func (s *MediaTableWithContext) UpdateLocation(sourceDsId string, sourceLocation string, targetDsId string, targetLocation string) error {
-	_, err := s.statements.updateMediaLocation.ExecContext(s.ctx, sourceDsId, sourceLocation, targetDsId, targetLocation)
+	_, err := s.stmt(s.statements.updateMediaLocation).ExecContext(s.ctx, sourceDsId, sourceLocation, targetDsId, targetLocation)
 	return err
 }
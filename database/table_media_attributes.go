@@ -18,10 +18,11 @@ type Purpose string
 const (
 	PurposeNone   Purpose = "none"
 	PurposePinned Purpose = "pinned"
+	PurposeEmoji  Purpose = "emoji"
 )
 
 func IsPurpose(purpose Purpose) bool {
-	return purpose == PurposeNone || purpose == PurposePinned
+	return purpose == PurposeNone || purpose == PurposePinned || purpose == PurposeEmoji
 }
 
 const selectMediaAttributes = "SELECT origin, media_id, purpose FROM media_attributes WHERE origin = $1 AND media_id = $2;"
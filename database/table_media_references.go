@@ -0,0 +1,239 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/lib/pq"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+)
+
+type DbMediaReference struct {
+	Origin     string
+	MediaId    string
+	RoomId     string
+	EventId    string
+	CreationTs int64
+}
+
+const insertMediaReference = "INSERT INTO media_references (origin, media_id, room_id, event_id, creation_ts) VALUES ($1, $2, $3, $4, $5) ON CONFLICT (origin, media_id, room_id, event_id) DO NOTHING;"
+const selectMediaReferencesForMedia = "SELECT origin, media_id, room_id, event_id, creation_ts FROM media_references WHERE origin = $1 AND media_id = $2;"
+const selectMediaReferencesForEvent = "SELECT origin, media_id, room_id, event_id, creation_ts FROM media_references WHERE room_id = $1 AND event_id = $2;"
+const selectMediaReferencesForRoom = "SELECT origin, media_id, room_id, event_id, creation_ts FROM media_references WHERE room_id = $1;"
+const selectDanglingMediaReferences = "SELECT r.origin, r.media_id, r.room_id, r.event_id, r.creation_ts FROM media_references AS r WHERE r.origin = ANY($1) AND NOT EXISTS (SELECT 1 FROM media AS m WHERE m.origin = r.origin AND m.media_id = r.media_id) AND NOT EXISTS (SELECT 1 FROM expiring_media AS e WHERE e.origin = r.origin AND e.media_id = r.media_id);"
+const deleteMediaReferencesForMedia = "DELETE FROM media_references WHERE origin = $1 AND media_id = $2;"
+const selectMediaReferenceStats = "SELECT COUNT(*), COUNT(DISTINCT (origin, media_id)), COUNT(DISTINCT room_id) FROM media_references;"
+const selectReferencedRoomIds = "SELECT DISTINCT room_id FROM media_references;"
+const selectMediaReferenceCount = "SELECT COUNT(*) FROM media_references WHERE origin = $1 AND media_id = $2;"
+const deleteMediaReferencesForEvent = "DELETE FROM media_references WHERE room_id = $1 AND event_id = $2;"
+const deleteMediaReferencesForRoom = "DELETE FROM media_references WHERE origin = $1 AND media_id = $2 AND room_id = $3;"
+const deleteAllMediaReferencesForRoom = "DELETE FROM media_references WHERE room_id = $1;"
+const deleteMediaReference = "DELETE FROM media_references WHERE origin = $1 AND media_id = $2 AND room_id = $3 AND event_id = $4;"
+
+type mediaReferencesTableStatements struct {
+	insertMediaReference            *sql.Stmt
+	selectMediaReferencesForMedia   *sql.Stmt
+	selectMediaReferencesForEvent   *sql.Stmt
+	selectMediaReferencesForRoom    *sql.Stmt
+	selectReferencedRoomIds         *sql.Stmt
+	selectMediaReferenceStats       *sql.Stmt
+	selectDanglingMediaReferences   *sql.Stmt
+	deleteMediaReferencesForMedia   *sql.Stmt
+	selectMediaReferenceCount       *sql.Stmt
+	deleteMediaReferencesForEvent   *sql.Stmt
+	deleteMediaReferencesForRoom    *sql.Stmt
+	deleteAllMediaReferencesForRoom *sql.Stmt
+	deleteMediaReference            *sql.Stmt
+}
+
+type mediaReferencesTableWithContext struct {
+	statements *mediaReferencesTableStatements
+	ctx        rcontext.RequestContext
+	tx         *sql.Tx
+}
+
+func prepareMediaReferencesTables(db *sql.DB) (*mediaReferencesTableStatements, error) {
+	var err error
+	var stmts = &mediaReferencesTableStatements{}
+
+	if stmts.insertMediaReference, err = db.Prepare(insertMediaReference); err != nil {
+		return nil, errors.New("error preparing insertMediaReference: " + err.Error())
+	}
+	if stmts.selectMediaReferencesForMedia, err = db.Prepare(selectMediaReferencesForMedia); err != nil {
+		return nil, errors.New("error preparing selectMediaReferencesForMedia: " + err.Error())
+	}
+	if stmts.selectMediaReferencesForEvent, err = db.Prepare(selectMediaReferencesForEvent); err != nil {
+		return nil, errors.New("error preparing selectMediaReferencesForEvent: " + err.Error())
+	}
+	if stmts.selectMediaReferencesForRoom, err = db.Prepare(selectMediaReferencesForRoom); err != nil {
+		return nil, errors.New("error preparing selectMediaReferencesForRoom: " + err.Error())
+	}
+	if stmts.selectReferencedRoomIds, err = db.Prepare(selectReferencedRoomIds); err != nil {
+		return nil, errors.New("error preparing selectReferencedRoomIds: " + err.Error())
+	}
+	if stmts.selectMediaReferenceStats, err = db.Prepare(selectMediaReferenceStats); err != nil {
+		return nil, errors.New("error preparing selectMediaReferenceStats: " + err.Error())
+	}
+	if stmts.selectDanglingMediaReferences, err = db.Prepare(selectDanglingMediaReferences); err != nil {
+		return nil, errors.New("error preparing selectDanglingMediaReferences: " + err.Error())
+	}
+	if stmts.deleteMediaReferencesForMedia, err = db.Prepare(deleteMediaReferencesForMedia); err != nil {
+		return nil, errors.New("error preparing deleteMediaReferencesForMedia: " + err.Error())
+	}
+	if stmts.selectMediaReferenceCount, err = db.Prepare(selectMediaReferenceCount); err != nil {
+		return nil, errors.New("error preparing selectMediaReferenceCount: " + err.Error())
+	}
+	if stmts.deleteMediaReferencesForEvent, err = db.Prepare(deleteMediaReferencesForEvent); err != nil {
+		return nil, errors.New("error preparing deleteMediaReferencesForEvent: " + err.Error())
+	}
+	if stmts.deleteMediaReferencesForRoom, err = db.Prepare(deleteMediaReferencesForRoom); err != nil {
+		return nil, errors.New("error preparing deleteMediaReferencesForRoom: " + err.Error())
+	}
+	if stmts.deleteAllMediaReferencesForRoom, err = db.Prepare(deleteAllMediaReferencesForRoom); err != nil {
+		return nil, errors.New("error preparing deleteAllMediaReferencesForRoom: " + err.Error())
+	}
+	if stmts.deleteMediaReference, err = db.Prepare(deleteMediaReference); err != nil {
+		return nil, errors.New("error preparing deleteMediaReference: " + err.Error())
+	}
+
+	return stmts, nil
+}
+
+func (s *mediaReferencesTableStatements) Prepare(ctx rcontext.RequestContext) *mediaReferencesTableWithContext {
+	return &mediaReferencesTableWithContext{
+		statements: s,
+		ctx:        ctx,
+	}
+}
+
+// PrepareTx is like Prepare, but runs all statements within the given transaction.
+func (s *mediaReferencesTableStatements) PrepareTx(ctx rcontext.RequestContext, tx *sql.Tx) *mediaReferencesTableWithContext {
+	return &mediaReferencesTableWithContext{
+		statements: s,
+		ctx:        ctx,
+		tx:         tx,
+	}
+}
+
+func (s *mediaReferencesTableWithContext) stmt(stmt *sql.Stmt) *sql.Stmt {
+	if s.tx != nil {
+		return s.tx.StmtContext(s.ctx, stmt)
+	}
+	return stmt
+}
+
+func (s *mediaReferencesTableWithContext) scanRows(rows *sql.Rows, err error) ([]*DbMediaReference, error) {
+	results := make([]*DbMediaReference, 0)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return results, nil
+		}
+		return nil, err
+	}
+	for rows.Next() {
+		val := &DbMediaReference{}
+		if err = rows.Scan(&val.Origin, &val.MediaId, &val.RoomId, &val.EventId, &val.CreationTs); err != nil {
+			return nil, err
+		}
+		results = append(results, val)
+	}
+	return results, nil
+}
+
+func (s *mediaReferencesTableWithContext) Insert(record *DbMediaReference) error {
+	_, err := s.stmt(s.statements.insertMediaReference).ExecContext(s.ctx, record.Origin, record.MediaId, record.RoomId, record.EventId, record.CreationTs)
+	return err
+}
+
+func (s *mediaReferencesTableWithContext) GetForMedia(origin string, mediaId string) ([]*DbMediaReference, error) {
+	return s.scanRows(s.stmt(s.statements.selectMediaReferencesForMedia).QueryContext(s.ctx, origin, mediaId))
+}
+
+func (s *mediaReferencesTableWithContext) GetForEvent(roomId string, eventId string) ([]*DbMediaReference, error) {
+	return s.scanRows(s.stmt(s.statements.selectMediaReferencesForEvent).QueryContext(s.ctx, roomId, eventId))
+}
+
+func (s *mediaReferencesTableWithContext) GetForRoom(roomId string) ([]*DbMediaReference, error) {
+	return s.scanRows(s.stmt(s.statements.selectMediaReferencesForRoom).QueryContext(s.ctx, roomId))
+}
+
+// GetRoomIds returns every room which references at least one piece of media.
+func (s *mediaReferencesTableWithContext) GetRoomIds() ([]string, error) {
+	results := make([]string, 0)
+	rows, err := s.stmt(s.statements.selectReferencedRoomIds).QueryContext(s.ctx)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return results, nil
+		}
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		val := ""
+		if err = rows.Scan(&val); err != nil {
+			return nil, err
+		}
+		results = append(results, val)
+	}
+	return results, nil
+}
+
+// GetStats returns the total number of references, the number of distinct media referenced, and the number of
+// distinct rooms holding references.
+func (s *mediaReferencesTableWithContext) GetStats() (int64, int64, int64, error) {
+	row := s.stmt(s.statements.selectMediaReferenceStats).QueryRowContext(s.ctx)
+	references, media, rooms := int64(0), int64(0), int64(0)
+	err := row.Scan(&references, &media, &rooms)
+	return references, media, rooms, err
+}
+
+// GetDangling returns references to media on the given origins which doesn't exist, and isn't waiting to be
+// uploaded either.
+func (s *mediaReferencesTableWithContext) GetDangling(origins []string) ([]*DbMediaReference, error) {
+	return s.scanRows(s.stmt(s.statements.selectDanglingMediaReferences).QueryContext(s.ctx, pq.Array(origins)))
+}
+
+func (s *mediaReferencesTableWithContext) CountForMedia(origin string, mediaId string) (int64, error) {
+	row := s.stmt(s.statements.selectMediaReferenceCount).QueryRowContext(s.ctx, origin, mediaId)
+	val := int64(0)
+	err := row.Scan(&val)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = nil
+		val = 0
+	}
+	return val, err
+}
+
+func (s *mediaReferencesTableWithContext) DeleteForEvent(roomId string, eventId string) error {
+	_, err := s.stmt(s.statements.deleteMediaReferencesForEvent).ExecContext(s.ctx, roomId, eventId)
+	return err
+}
+
+func (s *mediaReferencesTableWithContext) DeleteForRoom(origin string, mediaId string, roomId string) (int64, error) {
+	c, err := s.stmt(s.statements.deleteMediaReferencesForRoom).ExecContext(s.ctx, origin, mediaId, roomId)
+	if err != nil {
+		return 0, err
+	}
+	return c.RowsAffected()
+}
+
+func (s *mediaReferencesTableWithContext) DeleteAllForMedia(origin string, mediaId string) (int64, error) {
+	c, err := s.stmt(s.statements.deleteMediaReferencesForMedia).ExecContext(s.ctx, origin, mediaId)
+	if err != nil {
+		return 0, err
+	}
+	return c.RowsAffected()
+}
+
+func (s *mediaReferencesTableWithContext) DeleteAllForRoom(roomId string) error {
+	_, err := s.stmt(s.statements.deleteAllMediaReferencesForRoom).ExecContext(s.ctx, roomId)
+	return err
+}
+
+func (s *mediaReferencesTableWithContext) Delete(origin string, mediaId string, roomId string, eventId string) (int64, error) {
+	c, err := s.stmt(s.statements.deleteMediaReference).ExecContext(s.ctx, origin, mediaId, roomId, eventId)
+	if err != nil {
+		return 0, err
+	}
+	return c.RowsAffected()
+}
@@ -0,0 +1,65 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+)
+
+type DbMediaScan struct {
+	Sha256Hash string
+	ScannedTs  int64
+	Infected   bool
+	Signature  string
+}
+
+const upsertMediaScan = "INSERT INTO media_scans (sha256_hash, scanned_ts, infected, signature) VALUES ($1, $2, $3, $4) ON CONFLICT (sha256_hash) DO UPDATE SET scanned_ts = $2, infected = $3, signature = $4;"
+const selectMediaScan = "SELECT sha256_hash, scanned_ts, infected, signature FROM media_scans WHERE sha256_hash = $1;"
+
+type mediaScansTableStatements struct {
+	upsertMediaScan *sql.Stmt
+	selectMediaScan *sql.Stmt
+}
+
+type mediaScansTableWithContext struct {
+	statements *mediaScansTableStatements
+	ctx        rcontext.RequestContext
+}
+
+func prepareMediaScansTables(db *sql.DB) (*mediaScansTableStatements, error) {
+	var err error
+	var stmts = &mediaScansTableStatements{}
+
+	if stmts.upsertMediaScan, err = db.Prepare(upsertMediaScan); err != nil {
+		return nil, errors.New("error preparing upsertMediaScan: " + err.Error())
+	}
+	if stmts.selectMediaScan, err = db.Prepare(selectMediaScan); err != nil {
+		return nil, errors.New("error preparing selectMediaScan: " + err.Error())
+	}
+
+	return stmts, nil
+}
+
+func (s *mediaScansTableStatements) Prepare(ctx rcontext.RequestContext) *mediaScansTableWithContext {
+	return &mediaScansTableWithContext{
+		statements: s,
+		ctx:        ctx,
+	}
+}
+
+func (s *mediaScansTableWithContext) Upsert(record *DbMediaScan) error {
+	_, err := s.statements.upsertMediaScan.ExecContext(s.ctx, record.Sha256Hash, record.ScannedTs, record.Infected, record.Signature)
+	return err
+}
+
+func (s *mediaScansTableWithContext) Get(sha256hash string) (*DbMediaScan, error) {
+	row := s.statements.selectMediaScan.QueryRowContext(s.ctx, sha256hash)
+	val := &DbMediaScan{}
+	err := row.Scan(&val.Sha256Hash, &val.ScannedTs, &val.Infected, &val.Signature)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = nil
+		val = nil
+	}
+	return val, err
+}
@@ -0,0 +1,91 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+)
+
+type DbModerationDecision struct {
+	Id         int64
+	Origin     string
+	MediaId    string
+	Sha256Hash string
+	Policy     string
+	Action     string
+	Reason     string
+	Attempts   int
+	DecidedTs  int64
+}
+
+const insertModerationDecision = "INSERT INTO moderation_decisions (origin, media_id, sha256_hash, policy, action, reason, attempts, decided_ts) VALUES ($1, $2, $3, $4, $5, $6, $7, $8);"
+const selectModerationDecisionsForMedia = "SELECT id, origin, media_id, sha256_hash, policy, action, reason, attempts, decided_ts FROM moderation_decisions WHERE origin = $1 AND media_id = $2 ORDER BY decided_ts ASC;"
+const selectModerationDecisionsSince = "SELECT id, origin, media_id, sha256_hash, policy, action, reason, attempts, decided_ts FROM moderation_decisions WHERE decided_ts >= $1 ORDER BY decided_ts ASC LIMIT $2;"
+
+type moderationDecisionsTableStatements struct {
+	insertModerationDecision          *sql.Stmt
+	selectModerationDecisionsForMedia *sql.Stmt
+	selectModerationDecisionsSince    *sql.Stmt
+}
+
+type moderationDecisionsTableWithContext struct {
+	statements *moderationDecisionsTableStatements
+	ctx        rcontext.RequestContext
+}
+
+func prepareModerationDecisionsTables(db *sql.DB) (*moderationDecisionsTableStatements, error) {
+	var err error
+	var stmts = &moderationDecisionsTableStatements{}
+
+	if stmts.insertModerationDecision, err = db.Prepare(insertModerationDecision); err != nil {
+		return nil, errors.New("error preparing insertModerationDecision: " + err.Error())
+	}
+	if stmts.selectModerationDecisionsForMedia, err = db.Prepare(selectModerationDecisionsForMedia); err != nil {
+		return nil, errors.New("error preparing selectModerationDecisionsForMedia: " + err.Error())
+	}
+	if stmts.selectModerationDecisionsSince, err = db.Prepare(selectModerationDecisionsSince); err != nil {
+		return nil, errors.New("error preparing selectModerationDecisionsSince: " + err.Error())
+	}
+
+	return stmts, nil
+}
+
+func (s *moderationDecisionsTableStatements) Prepare(ctx rcontext.RequestContext) *moderationDecisionsTableWithContext {
+	return &moderationDecisionsTableWithContext{
+		statements: s,
+		ctx:        ctx,
+	}
+}
+
+func (s *moderationDecisionsTableWithContext) scanRows(rows *sql.Rows, err error) ([]*DbModerationDecision, error) {
+	results := make([]*DbModerationDecision, 0)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return results, nil
+		}
+		return nil, err
+	}
+	for rows.Next() {
+		val := &DbModerationDecision{}
+		if err = rows.Scan(&val.Id, &val.Origin, &val.MediaId, &val.Sha256Hash, &val.Policy, &val.Action, &val.Reason, &val.Attempts, &val.DecidedTs); err != nil {
+			return nil, err
+		}
+		results = append(results, val)
+	}
+	return results, nil
+}
+
+func (s *moderationDecisionsTableWithContext) Insert(record *DbModerationDecision) error {
+	_, err := s.statements.insertModerationDecision.ExecContext(s.ctx, record.Origin, record.MediaId, record.Sha256Hash, record.Policy, record.Action, record.Reason, record.Attempts, record.DecidedTs)
+	return err
+}
+
+func (s *moderationDecisionsTableWithContext) GetForMedia(origin string, mediaId string) ([]*DbModerationDecision, error) {
+	return s.scanRows(s.statements.selectModerationDecisionsForMedia.QueryContext(s.ctx, origin, mediaId))
+}
+
+// GetSince returns up to limit decisions made at or after the timestamp, oldest first.
+func (s *moderationDecisionsTableWithContext) GetSince(sinceTs int64, limit int) ([]*DbModerationDecision, error) {
+	return s.scanRows(s.statements.selectModerationDecisionsSince.QueryContext(s.ctx, sinceTs, limit))
+}
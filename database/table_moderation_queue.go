@@ -0,0 +1,109 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+)
+
+type DbModerationQueueItem struct {
+	Origin        string
+	MediaId       string
+	QueuedTs      int64
+	Attempts      int
+	NextAttemptTs int64
+	LastError     string
+}
+
+const insertModerationQueueItem = "INSERT INTO moderation_queue (origin, media_id, queued_ts, attempts, next_attempt_ts, last_error) VALUES ($1, $2, $3, 0, $3, '') ON CONFLICT (origin, media_id) DO NOTHING;"
+const selectDueModerationQueueItems = "SELECT origin, media_id, queued_ts, attempts, next_attempt_ts, last_error FROM moderation_queue WHERE next_attempt_ts <= $1 ORDER BY next_attempt_ts ASC LIMIT $2;"
+const updateModerationQueueItemRetry = "UPDATE moderation_queue SET attempts = $3, next_attempt_ts = $4, last_error = $5 WHERE origin = $1 AND media_id = $2;"
+const deleteModerationQueueItem = "DELETE FROM moderation_queue WHERE origin = $1 AND media_id = $2;"
+const selectModerationQueueCount = "SELECT COUNT(*) FROM moderation_queue;"
+
+type moderationQueueTableStatements struct {
+	insertModerationQueueItem      *sql.Stmt
+	selectDueModerationQueueItems  *sql.Stmt
+	updateModerationQueueItemRetry *sql.Stmt
+	deleteModerationQueueItem      *sql.Stmt
+	selectModerationQueueCount     *sql.Stmt
+}
+
+type moderationQueueTableWithContext struct {
+	statements *moderationQueueTableStatements
+	ctx        rcontext.RequestContext
+}
+
+func prepareModerationQueueTables(db *sql.DB) (*moderationQueueTableStatements, error) {
+	var err error
+	var stmts = &moderationQueueTableStatements{}
+
+	if stmts.insertModerationQueueItem, err = db.Prepare(insertModerationQueueItem); err != nil {
+		return nil, errors.New("error preparing insertModerationQueueItem: " + err.Error())
+	}
+	if stmts.selectDueModerationQueueItems, err = db.Prepare(selectDueModerationQueueItems); err != nil {
+		return nil, errors.New("error preparing selectDueModerationQueueItems: " + err.Error())
+	}
+	if stmts.updateModerationQueueItemRetry, err = db.Prepare(updateModerationQueueItemRetry); err != nil {
+		return nil, errors.New("error preparing updateModerationQueueItemRetry: " + err.Error())
+	}
+	if stmts.deleteModerationQueueItem, err = db.Prepare(deleteModerationQueueItem); err != nil {
+		return nil, errors.New("error preparing deleteModerationQueueItem: " + err.Error())
+	}
+	if stmts.selectModerationQueueCount, err = db.Prepare(selectModerationQueueCount); err != nil {
+		return nil, errors.New("error preparing selectModerationQueueCount: " + err.Error())
+	}
+
+	return stmts, nil
+}
+
+func (s *moderationQueueTableStatements) Prepare(ctx rcontext.RequestContext) *moderationQueueTableWithContext {
+	return &moderationQueueTableWithContext{
+		statements: s,
+		ctx:        ctx,
+	}
+}
+
+// Insert queues the media for moderation. Media which is already queued keeps its place in the queue.
+func (s *moderationQueueTableWithContext) Insert(origin string, mediaId string, queuedTs int64) error {
+	_, err := s.statements.insertModerationQueueItem.ExecContext(s.ctx, origin, mediaId, queuedTs)
+	return err
+}
+
+// GetDue returns up to limit items which are ready to be (re)attempted, oldest first.
+func (s *moderationQueueTableWithContext) GetDue(nowTs int64, limit int) ([]*DbModerationQueueItem, error) {
+	results := make([]*DbModerationQueueItem, 0)
+	rows, err := s.statements.selectDueModerationQueueItems.QueryContext(s.ctx, nowTs, limit)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return results, nil
+		}
+		return nil, err
+	}
+	for rows.Next() {
+		val := &DbModerationQueueItem{}
+		if err = rows.Scan(&val.Origin, &val.MediaId, &val.QueuedTs, &val.Attempts, &val.NextAttemptTs, &val.LastError); err != nil {
+			return nil, err
+		}
+		results = append(results, val)
+	}
+	return results, nil
+}
+
+func (s *moderationQueueTableWithContext) SetRetry(origin string, mediaId string, attempts int, nextAttemptTs int64, lastError string) error {
+	_, err := s.statements.updateModerationQueueItemRetry.ExecContext(s.ctx, origin, mediaId, attempts, nextAttemptTs, lastError)
+	return err
+}
+
+func (s *moderationQueueTableWithContext) Delete(origin string, mediaId string) error {
+	_, err := s.statements.deleteModerationQueueItem.ExecContext(s.ctx, origin, mediaId)
+	return err
+}
+
+func (s *moderationQueueTableWithContext) Count() (int64, error) {
+	row := s.statements.selectModerationQueueCount.QueryRowContext(s.ctx)
+	val := int64(0)
+	err := row.Scan(&val)
+	return val, err
+}
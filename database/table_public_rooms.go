@@ -0,0 +1,116 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+)
+
+type DbPublicRoom struct {
+	RoomId     string
+	SetBy      string
+	CreationTs int64
+}
+
+const insertPublicRoom = "INSERT INTO public_rooms (room_id, set_by, creation_ts) VALUES ($1, $2, $3) ON CONFLICT (room_id) DO NOTHING;"
+const selectPublicRoom = "SELECT room_id, set_by, creation_ts FROM public_rooms WHERE room_id = $1;"
+const selectAllPublicRooms = "SELECT room_id, set_by, creation_ts FROM public_rooms ORDER BY creation_ts;"
+const deletePublicRoom = "DELETE FROM public_rooms WHERE room_id = $1;"
+
+type publicRoomsTableStatements struct {
+	insertPublicRoom     *sql.Stmt
+	selectPublicRoom     *sql.Stmt
+	selectAllPublicRooms *sql.Stmt
+	deletePublicRoom     *sql.Stmt
+}
+
+type publicRoomsTableWithContext struct {
+	statements *publicRoomsTableStatements
+	ctx        rcontext.RequestContext
+	tx         *sql.Tx
+}
+
+func preparePublicRoomsTables(db *sql.DB) (*publicRoomsTableStatements, error) {
+	var err error
+	var stmts = &publicRoomsTableStatements{}
+
+	if stmts.insertPublicRoom, err = db.Prepare(insertPublicRoom); err != nil {
+		return nil, errors.New("error preparing insertPublicRoom: " + err.Error())
+	}
+	if stmts.selectPublicRoom, err = db.Prepare(selectPublicRoom); err != nil {
+		return nil, errors.New("error preparing selectPublicRoom: " + err.Error())
+	}
+	if stmts.selectAllPublicRooms, err = db.Prepare(selectAllPublicRooms); err != nil {
+		return nil, errors.New("error preparing selectAllPublicRooms: " + err.Error())
+	}
+	if stmts.deletePublicRoom, err = db.Prepare(deletePublicRoom); err != nil {
+		return nil, errors.New("error preparing deletePublicRoom: " + err.Error())
+	}
+
+	return stmts, nil
+}
+
+func (s *publicRoomsTableStatements) Prepare(ctx rcontext.RequestContext) *publicRoomsTableWithContext {
+	return &publicRoomsTableWithContext{
+		statements: s,
+		ctx:        ctx,
+	}
+}
+
+// PrepareTx is like Prepare, but runs all statements within the given transaction.
+func (s *publicRoomsTableStatements) PrepareTx(ctx rcontext.RequestContext, tx *sql.Tx) *publicRoomsTableWithContext {
+	return &publicRoomsTableWithContext{
+		statements: s,
+		ctx:        ctx,
+		tx:         tx,
+	}
+}
+
+func (s *publicRoomsTableWithContext) stmt(stmt *sql.Stmt) *sql.Stmt {
+	if s.tx != nil {
+		return s.tx.StmtContext(s.ctx, stmt)
+	}
+	return stmt
+}
+
+// Insert flags the room as public. Rooms which are already public are left unchanged.
+func (s *publicRoomsTableWithContext) Insert(record *DbPublicRoom) error {
+	_, err := s.stmt(s.statements.insertPublicRoom).ExecContext(s.ctx, record.RoomId, record.SetBy, record.CreationTs)
+	return err
+}
+
+// Get returns the room's public flag, or nil if the room has not been flagged as public.
+func (s *publicRoomsTableWithContext) Get(roomId string) (*DbPublicRoom, error) {
+	row := s.stmt(s.statements.selectPublicRoom).QueryRowContext(s.ctx, roomId)
+	val := &DbPublicRoom{}
+	err := row.Scan(&val.RoomId, &val.SetBy, &val.CreationTs)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return val, err
+}
+
+func (s *publicRoomsTableWithContext) GetAll() ([]*DbPublicRoom, error) {
+	results := make([]*DbPublicRoom, 0)
+	rows, err := s.stmt(s.statements.selectAllPublicRooms).QueryContext(s.ctx)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return results, nil
+		}
+		return nil, err
+	}
+	for rows.Next() {
+		val := &DbPublicRoom{}
+		if err = rows.Scan(&val.RoomId, &val.SetBy, &val.CreationTs); err != nil {
+			return nil, err
+		}
+		results = append(results, val)
+	}
+	return results, nil
+}
+
+func (s *publicRoomsTableWithContext) Delete(roomId string) error {
+	_, err := s.stmt(s.statements.deletePublicRoom).ExecContext(s.ctx, roomId)
+	return err
+}
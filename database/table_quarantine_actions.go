@@ -0,0 +1,96 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+)
+
+type DbQuarantineAction struct {
+	Id         int64
+	Origin     string
+	MediaId    string
+	Sha256Hash string
+	Action     string
+	Reason     string
+	Actor      string
+	ActionTs   int64
+}
+
+const insertQuarantineAction = "INSERT INTO quarantine_actions (origin, media_id, sha256_hash, action, reason, actor, action_ts) VALUES ($1, $2, $3, $4, $5, $6, $7);"
+const selectQuarantineActionsForMedia = "SELECT id, origin, media_id, sha256_hash, action, reason, actor, action_ts FROM quarantine_actions WHERE origin = $1 AND media_id = $2 ORDER BY action_ts ASC, id ASC;"
+const selectLatestQuarantineActionForMedia = "SELECT id, origin, media_id, sha256_hash, action, reason, actor, action_ts FROM quarantine_actions WHERE origin = $1 AND media_id = $2 ORDER BY action_ts DESC, id DESC LIMIT 1;"
+
+type quarantineActionsTableStatements struct {
+	insertQuarantineAction               *sql.Stmt
+	selectQuarantineActionsForMedia      *sql.Stmt
+	selectLatestQuarantineActionForMedia *sql.Stmt
+}
+
+type quarantineActionsTableWithContext struct {
+	statements *quarantineActionsTableStatements
+	ctx        rcontext.RequestContext
+}
+
+func prepareQuarantineActionsTables(db *sql.DB) (*quarantineActionsTableStatements, error) {
+	var err error
+	var stmts = &quarantineActionsTableStatements{}
+
+	if stmts.insertQuarantineAction, err = db.Prepare(insertQuarantineAction); err != nil {
+		return nil, errors.New("error preparing insertQuarantineAction: " + err.Error())
+	}
+	if stmts.selectQuarantineActionsForMedia, err = db.Prepare(selectQuarantineActionsForMedia); err != nil {
+		return nil, errors.New("error preparing selectQuarantineActionsForMedia: " + err.Error())
+	}
+	if stmts.selectLatestQuarantineActionForMedia, err = db.Prepare(selectLatestQuarantineActionForMedia); err != nil {
+		return nil, errors.New("error preparing selectLatestQuarantineActionForMedia: " + err.Error())
+	}
+
+	return stmts, nil
+}
+
+func (s *quarantineActionsTableStatements) Prepare(ctx rcontext.RequestContext) *quarantineActionsTableWithContext {
+	return &quarantineActionsTableWithContext{
+		statements: s,
+		ctx:        ctx,
+	}
+}
+
+func (s *quarantineActionsTableWithContext) scanRows(rows *sql.Rows, err error) ([]*DbQuarantineAction, error) {
+	results := make([]*DbQuarantineAction, 0)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return results, nil
+		}
+		return nil, err
+	}
+	for rows.Next() {
+		val := &DbQuarantineAction{}
+		if err = rows.Scan(&val.Id, &val.Origin, &val.MediaId, &val.Sha256Hash, &val.Action, &val.Reason, &val.Actor, &val.ActionTs); err != nil {
+			return nil, err
+		}
+		results = append(results, val)
+	}
+	return results, nil
+}
+
+func (s *quarantineActionsTableWithContext) Insert(record *DbQuarantineAction) error {
+	_, err := s.statements.insertQuarantineAction.ExecContext(s.ctx, record.Origin, record.MediaId, record.Sha256Hash, record.Action, record.Reason, record.Actor, record.ActionTs)
+	return err
+}
+
+func (s *quarantineActionsTableWithContext) GetForMedia(origin string, mediaId string) ([]*DbQuarantineAction, error) {
+	return s.scanRows(s.statements.selectQuarantineActionsForMedia.QueryContext(s.ctx, origin, mediaId))
+}
+
+// GetLatestForMedia returns the most recent action taken on the media, or nil if there isn't one.
+func (s *quarantineActionsTableWithContext) GetLatestForMedia(origin string, mediaId string) (*DbQuarantineAction, error) {
+	row := s.statements.selectLatestQuarantineActionForMedia.QueryRowContext(s.ctx, origin, mediaId)
+	val := &DbQuarantineAction{}
+	err := row.Scan(&val.Id, &val.Origin, &val.MediaId, &val.Sha256Hash, &val.Action, &val.Reason, &val.Actor, &val.ActionTs)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return val, err
+}
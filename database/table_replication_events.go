@@ -0,0 +1,89 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/lib/pq"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+)
+
+// Replication events are written by database triggers, in the same transaction as the change they describe.
+const (
+	ReplicationEventMediaDeleted       = "media_deleted"
+	ReplicationEventMediaQuarantined   = "media_quarantined"
+	ReplicationEventMediaUnquarantined = "media_unquarantined"
+	ReplicationEventReferenceAdded     = "reference_added"
+	ReplicationEventReferenceRemoved   = "reference_removed"
+)
+
+type DbReplicationEvent struct {
+	StreamId   int64
+	EventType  string
+	Origin     string
+	MediaId    string
+	RoomId     string
+	EventId    string
+	CreationTs int64
+}
+
+const selectReplicationEvents = "SELECT stream_id, event_type, origin, media_id, room_id, event_id, creation_ts FROM replication_events WHERE origin = ANY($1) AND stream_id > $2 ORDER BY stream_id ASC LIMIT $3;"
+const deleteOldReplicationEvents = "DELETE FROM replication_events WHERE creation_ts < $1;"
+
+type replicationEventsTableStatements struct {
+	selectReplicationEvents    *sql.Stmt
+	deleteOldReplicationEvents *sql.Stmt
+}
+
+type replicationEventsTableWithContext struct {
+	statements *replicationEventsTableStatements
+	ctx        rcontext.RequestContext
+}
+
+func prepareReplicationEventsTables(db *sql.DB) (*replicationEventsTableStatements, error) {
+	var err error
+	var stmts = &replicationEventsTableStatements{}
+
+	if stmts.selectReplicationEvents, err = db.Prepare(selectReplicationEvents); err != nil {
+		return nil, errors.New("error preparing selectReplicationEvents: " + err.Error())
+	}
+	if stmts.deleteOldReplicationEvents, err = db.Prepare(deleteOldReplicationEvents); err != nil {
+		return nil, errors.New("error preparing deleteOldReplicationEvents: " + err.Error())
+	}
+
+	return stmts, nil
+}
+
+func (s *replicationEventsTableStatements) Prepare(ctx rcontext.RequestContext) *replicationEventsTableWithContext {
+	return &replicationEventsTableWithContext{
+		statements: s,
+		ctx:        ctx,
+	}
+}
+
+// GetSince returns up to limit events for media from the given origins, in the order they were written, which come
+// after the given stream ID.
+func (s *replicationEventsTableWithContext) GetSince(origins []string, afterStreamId int64, limit int64) ([]*DbReplicationEvent, error) {
+	results := make([]*DbReplicationEvent, 0)
+	rows, err := s.statements.selectReplicationEvents.QueryContext(s.ctx, pq.Array(origins), afterStreamId, limit)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return results, nil
+		}
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		val := &DbReplicationEvent{}
+		if err = rows.Scan(&val.StreamId, &val.EventType, &val.Origin, &val.MediaId, &val.RoomId, &val.EventId, &val.CreationTs); err != nil {
+			return nil, err
+		}
+		results = append(results, val)
+	}
+	return results, rows.Err()
+}
+
+func (s *replicationEventsTableWithContext) DeleteOlderThan(beforeTs int64) error {
+	_, err := s.statements.deleteOldReplicationEvents.ExecContext(s.ctx, beforeTs)
+	return err
+}
@@ -0,0 +1,60 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+const selectReplicationSinceToken = "SELECT since_token FROM replication_state WHERE primary_url = $1;"
+const upsertReplicationSinceToken = "INSERT INTO replication_state (primary_url, since_token, updated_ts) VALUES ($1, $2, $3) ON CONFLICT (primary_url) DO UPDATE SET since_token = $2, updated_ts = $3;"
+
+type replicationStateTableStatements struct {
+	selectReplicationSinceToken *sql.Stmt
+	upsertReplicationSinceToken *sql.Stmt
+}
+
+type replicationStateTableWithContext struct {
+	statements *replicationStateTableStatements
+	ctx        rcontext.RequestContext
+}
+
+func prepareReplicationStateTables(db *sql.DB) (*replicationStateTableStatements, error) {
+	var err error
+	var stmts = &replicationStateTableStatements{}
+
+	if stmts.selectReplicationSinceToken, err = db.Prepare(selectReplicationSinceToken); err != nil {
+		return nil, errors.New("error preparing selectReplicationSinceToken: " + err.Error())
+	}
+	if stmts.upsertReplicationSinceToken, err = db.Prepare(upsertReplicationSinceToken); err != nil {
+		return nil, errors.New("error preparing upsertReplicationSinceToken: " + err.Error())
+	}
+
+	return stmts, nil
+}
+
+func (s *replicationStateTableStatements) Prepare(ctx rcontext.RequestContext) *replicationStateTableWithContext {
+	return &replicationStateTableWithContext{
+		statements: s,
+		ctx:        ctx,
+	}
+}
+
+// GetSinceToken returns how far media has been replicated from the given primary, or an empty string if nothing
+// has been replicated yet.
+func (s *replicationStateTableWithContext) GetSinceToken(primaryUrl string) (string, error) {
+	row := s.statements.selectReplicationSinceToken.QueryRowContext(s.ctx, primaryUrl)
+	val := ""
+	err := row.Scan(&val)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return val, err
+}
+
+func (s *replicationStateTableWithContext) SetSinceToken(primaryUrl string, sinceToken string) error {
+	_, err := s.statements.upsertReplicationSinceToken.ExecContext(s.ctx, primaryUrl, sinceToken, util.NowMillis())
+	return err
+}
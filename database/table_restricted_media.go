@@ -31,6 +31,7 @@ type restrictedMediaTableStatements struct {
 type restrictedMediaTableWithContext struct {
 	statements *restrictedMediaTableStatements
 	ctx        rcontext.RequestContext
+	tx         *sql.Tx
 }
 
 func prepareRestrictedMediaTables(db *sql.DB) (*restrictedMediaTableStatements, error) {
@@ -57,19 +58,35 @@ func (s *restrictedMediaTableStatements) Prepare(ctx rcontext.RequestContext) *r
 	}
 }
 
+// PrepareTx is like Prepare, but runs all statements within the given transaction.
+func (s *restrictedMediaTableStatements) PrepareTx(ctx rcontext.RequestContext, tx *sql.Tx) *restrictedMediaTableWithContext {
+	return &restrictedMediaTableWithContext{
+		statements: s,
+		ctx:        ctx,
+		tx:         tx,
+	}
+}
+
+func (s *restrictedMediaTableWithContext) stmt(stmt *sql.Stmt) *sql.Stmt {
+	if s.tx != nil {
+		return s.tx.StmtContext(s.ctx, stmt)
+	}
+	return stmt
+}
+
 func (s *restrictedMediaTableWithContext) Insert(origin string, mediaId string, condition RestrictedCondition, conditionValue string) error {
-	_, err := s.statements.insertRestrictedMedia.ExecContext(s.ctx, origin, mediaId, condition, conditionValue)
+	_, err := s.stmt(s.statements.insertRestrictedMedia).ExecContext(s.ctx, origin, mediaId, condition, conditionValue)
 	return err
 }
 
 func (s *restrictedMediaTableWithContext) Update(origin string, mediaId string, condition RestrictedCondition, conditionValue string) error {
-	_, err := s.statements.updateRestrictedMedia.ExecContext(s.ctx, origin, mediaId, condition, conditionValue)
+	_, err := s.stmt(s.statements.updateRestrictedMedia).ExecContext(s.ctx, origin, mediaId, condition, conditionValue)
 	return err
 }
 
 func (s *restrictedMediaTableWithContext) GetAllForId(origin string, mediaId string) ([]*DbRestrictedMedia, error) {
 	results := make([]*DbRestrictedMedia, 0)
-	rows, err := s.statements.selectRestrictedMedia.QueryContext(s.ctx, origin, mediaId)
+	rows, err := s.stmt(s.statements.selectRestrictedMedia).QueryContext(s.ctx, origin, mediaId)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return results, nil
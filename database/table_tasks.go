@@ -8,20 +8,24 @@ import (
 )
 
 type DbTask struct {
-	TaskId  int
-	Name    string
-	Params  *AnonymousJson
-	StartTs int64
-	EndTs   int64
-	Error   string
+	TaskId     int
+	Name       string
+	Params     *AnonymousJson
+	StartTs    int64
+	EndTs      int64
+	Error      string
+	Progress   *AnonymousJson
+	Checkpoint *AnonymousJson
 }
 
-const selectTask = "SELECT id, task, params, start_ts, end_ts, error FROM background_tasks WHERE id = $1;"
-const insertTask = "INSERT INTO background_tasks (task, params, start_ts, end_ts) VALUES ($1, $2, $3, 0) RETURNING id, task, params, start_ts, end_ts, error;"
-const selectAllTasks = "SELECT id, task, params, start_ts, end_ts, error FROM background_tasks;"
-const selectIncompleteTasks = "SELECT id, task, params, start_ts, end_ts, error FROM background_tasks WHERE end_ts <= 0;"
+const selectTask = "SELECT id, task, params, start_ts, end_ts, error, progress, checkpoint FROM background_tasks WHERE id = $1;"
+const insertTask = "INSERT INTO background_tasks (task, params, start_ts, end_ts) VALUES ($1, $2, $3, 0) RETURNING id, task, params, start_ts, end_ts, error, progress, checkpoint;"
+const selectAllTasks = "SELECT id, task, params, start_ts, end_ts, error, progress, checkpoint FROM background_tasks;"
+const selectIncompleteTasks = "SELECT id, task, params, start_ts, end_ts, error, progress, checkpoint FROM background_tasks WHERE end_ts <= 0;"
 const updateTaskEndTime = "UPDATE background_tasks SET end_ts = $2 WHERE id = $1;"
 const updateTaskError = "UPDATE background_tasks SET error = $2 WHERE id = $1;"
+const updateTaskProgress = "UPDATE background_tasks SET progress = $2 WHERE id = $1;"
+const updateTaskCheckpoint = "UPDATE background_tasks SET checkpoint = $2 WHERE id = $1;"
 
 type tasksTableStatements struct {
 	selectTask            *sql.Stmt
@@ -30,6 +34,8 @@ type tasksTableStatements struct {
 	selectIncompleteTasks *sql.Stmt
 	updateTaskEndTime     *sql.Stmt
 	updateTaskError       *sql.Stmt
+	updateTaskProgress    *sql.Stmt
+	updateTaskCheckpoint  *sql.Stmt
 }
 
 type tasksTableWithContext struct {
@@ -59,6 +65,12 @@ func prepareTasksTables(db *sql.DB) (*tasksTableStatements, error) {
 	if stmts.updateTaskError, err = db.Prepare(updateTaskError); err != nil {
 		return nil, errors.New("error preparing updateTaskError: " + err.Error())
 	}
+	if stmts.updateTaskProgress, err = db.Prepare(updateTaskProgress); err != nil {
+		return nil, errors.New("error preparing updateTaskProgress: " + err.Error())
+	}
+	if stmts.updateTaskCheckpoint, err = db.Prepare(updateTaskCheckpoint); err != nil {
+		return nil, errors.New("error preparing updateTaskCheckpoint: " + err.Error())
+	}
 
 	return stmts, nil
 }
@@ -73,7 +85,7 @@ func (s *tasksTableStatements) Prepare(ctx rcontext.RequestContext) *tasksTableW
 func (s *tasksTableWithContext) Insert(name string, params *AnonymousJson, startTs int64) (*DbTask, error) {
 	row := s.statements.insertTask.QueryRowContext(s.ctx, name, params, startTs)
 	val := &DbTask{}
-	err := row.Scan(&val.TaskId, &val.Name, &val.Params, &val.StartTs, &val.EndTs, &val.Error)
+	err := row.Scan(&val.TaskId, &val.Name, &val.Params, &val.StartTs, &val.EndTs, &val.Error, &val.Progress, &val.Checkpoint)
 	if err != nil {
 		return nil, err
 	}
@@ -90,10 +102,20 @@ func (s *tasksTableWithContext) SetError(taskId int, errVal string) error {
 	return err
 }
 
+func (s *tasksTableWithContext) SetProgress(taskId int, progress *AnonymousJson) error {
+	_, err := s.statements.updateTaskProgress.ExecContext(s.ctx, taskId, progress)
+	return err
+}
+
+func (s *tasksTableWithContext) SetCheckpoint(taskId int, checkpoint *AnonymousJson) error {
+	_, err := s.statements.updateTaskCheckpoint.ExecContext(s.ctx, taskId, checkpoint)
+	return err
+}
+
 func (s *tasksTableWithContext) Get(id int) (*DbTask, error) {
 	row := s.statements.selectTask.QueryRowContext(s.ctx, id)
 	val := &DbTask{}
-	err := row.Scan(&val.TaskId, &val.Name, &val.Params, &val.StartTs, &val.EndTs, &val.Error)
+	err := row.Scan(&val.TaskId, &val.Name, &val.Params, &val.StartTs, &val.EndTs, &val.Error, &val.Progress, &val.Checkpoint)
 	if errors.Is(err, sql.ErrNoRows) {
 		err = nil
 		val = nil
@@ -116,7 +138,7 @@ func (s *tasksTableWithContext) GetAll(includingFinished bool) ([]*DbTask, error
 	}
 	for rows.Next() {
 		val := &DbTask{}
-		if err = rows.Scan(&val.TaskId, &val.Name, &val.Params, &val.StartTs, &val.EndTs, &val.Error); err != nil {
+		if err = rows.Scan(&val.TaskId, &val.Name, &val.Params, &val.StartTs, &val.EndTs, &val.Error, &val.Progress, &val.Checkpoint); err != nil {
 			return nil, err
 		}
 		results = append(results, val)
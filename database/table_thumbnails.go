@@ -4,7 +4,9 @@ import (
 	"database/sql"
 	"errors"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/metrics"
 )
 
 type DbMethod string
@@ -21,18 +23,21 @@ type DbThumbnail struct {
 	//Sha256Hash  string
 	SizeBytes  int64
 	CreationTs int64
+	Format     string
+	// Passthrough is true when the thumbnail is the original media, served as-is
+	Passthrough bool
 	//DatastoreId string
 	//Location    string
 }
 
-const selectThumbnailByParams = "SELECT origin, media_id, content_type, width, height, method, animated, sha256_hash, size_bytes, creation_ts, datastore_id, location FROM thumbnails WHERE origin = $1 AND media_id = $2 AND width = $3 AND height = $4 AND method = $5 AND animated = $6;"
-const insertThumbnail = "INSERT INTO thumbnails (origin, media_id, content_type, width, height, method, animated, sha256_hash, size_bytes, creation_ts, datastore_id, location) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12);"
+const selectThumbnailByParams = "SELECT origin, media_id, content_type, width, height, method, animated, sha256_hash, size_bytes, creation_ts, datastore_id, location, format, passthrough FROM thumbnails WHERE origin = $1 AND media_id = $2 AND width = $3 AND height = $4 AND method = $5 AND animated = $6 AND format = $7;"
+const insertThumbnail = "INSERT INTO thumbnails (origin, media_id, content_type, width, height, method, animated, sha256_hash, size_bytes, creation_ts, datastore_id, location, format, passthrough) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14);"
 const selectThumbnailByLocationExists = "SELECT TRUE FROM thumbnails WHERE datastore_id = $1 AND location = $2 LIMIT 1;"
-const selectThumbnailsForMedia = "SELECT origin, media_id, content_type, width, height, method, animated, sha256_hash, size_bytes, creation_ts, datastore_id, location FROM thumbnails WHERE origin = $1 AND media_id = $2;"
-const selectOldThumbnails = "SELECT origin, media_id, content_type, width, height, method, animated, sha256_hash, size_bytes, creation_ts, datastore_id, location FROM thumbnails WHERE sha256_hash IN (SELECT t2.sha256_hash FROM thumbnails AS t2 WHERE t2.creation_ts < $1);"
-const deleteThumbnail = "DELETE FROM thumbnails WHERE origin = $1 AND media_id = $2 AND content_type = $3 AND width = $4 AND height = $5 AND method = $6 AND animated = $7 AND sha256_hash = $8 AND size_bytes = $9 AND creation_ts = $10 AND datastore_id = $11 AND location = $12;"
+const selectThumbnailsForMedia = "SELECT origin, media_id, content_type, width, height, method, animated, sha256_hash, size_bytes, creation_ts, datastore_id, location, format, passthrough FROM thumbnails WHERE origin = $1 AND media_id = $2;"
+const selectOldThumbnails = "SELECT origin, media_id, content_type, width, height, method, animated, sha256_hash, size_bytes, creation_ts, datastore_id, location, format, passthrough FROM thumbnails WHERE sha256_hash IN (SELECT t2.sha256_hash FROM thumbnails AS t2 WHERE t2.creation_ts < $1);"
+const deleteThumbnail = "DELETE FROM thumbnails WHERE origin = $1 AND media_id = $2 AND content_type = $3 AND width = $4 AND height = $5 AND method = $6 AND animated = $7 AND sha256_hash = $8 AND size_bytes = $9 AND creation_ts = $10 AND datastore_id = $11 AND location = $12 AND format = $13;"
 const updateThumbnailLocation = "UPDATE thumbnails SET datastore_id = $3, location = $4 WHERE datastore_id = $1 AND location = $2;"
-const selectThumbnailsByLocation = "SELECT origin, media_id, content_type, width, height, method, animated, sha256_hash, size_bytes, creation_ts, datastore_id, location FROM thumbnails WHERE datastore_id = $1 AND location = $2;"
+const selectThumbnailsByLocation = "SELECT origin, media_id, content_type, width, height, method, animated, sha256_hash, size_bytes, creation_ts, datastore_id, location, format, passthrough FROM thumbnails WHERE datastore_id = $1 AND location = $2;"
 
 type thumbnailsTableStatements struct {
 	selectThumbnailByParams         *sql.Stmt
@@ -43,11 +48,14 @@ type thumbnailsTableStatements struct {
 	deleteThumbnail                 *sql.Stmt
 	updateThumbnailLocation         *sql.Stmt
 	selectThumbnailsByLocation      *sql.Stmt
+
+	replicas *readReplicas
 }
 
 type thumbnailsTableWithContext struct {
 	statements *thumbnailsTableStatements
 	ctx        rcontext.RequestContext
+	primary    *thumbnailsTableStatements // set when reading from a replica
 }
 
 func prepareThumbnailsTables(db *sql.DB) (*thumbnailsTableStatements, error) {
@@ -89,14 +97,31 @@ func (s *thumbnailsTableStatements) Prepare(ctx rcontext.RequestContext) *thumbn
 	}
 }
 
-func (s *thumbnailsTableWithContext) GetByParams(origin string, mediaId string, width int, height int, method string, animated bool) (*DbThumbnail, error) {
-	row := s.statements.selectThumbnailByParams.QueryRowContext(s.ctx, origin, mediaId, width, height, method, animated)
+// PrepareRead is like Prepare, but sends lookups to a database read replica when one is configured and keeping up.
+// Only use the result for reads. Lookups which fail or find nothing on the replica are retried on the primary.
+func (s *thumbnailsTableStatements) PrepareRead(ctx rcontext.RequestContext) *thumbnailsTableWithContext {
+	if replica := s.replicas.pick(); replica != nil {
+		return &thumbnailsTableWithContext{
+			statements: replica.thumbnails,
+			ctx:        ctx,
+			primary:    s,
+		}
+	}
+	return s.Prepare(ctx)
+}
+
+func (s *thumbnailsTableWithContext) GetByParams(origin string, mediaId string, width int, height int, method string, animated bool, format string) (*DbThumbnail, error) {
+	row := s.statements.selectThumbnailByParams.QueryRowContext(s.ctx, origin, mediaId, width, height, method, animated, format)
 	val := &DbThumbnail{Locatable: &Locatable{}}
-	err := row.Scan(&val.Origin, &val.MediaId, &val.ContentType, &val.Width, &val.Height, &val.Method, &val.Animated, &val.Sha256Hash, &val.SizeBytes, &val.CreationTs, &val.DatastoreId, &val.Location)
+	err := row.Scan(&val.Origin, &val.MediaId, &val.ContentType, &val.Width, &val.Height, &val.Method, &val.Animated, &val.Sha256Hash, &val.SizeBytes, &val.CreationTs, &val.DatastoreId, &val.Location, &val.Format, &val.Passthrough)
 	if errors.Is(err, sql.ErrNoRows) {
 		err = nil
 		val = nil
 	}
+	if s.primary != nil && (err != nil || val == nil) {
+		metrics.DatabaseReplicaFallbacks.With(prometheus.Labels{"table": "thumbnails"}).Inc()
+		return s.primary.Prepare(s.ctx).GetByParams(origin, mediaId, width, height, method, animated, format)
+	}
 	return val, err
 }
 
@@ -110,7 +135,7 @@ func (s *thumbnailsTableWithContext) scanRows(rows *sql.Rows, err error) ([]*DbT
 	}
 	for rows.Next() {
 		val := &DbThumbnail{Locatable: &Locatable{}}
-		if err = rows.Scan(&val.Origin, &val.MediaId, &val.ContentType, &val.Width, &val.Height, &val.Method, &val.Animated, &val.Sha256Hash, &val.SizeBytes, &val.CreationTs, &val.DatastoreId, &val.Location); err != nil {
+		if err = rows.Scan(&val.Origin, &val.MediaId, &val.ContentType, &val.Width, &val.Height, &val.Method, &val.Animated, &val.Sha256Hash, &val.SizeBytes, &val.CreationTs, &val.DatastoreId, &val.Location, &val.Format, &val.Passthrough); err != nil {
 			return nil, err
 		}
 		results = append(results, val)
@@ -132,7 +157,7 @@ func (s *thumbnailsTableWithContext) GetByLocation(datastoreId string, location
 }
 
 func (s *thumbnailsTableWithContext) Insert(record *DbThumbnail) error {
-	_, err := s.statements.insertThumbnail.ExecContext(s.ctx, record.Origin, record.MediaId, record.ContentType, record.Width, record.Height, record.Method, record.Animated, record.Sha256Hash, record.SizeBytes, record.CreationTs, record.DatastoreId, record.Location)
+	_, err := s.statements.insertThumbnail.ExecContext(s.ctx, record.Origin, record.MediaId, record.ContentType, record.Width, record.Height, record.Method, record.Animated, record.Sha256Hash, record.SizeBytes, record.CreationTs, record.DatastoreId, record.Location, record.Format, record.Passthrough)
 	return err
 }
 
@@ -148,7 +173,7 @@ func (s *thumbnailsTableWithContext) LocationExists(datastoreId string, location
 }
 
 func (s *thumbnailsTableWithContext) Delete(record *DbThumbnail) error {
-	_, err := s.statements.deleteThumbnail.ExecContext(s.ctx, record.Origin, record.MediaId, record.ContentType, record.Width, record.Height, record.Method, record.Animated, record.Sha256Hash, record.SizeBytes, record.CreationTs, record.DatastoreId, record.Location)
+	_, err := s.statements.deleteThumbnail.ExecContext(s.ctx, record.Origin, record.MediaId, record.ContentType, record.Width, record.Height, record.Method, record.Animated, record.Sha256Hash, record.SizeBytes, record.CreationTs, record.DatastoreId, record.Location, record.Format)
 	return err
 }
 
@@ -0,0 +1,136 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/lib/pq"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+)
+
+type DbUnreferencedMedia struct {
+	Origin         string
+	MediaId        string
+	UnreferencedTs int64
+}
+
+const upsertUnreferencedMedia = "INSERT INTO unreferenced_media (origin, media_id, unreferenced_ts) VALUES ($1, $2, $3) ON CONFLICT (origin, media_id) DO UPDATE SET unreferenced_ts = $3;"
+const selectOldUnreferencedMedia = "SELECT origin, media_id, unreferenced_ts FROM unreferenced_media WHERE unreferenced_ts < $1;"
+const selectUnreferencedMediaCount = "SELECT COUNT(*) FROM unreferenced_media;"
+const selectStaleUnreferencedMedia = "SELECT u.origin, u.media_id, u.unreferenced_ts FROM unreferenced_media AS u WHERE EXISTS (SELECT 1 FROM media_references AS r WHERE r.origin = u.origin AND r.media_id = u.media_id) OR NOT EXISTS (SELECT 1 FROM media AS m WHERE m.origin = u.origin AND m.media_id = u.media_id);"
+const selectUnflaggedUnreferencedMedia = "SELECT m.origin, m.media_id, 0 FROM media AS m WHERE m.origin = ANY($1) AND NOT EXISTS (SELECT 1 FROM media_references AS r WHERE r.origin = m.origin AND r.media_id = m.media_id) AND NOT EXISTS (SELECT 1 FROM unreferenced_media AS u WHERE u.origin = m.origin AND u.media_id = m.media_id);"
+const deleteUnreferencedMedia = "DELETE FROM unreferenced_media WHERE origin = $1 AND media_id = $2;"
+
+type unreferencedMediaTableStatements struct {
+	upsertUnreferencedMedia      *sql.Stmt
+	selectOldUnreferencedMedia   *sql.Stmt
+	selectUnreferencedMediaCount *sql.Stmt
+	selectStaleUnreferenced      *sql.Stmt
+	selectUnflaggedUnreferenced  *sql.Stmt
+	deleteUnreferencedMedia      *sql.Stmt
+}
+
+type unreferencedMediaTableWithContext struct {
+	statements *unreferencedMediaTableStatements
+	ctx        rcontext.RequestContext
+	tx         *sql.Tx
+}
+
+func prepareUnreferencedMediaTables(db *sql.DB) (*unreferencedMediaTableStatements, error) {
+	var err error
+	var stmts = &unreferencedMediaTableStatements{}
+
+	if stmts.upsertUnreferencedMedia, err = db.Prepare(upsertUnreferencedMedia); err != nil {
+		return nil, errors.New("error preparing upsertUnreferencedMedia: " + err.Error())
+	}
+	if stmts.selectOldUnreferencedMedia, err = db.Prepare(selectOldUnreferencedMedia); err != nil {
+		return nil, errors.New("error preparing selectOldUnreferencedMedia: " + err.Error())
+	}
+	if stmts.selectUnreferencedMediaCount, err = db.Prepare(selectUnreferencedMediaCount); err != nil {
+		return nil, errors.New("error preparing selectUnreferencedMediaCount: " + err.Error())
+	}
+	if stmts.selectStaleUnreferenced, err = db.Prepare(selectStaleUnreferencedMedia); err != nil {
+		return nil, errors.New("error preparing selectStaleUnreferencedMedia: " + err.Error())
+	}
+	if stmts.selectUnflaggedUnreferenced, err = db.Prepare(selectUnflaggedUnreferencedMedia); err != nil {
+		return nil, errors.New("error preparing selectUnflaggedUnreferencedMedia: " + err.Error())
+	}
+	if stmts.deleteUnreferencedMedia, err = db.Prepare(deleteUnreferencedMedia); err != nil {
+		return nil, errors.New("error preparing deleteUnreferencedMedia: " + err.Error())
+	}
+
+	return stmts, nil
+}
+
+func (s *unreferencedMediaTableStatements) Prepare(ctx rcontext.RequestContext) *unreferencedMediaTableWithContext {
+	return &unreferencedMediaTableWithContext{
+		statements: s,
+		ctx:        ctx,
+	}
+}
+
+// PrepareTx is like Prepare, but runs all statements within the given transaction.
+func (s *unreferencedMediaTableStatements) PrepareTx(ctx rcontext.RequestContext, tx *sql.Tx) *unreferencedMediaTableWithContext {
+	return &unreferencedMediaTableWithContext{
+		statements: s,
+		ctx:        ctx,
+		tx:         tx,
+	}
+}
+
+func (s *unreferencedMediaTableWithContext) stmt(stmt *sql.Stmt) *sql.Stmt {
+	if s.tx != nil {
+		return s.tx.StmtContext(s.ctx, stmt)
+	}
+	return stmt
+}
+
+func (s *unreferencedMediaTableWithContext) Upsert(origin string, mediaId string, unreferencedTs int64) error {
+	_, err := s.stmt(s.statements.upsertUnreferencedMedia).ExecContext(s.ctx, origin, mediaId, unreferencedTs)
+	return err
+}
+
+func (s *unreferencedMediaTableWithContext) scanRows(rows *sql.Rows, err error) ([]*DbUnreferencedMedia, error) {
+	results := make([]*DbUnreferencedMedia, 0)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return results, nil
+		}
+		return nil, err
+	}
+	for rows.Next() {
+		val := &DbUnreferencedMedia{}
+		if err = rows.Scan(&val.Origin, &val.MediaId, &val.UnreferencedTs); err != nil {
+			return nil, err
+		}
+		results = append(results, val)
+	}
+	return results, nil
+}
+
+func (s *unreferencedMediaTableWithContext) GetOlderThan(beforeTs int64) ([]*DbUnreferencedMedia, error) {
+	return s.scanRows(s.stmt(s.statements.selectOldUnreferencedMedia).QueryContext(s.ctx, beforeTs))
+}
+
+// GetStale returns flagged media which has since been referenced again, or no longer exists.
+func (s *unreferencedMediaTableWithContext) GetStale() ([]*DbUnreferencedMedia, error) {
+	return s.scanRows(s.stmt(s.statements.selectStaleUnreferenced).QueryContext(s.ctx))
+}
+
+// GetUnflagged returns media on the given origins which has no references, but isn't flagged either. The
+// UnreferencedTs of each record is zero.
+func (s *unreferencedMediaTableWithContext) GetUnflagged(origins []string) ([]*DbUnreferencedMedia, error) {
+	return s.scanRows(s.stmt(s.statements.selectUnflaggedUnreferenced).QueryContext(s.ctx, pq.Array(origins)))
+}
+
+func (s *unreferencedMediaTableWithContext) Count() (int64, error) {
+	row := s.stmt(s.statements.selectUnreferencedMediaCount).QueryRowContext(s.ctx)
+	val := int64(0)
+	err := row.Scan(&val)
+	return val, err
+}
+
+func (s *unreferencedMediaTableWithContext) Delete(origin string, mediaId string) error {
+	_, err := s.stmt(s.statements.deleteUnreferencedMedia).ExecContext(s.ctx, origin, mediaId)
+	return err
+}
@@ -0,0 +1,129 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+type DbUploadPartial struct {
+	UserId        string
+	Key           string
+	ContentType   string
+	UploadName    string
+	TotalBytes    int64
+	ReceivedBytes int64
+	Location      string
+	ExpiresTs     int64
+}
+
+const upsertUploadPartial = "INSERT INTO upload_partials (user_id, idempotency_key, content_type, upload_name, total_bytes, received_bytes, location, expires_ts) VALUES ($1, $2, $3, $4, $5, $6, $7, $8) ON CONFLICT (user_id, idempotency_key) DO UPDATE SET content_type = $3, upload_name = $4, total_bytes = $5, received_bytes = $6, location = $7, expires_ts = $8;"
+const selectUploadPartial = "SELECT user_id, idempotency_key, content_type, upload_name, total_bytes, received_bytes, location, expires_ts FROM upload_partials WHERE user_id = $1 AND idempotency_key = $2 AND expires_ts >= $3;"
+const selectExpiredUploadPartials = "SELECT user_id, idempotency_key, content_type, upload_name, total_bytes, received_bytes, location, expires_ts FROM upload_partials WHERE expires_ts < $1;"
+const updateUploadPartialReceived = "UPDATE upload_partials SET received_bytes = $3 WHERE user_id = $1 AND idempotency_key = $2;"
+const selectUploadPartialUsage = "SELECT COUNT(*), COALESCE(SUM(total_bytes), 0) FROM upload_partials WHERE user_id = $1 AND idempotency_key <> $2 AND expires_ts >= $3;"
+const deleteUploadPartial = "DELETE FROM upload_partials WHERE user_id = $1 AND idempotency_key = $2;"
+
+type uploadPartialsTableStatements struct {
+	upsertUploadPartial         *sql.Stmt
+	selectUploadPartial         *sql.Stmt
+	selectExpiredUploadPartials *sql.Stmt
+	updateUploadPartialReceived *sql.Stmt
+	selectUploadPartialUsage    *sql.Stmt
+	deleteUploadPartial         *sql.Stmt
+}
+
+type uploadPartialsTableWithContext struct {
+	statements *uploadPartialsTableStatements
+	ctx        rcontext.RequestContext
+}
+
+func prepareUploadPartialsTables(db *sql.DB) (*uploadPartialsTableStatements, error) {
+	var err error
+	var stmts = &uploadPartialsTableStatements{}
+
+	if stmts.upsertUploadPartial, err = db.Prepare(upsertUploadPartial); err != nil {
+		return nil, errors.New("error preparing upsertUploadPartial: " + err.Error())
+	}
+	if stmts.selectUploadPartial, err = db.Prepare(selectUploadPartial); err != nil {
+		return nil, errors.New("error preparing selectUploadPartial: " + err.Error())
+	}
+	if stmts.selectExpiredUploadPartials, err = db.Prepare(selectExpiredUploadPartials); err != nil {
+		return nil, errors.New("error preparing selectExpiredUploadPartials: " + err.Error())
+	}
+	if stmts.updateUploadPartialReceived, err = db.Prepare(updateUploadPartialReceived); err != nil {
+		return nil, errors.New("error preparing updateUploadPartialReceived: " + err.Error())
+	}
+	if stmts.selectUploadPartialUsage, err = db.Prepare(selectUploadPartialUsage); err != nil {
+		return nil, errors.New("error preparing selectUploadPartialUsage: " + err.Error())
+	}
+	if stmts.deleteUploadPartial, err = db.Prepare(deleteUploadPartial); err != nil {
+		return nil, errors.New("error preparing deleteUploadPartial: " + err.Error())
+	}
+
+	return stmts, nil
+}
+
+func (s *uploadPartialsTableStatements) Prepare(ctx rcontext.RequestContext) *uploadPartialsTableWithContext {
+	return &uploadPartialsTableWithContext{
+		statements: s,
+		ctx:        ctx,
+	}
+}
+
+func (s *uploadPartialsTableWithContext) Upsert(record *DbUploadPartial) error {
+	_, err := s.statements.upsertUploadPartial.ExecContext(s.ctx, record.UserId, record.Key, record.ContentType, record.UploadName, record.TotalBytes, record.ReceivedBytes, record.Location, record.ExpiresTs)
+	return err
+}
+
+func (s *uploadPartialsTableWithContext) Get(userId string, key string) (*DbUploadPartial, error) {
+	row := s.statements.selectUploadPartial.QueryRowContext(s.ctx, userId, key, util.NowMillis())
+	val := &DbUploadPartial{}
+	err := row.Scan(&val.UserId, &val.Key, &val.ContentType, &val.UploadName, &val.TotalBytes, &val.ReceivedBytes, &val.Location, &val.ExpiresTs)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = nil
+		val = nil
+	}
+	return val, err
+}
+
+func (s *uploadPartialsTableWithContext) GetExpired() ([]*DbUploadPartial, error) {
+	results := make([]*DbUploadPartial, 0)
+	rows, err := s.statements.selectExpiredUploadPartials.QueryContext(s.ctx, util.NowMillis())
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return results, nil
+		}
+		return nil, err
+	}
+	for rows.Next() {
+		val := &DbUploadPartial{}
+		if err = rows.Scan(&val.UserId, &val.Key, &val.ContentType, &val.UploadName, &val.TotalBytes, &val.ReceivedBytes, &val.Location, &val.ExpiresTs); err != nil {
+			return nil, err
+		}
+		results = append(results, val)
+	}
+	return results, nil
+}
+
+func (s *uploadPartialsTableWithContext) UpdateReceived(userId string, key string, receivedBytes int64) error {
+	_, err := s.statements.updateUploadPartialReceived.ExecContext(s.ctx, userId, key, receivedBytes)
+	return err
+}
+
+// GetUsage returns how many unexpired partial uploads the user has, and their total size, not counting the one for
+// the given key.
+func (s *uploadPartialsTableWithContext) GetUsage(userId string, exceptKey string) (int64, int64, error) {
+	row := s.statements.selectUploadPartialUsage.QueryRowContext(s.ctx, userId, exceptKey, util.NowMillis())
+	var count int64
+	var totalBytes int64
+	err := row.Scan(&count, &totalBytes)
+	return count, totalBytes, err
+}
+
+func (s *uploadPartialsTableWithContext) Delete(userId string, key string) error {
+	_, err := s.statements.deleteUploadPartial.ExecContext(s.ctx, userId, key)
+	return err
+}
@@ -0,0 +1,67 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+)
+
+type DbUserPreferences struct {
+	UserId            string
+	AutoCompress      bool
+	StripMetadata     bool
+	DefaultVisibility string
+	SyncedTs          int64
+}
+
+const selectUserPreferences = "SELECT user_id, auto_compress, strip_metadata, default_visibility, synced_ts FROM user_media_preferences WHERE user_id = $1;"
+const upsertUserPreferences = "INSERT INTO user_media_preferences (user_id, auto_compress, strip_metadata, default_visibility, synced_ts) VALUES ($1, $2, $3, $4, $5) ON CONFLICT (user_id) DO UPDATE SET auto_compress = $2, strip_metadata = $3, default_visibility = $4, synced_ts = $5;"
+
+type userPreferencesTableStatements struct {
+	selectUserPreferences *sql.Stmt
+	upsertUserPreferences *sql.Stmt
+}
+
+type userPreferencesTableWithContext struct {
+	statements *userPreferencesTableStatements
+	ctx        rcontext.RequestContext
+}
+
+func prepareUserPreferencesTables(db *sql.DB) (*userPreferencesTableStatements, error) {
+	var err error
+	var stmts = &userPreferencesTableStatements{}
+
+	if stmts.selectUserPreferences, err = db.Prepare(selectUserPreferences); err != nil {
+		return nil, errors.New("error preparing selectUserPreferences: " + err.Error())
+	}
+	if stmts.upsertUserPreferences, err = db.Prepare(upsertUserPreferences); err != nil {
+		return nil, errors.New("error preparing upsertUserPreferences: " + err.Error())
+	}
+
+	return stmts, nil
+}
+
+func (s *userPreferencesTableStatements) Prepare(ctx rcontext.RequestContext) *userPreferencesTableWithContext {
+	return &userPreferencesTableWithContext{
+		statements: s,
+		ctx:        ctx,
+	}
+}
+
+// Get returns the user's stored media preferences, or nil if they have none.
+func (s *userPreferencesTableWithContext) Get(userId string) (*DbUserPreferences, error) {
+	row := s.statements.selectUserPreferences.QueryRowContext(s.ctx, userId)
+	val := &DbUserPreferences{}
+	err := row.Scan(&val.UserId, &val.AutoCompress, &val.StripMetadata, &val.DefaultVisibility, &val.SyncedTs)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = nil
+		val = nil
+	}
+	return val, err
+}
+
+func (s *userPreferencesTableWithContext) Upsert(prefs *DbUserPreferences) error {
+	_, err := s.statements.upsertUserPreferences.ExecContext(s.ctx, prefs.UserId, prefs.AutoCompress, prefs.StripMetadata, prefs.DefaultVisibility, prefs.SyncedTs)
+	return err
+}
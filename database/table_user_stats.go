@@ -25,12 +25,14 @@ type DbUserStats struct {
 
 const selectUserStatsUploadedBytes = "SELECT uploaded_bytes FROM user_stats WHERE user_id = $1;"
 const selectUserQuota = "SELECT user_id, uploaded_bytes, quota_max_bytes, quota_max_pending, quota_max_files FROM user_stats WHERE user_id = ANY($1);"
+const selectAllUserStats = "SELECT user_id, uploaded_bytes, quota_max_bytes, quota_max_pending, quota_max_files FROM user_stats WHERE uploaded_bytes > 0;"
 const updateUserQuota = "UPDATE user_stats SET quota_max_bytes = $2, quota_max_pending = $3, quota_max_files = $4 WHERE user_id = $1;"
 const insertUserQuota = "INSERT INTO user_stats (user_id, uploaded_bytes, quota_max_bytes, quota_max_pending, quota_max_files) VALUES ($1, $2, $3, $4, $5);"
 
 type userStatsTableStatements struct {
 	selectUserStatsUploadedBytes *sql.Stmt
 	selectUserQuota              *sql.Stmt
+	selectAllUserStats           *sql.Stmt
 	updateUserQuota              *sql.Stmt
 	insertUserQuota              *sql.Stmt
 }
@@ -50,6 +52,9 @@ func prepareUserStatsTables(db *sql.DB) (*userStatsTableStatements, error) {
 	if stmts.selectUserQuota, err = db.Prepare(selectUserQuota); err != nil {
 		return nil, errors.New("error preparing selectUserQuota: " + err.Error())
 	}
+	if stmts.selectAllUserStats, err = db.Prepare(selectAllUserStats); err != nil {
+		return nil, errors.New("error preparing selectAllUserStats: " + err.Error())
+	}
 	if stmts.updateUserQuota, err = db.Prepare(updateUserQuota); err != nil {
 		return nil, errors.New("error preparing updateUserQuota: " + err.Error())
 	}
@@ -99,6 +104,29 @@ func (s *userStatsTableWithContext) GetUserQuota(userIds []string) ([]*DbUserSta
 	return results, nil
 }
 
+// GetAllWithUploads returns the stats for every user who has uploaded media.
+func (s *userStatsTableWithContext) GetAllWithUploads() ([]*DbUserStats, error) {
+	rows, err := s.statements.selectAllUserStats.QueryContext(s.ctx)
+
+	results := make([]*DbUserStats, 0)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return results, nil
+		}
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		val := &DbUserStats{UserQuota: &UserQuota{}}
+		if err = rows.Scan(&val.UserId, &val.UploadedBytes, &val.UserQuota.MaxBytes, &val.UserQuota.MaxPending, &val.UserQuota.MaxFiles); err != nil {
+			return nil, err
+		}
+		results = append(results, val)
+	}
+
+	return results, nil
+}
+
 func (s *userStatsTableWithContext) SetUserQuota(userId string, maxBytes int64, maxPending int64, maxFiles int64) error {
 	// Need to insert default record if user has not uploaded any media beforehand
 	row := s.statements.selectUserQuota.QueryRowContext(s.ctx, pq.Array([]string{userId}))
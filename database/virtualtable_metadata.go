@@ -6,9 +6,18 @@ import (
 	"fmt"
 	"strings"
 
+	"github.com/lib/pq"
 	"github.com/t2bot/matrix-media-repo/common/rcontext"
 )
 
+// DatastoreObjectFilter narrows down the objects returned when listing a datastore. The zero value matches
+// everything. Thumbnails are matched by the user who uploaded their media.
+type DatastoreObjectFilter struct {
+	UserId       string
+	MinSizeBytes int64
+	MaxSizeBytes int64 // zero for no maximum
+}
+
 type VirtLastAccess struct {
 	*Locatable
 	SizeBytes    int64
@@ -17,14 +26,53 @@ type VirtLastAccess struct {
 	ContentType  string
 }
 
-const selectEstimatedDatastoreSize = "SELECT COALESCE(SUM(m2.size_bytes), 0) + COALESCE((SELECT SUM(t2.size_bytes) FROM (SELECT DISTINCT t.sha256_hash, MAX(t.size_bytes) AS size_bytes FROM thumbnails AS t WHERE t.datastore_id = $1 GROUP BY t.sha256_hash) AS t2), 0) AS size_total FROM (SELECT DISTINCT m.sha256_hash, MAX(m.size_bytes) AS size_bytes FROM media AS m WHERE m.datastore_id = $1 GROUP BY m.sha256_hash) AS m2;"
-const selectUploadSizesForServer = "SELECT COALESCE((SELECT SUM(size_bytes) FROM media WHERE origin = $1), 0) AS media, COALESCE((SELECT SUM(size_bytes) FROM thumbnails WHERE origin = $1), 0) AS thumbnails;"
+const selectEstimatedDatastoreSize = "SELECT COALESCE(SUM(m2.size_bytes), 0) + COALESCE((SELECT SUM(t2.size_bytes) FROM (SELECT DISTINCT t.sha256_hash, MAX(t.size_bytes) AS size_bytes FROM thumbnails AS t WHERE t.datastore_id = $1 AND t.passthrough = FALSE GROUP BY t.sha256_hash) AS t2), 0) AS size_total FROM (SELECT DISTINCT m.sha256_hash, MAX(m.size_bytes) AS size_bytes FROM media AS m WHERE m.datastore_id = $1 GROUP BY m.sha256_hash) AS m2;"
+const selectUploadSizesForServer = "SELECT COALESCE((SELECT SUM(size_bytes) FROM media WHERE origin = $1), 0) AS media, COALESCE((SELECT SUM(size_bytes) FROM thumbnails WHERE origin = $1 AND passthrough = FALSE), 0) AS thumbnails;"
 const selectUploadCountsForServer = "SELECT COALESCE((SELECT COUNT(origin) FROM media WHERE origin = $1), 0) AS media, COALESCE((SELECT COUNT(origin) FROM thumbnails WHERE origin = $1), 0) AS thumbnails;"
-const selectMediaForDatastoreWithLastAccess = "SELECT m.sha256_hash, m.size_bytes, m.datastore_id, m.location, m.creation_ts, a.last_access_ts, m.content_type FROM media AS m JOIN last_access AS a ON m.sha256_hash = a.sha256_hash WHERE a.last_access_ts < $1 AND m.datastore_id = $2;"
-const selectThumbnailsForDatastoreWithLastAccess = "SELECT m.sha256_hash, m.size_bytes, m.datastore_id, m.location, m.creation_ts, a.last_access_ts, m.content_type FROM thumbnails AS m JOIN last_access AS a ON m.sha256_hash = a.sha256_hash WHERE a.last_access_ts < $1 AND m.datastore_id = $2;"
+const selectMediaForDatastoreWithLastAccess = "SELECT m.sha256_hash, m.size_bytes, m.datastore_id, m.location, m.creation_ts, a.last_access_ts, m.content_type FROM media AS m JOIN last_access AS a ON m.sha256_hash = a.sha256_hash WHERE a.last_access_ts < $1 AND m.datastore_id = $2 AND ($3 = '' OR m.user_id = $3) AND m.size_bytes >= $4 AND ($5 <= 0 OR m.size_bytes <= $5);"
+const selectThumbnailsForDatastoreWithLastAccess = "SELECT m.sha256_hash, m.size_bytes, m.datastore_id, m.location, m.creation_ts, a.last_access_ts, m.content_type FROM thumbnails AS m JOIN last_access AS a ON m.sha256_hash = a.sha256_hash WHERE a.last_access_ts < $1 AND m.datastore_id = $2 AND ($3 = '' OR EXISTS (SELECT 1 FROM media AS o WHERE o.origin = m.origin AND o.media_id = m.media_id AND o.user_id = $3)) AND m.size_bytes >= $4 AND ($5 <= 0 OR m.size_bytes <= $5);"
 const updateQuarantineByHash = "WITH t AS (SELECT m.origin AS origin, m.media_id AS media_id, a.purpose AS purpose FROM media AS m LEFT JOIN media_attributes AS a ON m.origin = a.origin AND m.media_id = a.media_id WHERE m.sha256_hash = $1 AND (a.purpose IS NULL OR a.purpose <> $2) AND m.quarantined <> $3) UPDATE media AS m2 SET quarantined = $3 FROM t WHERE m2.origin = t.origin AND m2.media_id = t.media_id;"
 const updateQuarantineByHashAndOrigin = "WITH t AS (SELECT m.origin AS origin, m.media_id AS media_id, a.purpose AS purpose FROM media AS m LEFT JOIN media_attributes AS a ON m.origin = a.origin AND m.media_id = a.media_id WHERE m.origin = $1 AND m.sha256_hash = $2 AND (a.purpose IS NULL OR a.purpose <> $3) AND m.quarantined <> $4) UPDATE media AS m2 SET quarantined = $4 FROM t WHERE m2.origin = t.origin AND m2.media_id = t.media_id;"
 
+// DbStorageReportRow is the usage of one category of media in one age bucket. AgeBucket is the index of the
+// first threshold the media was created after, or the number of thresholds if it is older than all of them.
+type DbStorageReportRow struct {
+	Category  string
+	AgeBucket int
+	IsLocal   bool
+	Count     int64
+	SizeBytes int64
+}
+
+const selectStorageReport = "SELECT CASE WHEN content_type LIKE 'image/%' THEN 'images' WHEN content_type LIKE 'video/%' THEN 'video' WHEN content_type LIKE 'audio/%' THEN 'audio' ELSE 'other' END AS category, CASE WHEN creation_ts >= $2 THEN 0 WHEN creation_ts >= $3 THEN 1 WHEN creation_ts >= $4 THEN 2 WHEN creation_ts >= $5 THEN 3 ELSE 4 END AS age_bucket, origin = ANY($1) AS is_local, COUNT(*), COALESCE(SUM(size_bytes), 0) FROM media GROUP BY 1, 2, 3;"
+
+// DbRetentionCandidate is a media record which would be removed by a retention rule.
+type DbRetentionCandidate struct {
+	Origin    string
+	MediaId   string
+	SizeBytes int64
+}
+
+type DbOriginUsage struct {
+	Origin    string
+	SizeBytes int64
+}
+
+const selectRemoteOriginUsage = "SELECT origin, COALESCE(SUM(size_bytes), 0) FROM media WHERE NOT (origin = ANY($1)) GROUP BY origin;"
+const selectRetentionCandidates = "SELECT m.origin, m.media_id, m.size_bytes FROM media AS m LEFT JOIN last_access AS a ON a.sha256_hash = m.sha256_hash WHERE m.creation_ts < $1 AND ($2 = 'any' OR (m.origin = ANY($3)) = ($2 = 'local')) AND (a.last_access_ts IS NULL OR a.last_access_ts < $4) AND (CARDINALITY($5::text[]) = 0 OR m.content_type LIKE ANY($5)) AND m.size_bytes >= $6 AND (m.quarantined = false OR $7);"
+
+// DbDatastoreObject is an object referenced by the media or (non-passthrough) thumbnails tables. Objects shared by
+// several records are listed once, with the kind of the first record type referencing it.
+type DbDatastoreObject struct {
+	DatastoreId string
+	Location    string
+	Sha256Hash  string
+	SizeBytes   int64
+	Kind        string
+}
+
+const selectDatastoreObjects = "SELECT datastore_id, location, MIN(sha256_hash), MAX(size_bytes), MIN(kind) FROM (SELECT datastore_id, location, sha256_hash, size_bytes, 'media' AS kind FROM media UNION ALL SELECT datastore_id, location, sha256_hash, size_bytes, 'thumbnail' AS kind FROM thumbnails WHERE passthrough = FALSE) AS o WHERE location <> '' GROUP BY datastore_id, location ORDER BY datastore_id, location;"
+
 type SynStatUserOrderBy string
 
 const (
@@ -55,6 +103,10 @@ type metadataVirtualTableStatements struct {
 	selectThumbnailsForDatastoreWithLastAccess *sql.Stmt
 	updateQuarantineByHash                     *sql.Stmt
 	updateQuarantineByHashAndOrigin            *sql.Stmt
+	selectStorageReport                        *sql.Stmt
+	selectRetentionCandidates                  *sql.Stmt
+	selectRemoteOriginUsage                    *sql.Stmt
+	selectDatastoreObjects                     *sql.Stmt
 }
 
 type metadataVirtualTableWithContext struct {
@@ -89,6 +141,18 @@ func prepareMetadataVirtualTables(db *sql.DB) (*metadataVirtualTableStatements,
 	if stmts.updateQuarantineByHashAndOrigin, err = db.Prepare(updateQuarantineByHashAndOrigin); err != nil {
 		return nil, errors.New("error preparing updateQuarantineByHashAndOrigin: " + err.Error())
 	}
+	if stmts.selectStorageReport, err = db.Prepare(selectStorageReport); err != nil {
+		return nil, errors.New("error preparing selectStorageReport: " + err.Error())
+	}
+	if stmts.selectRetentionCandidates, err = db.Prepare(selectRetentionCandidates); err != nil {
+		return nil, errors.New("error preparing selectRetentionCandidates: " + err.Error())
+	}
+	if stmts.selectRemoteOriginUsage, err = db.Prepare(selectRemoteOriginUsage); err != nil {
+		return nil, errors.New("error preparing selectRemoteOriginUsage: " + err.Error())
+	}
+	if stmts.selectDatastoreObjects, err = db.Prepare(selectDatastoreObjects); err != nil {
+		return nil, errors.New("error preparing selectDatastoreObjects: " + err.Error())
+	}
 
 	return stmts, nil
 }
@@ -137,6 +201,92 @@ func (s *metadataVirtualTableWithContext) CountUsageForServer(serverName string)
 	return media, thumbs, err
 }
 
+// StorageReport groups all media by category, age, and whether it was uploaded to one of the localDomains.
+// The age thresholds are creation timestamps, newest first.
+func (s *metadataVirtualTableWithContext) StorageReport(localDomains []string, ageThresholds [4]int64) ([]*DbStorageReportRow, error) {
+	results := make([]*DbStorageReportRow, 0)
+	rows, err := s.statements.selectStorageReport.QueryContext(s.ctx, pq.Array(localDomains), ageThresholds[0], ageThresholds[1], ageThresholds[2], ageThresholds[3])
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return results, nil
+		}
+		return nil, err
+	}
+	for rows.Next() {
+		val := &DbStorageReportRow{}
+		if err = rows.Scan(&val.Category, &val.AgeBucket, &val.IsLocal, &val.Count, &val.SizeBytes); err != nil {
+			return nil, err
+		}
+		results = append(results, val)
+	}
+	return results, nil
+}
+
+// RetentionCandidates finds media created before createdBeforeTs and last accessed before accessedBeforeTs. The
+// origin scope is one of "local", "remote", or "any", using localDomains to tell them apart. Content types are
+// SQL LIKE patterns, and an empty list matches all content types.
+func (s *metadataVirtualTableWithContext) RetentionCandidates(localDomains []string, originScope string, createdBeforeTs int64, accessedBeforeTs int64, contentTypePatterns []string, minSizeBytes int64, includeQuarantined bool) ([]*DbRetentionCandidate, error) {
+	results := make([]*DbRetentionCandidate, 0)
+	rows, err := s.statements.selectRetentionCandidates.QueryContext(s.ctx, createdBeforeTs, originScope, pq.Array(localDomains), accessedBeforeTs, pq.Array(contentTypePatterns), minSizeBytes, includeQuarantined)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return results, nil
+		}
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		val := &DbRetentionCandidate{}
+		if err = rows.Scan(&val.Origin, &val.MediaId, &val.SizeBytes); err != nil {
+			return nil, err
+		}
+		results = append(results, val)
+	}
+	return results, rows.Err()
+}
+
+// RemoteOriginUsage sums the media bytes stored for each origin which isn't in localDomains.
+func (s *metadataVirtualTableWithContext) RemoteOriginUsage(localDomains []string) ([]*DbOriginUsage, error) {
+	results := make([]*DbOriginUsage, 0)
+	rows, err := s.statements.selectRemoteOriginUsage.QueryContext(s.ctx, pq.Array(localDomains))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return results, nil
+		}
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		val := &DbOriginUsage{}
+		if err = rows.Scan(&val.Origin, &val.SizeBytes); err != nil {
+			return nil, err
+		}
+		results = append(results, val)
+	}
+	return results, rows.Err()
+}
+
+// DatastoreObjects lists every object the media repo expects to find in its datastores.
+func (s *metadataVirtualTableWithContext) DatastoreObjects() ([]*DbDatastoreObject, error) {
+	results := make([]*DbDatastoreObject, 0)
+	rows, err := s.statements.selectDatastoreObjects.QueryContext(s.ctx)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return results, nil
+		}
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		val := &DbDatastoreObject{}
+		if err = rows.Scan(&val.DatastoreId, &val.Location, &val.Sha256Hash, &val.SizeBytes, &val.Kind); err != nil {
+			return nil, err
+		}
+		results = append(results, val)
+	}
+	return results, rows.Err()
+}
+
 func (s *metadataVirtualTableWithContext) UnoptimizedSynapseUserStatsPage(serverName string, orderBy SynStatUserOrderBy, startIdx int64, limit int64, fromTs int64, untilTs int64, search string, asc bool) ([]*DbSynUserStat, int64, error) {
 	sqlDir := "DESC"
 	if asc {
@@ -231,12 +381,12 @@ func (s *metadataVirtualTableWithContext) scanLastAccess(rows *sql.Rows, err err
 	return results, nil
 }
 
-func (s *metadataVirtualTableWithContext) GetMediaForDatastoreByLastAccess(datastoreId string, lastAccessTs int64) ([]*VirtLastAccess, error) {
-	return s.scanLastAccess(s.statements.selectMediaForDatastoreWithLastAccess.QueryContext(s.ctx, lastAccessTs, datastoreId))
+func (s *metadataVirtualTableWithContext) GetMediaForDatastoreByLastAccess(datastoreId string, lastAccessTs int64, filter DatastoreObjectFilter) ([]*VirtLastAccess, error) {
+	return s.scanLastAccess(s.statements.selectMediaForDatastoreWithLastAccess.QueryContext(s.ctx, lastAccessTs, datastoreId, filter.UserId, filter.MinSizeBytes, filter.MaxSizeBytes))
 }
 
-func (s *metadataVirtualTableWithContext) GetThumbnailsForDatastoreByLastAccess(datastoreId string, lastAccessTs int64) ([]*VirtLastAccess, error) {
-	return s.scanLastAccess(s.statements.selectThumbnailsForDatastoreWithLastAccess.QueryContext(s.ctx, lastAccessTs, datastoreId))
+func (s *metadataVirtualTableWithContext) GetThumbnailsForDatastoreByLastAccess(datastoreId string, lastAccessTs int64, filter DatastoreObjectFilter) ([]*VirtLastAccess, error) {
+	return s.scanLastAccess(s.statements.selectThumbnailsForDatastoreWithLastAccess.QueryContext(s.ctx, lastAccessTs, datastoreId, filter.UserId, filter.MinSizeBytes, filter.MaxSizeBytes))
 }
 
 func (s *metadataVirtualTableWithContext) UpdateQuarantineByHash(hash string, quarantined bool) (int64, error) {
@@ -254,3 +404,94 @@ func (s *metadataVirtualTableWithContext) UpdateQuarantineByHashAndOrigin(origin
 	}
 	return c.RowsAffected()
 }
+
+type UserMediaOrderBy string
+
+const (
+	UserMediaOrderByCreationTs UserMediaOrderBy = "creation_ts"
+	UserMediaOrderBySizeBytes  UserMediaOrderBy = "size_bytes"
+
+	DefaultUserMediaOrderBy = UserMediaOrderByCreationTs
+)
+
+func IsUserMediaOrderBy(orderBy UserMediaOrderBy) bool {
+	return orderBy == UserMediaOrderByCreationTs || orderBy == UserMediaOrderBySizeBytes
+}
+
+// UserMediaFilter narrows down the media returned by UserMediaPage. The zero value matches everything.
+type UserMediaFilter struct {
+	ContentTypePrefix string
+	DatastoreId       string
+}
+
+func (s *metadataVirtualTableWithContext) UserMediaPage(userId string, orderBy UserMediaOrderBy, startIdx int64, limit int64, filter UserMediaFilter, asc bool) ([]*DbMedia, int64, error) {
+	sqlDir := "DESC"
+	if asc {
+		sqlDir = "ASC"
+	}
+
+	if !IsUserMediaOrderBy(orderBy) {
+		return nil, 0, errors.New("sql injection prevented: orderBy must be recognized")
+	}
+
+	sqlParams := make([]interface{}, 0)
+	sqlWhere := make([]string, 0)
+
+	addParam := func(val interface{}) {
+		sqlParams = append(sqlParams, val)
+	}
+	addWhere := func(str string, val interface{}) {
+		addParam(val)
+		sqlWhere = append(sqlWhere, fmt.Sprintf(str, len(sqlParams)))
+	}
+
+	addWhere("user_id = $%d", userId)
+	if filter.ContentTypePrefix != "" {
+		escaped := strings.NewReplacer("\\", "\\\\", "%", "\\%", "_", "\\_").Replace(filter.ContentTypePrefix)
+		addWhere("content_type LIKE $%d", escaped+"%")
+	}
+	if filter.DatastoreId != "" {
+		addWhere("datastore_id = $%d", filter.DatastoreId)
+	}
+
+	addParam(limit)
+	sqlLimit := fmt.Sprintf("LIMIT $%d", len(sqlParams))
+	addParam(startIdx)
+	sqlOffset := fmt.Sprintf("OFFSET $%d", len(sqlParams))
+
+	sqlStart := fmt.Sprintf("FROM media WHERE %s", strings.Join(sqlWhere, " AND "))
+
+	// Media ID is a tiebreaker so pages are stable
+	sqlPageQ := fmt.Sprintf("SELECT origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, creation_ts, quarantined, datastore_id, location, original_upload_name %s ORDER BY %s %s, media_id %s %s %s;", sqlStart, orderBy, sqlDir, sqlDir, sqlLimit, sqlOffset)
+
+	results := make([]*DbMedia, 0)
+	rows, err := s.statements.db.QueryContext(s.ctx, sqlPageQ, sqlParams...)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return results, 0, nil
+		}
+		return nil, 0, err
+	}
+	for rows.Next() {
+		val := &DbMedia{Locatable: &Locatable{}}
+		err = rows.Scan(&val.Origin, &val.MediaId, &val.UploadName, &val.ContentType, &val.UserId, &val.Sha256Hash, &val.SizeBytes, &val.CreationTs, &val.Quarantined, &val.DatastoreId, &val.Location, &val.OriginalUploadName)
+		if err != nil {
+			return nil, 0, err
+		}
+		results = append(results, val)
+	}
+
+	sqlTotalQ := fmt.Sprintf("SELECT COUNT(*) %s;", sqlStart)
+	sqlParams = sqlParams[:len(sqlParams)-2] // trim off LIMIT and OFFSET values
+	row := s.statements.db.QueryRowContext(s.ctx, sqlTotalQ, sqlParams...)
+	total := int64(0)
+	err = row.Scan(&total)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return make([]*DbMedia, 0), 0, nil
+		}
+		return nil, 0, err
+	}
+
+	return results, total, nil
+}
@@ -14,17 +14,13 @@ import (
 )
 
 func BufferTemp(datastore config.DatastoreConfig, contents io.ReadCloser) (string, int64, io.ReadCloser, error) {
-	fpath := ""
-	var err error
-	if datastore.Type == "s3" {
-		fpath = datastore.Options["tempPath"]
-	} else if datastore.Type == "file" {
-		fpath, err = os.MkdirTemp(os.TempDir(), "mmr")
-		if err != nil {
-			return "", 0, nil, errors.New("error generating temporary directory: " + err.Error())
-		}
-	} else {
-		return "", 0, nil, errors.New("unknown datastore type - contact developer")
+	driver, err := getDriver(datastore)
+	if err != nil {
+		return "", 0, nil, err
+	}
+	fpath, err := driver.TempPath()
+	if err != nil {
+		return "", 0, nil, err
 	}
 
 	var target io.Writer
@@ -75,7 +71,7 @@ func BufferTemp(datastore config.DatastoreConfig, contents io.ReadCloser) (strin
 		}
 		return hash(), sizeBytes, readers.NewTempFileCloser(fpath, f.Name(), f), nil
 	} else if b, ok := target.(*bytes.Buffer); ok {
-		return hash(), sizeBytes, io.NopCloser(b), nil
+		return hash(), sizeBytes, readers.NopSeekCloser(bytes.NewReader(b.Bytes())), nil
 	} else {
 		return "", 0, nil, errors.New("developer error - did not account for possible stream writer type")
 	}
@@ -0,0 +1,21 @@
+//go:build !windows
+
+package datastores
+
+import (
+	"syscall"
+)
+
+// diskUsedPercent returns how full the filesystem holding the path is, counting space reserved for root as used.
+func diskUsedPercent(path string) (float64, error) {
+	stat := syscall.Statfs_t{}
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+	used := float64(stat.Blocks - stat.Bfree)
+	usable := used + float64(stat.Bavail)
+	if usable <= 0 {
+		return 0, nil
+	}
+	return used / usable * 100, nil
+}
@@ -0,0 +1,11 @@
+//go:build windows
+
+package datastores
+
+import (
+	"errors"
+)
+
+func diskUsedPercent(path string) (float64, error) {
+	return 0, errors.New("disk usage is not supported on this platform")
+}
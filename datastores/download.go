@@ -1,85 +1,94 @@
 package datastores
 
 import (
-	"errors"
-	"fmt"
 	"io"
-	"net/url"
-	"os"
-	"path"
-	"strings"
+	"time"
 
-	"github.com/minio/minio-go/v7"
-	"github.com/prometheus/client_golang/prometheus"
 	"github.com/t2bot/matrix-media-repo/common/config"
 	"github.com/t2bot/matrix-media-repo/common/rcontext"
-	"github.com/t2bot/matrix-media-repo/metrics"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/encryption"
 )
 
 func Download(ctx rcontext.RequestContext, ds config.DatastoreConfig, dsFileName string) (io.ReadSeekCloser, error) {
-	var err error
-	var rsc io.ReadSeekCloser
-	if ds.Type == "s3" {
-		var s3c *s3
-		s3c, err = getS3(ds)
-		if err != nil {
-			return nil, err
-		}
-
-		metrics.S3Operations.With(prometheus.Labels{"operation": "GetObject"}).Inc()
-		rsc, err = s3c.client.GetObject(ctx.Context, s3c.bucket, dsFileName, minio.GetObjectOptions{})
-	} else if ds.Type == "file" {
-		basePath := ds.Options["path"]
-
-		rsc, err = os.Open(path.Join(basePath, dsFileName))
-	} else {
-		return nil, errors.New("unknown datastore type - contact developer")
+	driver, err := getDriver(ds)
+	if err != nil {
+		return nil, err
 	}
-
-	return rsc, err
+	start := time.Now()
+	rsc, err := driver.Download(ctx, dsFileName)
+	if err = observe(ds, opDownload, start, err); err != nil {
+		return nil, err
+	}
+	return decryptIfNeeded(ctx, ds, dsFileName, rsc)
 }
 
 func DownloadOrRedirect(ctx rcontext.RequestContext, ds config.DatastoreConfig, dsFileName string) (io.ReadSeekCloser, error) {
-	if ds.Type != "s3" {
-		return Download(ctx, ds, dsFileName)
+	driver, err := getDriver(ds)
+	if err != nil {
+		return nil, err
 	}
 
-	s3c, err := getS3(ds)
+	keyId, err := getEncryptionKeyId(ctx, ds, dsFileName)
 	if err != nil {
 		return nil, err
 	}
 
-	if s3c.publicBaseUrl != "" {
-		metrics.S3Operations.With(prometheus.Labels{"operation": "RedirectGetObject"}).Inc()
-		return nil, redirect(fmt.Sprintf("%s%s", s3c.publicBaseUrl, dsFileName))
-	} else if s3c.redirectPresignURL {
-		reqParams := url.Values{}
-		presignedUrl, err := s3c.client.PresignedGetObject(ctx.Context, s3c.bucket, dsFileName, s3c.redirectPresignURLExpireTime, reqParams)
-
+	// Encrypted objects can't be served directly by the datastore, as only we can decrypt them
+	if redirector, ok := driver.(Redirector); ok && keyId == "" {
+		redirectUrl, err := redirector.RedirectUrl(ctx, dsFileName)
 		if err != nil {
 			return nil, err
 		}
-
-		if s3c.redirectDomain != "" {
-			presignedUrl.Host = strings.Replace(presignedUrl.Host, s3c.client.EndpointURL().Hostname(), s3c.redirectDomain, 1)
+		if redirectUrl != "" {
+			return nil, redirect(redirectUrl)
 		}
+	}
 
-		metrics.S3Operations.With(prometheus.Labels{"operation": "RedirectGetObject"}).Inc()
-		return nil, redirect(presignedUrl.String())
+	start := time.Now()
+	rsc, err := driver.Download(ctx, dsFileName)
+	if err = observe(ds, opDownload, start, err); err != nil {
+		return nil, err
 	}
+	return decrypt(rsc, keyId)
+}
 
-	return Download(ctx, ds, dsFileName)
+func getEncryptionKeyId(ctx rcontext.RequestContext, ds config.DatastoreConfig, dsFileName string) (string, error) {
+	return database.GetInstance().EncryptedObjects.Prepare(ctx).GetKeyId(ds.Id, dsFileName)
 }
 
-func WouldRedirectWhenCached(ctx rcontext.RequestContext, ds config.DatastoreConfig) (bool, error) {
-	if ds.Type != "s3" {
-		return false, nil
+func decryptIfNeeded(ctx rcontext.RequestContext, ds config.DatastoreConfig, dsFileName string, rsc io.ReadSeekCloser) (io.ReadSeekCloser, error) {
+	keyId, err := getEncryptionKeyId(ctx, ds, dsFileName)
+	if err != nil {
+		_ = rsc.Close()
+		return nil, err
+	}
+	return decrypt(rsc, keyId)
+}
+
+func decrypt(rsc io.ReadSeekCloser, keyId string) (io.ReadSeekCloser, error) {
+	if keyId == "" {
+		return rsc, nil
+	}
+	key, err := encryption.GetKey(keyId)
+	if err == nil {
+		var decrypted io.ReadSeekCloser
+		if decrypted, err = encryption.NewDecryptReader(rsc, key); err == nil {
+			return decrypted, nil
+		}
 	}
+	_ = rsc.Close()
+	return nil, err
+}
 
-	s3c, err := getS3(ds)
+func WouldRedirectWhenCached(ctx rcontext.RequestContext, ds config.DatastoreConfig) (bool, error) {
+	driver, err := getDriver(ds)
 	if err != nil {
 		return false, err
 	}
 
-	return s3c.redirectWhenCached && s3c.publicBaseUrl != "", nil
+	if redirector, ok := driver.(Redirector); ok {
+		return redirector.RedirectWhenCached(), nil
+	}
+	return false, nil
 }
@@ -0,0 +1,117 @@
+package datastores
+
+import (
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/faults"
+)
+
+// Driver is the storage implementation behind a datastore type. Drivers only need to move bytes around:
+// object naming, hashing, and size verification are handled by the datastores package.
+type Driver interface {
+	// Upload stores the object under (approximately) the given name, returning the location it was
+	// stored at and the number of bytes written.
+	Upload(ctx rcontext.RequestContext, objectName string, data io.Reader, size int64, contentType string) (string, int64, error)
+	// Download opens the object at the given location.
+	Download(ctx rcontext.RequestContext, location string) (io.ReadSeekCloser, error)
+	// Remove deletes the object at the given location. Objects which do not exist should not cause an error.
+	Remove(ctx rcontext.RequestContext, location string) error
+	// Uri describes where the datastore keeps its objects, for administrative purposes.
+	Uri() (string, error)
+	// Probe returns an error if the datastore is not currently usable.
+	Probe(ctx rcontext.RequestContext) error
+	// TempPath returns a directory uploads can be buffered to before being stored. An empty string causes
+	// uploads to be buffered in memory.
+	TempPath() (string, error)
+}
+
+// Redirector is optionally implemented by drivers which are able to send clients directly to an object.
+type Redirector interface {
+	// RedirectUrl returns the URL to send the client to, or an empty string if the object should be
+	// downloaded normally.
+	RedirectUrl(ctx rcontext.RequestContext, location string) (string, error)
+	// RedirectWhenCached returns true if cached downloads should be redirected rather than served.
+	RedirectWhenCached() bool
+}
+
+// LocalDisk is optionally implemented by drivers which keep data on a local disk, so the disk watermarks can
+// cover it.
+type LocalDisk interface {
+	// DiskPaths returns the local directories the driver writes to. The first path is where objects are stored,
+	// and is empty if objects are stored elsewhere. Any further paths (such as a directory uploads are buffered in)
+	// are only written to temporarily.
+	DiskPaths() []string
+}
+
+// UrlAddressable is optionally implemented by drivers whose objects can be addressed by URL. The URLs are recorded
+// in exports so the objects can be found again when importing.
+type UrlAddressable interface {
+	// ObjectUrl returns the URL for the object at the given location.
+	ObjectUrl(location string, style S3UrlStyle) string
+	// LocationFromUrl returns the location of the object the URL points to, or false if the URL does not belong to
+	// this datastore.
+	LocationFromUrl(objectUrl string) (string, bool)
+}
+
+// ObjectLister is optionally implemented by drivers which can list the objects they hold.
+type ObjectLister interface {
+	// ListObjects lists every object in the datastore. Errors encountered while listing are sent on the channel.
+	ListObjects(ctx rcontext.RequestContext) (<-chan ListedObject, error)
+}
+
+type ListedObject struct {
+	Location  string
+	SizeBytes int64
+	Err       error
+}
+
+// DriverFactory returns the Driver for the given datastore config. Factories are called for every operation
+// and are expected to cache any expensive state themselves.
+type DriverFactory func(ds config.DatastoreConfig) (Driver, error)
+
+var drivers = make(map[string]DriverFactory)
+var driversLock = new(sync.RWMutex)
+
+// Register makes a datastore type available for use in config. Panics if the type is already registered.
+func Register(dsType string, factory DriverFactory) {
+	driversLock.Lock()
+	defer driversLock.Unlock()
+	if factory == nil {
+		panic("datastores: nil factory for " + dsType)
+	}
+	if _, ok := drivers[dsType]; ok {
+		panic("datastores: type " + dsType + " is already registered")
+	}
+	drivers[dsType] = factory
+}
+
+// IsRegistered returns true if a driver has been registered for the datastore type.
+func IsRegistered(dsType string) bool {
+	driversLock.RLock()
+	defer driversLock.RUnlock()
+	_, ok := drivers[dsType]
+	return ok
+}
+
+func getDriver(ds config.DatastoreConfig) (Driver, error) {
+	d, err := lookupDriver(ds)
+	if err != nil || !faults.IsEnabled(faults.TargetDatastores) {
+		return d, err
+	}
+	return withFaults(d), nil
+}
+
+// lookupDriver returns the driver without fault injection, for inspecting which optional interfaces it implements.
+func lookupDriver(ds config.DatastoreConfig) (Driver, error) {
+	driversLock.RLock()
+	factory, ok := drivers[ds.Type]
+	driversLock.RUnlock()
+	if !ok {
+		return nil, errors.New("unknown datastore type: " + ds.Type)
+	}
+	return factory(ds)
+}
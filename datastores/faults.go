@@ -0,0 +1,54 @@
+package datastores
+
+import (
+	"io"
+
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/faults"
+)
+
+// faultyDriver injects latency and failures into a driver's operations. See the `faultInjection` config.
+type faultyDriver struct {
+	Driver
+}
+
+// faultyRedirectDriver is a faultyDriver which keeps the wrapped driver's ability to redirect.
+type faultyRedirectDriver struct {
+	faultyDriver
+	Redirector
+}
+
+func withFaults(d Driver) Driver {
+	if r, ok := d.(Redirector); ok {
+		return &faultyRedirectDriver{faultyDriver: faultyDriver{Driver: d}, Redirector: r}
+	}
+	return &faultyDriver{Driver: d}
+}
+
+func (f *faultyDriver) Upload(ctx rcontext.RequestContext, objectName string, data io.Reader, size int64, contentType string) (string, int64, error) {
+	if err := faults.Inject(faults.TargetDatastores); err != nil {
+		return "", 0, err
+	}
+	return f.Driver.Upload(ctx, objectName, data, size, contentType)
+}
+
+func (f *faultyDriver) Download(ctx rcontext.RequestContext, location string) (io.ReadSeekCloser, error) {
+	if err := faults.Inject(faults.TargetDatastores); err != nil {
+		return nil, err
+	}
+	return f.Driver.Download(ctx, location)
+}
+
+func (f *faultyDriver) Remove(ctx rcontext.RequestContext, location string) error {
+	if err := faults.Inject(faults.TargetDatastores); err != nil {
+		return err
+	}
+	return f.Driver.Remove(ctx, location)
+}
+
+func (f *faultyDriver) Probe(ctx rcontext.RequestContext) error {
+	if err := faults.Inject(faults.TargetDatastores); err != nil {
+		return err
+	}
+	return f.Driver.Probe(ctx)
+}
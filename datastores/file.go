@@ -0,0 +1,86 @@
+package datastores
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path"
+
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/util/readers"
+)
+
+type file struct {
+	basePath string
+}
+
+func init() {
+	Register("file", func(ds config.DatastoreConfig) (Driver, error) {
+		return &file{basePath: ds.Options["path"]}, nil
+	})
+}
+
+func (f *file) Upload(ctx rcontext.RequestContext, objectName string, data io.Reader, size int64, contentType string) (string, int64, error) {
+	firstContainer := objectName[0:2]
+	secondContainer := objectName[2:4]
+	fileName := objectName[4:]
+	location := path.Join(firstContainer, secondContainer, fileName)
+	targetDir := path.Join(f.basePath, firstContainer, secondContainer)
+	targetFile := path.Join(targetDir, fileName)
+
+	// Persist file
+	if err := os.MkdirAll(targetDir, 0755); err != nil {
+		return "", 0, err
+	}
+	fh, err := os.OpenFile(targetFile, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return "", 0, err
+	}
+	uploadedBytes, err := io.Copy(fh, readers.NewContextReader(ctx.Context, data))
+	if err != nil {
+		_ = fh.Close()
+		_ = os.Remove(targetFile)
+		return "", 0, err
+	}
+	return location, uploadedBytes, fh.Close()
+}
+
+func (f *file) Download(ctx rcontext.RequestContext, location string) (io.ReadSeekCloser, error) {
+	return os.Open(path.Join(f.basePath, location))
+}
+
+func (f *file) Remove(ctx rcontext.RequestContext, location string) error {
+	err := os.Remove(path.Join(f.basePath, location))
+	if err != nil && os.IsNotExist(err) {
+		return nil // not existing means it was deleted, as far as we care
+	}
+	return err
+}
+
+func (f *file) Uri() (string, error) {
+	return f.basePath, nil
+}
+
+func (f *file) Probe(ctx rcontext.RequestContext) error {
+	info, err := os.Stat(f.basePath)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return errors.New("path is not a directory")
+	}
+	return nil
+}
+
+func (f *file) DiskPaths() []string {
+	return []string{f.basePath}
+}
+
+func (f *file) TempPath() (string, error) {
+	fpath, err := os.MkdirTemp(os.TempDir(), "mmr")
+	if err != nil {
+		return "", errors.New("error generating temporary directory: " + err.Error())
+	}
+	return fpath, nil
+}
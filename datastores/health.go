@@ -0,0 +1,40 @@
+package datastores
+
+import (
+	"time"
+
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+)
+
+type HealthStatus struct {
+	Healthy       bool   `json:"healthy"`
+	LatencyMs     int64  `json:"latency_ms"`
+	Error         string `json:"error,omitempty"`
+	SelfTestError string `json:"self_test_error,omitempty"`
+}
+
+// CheckHealth probes the datastore to ensure it is reachable: file datastores must have an accessible
+// directory, and S3 datastores must be able to see their bucket.
+func CheckHealth(ctx rcontext.RequestContext, ds config.DatastoreConfig) *HealthStatus {
+	start := time.Now()
+	err := probe(ctx, ds)
+	status := &HealthStatus{
+		Healthy:       err == nil && IsHealthy(ds.Id),
+		LatencyMs:     time.Since(start).Milliseconds(),
+		SelfTestError: SelfTestError(ds.Id),
+	}
+	if err != nil {
+		status.Error = err.Error()
+	}
+	return status
+}
+
+func probe(ctx rcontext.RequestContext, ds config.DatastoreConfig) error {
+	driver, err := getDriver(ds)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	return observe(ds, opStat, start, driver.Probe(ctx))
+}
@@ -2,7 +2,6 @@ package datastores
 
 import (
 	"errors"
-	"fmt"
 
 	"github.com/t2bot/matrix-media-repo/common/config"
 	"github.com/t2bot/matrix-media-repo/common/rcontext"
@@ -23,26 +22,37 @@ type SizeEstimate struct {
 }
 
 func GetUri(ds config.DatastoreConfig) (string, error) {
-	if ds.Type == "s3" {
-		s3c, err := getS3(ds)
-		if err != nil {
-			return "", err
-		}
-		return fmt.Sprintf("s3://%s/%s", s3c.client.EndpointURL().Hostname(), s3c.bucket), nil
-	} else if ds.Type == "file" {
-		return ds.Options["path"], nil
-	} else {
-		return "", errors.New("unknown datastore type - contact developer")
+	driver, err := getDriver(ds)
+	if err != nil {
+		return "", err
+	}
+	return driver.Uri()
+}
+
+// ListObjects lists every object in the datastore. Returns an error if the datastore's driver can't list objects.
+func ListObjects(ctx rcontext.RequestContext, ds config.DatastoreConfig) (<-chan ListedObject, error) {
+	driver, err := lookupDriver(ds)
+	if err != nil {
+		return nil, err
+	}
+	lister, ok := driver.(ObjectLister)
+	if !ok {
+		return nil, errors.New("datastore type " + ds.Type + " can't list its objects")
 	}
+	return lister.ListObjects(ctx)
 }
 
 func SizeOfDsIdWithAge(ctx rcontext.RequestContext, dsId string, beforeTs int64) (*SizeEstimate, error) {
+	return SizeOfDsIdWithFilter(ctx, dsId, beforeTs, database.DatastoreObjectFilter{})
+}
+
+func SizeOfDsIdWithFilter(ctx rcontext.RequestContext, dsId string, beforeTs int64, filter database.DatastoreObjectFilter) (*SizeEstimate, error) {
 	db := database.GetInstance().MetadataView.Prepare(ctx)
-	media, err := db.GetMediaForDatastoreByLastAccess(dsId, beforeTs)
+	media, err := db.GetMediaForDatastoreByLastAccess(dsId, beforeTs, filter)
 	if err != nil {
 		return nil, err
 	}
-	thumbs, err := db.GetThumbnailsForDatastoreByLastAccess(dsId, beforeTs)
+	thumbs, err := db.GetThumbnailsForDatastoreByLastAccess(dsId, beforeTs, filter)
 	if err != nil {
 		return nil, err
 	}
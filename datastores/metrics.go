@@ -0,0 +1,88 @@
+package datastores
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/metrics"
+)
+
+const (
+	opUpload   = "upload"
+	opDownload = "download"
+	opDelete   = "delete"
+	opStat     = "stat"
+)
+
+const (
+	errClassNone     = "none"
+	errClassTimeout  = "timeout"
+	errClassCanceled = "canceled"
+	errClassAuth     = "auth"
+	errClassNotFound = "notfound"
+	errClassOther    = "other"
+)
+
+// observe records the outcome of a datastore operation which started at the given time. The error is
+// returned unchanged for convenience.
+func observe(ds config.DatastoreConfig, operation string, start time.Time, err error) error {
+	metrics.DatastoreOperationTime.With(prometheus.Labels{
+		"datastore": ds.Id,
+		"operation": operation,
+	}).Observe(time.Since(start).Seconds())
+	metrics.DatastoreOperations.With(prometheus.Labels{
+		"datastore":   ds.Id,
+		"operation":   operation,
+		"error_class": classifyError(err),
+	}).Inc()
+	return err
+}
+
+func classifyError(err error) string {
+	if err == nil {
+		return errClassNone
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return errClassTimeout
+	}
+	if errors.Is(err, context.Canceled) {
+		return errClassCanceled
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return errClassTimeout
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		return errClassNotFound
+	}
+	if errors.Is(err, fs.ErrPermission) {
+		return errClassAuth
+	}
+
+	s3err := minio.ToErrorResponse(err)
+	switch s3err.Code {
+	case "NoSuchKey", "NoSuchBucket":
+		return errClassNotFound
+	case "AccessDenied", "InvalidAccessKeyId", "SignatureDoesNotMatch", "ExpiredToken":
+		return errClassAuth
+	case "RequestTimeout":
+		return errClassTimeout
+	}
+	switch s3err.StatusCode {
+	case http.StatusNotFound:
+		return errClassNotFound
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return errClassAuth
+	case http.StatusRequestTimeout, http.StatusGatewayTimeout:
+		return errClassTimeout
+	}
+
+	return errClassOther
+}
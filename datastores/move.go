@@ -0,0 +1,43 @@
+package datastores
+
+import (
+	"errors"
+
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+)
+
+// Move copies an object from one datastore to another, points all media and thumbnail records at the new copy,
+// then removes the original object. Returns the new location of the object.
+func Move(ctx rcontext.RequestContext, sourceDs config.DatastoreConfig, targetDs config.DatastoreConfig, location string, sizeBytes int64, contentType string, sha256hash string) (string, error) {
+	if sourceDs.Id == targetDs.Id {
+		return "", errors.New("source and target datastores are the same")
+	}
+
+	mediaDb := database.GetInstance().Media.Prepare(ctx)
+	thumbsDb := database.GetInstance().Thumbnails.Prepare(ctx)
+
+	sourceStream, err := Download(ctx, sourceDs, location)
+	if err != nil {
+		return "", errors.Join(errors.New("failed to start download from source"), err)
+	}
+
+	newLocation, err := Upload(ctx, targetDs, sourceStream, sizeBytes, contentType, sha256hash)
+	if err != nil {
+		return "", errors.Join(errors.New("failed to upload to target"), err)
+	}
+
+	if err = mediaDb.UpdateLocation(sourceDs.Id, location, targetDs.Id, newLocation); err != nil {
+		return "", errors.Join(errors.New("failed to update media table with new datastore and location"), err)
+	}
+	if err = thumbsDb.UpdateLocation(sourceDs.Id, location, targetDs.Id, newLocation); err != nil {
+		return "", errors.Join(errors.New("failed to update thumbnails table with new datastore and location"), err)
+	}
+
+	if err = Remove(ctx, sourceDs, location); err != nil {
+		return "", errors.Join(errors.New("failed to remove source object from datastore"), err)
+	}
+
+	return newLocation, nil
+}
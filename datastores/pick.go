@@ -2,6 +2,7 @@ package datastores
 
 import (
 	"errors"
+	"slices"
 
 	"github.com/t2bot/matrix-media-repo/common/config"
 	"github.com/t2bot/matrix-media-repo/common/rcontext"
@@ -9,11 +10,23 @@ import (
 )
 
 func Pick(ctx rcontext.RequestContext, kind Kind) (config.DatastoreConfig, error) {
+	return PickExcluding(ctx, kind, nil)
+}
+
+// PickExcluding is the same as Pick, but never returns one of the excluded datastore IDs.
+func PickExcluding(ctx rcontext.RequestContext, kind Kind, excludeIds []string) (config.DatastoreConfig, error) {
 	usable := make([]config.DatastoreConfig, 0)
 	for _, conf := range ctx.Config.DataStores {
 		if !HasListedKind(conf.MediaKinds, kind) {
 			continue
 		}
+		if slices.Contains(excludeIds, conf.Id) {
+			continue
+		}
+		if !IsHealthy(conf.Id) {
+			ctx.Log.Debugf("Skipping datastore %s because it failed its self test", conf.Id)
+			continue
+		}
 		usable = append(usable, conf)
 	}
 
@@ -1,8 +1,20 @@
 package datastores
 
 import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -10,15 +22,25 @@ import (
 
 	"github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/minio/minio-go/v7/pkg/encrypt"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
 	"github.com/t2bot/matrix-media-repo/common/config"
 	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/metrics"
 )
 
-var s3clients = &sync.Map{}
+// defaultS3DownloadChunkBytes is how much of an object is requested from S3 at a time when downloading.
+const defaultS3DownloadChunkBytes = 8 * 1024 * 1024
+
+var s3clients = make(map[string]*s3)
+var s3clientsLock = new(sync.RWMutex)
 
 type s3 struct {
 	client                       *minio.Client
+	transport                    *http.Transport
+	fingerprint                  string
+	bucketLookup                 minio.BucketLookupType
 	storageClass                 string
 	bucket                       string
 	publicBaseUrl                string
@@ -28,17 +50,72 @@ type s3 struct {
 	redirectDomain               string
 	redirectPresignURL           bool
 	redirectPresignURLExpireTime time.Duration
+	tempPath                     string
+	sse                          encrypt.ServerSide
+	downloadChunkBytes           int64
+}
+
+func init() {
+	Register("s3", func(ds config.DatastoreConfig) (Driver, error) {
+		return getS3(ds)
+	})
 }
 
 func ResetS3Clients() {
-	s3clients = &sync.Map{}
+	s3clientsLock.Lock()
+	defer s3clientsLock.Unlock()
+	for _, s3c := range s3clients {
+		s3c.transport.CloseIdleConnections()
+	}
+	s3clients = make(map[string]*s3)
+}
+
+// s3Fingerprint identifies the options a client was built with, so a changed config gets a fresh client.
+func s3Fingerprint(ds config.DatastoreConfig) string {
+	keys := make([]string, 0, len(ds.Options))
+	for k := range ds.Options {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	hasher := sha256.New()
+	for _, k := range keys {
+		hasher.Write([]byte(k + "=" + ds.Options[k] + "\n"))
+	}
+	return hex.EncodeToString(hasher.Sum(nil))
 }
 
 func getS3(ds config.DatastoreConfig) (*s3, error) {
-	if val, ok := s3clients.Load(ds.Id); ok {
-		return val.(*s3), nil
+	fingerprint := s3Fingerprint(ds)
+
+	s3clientsLock.RLock()
+	val, ok := s3clients[ds.Id]
+	s3clientsLock.RUnlock()
+	if ok && val.fingerprint == fingerprint {
+		return val, nil
+	}
+
+	s3clientsLock.Lock()
+	defer s3clientsLock.Unlock()
+
+	// Another request may have created the client while we were waiting for the lock
+	val, ok = s3clients[ds.Id]
+	if ok && val.fingerprint == fingerprint {
+		return val, nil
 	}
 
+	s3c, err := newS3(ds, fingerprint)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		logrus.Infof("Configuration for datastore %s changed - recreating S3 client", ds.Id)
+		val.transport.CloseIdleConnections()
+	}
+	s3clients[ds.Id] = s3c
+	return s3c, nil
+}
+
+func newS3(ds config.DatastoreConfig, fingerprint string) (*s3, error) {
 	endpoint := ds.Options["endpoint"]
 	bucket := ds.Options["bucketName"]
 	accessKeyId := ds.Options["accessKeyId"]
@@ -100,6 +177,13 @@ func getS3(ds config.DatastoreConfig) (*s3, error) {
 		}
 	}
 
+	forcePathStyleStr, hasForcePathStyle := ds.Options["forcePathStyle"]
+	if hasForcePathStyle && forcePathStyleStr != "" {
+		if forcePathStyle, _ := strconv.ParseBool(forcePathStyleStr); forcePathStyle {
+			bucketLookup = minio.BucketLookupPath
+		}
+	}
+
 	useRedirectPresignURL := false
 	if hasRedirectPresignURL && useRedirectPresignURLStr != "" {
 		useRedirectPresignURL, _ = strconv.ParseBool(useRedirectPresignURLStr)
@@ -116,20 +200,58 @@ func getS3(ds config.DatastoreConfig) (*s3, error) {
 		}
 	}
 
-	var err error
+	transport, err := minio.DefaultTransport(useSsl)
+	if err != nil {
+		return nil, err
+	}
+	transport.MaxIdleConns = parseS3IntOption(ds, "maxIdleConns", transport.MaxIdleConns)
+	transport.MaxIdleConnsPerHost = parseS3IntOption(ds, "maxIdleConnsPerHost", transport.MaxIdleConnsPerHost)
+	transport.IdleConnTimeout = parseS3DurationOption(ds, "idleConnTimeout", transport.IdleConnTimeout)
+	transport.ResponseHeaderTimeout = parseS3DurationOption(ds, "responseHeaderTimeout", transport.ResponseHeaderTimeout)
+	transport.TLSHandshakeTimeout = parseS3DurationOption(ds, "tlsHandshakeTimeout", transport.TLSHandshakeTimeout)
+	if useSsl {
+		if err = configureS3Tls(ds, transport); err != nil {
+			return nil, err
+		}
+	}
+	dialTimeout := parseS3DurationOption(ds, "dialTimeout", 30*time.Second)
+	transport.DialContext = (&net.Dialer{
+		Timeout:   dialTimeout,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+
+	sse, err := parseS3Encryption(ds)
+	if err != nil {
+		return nil, err
+	}
+	if sse != nil && sse.Type() == encrypt.SSEC && (publicBaseUrl != "" || useRedirectPresignURL) {
+		logrus.Warnf("Datastore %s uses customer-provided encryption keys, which clients can't be redirected with - redirects are disabled", ds.Id)
+		publicBaseUrl = ""
+		useRedirectPresignURL = false
+	}
+
 	var client *minio.Client
 	client, err = minio.New(endpoint, &minio.Options{
 		Region:       region,
 		Secure:       useSsl,
 		Creds:        credentials.NewStaticV4(accessKeyId, accessSecret, ""),
 		BucketLookup: bucketLookup,
+		Transport:    transport,
 	})
 	if err != nil {
 		return nil, err
 	}
+	if traceStr, hasTrace := ds.Options["trace"]; hasTrace && traceStr != "" {
+		if trace, _ := strconv.ParseBool(traceStr); trace {
+			client.TraceOn(logrus.WithField("datastore", ds.Id).WriterLevel(logrus.DebugLevel))
+		}
+	}
 
 	s3c := &s3{
 		client:                       client,
+		transport:                    transport,
+		fingerprint:                  fingerprint,
+		bucketLookup:                 bucketLookup,
 		storageClass:                 storageClass,
 		bucket:                       bucket,
 		publicBaseUrl:                publicBaseUrl,
@@ -139,62 +261,196 @@ func getS3(ds config.DatastoreConfig) (*s3, error) {
 		redirectDomain:               redirectDomain,
 		redirectPresignURL:           useRedirectPresignURL,
 		redirectPresignURLExpireTime: redirectPresignURLExpireTime,
+		tempPath:                     ds.Options["tempPath"],
+		sse:                          sse,
+		downloadChunkBytes:           int64(parseS3IntOption(ds, "downloadChunkBytes", defaultS3DownloadChunkBytes)),
 	}
-	s3clients.Store(ds.Id, s3c)
 	return s3c, nil
 }
 
-func ListS3Files(ctx rcontext.RequestContext, ds config.DatastoreConfig) (<-chan minio.ObjectInfo, error) {
-	if ds.Type != "s3" {
-		return nil, errors.New("not an S3 datastore")
-	}
-	s3c, err := getS3(ds)
-	if err != nil {
-		return nil, err
+func (s *s3) Upload(ctx rcontext.RequestContext, objectName string, data io.Reader, size int64, contentType string) (string, int64, error) {
+	if s.prefixLength > 0 {
+		objectName = objectName[:s.prefixLength] + "/" + objectName[s.prefixLength:]
 	}
-	return s3c.client.ListObjects(ctx.Context, s3c.bucket, minio.ListObjectsOptions{
-		Recursive: false,
-	}), nil
+
+	metrics.S3Operations.With(prometheus.Labels{"operation": "PutObject"}).Inc()
+	info, err := s.client.PutObject(ctx.Context, s.bucket, objectName, data, size, minio.PutObjectOptions{
+		StorageClass:         s.storageClass,
+		ContentType:          contentType,
+		DisableMultipart:     !s.multipartUploads,
+		ServerSideEncryption: s.sse,
+	})
+	return objectName, info.Size, err
 }
 
-func GetS3Url(ds config.DatastoreConfig, location string) (string, error) {
-	if ds.Type != "s3" {
-		return "", nil
+func (s *s3) Download(ctx rcontext.RequestContext, location string) (io.ReadSeekCloser, error) {
+	if s.downloadChunkBytes > 0 {
+		return newS3ChunkedReader(ctx.Context, s, location, s.downloadChunkBytes), nil
 	}
+	metrics.S3Operations.With(prometheus.Labels{"operation": "GetObject"}).Inc()
+	// Only customer-provided keys need to be supplied on download: the other types are decrypted by S3
+	return s.client.GetObject(ctx.Context, s.bucket, location, minio.GetObjectOptions{ServerSideEncryption: s.sse})
+}
 
-	s3c, err := getS3(ds)
+func (s *s3) Remove(ctx rcontext.RequestContext, location string) error {
+	metrics.S3Operations.With(prometheus.Labels{"operation": "RemoveObject"}).Inc()
+	return s.client.RemoveObject(ctx.Context, s.bucket, location, minio.RemoveObjectOptions{})
+}
+
+func (s *s3) Uri() (string, error) {
+	return fmt.Sprintf("s3://%s/%s", s.client.EndpointURL().Hostname(), s.bucket), nil
+}
+
+func (s *s3) Probe(ctx rcontext.RequestContext) error {
+	metrics.S3Operations.With(prometheus.Labels{"operation": "BucketExists"}).Inc()
+	exists, err := s.client.BucketExists(ctx.Context, s.bucket)
 	if err != nil {
-		return "", err
+		return err
+	}
+	if !exists {
+		return errors.New("bucket does not exist")
 	}
+	return nil
+}
 
-	// HACK: Surely there's a better way...
-	return fmt.Sprintf("%s/%s/%s", s3c.client.EndpointURL(), s3c.bucket, location), nil
+func (s *s3) TempPath() (string, error) {
+	return s.tempPath, nil
 }
 
-func ParseS3Url(s3url string) (config.DatastoreConfig, string, error) {
-	parts := strings.Split(s3url[len("https://"):], "/")
-	if len(parts) < 3 {
-		return config.DatastoreConfig{}, "", errors.New("invalid url")
-	}
+func (s *s3) DiskPaths() []string {
+	return []string{"", s.tempPath}
+}
 
-	endpoint := parts[0]
-	location := parts[len(parts)-1]
-	bucket := strings.Join(parts[1:len(parts)-1], "/")
+func (s *s3) RedirectUrl(ctx rcontext.RequestContext, location string) (string, error) {
+	if s.publicBaseUrl != "" {
+		metrics.S3Operations.With(prometheus.Labels{"operation": "RedirectGetObject"}).Inc()
+		return fmt.Sprintf("%s%s", s.publicBaseUrl, location), nil
+	} else if s.redirectPresignURL {
+		reqParams := url.Values{}
+		presignedUrl, err := s.client.PresignedGetObject(ctx.Context, s.bucket, location, s.redirectPresignURLExpireTime, reqParams)
+		if err != nil {
+			return "", err
+		}
 
-	for _, c := range config.Get().DataStores {
-		if c.Type != "s3" {
-			continue
+		if s.redirectDomain != "" {
+			presignedUrl.Host = strings.Replace(presignedUrl.Host, s.client.EndpointURL().Hostname(), s.redirectDomain, 1)
 		}
 
-		s3c, err := getS3(c)
+		metrics.S3Operations.With(prometheus.Labels{"operation": "RedirectGetObject"}).Inc()
+		return presignedUrl.String(), nil
+	}
+	return "", nil
+}
+
+func (s *s3) RedirectWhenCached() bool {
+	return s.redirectWhenCached && s.publicBaseUrl != ""
+}
+
+func configureS3Tls(ds config.DatastoreConfig, transport *http.Transport) error {
+	if transport.TLSClientConfig == nil {
+		transport.TLSClientConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+
+	if caCertPath := ds.Options["caCertPath"]; caCertPath != "" {
+		pem, err := os.ReadFile(caCertPath)
 		if err != nil {
-			return config.DatastoreConfig{}, "", err
+			return errors.New("error reading caCertPath for datastore " + ds.Id + ": " + err.Error())
 		}
+		rootCAs := transport.TLSClientConfig.RootCAs
+		if rootCAs == nil {
+			rootCAs, err = x509.SystemCertPool()
+			if err != nil {
+				rootCAs = x509.NewCertPool()
+			}
+		}
+		if !rootCAs.AppendCertsFromPEM(pem) {
+			return errors.New("no certificates found in caCertPath for datastore " + ds.Id)
+		}
+		transport.TLSClientConfig.RootCAs = rootCAs
+	}
 
-		if s3c.client.EndpointURL().Host == endpoint && s3c.bucket == bucket {
-			return c, location, nil
+	skipVerifyStr, hasSkipVerify := ds.Options["insecureSkipVerify"]
+	if hasSkipVerify && skipVerifyStr != "" {
+		if skipVerify, _ := strconv.ParseBool(skipVerifyStr); skipVerify {
+			logrus.Warnf("TLS certificate verification is disabled for datastore %s - this is insecure", ds.Id)
+			transport.TLSClientConfig.InsecureSkipVerify = true
 		}
 	}
 
-	return config.DatastoreConfig{}, "", errors.New("could not locate datastore")
+	return nil
+}
+
+// parseS3Encryption returns the server-side encryption to apply to objects, or nil if objects are stored as the
+// bucket's default.
+func parseS3Encryption(ds config.DatastoreConfig) (encrypt.ServerSide, error) {
+	switch strings.ToLower(ds.Options["serverSideEncryption"]) {
+	case "", "none":
+		return nil, nil
+	case "sse-s3":
+		return encrypt.NewSSE(), nil
+	case "sse-kms":
+		var kmsContext interface{}
+		if contextStr := ds.Options["sseKmsContext"]; contextStr != "" {
+			if err := json.Unmarshal([]byte(contextStr), &kmsContext); err != nil {
+				return nil, errors.New("invalid sseKmsContext for datastore " + ds.Id + ": " + err.Error())
+			}
+		}
+		sse, err := encrypt.NewSSEKMS(ds.Options["sseKmsKeyId"], kmsContext)
+		if err != nil {
+			return nil, errors.New("invalid SSE-KMS options for datastore " + ds.Id + ": " + err.Error())
+		}
+		return sse, nil
+	case "sse-c":
+		key, err := base64.StdEncoding.DecodeString(ds.Options["sseCustomerKey"])
+		if err != nil {
+			return nil, errors.New("invalid sseCustomerKey for datastore " + ds.Id + ": " + err.Error())
+		}
+		sse, err := encrypt.NewSSEC(key)
+		if err != nil {
+			return nil, errors.New("invalid sseCustomerKey for datastore " + ds.Id + ": " + err.Error())
+		}
+		return sse, nil
+	default:
+		return nil, errors.New("unknown serverSideEncryption for datastore " + ds.Id + ": " + ds.Options["serverSideEncryption"])
+	}
+}
+
+func parseS3IntOption(ds config.DatastoreConfig, key string, def int) int {
+	str, ok := ds.Options[key]
+	if !ok || str == "" {
+		return def
+	}
+	val, err := strconv.Atoi(str)
+	if err != nil || val < 0 {
+		logrus.Warnf("Invalid %s for datastore %s: %s - using default %d", key, ds.Id, str, def)
+		return def
+	}
+	return val
+}
+
+func parseS3DurationOption(ds config.DatastoreConfig, key string, def time.Duration) time.Duration {
+	str, ok := ds.Options[key]
+	if !ok || str == "" {
+		return def
+	}
+	val, err := time.ParseDuration(str)
+	if err != nil || val < 0 {
+		logrus.Warnf("Invalid %s for datastore %s: %s - using default %s", key, ds.Id, str, def)
+		return def
+	}
+	return val
+}
+
+func (s *s3) ListObjects(ctx rcontext.RequestContext) (<-chan ListedObject, error) {
+	objects := s.client.ListObjects(ctx.Context, s.bucket, minio.ListObjectsOptions{
+		Recursive: false,
+	})
+	ch := make(chan ListedObject)
+	go func() {
+		defer close(ch)
+		for object := range objects {
+			ch <- ListedObject{Location: object.Key, SizeBytes: object.Size, Err: object.Err}
+		}
+	}()
+	return ch, nil
 }
@@ -0,0 +1,149 @@
+package datastores
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/t2bot/matrix-media-repo/metrics"
+)
+
+// s3ChunkedReader reads an object with one ranged request per chunk, only requesting the next chunk once the
+// previous one has been read. This keeps S3 from sending much more of the object than the reader has consumed,
+// so slow clients hold back the download, and disconnected clients stop it.
+type s3ChunkedReader struct {
+	s         *s3
+	location  string
+	chunkSize int64
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mutex    sync.Mutex
+	offset   int64
+	chunk    *minio.Object
+	chunkEnd int64
+	eof      bool
+	closed   bool
+}
+
+func newS3ChunkedReader(ctx context.Context, s *s3, location string, chunkSize int64) *s3ChunkedReader {
+	ctx, cancel := context.WithCancel(ctx)
+	return &s3ChunkedReader{
+		s:         s,
+		location:  location,
+		chunkSize: chunkSize,
+		ctx:       ctx,
+		cancel:    cancel,
+	}
+}
+
+func (r *s3ChunkedReader) Read(p []byte) (int, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.closed {
+		return 0, io.ErrClosedPipe
+	}
+	for {
+		if r.chunk == nil {
+			if r.eof {
+				return 0, io.EOF
+			}
+			if err := r.openChunk(); err != nil {
+				return 0, err
+			}
+		}
+
+		n, err := r.chunk.Read(p)
+		r.offset += int64(n)
+		if errors.Is(err, io.EOF) {
+			r.closeChunk()
+			// A short chunk means the object ended within it
+			r.eof = r.offset < r.chunkEnd
+			if n > 0 || r.eof {
+				return n, nil
+			}
+			continue
+		}
+		if err != nil && minio.ToErrorResponse(err).Code == "InvalidRange" {
+			// The previous chunk ended exactly at the end of the object
+			r.closeChunk()
+			r.eof = true
+			return n, io.EOF
+		}
+		return n, err
+	}
+}
+
+func (r *s3ChunkedReader) openChunk() error {
+	opts := minio.GetObjectOptions{ServerSideEncryption: r.s.sse}
+	if err := opts.SetRange(r.offset, r.offset+r.chunkSize-1); err != nil {
+		return err
+	}
+	metrics.S3Operations.With(prometheus.Labels{"operation": "GetObject"}).Inc()
+	chunk, err := r.s.client.GetObject(r.ctx, r.s.bucket, r.location, opts)
+	if err != nil {
+		return err
+	}
+	r.chunk = chunk
+	r.chunkEnd = r.offset + r.chunkSize
+	return nil
+}
+
+func (r *s3ChunkedReader) closeChunk() {
+	if r.chunk != nil {
+		_ = r.chunk.Close()
+		r.chunk = nil
+	}
+}
+
+func (r *s3ChunkedReader) Seek(offset int64, whence int) (int64, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.closed {
+		return 0, io.ErrClosedPipe
+	}
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		metrics.S3Operations.With(prometheus.Labels{"operation": "StatObject"}).Inc()
+		info, err := r.s.client.StatObject(r.ctx, r.s.bucket, r.location, minio.StatObjectOptions{ServerSideEncryption: r.s.sse})
+		if err != nil {
+			return r.offset, err
+		}
+		offset += info.Size
+	default:
+		return r.offset, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return r.offset, errors.New("negative position")
+	}
+
+	// Seeking to where we already are is common (shared readers do it before every read), and shouldn't cost a request
+	if offset != r.offset {
+		r.closeChunk()
+		r.offset = offset
+		r.eof = false
+	}
+	return r.offset, nil
+}
+
+func (r *s3ChunkedReader) Close() error {
+	r.cancel() // abort anything still in flight, before waiting for a blocked read to notice
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	r.closeChunk()
+	return nil
+}
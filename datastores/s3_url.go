@@ -0,0 +1,116 @@
+package datastores
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/s3utils"
+	"github.com/t2bot/matrix-media-repo/common/config"
+)
+
+type S3UrlStyle int
+
+const (
+	// S3UrlDirect addresses the object on the S3 endpoint itself, using the datastore's addressing style. These
+	// URLs can be parsed back into a datastore and location with ParseS3Url.
+	S3UrlDirect S3UrlStyle = iota
+	// S3UrlPublic is the URL a client would be sent to: the publicBaseUrl if set, otherwise the direct URL with
+	// the redirectDomain (CDN) applied.
+	S3UrlPublic
+)
+
+func (s *s3) isVirtualHostStyle() bool {
+	if s.bucketLookup == minio.BucketLookupDNS {
+		return true
+	}
+	if s.bucketLookup == minio.BucketLookupPath {
+		return false
+	}
+	return s3utils.IsVirtualHostSupported(*s.client.EndpointURL(), s.bucket)
+}
+
+func (s *s3) ObjectUrl(location string, style S3UrlStyle) string {
+	if style == S3UrlPublic && s.publicBaseUrl != "" {
+		return s.publicBaseUrl + location // same format as redirects
+	}
+
+	endpoint := s.client.EndpointURL()
+	u := &url.URL{
+		Scheme: endpoint.Scheme, // honours the `ssl` option
+		Host:   endpoint.Host,
+	}
+	if s.isVirtualHostStyle() {
+		u.Host = s.bucket + "." + endpoint.Host
+		u.Path = "/" + location
+	} else {
+		u.Path = "/" + s.bucket + "/" + location
+	}
+	if style == S3UrlPublic && s.redirectDomain != "" {
+		u.Host = strings.Replace(u.Host, endpoint.Hostname(), s.redirectDomain, 1)
+	}
+	return u.String()
+}
+
+// LocationFromUrl accepts direct URLs for the datastore. Path-style URLs are always accepted, as older archives were
+// written with them regardless of the datastore's addressing style.
+func (s *s3) LocationFromUrl(objectUrl string) (string, bool) {
+	endpoint := s.client.EndpointURL()
+	prefixes := []string{
+		s.ObjectUrl("", S3UrlDirect),
+		endpoint.Host + "/" + s.bucket + "/", // legacy, scheme-less to accept either
+	}
+	trimmed := strings.TrimPrefix(strings.TrimPrefix(objectUrl, "https://"), "http://")
+	for i, prefix := range prefixes {
+		candidate := objectUrl
+		if i > 0 {
+			candidate = trimmed
+		}
+		if location, found := strings.CutPrefix(candidate, prefix); found && location != "" {
+			if unescaped, err := url.PathUnescape(location); err == nil {
+				location = unescaped
+			}
+			return location, true
+		}
+	}
+	return "", false
+}
+
+// BuildS3Url returns the URL for an object in a datastore whose objects are addressable by URL, such as S3. Returns
+// an empty string for other datastores.
+func BuildS3Url(ds config.DatastoreConfig, location string, style S3UrlStyle) (string, error) {
+	driver, err := lookupDriver(ds)
+	if err != nil {
+		return "", err
+	}
+	addressable, ok := driver.(UrlAddressable)
+	if !ok {
+		return "", nil
+	}
+	return addressable.ObjectUrl(location, style), nil
+}
+
+// GetS3Url returns the direct URL for an object in a datastore, suitable for ParseS3Url.
+func GetS3Url(ds config.DatastoreConfig, location string) (string, error) {
+	return BuildS3Url(ds, location, S3UrlDirect)
+}
+
+// ParseS3Url finds the datastore and location for a direct URL returned by GetS3Url.
+func ParseS3Url(objectUrl string) (config.DatastoreConfig, string, error) {
+	for _, c := range config.Get().DataStores {
+		driver, err := lookupDriver(c)
+		if err != nil {
+			return config.DatastoreConfig{}, "", err
+		}
+		addressable, ok := driver.(UrlAddressable)
+		if !ok {
+			continue
+		}
+		if location, found := addressable.LocationFromUrl(objectUrl); found {
+			return c, location, nil
+		}
+	}
+
+	return config.DatastoreConfig{}, "", errors.New("could not locate datastore")
+}
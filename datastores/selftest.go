@@ -0,0 +1,151 @@
+package datastores
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/util/ids"
+)
+
+var unhealthy = new(sync.Map) // datastore ID -> self test error
+var selfTestLock = new(sync.Mutex)
+var selfTestStop chan bool
+
+// IsHealthy returns false if the datastore failed its most recent self test.
+func IsHealthy(dsId string) bool {
+	_, failed := unhealthy.Load(dsId)
+	return !failed
+}
+
+// SelfTestError returns the error from the datastore's most recent self test, or an empty string if it passed.
+func SelfTestError(dsId string) string {
+	if val, failed := unhealthy.Load(dsId); failed {
+		return val.(string)
+	}
+	return ""
+}
+
+// SelfTest writes a small canary object to the datastore, reads it back, then deletes it.
+func SelfTest(ctx rcontext.RequestContext, ds config.DatastoreConfig) error {
+	driver, err := getDriver(ds)
+	if err != nil {
+		return err
+	}
+
+	objectName, err := ids.NewUniqueId()
+	if err != nil {
+		return err
+	}
+	objectName = fmt.Sprintf("%sselftest", objectName)
+	payload := []byte("matrix-media-repo self test " + objectName)
+
+	location, written, err := driver.Upload(ctx, objectName, bytes.NewReader(payload), int64(len(payload)), "text/plain")
+	if err != nil {
+		return errors.Join(errors.New("failed to write canary object"), err)
+	}
+	defer func() {
+		if err2 := driver.Remove(ctx, location); err2 != nil {
+			ctx.Log.Warn("Failed to remove canary object: ", err2)
+		}
+	}()
+	if written != int64(len(payload)) {
+		return fmt.Errorf("canary object size mismatch: expected %d got %d bytes", len(payload), written)
+	}
+
+	stream, err := driver.Download(ctx, location)
+	if err != nil {
+		return errors.Join(errors.New("failed to read canary object"), err)
+	}
+	defer stream.Close()
+	read, err := io.ReadAll(stream)
+	if err != nil {
+		return errors.Join(errors.New("failed to read canary object"), err)
+	}
+	if !bytes.Equal(read, payload) {
+		return errors.New("canary object was read back with different contents")
+	}
+
+	return nil
+}
+
+// SelfTestAll runs SelfTest against every datastore which accepts new media, marking failing datastores unhealthy
+// so they aren't picked for uploads.
+func SelfTestAll(ctx rcontext.RequestContext) {
+	for _, ds := range config.UniqueDatastores() {
+		if len(ds.MediaKinds) == 0 {
+			unhealthy.Delete(ds.Id) // read only, so there's nothing to test
+			continue
+		}
+
+		dsCtx := ctx.LogWithFields(logrus.Fields{"dsId": ds.Id})
+		if err := SelfTest(dsCtx, ds); err != nil {
+			if IsHealthy(ds.Id) {
+				sentry.CaptureException(err)
+			}
+			dsCtx.Log.Error("Datastore failed self test and will not be used for uploads: ", err)
+			unhealthy.Store(ds.Id, err.Error())
+		} else {
+			if !IsHealthy(ds.Id) {
+				dsCtx.Log.Info("Datastore passed self test and will be used for uploads again")
+			}
+			unhealthy.Delete(ds.Id)
+		}
+	}
+}
+
+// StartSelfTests runs the datastore self tests immediately, then again on the configured interval. Calling this
+// again restarts the tests with the current config.
+func StartSelfTests() {
+	StopSelfTests()
+
+	conf := config.Get().DatastoreSelfTest
+	if !conf.Enabled {
+		unhealthy.Range(func(key, value any) bool {
+			unhealthy.Delete(key)
+			return true
+		})
+		return
+	}
+
+	ctx := rcontext.Initial().LogWithFields(logrus.Fields{"selfTest": true})
+	SelfTestAll(ctx)
+
+	if conf.IntervalMinutes <= 0 {
+		return
+	}
+
+	selfTestLock.Lock()
+	defer selfTestLock.Unlock()
+	stop := make(chan bool)
+	selfTestStop = stop
+	ticker := time.NewTicker(time.Duration(conf.IntervalMinutes) * time.Minute)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				SelfTestAll(ctx)
+			}
+		}
+	}()
+}
+
+// StopSelfTests stops the periodic datastore self tests, if running.
+func StopSelfTests() {
+	selfTestLock.Lock()
+	defer selfTestLock.Unlock()
+	if selfTestStop != nil {
+		close(selfTestStop)
+		selfTestStop = nil
+	}
+}
@@ -0,0 +1,91 @@
+package datastores
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+var restoring = new(sync.Map)
+
+// GetArchive returns the datastore which old media is tiered to, if tiering is enabled.
+func GetArchive(ctx rcontext.RequestContext) (config.DatastoreConfig, bool) {
+	if !config.Get().Tiering.Enabled || config.Get().Tiering.ArchiveDatastoreId == "" {
+		return config.DatastoreConfig{}, false
+	}
+	return Get(ctx, config.Get().Tiering.ArchiveDatastoreId)
+}
+
+// RestoreIfArchived moves the object back out of the archive datastore in the background, if it is in the archive
+// datastore and tiering is configured to restore on access. Only one restore per object runs at a time.
+func RestoreIfArchived(ctx rcontext.RequestContext, object *database.Locatable) {
+	if !config.Get().Tiering.RestoreOnAccess || config.Get().Deployment.IsDownloadsOnly() {
+		return // download instances don't write to the database, so can't move objects
+	}
+	archiveDs, ok := GetArchive(ctx)
+	if !ok || object.DatastoreId != archiveDs.Id {
+		return
+	}
+
+	restoreId := fmt.Sprintf("%s/%s", object.DatastoreId, object.Location)
+	if _, running := restoring.LoadOrStore(restoreId, true); running {
+		return
+	}
+
+	ctx = ctx.AsBackground().LogWithFields(logrus.Fields{"sha256": object.Sha256Hash, "location": object.Location})
+	go func() {
+		defer restoring.Delete(restoreId)
+		if err := restore(ctx, archiveDs, object); err != nil {
+			ctx.Log.Error("Error restoring object from archive datastore: ", err)
+			sentry.CaptureException(err)
+		}
+	}()
+}
+
+func restore(ctx rcontext.RequestContext, archiveDs config.DatastoreConfig, object *database.Locatable) error {
+	kind := ThumbnailsKind
+	sizeBytes := int64(0)
+	contentType := ""
+
+	media, err := database.GetInstance().Media.Prepare(ctx).GetByLocation(archiveDs.Id, object.Location)
+	if err != nil {
+		return err
+	}
+	if len(media) > 0 {
+		kind = RemoteMediaKind
+		if util.IsServerOurs(media[0].Origin) {
+			kind = LocalMediaKind
+		}
+		sizeBytes = media[0].SizeBytes
+		contentType = media[0].ContentType
+	} else {
+		thumbs, err := database.GetInstance().Thumbnails.Prepare(ctx).GetByLocation(archiveDs.Id, object.Location)
+		if err != nil {
+			return err
+		}
+		if len(thumbs) == 0 {
+			return nil // already restored, or deleted
+		}
+		sizeBytes = thumbs[0].SizeBytes
+		contentType = thumbs[0].ContentType
+	}
+
+	targetDs, err := Pick(ctx, kind)
+	if err != nil {
+		return err
+	}
+	if targetDs.Id == archiveDs.Id {
+		return errors.New("the archive datastore is the only datastore for " + string(kind))
+	}
+
+	ctx.Log.Debugf("Restoring object from archive datastore to %s", targetDs.Id)
+	_, err = Move(ctx, archiveDs, targetDs, object.Location, sizeBytes, contentType, object.Sha256Hash)
+	return err
+}
@@ -0,0 +1,77 @@
+package datastores
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+)
+
+// CheckDiskSpace returns common.ErrInsufficientStorage if the temporary directory, or the disk of any datastore
+// which could receive media of the given kind, is above the hard watermark.
+func CheckDiskSpace(ctx rcontext.RequestContext, kind Kind) error {
+	conf := config.Get().DiskWatermarks
+	if !conf.Enabled || conf.HardPercent <= 0 {
+		return nil
+	}
+
+	paths := []string{os.TempDir()}
+	for _, ds := range ctx.Config.DataStores {
+		if !HasListedKind(ds.MediaKinds, kind) {
+			continue
+		}
+		for _, p := range diskPaths(ds) {
+			if p != "" {
+				paths = append(paths, p)
+			}
+		}
+	}
+
+	for _, p := range paths {
+		used, err := diskUsedPercent(p)
+		if err != nil {
+			ctx.Log.Debugf("Unable to determine disk usage of %s: %v", p, err)
+			continue
+		}
+		if used >= conf.HardPercent {
+			ctx.Log.Warnf("Disk holding %s is %.1f%% full, which is above the hard watermark", p, used)
+			return fmt.Errorf("%w: %s is %.1f%% full", common.ErrInsufficientStorage, p, used)
+		}
+	}
+	return nil
+}
+
+// AboveSoftWatermark returns true if the datastore's disk is above the soft watermark. Datastores which aren't
+// stored on a local disk are never above the watermark.
+func AboveSoftWatermark(ctx rcontext.RequestContext, ds config.DatastoreConfig) (bool, float64, error) {
+	conf := config.Get().DiskWatermarks
+	p := localPath(ds)
+	if !conf.Enabled || conf.SoftPercent <= 0 || p == "" {
+		return false, 0, nil
+	}
+	used, err := diskUsedPercent(p)
+	if err != nil {
+		return false, 0, err
+	}
+	return used >= conf.SoftPercent, used, nil
+}
+
+func diskPaths(ds config.DatastoreConfig) []string {
+	driver, err := lookupDriver(ds)
+	if err != nil {
+		return nil
+	}
+	if local, ok := driver.(LocalDisk); ok {
+		return local.DiskPaths()
+	}
+	return nil
+}
+
+func localPath(ds config.DatastoreConfig) string {
+	if paths := diskPaths(ds); len(paths) > 0 {
+		return paths[0]
+	}
+	return ""
+}
@@ -0,0 +1,66 @@
+package encryption
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"github.com/t2bot/matrix-media-repo/common/config"
+)
+
+const keySize = 32 // AES-256
+
+// Enabled returns true if newly uploaded objects should be encrypted.
+func Enabled() bool {
+	return config.Get().Encryption.Enabled
+}
+
+// CurrentKey returns the ID and value of the key new objects should be encrypted with.
+func CurrentKey() (string, []byte, error) {
+	keyId := config.Get().Encryption.CurrentKeyId
+	key, err := GetKey(keyId)
+	return keyId, key, err
+}
+
+// GetKey returns the value of the configured key with the given ID.
+func GetKey(keyId string) ([]byte, error) {
+	for _, k := range config.Get().Encryption.Keys {
+		if k.Id == keyId {
+			return decodeKey(k)
+		}
+	}
+	return nil, fmt.Errorf("encryption key %s is not configured", keyId)
+}
+
+// CheckConfig validates every configured key, and that the current key exists when encryption is enabled.
+func CheckConfig() error {
+	conf := config.Get().Encryption
+	seen := make(map[string]bool)
+	for _, k := range conf.Keys {
+		if k.Id == "" {
+			return errors.New("encryption keys must have an id")
+		}
+		if seen[k.Id] {
+			return fmt.Errorf("encryption key %s is configured more than once", k.Id)
+		}
+		seen[k.Id] = true
+		if _, err := decodeKey(k); err != nil {
+			return err
+		}
+	}
+	if conf.Enabled && !seen[conf.CurrentKeyId] {
+		return fmt.Errorf("current encryption key %s is not configured", conf.CurrentKeyId)
+	}
+	return nil
+}
+
+func decodeKey(k config.EncryptionKeyConfig) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(k.Key)
+	if err != nil {
+		return nil, fmt.Errorf("encryption key %s is not valid base64: %w", k.Id, err)
+	}
+	if len(key) != keySize {
+		return nil, fmt.Errorf("encryption key %s must be %d bytes, got %d", k.Id, keySize, len(key))
+	}
+	return key, nil
+}
@@ -0,0 +1,271 @@
+package encryption
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Objects are stored as a short header followed by a series of independently sealed AES-GCM segments. Each
+// segment covers SegmentSize bytes of plaintext (the last may be shorter), which keeps memory use bounded
+// and allows the plaintext to be seeked without decrypting everything before it.
+const (
+	SegmentSize = 64 * 1024
+	HeaderSize  = len(magic) + 1 + nonceSize
+	Overhead    = 16 // GCM tag
+
+	magic     = "MMRE"
+	version   = byte(1)
+	nonceSize = 12
+)
+
+var ErrInvalidCiphertext = errors.New("encryption: invalid or corrupt ciphertext")
+
+// EncryptedSize returns the number of bytes an object of plainSize bytes occupies once encrypted.
+func EncryptedSize(plainSize int64) int64 {
+	return int64(HeaderSize) + plainSize + segmentCount(plainSize)*Overhead
+}
+
+// PlaintextSize is the inverse of EncryptedSize.
+func PlaintextSize(encryptedSize int64) (int64, error) {
+	body := encryptedSize - int64(HeaderSize)
+	if body < Overhead {
+		return 0, ErrInvalidCiphertext
+	}
+	segments := (body + SegmentSize + Overhead - 1) / (SegmentSize + Overhead)
+	plainSize := body - segments*Overhead
+	if plainSize < 0 || segmentCount(plainSize) != segments {
+		return 0, ErrInvalidCiphertext
+	}
+	return plainSize, nil
+}
+
+func segmentCount(plainSize int64) int64 {
+	if plainSize <= 0 {
+		return 1 // an empty object still has a single (empty) segment so truncation can be detected
+	}
+	return (plainSize + SegmentSize - 1) / SegmentSize
+}
+
+func newAead(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func segmentNonce(base []byte, index uint64) []byte {
+	nonce := make([]byte, nonceSize)
+	copy(nonce, base)
+	counter := binary.BigEndian.Uint64(nonce[nonceSize-8:])
+	binary.BigEndian.PutUint64(nonce[nonceSize-8:], counter^index)
+	return nonce
+}
+
+// segmentAad binds each segment to its position, and marks the last one to prevent truncation.
+func segmentAad(index uint64, final bool) []byte {
+	aad := make([]byte, 9)
+	binary.BigEndian.PutUint64(aad, index)
+	if final {
+		aad[8] = 1
+	}
+	return aad
+}
+
+type encryptReader struct {
+	src   *bufio.Reader
+	aead  cipher.AEAD
+	nonce []byte
+	index uint64
+	plain []byte
+	out   []byte
+	done  bool
+}
+
+// NewEncryptReader returns a reader which produces the encrypted form of src using the given 32 byte key.
+func NewEncryptReader(src io.Reader, key []byte) (io.Reader, error) {
+	aead, err := newAead(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, nonceSize)
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 0, HeaderSize)
+	header = append(header, magic...)
+	header = append(header, version)
+	header = append(header, nonce...)
+
+	return &encryptReader{
+		src:   bufio.NewReader(src),
+		aead:  aead,
+		nonce: nonce,
+		plain: make([]byte, SegmentSize),
+		out:   header,
+	}, nil
+}
+
+func (r *encryptReader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.sealNext(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+func (r *encryptReader) sealNext() error {
+	n, err := io.ReadFull(r.src, r.plain)
+	final := false
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		final = true
+	} else if err != nil {
+		return err
+	} else if _, err = r.src.Peek(1); errors.Is(err, io.EOF) {
+		final = true
+	} else if err != nil {
+		return err
+	}
+
+	r.out = r.aead.Seal(r.out[:0], segmentNonce(r.nonce, r.index), r.plain[:n], segmentAad(r.index, final))
+	r.index++
+	r.done = final
+	return nil
+}
+
+type decryptReader struct {
+	src       io.ReadSeekCloser
+	aead      cipher.AEAD
+	nonce     []byte
+	plainSize int64
+	lastIndex uint64
+	pos       int64 // position in the plaintext
+	srcPos    int64 // position in the ciphertext
+
+	segIndex uint64
+	segment  []byte // decrypted segment at segIndex, if any
+	sealed   []byte
+}
+
+// NewDecryptReader wraps an encrypted object, returning a seekable reader over its plaintext. The source
+// must support seeking to its end so the plaintext size can be determined.
+func NewDecryptReader(src io.ReadSeekCloser, key []byte) (io.ReadSeekCloser, error) {
+	aead, err := newAead(key)
+	if err != nil {
+		return nil, err
+	}
+
+	encryptedSize, err := src.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	plainSize, err := PlaintextSize(encryptedSize)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = src.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, HeaderSize)
+	if _, err = io.ReadFull(src, header); err != nil {
+		return nil, fmt.Errorf("encryption: error reading header: %w", err)
+	}
+	if string(header[:len(magic)]) != magic {
+		return nil, ErrInvalidCiphertext
+	}
+	if header[len(magic)] != version {
+		return nil, fmt.Errorf("encryption: unsupported version %d", header[len(magic)])
+	}
+
+	return &decryptReader{
+		src:       src,
+		aead:      aead,
+		nonce:     header[len(magic)+1:],
+		plainSize: plainSize,
+		lastIndex: uint64(segmentCount(plainSize) - 1),
+		srcPos:    int64(HeaderSize),
+		sealed:    make([]byte, SegmentSize+Overhead),
+	}, nil
+}
+
+func (r *decryptReader) Read(p []byte) (int, error) {
+	if r.pos >= r.plainSize {
+		return 0, io.EOF
+	}
+	index := uint64(r.pos / SegmentSize)
+	if r.segment == nil || r.segIndex != index {
+		if err := r.openSegment(index); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.segment[r.pos%SegmentSize:])
+	r.pos += int64(n)
+	return n, nil
+}
+
+func (r *decryptReader) openSegment(index uint64) error {
+	offset := int64(HeaderSize) + int64(index)*(SegmentSize+Overhead)
+	if offset != r.srcPos {
+		if _, err := r.src.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+		r.srcPos = offset
+	}
+
+	length := int64(SegmentSize + Overhead)
+	if index == r.lastIndex {
+		length = r.plainSize - int64(index)*SegmentSize + Overhead
+	}
+	sealed := r.sealed[:length]
+	n, err := io.ReadFull(r.src, sealed)
+	r.srcPos += int64(n)
+	if err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return ErrInvalidCiphertext
+		}
+		return err
+	}
+
+	r.segment, err = r.aead.Open(r.segment[:0], segmentNonce(r.nonce, index), sealed, segmentAad(index, index == r.lastIndex))
+	if err != nil {
+		r.segment = nil
+		return ErrInvalidCiphertext
+	}
+	r.segIndex = index
+	return nil
+}
+
+func (r *decryptReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.plainSize
+	default:
+		return 0, errors.New("encryption: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("encryption: negative position")
+	}
+	r.pos = offset
+	return offset, nil
+}
+
+func (r *decryptReader) Close() error {
+	return r.src.Close()
+}
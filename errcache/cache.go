@@ -37,3 +37,9 @@ func (e *ErrCache) Set(key string, err error) {
 	e.cache.Set(key, err, cache.DefaultExpiration)
 	e.mu.Unlock()
 }
+
+func (e *ErrCache) Delete(key string) {
+	e.mu.Lock()
+	e.cache.Delete(key)
+	e.mu.Unlock()
+}
@@ -0,0 +1,162 @@
+package events
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/metrics"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+type MediaEventType string
+
+const (
+	MediaUploaded    MediaEventType = "media.uploaded"
+	MediaQuarantined MediaEventType = "media.quarantined"
+	MediaPurged      MediaEventType = "media.purged"
+)
+
+// MediaEvent describes a change in a piece of media's lifecycle, for consumption by downstream systems.
+type MediaEvent struct {
+	Type        MediaEventType `json:"type"`
+	Origin      string         `json:"origin"`
+	MediaId     string         `json:"media_id"`
+	UserId      string         `json:"user_id,omitempty"`
+	SizeBytes   int64          `json:"size"`
+	ContentType string         `json:"content_type,omitempty"`
+	Sha256Hash  string         `json:"sha256"`
+	Ts          int64          `json:"ts"`
+}
+
+// Broker publishes events to a message broker. Implementations don't need to be safe for concurrent use.
+type Broker interface {
+	// Publish sends the payload to the topic. The key identifies the media the event is about, for brokers which
+	// partition by key.
+	Publish(topic string, key string, payload []byte) error
+	Close() error
+}
+
+// Subscriber is called with each event emitted by this process, whether or not the event stream is enabled.
+// Subscribers are called synchronously by Emit, so must not block.
+type Subscriber func(ctx rcontext.RequestContext, event *MediaEvent)
+
+var queue chan *MediaEvent
+var startOnce = &sync.Once{}
+var subscribers = make([]Subscriber, 0)
+var subscribersLock = &sync.RWMutex{}
+
+// Subscribe registers a function to be called for every event emitted by this process.
+func Subscribe(subscriber Subscriber) {
+	subscribersLock.Lock()
+	defer subscribersLock.Unlock()
+	subscribers = append(subscribers, subscriber)
+}
+
+// Emit passes an event about the media to the subscribers, and queues it for publishing if the event stream is
+// enabled. Events are dropped rather than blocking the caller if the broker is unable to keep up.
+func Emit(ctx rcontext.RequestContext, eventType MediaEventType, record *database.DbMedia) {
+	event := &MediaEvent{
+		Type:        eventType,
+		Origin:      record.Origin,
+		MediaId:     record.MediaId,
+		UserId:      record.UserId,
+		SizeBytes:   record.SizeBytes,
+		ContentType: record.ContentType,
+		Sha256Hash:  record.Sha256Hash,
+		Ts:          util.NowMillis(),
+	}
+
+	subscribersLock.RLock()
+	for _, subscriber := range subscribers {
+		subscriber(ctx, event)
+	}
+	subscribersLock.RUnlock()
+
+	if !config.Get().EventStream.Enabled {
+		return
+	}
+	startOnce.Do(start)
+
+	select {
+	case queue <- event:
+	default:
+		metrics.MediaEventsDropped.With(map[string]string{"type": string(eventType), "reason": "queue_full"}).Inc()
+		ctx.Log.Warnf("Event stream queue is full - dropping %s event for %s", eventType, util.MxcUri(record.Origin, record.MediaId))
+	}
+}
+
+func start() {
+	size := config.Get().EventStream.QueueSize
+	if size <= 0 {
+		size = 1
+	}
+	queue = make(chan *MediaEvent, size)
+	go publishLoop()
+}
+
+func publishLoop() {
+	var broker Broker
+	var brokerConf config.EventStreamConfig
+	for event := range queue {
+		conf := config.Get().EventStream
+		if broker != nil && conf != brokerConf {
+			logrus.Info("Event stream configuration changed - reconnecting to broker")
+			closeBroker(broker)
+			broker = nil
+		}
+		if !conf.Enabled {
+			continue
+		}
+
+		err := func() error {
+			if broker == nil {
+				b, err := newBroker(conf)
+				if err != nil {
+					return err
+				}
+				broker = b
+				brokerConf = conf
+			}
+			payload, err := json.Marshal(event)
+			if err != nil {
+				return err
+			}
+			return broker.Publish(conf.Topic, util.MxcUri(event.Origin, event.MediaId), payload)
+		}()
+		if err != nil {
+			metrics.MediaEventsDropped.With(map[string]string{"type": string(event.Type), "reason": "publish_failed"}).Inc()
+			logrus.Error("Error publishing media event: ", err)
+			sentry.CaptureException(err)
+			if broker != nil {
+				// Reconnect on the next event, in case the connection is broken
+				closeBroker(broker)
+				broker = nil
+			}
+			continue
+		}
+		metrics.MediaEventsPublished.With(map[string]string{"type": string(event.Type)}).Inc()
+	}
+}
+
+func newBroker(conf config.EventStreamConfig) (Broker, error) {
+	switch conf.Broker {
+	case "nats":
+		return newNatsBroker(conf.Nats)
+	case "kafka":
+		return newKafkaBroker(conf.Kafka)
+	default:
+		return nil, errors.New("unknown event stream broker: " + conf.Broker)
+	}
+}
+
+func closeBroker(broker Broker) {
+	if err := broker.Close(); err != nil {
+		logrus.Warn("Non-fatal error closing event stream broker: ", err)
+	}
+}
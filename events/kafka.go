@@ -0,0 +1,76 @@
+package events
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/t2bot/matrix-media-repo/common/config"
+)
+
+// kafkaBroker publishes to Kafka through a REST proxy which supports the v2 API, such as the Confluent REST Proxy
+// or Redpanda's HTTP proxy. Events are keyed by MXC URI so a piece of media's events stay in order.
+type kafkaBroker struct {
+	conf   config.KafkaEventStreamConfig
+	client *http.Client
+}
+
+type kafkaRecords struct {
+	Records []kafkaRecord `json:"records"`
+}
+
+type kafkaRecord struct {
+	Key   string          `json:"key"`
+	Value json.RawMessage `json:"value"`
+}
+
+func newKafkaBroker(conf config.KafkaEventStreamConfig) (*kafkaBroker, error) {
+	if conf.RestProxyUrl == "" {
+		return nil, errors.New("no Kafka REST proxy url configured")
+	}
+	return &kafkaBroker{
+		conf: conf,
+		client: &http.Client{
+			Timeout: time.Duration(conf.TimeoutSeconds) * time.Second,
+		},
+	}, nil
+}
+
+func (b *kafkaBroker) Publish(topic string, key string, payload []byte) error {
+	body, err := json.Marshal(kafkaRecords{Records: []kafkaRecord{{Key: key, Value: payload}}})
+	if err != nil {
+		return err
+	}
+
+	endpoint := strings.TrimSuffix(b.conf.RestProxyUrl, "/") + "/topics/" + url.PathEscape(topic)
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", "matrix-media-repo")
+	req.Header.Set("Content-Type", "application/vnd.kafka.json.v2+json")
+	req.Header.Set("Accept", "application/vnd.kafka.v2+json")
+	if b.conf.Username != "" {
+		req.SetBasicAuth(b.conf.Username, b.conf.Password)
+	}
+
+	res, err := b.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status code %d from Kafka REST proxy", res.StatusCode)
+	}
+	return nil
+}
+
+func (b *kafkaBroker) Close() error {
+	b.client.CloseIdleConnections()
+	return nil
+}
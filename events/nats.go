@@ -0,0 +1,173 @@
+package events
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/version"
+)
+
+const natsTimeout = 10 * time.Second
+
+// natsBroker speaks just enough of the NATS client protocol (https://docs.nats.io/reference/reference-protocols/nats-protocol)
+// to publish messages. Subjects are the configured topic.
+type natsBroker struct {
+	conn    net.Conn
+	writeMu sync.Mutex
+	errMu   sync.Mutex
+	err     error
+}
+
+type natsConnect struct {
+	Verbose   bool   `json:"verbose"`
+	Pedantic  bool   `json:"pedantic"`
+	Name      string `json:"name"`
+	Lang      string `json:"lang"`
+	Version   string `json:"version"`
+	AuthToken string `json:"auth_token,omitempty"`
+	User      string `json:"user,omitempty"`
+	Pass      string `json:"pass,omitempty"`
+}
+
+func newNatsBroker(conf config.NatsEventStreamConfig) (*natsBroker, error) {
+	u, err := url.Parse(conf.Url)
+	if err != nil {
+		return nil, err
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "4222")
+	}
+
+	var conn net.Conn
+	dialer := &net.Dialer{Timeout: natsTimeout}
+	switch u.Scheme {
+	case "nats":
+		conn, err = dialer.Dial("tcp", host)
+	case "tls":
+		conn, err = tls.DialWithDialer(dialer, "tcp", host, &tls.Config{ServerName: u.Hostname()})
+	default:
+		return nil, errors.New("unsupported NATS url scheme: " + u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	b := &natsBroker{conn: conn}
+	reader := bufio.NewReader(conn)
+	_ = conn.SetDeadline(time.Now().Add(natsTimeout))
+
+	// The server always starts by describing itself
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		_ = conn.Close()
+		return nil, errors.New("unexpected greeting from NATS server: " + strings.TrimSpace(line))
+	}
+
+	connect := natsConnect{
+		Name:      "matrix-media-repo",
+		Lang:      "go",
+		Version:   version.Version,
+		AuthToken: conf.Token,
+		User:      conf.Username,
+		Pass:      conf.Password,
+	}
+	if u.User != nil && connect.User == "" {
+		connect.User = u.User.Username()
+		connect.Pass, _ = u.User.Password()
+	}
+	c, err := json.Marshal(connect)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	if _, err = fmt.Fprintf(conn, "CONNECT %s\r\nPING\r\n", c); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	// A PONG confirms we were accepted. Authentication failures are reported with -ERR instead.
+	line, err = reader.ReadString('\n')
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	if strings.TrimSpace(line) != "PONG" {
+		_ = conn.Close()
+		return nil, errors.New("NATS server rejected connection: " + strings.TrimSpace(line))
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	go b.readLoop(reader)
+	return b, nil
+}
+
+// readLoop answers the server's keepalives, and records any errors it reports.
+func (b *natsBroker) readLoop(reader *bufio.Reader) {
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			b.setErr(err)
+			return
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "PING":
+			b.writeMu.Lock()
+			_, err = b.conn.Write([]byte("PONG\r\n"))
+			b.writeMu.Unlock()
+			if err != nil {
+				b.setErr(err)
+				return
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			b.setErr(errors.New("NATS server error: " + line))
+		}
+	}
+}
+
+func (b *natsBroker) setErr(err error) {
+	b.errMu.Lock()
+	defer b.errMu.Unlock()
+	if b.err == nil {
+		b.err = err
+	}
+}
+
+func (b *natsBroker) Publish(topic string, key string, payload []byte) error {
+	b.errMu.Lock()
+	err := b.err
+	b.errMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	b.writeMu.Lock()
+	defer b.writeMu.Unlock()
+	_ = b.conn.SetWriteDeadline(time.Now().Add(natsTimeout))
+	if _, err = fmt.Fprintf(b.conn, "PUB %s %d\r\n", topic, len(payload)); err != nil {
+		return err
+	}
+	if _, err = b.conn.Write(payload); err != nil {
+		return err
+	}
+	_, err = b.conn.Write([]byte("\r\n"))
+	return err
+}
+
+func (b *natsBroker) Close() error {
+	return b.conn.Close()
+}
@@ -0,0 +1,59 @@
+package faults
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/metrics"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+const (
+	TargetDatastores  = "datastores"
+	TargetHomeservers = "homeservers"
+	TargetFederation  = "federation"
+)
+
+// ErrInjected is returned by operations which were failed on purpose by fault injection.
+var ErrInjected = errors.New("fault injected for testing")
+
+var warnOnce = &sync.Once{}
+
+// IsEnabled returns true if faults should be injected into operations against the given target.
+func IsEnabled(target string) bool {
+	conf := config.Get().FaultInjection
+	return conf.Enabled && util.ArrayContains(conf.Targets, target)
+}
+
+// Inject delays the caller by the configured latency, then returns ErrInjected at the configured failure
+// rate. Does nothing (and returns nil) if fault injection is not enabled for the target.
+//
+// This is for testing retry, failover, and backoff behaviour only: it should never be enabled in production.
+func Inject(target string) error {
+	if !IsEnabled(target) {
+		return nil
+	}
+	warnOnce.Do(func() {
+		logrus.Warn("Fault injection is enabled: operations will be delayed and fail at random. Do not use this in production.")
+	})
+
+	conf := config.Get().FaultInjection
+	delay := conf.LatencyMs
+	if conf.JitterMs > 0 {
+		delay += rand.Intn(conf.JitterMs + 1)
+	}
+	if delay > 0 {
+		metrics.FaultsInjected.With(prometheus.Labels{"target": target, "kind": "latency"}).Inc()
+		time.Sleep(time.Duration(delay) * time.Millisecond)
+	}
+	if conf.FailureRate > 0 && rand.Float64() < conf.FailureRate {
+		metrics.FaultsInjected.With(prometheus.Labels{"target": target, "kind": "failure"}).Inc()
+		return ErrInjected
+	}
+	return nil
+}
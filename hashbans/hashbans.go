@@ -0,0 +1,83 @@
+package hashbans
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"strings"
+
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/redislib"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+// NormalizeHash returns the lowercase form of a hex sha256 hash, and whether the hash is valid.
+func NormalizeHash(hash string) (string, bool) {
+	hash = strings.ToLower(hash)
+	if b, err := hex.DecodeString(hash); err != nil || len(b) != sha256.Size {
+		return "", false
+	}
+	return hash, true
+}
+
+// IsBanned returns true if any source has banned the given hash.
+func IsBanned(ctx rcontext.RequestContext, sha256hash string) (bool, error) {
+	bans, err := database.GetInstance().BannedHashes.Prepare(ctx).Get(sha256hash)
+	if err != nil {
+		return false, err
+	}
+	return len(bans) > 0, nil
+}
+
+// ReplaceBans sets the hashes banned by the source, removing any others it banned before. Returns the hashes
+// which were not already banned by the source.
+func ReplaceBans(ctx rcontext.RequestContext, source string, hashes []string, reasons map[string]string) ([]string, error) {
+	newHashes := make([]string, 0)
+	err := database.GetInstance().WithTransaction(ctx, func(tx *sql.Tx) error {
+		db := database.GetInstance().BannedHashes.PrepareTx(ctx, tx)
+		existing, err := db.GetBySource(source)
+		if err != nil {
+			return err
+		}
+		known := make(map[string]bool)
+		for _, ban := range existing {
+			known[ban.Sha256Hash] = true
+		}
+
+		if err = db.DeleteBySourceExcept(source, hashes); err != nil {
+			return err
+		}
+		now := util.NowMillis()
+		for _, hash := range hashes {
+			if err = db.Insert(&database.DbBannedHash{
+				Sha256Hash: hash,
+				Source:     source,
+				Reason:     reasons[hash],
+				BannedTs:   now,
+			}); err != nil {
+				return err
+			}
+			if !known[hash] {
+				newHashes = append(newHashes, hash)
+			}
+		}
+		return nil
+	})
+	return newHashes, err
+}
+
+// QuarantineExisting quarantines any media already stored with the given hashes. Errors are logged rather than
+// returned so one bad hash doesn't stop the others.
+func QuarantineExisting(ctx rcontext.RequestContext, hashes []string) {
+	metadataDb := database.GetInstance().MetadataView.Prepare(ctx)
+	for _, hash := range hashes {
+		if _, err := metadataDb.UpdateQuarantineByHash(hash, true); err != nil {
+			ctx.Log.Warnf("Error quarantining existing media for banned hash %s: %v", hash, err)
+			continue
+		}
+		if err := redislib.DeleteMedia(ctx, hash); err != nil {
+			ctx.Log.Warn("Error while deleting cached media: ", err)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package hashbans
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+const maxListSizeBytes = 64 * 1024 * 1024
+
+// RemoteList is the document served by a remote hash ban list. The list is signed by computing the canonical
+// JSON of the document without the `signatures` property, and signing that with an ed25519 key.
+type RemoteList struct {
+	Hashes     []*RemoteListEntry `json:"hashes"`
+	Signatures map[string]string  `json:"signatures"`
+}
+
+type RemoteListEntry struct {
+	Sha256 string `json:"sha256"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// SourceForList returns the source name bans from the given remote list are stored under.
+func SourceForList(listUrl string) string {
+	return "remote:" + listUrl
+}
+
+// SyncRemoteLists fetches every configured remote list, replacing the bans previously imported from it. A list
+// which can't be fetched or verified keeps its previous bans.
+func SyncRemoteLists(ctx rcontext.RequestContext) error {
+	var lastErr error
+	for _, list := range config.Get().HashBans.RemoteLists {
+		listCtx := ctx.LogWithFields(logrus.Fields{"hashBanList": list.Url})
+		if err := syncRemoteList(listCtx, list); err != nil {
+			listCtx.Log.Warn("Error syncing hash ban list: ", err)
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+func syncRemoteList(ctx rcontext.RequestContext, listConf config.RemoteHashBanListConfig) error {
+	list, err := fetchRemoteList(ctx, listConf)
+	if err != nil {
+		return err
+	}
+
+	source := SourceForList(listConf.Url)
+	hashes := make([]string, 0, len(list.Hashes))
+	reasons := make(map[string]string)
+	for _, entry := range list.Hashes {
+		hash, ok := NormalizeHash(entry.Sha256)
+		if !ok {
+			ctx.Log.Warnf("Ignoring invalid hash %s", entry.Sha256)
+			continue
+		}
+		if _, ok = reasons[hash]; !ok {
+			hashes = append(hashes, hash)
+		}
+		reasons[hash] = entry.Reason
+	}
+
+	newHashes, err := ReplaceBans(ctx, source, hashes, reasons)
+	if err != nil {
+		return err
+	}
+	ctx.Log.Infof("Synced hash ban list: %d hashes, %d new", len(hashes), len(newHashes))
+
+	if config.Get().HashBans.QuarantineExisting {
+		QuarantineExisting(ctx, newHashes)
+	}
+
+	return nil
+}
+
+func fetchRemoteList(ctx rcontext.RequestContext, listConf config.RemoteHashBanListConfig) (*RemoteList, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, listConf.Url, nil)
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{
+		Timeout: time.Duration(config.Get().HashBans.FetchTimeoutSeconds) * time.Second,
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %d", res.StatusCode)
+	}
+	b, err := io.ReadAll(io.LimitReader(res.Body, maxListSizeBytes))
+	if err != nil {
+		return nil, err
+	}
+
+	if err = VerifyRemoteList(b, listConf.KeyId, listConf.PublicKey); err != nil {
+		return nil, err
+	}
+	list := &RemoteList{}
+	if err = json.Unmarshal(b, list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// VerifyRemoteList checks the signature on a remote list document using the given ed25519 public key (in
+// unpadded base64).
+func VerifyRemoteList(document []byte, keyId string, publicKey string) error {
+	pubKey, err := util.DecodeUnpaddedBase64String(publicKey)
+	if err != nil {
+		return fmt.Errorf("invalid public key: %w", err)
+	}
+	if len(pubKey) != ed25519.PublicKeySize {
+		return errors.New("invalid public key: wrong length")
+	}
+
+	raw := make(map[string]interface{})
+	if err = json.Unmarshal(document, &raw); err != nil {
+		return err
+	}
+	signatures, ok := raw["signatures"].(map[string]interface{})
+	if !ok {
+		return errors.New("list is not signed")
+	}
+	signature, ok := signatures[keyId].(string)
+	if !ok {
+		return fmt.Errorf("list is not signed by %s", keyId)
+	}
+	sig, err := util.DecodeUnpaddedBase64String(signature)
+	if err != nil {
+		return fmt.Errorf("invalid signature: %w", err)
+	}
+
+	delete(raw, "signatures")
+	canonical, err := util.EncodeCanonicalJson(raw)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(pubKey, canonical, sig) {
+		return errors.New("signature does not match")
+	}
+	return nil
+}
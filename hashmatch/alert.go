@@ -0,0 +1,79 @@
+package hashmatch
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/metrics"
+)
+
+// Alert is sent to the alert webhook when media matches a hash list.
+type Alert struct {
+	Origin  string  `json:"origin"`
+	MediaId string  `json:"media_id"`
+	UserId  string  `json:"user_id,omitempty"`
+	Hashes  *Hashes `json:"hashes"`
+	Match   *Match  `json:"match"`
+}
+
+// SendAlert tells admins about the match through the logs, Sentry, and the alert webhook (if configured). Errors
+// sending the webhook are logged rather than returned.
+func SendAlert(ctx rcontext.RequestContext, alert *Alert) {
+	metrics.HashMatches.With(prometheus.Labels{"hash_type": alert.Match.HashType, "source": alert.Match.Source}).Inc()
+
+	ctx.Log.WithFields(logrus.Fields{
+		"userId":   alert.UserId,
+		"sha256":   alert.Hashes.Sha256,
+		"hashType": alert.Match.HashType,
+		"hash":     alert.Match.Hash,
+		"distance": alert.Match.Distance,
+		"source":   alert.Match.Source,
+		"reason":   alert.Match.Reason,
+	}).Error("Media matched a hash list and was quarantined")
+	sentry.CaptureMessage(fmt.Sprintf("Media mxc://%s/%s matched a hash list (%s)", alert.Origin, alert.MediaId, alert.Match.HashType))
+
+	conf := config.Get().HashMatching
+	if conf.AlertWebhookUrl == "" {
+		return
+	}
+	if err := postAlert(ctx, conf, alert); err != nil {
+		ctx.Log.Error("Error sending hash match alert: ", err)
+		sentry.CaptureException(err)
+	}
+}
+
+func postAlert(ctx rcontext.RequestContext, conf config.HashMatchingConfig, alert *Alert) error {
+	b, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, conf.AlertWebhookUrl, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", "matrix-media-repo")
+	req.Header.Set("Content-Type", "application/json")
+	if conf.AlertWebhookSecret != "" {
+		req.Header.Set("Authorization", "Bearer "+conf.AlertWebhookSecret)
+	}
+	client := &http.Client{
+		Timeout: time.Duration(conf.TimeoutSeconds) * time.Second,
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status code %d", res.StatusCode)
+	}
+	return nil
+}
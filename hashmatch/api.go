@@ -0,0 +1,68 @@
+package hashmatch
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+)
+
+type apiResponse struct {
+	Match bool   `json:"match"`
+	Hash  string `json:"hash"`
+	Type  string `json:"hash_type"`
+	// Distance is optional, and only meaningful for PDQ matches
+	Distance int    `json:"distance"`
+	Reason   string `json:"reason"`
+}
+
+// checkApi POSTs the hashes as JSON to the configured hash matching service, which responds with whether they
+// matched anything.
+func checkApi(ctx rcontext.RequestContext, conf config.HashMatchingConfig, hashes *Hashes) (*Match, error) {
+	b, err := json.Marshal(hashes)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, conf.ApiUrl, bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "matrix-media-repo")
+	req.Header.Set("Content-Type", "application/json")
+	if conf.ApiSecret != "" {
+		req.Header.Set("Authorization", "Bearer "+conf.ApiSecret)
+	}
+
+	client := &http.Client{
+		Timeout: time.Duration(conf.TimeoutSeconds) * time.Second,
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %d", res.StatusCode)
+	}
+
+	val := &apiResponse{}
+	if err = json.NewDecoder(io.LimitReader(res.Body, 1048576)).Decode(val); err != nil {
+		return nil, errors.Join(errors.New("error decoding hash matching response"), err)
+	}
+	if !val.Match {
+		return nil, nil
+	}
+	return &Match{
+		HashType: val.Type,
+		Hash:     val.Hash,
+		Distance: val.Distance,
+		Source:   "api",
+		Reason:   val.Reason,
+	}, nil
+}
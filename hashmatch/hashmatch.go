@@ -0,0 +1,122 @@
+package hashmatch
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"strings"
+
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	_ "golang.org/x/image/webp"
+)
+
+const (
+	HashTypeMd5 = "md5"
+	HashTypePdq = "pdq"
+)
+
+// Hashes are the hashes of a piece of media which are checked against hash lists. Pdq is empty if the media isn't
+// an image which could be decoded.
+type Hashes struct {
+	Sha256     string `json:"sha256,omitempty"`
+	Md5        string `json:"md5"`
+	Pdq        string `json:"pdq,omitempty"`
+	PdqQuality int    `json:"pdq_quality,omitempty"`
+}
+
+// Match describes which hash list entry the media matched.
+type Match struct {
+	HashType string `json:"hash_type"`
+	Hash     string `json:"hash"`
+	Distance int    `json:"distance"`
+	Source   string `json:"source"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// IsEnabled returns true if newly stored media of the given kind should be checked against the hash lists.
+func IsEnabled(isRemote bool) bool {
+	conf := config.Get().HashMatching
+	return conf.Enabled && (!isRemote || conf.CheckRemoteMedia)
+}
+
+// limitedBuffer buffers writes until the limit is reached, after which it discards everything.
+type limitedBuffer struct {
+	buf      bytes.Buffer
+	limit    int64
+	overflow bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if !b.overflow {
+		if int64(b.buf.Len()+len(p)) > b.limit {
+			b.overflow = true
+			b.buf = bytes.Buffer{}
+		} else {
+			b.buf.Write(p)
+		}
+	}
+	return len(p), nil
+}
+
+// Compute reads the media to the end, computing its hashes. Images larger than the thumbnailer's source limits
+// are not PDQ hashed.
+func Compute(ctx rcontext.RequestContext, r io.Reader, contentType string) (*Hashes, error) {
+	md5h := md5.New()
+	var w io.Writer = md5h
+	var imgBuf *limitedBuffer
+	if strings.HasPrefix(contentType, "image/") {
+		imgBuf = &limitedBuffer{limit: ctx.Config.Thumbnails.MaxSourceBytes}
+		w = io.MultiWriter(md5h, imgBuf)
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		return nil, err
+	}
+
+	hashes := &Hashes{Md5: hex.EncodeToString(md5h.Sum(nil))}
+	if imgBuf != nil && !imgBuf.overflow {
+		hashes.Pdq, hashes.PdqQuality = pdqFromBytes(ctx, imgBuf.buf.Bytes())
+	}
+	return hashes, nil
+}
+
+func pdqFromBytes(ctx rcontext.RequestContext, b []byte) (string, int) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(b))
+	if err != nil {
+		ctx.Log.Debug("Not PDQ hashing undecodable image: ", err)
+		return "", 0
+	}
+	if cfg.Width*cfg.Height >= ctx.Config.Thumbnails.MaxPixels {
+		ctx.Log.Debug("Not PDQ hashing image: too many pixels")
+		return "", 0
+	}
+	img, _, err := image.Decode(bytes.NewReader(b))
+	if err != nil {
+		ctx.Log.Debug("Not PDQ hashing undecodable image: ", err)
+		return "", 0
+	}
+	return PdqHash(img)
+}
+
+// Check compares the hashes against the configured hash list and API, returning the first match or nil.
+func Check(ctx rcontext.RequestContext, hashes *Hashes) (*Match, error) {
+	conf := config.Get().HashMatching
+	if conf.ListPath != "" {
+		list, err := getLocalList(conf.ListPath)
+		if err != nil {
+			return nil, err
+		}
+		if match := list.match(hashes, conf.PdqMaxDistance, conf.PdqMinQuality); match != nil {
+			return match, nil
+		}
+	}
+	if conf.ApiUrl != "" {
+		return checkApi(ctx, conf, hashes)
+	}
+	return nil, nil
+}
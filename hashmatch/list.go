@@ -0,0 +1,108 @@
+package hashmatch
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// localList is a hash list loaded from a file. Each line is `md5:<hex>` or `pdq:<hex>`, optionally followed by
+// whitespace and a reason. Blank lines and lines starting with # are ignored.
+type localList struct {
+	path    string
+	modTime time.Time
+	md5     map[string]string
+	pdq     map[string]string
+}
+
+var cachedList *localList
+var listLock = new(sync.Mutex)
+
+// getLocalList returns the list at the path, reloading it if the file has changed since it was last read.
+func getLocalList(path string) (*localList, error) {
+	listLock.Lock()
+	defer listLock.Unlock()
+
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if cachedList != nil && cachedList.path == path && cachedList.modTime.Equal(stat.ModTime()) {
+		return cachedList, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	list := &localList{
+		path:    path,
+		modTime: stat.ModTime(),
+		md5:     make(map[string]string),
+		pdq:     make(map[string]string),
+	}
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		entry, reason, _ := strings.Cut(strings.ReplaceAll(line, "\t", " "), " ")
+		hashType, hash, ok := strings.Cut(strings.ToLower(entry), ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid hash list entry on line %d", lineNum)
+		}
+		reason = strings.TrimSpace(reason)
+		switch hashType {
+		case HashTypeMd5:
+			list.md5[hash] = reason
+		case HashTypePdq:
+			list.pdq[hash] = reason
+		default:
+			return nil, fmt.Errorf("unknown hash type '%s' on line %d", hashType, lineNum)
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	cachedList = list
+	return list, nil
+}
+
+func (l *localList) match(hashes *Hashes, pdqMaxDistance int, pdqMinQuality int) *Match {
+	if reason, ok := l.md5[hashes.Md5]; ok {
+		return &Match{
+			HashType: HashTypeMd5,
+			Hash:     hashes.Md5,
+			Source:   "list",
+			Reason:   reason,
+		}
+	}
+	if hashes.Pdq == "" || hashes.PdqQuality < pdqMinQuality {
+		return nil
+	}
+	// PDQ matches are near matches, so every entry needs comparing
+	var best *Match
+	for hash, reason := range l.pdq {
+		distance := PdqDistance(hashes.Pdq, hash)
+		if distance < 0 || distance > pdqMaxDistance {
+			continue
+		}
+		if best == nil || distance < best.Distance {
+			best = &Match{
+				HashType: HashTypePdq,
+				Hash:     hash,
+				Distance: distance,
+				Source:   "list",
+				Reason:   reason,
+			}
+		}
+	}
+	return best
+}
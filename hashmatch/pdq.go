@@ -0,0 +1,202 @@
+package hashmatch
+
+import (
+	"encoding/hex"
+	"fmt"
+	"image"
+	"math"
+	"math/bits"
+	"sort"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// This is a port of the reference PDQ implementation (https://github.com/facebook/ThreatExchange/tree/main/pdq).
+// Hashes are formatted the same way as the reference, so they can be compared with industry hash lists.
+
+const pdqBufferSize = 64
+const pdqHashSize = 16
+
+// pdqDownsampleSize is the largest dimension hashed, as in the reference. Larger images are shrunk first, which
+// barely changes the hash and keeps the cost of hashing bounded.
+const pdqDownsampleSize = 512
+
+var pdqDct = makePdqDctMatrix()
+
+func makePdqDctMatrix() [pdqHashSize][pdqBufferSize]float64 {
+	var d [pdqHashSize][pdqBufferSize]float64
+	scale := math.Sqrt(2.0 / pdqBufferSize)
+	for i := 0; i < pdqHashSize; i++ {
+		for j := 0; j < pdqBufferSize; j++ {
+			d[i][j] = scale * math.Cos((math.Pi/2/pdqBufferSize)*float64(i+1)*float64(2*j+1))
+		}
+	}
+	return d
+}
+
+// PdqHash computes the 256 bit PDQ hash of the image as 64 hex characters, and its quality from 0 to 100. Hashes
+// of low quality images (such as solid colours) match too easily to be useful.
+func PdqHash(img image.Image) (string, int) {
+	b := img.Bounds()
+	if b.Dx() > pdqDownsampleSize || b.Dy() > pdqDownsampleSize {
+		img = imaging.Fit(img, pdqDownsampleSize, pdqDownsampleSize, imaging.Box)
+		b = img.Bounds()
+	}
+	numRows := b.Dy()
+	numCols := b.Dx()
+	if numRows == 0 || numCols == 0 {
+		return "", 0
+	}
+
+	luma := make([]float64, numRows*numCols)
+	for y := 0; y < numRows; y++ {
+		for x := 0; x < numCols; x++ {
+			r, g, bl, _ := img.At(b.Min.X+x, b.Min.Y+y).RGBA()
+			luma[y*numCols+x] = 0.299*float64(r>>8) + 0.587*float64(g>>8) + 0.114*float64(bl>>8)
+		}
+	}
+
+	jaroszFilter(luma, numRows, numCols, jaroszWindowSize(numCols), jaroszWindowSize(numRows), 2)
+	var buf [pdqBufferSize][pdqBufferSize]float64
+	for i := 0; i < pdqBufferSize; i++ {
+		ini := int((float64(i) + 0.5) * float64(numRows) / pdqBufferSize)
+		for j := 0; j < pdqBufferSize; j++ {
+			inj := int((float64(j) + 0.5) * float64(numCols) / pdqBufferSize)
+			buf[i][j] = luma[ini*numCols+inj]
+		}
+	}
+
+	quality := pdqQuality(&buf)
+
+	// DCT * buf * DCT^T, keeping only the top-left 16x16 coefficients (without the DC component)
+	var tmp [pdqHashSize][pdqBufferSize]float64
+	for i := 0; i < pdqHashSize; i++ {
+		for j := 0; j < pdqBufferSize; j++ {
+			sum := 0.0
+			for k := 0; k < pdqBufferSize; k++ {
+				sum += pdqDct[i][k] * buf[k][j]
+			}
+			tmp[i][j] = sum
+		}
+	}
+	coefficients := make([]float64, pdqHashSize*pdqHashSize)
+	for i := 0; i < pdqHashSize; i++ {
+		for j := 0; j < pdqHashSize; j++ {
+			sum := 0.0
+			for k := 0; k < pdqBufferSize; k++ {
+				sum += tmp[i][k] * pdqDct[j][k]
+			}
+			coefficients[i*pdqHashSize+j] = sum
+		}
+	}
+
+	sorted := make([]float64, len(coefficients))
+	copy(sorted, coefficients)
+	sort.Float64s(sorted)
+	median := sorted[(len(sorted)+1)/2-1] // the lower median, as picked by the reference's Torben median
+
+	var words [pdqHashSize]uint16
+	for k, v := range coefficients {
+		if v > median {
+			words[k>>4] |= 1 << (k & 15)
+		}
+	}
+
+	// The reference formats the most significant word first
+	sb := strings.Builder{}
+	for i := pdqHashSize - 1; i >= 0; i-- {
+		sb.WriteString(fmt.Sprintf("%04x", words[i]))
+	}
+	return sb.String(), quality
+}
+
+// PdqDistance returns the number of bits which differ between two hex PDQ hashes, or -1 if either is invalid.
+func PdqDistance(a string, b string) int {
+	ab, err := hex.DecodeString(a)
+	if err != nil || len(ab) != 32 {
+		return -1
+	}
+	bb, err := hex.DecodeString(b)
+	if err != nil || len(bb) != 32 {
+		return -1
+	}
+	distance := 0
+	for i := range ab {
+		distance += bits.OnesCount8(ab[i] ^ bb[i])
+	}
+	return distance
+}
+
+func pdqQuality(buf *[pdqBufferSize][pdqBufferSize]float64) int {
+	gradientSum := 0
+	for i := 0; i < pdqBufferSize-1; i++ {
+		for j := 0; j < pdqBufferSize; j++ {
+			gradientSum += int(math.Abs((buf[i][j] - buf[i+1][j]) * 100 / 255))
+		}
+	}
+	for i := 0; i < pdqBufferSize; i++ {
+		for j := 0; j < pdqBufferSize-1; j++ {
+			gradientSum += int(math.Abs((buf[i][j] - buf[i][j+1]) * 100 / 255))
+		}
+	}
+	return min(gradientSum/90, 100)
+}
+
+func jaroszWindowSize(oldDimension int) int {
+	return (oldDimension + 2*pdqBufferSize - 1) / (2 * pdqBufferSize)
+}
+
+// jaroszFilter blurs the buffer in place with repeated box filters, approximating a tent filter.
+func jaroszFilter(buf []float64, numRows int, numCols int, windowAlongRows int, windowAlongCols int, iterations int) {
+	tmp := make([]float64, len(buf))
+	for n := 0; n < iterations; n++ {
+		for i := 0; i < numRows; i++ {
+			box1D(buf[i*numCols:], tmp[i*numCols:], numCols, 1, windowAlongRows)
+		}
+		for j := 0; j < numCols; j++ {
+			box1D(tmp[j:], buf[j:], numRows, numCols, windowAlongCols)
+		}
+	}
+}
+
+func box1D(in []float64, out []float64, length int, stride int, fullWindowSize int) {
+	halfWindowSize := (fullWindowSize + 2) / 2
+	phase1 := halfWindowSize - 1
+	phase2 := fullWindowSize - halfWindowSize + 1
+	phase3 := length - fullWindowSize
+	phase4 := halfWindowSize - 1
+
+	li := 0
+	ri := 0
+	oi := 0
+	sum := 0.0
+	windowSize := 0
+	for i := 0; i < phase1; i++ {
+		sum += in[ri]
+		windowSize++
+		ri += stride
+	}
+	for i := 0; i < phase2; i++ {
+		sum += in[ri]
+		windowSize++
+		out[oi] = sum / float64(windowSize)
+		ri += stride
+		oi += stride
+	}
+	for i := 0; i < phase3; i++ {
+		sum += in[ri]
+		sum -= in[li]
+		out[oi] = sum / float64(windowSize)
+		li += stride
+		ri += stride
+		oi += stride
+	}
+	for i := 0; i < phase4; i++ {
+		sum -= in[li]
+		windowSize--
+		out[oi] = sum / float64(windowSize)
+		li += stride
+		oi += stride
+	}
+}
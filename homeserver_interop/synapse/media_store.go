@@ -0,0 +1,37 @@
+package synapse
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// WalkLocalMediaStore calls fn for each local media file in a Synapse media_store_path, in lexical media ID order.
+// Thumbnails, remote media, and URL previews are not visited.
+func WalkLocalMediaStore(storePath string, fn func(mediaId string, filePath string) error) error {
+	// For MediaID AABBCCDD :
+	// $storePath/local_content/AA/BB/CCDD
+	root := filepath.Join(storePath, "local_content")
+	if _, err := os.Stat(root); err != nil {
+		return errors.Join(errors.New("media store does not appear to have a local_content directory"), err)
+	}
+	return filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		parts := strings.Split(filepath.ToSlash(rel), "/")
+		if len(parts) != 3 {
+			return nil // not a media file
+		}
+		return fn(strings.Join(parts, ""), p)
+	})
+}
@@ -0,0 +1,180 @@
+package limits
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/redislib"
+)
+
+// RateLimitError is returned when an upload would exceed a rate limit. It wraps common.ErrRateLimitExceeded.
+type RateLimitError struct {
+	RetryAfter time.Duration
+	Reason     string
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("%s: %s", common.ErrRateLimitExceeded.Error(), e.Reason)
+}
+
+func (e *RateLimitError) Unwrap() error {
+	return common.ErrRateLimitExceeded
+}
+
+type localCounter struct {
+	value     int64
+	expiresAt time.Time
+}
+
+// localCounters are used when Redis isn't available, and are therefore not shared across processes
+var localCounters = make(map[string]*localCounter)
+var localCountersLock = &sync.Mutex{}
+
+type uploadCounter struct {
+	key       string
+	by        int64
+	limit     int64
+	window    time.Duration
+	resetsAt  time.Time
+	limitName string
+}
+
+// uploadCounters returns the enabled counters which an upload of sizeBytes by the user to the server would count
+// against.
+func uploadCounters(conf config.UploadRateLimits, userId string, serverName string, sizeBytes int64) []uploadCounter {
+	checks := []struct {
+		subject string
+		limits  config.UploadRateLimitConfig
+	}{
+		{"user:" + userId, conf.PerUser},
+		{"server:" + serverName, conf.PerServer},
+	}
+
+	now := time.Now()
+	counters := make([]uploadCounter, 0)
+	for _, check := range checks {
+		for _, c := range []struct {
+			name   string
+			by     int64
+			limit  int64
+			window time.Duration
+		}{
+			{"uploads", 1, check.limits.UploadsPerMinute, time.Minute},
+			{"bytes", sizeBytes, check.limits.BytesPerHour, time.Hour},
+		} {
+			if c.limit <= 0 {
+				continue
+			}
+			windowStart := now.Truncate(c.window)
+			counters = append(counters, uploadCounter{
+				key:       fmt.Sprintf("mmr:ratelimit:%s:%s:%d", c.name, check.subject, windowStart.Unix()),
+				by:        c.by,
+				limit:     c.limit,
+				window:    c.window,
+				resetsAt:  windowStart.Add(c.window),
+				limitName: fmt.Sprintf("%s %s", check.subject, c.name),
+			})
+		}
+	}
+	return counters
+}
+
+func (c uploadCounter) exceeded(val int64) error {
+	if val <= c.limit {
+		return nil
+	}
+	return &RateLimitError{
+		RetryAfter: time.Until(c.resetsAt),
+		Reason:     c.limitName + " limit reached",
+	}
+}
+
+// CheckUploadStart checks, without counting anything, whether an upload of declaredBytes would currently be allowed
+// by the upload rate limits of the request's domain. This is used to reject uploads before their body is read: the
+// upload is counted by CheckUpload once its actual size is known. A declaredBytes of zero or less (unknown) only
+// checks the number of uploads.
+func CheckUploadStart(ctx rcontext.RequestContext, userId string, serverName string, declaredBytes int64) error {
+	conf := ctx.Config.Uploads.RateLimit
+	if !conf.Enabled {
+		return nil
+	}
+	if declaredBytes < 0 {
+		declaredBytes = 0
+	}
+
+	for _, c := range uploadCounters(conf, userId, serverName, declaredBytes) {
+		val, err := increment(ctx, c.key, 0, c.window)
+		if err != nil {
+			return err
+		}
+		if err = c.exceeded(val + c.by); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CheckUpload counts an upload of sizeBytes against the upload rate limits of the request's domain, for the user and
+// the server they are uploading to. If any limit would be exceeded, nothing is counted and a *RateLimitError is
+// returned.
+func CheckUpload(ctx rcontext.RequestContext, userId string, serverName string, sizeBytes int64) error {
+	conf := ctx.Config.Uploads.RateLimit
+	if !conf.Enabled {
+		return nil
+	}
+
+	applied := make([]uploadCounter, 0)
+	rollback := func() {
+		for _, c := range applied {
+			if _, err := increment(ctx, c.key, -c.by, c.window); err != nil {
+				ctx.Log.Warn("Error rolling back upload rate limit counter: ", err)
+				sentry.CaptureException(err)
+			}
+		}
+	}
+
+	for _, c := range uploadCounters(conf, userId, serverName, sizeBytes) {
+		val, err := increment(ctx, c.key, c.by, c.window)
+		if err != nil {
+			rollback()
+			return err
+		}
+		applied = append(applied, c)
+		if err = c.exceeded(val); err != nil {
+			rollback()
+			return err
+		}
+	}
+
+	return nil
+}
+
+func increment(ctx rcontext.RequestContext, key string, by int64, window time.Duration) (int64, error) {
+	val, ok, err := redislib.IncrementCounter(ctx, key, by, window)
+	if ok {
+		return val, err
+	}
+
+	localCountersLock.Lock()
+	defer localCountersLock.Unlock()
+
+	now := time.Now()
+	for k, c := range localCounters {
+		if now.After(c.expiresAt) {
+			delete(localCounters, k)
+		}
+	}
+
+	counter, ok := localCounters[key]
+	if !ok {
+		counter = &localCounter{expiresAt: now.Add(window)}
+		localCounters[key] = counter
+	}
+	counter.value += by
+	return counter.value, nil
+}
@@ -50,6 +50,10 @@ func getFederationBreaker(hostname string) *circuit.Breaker {
 }
 
 func doBreakerRequest(ctx rcontext.RequestContext, serverName string, accessToken string, appserviceUserId string, ipAddr string, method string, path string, resp interface{}) error {
+	return doBreakerRequestWithBody(ctx, serverName, accessToken, appserviceUserId, ipAddr, method, path, nil, resp)
+}
+
+func doBreakerRequestWithBody(ctx rcontext.RequestContext, serverName string, accessToken string, appserviceUserId string, ipAddr string, method string, path string, body interface{}, resp interface{}) error {
 	hs, cb := getBreakerAndConfig(serverName)
 
 	var replyError error
@@ -66,7 +70,7 @@ func doBreakerRequest(ctx rcontext.RequestContext, serverName string, accessToke
 			q.Set(k, v)
 		}
 		target.RawQuery = q.Encode()
-		err := doRequest(ctx, method, target.String(), nil, resp, accessToken, ipAddr)
+		err := doRequest(ctx, method, target.String(), body, resp, accessToken, ipAddr)
 		if err != nil {
 			ctx.Log.Debug("Error from homeserver: ", err)
 			err, authError = filterError(err)
@@ -0,0 +1,73 @@
+package matrix
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/metrics"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+type originState struct {
+	lock          sync.Mutex
+	failures      int
+	nextAttemptTs int64
+}
+
+var origins = &sync.Map{}
+
+func getOriginState(origin string) *originState {
+	state, _ := origins.LoadOrStore(origin, &originState{})
+	return state.(*originState)
+}
+
+// CheckOriginBackoff returns common.ErrOriginUnavailable if the origin has failed too many times in a row and is
+// still being backed off from. Once the backoff expires, requests are let through again to see if the origin has
+// recovered.
+func CheckOriginBackoff(origin string) error {
+	if !config.Get().Federation.OriginBackoff.Enabled {
+		return nil
+	}
+	state := getOriginState(origin)
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	if state.nextAttemptTs > util.NowMillis() {
+		metrics.RemoteFetchesShortCircuited.With(prometheus.Labels{"origin": origin}).Inc()
+		return common.ErrOriginUnavailable
+	}
+	return nil
+}
+
+// RecordOriginSuccess resets the origin's failure count. Any response from the origin which isn't a server error
+// (including 404s) counts as a success.
+func RecordOriginSuccess(origin string) {
+	state := getOriginState(origin)
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	state.failures = 0
+	state.nextAttemptTs = 0
+}
+
+// RecordOriginFailure counts a failed request to the origin. Once the failure threshold is reached, the origin is
+// backed off from for exponentially longer after each further failure, up to the configured maximum.
+func RecordOriginFailure(origin string) {
+	conf := config.Get().Federation.OriginBackoff
+	state := getOriginState(origin)
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	state.failures++
+	if state.failures < conf.FailureThreshold {
+		return
+	}
+
+	backoff := time.Duration(conf.MinBackoffSeconds) * time.Second
+	maxBackoff := time.Duration(conf.MaxBackoffSeconds) * time.Second
+	for i := conf.FailureThreshold; i < state.failures && backoff < maxBackoff; i++ {
+		backoff *= 2
+	}
+	backoff = min(backoff, maxBackoff)
+	state.nextAttemptTs = util.NowMillis() + backoff.Milliseconds()
+}
@@ -15,6 +15,7 @@ import (
 	"time"
 
 	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/faults"
 )
 
 const NoSigningKey = ""
@@ -22,6 +23,9 @@ const NoSigningKey = ""
 // Based in part on https://github.com/matrix-org/gomatrix/blob/072b39f7fa6b40257b4eead8c958d71985c28bdd/client.go#L180-L243
 func doRequest(ctx rcontext.RequestContext, method string, urlStr string, body interface{}, result interface{}, accessToken string, ipAddr string) error {
 	ctx.Log.Debugf("Calling %s %s", method, urlStr)
+	if err := faults.Inject(faults.TargetHomeservers); err != nil {
+		return err
+	}
 	var bodyBytes []byte
 	if body != nil {
 		jsonStr, err := json.Marshal(body)
@@ -88,6 +92,10 @@ func FederatedGet(ctx rcontext.RequestContext, reqUrl string, realHost string, d
 
 	var resp *http.Response
 	replyError := cb.CallContext(ctx, func() error {
+		if err := faults.Inject(faults.TargetFederation); err != nil {
+			return err
+		}
+
 		req, err := http.NewRequest(http.MethodGet, reqUrl, nil)
 		if err != nil {
 			return err
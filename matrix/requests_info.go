@@ -1,6 +1,10 @@
 package matrix
 
-import "github.com/t2bot/matrix-media-repo/common/rcontext"
+import (
+	"net/url"
+
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+)
 
 type ClientVersionsResponse struct {
 	Versions         []string        `json:"versions"`
@@ -15,3 +19,51 @@ func ClientVersions(ctx rcontext.RequestContext, serverName string, accessToken
 	}
 	return response, nil
 }
+
+func GetJoinedRooms(ctx rcontext.RequestContext, serverName string, accessToken string, ipAddr string) ([]string, error) {
+	response := &joinedRoomsResponse{}
+	err := doBreakerRequest(ctx, serverName, accessToken, "", ipAddr, "GET", "/_matrix/client/v3/joined_rooms", response)
+	if err != nil {
+		return nil, err
+	}
+	return response.JoinedRooms, nil
+}
+
+func GetRoomState(ctx rcontext.RequestContext, serverName string, accessToken string, roomId string) ([]*StateEvent, error) {
+	response := make([]*StateEvent, 0)
+	err := doBreakerRequest(ctx, serverName, accessToken, "", "", "GET", "/_matrix/client/v3/rooms/"+url.PathEscape(roomId)+"/state", &response)
+	if err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// GetStateEvent gets the content of the room's state event with the given type and state key, as seen by the user.
+func GetStateEvent(ctx rcontext.RequestContext, serverName string, accessToken string, ipAddr string, roomId string, eventType string, stateKey string, content interface{}) error {
+	path := "/_matrix/client/v3/rooms/" + url.PathEscape(roomId) + "/state/" + url.PathEscape(eventType) + "/" + url.PathEscape(stateKey)
+	return doBreakerRequest(ctx, serverName, accessToken, "", ipAddr, "GET", path, content)
+}
+
+// SendStateEvent replaces the room's state event of the given type and state key. Returns the new event's ID.
+func SendStateEvent(ctx rcontext.RequestContext, serverName string, accessToken string, roomId string, eventType string, stateKey string, content interface{}) (string, error) {
+	response := &sendEventResponse{}
+	path := "/_matrix/client/v3/rooms/" + url.PathEscape(roomId) + "/state/" + url.PathEscape(eventType) + "/" + url.PathEscape(stateKey)
+	err := doBreakerRequestWithBody(ctx, serverName, accessToken, "", "", "PUT", path, content, response)
+	if err != nil {
+		return "", err
+	}
+	return response.EventId, nil
+}
+
+// GetAccountData gets the content of the user's global account data of the given type. If the user has no such
+// account data, an *ErrorResponse with the M_NOT_FOUND code is returned.
+func GetAccountData(ctx rcontext.RequestContext, serverName string, accessToken string, ipAddr string, userId string, dataType string, content interface{}) error {
+	path := "/_matrix/client/v3/user/" + url.PathEscape(userId) + "/account_data/" + url.PathEscape(dataType)
+	return doBreakerRequest(ctx, serverName, accessToken, "", ipAddr, "GET", path, content)
+}
+
+// SetAccountData replaces the content of the user's global account data of the given type.
+func SetAccountData(ctx rcontext.RequestContext, serverName string, accessToken string, ipAddr string, userId string, dataType string, content interface{}) error {
+	path := "/_matrix/client/v3/user/" + url.PathEscape(userId) + "/account_data/" + url.PathEscape(dataType)
+	return doBreakerRequestWithBody(ctx, serverName, accessToken, "", ipAddr, "PUT", path, content, nil)
+}
@@ -34,6 +34,7 @@ type ServerSigningKeys map[string]ed25519.PublicKey
 var signingKeySf = new(typedsf.Group[ServerSigningKeys])
 var signingKeyCache = cache.New(cache.NoExpiration, 30*time.Second)
 var signingKeyRWLock = new(sync.RWMutex)
+var signingKeyRefreshes = cache.New(time.Minute, 2*time.Minute)
 
 // TestsOnlyInjectSigningKey
 // Deprecated: For tests only.
@@ -95,7 +96,7 @@ func QuerySigningKeys(serverName string) (ServerSigningKeys, error) {
 
 		// check cache once more, just in case the locks overlapped
 		cachedKeys := querySigningKeyCache(serverName)
-		if keys != nil {
+		if cachedKeys != nil {
 			return cachedKeys, nil
 		}
 
@@ -149,6 +150,18 @@ func QuerySigningKeys(serverName string) (ServerSigningKeys, error) {
 	return keys, err
 }
 
+// RefreshSigningKeys forgets the cached keys for the server and fetches them again. This is used when a request is
+// signed by a key we don't know about yet, such as after the server rotated its key. To avoid being made to fetch
+// keys for every request, keys are only refreshed once per minute for each server.
+func RefreshSigningKeys(serverName string) (ServerSigningKeys, error) {
+	if err := signingKeyRefreshes.Add(serverName, true, cache.DefaultExpiration); err == nil {
+		signingKeyRWLock.Lock()
+		signingKeyCache.Delete(serverName)
+		signingKeyRWLock.Unlock()
+	}
+	return QuerySigningKeys(serverName)
+}
+
 func CheckSigningKeySignatures(serverName string, keyInfo *ServerKeyResult, raw database.AnonymousJson) (ServerSigningKeys, error) {
 	serverKeys := make(ServerSigningKeys)
 	for keyId, keyObj := range keyInfo.VerifyKeys {
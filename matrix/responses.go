@@ -13,6 +13,23 @@ type whoisResponse struct {
 	// We don't actually care about any of the fields here
 }
 
+type joinedRoomsResponse struct {
+	JoinedRooms []string `json:"joined_rooms"`
+}
+
+type sendEventResponse struct {
+	EventId string `json:"event_id"`
+}
+
+// StateEvent is the subset of a room state event the media repo needs.
+type StateEvent struct {
+	Type     string                 `json:"type"`
+	StateKey string                 `json:"state_key"`
+	EventId  string                 `json:"event_id"`
+	Sender   string                 `json:"sender"`
+	Content  map[string]interface{} `json:"content"`
+}
+
 type MediaListResponse struct {
 	LocalMxcs  []string `json:"local"`
 	RemoteMxcs []string `json:"remote"`
@@ -21,3 +38,27 @@ type MediaListResponse struct {
 type wellknownServerResponse struct {
 	ServerAddr string `json:"m.server"`
 }
+
+type PowerLevelsContent struct {
+	Users        map[string]int `json:"users"`
+	UsersDefault int            `json:"users_default"`
+	Redact       *int           `json:"redact,omitempty"`
+}
+
+// UserLevel returns the user's power level, falling back to the room's default.
+func (p *PowerLevelsContent) UserLevel(userId string) int {
+	if level, ok := p.Users[userId]; ok {
+		return level
+	}
+	return p.UsersDefault
+}
+
+// CanRedact returns true if the user's power level allows them to redact other users' events, making them a moderator
+// of the room.
+func (p *PowerLevelsContent) CanRedact(userId string) bool {
+	redact := 50 // spec default
+	if p.Redact != nil {
+		redact = *p.Redact
+	}
+	return p.UserLevel(userId) >= redact
+}
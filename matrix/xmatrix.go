@@ -30,6 +30,16 @@ func ValidateXMatrixAuth(request *http.Request, expectNoContent bool) (string, e
 	if err != nil {
 		return "", err
 	}
+	for _, auth := range auths {
+		if _, ok := keys[auth.KeyId]; !ok {
+			// The server may have a new key since we last asked
+			keys, err = RefreshSigningKeys(auths[0].Origin)
+			if err != nil {
+				return "", err
+			}
+			break
+		}
+	}
 
 	uri := request.RequestURI
 	if strings.HasSuffix(uri, "?") {
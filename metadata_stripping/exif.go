@@ -0,0 +1,62 @@
+package metadata_stripping
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+const orientationTag = 0x0112
+
+var exifHeader = []byte("Exif\x00\x00")
+
+// exifOrientation reads the orientation tag from raw EXIF data, returning zero if not present.
+func exifOrientation(b []byte) uint16 {
+	b = bytes.TrimPrefix(b, exifHeader)
+	if len(b) < 8 {
+		return 0
+	}
+
+	var order binary.ByteOrder
+	switch string(b[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+
+	offset := int64(order.Uint32(b[4:8]))
+	if offset+2 > int64(len(b)) {
+		return 0
+	}
+	count := int64(order.Uint16(b[offset:]))
+	for i := int64(0); i < count; i++ {
+		entry := offset + 2 + (i * 12)
+		if entry+12 > int64(len(b)) {
+			break
+		}
+		if order.Uint16(b[entry:]) == orientationTag && order.Uint16(b[entry+2:]) == 3 { // 3 = SHORT
+			val := order.Uint16(b[entry+8:])
+			if val >= 1 && val <= 8 {
+				return val
+			}
+			break
+		}
+	}
+	return 0
+}
+
+// minimalExif builds TIFF-formatted EXIF data containing only the orientation tag.
+func minimalExif(orientation uint16) []byte {
+	b := make([]byte, 26)
+	copy(b, "MM\x00\x2a")
+	binary.BigEndian.PutUint32(b[4:], 8)               // offset of IFD0
+	binary.BigEndian.PutUint16(b[8:], 1)               // 1 entry
+	binary.BigEndian.PutUint16(b[10:], orientationTag) // tag
+	binary.BigEndian.PutUint16(b[12:], 3)              // SHORT
+	binary.BigEndian.PutUint32(b[14:], 1)              // count
+	binary.BigEndian.PutUint16(b[18:], orientation)    // value (left-justified), followed by padding
+	// the remaining 4 bytes are the (zero) offset to the next IFD
+	return b
+}
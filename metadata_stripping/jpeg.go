@@ -0,0 +1,105 @@
+package metadata_stripping
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+)
+
+const (
+	jpegSOI   = 0xD8
+	jpegEOI   = 0xD9
+	jpegSOS   = 0xDA
+	jpegAPP1  = 0xE1 // EXIF and XMP
+	jpegAPP13 = 0xED // Photoshop/IPTC
+	jpegCOM   = 0xFE
+)
+
+func stripJpeg(r *bufio.Reader, w io.Writer) error {
+	if sig, err := r.Peek(2); err != nil || sig[0] != 0xFF || sig[1] != jpegSOI {
+		_, err = io.Copy(w, r)
+		return err
+	}
+	if _, err := io.CopyN(w, r, 2); err != nil {
+		return err
+	}
+
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return eofOk(err)
+		}
+		if b != 0xFF {
+			// Not where we expect a marker: give up and pass the rest through untouched
+			if _, err = w.Write([]byte{b}); err != nil {
+				return err
+			}
+			_, err = io.Copy(w, r)
+			return err
+		}
+		marker := byte(0xFF)
+		for marker == 0xFF { // skip fill bytes
+			if marker, err = r.ReadByte(); err != nil {
+				return eofOk(err)
+			}
+		}
+
+		// Markers without a length
+		if marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7) {
+			if _, err = w.Write([]byte{0xFF, marker}); err != nil {
+				return err
+			}
+			continue
+		}
+		if marker == jpegEOI || marker == jpegSOS {
+			// Everything after the start of scan is image data
+			if _, err = w.Write([]byte{0xFF, marker}); err != nil {
+				return err
+			}
+			_, err = io.Copy(w, r)
+			return err
+		}
+
+		lenBytes := make([]byte, 2)
+		if _, err = io.ReadFull(r, lenBytes); err != nil {
+			return eofOk(err)
+		}
+		length := int64(binary.BigEndian.Uint16(lenBytes)) - 2
+		if length < 0 {
+			length = 0
+		}
+
+		if marker == jpegAPP1 || marker == jpegAPP13 || marker == jpegCOM {
+			payload := make([]byte, length)
+			if _, err = io.ReadFull(r, payload); err != nil {
+				return eofOk(err)
+			}
+			// Drop the segment, unless it's EXIF with an orientation we need to keep
+			if marker == jpegAPP1 {
+				if orientation := exifOrientation(payload); orientation > 1 {
+					replacement := append(append([]byte{}, exifHeader...), minimalExif(orientation)...)
+					segment := []byte{0xFF, jpegAPP1, 0, 0}
+					binary.BigEndian.PutUint16(segment[2:], uint16(len(replacement)+2))
+					if _, err = w.Write(append(segment, replacement...)); err != nil {
+						return err
+					}
+				}
+			}
+			continue
+		}
+
+		if _, err = w.Write([]byte{0xFF, marker, lenBytes[0], lenBytes[1]}); err != nil {
+			return err
+		}
+		if _, err = io.CopyN(w, r, length); err != nil {
+			return eofOk(err)
+		}
+	}
+}
+
+func eofOk(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil // truncated image: we've written everything we could
+	}
+	return err
+}
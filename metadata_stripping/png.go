@@ -0,0 +1,77 @@
+package metadata_stripping
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+)
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+var pngDroppedChunks = map[string]bool{
+	"eXIf": true,
+	"tEXt": true,
+	"zTXt": true,
+	"iTXt": true,
+	"tIME": true,
+}
+
+func stripPng(r *bufio.Reader, w io.Writer) error {
+	if sig, err := r.Peek(len(pngSignature)); err != nil || !bytes.Equal(sig, pngSignature) {
+		_, err = io.Copy(w, r)
+		return err
+	}
+	if _, err := io.CopyN(w, r, int64(len(pngSignature))); err != nil {
+		return err
+	}
+
+	header := make([]byte, 8) // length + type
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			return eofOk(err)
+		}
+		length := int64(binary.BigEndian.Uint32(header[0:4]))
+		chunkType := string(header[4:8])
+
+		if pngDroppedChunks[chunkType] {
+			data := make([]byte, length)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return eofOk(err)
+			}
+			if _, err := r.Discard(4); err != nil { // crc
+				return eofOk(err)
+			}
+			if chunkType == "eXIf" {
+				if orientation := exifOrientation(data); orientation > 1 {
+					if err := writePngChunk(w, chunkType, minimalExif(orientation)); err != nil {
+						return err
+					}
+				}
+			}
+			continue
+		}
+
+		if _, err := w.Write(header); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(w, r, length+4); err != nil { // data + crc
+			return eofOk(err)
+		}
+		if chunkType == "IEND" {
+			_, err := io.Copy(w, r)
+			return err
+		}
+	}
+}
+
+func writePngChunk(w io.Writer, chunkType string, data []byte) error {
+	b := make([]byte, 8, 12+len(data))
+	binary.BigEndian.PutUint32(b[0:4], uint32(len(data)))
+	copy(b[4:8], chunkType)
+	b = append(b, data...)
+	b = binary.BigEndian.AppendUint32(b, crc32.ChecksumIEEE(b[4:]))
+	_, err := w.Write(b)
+	return err
+}
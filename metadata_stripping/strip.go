@@ -0,0 +1,61 @@
+package metadata_stripping
+
+import (
+	"bufio"
+	"io"
+
+	"github.com/t2bot/matrix-media-repo/util"
+	"github.com/t2bot/matrix-media-repo/util/readers"
+)
+
+type stripFn func(r *bufio.Reader, w io.Writer) error
+
+var strippers = map[string]stripFn{
+	"image/jpeg": stripJpeg,
+	"image/jpg":  stripJpeg,
+	"image/png":  stripPng,
+	"image/webp": stripWebp,
+}
+
+func IsSupported(contentType string) bool {
+	_, ok := strippers[util.FixContentType(contentType)]
+	return ok
+}
+
+// Strip returns a stream of the image with identifying metadata (EXIF, XMP, comments, etc) removed. The
+// image's orientation is retained. Streams which don't look like the claimed content type are passed through
+// untouched. Unsupported content types return the stream as-is.
+func Strip(r io.ReadCloser, contentType string) io.ReadCloser {
+	fn, ok := strippers[util.FixContentType(contentType)]
+	if !ok {
+		return r
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		src := &errorTrackingReader{r: r}
+		err := fn(bufio.NewReader(src), pw)
+		if src.err != nil {
+			// The strippers tolerate truncated images, so make sure we don't hide a failed read
+			err = src.err
+		}
+		_ = pw.CloseWithError(err)
+	}()
+	return readers.NewCancelCloser(pr, func() {
+		_ = pr.Close()
+		_ = r.Close()
+	})
+}
+
+type errorTrackingReader struct {
+	r   io.Reader
+	err error
+}
+
+func (t *errorTrackingReader) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	if err != nil && err != io.EOF && t.err == nil {
+		t.err = err
+	}
+	return n, err
+}
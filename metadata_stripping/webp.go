@@ -0,0 +1,81 @@
+package metadata_stripping
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+)
+
+const (
+	webpFlagXmp  = 0x04
+	webpFlagExif = 0x08
+)
+
+// stripWebp removes metadata from WebP images. The RIFF container declares its size up front, so rather than
+// buffering the whole image to recalculate it, metadata chunks are overwritten in place: the EXIF chunk is
+// replaced with one holding only the orientation, and XMP chunks become zeroed unknown chunks (which decoders
+// ignore).
+func stripWebp(r *bufio.Reader, w io.Writer) error {
+	if sig, err := r.Peek(12); err != nil || string(sig[0:4]) != "RIFF" || string(sig[8:12]) != "WEBP" {
+		_, err = io.Copy(w, r)
+		return err
+	}
+	if _, err := io.CopyN(w, r, 12); err != nil {
+		return err
+	}
+
+	header := make([]byte, 8) // fourcc + size
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			return eofOk(err)
+		}
+		fourcc := string(header[0:4])
+		size := int64(binary.LittleEndian.Uint32(header[4:8]))
+		padded := size + (size & 1)
+
+		switch fourcc {
+		case "VP8X":
+			data := make([]byte, padded)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return eofOk(err)
+			}
+			if len(data) > 0 {
+				data[0] &^= webpFlagXmp
+			}
+			if _, err := w.Write(append(header, data...)); err != nil {
+				return err
+			}
+		case "EXIF", "XMP ":
+			data := make([]byte, padded)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return eofOk(err)
+			}
+			replacement := make([]byte, padded)
+			if fourcc == "EXIF" {
+				orientation := exifOrientation(data)
+				if orientation == 0 {
+					orientation = 1
+				}
+				minimal := minimalExif(orientation)
+				if int64(len(minimal)) <= size {
+					copy(replacement, minimal)
+				} else {
+					fourcc = "JUNK"
+				}
+			} else {
+				fourcc = "JUNK"
+			}
+			copy(header[0:4], fourcc)
+			if _, err := w.Write(append(header, replacement...)); err != nil {
+				return err
+			}
+		default:
+			if _, err := w.Write(header); err != nil {
+				return err
+			}
+			if _, err := io.CopyN(w, r, padded); err != nil {
+				return eofOk(err)
+			}
+		}
+	}
+}
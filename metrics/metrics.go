@@ -22,24 +22,108 @@ var CacheHits = prometheus.NewCounterVec(prometheus.CounterOpts{
 var CacheMisses = prometheus.NewCounterVec(prometheus.CounterOpts{
 	Name: "media_cache_misses_total",
 }, []string{"cache"})
+var CacheEvictions = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "media_cache_evictions_total",
+}, []string{"cache"})
 var ThumbnailsGenerated = prometheus.NewCounterVec(prometheus.CounterOpts{
 	Name: "media_thumbnails_generated_total",
 }, []string{"width", "height", "method", "animated", "origin"})
 var MediaDownloaded = prometheus.NewCounterVec(prometheus.CounterOpts{
 	Name: "media_downloaded_total",
 }, []string{"origin"})
+var MediaDownloadsCoalesced = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "media_downloads_coalesced_total",
+}, []string{"origin"})
 var UrlPreviewsGenerated = prometheus.NewCounterVec(prometheus.CounterOpts{
 	Name: "media_url_previews_generated_total",
 }, []string{"type"})
 var S3Operations = prometheus.NewCounterVec(prometheus.CounterOpts{
 	Name: "media_s3_operations_total",
 }, []string{"operation"})
+var DatastoreOperations = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "media_datastore_operations_total",
+}, []string{"datastore", "operation", "error_class"})
+var DatastoreFailovers = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "media_datastore_failovers_total",
+}, []string{"from_datastore", "to_datastore"})
+var DatastoreOperationTime = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Name: "media_datastore_operation_time_seconds",
+}, []string{"datastore", "operation"})
 var MediaAgeAccessed = prometheus.NewHistogram(prometheus.HistogramOpts{
 	Name: "media_age_accessed_media_seconds",
 	Buckets: []float64{
 		5, 15, 30, 60, 120, 150, 300, 900, 1800, 3600, 9000, 18000, 43200, 86400, 1296000, 2592000, 15811200, 31536000,
 	},
 })
+var AsyncMediaCreated = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "media_async_created_total",
+}, []string{"origin"})
+var AsyncMediaPending = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "media_async_pending",
+}, []string{"origin"})
+var AsyncMediaExpired = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "media_async_expired_total",
+}, []string{"origin"})
+var AsyncUploadCompleteTime = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Name: "media_async_upload_complete_seconds",
+	Buckets: []float64{
+		0.5, 1, 2.5, 5, 10, 30, 60, 120, 300, 900, 1800, 3600, 86400,
+	},
+}, []string{"origin"})
+var AsyncUploadWaits = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "media_async_upload_waits_total",
+}, []string{"outcome"})
+var UserStorageUsers = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "media_user_storage_users",
+}, []string{"max_bytes"})
+var UserQuotaUsers = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "media_user_quota_users",
+}, []string{"used_fraction"})
+var MediaReferences = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "media_references",
+})
+var ReferencedMedia = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "media_referenced_media",
+})
+var ReferencingRooms = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "media_referencing_rooms",
+})
+var UnreferencedMedia = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "media_unreferenced_media",
+})
+var MediaEventsPublished = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "media_events_published_total",
+}, []string{"type"})
+var MediaEventsDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "media_events_dropped_total",
+}, []string{"type", "reason"})
+var HashMatches = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "hash_matches_total",
+}, []string{"hash_type", "source"})
+var RemoteFetchesShortCircuited = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "remote_fetches_short_circuited_total",
+}, []string{"origin"})
+var DownloadStageTime = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Name: "media_download_stage_time_seconds",
+}, []string{"stage"})
+var DownloadStageErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "media_download_stage_errors_total",
+}, []string{"stage"})
+var FaultsInjected = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "faults_injected_total",
+}, []string{"target", "kind"})
+var DatabaseReplicaLag = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "media_database_replica_lag_seconds",
+}, []string{"replica"})
+var DatabaseReplicaFallbacks = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "media_database_replica_fallbacks_total",
+}, []string{"table"})
+var DatabaseQueryTime = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Name: "media_database_query_seconds",
+}, []string{"pool", "store"})
+var WebhookDeliveries = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "media_webhook_deliveries_total",
+}, []string{"type", "result"})
 
 func init() {
 	prometheus.MustRegister(HttpRequests)
@@ -48,9 +132,36 @@ func init() {
 	prometheus.MustRegister(HttpResponseTime)
 	prometheus.MustRegister(CacheHits)
 	prometheus.MustRegister(CacheMisses)
+	prometheus.MustRegister(CacheEvictions)
 	prometheus.MustRegister(ThumbnailsGenerated)
 	prometheus.MustRegister(MediaDownloaded)
+	prometheus.MustRegister(MediaDownloadsCoalesced)
 	prometheus.MustRegister(UrlPreviewsGenerated)
 	prometheus.MustRegister(S3Operations)
+	prometheus.MustRegister(DatastoreOperations)
+	prometheus.MustRegister(DatastoreOperationTime)
+	prometheus.MustRegister(DatastoreFailovers)
 	prometheus.MustRegister(MediaAgeAccessed)
+	prometheus.MustRegister(AsyncMediaCreated)
+	prometheus.MustRegister(AsyncMediaPending)
+	prometheus.MustRegister(AsyncMediaExpired)
+	prometheus.MustRegister(AsyncUploadCompleteTime)
+	prometheus.MustRegister(AsyncUploadWaits)
+	prometheus.MustRegister(UserStorageUsers)
+	prometheus.MustRegister(UserQuotaUsers)
+	prometheus.MustRegister(MediaReferences)
+	prometheus.MustRegister(ReferencedMedia)
+	prometheus.MustRegister(ReferencingRooms)
+	prometheus.MustRegister(UnreferencedMedia)
+	prometheus.MustRegister(MediaEventsPublished)
+	prometheus.MustRegister(MediaEventsDropped)
+	prometheus.MustRegister(HashMatches)
+	prometheus.MustRegister(RemoteFetchesShortCircuited)
+	prometheus.MustRegister(DownloadStageTime)
+	prometheus.MustRegister(DownloadStageErrors)
+	prometheus.MustRegister(FaultsInjected)
+	prometheus.MustRegister(DatabaseReplicaLag)
+	prometheus.MustRegister(DatabaseReplicaFallbacks)
+	prometheus.MustRegister(DatabaseQueryTime)
+	prometheus.MustRegister(WebhookDeliveries)
 }
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS idx_media_references_room_event;
+DROP INDEX IF EXISTS idx_media_references;
+DROP TABLE IF EXISTS media_references;
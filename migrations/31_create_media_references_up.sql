@@ -0,0 +1,3 @@
+CREATE TABLE IF NOT EXISTS media_references (origin TEXT NOT NULL, media_id TEXT NOT NULL, room_id TEXT NOT NULL, event_id TEXT NOT NULL, creation_ts BIGINT NOT NULL);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_media_references ON media_references (origin, media_id, room_id, event_id);
+CREATE INDEX IF NOT EXISTS idx_media_references_room_event ON media_references (room_id, event_id);
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_unreferenced_media;
+DROP TABLE IF EXISTS unreferenced_media;
@@ -0,0 +1,2 @@
+CREATE TABLE IF NOT EXISTS unreferenced_media (origin TEXT NOT NULL, media_id TEXT NOT NULL, unreferenced_ts BIGINT NOT NULL);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_unreferenced_media ON unreferenced_media (origin, media_id);
@@ -0,0 +1 @@
+ALTER TABLE expiring_media DROP COLUMN IF EXISTS room_ids;
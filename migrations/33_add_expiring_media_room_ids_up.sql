@@ -0,0 +1 @@
+ALTER TABLE expiring_media ADD COLUMN IF NOT EXISTS room_ids TEXT[] NOT NULL DEFAULT '{}';
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS idx_upload_idempotency_keys_expires_ts;
+DROP INDEX IF EXISTS idx_upload_idempotency_keys;
+DROP TABLE IF EXISTS upload_idempotency_keys;
@@ -0,0 +1,3 @@
+CREATE TABLE IF NOT EXISTS upload_idempotency_keys (user_id TEXT NOT NULL, idempotency_key TEXT NOT NULL, origin TEXT NOT NULL, media_id TEXT NOT NULL, expires_ts BIGINT NOT NULL);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_upload_idempotency_keys ON upload_idempotency_keys (user_id, idempotency_key);
+CREATE INDEX IF NOT EXISTS idx_upload_idempotency_keys_expires_ts ON upload_idempotency_keys (expires_ts);
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS idx_upload_partials_expires_ts;
+DROP INDEX IF EXISTS idx_upload_partials;
+DROP TABLE IF EXISTS upload_partials;
@@ -0,0 +1,3 @@
+CREATE TABLE IF NOT EXISTS upload_partials (user_id TEXT NOT NULL, idempotency_key TEXT NOT NULL, content_type TEXT NOT NULL, upload_name TEXT NOT NULL, total_bytes BIGINT NOT NULL, received_bytes BIGINT NOT NULL, location TEXT NOT NULL, expires_ts BIGINT NOT NULL);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_upload_partials ON upload_partials (user_id, idempotency_key);
+CREATE INDEX IF NOT EXISTS idx_upload_partials_expires_ts ON upload_partials (expires_ts);
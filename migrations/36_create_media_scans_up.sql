@@ -0,0 +1 @@
+CREATE TABLE IF NOT EXISTS media_scans (sha256_hash TEXT PRIMARY KEY NOT NULL, scanned_ts BIGINT NOT NULL, infected BOOL NOT NULL, signature TEXT NOT NULL);
@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS thumbnails_downgraded_formats AS SELECT * FROM thumbnails WHERE FALSE;
+INSERT INTO thumbnails_downgraded_formats SELECT * FROM thumbnails WHERE format <> '';
+DELETE FROM thumbnails WHERE format <> '';
+DROP INDEX IF EXISTS thumbnails_index;
+CREATE UNIQUE INDEX IF NOT EXISTS thumbnails_index ON thumbnails (media_id, origin, width, height, method, animated);
+ALTER TABLE thumbnails DROP COLUMN IF EXISTS format;
@@ -0,0 +1,6 @@
+ALTER TABLE thumbnails ADD COLUMN IF NOT EXISTS format TEXT NOT NULL DEFAULT '';
+DROP INDEX IF EXISTS thumbnails_index;
+CREATE UNIQUE INDEX IF NOT EXISTS thumbnails_index ON thumbnails (media_id, origin, width, height, method, animated, format);
+CREATE TABLE IF NOT EXISTS thumbnails_downgraded_formats AS SELECT * FROM thumbnails WHERE FALSE;
+INSERT INTO thumbnails SELECT * FROM thumbnails_downgraded_formats ON CONFLICT DO NOTHING;
+DROP TABLE thumbnails_downgraded_formats;
@@ -0,0 +1 @@
+ALTER TABLE media ADD COLUMN IF NOT EXISTS original_upload_name TEXT NOT NULL DEFAULT '';
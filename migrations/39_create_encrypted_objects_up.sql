@@ -0,0 +1 @@
+CREATE TABLE IF NOT EXISTS encrypted_objects (datastore_id TEXT NOT NULL, location TEXT NOT NULL, key_id TEXT NOT NULL, PRIMARY KEY (datastore_id, location));
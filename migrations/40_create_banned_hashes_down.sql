@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS banned_hashes_source_idx;
+DROP TABLE IF EXISTS banned_hashes;
@@ -0,0 +1,2 @@
+CREATE TABLE IF NOT EXISTS banned_hashes (sha256_hash TEXT NOT NULL, source TEXT NOT NULL, reason TEXT NOT NULL, banned_ts BIGINT NOT NULL, PRIMARY KEY (sha256_hash, source));
+CREATE INDEX IF NOT EXISTS banned_hashes_source_idx ON banned_hashes (source);
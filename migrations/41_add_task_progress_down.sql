@@ -0,0 +1 @@
+ALTER TABLE background_tasks DROP COLUMN IF EXISTS progress;
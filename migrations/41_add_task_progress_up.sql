@@ -0,0 +1 @@
+ALTER TABLE background_tasks ADD COLUMN IF NOT EXISTS progress JSON NOT NULL DEFAULT '{}';
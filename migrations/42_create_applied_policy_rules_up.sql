@@ -0,0 +1 @@
+CREATE TABLE IF NOT EXISTS applied_policy_rules (room_id TEXT NOT NULL, event_id TEXT NOT NULL, applied_ts BIGINT NOT NULL, PRIMARY KEY (room_id, event_id));
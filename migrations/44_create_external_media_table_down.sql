@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS idx_external_media;
+DROP INDEX IF EXISTS idx_external_media_user_id;
+DROP TABLE IF EXISTS external_media;
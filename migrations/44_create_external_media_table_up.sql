@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS external_media (
+    origin TEXT NOT NULL,
+    media_id TEXT NOT NULL,
+    user_id TEXT NOT NULL,
+    url TEXT NOT NULL,
+    content_type TEXT NOT NULL,
+    upload_name TEXT NOT NULL,
+    room_ids TEXT[] NOT NULL DEFAULT '{}',
+    creation_ts BIGINT NOT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_external_media ON external_media (media_id, origin);
+CREATE INDEX IF NOT EXISTS idx_external_media_user_id ON external_media (user_id);
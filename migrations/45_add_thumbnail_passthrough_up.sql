@@ -0,0 +1 @@
+ALTER TABLE thumbnails ADD COLUMN IF NOT EXISTS passthrough BOOLEAN NOT NULL DEFAULT FALSE;
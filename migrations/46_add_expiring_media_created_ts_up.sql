@@ -0,0 +1 @@
+ALTER TABLE expiring_media ADD COLUMN IF NOT EXISTS created_ts BIGINT NOT NULL DEFAULT 0;
@@ -0,0 +1 @@
+CREATE TABLE IF NOT EXISTS public_rooms (room_id TEXT PRIMARY KEY NOT NULL, set_by TEXT NOT NULL, creation_ts BIGINT NOT NULL);
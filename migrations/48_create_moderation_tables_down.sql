@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS moderation_decisions_decided_ts_idx;
+DROP INDEX IF EXISTS moderation_decisions_media_idx;
+DROP TABLE IF EXISTS moderation_decisions;
+DROP INDEX IF EXISTS moderation_queue_next_attempt_idx;
+DROP TABLE IF EXISTS moderation_queue;
@@ -0,0 +1,5 @@
+CREATE TABLE IF NOT EXISTS moderation_queue (origin TEXT NOT NULL, media_id TEXT NOT NULL, queued_ts BIGINT NOT NULL, attempts INT NOT NULL, next_attempt_ts BIGINT NOT NULL, last_error TEXT NOT NULL, PRIMARY KEY (origin, media_id));
+CREATE INDEX IF NOT EXISTS moderation_queue_next_attempt_idx ON moderation_queue (next_attempt_ts);
+CREATE TABLE IF NOT EXISTS moderation_decisions (id BIGSERIAL PRIMARY KEY, origin TEXT NOT NULL, media_id TEXT NOT NULL, sha256_hash TEXT NOT NULL, policy TEXT NOT NULL, action TEXT NOT NULL, reason TEXT NOT NULL, attempts INT NOT NULL, decided_ts BIGINT NOT NULL);
+CREATE INDEX IF NOT EXISTS moderation_decisions_media_idx ON moderation_decisions (origin, media_id);
+CREATE INDEX IF NOT EXISTS moderation_decisions_decided_ts_idx ON moderation_decisions (decided_ts);
@@ -0,0 +1 @@
+ALTER TABLE media ADD COLUMN IF NOT EXISTS nsfw_score REAL NULL;
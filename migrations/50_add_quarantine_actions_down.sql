@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS quarantine_actions_media_idx;
+DROP TABLE IF EXISTS quarantine_actions;
@@ -0,0 +1,2 @@
+CREATE TABLE IF NOT EXISTS quarantine_actions (id BIGSERIAL PRIMARY KEY, origin TEXT NOT NULL, media_id TEXT NOT NULL, sha256_hash TEXT NOT NULL, action TEXT NOT NULL, reason TEXT NOT NULL, actor TEXT NOT NULL, action_ts BIGINT NOT NULL);
+CREATE INDEX IF NOT EXISTS quarantine_actions_media_idx ON quarantine_actions (origin, media_id);
@@ -0,0 +1 @@
+CREATE TABLE IF NOT EXISTS replication_state (primary_url TEXT PRIMARY KEY NOT NULL, since_token TEXT NOT NULL, updated_ts BIGINT NOT NULL);
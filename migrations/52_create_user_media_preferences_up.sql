@@ -0,0 +1 @@
+CREATE TABLE IF NOT EXISTS user_media_preferences (user_id TEXT PRIMARY KEY NOT NULL, auto_compress BOOL NOT NULL, strip_metadata BOOL NOT NULL, default_visibility TEXT NOT NULL, synced_ts BIGINT NOT NULL);
@@ -0,0 +1,5 @@
+DROP TRIGGER IF EXISTS media_references_change_for_replication ON media_references;
+DROP FUNCTION IF EXISTS track_replication_media_references();
+DROP TRIGGER IF EXISTS media_change_for_replication ON media;
+DROP FUNCTION IF EXISTS track_replication_media();
+DROP TABLE IF EXISTS replication_events;
@@ -0,0 +1,37 @@
+CREATE TABLE IF NOT EXISTS replication_events (stream_id BIGSERIAL PRIMARY KEY NOT NULL, event_type TEXT NOT NULL, origin TEXT NOT NULL, media_id TEXT NOT NULL, room_id TEXT NOT NULL DEFAULT '', event_id TEXT NOT NULL DEFAULT '', creation_ts BIGINT NOT NULL);
+CREATE INDEX IF NOT EXISTS idx_replication_events_creation_ts ON replication_events (creation_ts);
+CREATE OR REPLACE FUNCTION track_replication_media()
+    RETURNS TRIGGER
+    LANGUAGE PLPGSQL
+    AS
+$$
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        INSERT INTO replication_events (event_type, origin, media_id, creation_ts) VALUES ('media_deleted', OLD.origin, OLD.media_id, (EXTRACT(EPOCH FROM CLOCK_TIMESTAMP()) * 1000)::BIGINT);
+        RETURN OLD;
+    ELSIF NEW.quarantined AND NOT OLD.quarantined THEN
+        INSERT INTO replication_events (event_type, origin, media_id, creation_ts) VALUES ('media_quarantined', NEW.origin, NEW.media_id, (EXTRACT(EPOCH FROM CLOCK_TIMESTAMP()) * 1000)::BIGINT);
+    ELSIF OLD.quarantined AND NOT NEW.quarantined THEN
+        INSERT INTO replication_events (event_type, origin, media_id, creation_ts) VALUES ('media_unquarantined', NEW.origin, NEW.media_id, (EXTRACT(EPOCH FROM CLOCK_TIMESTAMP()) * 1000)::BIGINT);
+    END IF;
+    RETURN NEW;
+END;
+$$;
+DROP TRIGGER IF EXISTS media_change_for_replication ON media;
+CREATE TRIGGER media_change_for_replication AFTER UPDATE OF quarantined OR DELETE ON media FOR EACH ROW EXECUTE PROCEDURE track_replication_media();
+CREATE OR REPLACE FUNCTION track_replication_media_references()
+    RETURNS TRIGGER
+    LANGUAGE PLPGSQL
+    AS
+$$
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        INSERT INTO replication_events (event_type, origin, media_id, room_id, event_id, creation_ts) VALUES ('reference_removed', OLD.origin, OLD.media_id, OLD.room_id, OLD.event_id, (EXTRACT(EPOCH FROM CLOCK_TIMESTAMP()) * 1000)::BIGINT);
+        RETURN OLD;
+    END IF;
+    INSERT INTO replication_events (event_type, origin, media_id, room_id, event_id, creation_ts) VALUES ('reference_added', NEW.origin, NEW.media_id, NEW.room_id, NEW.event_id, (EXTRACT(EPOCH FROM CLOCK_TIMESTAMP()) * 1000)::BIGINT);
+    RETURN NEW;
+END;
+$$;
+DROP TRIGGER IF EXISTS media_references_change_for_replication ON media_references;
+CREATE TRIGGER media_references_change_for_replication AFTER INSERT OR DELETE ON media_references FOR EACH ROW EXECUTE PROCEDURE track_replication_media_references();
@@ -0,0 +1,30 @@
+DROP TABLE IF EXISTS quarantine_actions;
+DROP TABLE IF EXISTS moderation_decisions;
+DROP TABLE IF EXISTS moderation_queue;
+DROP TABLE IF EXISTS public_rooms;
+DROP TABLE IF EXISTS external_media;
+DROP TABLE IF EXISTS applied_policy_rules;
+DROP TABLE IF EXISTS banned_hashes;
+DROP TABLE IF EXISTS encrypted_objects;
+DROP TABLE IF EXISTS media_scans;
+DROP TABLE IF EXISTS upload_partials;
+DROP TABLE IF EXISTS upload_idempotency_keys;
+DROP TABLE IF EXISTS unreferenced_media;
+DROP TABLE IF EXISTS media_references;
+DROP TABLE IF EXISTS restricted_media;
+DROP TABLE IF EXISTS media_id_hold;
+DROP TABLE IF EXISTS expiring_media;
+DROP TRIGGER IF EXISTS media_delete_for_user;
+DROP TRIGGER IF EXISTS media_update_for_user;
+DROP TRIGGER IF EXISTS media_insert_for_user;
+DROP TABLE IF EXISTS user_stats;
+DROP TABLE IF EXISTS media_attributes;
+DROP TABLE IF EXISTS export_parts;
+DROP TABLE IF EXISTS exports;
+DROP TABLE IF EXISTS reserved_media;
+DROP TABLE IF EXISTS background_tasks;
+DROP TABLE IF EXISTS datastores;
+DROP TABLE IF EXISTS last_access;
+DROP TABLE IF EXISTS url_previews;
+DROP TABLE IF EXISTS thumbnails;
+DROP TABLE IF EXISTS media;
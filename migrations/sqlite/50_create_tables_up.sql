@@ -0,0 +1,186 @@
+-- The SQLite schema starts from the PostgreSQL schema as of migration 50. Each later PostgreSQL migration needs a SQLite migration with the same name.
+
+CREATE TABLE IF NOT EXISTS media (
+	origin TEXT NOT NULL,
+	media_id TEXT NOT NULL,
+	upload_name TEXT NOT NULL,
+	content_type TEXT NOT NULL,
+	user_id TEXT NOT NULL,
+	sha256_hash TEXT NOT NULL,
+	size_bytes BIGINT NOT NULL,
+	location TEXT NOT NULL,
+	creation_ts BIGINT NOT NULL,
+	quarantined BOOL NOT NULL DEFAULT FALSE,
+	datastore_id TEXT NOT NULL DEFAULT '',
+	original_upload_name TEXT NOT NULL DEFAULT '',
+	nsfw_score REAL NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS media_index ON media (media_id, origin);
+CREATE INDEX IF NOT EXISTS idx_sha256_hash_media ON media (sha256_hash);
+CREATE INDEX IF NOT EXISTS idx_origin_media ON media (origin);
+CREATE INDEX IF NOT EXISTS idx_origin_user_id_media ON media (origin, user_id);
+CREATE INDEX IF NOT EXISTS idx_user_id_media ON media (user_id);
+CREATE INDEX IF NOT EXISTS idx_datastore_id_location_media ON media (datastore_id, location);
+CREATE INDEX IF NOT EXISTS idx_datastore_id_media ON media (datastore_id);
+
+CREATE TABLE IF NOT EXISTS thumbnails (
+	origin TEXT NOT NULL,
+	media_id TEXT NOT NULL,
+	width INT NOT NULL,
+	height INT NOT NULL,
+	method TEXT NOT NULL,
+	content_type TEXT NOT NULL,
+	size_bytes BIGINT NOT NULL,
+	location TEXT NOT NULL,
+	creation_ts BIGINT NOT NULL,
+	animated BOOL NOT NULL DEFAULT FALSE,
+	sha256_hash TEXT NOT NULL,
+	datastore_id TEXT NOT NULL DEFAULT '',
+	format TEXT NOT NULL DEFAULT '',
+	passthrough BOOLEAN NOT NULL DEFAULT FALSE
+);
+CREATE UNIQUE INDEX IF NOT EXISTS thumbnails_index ON thumbnails (media_id, origin, width, height, method, animated, format);
+CREATE INDEX IF NOT EXISTS idx_sha256_hash_thumbnails ON thumbnails (sha256_hash);
+CREATE INDEX IF NOT EXISTS idx_origin_thumbnails ON thumbnails (origin);
+CREATE INDEX IF NOT EXISTS idx_creation_ts_thumbnails ON thumbnails (creation_ts);
+CREATE INDEX IF NOT EXISTS idx_datastore_id_location_thumbnails ON thumbnails (datastore_id, location);
+CREATE INDEX IF NOT EXISTS idx_datastore_id_thumbnails ON thumbnails (datastore_id);
+
+CREATE TABLE IF NOT EXISTS url_previews (
+	url TEXT NOT NULL,
+	error_code TEXT NOT NULL,
+	bucket_ts BIGINT NOT NULL,
+	site_url TEXT NOT NULL,
+	site_name TEXT NOT NULL,
+	resource_type TEXT NOT NULL,
+	description TEXT NOT NULL,
+	title TEXT NOT NULL,
+	image_mxc TEXT NOT NULL,
+	image_type TEXT NOT NULL,
+	image_size BIGINT NOT NULL,
+	image_width INT NOT NULL,
+	image_height INT NOT NULL,
+	language_header TEXT NULL DEFAULT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS url_previews_index ON url_previews (url, error_code, bucket_ts);
+
+CREATE TABLE IF NOT EXISTS last_access (sha256_hash TEXT NOT NULL, last_access_ts BIGINT NOT NULL);
+CREATE UNIQUE INDEX IF NOT EXISTS last_access_index ON last_access (sha256_hash);
+
+CREATE TABLE IF NOT EXISTS datastores (datastore_id TEXT NOT NULL, ds_type TEXT NOT NULL, uri TEXT NOT NULL);
+CREATE UNIQUE INDEX IF NOT EXISTS datastores_index ON datastores (datastore_id);
+
+CREATE TABLE IF NOT EXISTS background_tasks (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	task TEXT NOT NULL,
+	params JSON NOT NULL,
+	start_ts BIGINT NOT NULL,
+	end_ts BIGINT NOT NULL,
+	error TEXT NOT NULL DEFAULT '',
+	progress JSON NOT NULL DEFAULT '{}',
+	checkpoint JSON NOT NULL DEFAULT '{}'
+);
+
+CREATE TABLE IF NOT EXISTS reserved_media (origin TEXT NOT NULL, media_id TEXT NOT NULL, reason TEXT NOT NULL);
+CREATE UNIQUE INDEX IF NOT EXISTS reserved_media_index ON reserved_media (media_id, origin);
+
+CREATE TABLE IF NOT EXISTS exports (export_id TEXT PRIMARY KEY NOT NULL, entity TEXT NOT NULL);
+CREATE TABLE IF NOT EXISTS export_parts (
+	export_id TEXT NOT NULL,
+	"index" INT NOT NULL,
+	size_bytes BIGINT NOT NULL,
+	file_name TEXT NOT NULL,
+	datastore_id TEXT NOT NULL,
+	location TEXT NOT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS export_parts_index ON export_parts (export_id, "index");
+
+CREATE TABLE IF NOT EXISTS media_attributes (origin TEXT NOT NULL, media_id TEXT NOT NULL, purpose TEXT NOT NULL);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_media_attributes ON media_attributes (media_id, origin);
+CREATE INDEX IF NOT EXISTS idx_media_attributes_purpose ON media_attributes (purpose);
+
+CREATE TABLE IF NOT EXISTS user_stats (
+	user_id TEXT PRIMARY KEY NOT NULL,
+	uploaded_bytes BIGINT NOT NULL,
+	quota_max_bytes BIGINT NOT NULL DEFAULT -1,
+	quota_max_pending BIGINT NOT NULL DEFAULT -1,
+	quota_max_files BIGINT NOT NULL DEFAULT -1
+);
+CREATE TRIGGER IF NOT EXISTS media_insert_for_user AFTER INSERT ON media FOR EACH ROW BEGIN
+	INSERT INTO user_stats (user_id, uploaded_bytes) VALUES (NEW.user_id, NEW.size_bytes) ON CONFLICT (user_id) DO UPDATE SET uploaded_bytes = user_stats.uploaded_bytes + NEW.size_bytes;
+END;
+CREATE TRIGGER IF NOT EXISTS media_update_for_user AFTER UPDATE OF user_id, size_bytes ON media FOR EACH ROW BEGIN
+	INSERT INTO user_stats (user_id, uploaded_bytes) VALUES (NEW.user_id, 0) ON CONFLICT (user_id) DO NOTHING;
+	INSERT INTO user_stats (user_id, uploaded_bytes) VALUES (OLD.user_id, 0) ON CONFLICT (user_id) DO NOTHING;
+	UPDATE user_stats SET uploaded_bytes = user_stats.uploaded_bytes - OLD.size_bytes WHERE user_stats.user_id = OLD.user_id;
+	UPDATE user_stats SET uploaded_bytes = user_stats.uploaded_bytes + NEW.size_bytes WHERE user_stats.user_id = NEW.user_id;
+END;
+CREATE TRIGGER IF NOT EXISTS media_delete_for_user AFTER DELETE ON media FOR EACH ROW BEGIN
+	UPDATE user_stats SET uploaded_bytes = user_stats.uploaded_bytes - OLD.size_bytes WHERE user_stats.user_id = OLD.user_id;
+END;
+
+CREATE TABLE IF NOT EXISTS expiring_media (
+	origin TEXT NOT NULL,
+	media_id TEXT NOT NULL,
+	user_id TEXT NOT NULL,
+	expires_ts BIGINT NOT NULL,
+	room_ids TEXT NOT NULL DEFAULT '{}',
+	created_ts BIGINT NOT NULL DEFAULT 0
+);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_expiring_media ON expiring_media (media_id, origin);
+CREATE INDEX IF NOT EXISTS idx_expiring_media_user_id ON expiring_media (user_id);
+CREATE INDEX IF NOT EXISTS idx_expiring_media_expires_ts ON expiring_media (expires_ts);
+
+CREATE TABLE IF NOT EXISTS media_id_hold (origin TEXT NOT NULL, media_id TEXT NOT NULL, reason TEXT NOT NULL, held_ts BIGINT NOT NULL DEFAULT 0);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_media_id_hold ON media_id_hold (media_id, origin);
+
+CREATE TABLE IF NOT EXISTS restricted_media (origin TEXT NOT NULL, media_id TEXT NOT NULL, condition_type TEXT NOT NULL, condition_value TEXT NOT NULL);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_restricted_media ON restricted_media (origin, media_id);
+
+CREATE TABLE IF NOT EXISTS media_references (origin TEXT NOT NULL, media_id TEXT NOT NULL, room_id TEXT NOT NULL, event_id TEXT NOT NULL, creation_ts BIGINT NOT NULL);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_media_references ON media_references (origin, media_id, room_id, event_id);
+CREATE INDEX IF NOT EXISTS idx_media_references_room_event ON media_references (room_id, event_id);
+
+CREATE TABLE IF NOT EXISTS unreferenced_media (origin TEXT NOT NULL, media_id TEXT NOT NULL, unreferenced_ts BIGINT NOT NULL);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_unreferenced_media ON unreferenced_media (origin, media_id);
+
+CREATE TABLE IF NOT EXISTS upload_idempotency_keys (user_id TEXT NOT NULL, idempotency_key TEXT NOT NULL, origin TEXT NOT NULL, media_id TEXT NOT NULL, expires_ts BIGINT NOT NULL);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_upload_idempotency_keys ON upload_idempotency_keys (user_id, idempotency_key);
+CREATE INDEX IF NOT EXISTS idx_upload_idempotency_keys_expires_ts ON upload_idempotency_keys (expires_ts);
+
+CREATE TABLE IF NOT EXISTS upload_partials (user_id TEXT NOT NULL, idempotency_key TEXT NOT NULL, content_type TEXT NOT NULL, upload_name TEXT NOT NULL, total_bytes BIGINT NOT NULL, received_bytes BIGINT NOT NULL, location TEXT NOT NULL, expires_ts BIGINT NOT NULL);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_upload_partials ON upload_partials (user_id, idempotency_key);
+CREATE INDEX IF NOT EXISTS idx_upload_partials_expires_ts ON upload_partials (expires_ts);
+
+CREATE TABLE IF NOT EXISTS media_scans (sha256_hash TEXT PRIMARY KEY NOT NULL, scanned_ts BIGINT NOT NULL, infected BOOL NOT NULL, signature TEXT NOT NULL);
+
+CREATE TABLE IF NOT EXISTS encrypted_objects (datastore_id TEXT NOT NULL, location TEXT NOT NULL, key_id TEXT NOT NULL, PRIMARY KEY (datastore_id, location));
+
+CREATE TABLE IF NOT EXISTS banned_hashes (sha256_hash TEXT NOT NULL, source TEXT NOT NULL, reason TEXT NOT NULL, banned_ts BIGINT NOT NULL, PRIMARY KEY (sha256_hash, source));
+CREATE INDEX IF NOT EXISTS banned_hashes_source_idx ON banned_hashes (source);
+
+CREATE TABLE IF NOT EXISTS applied_policy_rules (room_id TEXT NOT NULL, event_id TEXT NOT NULL, applied_ts BIGINT NOT NULL, PRIMARY KEY (room_id, event_id));
+
+CREATE TABLE IF NOT EXISTS external_media (
+	origin TEXT NOT NULL,
+	media_id TEXT NOT NULL,
+	user_id TEXT NOT NULL,
+	url TEXT NOT NULL,
+	content_type TEXT NOT NULL,
+	upload_name TEXT NOT NULL,
+	room_ids TEXT NOT NULL DEFAULT '{}',
+	creation_ts BIGINT NOT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_external_media ON external_media (media_id, origin);
+CREATE INDEX IF NOT EXISTS idx_external_media_user_id ON external_media (user_id);
+
+CREATE TABLE IF NOT EXISTS public_rooms (room_id TEXT PRIMARY KEY NOT NULL, set_by TEXT NOT NULL, creation_ts BIGINT NOT NULL);
+
+CREATE TABLE IF NOT EXISTS moderation_queue (origin TEXT NOT NULL, media_id TEXT NOT NULL, queued_ts BIGINT NOT NULL, attempts INT NOT NULL, next_attempt_ts BIGINT NOT NULL, last_error TEXT NOT NULL, PRIMARY KEY (origin, media_id));
+CREATE INDEX IF NOT EXISTS moderation_queue_next_attempt_idx ON moderation_queue (next_attempt_ts);
+CREATE TABLE IF NOT EXISTS moderation_decisions (id INTEGER PRIMARY KEY AUTOINCREMENT, origin TEXT NOT NULL, media_id TEXT NOT NULL, sha256_hash TEXT NOT NULL, policy TEXT NOT NULL, action TEXT NOT NULL, reason TEXT NOT NULL, attempts INT NOT NULL, decided_ts BIGINT NOT NULL);
+CREATE INDEX IF NOT EXISTS moderation_decisions_media_idx ON moderation_decisions (origin, media_id);
+CREATE INDEX IF NOT EXISTS moderation_decisions_decided_ts_idx ON moderation_decisions (decided_ts);
+
+CREATE TABLE IF NOT EXISTS quarantine_actions (id INTEGER PRIMARY KEY AUTOINCREMENT, origin TEXT NOT NULL, media_id TEXT NOT NULL, sha256_hash TEXT NOT NULL, action TEXT NOT NULL, reason TEXT NOT NULL, actor TEXT NOT NULL, action_ts BIGINT NOT NULL);
+CREATE INDEX IF NOT EXISTS quarantine_actions_media_idx ON quarantine_actions (origin, media_id);
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS idx_gallery_links_expires_ts;
+DROP INDEX IF EXISTS idx_gallery_links_room_id;
+DROP TABLE IF EXISTS gallery_links;
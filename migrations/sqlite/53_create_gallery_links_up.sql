@@ -0,0 +1,3 @@
+CREATE TABLE IF NOT EXISTS gallery_links (token_id TEXT PRIMARY KEY NOT NULL, room_id TEXT NOT NULL, issued_by TEXT NOT NULL, creation_ts BIGINT NOT NULL, expires_ts BIGINT NOT NULL);
+CREATE INDEX IF NOT EXISTS idx_gallery_links_room_id ON gallery_links (room_id);
+CREATE INDEX IF NOT EXISTS idx_gallery_links_expires_ts ON gallery_links (expires_ts);
@@ -0,0 +1,5 @@
+DROP TRIGGER IF EXISTS media_references_delete_for_replication;
+DROP TRIGGER IF EXISTS media_references_insert_for_replication;
+DROP TRIGGER IF EXISTS media_quarantine_for_replication;
+DROP TRIGGER IF EXISTS media_delete_for_replication;
+DROP TABLE IF EXISTS replication_events;
@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS replication_events (stream_id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL, event_type TEXT NOT NULL, origin TEXT NOT NULL, media_id TEXT NOT NULL, room_id TEXT NOT NULL DEFAULT '', event_id TEXT NOT NULL DEFAULT '', creation_ts BIGINT NOT NULL);
+CREATE INDEX IF NOT EXISTS idx_replication_events_creation_ts ON replication_events (creation_ts);
+CREATE TRIGGER IF NOT EXISTS media_delete_for_replication AFTER DELETE ON media FOR EACH ROW BEGIN
+	INSERT INTO replication_events (event_type, origin, media_id, creation_ts) VALUES ('media_deleted', OLD.origin, OLD.media_id, CAST((julianday('now') - 2440587.5) * 86400000 AS INTEGER));
+END;
+CREATE TRIGGER IF NOT EXISTS media_quarantine_for_replication AFTER UPDATE OF quarantined ON media FOR EACH ROW WHEN NEW.quarantined <> OLD.quarantined BEGIN
+	INSERT INTO replication_events (event_type, origin, media_id, creation_ts) VALUES (CASE WHEN NEW.quarantined THEN 'media_quarantined' ELSE 'media_unquarantined' END, NEW.origin, NEW.media_id, CAST((julianday('now') - 2440587.5) * 86400000 AS INTEGER));
+END;
+CREATE TRIGGER IF NOT EXISTS media_references_insert_for_replication AFTER INSERT ON media_references FOR EACH ROW BEGIN
+	INSERT INTO replication_events (event_type, origin, media_id, room_id, event_id, creation_ts) VALUES ('reference_added', NEW.origin, NEW.media_id, NEW.room_id, NEW.event_id, CAST((julianday('now') - 2440587.5) * 86400000 AS INTEGER));
+END;
+CREATE TRIGGER IF NOT EXISTS media_references_delete_for_replication AFTER DELETE ON media_references FOR EACH ROW BEGIN
+	INSERT INTO replication_events (event_type, origin, media_id, room_id, event_id, creation_ts) VALUES ('reference_removed', OLD.origin, OLD.media_id, OLD.room_id, OLD.event_id, CAST((julianday('now') - 2440587.5) * 86400000 AS INTEGER));
+END;
@@ -0,0 +1,68 @@
+package moderation
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+)
+
+// httpPolicy POSTs the request as JSON to an external service, which responds with the decision.
+type httpPolicy struct {
+	conf config.ModerationConfig
+}
+
+func newHttpPolicy(conf config.ModerationConfig) *httpPolicy {
+	return &httpPolicy{conf: conf}
+}
+
+func (p *httpPolicy) Name() string {
+	return "http"
+}
+
+func (p *httpPolicy) Check(ctx rcontext.RequestContext, req *Request) (*Decision, error) {
+	if p.conf.Url == "" {
+		return nil, errors.New("no moderation url configured")
+	}
+
+	b, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, p.conf.Url, bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("User-Agent", "matrix-media-repo")
+	httpReq.Header.Set("Content-Type", "application/json")
+	if p.conf.Secret != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+p.conf.Secret)
+	}
+
+	client := &http.Client{
+		Timeout: time.Duration(p.conf.TimeoutSeconds) * time.Second,
+	}
+	res, err := client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %d", res.StatusCode)
+	}
+
+	decision := &Decision{}
+	if err = json.NewDecoder(io.LimitReader(res.Body, 1048576)).Decode(decision); err != nil {
+		return nil, errors.Join(errors.New("error decoding moderation decision"), err)
+	}
+	if !IsAction(decision.Action) {
+		return nil, errors.New("unknown moderation action: " + string(decision.Action))
+	}
+	return decision, nil
+}
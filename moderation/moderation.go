@@ -0,0 +1,89 @@
+package moderation
+
+import (
+	"sync"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+type Action string
+
+const (
+	ActionAllow      Action = "allow"
+	ActionQuarantine Action = "quarantine"
+	ActionDelete     Action = "delete"
+)
+
+// ActionFailed is recorded in the audit log when the policy couldn't make a decision after every attempt. The
+// configured failAction is applied instead.
+const ActionFailed Action = "failed"
+
+func IsAction(action Action) bool {
+	return action == ActionAllow || action == ActionQuarantine || action == ActionDelete
+}
+
+// Request describes the media being moderated.
+type Request struct {
+	Origin      string `json:"origin"`
+	MediaId     string `json:"media_id"`
+	UserId      string `json:"user_id,omitempty"`
+	ContentType string `json:"content_type"`
+	SizeBytes   int64  `json:"size"`
+	Sha256Hash  string `json:"sha256"`
+	IsRemote    bool   `json:"is_remote"`
+
+	// Thumbnail is a small preview of the media, if it could be thumbnailed and thumbnails are being sent.
+	Thumbnail            []byte `json:"thumbnail,omitempty"`
+	ThumbnailContentType string `json:"thumbnail_content_type,omitempty"`
+}
+
+type Decision struct {
+	Action Action `json:"action"`
+	Reason string `json:"reason"`
+}
+
+// Policy decides what happens to media after it has been stored.
+type Policy interface {
+	// Name identifies the policy in the audit log.
+	Name() string
+	// Check returns the decision for the media. Errors are retried later.
+	Check(ctx rcontext.RequestContext, req *Request) (*Decision, error)
+}
+
+var policy Policy
+var policyLock = new(sync.RWMutex)
+
+// SetPolicy replaces the policy used to moderate media. If nil, the HTTP policy described by the config is used.
+func SetPolicy(p Policy) {
+	policyLock.Lock()
+	defer policyLock.Unlock()
+	policy = p
+}
+
+func GetPolicy() Policy {
+	policyLock.RLock()
+	defer policyLock.RUnlock()
+	if policy != nil {
+		return policy
+	}
+	return newHttpPolicy(config.Get().Moderation)
+}
+
+// ShouldModerate returns true if newly stored media of the given kind should be queued for moderation.
+func ShouldModerate(isRemote bool) bool {
+	conf := config.Get().Moderation
+	return conf.Enabled && (!isRemote || conf.CheckRemoteMedia)
+}
+
+// Enqueue queues the media to be checked by the policy in the background. Errors are logged, but otherwise ignored
+// so they don't fail the upload.
+func Enqueue(ctx rcontext.RequestContext, record *database.DbMedia) {
+	if err := database.GetInstance().ModerationQueue.Prepare(ctx).Insert(record.Origin, record.MediaId, util.NowMillis()); err != nil {
+		ctx.Log.Warn("Non-fatal error queueing media for moderation: ", err)
+		sentry.CaptureException(err)
+	}
+}
@@ -0,0 +1,61 @@
+package notifier
+
+import (
+	"encoding/json"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/redislib"
+)
+
+const invalidationsNotifyRedisChannel = "mmr:invalidations"
+
+type InvalidationKind string
+
+const (
+	// InvalidateMedia is sent when media is purged, quarantined, or has its attributes changed.
+	InvalidateMedia InvalidationKind = "media"
+	// InvalidateAccessTokens is sent when access tokens are logged out.
+	InvalidateAccessTokens InvalidationKind = "access_tokens"
+)
+
+// Invalidation describes state which other media repo instances may have cached in memory, and which has changed.
+type Invalidation struct {
+	Kind       InvalidationKind `json:"kind"`
+	Origin     string           `json:"origin,omitempty"`
+	MediaId    string           `json:"media_id,omitempty"`
+	Sha256Hash string           `json:"sha256,omitempty"`
+}
+
+// SubscribeToInvalidations returns a channel of invalidations published by other media repo instances, or nil if
+// there are no other instances to hear from.
+func SubscribeToInvalidations() <-chan Invalidation {
+	ch := redislib.Subscribe(invalidationsNotifyRedisChannel)
+	if ch == nil {
+		return nil
+	}
+
+	retCh := make(chan Invalidation)
+	go func() {
+		for val := range ch {
+			invalidation := Invalidation{}
+			if err := json.Unmarshal([]byte(val), &invalidation); err != nil {
+				sentry.CaptureException(err)
+				logrus.Error("Internal error handling invalidations subscribe: ", err)
+			} else {
+				retCh <- invalidation
+			}
+		}
+		close(retCh)
+	}()
+	return retCh
+}
+
+func Invalidate(ctx rcontext.RequestContext, invalidation Invalidation) error {
+	b, err := json.Marshal(invalidation)
+	if err != nil {
+		return err
+	}
+	return redislib.Publish(ctx, invalidationsNotifyRedisChannel, string(b))
+}
@@ -0,0 +1,50 @@
+package notifier
+
+import (
+	"encoding/json"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/redislib"
+)
+
+const membershipsNotifyRedisChannel = "mmr:memberships"
+
+// MembershipChange describes a room membership which changed, or all of a room's memberships if UserId is empty.
+type MembershipChange struct {
+	RoomId string `json:"room_id"`
+	UserId string `json:"user_id,omitempty"`
+}
+
+// SubscribeToMemberships returns a channel of membership changes published by other media repo instances, or nil if
+// there are no other instances to hear from.
+func SubscribeToMemberships() <-chan MembershipChange {
+	ch := redislib.Subscribe(membershipsNotifyRedisChannel)
+	if ch == nil {
+		return nil
+	}
+
+	retCh := make(chan MembershipChange)
+	go func() {
+		for val := range ch {
+			change := MembershipChange{}
+			if err := json.Unmarshal([]byte(val), &change); err != nil {
+				sentry.CaptureException(err)
+				logrus.Error("Internal error handling memberships subscribe: ", err)
+			} else {
+				retCh <- change
+			}
+		}
+		close(retCh)
+	}()
+	return retCh
+}
+
+func MembershipChanged(ctx rcontext.RequestContext, change MembershipChange) error {
+	b, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+	return redislib.Publish(ctx, membershipsNotifyRedisChannel, string(b))
+}
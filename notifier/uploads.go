@@ -3,26 +3,57 @@ package notifier
 import (
 	"sync"
 
-	"github.com/sirupsen/logrus"
 	"github.com/t2bot/matrix-media-repo/common/rcontext"
 	"github.com/t2bot/matrix-media-repo/database"
-	"github.com/t2bot/matrix-media-repo/redislib"
 	"github.com/t2bot/matrix-media-repo/util"
 )
 
+// UploadNotifier relays upload completion to waiters on other instances of the media repo.
+type UploadNotifier interface {
+	// Publish broadcasts the completed upload to all other instances.
+	Publish(ctx rcontext.RequestContext, record *database.DbMedia) error
+	// Subscribe starts listening for uploads completed elsewhere, calling onUpload for each. Returns false if
+	// the notifier is unable to receive notifications.
+	Subscribe(onUpload func(record *database.DbMedia)) bool
+}
+
+// localOnlyNotifier is used when no cross-instance backend is available. Waiters on the same instance are
+// always notified directly, so this does nothing.
+type localOnlyNotifier struct{}
+
+func (n localOnlyNotifier) Publish(ctx rcontext.RequestContext, record *database.DbMedia) error {
+	return nil
+}
+
+func (n localOnlyNotifier) Subscribe(onUpload func(record *database.DbMedia)) bool {
+	return false
+}
+
 var localUploadWaiters = make(map[string][]chan *database.DbMedia)
 var uploadMutex = new(sync.Mutex)
-var uploadsRedisChan <-chan string
+var uploadNotifier UploadNotifier = redisUploadNotifier{}
+var uploadNotifierSubscribed = false
 
-const uploadsNotifyRedisChannel = "mmr:upload_mxc"
+// SetUploadNotifier replaces the backend used to relay uploads between instances. Must be called before any
+// uploads are waited upon.
+func SetUploadNotifier(n UploadNotifier) {
+	uploadMutex.Lock()
+	defer uploadMutex.Unlock()
+	if n == nil {
+		n = localOnlyNotifier{}
+	}
+	uploadNotifier = n
+	uploadNotifierSubscribed = false
+}
 
 func GetUploadWaitChannel(origin string, mediaId string) (<-chan *database.DbMedia, func()) {
-	subscribeRedisUploads()
 	mxc := util.MxcUri(origin, mediaId)
 
 	uploadMutex.Lock()
 	defer uploadMutex.Unlock()
 
+	subscribeUploads()
+
 	if _, ok := localUploadWaiters[mxc]; !ok {
 		localUploadWaiters[mxc] = make([]chan *database.DbMedia, 0)
 	}
@@ -50,9 +81,12 @@ func GetUploadWaitChannel(origin string, mediaId string) (<-chan *database.DbMed
 }
 
 func UploadDone(ctx rcontext.RequestContext, record *database.DbMedia) error {
-	mxc := util.MxcUri(record.Origin, record.MediaId)
 	noRelayNotifyUpload(record)
-	return redislib.Publish(ctx, uploadsNotifyRedisChannel, mxc)
+
+	uploadMutex.Lock()
+	n := uploadNotifier
+	uploadMutex.Unlock()
+	return n.Publish(ctx, record)
 }
 
 func noRelayNotifyUpload(record *database.DbMedia) {
@@ -71,41 +105,10 @@ func noRelayNotifyUpload(record *database.DbMedia) {
 	}()
 }
 
-func subscribeRedisUploads() {
-	if uploadsRedisChan != nil {
+// subscribeUploads must be called with uploadMutex held.
+func subscribeUploads() {
+	if uploadNotifierSubscribed {
 		return
 	}
-
-	uploadMutex.Lock()
-	defer uploadMutex.Unlock()
-
-	uploadsRedisChan = redislib.Subscribe(uploadsNotifyRedisChannel)
-	if uploadsRedisChan == nil {
-		return // no redis to subscribe with
-	}
-	go func() {
-		for {
-			val := <-uploadsRedisChan
-			logrus.Debug("Received value from uploads notify channel: ", val)
-
-			origin, mediaId, err := util.SplitMxc(val)
-			if err != nil {
-				logrus.Warn("Non-fatal error receiving from uploads notify channel: ", err)
-				continue
-			}
-
-			db := database.GetInstance().Media.Prepare(rcontext.Initial())
-			record, err := db.GetById(origin, mediaId)
-			if err != nil {
-				logrus.Warn("Non-fatal error processing record from uploads notify channel: ", err)
-				continue
-			}
-			if record == nil {
-				logrus.Warn("Received notification that a media record is available, but it's not")
-				continue
-			}
-
-			noRelayNotifyUpload(record)
-		}
-	}()
+	uploadNotifierSubscribed = uploadNotifier.Subscribe(noRelayNotifyUpload)
 }
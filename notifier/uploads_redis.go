@@ -0,0 +1,57 @@
+package notifier
+
+import (
+	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/redislib"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+const uploadsNotifyRedisChannel = "mmr:upload_mxc"
+
+// redisUploadNotifier relays uploads over Redis pub/sub. When Redis is not configured, it behaves like a
+// local-only notifier.
+type redisUploadNotifier struct{}
+
+func (n redisUploadNotifier) Publish(ctx rcontext.RequestContext, record *database.DbMedia) error {
+	return redislib.Publish(ctx, uploadsNotifyRedisChannel, util.MxcUri(record.Origin, record.MediaId))
+}
+
+func (n redisUploadNotifier) Subscribe(onUpload func(record *database.DbMedia)) bool {
+	ch := redislib.Subscribe(uploadsNotifyRedisChannel)
+	if ch == nil {
+		return false // no redis to subscribe with
+	}
+	go func() {
+		for val := range ch {
+			logrus.Debug("Received value from uploads notify channel: ", val)
+
+			origin, mediaId, err := util.SplitMxc(val)
+			if err != nil {
+				logrus.Warn("Non-fatal error receiving from uploads notify channel: ", err)
+				continue
+			}
+
+			db := database.GetInstance().Media.Prepare(rcontext.Initial())
+			record, err := db.GetById(origin, mediaId)
+			if err != nil {
+				logrus.Warn("Non-fatal error processing record from uploads notify channel: ", err)
+				continue
+			}
+			if record == nil {
+				logrus.Warn("Received notification that a media record is available, but it's not")
+				continue
+			}
+
+			onUpload(record)
+		}
+
+		// The subscription was closed (Redis stopped or reconnected without a ring), so allow a fresh
+		// subscription on the next wait.
+		uploadMutex.Lock()
+		uploadNotifierSubscribed = false
+		uploadMutex.Unlock()
+	}()
+	return true
+}
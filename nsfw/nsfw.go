@@ -0,0 +1,69 @@
+package nsfw
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+)
+
+type classifyResponse struct {
+	Score *float64 `json:"score"`
+}
+
+// IsEnabled returns true if newly stored media of the given kind should be classified.
+func IsEnabled(isRemote bool) bool {
+	conf := config.Get().Nsfw
+	return conf.Enabled && (!isRemote || conf.CheckRemoteMedia)
+}
+
+// ShouldQuarantine returns true if the score is at or above the configured quarantine threshold.
+func ShouldQuarantine(score float64) bool {
+	threshold := config.Get().Nsfw.QuarantineThreshold
+	return threshold > 0 && score >= threshold
+}
+
+// Classify POSTs the image to the configured classifier, which responds with a score from 0 (safe) to 1 (explicit).
+func Classify(ctx rcontext.RequestContext, contentType string, img []byte) (float64, error) {
+	conf := config.Get().Nsfw
+	if conf.ApiUrl == "" {
+		return 0, errors.New("no nsfw classifier url configured")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, conf.ApiUrl, bytes.NewReader(img))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("User-Agent", "matrix-media-repo")
+	req.Header.Set("Content-Type", contentType)
+	if conf.ApiSecret != "" {
+		req.Header.Set("Authorization", "Bearer "+conf.ApiSecret)
+	}
+
+	client := &http.Client{
+		Timeout: time.Duration(conf.TimeoutSeconds) * time.Second,
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("unexpected status code %d", res.StatusCode)
+	}
+
+	val := &classifyResponse{}
+	if err = json.NewDecoder(io.LimitReader(res.Body, 1048576)).Decode(val); err != nil {
+		return 0, errors.Join(errors.New("error decoding nsfw classification"), err)
+	}
+	if val.Score == nil || *val.Score < 0 || *val.Score > 1 {
+		return 0, errors.New("nsfw classifier returned an invalid score")
+	}
+	return *val.Score, nil
+}
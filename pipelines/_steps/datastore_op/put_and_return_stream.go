@@ -25,6 +25,12 @@ type uploadResult struct {
 }
 
 func PutAndReturnStream(ctx rcontext.RequestContext, origin string, mediaId string, input io.ReadCloser, contentType string, fileName string, kind datastores.Kind) (*database.DbMedia, io.ReadCloser, error) {
+	return PutAndReturnStreamFor(ctx, origin, mediaId, input, contentType, fileName, "", kind, nil)
+}
+
+// PutAndReturnStreamFor is like PutAndReturnStream, but stores the media as owned by the given user. The media will be
+// referenced by each of the roomIds once stored.
+func PutAndReturnStreamFor(ctx rcontext.RequestContext, origin string, mediaId string, input io.ReadCloser, contentType string, fileName string, userId string, kind datastores.Kind, roomIds []string) (*database.DbMedia, io.ReadCloser, error) {
 	dsConf, err := datastores.Pick(ctx, kind)
 	if err != nil {
 		return nil, nil, err
@@ -56,7 +62,7 @@ func PutAndReturnStream(ctx rcontext.RequestContext, origin string, mediaId stri
 	}(dsConf, pr, bufferCh)
 
 	go func(ctx rcontext.RequestContext, origin string, mediaId string, r io.ReadCloser, upstreamClose func() error, contentType string, fileName string, kind datastores.Kind, uploadCh chan uploadResult) {
-		m, err2 := pipeline_upload.Execute(ctx, origin, mediaId, r, contentType, fileName, "", kind)
+		m, err2 := pipeline_upload.Execute(ctx, origin, mediaId, r, contentType, fileName, userId, kind, roomIds)
 		// async the channel update to avoid deadlocks
 		go func(uploadCh chan uploadResult, err2 error, m *database.DbMedia) {
 			uploadCh <- uploadResult{err: err2, m: m}
@@ -0,0 +1,118 @@
+package download
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/patrickmn/go-cache"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/notifier"
+	"github.com/t2bot/matrix-media-repo/util"
+	"github.com/t2bot/matrix-media-repo/util/readers"
+)
+
+var emojiCache *cache.Cache
+var notEmojiCache *cache.Cache
+var emojiCacheBytes = &atomic.Int64{}
+var emojiCacheOnce = &sync.Once{}
+
+func initEmojiCache() {
+	ttl := time.Duration(config.Get().Emoji.MemoryCache.TtlMinutes) * time.Minute
+	emojiCache = cache.New(ttl, ttl*2)
+	emojiCache.OnEvicted(func(key string, val interface{}) {
+		emojiCacheBytes.Add(-int64(len(val.([]byte))))
+	})
+	notEmojiCache = cache.New(ttl, ttl*2)
+
+	if ch := notifier.SubscribeToInvalidations(); ch != nil {
+		go func() {
+			for invalidation := range ch {
+				if invalidation.Kind == notifier.InvalidateMedia {
+					forgetEmoji(invalidation.Origin, invalidation.MediaId, invalidation.Sha256Hash)
+				}
+			}
+		}()
+	}
+}
+
+func forgetEmoji(origin string, mediaId string, sha256hash string) {
+	if sha256hash != "" {
+		emojiCache.Delete(sha256hash)
+	}
+	notEmojiCache.Delete(origin + "/" + mediaId)
+}
+
+// InvalidateMedia drops anything cached in memory for the media, after it has been purged, quarantined, or had its
+// attributes changed. The hash may be empty if it isn't known. Other media repo instances are told to do the same.
+func InvalidateMedia(ctx rcontext.RequestContext, origin string, mediaId string, sha256hash string) {
+	emojiCacheOnce.Do(initEmojiCache)
+	forgetEmoji(origin, mediaId, sha256hash)
+	err := notifier.Invalidate(ctx, notifier.Invalidation{
+		Kind:       notifier.InvalidateMedia,
+		Origin:     origin,
+		MediaId:    mediaId,
+		Sha256Hash: sha256hash,
+	})
+	if err != nil {
+		ctx.Log.Warn("Non-fatal error broadcasting media invalidation: ", err)
+		sentry.CaptureException(err)
+	}
+}
+
+// OpenEmoji returns a stream for emoji media from an in-memory cache, populating the cache if needed. Returns nil if
+// the media is not an emoji, or emoji aren't being cached.
+func OpenEmoji(ctx rcontext.RequestContext, record *database.DbMedia) (io.ReadSeekCloser, error) {
+	conf := config.Get().Emoji
+	if !conf.Enabled || conf.MemoryCache.MaxBytes <= 0 || record.SizeBytes > conf.MemoryCache.MaxBytes {
+		return nil, nil
+	}
+	if !util.ArrayContains(conf.ContentTypes, record.ContentType) {
+		return nil, nil
+	}
+	emojiCacheOnce.Do(initEmojiCache)
+
+	if val, ok := emojiCache.Get(record.Sha256Hash); ok {
+		ctx.AccessLog().CacheHit = true
+		return readers.NopSeekCloser(bytes.NewReader(val.([]byte))), nil
+	}
+	if _, ok := notEmojiCache.Get(record.Origin + "/" + record.MediaId); ok {
+		return nil, nil
+	}
+
+	attrs, err := database.GetInstance().MediaAttributes.Prepare(ctx).Get(record.Origin, record.MediaId)
+	if err != nil {
+		return nil, err
+	}
+	if attrs == nil || attrs.Purpose != database.PurposeEmoji {
+		notEmojiCache.Set(record.Origin+"/"+record.MediaId, true, cache.DefaultExpiration)
+		return nil, nil
+	}
+
+	stream, err := OpenStream(ctx, record.Locatable)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+	b, err := io.ReadAll(stream)
+	if err != nil {
+		return nil, err
+	}
+
+	if emojiCacheBytes.Add(int64(len(b))) <= conf.MemoryCache.MaxBytes {
+		if err = emojiCache.Add(record.Sha256Hash, b, cache.DefaultExpiration); err != nil {
+			// Another request cached it first
+			emojiCacheBytes.Add(-int64(len(b)))
+		}
+	} else {
+		ctx.Log.Debug("Emoji cache is full - not caching ", record.Sha256Hash)
+		emojiCacheBytes.Add(-int64(len(b)))
+	}
+
+	return readers.NopSeekCloser(bytes.NewReader(b)), nil
+}
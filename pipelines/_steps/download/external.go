@@ -0,0 +1,148 @@
+package download
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/datastores"
+	"github.com/t2bot/matrix-media-repo/errcache"
+	"github.com/t2bot/matrix-media-repo/pipelines/_steps/datastore_op"
+	"github.com/t2bot/matrix-media-repo/pipelines/_steps/upload"
+	"github.com/t2bot/matrix-media-repo/util/readers"
+)
+
+// TryExternal fetches local media which was registered with an external URL, storing it as though the registering
+// user uploaded it. Returns common.ErrMediaNotFound if the media has no external URL.
+func TryExternal(ctx rcontext.RequestContext, origin string, mediaId string) (*database.DbMedia, io.ReadCloser, error) {
+	db := database.GetInstance().ExternalMedia.Prepare(ctx)
+	record, err := db.Get(origin, mediaId)
+	if err != nil {
+		return nil, nil, err
+	}
+	if record == nil {
+		return nil, nil, common.ErrMediaNotFound
+	}
+
+	cacheKey := fmt.Sprintf("external/%s/%s", origin, mediaId)
+	if err = errcache.DownloadErrors.Get(cacheKey); err != nil {
+		return nil, nil, err
+	}
+	errFn := func(err error) (*database.DbMedia, io.ReadCloser, error) {
+		errcache.DownloadErrors.Set(cacheKey, err)
+		return nil, nil, err
+	}
+
+	// The allowed hosts may have changed since the media was registered, so check again
+	externalUrl, err := url.Parse(record.Url)
+	if err != nil {
+		return errFn(err)
+	}
+	if err = upload.CheckExternalUrl(ctx, externalUrl); err != nil {
+		return errFn(err)
+	}
+
+	// Hostnames are resolved here so the address which is checked is the one we connect to
+	dialer := &net.Dialer{}
+	client := &http.Client{
+		Timeout: time.Duration(ctx.Config.Uploads.ExternalMedia.TimeoutSeconds) * time.Second,
+		Transport: &http.Transport{
+			DisableKeepAlives: true,
+			DialContext: func(ctx2 context.Context, network string, addr string) (net.Conn, error) {
+				host, port, err := net.SplitHostPort(addr)
+				if err != nil {
+					return nil, err
+				}
+				addrs, err := net.DefaultResolver.LookupIPAddr(ctx2, host)
+				if err != nil {
+					return nil, err
+				}
+				if len(addrs) == 0 {
+					return nil, common.ErrHostNotFound
+				}
+				for _, ipAddr := range addrs {
+					if err = upload.CheckExternalAddress(ctx, ipAddr.IP); err != nil {
+						return nil, err
+					}
+				}
+				return dialer.DialContext(ctx2, network, net.JoinHostPort(addrs[0].IP.String(), port))
+			},
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			return upload.CheckExternalUrl(ctx, req.URL)
+		},
+	}
+	req, err := http.NewRequestWithContext(ctx.Context, http.MethodGet, externalUrl.String(), nil)
+	if err != nil {
+		return errFn(err)
+	}
+	ctx.Log.Debugf("Fetching external media from %s", externalUrl.Hostname())
+	resp, err := client.Do(req)
+	if err != nil {
+		return errFn(err)
+	}
+	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone {
+		resp.Body.Close()
+		return errFn(common.ErrMediaNotFound)
+	} else if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return errFn(fmt.Errorf("unexpected status code %d", resp.StatusCode))
+	}
+
+	if resp.Header.Get("Content-Length") != "" {
+		contentLength, err := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+		if err != nil {
+			resp.Body.Close()
+			return errFn(err)
+		}
+		if ctx.Config.Uploads.MaxSizeBytes > 0 && contentLength > ctx.Config.Uploads.MaxSizeBytes {
+			resp.Body.Close()
+			return errFn(common.ErrMediaTooLarge)
+		}
+	}
+	if ctx.Config.Uploads.MaxSizeBytes > 0 {
+		resp.Body = readers.LimitReaderWithOverrunError(resp.Body, ctx.Config.Uploads.MaxSizeBytes)
+	}
+
+	contentType := record.ContentType
+	if contentType == "" {
+		contentType = resp.Header.Get("Content-Type")
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream" // binary
+	}
+	fileName := record.UploadName
+	if fileName == "" {
+		_, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition"))
+		if err == nil && params["filename"] != "" {
+			fileName = params["filename"]
+		}
+	}
+
+	media, r, err := datastore_op.PutAndReturnStreamFor(ctx, origin, mediaId, resp.Body, contentType, fileName, record.UserId, datastores.LocalMediaKind, record.RoomIds)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The media is stored now, so future downloads are served from the datastore
+	if err = db.Delete(origin, mediaId); err != nil {
+		ctx.Log.Warn("Non-fatal error removing external media record: ", err)
+		sentry.CaptureException(err)
+	}
+
+	return media, r, nil
+}
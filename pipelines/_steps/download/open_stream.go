@@ -43,6 +43,7 @@ func doOpenStream(ctx rcontext.RequestContext, media *database.Locatable, canRed
 	if !ok {
 		return nil, ds, errors.New("unable to locate datastore for media")
 	}
+	datastores.RestoreIfArchived(ctx, media)
 
 	redirectWhenCached, err := datastores.WouldRedirectWhenCached(ctx, ds)
 	if err != nil {
@@ -50,10 +51,14 @@ func doOpenStream(ctx rcontext.RequestContext, media *database.Locatable, canRed
 		redirectWhenCached = false
 	}
 
-	if !redirectWhenCached || !canRedirect {
+	if ctx.Config.Downloads.ThinProxy.Enabled {
+		// The cache holds whole files in memory, which is exactly what thin proxy mode is trying to avoid
+		ctx.Log.Debugf("Ignoring cache for %s due to thin proxy mode", media.Sha256Hash)
+	} else if !redirectWhenCached || !canRedirect {
 		reader, err := redislib.TryGetMedia(ctx, media.Sha256Hash)
 		if err != nil || reader != nil {
 			ctx.Log.Debugf("Got %s from cache", media.Sha256Hash)
+			ctx.AccessLog().CacheHit = reader != nil
 			return readers.NopSeekCloser(reader), config.DatastoreConfig{}, err
 		}
 	} else {
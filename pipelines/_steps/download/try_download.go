@@ -1,6 +1,7 @@
 package download
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -14,6 +15,7 @@ import (
 
 	"github.com/getsentry/sentry-go"
 	"github.com/prometheus/client_golang/prometheus"
+	sfstreams "github.com/t2bot/go-singleflight-streams"
 	"github.com/t2bot/matrix-media-repo/common"
 	"github.com/t2bot/matrix-media-repo/common/rcontext"
 	"github.com/t2bot/matrix-media-repo/database"
@@ -35,11 +37,54 @@ type downloadResult struct {
 	err         error
 }
 
+// fetchSf coalesces concurrent fetches of the same remote media, so only one request reaches the origin no matter
+// how many clients (or domains, or request options) are waiting on it.
+var fetchSf = new(sfstreams.Group)
+
+func init() {
+	fetchSf.UseSeekers = true
+}
+
 func TryDownload(ctx rcontext.RequestContext, origin string, mediaId string) (*database.DbMedia, io.ReadCloser, error) {
 	if util.IsServerOurs(origin) {
 		return nil, nil, common.ErrMediaNotFound
 	}
 
+	leader := false
+	r, err, shared := fetchSf.Do(fmt.Sprintf("%s/%s", origin, mediaId), func() (io.ReadCloser, error) {
+		leader = true
+
+		// The fetch is shared by every waiter, so it shouldn't be cancelled when the request which started it ends
+		fetchCtx := ctx
+		fetchCtx.Context = context.WithoutCancel(ctx.Context)
+		_, stream, err := fetchRemote(fetchCtx, origin, mediaId)
+		return stream, err
+	})
+	if shared && !leader {
+		metrics.MediaDownloadsCoalesced.With(prometheus.Labels{"origin": origin}).Inc()
+	}
+	if err != nil {
+		if r != nil {
+			_ = r.Close()
+		}
+		return nil, nil, err
+	}
+
+	// The fetch stored the media before returning its stream, so every waiter can look up the same record
+	record, err := database.GetInstance().Media.Prepare(ctx).GetById(origin, mediaId)
+	if err == nil && record == nil {
+		err = errors.New("unexpected error: remote media was fetched but has no record")
+	}
+	if err != nil {
+		if r != nil {
+			_ = r.Close()
+		}
+		return nil, nil, err
+	}
+	return record, r, nil
+}
+
+func fetchRemote(ctx rcontext.RequestContext, origin string, mediaId string) (*database.DbMedia, io.ReadCloser, error) {
 	ch := make(chan downloadResult)
 	defer close(ch)
 	fn := func() {
@@ -49,14 +94,25 @@ func TryDownload(ctx rcontext.RequestContext, origin string, mediaId string) (*d
 			return
 		}
 
+		// Don't bother the origin while it's being backed off from, and don't cache the error either: the origin
+		// may recover before the cached error would expire.
+		if err := matrix.CheckOriginBackoff(origin); err != nil {
+			ch <- downloadResult{err: err}
+			return
+		}
+
 		errFn := func(err error) {
 			errcache.DownloadErrors.Set(cacheKey, err)
 			ch <- downloadResult{err: err}
 		}
+		originErrFn := func(err error) {
+			matrix.RecordOriginFailure(origin)
+			errFn(err)
+		}
 
 		baseUrl, realHost, err := matrix.GetServerApiUrl(origin)
 		if err != nil {
-			errFn(err)
+			originErrFn(err)
 			return
 		}
 
@@ -68,7 +124,7 @@ func TryDownload(ctx rcontext.RequestContext, origin string, mediaId string) (*d
 			resp, err = matrix.FederatedGet(ctx, downloadUrl, realHost, origin, ctx.Config.SigningKeyPath)
 			metrics.MediaDownloaded.With(prometheus.Labels{"origin": origin}).Inc()
 			if err != nil {
-				errFn(err)
+				originErrFn(err)
 				return
 			}
 			if resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusUnauthorized {
@@ -103,11 +159,16 @@ func TryDownload(ctx rcontext.RequestContext, origin string, mediaId string) (*d
 			resp, err = matrix.FederatedGet(ctx, downloadUrl, realHost, origin, matrix.NoSigningKey)
 			metrics.MediaDownloaded.With(prometheus.Labels{"origin": origin}).Inc()
 			if err != nil {
-				errFn(err)
+				originErrFn(err)
 				return
 			}
 		}
 
+		if resp.StatusCode >= 500 {
+			originErrFn(errors.New(fmt.Sprintf("unexpected status code %d", resp.StatusCode)))
+			return
+		}
+		matrix.RecordOriginSuccess(origin)
 		if resp.StatusCode == http.StatusNotFound {
 			errFn(common.ErrMediaNotFound)
 			return
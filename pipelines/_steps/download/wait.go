@@ -1,9 +1,11 @@
 package download
 
 import (
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/t2bot/matrix-media-repo/common"
 	"github.com/t2bot/matrix-media-repo/common/rcontext"
 	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/metrics"
 	"github.com/t2bot/matrix-media-repo/notifier"
 )
 
@@ -14,15 +16,31 @@ func WaitForAsyncMedia(ctx rcontext.RequestContext, origin string, mediaId strin
 		return nil, err
 	}
 	if record == nil || record.IsExpired() {
+		if record != nil {
+			metrics.AsyncUploadWaits.With(prometheus.Labels{"outcome": "expired"}).Inc()
+		}
 		return nil, nil // there's not going to be a record
 	}
 
 	ch, finish := notifier.GetUploadWaitChannel(origin, mediaId)
 	defer finish()
+
+	// The upload may have completed (possibly on another instance) before we started waiting
+	media, err := database.GetInstance().Media.Prepare(ctx).GetById(origin, mediaId)
+	if err != nil {
+		return nil, err
+	}
+	if media != nil {
+		metrics.AsyncUploadWaits.With(prometheus.Labels{"outcome": "already_uploaded"}).Inc()
+		return media, nil
+	}
+
 	select {
 	case <-ctx.Context.Done():
+		metrics.AsyncUploadWaits.With(prometheus.Labels{"outcome": "timed_out"}).Inc()
 		return nil, common.ErrMediaNotYetUploaded
 	case val := <-ch:
+		metrics.AsyncUploadWaits.With(prometheus.Labels{"outcome": "uploaded"}).Inc()
 		return val, nil
 	}
 }
@@ -1,19 +1,83 @@
 package meta
 
 import (
+	"encoding/json"
+
 	"github.com/getsentry/sentry-go"
+	"github.com/t2bot/matrix-media-repo/common/config"
 	"github.com/t2bot/matrix-media-repo/common/rcontext"
 	"github.com/t2bot/matrix-media-repo/database"
 	"github.com/t2bot/matrix-media-repo/metrics"
+	"github.com/t2bot/matrix-media-repo/redislib"
 	"github.com/t2bot/matrix-media-repo/util"
 )
 
+// accessQueue holds last access times recorded by download instances, until the write tier saves them.
+const accessQueue = "mmr:access_queue"
+
+// accessQueueBatchSize is the most queued accesses saved at once.
+const accessQueueBatchSize = 1000
+
+type queuedAccess struct {
+	Sha256Hash string `json:"sha256"`
+	AccessTs   int64  `json:"ts"`
+}
+
 func FlagAccess(ctx rcontext.RequestContext, sha256hash string, uploadTime int64) {
 	if uploadTime > 0 {
 		metrics.MediaAgeAccessed.Observe(float64(util.NowMillis()-uploadTime) / 1000.0)
 	}
+	if config.Get().Deployment.IsDownloadsOnly() {
+		queueAccess(ctx, sha256hash)
+		return
+	}
 	if err := database.GetInstance().LastAccess.Prepare(ctx).Upsert(sha256hash, util.NowMillis()); err != nil {
 		ctx.Log.Warnf("Non-fatal error while updating last access for '%s': %s", sha256hash, err.Error())
 		sentry.CaptureException(err)
 	}
 }
+
+func queueAccess(ctx rcontext.RequestContext, sha256hash string) {
+	b, err := json.Marshal(&queuedAccess{Sha256Hash: sha256hash, AccessTs: util.NowMillis()})
+	if err == nil {
+		err = redislib.PushQueue(ctx, accessQueue, string(b), 0)
+	}
+	if err != nil {
+		ctx.Log.Warnf("Non-fatal error while queueing last access for '%s': %s", sha256hash, err.Error())
+		sentry.CaptureException(err)
+	}
+}
+
+// SaveQueuedAccesses records the last access times queued by download instances, returning the number of media
+// objects updated.
+func SaveQueuedAccesses(ctx rcontext.RequestContext) (int, error) {
+	db := database.GetInstance().LastAccess.Prepare(ctx)
+	saved := 0
+	for {
+		vals, err := redislib.PopQueueBatch(ctx, accessQueue, accessQueueBatchSize)
+		if err != nil {
+			return saved, err
+		}
+
+		// Popular media is likely to appear many times, so only the latest access is written
+		latest := make(map[string]int64)
+		for _, val := range vals {
+			access := &queuedAccess{}
+			if err = json.Unmarshal([]byte(val), access); err != nil {
+				ctx.Log.Warn("Skipping malformed queued access: ", err)
+				continue
+			}
+			latest[access.Sha256Hash] = max(latest[access.Sha256Hash], access.AccessTs)
+		}
+		for hash, ts := range latest {
+			if err = db.Upsert(hash, ts); err != nil {
+				return saved, err
+			}
+			saved++
+		}
+
+		if len(vals) < accessQueueBatchSize {
+			return saved, nil
+		}
+	}
+}
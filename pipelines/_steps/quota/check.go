@@ -5,8 +5,10 @@ import (
 
 	"github.com/ryanuber/go-glob"
 	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/config"
 	"github.com/t2bot/matrix-media-repo/common/rcontext"
 	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/webhooks"
 )
 
 type Type int64
@@ -17,6 +19,19 @@ const (
 	MaxCount   Type = 2
 )
 
+func (t Type) String() string {
+	switch t {
+	case MaxBytes:
+		return "max_bytes"
+	case MaxPending:
+		return "max_pending"
+	case MaxCount:
+		return "max_files"
+	default:
+		return "unknown"
+	}
+}
+
 func Check(ctx rcontext.RequestContext, userId string, quotaType Type) error {
 	limit, err := Limit(ctx, userId, quotaType)
 	if err != nil {
@@ -37,6 +52,7 @@ func Check(ctx rcontext.RequestContext, userId string, quotaType Type) error {
 		return nil
 	} else {
 		ctx.Log.Debugf("Quota %d current=%d limit=%d", int64(quotaType), count, limit)
+		webhooks.NotifyQuotaExceeded(ctx, userId, quotaType.String(), count, limit, 0)
 		return common.ErrQuotaExceeded
 	}
 }
@@ -74,6 +90,7 @@ func CanUpload(ctx rcontext.RequestContext, userId string, bytes int64) error {
 
 	if (count + bytes) > limit {
 		ctx.Log.Debugf("Quota %s current=%d bytes=%d limit=%d", "CanUpload", count, bytes, limit)
+		webhooks.NotifyQuotaExceeded(ctx, userId, MaxBytes.String(), count, limit, bytes)
 		return common.ErrQuotaExceeded
 	}
 
@@ -86,9 +103,10 @@ func CanUpload(ctx rcontext.RequestContext, userId string, bytes int64) error {
 
 func Limit(ctx rcontext.RequestContext, userId string, quotaType Type) (int64, error) {
 	if !ctx.Config.Uploads.Quota.Enabled {
-		return defaultLimit(ctx, quotaType)
+		return defaultLimit(&ctx.Config, quotaType)
 	}
 
+	var stats *database.DbUserStats
 	db := database.GetInstance().UserStats.Prepare(ctx)
 	record, err := db.GetUserQuota([]string{userId})
 	if err != nil {
@@ -96,33 +114,47 @@ func Limit(ctx rcontext.RequestContext, userId string, quotaType Type) (int64, e
 	} else if len(record) == 0 {
 		ctx.Log.Warn("User " + userId + " does not exist in DB. Skipping DB quota check...")
 	} else {
+		stats = record[0]
+	}
+
+	return LimitFromStats(&ctx.Config, userId, stats, quotaType)
+}
+
+// LimitFromStats is like Limit, but uses the user's already-loaded stats record (which may be nil) and the given
+// domain config instead of querying for them.
+func LimitFromStats(conf *config.DomainRepoConfig, userId string, stats *database.DbUserStats, quotaType Type) (int64, error) {
+	if !conf.Uploads.Quota.Enabled {
+		return defaultLimit(conf, quotaType)
+	}
+
+	if stats != nil {
 		// DB quotas takes precedence over config quotas if value is not -1
-		quota := record[0].UserQuota
+		quota := stats.UserQuota
 		switch quotaType {
 		case MaxBytes:
 			if quota.MaxBytes > 0 {
 				return quota.MaxBytes, nil
 			} else if quota.MaxBytes == 0 {
-				return defaultLimit(ctx, quotaType)
+				return defaultLimit(conf, quotaType)
 			}
 		case MaxPending:
 			if quota.MaxPending > 0 {
 				return quota.MaxPending, nil
 			} else if quota.MaxPending == 0 {
-				return defaultLimit(ctx, quotaType)
+				return defaultLimit(conf, quotaType)
 			}
 		case MaxCount:
 			if quota.MaxFiles > 0 {
 				return quota.MaxFiles, nil
 			} else if quota.MaxFiles == 0 {
-				return defaultLimit(ctx, quotaType)
+				return defaultLimit(conf, quotaType)
 			}
 		default:
 			return 0, errors.New("missing db switch for quota type - contact developer")
 		}
 	}
 
-	for _, q := range ctx.Config.Uploads.Quota.UserQuotas {
+	for _, q := range conf.Uploads.Quota.UserQuotas {
 		if glob.Glob(q.Glob, userId) {
 			if quotaType == MaxBytes {
 				return q.MaxBytes, nil
@@ -136,14 +168,14 @@ func Limit(ctx rcontext.RequestContext, userId string, quotaType Type) (int64, e
 		}
 	}
 
-	return defaultLimit(ctx, quotaType)
+	return defaultLimit(conf, quotaType)
 }
 
-func defaultLimit(ctx rcontext.RequestContext, quotaType Type) (int64, error) {
+func defaultLimit(conf *config.DomainRepoConfig, quotaType Type) (int64, error) {
 	if quotaType == MaxBytes {
 		return -1, nil
 	} else if quotaType == MaxPending {
-		return ctx.Config.Uploads.MaxPending, nil
+		return conf.Uploads.MaxPending, nil
 	} else if quotaType == MaxCount {
 		return 0, nil
 	}
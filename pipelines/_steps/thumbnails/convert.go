@@ -0,0 +1,99 @@
+package thumbnails
+
+import (
+	"io"
+
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/datastores"
+	"github.com/t2bot/matrix-media-repo/pipelines/_steps/datastore_op"
+	"github.com/t2bot/matrix-media-repo/pipelines/_steps/download"
+	"github.com/t2bot/matrix-media-repo/pool"
+	"github.com/t2bot/matrix-media-repo/thumbnailing"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+// ConversionMethod is the thumbnail method conversions are stored under. Conversions are full size, so they are
+// stored with zero width and height.
+const ConversionMethod = "convert"
+
+// GetConversion returns the stored conversion of the media to the format, or nil if there isn't one.
+func GetConversion(ctx rcontext.RequestContext, origin string, mediaId string, format string) (*database.DbThumbnail, error) {
+	return database.GetInstance().Thumbnails.Prepare(ctx).GetByParams(origin, mediaId, 0, 0, ConversionMethod, false, format)
+}
+
+// Convert converts the media to the format, storing the result alongside the media's thumbnails so it is reused
+// and purged with them.
+func Convert(ctx rcontext.RequestContext, mediaRecord *database.DbMedia, format string) (*database.DbThumbnail, io.ReadCloser, error) {
+	var res generateResult
+	if config.Get().ThumbnailWorkers.Enabled {
+		res = offloadGenerate(ctx, &offloadJob{
+			Kind:    offloadKindConvert,
+			Origin:  mediaRecord.Origin,
+			MediaId: mediaRecord.MediaId,
+			Format:  format,
+		})
+	} else {
+		ch := make(chan generateResult)
+		defer close(ch)
+		fn := func() {
+			ch <- convertLocally(ctx, mediaRecord, format)
+		}
+		if err := pool.ThumbnailQueue.Schedule(fn); err != nil {
+			return nil, nil, err
+		}
+		res = <-ch
+	}
+	if res.err != nil {
+		return nil, nil, res.err
+	}
+	return storeConversion(ctx, mediaRecord, format, res)
+}
+
+func convertLocally(ctx rcontext.RequestContext, mediaRecord *database.DbMedia, format string) generateResult {
+	mediaStream, err := download.OpenStream(ctx, mediaRecord.Locatable)
+	if err != nil {
+		return generateResult{err: err}
+	}
+	i, err := thumbnailing.Convert(ctx, mediaStream, util.FixContentType(mediaRecord.ContentType), format)
+	return generateResult{i: i, err: err}
+}
+
+func storeConversion(ctx rcontext.RequestContext, mediaRecord *database.DbMedia, format string, res generateResult) (*database.DbThumbnail, io.ReadCloser, error) {
+	convMediaRecord := res.stored
+	var convStream io.ReadCloser
+	var err error
+	if convMediaRecord != nil {
+		// A worker already stored the conversion for us
+		convStream, err = download.OpenStream(ctx, convMediaRecord.Locatable)
+	} else {
+		convMediaRecord, convStream, err = datastore_op.PutAndReturnStream(ctx, ctx.Request.Host, "", res.i.Reader, res.i.ContentType, "", datastores.ThumbnailsKind)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	newRecord := &database.DbThumbnail{
+		Origin:      mediaRecord.Origin,
+		MediaId:     mediaRecord.MediaId,
+		ContentType: convMediaRecord.ContentType,
+		Width:       0,
+		Height:      0,
+		Method:      ConversionMethod,
+		Animated:    false,
+		Format:      format,
+		SizeBytes:   convMediaRecord.SizeBytes,
+		CreationTs:  convMediaRecord.CreationTs,
+		Locatable: &database.Locatable{
+			Sha256Hash:  convMediaRecord.Sha256Hash,
+			DatastoreId: convMediaRecord.DatastoreId,
+			Location:    convMediaRecord.Location,
+		},
+	}
+	if err = database.GetInstance().Thumbnails.Prepare(ctx).Insert(newRecord); err != nil {
+		defer convStream.Close()
+		return nil, nil, err
+	}
+	return newRecord, convStream, nil
+}
@@ -8,6 +8,7 @@ import (
 	"github.com/getsentry/sentry-go"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/config"
 	"github.com/t2bot/matrix-media-repo/common/rcontext"
 	"github.com/t2bot/matrix-media-repo/database"
 	"github.com/t2bot/matrix-media-repo/datastores"
@@ -21,80 +22,174 @@ import (
 )
 
 type generateResult struct {
-	i   *m.Thumbnail
-	err error
+	i           *m.Thumbnail
+	passthrough bool
+	err         error
+
+	// stored is set instead of i when a thumbnail worker has already put the result in a datastore
+	stored         *database.DbMedia
+	storedAnimated bool
 }
 
-func Generate(ctx rcontext.RequestContext, mediaRecord *database.DbMedia, width int, height int, method string, animated bool) (*database.DbThumbnail, io.ReadCloser, error) {
-	ch := make(chan generateResult)
-	defer close(ch)
-	fn := func() {
-		metric := metrics.ThumbnailsGenerated.With(prometheus.Labels{
-			"width":    strconv.Itoa(width),
-			"height":   strconv.Itoa(height),
-			"method":   method,
-			"animated": strconv.FormatBool(animated),
-			"origin":   mediaRecord.Origin,
-		})
+// passthroughTypes are the content types which are safe to serve as their own thumbnail
+var passthroughTypes = []string{
+	"image/jpeg",
+	"image/png",
+	"image/apng",
+	"image/gif",
+	"image/webp",
+}
+
+func canPassthrough(ctx rcontext.RequestContext, mediaRecord *database.DbMedia, contentType string) bool {
+	maxBytes := ctx.Config.Thumbnails.PassthroughMaxBytes
+	return maxBytes > 0 && mediaRecord.SizeBytes <= maxBytes && util.ArrayContains(passthroughTypes, contentType)
+}
 
-		mediaStream, err := download.OpenStream(ctx, mediaRecord.Locatable)
+// isEmoji returns true if the media is in the emoji content class, which keeps its exact bytes instead of being
+// recompressed.
+func isEmoji(ctx rcontext.RequestContext, mediaRecord *database.DbMedia, contentType string) bool {
+	conf := config.Get().Emoji
+	if !conf.Enabled || !util.ArrayContains(passthroughTypes, contentType) {
+		return false
+	}
+	attrs, err := database.GetInstance().MediaAttributes.Prepare(ctx).Get(mediaRecord.Origin, mediaRecord.MediaId)
+	if err != nil {
+		ctx.Log.Warn("Non-fatal error looking up media attributes: ", err)
+		sentry.CaptureException(err)
+		return false
+	}
+	return attrs != nil && attrs.Purpose == database.PurposeEmoji
+}
+
+func generateLocally(ctx rcontext.RequestContext, mediaRecord *database.DbMedia, width int, height int, method string, animated bool, format string) generateResult {
+	metric := metrics.ThumbnailsGenerated.With(prometheus.Labels{
+		"width":    strconv.Itoa(width),
+		"height":   strconv.Itoa(height),
+		"method":   method,
+		"animated": strconv.FormatBool(animated),
+		"origin":   mediaRecord.Origin,
+	})
+
+	fixedContentType := util.FixContentType(mediaRecord.ContentType)
+
+	// Emoji are never recompressed, regardless of the requested size
+	if isEmoji(ctx, mediaRecord, fixedContentType) {
+		return generateResult{passthrough: true}
+	}
+
+	// Small images which already fit are served as-is, avoiding quality loss from re-encoding
+	if canPassthrough(ctx, mediaRecord, fixedContentType) {
+		sourceStream, err := download.OpenStream(ctx, mediaRecord.Locatable)
 		if err != nil {
-			ch <- generateResult{err: err}
-			return
+			return generateResult{err: err}
 		}
-		fixedContentType := util.FixContentType(mediaRecord.ContentType)
-
-		i, err := thumbnailing.GenerateThumbnail(mediaStream, fixedContentType, width, height, method, animated, ctx)
+		fits, err := thumbnailing.FitsWithin(sourceStream, fixedContentType, width, height, ctx)
 		if err != nil {
-			if i != nil && i.Reader != nil {
-				err2 := i.Reader.Close()
-				if err2 != nil {
-					ctx.Log.Warn("Non-fatal error cleaning up thumbnail stream: ", err2)
-				}
-			}
-			if errors.Is(err, common.ErrMediaDimensionsTooSmall) {
-				metric.Inc()
+			return generateResult{err: err}
+		}
+		if fits {
+			return generateResult{passthrough: true}
+		}
+	}
+
+	mediaStream, err := download.OpenStream(ctx, mediaRecord.Locatable)
+	if err != nil {
+		return generateResult{err: err}
+	}
+
+	i, err := thumbnailing.GenerateThumbnail(mediaStream, fixedContentType, width, height, method, animated, ctx)
+	if err != nil {
+		if i != nil && i.Reader != nil {
+			err2 := i.Reader.Close()
+			if err2 != nil {
+				ctx.Log.Warn("Non-fatal error cleaning up thumbnail stream: ", err2)
 			}
-			ch <- generateResult{err: err}
-			return
 		}
+		if errors.Is(err, common.ErrMediaDimensionsTooSmall) {
+			metric.Inc()
+		}
+		return generateResult{err: err}
+	}
 
-		metric.Inc()
-		ch <- generateResult{i: i}
+	if format != thumbnailing.FormatNative {
+		var transcoded *m.Thumbnail
+		transcoded, err = thumbnailing.Transcode(i, format, ctx)
+		if err != nil {
+			if transcoded == nil {
+				return generateResult{err: err}
+			}
+			// We still have a usable thumbnail, just not in the requested format
+			ctx.Log.Warn("Non-fatal error transcoding thumbnail: ", err)
+			sentry.CaptureException(err)
+		}
+		i = transcoded
 	}
 
-	if err := pool.ThumbnailQueue.Schedule(fn); err != nil {
-		return nil, nil, err
+	metric.Inc()
+	return generateResult{i: i}
+}
+
+func Generate(ctx rcontext.RequestContext, mediaRecord *database.DbMedia, width int, height int, method string, animated bool, format string) (*database.DbThumbnail, io.ReadCloser, error) {
+	var res generateResult
+	if config.Get().ThumbnailWorkers.Enabled {
+		res = offloadGenerate(ctx, &offloadJob{
+			Kind:     offloadKindThumbnail,
+			Origin:   mediaRecord.Origin,
+			MediaId:  mediaRecord.MediaId,
+			Width:    width,
+			Height:   height,
+			Method:   method,
+			Animated: animated,
+			Format:   format,
+		})
+	} else {
+		ch := make(chan generateResult)
+		defer close(ch)
+		fn := func() {
+			ch <- generateLocally(ctx, mediaRecord, width, height, method, animated, format)
+		}
+		if err := pool.ThumbnailQueue.Schedule(fn); err != nil {
+			return nil, nil, err
+		}
+		res = <-ch
 	}
-	res := <-ch
 	if res.err != nil {
 		return nil, nil, res.err
 	}
-	if res.i == nil {
+	if res.passthrough {
+		return recordPassthrough(ctx, mediaRecord, width, height, method, animated, format)
+	}
+	if res.i == nil && res.stored == nil {
 		// Couldn't generate a thumbnail
 		return nil, nil, common.ErrMediaNotFound
 	}
 
-	// At this point, res.i is our thumbnail
+	// At this point, res.i or res.stored is our thumbnail
+	generatedAnimated := res.storedAnimated
+	if res.i != nil {
+		generatedAnimated = res.i.Animated
+	}
 
 	// Quickly check to see if we already have a database record for this thumbnail. We do this because predicting
 	// what the thumbnailer will generate is non-trivial, but it might generate a conflicting thumbnail (particularly
 	// when `defaultAnimated` is `true`.
 	db := database.GetInstance().Thumbnails.Prepare(ctx)
-	if res.i.Animated != animated { // this is the only thing that could have changed during generation
-		existingRecord, err := db.GetByParams(mediaRecord.Origin, mediaRecord.MediaId, width, height, method, res.i.Animated)
+	if generatedAnimated != animated { // this is the only thing that could have changed during generation
+		existingRecord, err := db.GetByParams(mediaRecord.Origin, mediaRecord.MediaId, width, height, method, generatedAnimated, format)
 		if err != nil {
 			return nil, nil, err
 		}
 		if existingRecord != nil {
 			ctx.Log.Debug("Found existing record for parameters - discarding generated thumbnail")
-			defer res.i.Reader.Close()
+			if res.i != nil {
+				defer res.i.Reader.Close()
+			}
 
 			// Optimization: prevent future generator waste by inserting an `animated=true` record for static media,
 			// since we won't ever generate an animated version. This is safe because to get here the thumbnail needed
 			// to be requested as animated, but the generated one wasn't. This implies we are trying to animate a static
 			// image, which doesn't work.
-			if !res.i.Animated {
+			if !generatedAnimated {
 				existingRecord.Animated = true
 				// we don't modify the creation time, so it expires at a sane point in history
 				err = db.Insert(existingRecord)
@@ -112,8 +207,15 @@ func Generate(ctx rcontext.RequestContext, mediaRecord *database.DbMedia, width
 		}
 	}
 
-	// We don't have an existing record. Store the stream and insert a record.
-	thumbMediaRecord, thumbStream, err := datastore_op.PutAndReturnStream(ctx, ctx.Request.Host, "", res.i.Reader, res.i.ContentType, "", datastores.ThumbnailsKind)
+	// We don't have an existing record. Store the stream (unless a worker already did) and insert a record.
+	thumbMediaRecord := res.stored
+	var thumbStream io.ReadCloser
+	var err error
+	if thumbMediaRecord != nil {
+		thumbStream, err = download.OpenStream(ctx, thumbMediaRecord.Locatable)
+	} else {
+		thumbMediaRecord, thumbStream, err = datastore_op.PutAndReturnStream(ctx, ctx.Request.Host, "", res.i.Reader, res.i.ContentType, "", datastores.ThumbnailsKind)
+	}
 	if err != nil {
 		return nil, nil, err
 	}
@@ -126,7 +228,8 @@ func Generate(ctx rcontext.RequestContext, mediaRecord *database.DbMedia, width
 		Width:       width,
 		Height:      height,
 		Method:      method,
-		Animated:    res.i.Animated,
+		Animated:    generatedAnimated,
+		Format:      format,
 		SizeBytes:   thumbMediaRecord.SizeBytes,
 		CreationTs:  thumbMediaRecord.CreationTs,
 		Locatable: &database.Locatable{
@@ -143,3 +246,34 @@ func Generate(ctx rcontext.RequestContext, mediaRecord *database.DbMedia, width
 
 	return newRecord, thumbStream, nil
 }
+
+func recordPassthrough(ctx rcontext.RequestContext, mediaRecord *database.DbMedia, width int, height int, method string, animated bool, format string) (*database.DbThumbnail, io.ReadCloser, error) {
+	ctx.Log.Debug("Using original media as the thumbnail")
+	newRecord := &database.DbThumbnail{
+		Origin:      mediaRecord.Origin,
+		MediaId:     mediaRecord.MediaId,
+		ContentType: mediaRecord.ContentType,
+		Width:       width,
+		Height:      height,
+		Method:      method,
+		Animated:    animated,
+		Format:      format,
+		SizeBytes:   mediaRecord.SizeBytes,
+		CreationTs:  util.NowMillis(),
+		Passthrough: true,
+		Locatable: &database.Locatable{
+			Sha256Hash:  mediaRecord.Sha256Hash,
+			DatastoreId: mediaRecord.DatastoreId,
+			Location:    mediaRecord.Location,
+		},
+	}
+	if err := database.GetInstance().Thumbnails.Prepare(ctx).Insert(newRecord); err != nil {
+		return nil, nil, err
+	}
+
+	rsc, err := download.OpenStream(ctx, newRecord.Locatable)
+	if err != nil {
+		return nil, nil, err
+	}
+	return newRecord, rsc, nil
+}
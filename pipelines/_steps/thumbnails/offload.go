@@ -0,0 +1,261 @@
+package thumbnails
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/datastores"
+	"github.com/t2bot/matrix-media-repo/pipelines/_steps/datastore_op"
+	"github.com/t2bot/matrix-media-repo/redislib"
+	"github.com/t2bot/matrix-media-repo/thumbnailing"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+const offloadJobQueue = "mmr:thumbnail_jobs"
+const offloadReplyQueuePrefix = "mmr:thumbnail_job_result:"
+
+const (
+	offloadKindThumbnail = "thumbnail"
+	offloadKindConvert   = "convert"
+)
+
+// offloadErrors are the errors which callers act upon, and so need to survive the trip back from the worker.
+var offloadErrors = map[string]error{
+	"unsupported":        thumbnailing.ErrUnsupported,
+	"format_unsupported": thumbnailing.ErrFormatUnsupported,
+	"too_small":          common.ErrMediaDimensionsTooSmall,
+	"too_large":          common.ErrMediaTooLarge,
+	"not_found":          common.ErrMediaNotFound,
+}
+
+type offloadJob struct {
+	Id       string `json:"id"`
+	Kind     string `json:"kind"`
+	Host     string `json:"host"`
+	Origin   string `json:"origin"`
+	MediaId  string `json:"media_id"`
+	Width    int    `json:"width"`
+	Height   int    `json:"height"`
+	Method   string `json:"method"`
+	Animated bool   `json:"animated"`
+	Format   string `json:"format"`
+	QueuedTs int64  `json:"queued_ts"`
+}
+
+type offloadResult struct {
+	Error       string `json:"error,omitempty"`
+	ErrorKind   string `json:"error_kind,omitempty"`
+	Passthrough bool   `json:"passthrough,omitempty"`
+	Animated    bool   `json:"animated"`
+	ContentType string `json:"content_type"`
+	SizeBytes   int64  `json:"size_bytes"`
+	CreationTs  int64  `json:"creation_ts"`
+	Sha256Hash  string `json:"sha256"`
+	DatastoreId string `json:"datastore_id"`
+	Location    string `json:"location"`
+}
+
+func offloadTimeout() time.Duration {
+	return time.Duration(config.Get().ThumbnailWorkers.TimeoutSeconds) * time.Second
+}
+
+// offloadGenerate pushes the job to the worker queue and waits for a worker to store the result. The returned
+// result has a stored record instead of a stream.
+func offloadGenerate(ctx rcontext.RequestContext, job *offloadJob) generateResult {
+	var err error
+	if job.Id, err = util.GenerateRandomString(16); err != nil {
+		return generateResult{err: err}
+	}
+	job.Host = ctx.Request.Host
+	job.QueuedTs = util.NowMillis()
+	b, err := json.Marshal(job)
+	if err != nil {
+		return generateResult{err: err}
+	}
+
+	ctx.Log.Debugf("Offloading %s job %s to thumbnail workers", job.Kind, job.Id)
+	timeout := offloadTimeout()
+	if err = redislib.PushQueue(ctx, offloadJobQueue, string(b), 0); err != nil {
+		return generateResult{err: err}
+	}
+	reply, err := redislib.PopQueue(ctx, offloadReplyQueuePrefix+job.Id, timeout)
+	if err != nil {
+		return generateResult{err: err}
+	}
+	if reply == "" {
+		return generateResult{err: errors.New("timed out waiting for a thumbnail worker to process job " + job.Id)}
+	}
+
+	res := &offloadResult{}
+	if err = json.Unmarshal([]byte(reply), res); err != nil {
+		return generateResult{err: err}
+	}
+	if res.Error != "" {
+		if knownErr, ok := offloadErrors[res.ErrorKind]; ok {
+			return generateResult{err: knownErr}
+		}
+		return generateResult{err: errors.New("thumbnail worker error: " + res.Error)}
+	}
+	if res.Passthrough {
+		return generateResult{passthrough: true}
+	}
+	return generateResult{
+		stored: &database.DbMedia{
+			ContentType: res.ContentType,
+			SizeBytes:   res.SizeBytes,
+			CreationTs:  res.CreationTs,
+			Locatable: &database.Locatable{
+				Sha256Hash:  res.Sha256Hash,
+				DatastoreId: res.DatastoreId,
+				Location:    res.Location,
+			},
+		},
+		storedAnimated: res.Animated,
+	}
+}
+
+// ServeOffloadedJobs processes jobs from the worker queue until the stop channel is closed. This is run by the
+// dedicated thumbnailer worker processes rather than the media repo itself.
+func ServeOffloadedJobs(concurrency int, stop <-chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-stop
+		cancel()
+	}()
+
+	wg := &sync.WaitGroup{}
+	for i := 0; i < max(concurrency, 1); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				pollCtx := rcontext.Initial()
+				pollCtx.Context = ctx
+				payload, err := redislib.PopQueue(pollCtx, offloadJobQueue, 5*time.Second)
+				if err != nil {
+					if ctx.Err() == nil {
+						logrus.Error("Error waiting for thumbnail jobs: ", err)
+						sentry.CaptureException(err)
+						time.Sleep(5 * time.Second)
+					}
+					continue
+				}
+				if payload == "" {
+					continue
+				}
+				processOffloadedJob(payload)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func processOffloadedJob(payload string) {
+	job := &offloadJob{}
+	if err := json.Unmarshal([]byte(payload), job); err != nil {
+		logrus.Error("Discarding malformed thumbnail job: ", err)
+		sentry.CaptureException(err)
+		return
+	}
+
+	ctx := rcontext.Initial().LogWithFields(logrus.Fields{
+		"jobId":   job.Id,
+		"kind":    job.Kind,
+		"origin":  job.Origin,
+		"mediaId": job.MediaId,
+	})
+	timeout := offloadTimeout()
+	if util.NowMillis()-job.QueuedTs > timeout.Milliseconds() {
+		ctx.Log.Warn("Skipping thumbnail job which the requester has stopped waiting for")
+		return
+	}
+	if domain := config.GetDomain(job.Host); domain != nil {
+		ctx.Config = *domain
+	}
+	ctx.Request = &http.Request{Host: job.Host, URL: &url.URL{}, Header: http.Header{}}
+	var cancel context.CancelFunc
+	ctx.Context, cancel = context.WithTimeout(ctx.Context, timeout)
+	defer cancel()
+
+	res := runOffloadedJob(ctx, job)
+	if res.Error != "" {
+		ctx.Log.Debug("Thumbnail job failed: ", res.Error)
+	}
+	b, err := json.Marshal(res)
+	if err != nil {
+		ctx.Log.Error("Error encoding thumbnail job result: ", err)
+		sentry.CaptureException(err)
+		return
+	}
+	// The reply expires so abandoned results don't pile up in Redis
+	if err = redislib.PushQueue(ctx, offloadReplyQueuePrefix+job.Id, string(b), timeout); err != nil {
+		ctx.Log.Error("Error replying to thumbnail job: ", err)
+		sentry.CaptureException(err)
+	}
+}
+
+func runOffloadedJob(ctx rcontext.RequestContext, job *offloadJob) *offloadResult {
+	mediaRecord, err := database.GetInstance().Media.Prepare(ctx).GetById(job.Origin, job.MediaId)
+	if err == nil && mediaRecord == nil {
+		err = common.ErrMediaNotFound
+	}
+	if err != nil {
+		return toOffloadError(err)
+	}
+
+	var res generateResult
+	switch job.Kind {
+	case offloadKindThumbnail:
+		res = generateLocally(ctx, mediaRecord, job.Width, job.Height, job.Method, job.Animated, job.Format)
+	case offloadKindConvert:
+		res = convertLocally(ctx, mediaRecord, job.Format)
+	default:
+		return toOffloadError(errors.New("unknown job kind: " + job.Kind))
+	}
+	if res.err != nil {
+		return toOffloadError(res.err)
+	}
+	if res.passthrough {
+		return &offloadResult{Passthrough: true}
+	}
+	if res.i == nil {
+		return toOffloadError(common.ErrMediaNotFound)
+	}
+
+	record, stream, err := datastore_op.PutAndReturnStream(ctx, job.Host, "", res.i.Reader, res.i.ContentType, "", datastores.ThumbnailsKind)
+	if err != nil {
+		return toOffloadError(err)
+	}
+	_ = stream.Close()
+	return &offloadResult{
+		Animated:    res.i.Animated,
+		ContentType: record.ContentType,
+		SizeBytes:   record.SizeBytes,
+		CreationTs:  record.CreationTs,
+		Sha256Hash:  record.Sha256Hash,
+		DatastoreId: record.DatastoreId,
+		Location:    record.Location,
+	}
+}
+
+func toOffloadError(err error) *offloadResult {
+	res := &offloadResult{Error: err.Error()}
+	for kind, knownErr := range offloadErrors {
+		if errors.Is(err, knownErr) {
+			res.ErrorKind = kind
+			break
+		}
+	}
+	return res
+}
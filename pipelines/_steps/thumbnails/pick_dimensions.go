@@ -14,8 +14,11 @@ func PickNewDimensions(ctx rcontext.RequestContext, desiredWidth int, desiredHei
 	if desiredHeight <= 0 {
 		return 0, 0, "", errors.New("height must be positive")
 	}
-	if desiredMethod != "crop" && desiredMethod != "scale" {
-		return 0, 0, "", errors.New("method must be crop or scale")
+	if desiredMethod == "smart" && !ctx.Config.Thumbnails.SmartCrop {
+		desiredMethod = "crop"
+	}
+	if desiredMethod != "crop" && desiredMethod != "scale" && desiredMethod != "smart" {
+		return 0, 0, "", errors.New("method must be crop, scale, or smart")
 	}
 
 	foundSize := false
@@ -55,7 +58,7 @@ func PickNewDimensions(ctx rcontext.RequestContext, desiredWidth int, desiredHei
 		targetHeight = largestHeight
 	}
 
-	if desiredMethod == "crop" {
+	if desiredMethod == "crop" || desiredMethod == "smart" {
 		// We need to maintain the aspect ratio of the request
 		sizeAspect := float32(targetWidth) / float32(targetHeight)
 		if sizeAspect != desiredAspectRatio { // it's unlikely to match, but we can dream
@@ -0,0 +1,81 @@
+package upload
+
+import (
+	"errors"
+	"io"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-media-repo/antivirus"
+	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+type ScanResponse struct {
+	Err    error
+	Result *antivirus.ScanResult
+}
+
+func ScanAsync(ctx rcontext.RequestContext, reader io.Reader) chan ScanResponse {
+	opChan := make(chan ScanResponse)
+	go func() {
+		//goland:noinspection GoUnhandledErrorResult
+		defer io.Copy(io.Discard, reader) // we need to flush the reader as we might end up blocking the upload
+
+		result, err := antivirus.Scan(reader)
+		go func() {
+			// run async to avoid deadlock
+			opChan <- ScanResponse{
+				Err:    err,
+				Result: result,
+			}
+		}()
+	}()
+	return opChan
+}
+
+// ApplyScanResult records the scan result for the hash and decides what happens to the upload. Returns true if
+// the upload should be quarantined, or an error if it should be rejected.
+func ApplyScanResult(ctx rcontext.RequestContext, sha256hash string, res ScanResponse) (bool, error) {
+	if errors.Is(res.Err, antivirus.ErrStreamTooLarge) {
+		// Not a clamd failure: the upload is bigger than clamd will scan. Raise StreamMaxLength in clamd.conf to match
+		// uploads.maxBytes so every upload can be scanned.
+		if config.Get().Antivirus.FailOpen {
+			ctx.Log.Warn("Accepting upload which is too large for clamd to scan")
+			return false, nil
+		}
+		ctx.Log.Warn("Rejecting upload which is too large for clamd to scan")
+		return false, errors.Join(common.ErrMediaTooLargeToScan, res.Err)
+	}
+	if res.Err != nil {
+		if config.Get().Antivirus.FailOpen {
+			ctx.Log.Warn("Accepting upload which failed to scan: ", res.Err)
+			sentry.CaptureException(res.Err)
+			return false, nil
+		}
+		return false, errors.Join(common.ErrMediaScanFailed, res.Err)
+	}
+
+	err := database.GetInstance().MediaScans.Prepare(ctx).Upsert(&database.DbMediaScan{
+		Sha256Hash: sha256hash,
+		ScannedTs:  util.NowMillis(),
+		Infected:   res.Result.Infected,
+		Signature:  res.Result.Signature,
+	})
+	if err != nil {
+		ctx.Log.Warn("Non-fatal error recording scan result: ", err)
+		sentry.CaptureException(err)
+	}
+
+	if !res.Result.Infected {
+		return false, nil
+	}
+	ctx.Log.WithFields(logrus.Fields{"signature": res.Result.Signature}).Warn("Virus detected in upload")
+	if config.Get().Antivirus.InfectedAction == "quarantine" {
+		return true, nil
+	}
+	return false, common.ErrMediaInfected
+}
@@ -0,0 +1,108 @@
+package upload
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+const attestationVersion = "a1"
+
+// Attestation vouches that a user may upload media up to a given size. Attestations are issued by the homeserver or
+// an operator service, and are signed with one of the domain's `uploads.attestation.trustedKeys`.
+type Attestation struct {
+	KeyId     string `json:"key_id"`
+	UserId    string `json:"user_id"`
+	MaxBytes  int64  `json:"max_bytes"`
+	ExpiresTs int64  `json:"expires_ts"`
+	// Sha256Hash optionally limits the attestation to uploads of exactly this content, as hex.
+	Sha256Hash string `json:"sha256,omitempty"`
+}
+
+type attestationFlagKey struct{}
+
+type attestationFlag struct {
+	attestation *Attestation
+}
+
+// VerifyAttestation checks the attestation's signature, expiry, and user. Attestations are formatted as
+// `a1.<payload>.<signature>`, where the payload is the JSON Attestation and the signature is an ed25519 signature
+// of `a1.<payload>`, both as unpadded URL-safe base64.
+func VerifyAttestation(ctx rcontext.RequestContext, token string, userId string) (*Attestation, error) {
+	conf := ctx.Config.Uploads.Attestation
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != attestationVersion {
+		return nil, common.ErrInvalidAttestation
+	}
+	b, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, common.ErrInvalidAttestation
+	}
+	val := &Attestation{}
+	if err = json.Unmarshal(b, val); err != nil {
+		return nil, common.ErrInvalidAttestation
+	}
+
+	keyB64, ok := conf.TrustedKeys[val.KeyId]
+	if !ok {
+		return nil, errors.Join(common.ErrInvalidAttestation, fmt.Errorf("key '%s' is not trusted", val.KeyId))
+	}
+	key, err := util.DecodeUnpaddedBase64String(keyB64)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, errors.Join(common.ErrInvalidAttestation, fmt.Errorf("trusted key '%s' is not an ed25519 public key", val.KeyId))
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !ed25519.Verify(key, []byte(parts[0]+"."+parts[1]), sig) {
+		return nil, errors.Join(common.ErrInvalidAttestation, errors.New("bad signature"))
+	}
+
+	if val.UserId != userId {
+		return nil, errors.Join(common.ErrInvalidAttestation, errors.New("attestation is for another user"))
+	}
+	now := util.NowMillis()
+	if val.ExpiresTs <= now {
+		return nil, errors.Join(common.ErrInvalidAttestation, errors.New("attestation has expired"))
+	}
+	// Attestations are meant to be short-lived, so a stolen one isn't useful for long
+	if conf.MaxLifetimeSeconds > 0 && val.ExpiresTs-now > conf.MaxLifetimeSeconds*1000 {
+		return nil, errors.Join(common.ErrInvalidAttestation, errors.New("attestation expires too far in the future"))
+	}
+	return val, nil
+}
+
+// FlagAttestation returns a context in which uploads are checked against the given attestation once their size is
+// known. A nil attestation means the uploader didn't supply one, so only small uploads are allowed.
+func FlagAttestation(ctx rcontext.RequestContext, attestation *Attestation) rcontext.RequestContext {
+	ctx.Context = context.WithValue(ctx.Context, attestationFlagKey{}, attestationFlag{attestation: attestation})
+	return ctx
+}
+
+// CheckAttestation returns common.ErrAttestationRequired if an upload of the given size and SHA-256 hash needs an
+// attestation which the uploader didn't supply, or which doesn't cover that upload. The hash is only checked when
+// given, as it isn't known until the upload has been read. Uploads not flagged with FlagAttestation, such as those
+// made by the media repo itself, are not checked.
+func CheckAttestation(ctx rcontext.RequestContext, sizeBytes int64, sha256Hash string) error {
+	conf := ctx.Config.Uploads.Attestation
+	if !conf.Enabled || sizeBytes < conf.MinBytes {
+		return nil
+	}
+	flagged, ok := ctx.Context.Value(attestationFlagKey{}).(attestationFlag)
+	if !ok {
+		return nil
+	}
+	if flagged.attestation == nil || sizeBytes > flagged.attestation.MaxBytes {
+		return common.ErrAttestationRequired
+	}
+	if sha256Hash != "" && flagged.attestation.Sha256Hash != "" && !strings.EqualFold(sha256Hash, flagged.attestation.Sha256Hash) {
+		return common.ErrAttestationRequired
+	}
+	return nil
+}
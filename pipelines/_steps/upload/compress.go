@@ -0,0 +1,44 @@
+package upload
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/thumbnailing"
+	"github.com/t2bot/matrix-media-repo/util/readers"
+)
+
+// Compress re-encodes JPEG uploads to be smaller, for users who have asked for their uploads to be compressed. The
+// original is kept if it can't be compressed, or if compressing doesn't make it smaller.
+func Compress(ctx rcontext.RequestContext, r io.ReadCloser, contentType string) (io.ReadCloser, error) {
+	if contentType != "image/jpeg" {
+		return r, nil
+	}
+
+	b, err := io.ReadAll(io.LimitReader(r, ctx.Config.Thumbnails.MaxSourceBytes+1))
+	if err != nil {
+		_ = r.Close()
+		return nil, err
+	}
+	if int64(len(b)) > ctx.Config.Thumbnails.MaxSourceBytes {
+		ctx.Log.Debug("Upload is too large to compress")
+		return readers.NewCancelCloser(io.NopCloser(io.MultiReader(bytes.NewReader(b), r)), func() {
+			r.Close()
+		}), nil
+	}
+	_ = r.Close()
+
+	conf := config.Get().UserPreferences.Compression
+	compressed, err := thumbnailing.CompressJpeg(ctx, b, conf.MaxDimension, conf.Quality)
+	if err != nil {
+		ctx.Log.Debug("Keeping original upload after failing to compress: ", err)
+		return io.NopCloser(bytes.NewReader(b)), nil
+	}
+	if len(compressed) >= len(b) {
+		return io.NopCloser(bytes.NewReader(b)), nil
+	}
+	ctx.Log.Debugf("Compressed upload from %d to %d bytes", len(b), len(compressed))
+	return io.NopCloser(bytes.NewReader(compressed)), nil
+}
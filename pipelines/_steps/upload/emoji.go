@@ -0,0 +1,66 @@
+package upload
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/util"
+	"github.com/t2bot/matrix-media-repo/util/readers"
+)
+
+type emojiFlagKey struct{}
+
+// FlagEmoji returns a context in which uploads are treated as emoji, even if they are larger than emoji.maxBytes.
+func FlagEmoji(ctx rcontext.RequestContext) rcontext.RequestContext {
+	ctx.Context = context.WithValue(ctx.Context, emojiFlagKey{}, true)
+	return ctx
+}
+
+func isFlaggedEmoji(ctx rcontext.RequestContext) bool {
+	flagged, _ := ctx.Context.Value(emojiFlagKey{}).(bool)
+	return flagged
+}
+
+// LooksLikeEmoji returns true if media of the given type and size belongs in the emoji content class.
+func LooksLikeEmoji(contentType string, sizeBytes int64) bool {
+	conf := config.Get().Emoji
+	return conf.Enabled && sizeBytes <= conf.MaxBytes && util.ArrayContains(conf.ContentTypes, contentType)
+}
+
+// DetectEmoji works out whether an upload is an emoji before it is stored, so its bytes can be kept exactly as they
+// were uploaded. The returned reader must be used in place of r.
+func DetectEmoji(ctx rcontext.RequestContext, r io.ReadCloser, contentType string) (io.ReadCloser, bool) {
+	conf := config.Get().Emoji
+	if !conf.Enabled || !util.ArrayContains(conf.ContentTypes, contentType) {
+		return r, false
+	}
+	if isFlaggedEmoji(ctx) {
+		return r, true
+	}
+
+	// Read just past the limit: if the stream ends first, it's small enough to be an emoji
+	buf := make([]byte, conf.MaxBytes+1)
+	n, err := io.ReadFull(r, buf)
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return readers.NewCancelCloser(io.NopCloser(bytes.NewReader(buf[:n])), func() {
+			r.Close()
+		}), true
+	}
+	return readers.NewCancelCloser(io.NopCloser(io.MultiReader(bytes.NewReader(buf[:n]), r)), func() {
+		r.Close()
+	}), false
+}
+
+// MarkEmoji records the media as belonging to the emoji content class.
+func MarkEmoji(ctx rcontext.RequestContext, origin string, mediaId string) {
+	if err := database.GetInstance().MediaAttributes.Prepare(ctx).UpsertPurpose(origin, mediaId, database.PurposeEmoji); err != nil {
+		ctx.Log.Warn("Non-fatal error marking media as an emoji: ", err)
+		sentry.CaptureException(err)
+	}
+}
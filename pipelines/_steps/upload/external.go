@@ -0,0 +1,54 @@
+package upload
+
+import (
+	"net"
+	"net/url"
+
+	"github.com/ryanuber/go-glob"
+	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+)
+
+// CanRegisterExternal returns true if the user is permitted to register media which is fetched from an external URL.
+func CanRegisterExternal(ctx rcontext.RequestContext, userId string) bool {
+	if !ctx.Config.Uploads.ExternalMedia.Enabled {
+		return false
+	}
+	for _, pattern := range ctx.Config.Uploads.ExternalMedia.AllowedUsers {
+		if glob.Glob(pattern, userId) {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckExternalUrl returns common.ErrHostNotAllowed if media may not be fetched from the given URL.
+func CheckExternalUrl(ctx rcontext.RequestContext, u *url.URL) error {
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return common.ErrHostNotAllowed
+	}
+	for _, pattern := range ctx.Config.Uploads.ExternalMedia.AllowedHosts {
+		if glob.Glob(pattern, u.Hostname()) {
+			return nil
+		}
+	}
+	return common.ErrHostNotAllowed
+}
+
+// CheckExternalAddress returns common.ErrHostNotAllowed if media may not be fetched from the given IP address.
+func CheckExternalAddress(ctx rcontext.RequestContext, ip net.IP) error {
+	if ip.IsUnspecified() {
+		return common.ErrHostNotAllowed
+	}
+	for _, cidr := range ctx.Config.Uploads.ExternalMedia.DisallowedNetworks {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			ctx.Log.Warn("Ignoring invalid disallowed network for external media: ", err)
+			continue
+		}
+		if network.Contains(ip) {
+			return common.ErrHostNotAllowed
+		}
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package upload
+
+import (
+	"errors"
+	"io"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/datastores"
+	"github.com/t2bot/matrix-media-repo/metrics"
+)
+
+// FailoverUpload retries a failed datastore upload against the other datastores which accept the media kind, one at
+// a time, until one succeeds. The buffer must be seekable so it can be read again from the start. Returns the
+// datastore the media was uploaded to and its location, or the last upload error if every datastore failed.
+func FailoverUpload(ctx rcontext.RequestContext, kind datastores.Kind, failedDs config.DatastoreConfig, uploadErr error, buffer io.Reader, sizeBytes int64, contentType string, sha256hash string) (config.DatastoreConfig, string, error) {
+	seeker, ok := buffer.(io.ReadSeeker)
+	if !ok {
+		return failedDs, "", uploadErr
+	}
+
+	tried := []string{failedDs.Id}
+	for {
+		ctx.Log.Warnf("Upload to datastore %s failed, trying another datastore: %v", failedDs.Id, uploadErr)
+		sentry.CaptureException(uploadErr)
+
+		nextDs, err := datastores.PickExcluding(ctx, kind, tried)
+		if err != nil {
+			ctx.Log.Debug("No more datastores to fail over to: ", err)
+			return failedDs, "", uploadErr
+		}
+		metrics.DatastoreFailovers.With(prometheus.Labels{"from_datastore": failedDs.Id, "to_datastore": nextDs.Id}).Inc()
+
+		if _, err = seeker.Seek(0, io.SeekStart); err != nil {
+			return failedDs, "", errors.Join(uploadErr, err)
+		}
+		location, err := datastores.Upload(ctx, nextDs, io.NopCloser(seeker), sizeBytes, contentType, sha256hash)
+		if err == nil {
+			ctx.Log.Infof("Upload failed over from datastore %s to %s", failedDs.Id, nextDs.Id)
+			return nextDs, location, nil
+		}
+
+		tried = append(tried, nextDs.Id)
+		failedDs = nextDs
+		uploadErr = err
+	}
+}
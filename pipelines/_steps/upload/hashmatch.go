@@ -0,0 +1,85 @@
+package upload
+
+import (
+	"errors"
+	"io"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/hashmatch"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+// hashMatchPolicy is the policy name hash list matches are recorded under in the moderation audit log.
+const hashMatchPolicy = "hash_match"
+
+type HashMatchResponse struct {
+	Err    error
+	Hashes *hashmatch.Hashes
+}
+
+func ComputeHashesAsync(ctx rcontext.RequestContext, reader io.Reader, contentType string) chan HashMatchResponse {
+	opChan := make(chan HashMatchResponse)
+	go func() {
+		//goland:noinspection GoUnhandledErrorResult
+		defer io.Copy(io.Discard, reader) // we need to flush the reader as we might end up blocking the upload
+
+		hashes, err := hashmatch.Compute(ctx, reader, contentType)
+		go func() {
+			// run async to avoid deadlock
+			opChan <- HashMatchResponse{
+				Err:    err,
+				Hashes: hashes,
+			}
+		}()
+	}()
+	return opChan
+}
+
+// ApplyHashMatch checks the upload's hashes against the hash lists, alerting admins about matches. Returns true
+// if the upload should be quarantined, or an error if it should be rejected.
+func ApplyHashMatch(ctx rcontext.RequestContext, origin string, mediaId string, userId string, sha256hash string, res HashMatchResponse) (bool, error) {
+	var match *hashmatch.Match
+	err := res.Err
+	if err == nil {
+		res.Hashes.Sha256 = sha256hash
+		match, err = hashmatch.Check(ctx, res.Hashes)
+	}
+	if err != nil {
+		if config.Get().HashMatching.FailOpen {
+			ctx.Log.Warn("Accepting upload which failed to be checked against hash lists: ", err)
+			sentry.CaptureException(err)
+			return false, nil
+		}
+		return false, errors.Join(common.ErrMediaHashCheckFailed, err)
+	}
+	if match == nil {
+		return false, nil
+	}
+
+	err = database.GetInstance().ModerationLog.Prepare(ctx).Insert(&database.DbModerationDecision{
+		Origin:     origin,
+		MediaId:    mediaId,
+		Sha256Hash: sha256hash,
+		Policy:     hashMatchPolicy,
+		Action:     "quarantine",
+		Reason:     match.HashType + " match from " + match.Source + ": " + match.Reason,
+		Attempts:   1,
+		DecidedTs:  util.NowMillis(),
+	})
+	if err != nil {
+		ctx.Log.Warn("Non-fatal error recording hash match: ", err)
+		sentry.CaptureException(err)
+	}
+	hashmatch.SendAlert(ctx, &hashmatch.Alert{
+		Origin:  origin,
+		MediaId: mediaId,
+		UserId:  userId,
+		Hashes:  res.Hashes,
+		Match:   match,
+	})
+	return true, nil
+}
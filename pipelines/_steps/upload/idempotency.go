@@ -0,0 +1,118 @@
+package upload
+
+import (
+	"time"
+
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+// IdempotencyLeaseSeconds is how long an idempotency key stays reserved for an upload which hasn't finished yet. The
+// reservation is renewed while the upload runs (see HoldIdempotencyKey), so if the process dies mid-upload the client
+// can retry with the same key shortly after, rather than once the full idempotency window has passed.
+const IdempotencyLeaseSeconds = 60
+
+// FindIdempotentMedia returns the media previously uploaded by the user under the given idempotency key, if
+// the key is still valid and the media still exists. Returns nil otherwise, including while the upload holding
+// the key is still in progress.
+func FindIdempotentMedia(ctx rcontext.RequestContext, userId string, key string) (*database.DbMedia, error) {
+	if key == "" || ctx.Config.Uploads.IdempotencySeconds <= 0 {
+		return nil, nil
+	}
+	record, err := database.GetInstance().IdempotencyKeys.Prepare(ctx).Get(userId, key)
+	if err != nil || record == nil || record.MediaId == "" {
+		return nil, err
+	}
+	return database.GetInstance().Media.Prepare(ctx).GetById(record.Origin, record.MediaId)
+}
+
+// ReserveIdempotencyKey claims the idempotency key before the upload starts, so concurrent retries with the same
+// key can't both store media. If the key has already been used, the media it points at is returned instead and
+// should be used as the response. Returns false (and no media) if another upload holding the key is still running.
+func ReserveIdempotencyKey(ctx rcontext.RequestContext, userId string, key string) (bool, *database.DbMedia, error) {
+	if key == "" || ctx.Config.Uploads.IdempotencySeconds <= 0 {
+		return true, nil, nil
+	}
+	db := database.GetInstance().IdempotencyKeys.Prepare(ctx)
+	for attempt := 0; attempt < 2; attempt++ {
+		reserved, err := db.Reserve(userId, key, util.NowMillis()+IdempotencyLeaseSeconds*1000)
+		if err != nil || reserved {
+			return reserved, nil, err
+		}
+		record, err := db.Get(userId, key)
+		if err != nil {
+			return false, nil, err
+		}
+		if record == nil {
+			continue // expired between the two queries
+		}
+		if record.MediaId == "" {
+			return false, nil, nil
+		}
+		existing, err := database.GetInstance().Media.Prepare(ctx).GetById(record.Origin, record.MediaId)
+		if err != nil {
+			return false, nil, err
+		}
+		if existing != nil {
+			return false, existing, nil
+		}
+		// The media has since been deleted - let this upload take over the key
+		if err = db.Delete(userId, key); err != nil {
+			return false, nil, err
+		}
+	}
+	return false, nil, nil
+}
+
+// HoldIdempotencyKey renews the reservation taken by ReserveIdempotencyKey until the returned function is called, which
+// must happen once the upload has finished.
+func HoldIdempotencyKey(ctx rcontext.RequestContext, userId string, key string) func() {
+	if key == "" || ctx.Config.Uploads.IdempotencySeconds <= 0 {
+		return func() {}
+	}
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(IdempotencyLeaseSeconds * time.Second / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				err := database.GetInstance().IdempotencyKeys.Prepare(ctx).RenewPending(userId, key, util.NowMillis()+IdempotencyLeaseSeconds*1000)
+				if err != nil {
+					ctx.Log.Warn("Non-fatal error renewing idempotency key reservation: ", err)
+				}
+			}
+		}
+	}()
+	return func() {
+		close(done)
+	}
+}
+
+// RecordIdempotencyKey points the reserved idempotency key at the uploaded media, keeping it for the full idempotency
+// window.
+func RecordIdempotencyKey(ctx rcontext.RequestContext, userId string, key string, media *database.DbMedia) error {
+	if key == "" || ctx.Config.Uploads.IdempotencySeconds <= 0 {
+		return nil
+	}
+	return database.GetInstance().IdempotencyKeys.Prepare(ctx).Update(&database.DbIdempotencyKey{
+		UserId:    userId,
+		Key:       key,
+		Origin:    media.Origin,
+		MediaId:   media.MediaId,
+		ExpiresTs: util.NowMillis() + ctx.Config.Uploads.IdempotencySeconds*1000,
+	})
+}
+
+// ReleaseIdempotencyKey gives up a reserved idempotency key after the upload failed, so the client can retry.
+func ReleaseIdempotencyKey(ctx rcontext.RequestContext, userId string, key string) {
+	if key == "" || ctx.Config.Uploads.IdempotencySeconds <= 0 {
+		return
+	}
+	if err := database.GetInstance().IdempotencyKeys.Prepare(ctx).DeletePending(userId, key); err != nil {
+		ctx.Log.Warn("Non-fatal error releasing idempotency key: ", err)
+	}
+}
@@ -0,0 +1,65 @@
+package upload
+
+import (
+	"io"
+	"strings"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/nsfw"
+)
+
+type NsfwResponse struct {
+	Err   error
+	Score *float64
+}
+
+// ClassifyAsync classifies images with the NSFW classifier. Media which isn't an image, or is larger than the
+// thumbnailer's source limit, isn't classified and gets a nil score.
+func ClassifyAsync(ctx rcontext.RequestContext, reader io.Reader, contentType string) chan NsfwResponse {
+	opChan := make(chan NsfwResponse)
+	go func() {
+		//goland:noinspection GoUnhandledErrorResult
+		defer io.Copy(io.Discard, reader) // we need to flush the reader as we might end up blocking the upload
+
+		res := NsfwResponse{}
+		if strings.HasPrefix(contentType, "image/") {
+			b, err := io.ReadAll(io.LimitReader(reader, ctx.Config.Thumbnails.MaxSourceBytes+1))
+			if err != nil {
+				res.Err = err
+			} else if int64(len(b)) > ctx.Config.Thumbnails.MaxSourceBytes {
+				ctx.Log.Debug("Not classifying image: too large")
+			} else {
+				var score float64
+				score, res.Err = nsfw.Classify(ctx, contentType, b)
+				if res.Err == nil {
+					res.Score = &score
+				}
+			}
+		}
+		go func() {
+			// run async to avoid deadlock
+			opChan <- res
+		}()
+	}()
+	return opChan
+}
+
+// ApplyNsfwScore returns true if the upload should be quarantined due to its score. Classification is advisory,
+// so errors are logged rather than failing the upload.
+func ApplyNsfwScore(ctx rcontext.RequestContext, res NsfwResponse) bool {
+	if res.Err != nil {
+		ctx.Log.Warn("Non-fatal error classifying upload: ", res.Err)
+		sentry.CaptureException(res.Err)
+		return false
+	}
+	if res.Score == nil {
+		return false
+	}
+	if nsfw.ShouldQuarantine(*res.Score) {
+		ctx.Log.WithFields(logrus.Fields{"nsfwScore": *res.Score}).Info("Quarantining upload due to NSFW score")
+		return true
+	}
+	return false
+}
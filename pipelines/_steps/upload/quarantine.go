@@ -4,6 +4,7 @@ import (
 	"github.com/t2bot/matrix-media-repo/common"
 	"github.com/t2bot/matrix-media-repo/common/rcontext"
 	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/hashbans"
 )
 
 func CheckQuarantineStatus(ctx rcontext.RequestContext, hash string) error {
@@ -14,5 +15,14 @@ func CheckQuarantineStatus(ctx rcontext.RequestContext, hash string) error {
 	if q {
 		return common.ErrMediaQuarantined
 	}
+
+	// Banned hashes are treated the same as quarantined media
+	banned, err := hashbans.IsBanned(ctx, hash)
+	if err != nil {
+		return err
+	}
+	if banned {
+		return common.ErrMediaQuarantined
+	}
 	return nil
 }
@@ -0,0 +1,58 @@
+package upload
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/events"
+	"github.com/t2bot/matrix-media-repo/references"
+	"github.com/t2bot/matrix-media-repo/restrictions"
+)
+
+// PersistMedia inserts the media record, its restrictions, and its room references in a single transaction, so
+// a partial failure can't leave a media record behind without its references.
+func PersistMedia(ctx rcontext.RequestContext, record *database.DbMedia, roomIds []string) error {
+	err := database.GetInstance().WithTransaction(ctx, func(tx *sql.Tx) error {
+		if err := database.GetInstance().Media.PrepareTx(ctx, tx).Insert(record); err != nil {
+			return err
+		}
+		if config.Get().General.FreezeUnauthenticatedMedia || isFlaggedRequiresAuth(ctx) {
+			if err := restrictions.SetMediaRequiresAuthTx(ctx, tx, record.Origin, record.MediaId); err != nil {
+				return err
+			}
+		}
+		return addReferencesTx(ctx, tx, record.Origin, record.MediaId, roomIds)
+	})
+	if err != nil {
+		return errors.Join(common.ErrMediaNotPersisted, err)
+	}
+	events.Emit(ctx, events.MediaUploaded, record)
+	return nil
+}
+
+// AddReferences records the room references for already-persisted media in a single transaction.
+func AddReferences(ctx rcontext.RequestContext, origin string, mediaId string, roomIds []string) error {
+	if len(roomIds) == 0 {
+		return nil
+	}
+	err := database.GetInstance().WithTransaction(ctx, func(tx *sql.Tx) error {
+		return addReferencesTx(ctx, tx, origin, mediaId, roomIds)
+	})
+	if err != nil {
+		return errors.Join(common.ErrMediaNotPersisted, err)
+	}
+	return nil
+}
+
+func addReferencesTx(ctx rcontext.RequestContext, tx *sql.Tx, origin string, mediaId string, roomIds []string) error {
+	for _, roomId := range roomIds {
+		if err := references.AddMediaReferenceTx(ctx, tx, origin, mediaId, roomId, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
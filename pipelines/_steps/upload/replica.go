@@ -0,0 +1,21 @@
+package upload
+
+import (
+	"context"
+
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+)
+
+type replicaFlagKey struct{}
+
+// FlagReplica returns a context in which uploads are copies of media from a primary media repo. Replicas are stored
+// exactly as received, and don't count against the uploader's quota or size limits.
+func FlagReplica(ctx rcontext.RequestContext) rcontext.RequestContext {
+	ctx.Context = context.WithValue(ctx.Context, replicaFlagKey{}, true)
+	return ctx
+}
+
+func IsReplica(ctx rcontext.RequestContext) bool {
+	flagged, _ := ctx.Context.Value(replicaFlagKey{}).(bool)
+	return flagged
+}
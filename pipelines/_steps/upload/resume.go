@@ -0,0 +1,180 @@
+package upload
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/datastores"
+	"github.com/t2bot/matrix-media-repo/util"
+	"github.com/t2bot/matrix-media-repo/util/ids"
+)
+
+// Partial uploads are kept on the local disk of the instance which received them, so continuations must reach
+// the same instance. A continuation which lands elsewhere sees ErrPartialUploadNotFound and restarts.
+var partialUploadsDir = filepath.Join(os.TempDir(), "mmr-partial-uploads")
+
+var activePartials = new(sync.Map)
+
+// IsResumableUpload returns true if an upload of the given size should be received as a resumable upload.
+func IsResumableUpload(ctx rcontext.RequestContext, key string, totalBytes int64) bool {
+	minBytes := ctx.Config.Uploads.ResumableMinBytes
+	return key != "" && minBytes > 0 && ctx.Config.Uploads.IdempotencySeconds > 0 && totalBytes >= minBytes
+}
+
+// GetPartialUpload returns the partial upload for the user's idempotency key, or nil if there isn't one.
+func GetPartialUpload(ctx rcontext.RequestContext, userId string, key string) (*database.DbUploadPartial, error) {
+	record, err := database.GetInstance().UploadPartials.Prepare(ctx).Get(userId, key)
+	if err != nil || record == nil {
+		return record, err
+	}
+	if _, err = os.Stat(record.Location); err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil // received by another instance, or cleaned up
+		}
+		return nil, err
+	}
+	return record, nil
+}
+
+// ReceivePartialUpload appends the body to the partial upload for the user's idempotency key, starting at the
+// given offset. An offset of zero starts a new partial upload, replacing any existing one. The returned record
+// reflects the bytes received, even if the body ended early (in which case an error is also returned).
+func ReceivePartialUpload(ctx rcontext.RequestContext, userId string, key string, contentType string, filename string, body io.Reader, offset int64, totalBytes int64) (*database.DbUploadPartial, error) {
+	lockKey := userId + "/" + key
+	if _, busy := activePartials.LoadOrStore(lockKey, true); busy {
+		return nil, common.ErrPartialUploadInProgress
+	}
+	defer activePartials.Delete(lockKey)
+
+	// Partial uploads live in the temporary directory, which is covered by the disk watermarks
+	if err := datastores.CheckDiskSpace(ctx, datastores.LocalMediaKind); err != nil {
+		return nil, err
+	}
+
+	db := database.GetInstance().UploadPartials.Prepare(ctx)
+	record, err := GetPartialUpload(ctx, userId, key)
+	if err != nil {
+		return nil, err
+	}
+
+	if offset == 0 {
+		if err = checkPartialUploadLimits(ctx, userId, key, totalBytes); err != nil {
+			return nil, err
+		}
+		if record != nil {
+			_ = os.Remove(record.Location)
+		}
+		if err = os.MkdirAll(partialUploadsDir, 0700); err != nil {
+			return nil, err
+		}
+		fileId, err := ids.NewUniqueId()
+		if err != nil {
+			return nil, err
+		}
+		record = &database.DbUploadPartial{
+			UserId:        userId,
+			Key:           key,
+			ContentType:   contentType,
+			UploadName:    filename,
+			TotalBytes:    totalBytes,
+			ReceivedBytes: 0,
+			Location:      filepath.Join(partialUploadsDir, fileId),
+			ExpiresTs:     util.NowMillis() + ctx.Config.Uploads.IdempotencySeconds*1000,
+		}
+		if err = db.Upsert(record); err != nil {
+			return nil, err
+		}
+	} else if record == nil {
+		return nil, common.ErrPartialUploadNotFound
+	} else if record.ReceivedBytes != offset || record.TotalBytes != totalBytes {
+		return record, common.ErrPartialUploadOffset
+	}
+
+	f, err := os.OpenFile(record.Location, os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if _, err = f.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	written, copyErr := io.Copy(f, io.LimitReader(body, totalBytes-offset))
+	if err = f.Sync(); err != nil && copyErr == nil {
+		copyErr = err
+	}
+	record.ReceivedBytes = offset + written
+	if err = db.UpdateReceived(userId, key, record.ReceivedBytes); err != nil {
+		return nil, err
+	}
+	if copyErr != nil {
+		return record, copyErr
+	}
+	return record, nil
+}
+
+// checkPartialUploadLimits returns common.ErrPartialUploadLimit if starting a partial upload of totalBytes would take
+// the user over their limits. The user's existing partial upload for the key, if any, is being replaced and so
+// isn't counted.
+func checkPartialUploadLimits(ctx rcontext.RequestContext, userId string, key string, totalBytes int64) error {
+	maxCount := ctx.Config.Uploads.MaxPartialUploads
+	maxBytes := ctx.Config.Uploads.MaxPartialBytes
+	if maxCount <= 0 && maxBytes <= 0 {
+		return nil
+	}
+	count, usedBytes, err := database.GetInstance().UploadPartials.Prepare(ctx).GetUsage(userId, key)
+	if err != nil {
+		return err
+	}
+	if maxCount > 0 && count >= maxCount {
+		return fmt.Errorf("%w: %d of %d already in progress", common.ErrPartialUploadLimit, count, maxCount)
+	}
+	if maxBytes > 0 && usedBytes+totalBytes > maxBytes {
+		return fmt.Errorf("%w: %d bytes already in progress, limit is %d", common.ErrPartialUploadLimit, usedBytes, maxBytes)
+	}
+	return nil
+}
+
+// OpenPartialUpload opens the received bytes of a partial upload for reading.
+func OpenPartialUpload(record *database.DbUploadPartial) (io.ReadCloser, error) {
+	return os.Open(record.Location)
+}
+
+// DeletePartialUpload removes the partial upload and its received bytes.
+func DeletePartialUpload(ctx rcontext.RequestContext, record *database.DbUploadPartial) error {
+	if err := os.Remove(record.Location); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return database.GetInstance().UploadPartials.Prepare(ctx).Delete(record.UserId, record.Key)
+}
+
+// PurgeStalePartialFiles removes partially received uploads from the local disk which haven't been written to
+// since the given time. This catches files whose database records were cleaned up by another instance.
+func PurgeStalePartialFiles(before time.Time) error {
+	entries, err := os.ReadDir(partialUploadsDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		if info.ModTime().Before(before) {
+			if err = os.Remove(filepath.Join(partialUploadsDir, entry.Name())); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+package upload
+
+import (
+	"io"
+
+	"github.com/ryanuber/go-glob"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/metadata_stripping"
+)
+
+// StripMetadata removes identifying metadata from the upload if the server is configured to, or if the user has
+// asked for it through their preferences. Users can't opt out of the server's own stripping.
+func StripMetadata(ctx rcontext.RequestContext, r io.ReadCloser, contentType string, userId string, userRequested bool) io.ReadCloser {
+	if !metadata_stripping.IsSupported(contentType) {
+		return r
+	}
+	if config.Runtime.IsImportProcess || IsReplica(ctx) {
+		return r // imported and replicated media should be stored exactly as it was on the source server
+	}
+	if userRequested {
+		return metadata_stripping.Strip(r, contentType)
+	}
+	if !ctx.Config.Uploads.StripMetadata.Enabled {
+		return r
+	}
+	for _, pattern := range ctx.Config.Uploads.StripMetadata.ExemptUsers {
+		if glob.Glob(pattern, userId) {
+			ctx.Log.Debug("User is exempt from metadata stripping")
+			return r
+		}
+	}
+	return metadata_stripping.Strip(r, contentType)
+}
@@ -0,0 +1,21 @@
+package upload
+
+import (
+	"context"
+
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+)
+
+type requiresAuthFlagKey struct{}
+
+// FlagRequiresAuth returns a context in which uploads are only downloadable through authenticated media endpoints,
+// as though `freezeUnauthenticatedMedia` were enabled for them.
+func FlagRequiresAuth(ctx rcontext.RequestContext) rcontext.RequestContext {
+	ctx.Context = context.WithValue(ctx.Context, requiresAuthFlagKey{}, true)
+	return ctx
+}
+
+func isFlaggedRequiresAuth(ctx rcontext.RequestContext) bool {
+	flagged, _ := ctx.Context.Value(requiresAuthFlagKey{}).(bool)
+	return flagged
+}
@@ -24,7 +24,7 @@ func UploadImage(ctx rcontext.RequestContext, image *m.PreviewImage, onHost stri
 	mediaChan := make(chan *database.DbMedia)
 	defer close(mediaChan)
 	go func() {
-		media, err := pipeline_upload.Execute(ctx, onHost, "", io.NopCloser(tee), image.ContentType, image.Filename, userId, datastores.LocalMediaKind)
+		media, err := pipeline_upload.Execute(ctx, onHost, "", io.NopCloser(tee), image.ContentType, image.Filename, userId, datastores.LocalMediaKind, nil)
 		if err != nil {
 			_ = pw.CloseWithError(err)
 		} else {
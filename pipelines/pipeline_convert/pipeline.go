@@ -0,0 +1,119 @@
+package pipeline_convert
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/t2bot/go-leaky-bucket"
+	sfstreams "github.com/t2bot/go-singleflight-streams"
+	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/limits"
+	"github.com/t2bot/matrix-media-repo/pipelines/_steps/download"
+	"github.com/t2bot/matrix-media-repo/pipelines/_steps/thumbnails"
+	"github.com/t2bot/matrix-media-repo/pipelines/pipeline_download"
+	"github.com/t2bot/matrix-media-repo/thumbnailing"
+	"github.com/t2bot/matrix-media-repo/util"
+	"github.com/t2bot/matrix-media-repo/util/readers"
+)
+
+var streamSf = new(sfstreams.Group)
+
+func init() {
+	streamSf.UseSeekers = true
+}
+
+// ErrAlreadyInFormat is returned when the media doesn't need converting. The original should be served instead.
+var ErrAlreadyInFormat = errors.New("media is already in the requested format")
+
+// ConvertOpts are options for converting media to another format
+type ConvertOpts struct {
+	pipeline_download.DownloadOpts
+	Format string
+}
+
+func (o ConvertOpts) String() string {
+	return fmt.Sprintf("%s,f=%s", o.DownloadOpts.String(), o.Format)
+}
+
+func Execute(ctx rcontext.RequestContext, origin string, mediaId string, opts ConvertOpts) (*database.DbThumbnail, io.ReadCloser, error) {
+	// Step 1: Get the media record, which also checks restrictions
+	recordOpts := opts.DownloadOpts
+	recordOpts.RecordOnly = true
+	mediaRecord, dr, err := pipeline_download.Execute(ctx, origin, mediaId, recordOpts)
+	if dr != nil {
+		// Shouldn't be returned, but just in case...
+		dr.Close()
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if mediaRecord == nil {
+		return nil, nil, common.ErrMediaNotFound
+	}
+	if util.FixContentType(mediaRecord.ContentType) == thumbnailing.ConversionContentType(opts.Format) {
+		return nil, nil, ErrAlreadyInFormat
+	}
+
+	// Step 2: Check rate limits if we already have the conversion
+	record, err := thumbnails.GetConversion(ctx, origin, mediaId, opts.Format)
+	if err != nil {
+		return nil, nil, err
+	}
+	limitBucket, err := limits.GetBucket(ctx, limits.GetRequestIP(ctx.Request))
+	if err != nil {
+		return nil, nil, err
+	}
+	if limitBucket != nil && record != nil {
+		if limitErr := limitBucket.Add(record.SizeBytes); limitErr != nil {
+			if errors.Is(limitErr, leaky.ErrBucketFull) {
+				ctx.Log.Debugf("Rate limited on SizeBytes=%d/%d", record.SizeBytes, limitBucket.Remaining())
+				return nil, nil, common.ErrRateLimitExceeded
+			}
+			return nil, nil, limitErr
+		}
+	}
+
+	// Step 3: Make our context a timeout context
+	var cancel context.CancelFunc
+	//goland:noinspection GoVetLostCancel - we handle the function in our custom cancelCloser struct
+	ctx.Context, cancel = context.WithTimeout(ctx.Context, opts.BlockForReadUntil)
+
+	// Step 4: Join the singleflight queue to convert the media (or open the existing conversion)
+	sfKey := fmt.Sprintf("%s/%s?%s", origin, mediaId, opts.String())
+	r, err, _ := streamSf.Do(sfKey, func() (io.ReadCloser, error) {
+		if record != nil {
+			if opts.CanRedirect {
+				return download.OpenOrRedirect(ctx, record.Locatable)
+			}
+			return download.OpenStream(ctx, record.Locatable)
+		}
+		if config.Get().Deployment.IsDownloadsOnly() {
+			return nil, common.ErrReadOnlyInstance // the write tier stores conversions
+		}
+		var convStream io.ReadCloser
+		record, convStream, err = thumbnails.Convert(ctx, mediaRecord, opts.Format)
+		return convStream, err
+	})
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+	if record == nil {
+		// Another request converted the media for us
+		record, err = thumbnails.GetConversion(ctx, origin, mediaId, opts.Format)
+		if err == nil && record == nil {
+			err = errors.New("unexpected error: no viable record and no error condition")
+		}
+		if err != nil {
+			r.Close()
+			cancel()
+			return nil, nil, err
+		}
+	}
+	return record, readers.NewCancelCloser(r, cancel), nil
+}
@@ -1,8 +1,10 @@
 package pipeline_create
 
 import (
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/t2bot/matrix-media-repo/common/rcontext"
 	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/metrics"
 	"github.com/t2bot/matrix-media-repo/pipelines/_steps/quota"
 	"github.com/t2bot/matrix-media-repo/pipelines/_steps/upload"
 	"github.com/t2bot/matrix-media-repo/util"
@@ -10,7 +12,8 @@ import (
 
 const DefaultExpirationTime = 0
 
-func Execute(ctx rcontext.RequestContext, origin string, userId string, expirationTime int64) (*database.DbExpiringMedia, error) {
+// Execute Media ID creation. The media will be referenced by each of the roomIds once uploaded.
+func Execute(ctx rcontext.RequestContext, origin string, userId string, expirationTime int64, roomIds []string) (*database.DbExpiringMedia, error) {
 	// Step 1: Check quota
 	if err := quota.Check(ctx, userId, quota.MaxPending); err != nil {
 		return nil, err
@@ -27,9 +30,13 @@ func Execute(ctx rcontext.RequestContext, origin string, userId string, expirati
 		expirationTime = ctx.Config.Uploads.MaxAgeSeconds * 1000
 	}
 	expiresTs := util.NowMillis() + expirationTime
-	if err = database.GetInstance().ExpiringMedia.Prepare(ctx).Insert(origin, mediaId, userId, expiresTs); err != nil {
+	if roomIds == nil {
+		roomIds = make([]string, 0)
+	}
+	if err = database.GetInstance().ExpiringMedia.Prepare(ctx).Insert(origin, mediaId, userId, expiresTs, roomIds); err != nil {
 		return nil, err
 	}
+	metrics.AsyncMediaCreated.With(prometheus.Labels{"origin": origin}).Inc()
 
 	// Step 4: Return database record
 	return &database.DbExpiringMedia{
@@ -37,5 +44,7 @@ func Execute(ctx rcontext.RequestContext, origin string, userId string, expirati
 		MediaId:   mediaId,
 		UserId:    userId,
 		ExpiresTs: expiresTs,
+		RoomIds:   roomIds,
+		CreatedTs: util.NowMillis(),
 	}, nil
 }
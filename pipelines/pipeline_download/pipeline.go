@@ -11,6 +11,7 @@ import (
 	"github.com/t2bot/go-leaky-bucket"
 	"github.com/t2bot/go-singleflight-streams"
 	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/config"
 	"github.com/t2bot/matrix-media-repo/common/rcontext"
 	"github.com/t2bot/matrix-media-repo/database"
 	"github.com/t2bot/matrix-media-repo/limits"
@@ -36,6 +37,7 @@ type DownloadOpts struct {
 	RecordOnly          bool
 	CanRedirect         bool
 	AuthProvided        bool
+	Requester           *restrictions.Requester // nil skips room access checks, for internal callers
 }
 
 func (o DownloadOpts) String() string {
@@ -44,10 +46,8 @@ func (o DownloadOpts) String() string {
 
 func Execute(ctx rcontext.RequestContext, origin string, mediaId string, opts DownloadOpts) (*database.DbMedia, io.ReadCloser, error) {
 	// Step 0: Check restrictions
-	if requiresAuth, err := restrictions.DoesMediaRequireAuth(ctx, origin, mediaId); err != nil {
+	if err := runStages(&State{Ctx: ctx, Origin: origin, MediaId: mediaId, Opts: opts}, PhaseAuthorize, nil); err != nil {
 		return nil, nil, err
-	} else if requiresAuth && !opts.AuthProvided {
-		return nil, nil, common.ErrRestrictedAuth
 	}
 
 	// Step 1: Make our context a timeout context
@@ -58,7 +58,7 @@ func Execute(ctx rcontext.RequestContext, origin string, mediaId string, opts Do
 	// Step 2: Join the singleflight queue for stream and DB record
 	sfKey := fmt.Sprintf("%s/%s?%s", origin, mediaId, opts.String())
 	fetchRecordFn := func() (*database.DbMedia, error) {
-		mediaDb := database.GetInstance().Media.Prepare(ctx)
+		mediaDb := database.GetInstance().Media.PrepareRead(ctx)
 		record, err := mediaDb.GetById(origin, mediaId)
 		if err != nil {
 			return nil, err
@@ -119,21 +119,24 @@ func Execute(ctx rcontext.RequestContext, origin string, mediaId string, opts Do
 			if opts.RecordOnly {
 				return nil, nil
 			}
-			if opts.CanRedirect {
-				return download.OpenOrRedirect(ctx, record.Locatable)
-			} else {
-				return download.OpenStream(ctx, record.Locatable)
-			}
+			state := &State{Ctx: ctx, Origin: origin, MediaId: mediaId, Opts: opts, Record: record}
+			err := runStages(state, PhaseOpen, func() bool { return state.Stream != nil })
+			return state.Stream, err
 		}
 
-		// Step 4: Media record unknown - download it (if possible)
-		if !opts.FetchRemoteIfNeeded {
-			return nil, common.ErrMediaNotFound
+		// Step 4: Media record unknown - fetch it from its external URL if it's ours, or download it (if possible).
+		// Download instances can't store what they fetch, so leave that to the write tier.
+		if config.Get().Deployment.IsDownloadsOnly() {
+			return nil, common.ErrReadOnlyInstance
 		}
-		record, r, err := download.TryDownload(ctx, origin, mediaId)
-		if err != nil {
+		state := &State{Ctx: ctx, Origin: origin, MediaId: mediaId, Opts: opts}
+		if err := runStages(state, PhaseFetch, func() bool { return state.Record != nil }); err != nil {
 			return nil, err
 		}
+		if state.Record == nil {
+			return nil, common.ErrMediaNotFound
+		}
+		record, r := state.Record, state.Stream
 		recordSf.OverwriteCacheKey(sfKey, record)
 		if record.Quarantined {
 			return quarantine.ReturnAppropriateThing(ctx, true, opts.RecordOnly, 512, 512)
@@ -197,5 +200,15 @@ func Execute(ctx rcontext.RequestContext, origin string, mediaId string, opts Do
 		cancel()
 		return record, nil, nil
 	}
-	return record, readers.NewCancelCloser(r, cancel), nil
+
+	// Step 6: Apply any transforms for this requester
+	state := &State{Ctx: ctx, Origin: origin, MediaId: mediaId, Opts: opts, Record: record, Stream: r}
+	if err = runStages(state, PhaseTransform, nil); err != nil {
+		cancel()
+		if state.Stream != nil {
+			state.Stream.Close()
+		}
+		return nil, nil, err
+	}
+	return record, readers.NewCancelCloser(state.Stream, cancel), nil
 }
@@ -0,0 +1,114 @@
+package pipeline_download
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/metrics"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+// Phase is the point in the download at which a Stage runs. Stages run in registration order within a phase.
+type Phase int
+
+const (
+	// PhaseAuthorize stages run before anything is looked up, and reject requesters which may not see the media.
+	PhaseAuthorize Phase = iota
+	// PhaseOpen stages open a stream for a known media record. The first stage to set State.Stream wins.
+	PhaseOpen
+	// PhaseFetch stages find media which doesn't have a record yet, such as remote media. The first stage to set
+	// State.Record (and State.Stream) wins.
+	PhaseFetch
+	// PhaseTransform stages may replace State.Stream before it is returned. Unlike the other phases, these run once
+	// per requester rather than once per concurrent group of requests for the same media.
+	PhaseTransform
+)
+
+// State is shared between the stages of a single download.
+type State struct {
+	Ctx     rcontext.RequestContext
+	Origin  string
+	MediaId string
+	Opts    DownloadOpts
+
+	Record *database.DbMedia
+	Stream io.ReadCloser
+}
+
+// Stage is a single step of the download pipeline.
+type Stage struct {
+	Name  string
+	Phase Phase
+	// Required stages run even if they are listed in `downloads.disabledStages`.
+	Required bool
+	// Applies reports whether the stage should run for the download. If nil, the stage always runs.
+	Applies func(s *State) bool
+	Run     func(s *State) error
+}
+
+var stagesLock = &sync.RWMutex{}
+
+// RegisterStage adds the stage to the end of its phase. Panics if a stage with the same name already exists.
+func RegisterStage(stage *Stage) {
+	stagesLock.Lock()
+	defer stagesLock.Unlock()
+	for _, s := range stages {
+		if s.Name == stage.Name {
+			panic("download stage already registered: " + stage.Name)
+		}
+	}
+	stages = append(stages, stage)
+}
+
+// StageNames returns the names of all registered stages, in the order they run.
+func StageNames() []string {
+	stagesLock.RLock()
+	defer stagesLock.RUnlock()
+	names := make([]string, 0, len(stages))
+	for phase := PhaseAuthorize; phase <= PhaseTransform; phase++ {
+		for _, s := range stages {
+			if s.Phase == phase {
+				names = append(names, s.Name)
+			}
+		}
+	}
+	return names
+}
+
+// runStages runs the phase's stages, stopping early once done reports true.
+func runStages(state *State, phase Phase, done func() bool) error {
+	stagesLock.RLock()
+	phaseStages := make([]*Stage, 0)
+	for _, s := range stages {
+		if s.Phase == phase {
+			phaseStages = append(phaseStages, s)
+		}
+	}
+	stagesLock.RUnlock()
+
+	disabled := state.Ctx.Config.Downloads.DisabledStages
+	for _, s := range phaseStages {
+		if done != nil && done() {
+			return nil
+		}
+		if !s.Required && util.ArrayContains(disabled, s.Name) {
+			continue
+		}
+		if s.Applies != nil && !s.Applies(state) {
+			continue
+		}
+
+		start := time.Now()
+		err := s.Run(state)
+		metrics.DownloadStageTime.With(prometheus.Labels{"stage": s.Name}).Observe(time.Since(start).Seconds())
+		if err != nil {
+			metrics.DownloadStageErrors.With(prometheus.Labels{"stage": s.Name}).Inc()
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package pipeline_download
+
+import (
+	"context"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/pipelines/_steps/download"
+	"github.com/t2bot/matrix-media-repo/restrictions"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+// stages are the registered download stages. The built-in stages come first.
+var stages = []*Stage{
+	// Authorize: media which requires auth, and media restricted to room members
+	{
+		Name:     "require_auth",
+		Phase:    PhaseAuthorize,
+		Required: true,
+		Applies: func(s *State) bool {
+			return !s.Opts.AuthProvided
+		},
+		Run: func(s *State) error {
+			if requiresAuth, err := restrictions.DoesMediaRequireAuth(s.Ctx, s.Origin, s.MediaId); err != nil || !requiresAuth {
+				return err
+			}
+			// Media in public rooms (or shared with a gallery link) stays available to anonymous clients
+			if allowed, err := restrictions.CanAccessWithoutAuth(s.Ctx, s.Origin, s.MediaId, s.Opts.Requester); err != nil {
+				return err
+			} else if !allowed {
+				return common.ErrRestrictedAuth
+			}
+			return nil
+		},
+	},
+	{
+		Name:     "room_access",
+		Phase:    PhaseAuthorize,
+		Required: true,
+		Applies: func(s *State) bool {
+			return s.Opts.Requester != nil
+		},
+		Run: func(s *State) error {
+			return restrictions.CheckRoomAccess(s.Ctx, s.Origin, s.MediaId, *s.Opts.Requester)
+		},
+	},
+
+	// Open: serve emoji from memory where possible, otherwise from the datastore
+	{
+		Name:  "emoji_cache",
+		Phase: PhaseOpen,
+		Run: func(s *State) error {
+			if emoji, err := download.OpenEmoji(s.Ctx, s.Record); err != nil {
+				s.Ctx.Log.Warn("Non-fatal error reading emoji from memory cache: ", err)
+				sentry.CaptureException(err)
+			} else if emoji != nil {
+				s.Stream = emoji
+			}
+			return nil
+		},
+	},
+	{
+		Name:     "datastore",
+		Phase:    PhaseOpen,
+		Required: true,
+		Run: func(s *State) error {
+			// The stream outlives the wait for the media, and may be shared by several requests, so it only stops
+			// once closed by every reader rather than when the first request's context ends.
+			ctx := s.Ctx
+			ctx.Context = context.WithoutCancel(s.Ctx.Context)
+			var err error
+			if s.Opts.CanRedirect {
+				s.Stream, err = download.OpenOrRedirect(ctx, s.Record.Locatable)
+			} else {
+				s.Stream, err = download.OpenStream(ctx, s.Record.Locatable)
+			}
+			return err
+		},
+	},
+
+	// Fetch: local media from its external URL, or remote media from its origin
+	{
+		Name:  "external",
+		Phase: PhaseFetch,
+		Applies: func(s *State) bool {
+			return util.IsServerOurs(s.Origin)
+		},
+		Run: func(s *State) error {
+			var err error
+			s.Record, s.Stream, err = download.TryExternal(s.Ctx, s.Origin, s.MediaId)
+			return err
+		},
+	},
+	{
+		Name:  "federation",
+		Phase: PhaseFetch,
+		Applies: func(s *State) bool {
+			return !util.IsServerOurs(s.Origin) && s.Opts.FetchRemoteIfNeeded
+		},
+		Run: func(s *State) error {
+			var err error
+			s.Record, s.Stream, err = download.TryDownload(s.Ctx, s.Origin, s.MediaId)
+			return err
+		},
+	},
+}
@@ -10,6 +10,7 @@ import (
 	"github.com/t2bot/go-leaky-bucket"
 	sfstreams "github.com/t2bot/go-singleflight-streams"
 	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/config"
 	"github.com/t2bot/matrix-media-repo/common/rcontext"
 	"github.com/t2bot/matrix-media-repo/database"
 	"github.com/t2bot/matrix-media-repo/limits"
@@ -36,10 +37,11 @@ type ThumbnailOpts struct {
 	Height   int
 	Method   string
 	Animated bool
+	Format   string
 }
 
 func (o ThumbnailOpts) String() string {
-	return fmt.Sprintf("%s,w=%d,h=%d,m=%s,a=%t", o.DownloadOpts.String(), o.Width, o.Height, o.Method, o.Animated)
+	return fmt.Sprintf("%s,w=%d,h=%d,m=%s,a=%t,f=%s", o.DownloadOpts.String(), o.Width, o.Height, o.Method, o.Animated, o.Format)
 }
 
 func (o ThumbnailOpts) ImpliedDownloadOpts() pipeline_download.DownloadOpts {
@@ -48,6 +50,7 @@ func (o ThumbnailOpts) ImpliedDownloadOpts() pipeline_download.DownloadOpts {
 		BlockForReadUntil:   o.BlockForReadUntil,
 		RecordOnly:          true,
 		AuthProvided:        o.AuthProvided,
+		// Requester is left nil: room access has already been checked by the thumbnail pipeline
 	}
 }
 
@@ -56,7 +59,17 @@ func Execute(ctx rcontext.RequestContext, origin string, mediaId string, opts Th
 	if requiresAuth, err := restrictions.DoesMediaRequireAuth(ctx, origin, mediaId); err != nil {
 		return nil, nil, err
 	} else if requiresAuth && !opts.AuthProvided {
-		return nil, nil, common.ErrRestrictedAuth
+		// Media in public rooms (or shared with a gallery link) stays available to anonymous clients
+		if allowed, err := restrictions.CanAccessWithoutAuth(ctx, origin, mediaId, opts.Requester); err != nil {
+			return nil, nil, err
+		} else if !allowed {
+			return nil, nil, common.ErrRestrictedAuth
+		}
+	}
+	if opts.Requester != nil {
+		if err := restrictions.CheckRoomAccess(ctx, origin, mediaId, *opts.Requester); err != nil {
+			return nil, nil, err
+		}
 	}
 
 	// Step 1: Fix the request parameters
@@ -76,8 +89,8 @@ func Execute(ctx rcontext.RequestContext, origin string, mediaId string, opts Th
 	// Step 3: Join the singleflight queue for stream and DB record
 	sfKey := fmt.Sprintf("%s/%s?%s", origin, mediaId, opts.String())
 	fetchRecordFn := func() (*database.DbThumbnail, error) {
-		thumbDb := database.GetInstance().Thumbnails.Prepare(ctx)
-		return thumbDb.GetByParams(origin, mediaId, opts.Width, opts.Height, opts.Method, opts.Animated)
+		thumbDb := database.GetInstance().Thumbnails.PrepareRead(ctx)
+		return thumbDb.GetByParams(origin, mediaId, opts.Width, opts.Height, opts.Method, opts.Animated, opts.Format)
 	}
 	record, err := recordSf.Do(sfKey, fetchRecordFn)
 	defer recordSf.ForgetCacheKey(sfKey)
@@ -141,8 +154,11 @@ func Execute(ctx rcontext.RequestContext, origin string, mediaId string, opts Th
 			}
 		}
 
-		// Step 6: Generate the thumbnail and return that
-		record, r, err := thumbnails.Generate(ctx, mediaRecord, opts.Width, opts.Height, opts.Method, opts.Animated)
+		// Step 6: Generate the thumbnail and return that. Download instances leave this to the write tier.
+		if config.Get().Deployment.IsDownloadsOnly() {
+			return nil, common.ErrReadOnlyInstance
+		}
+		record, r, err := thumbnails.Generate(ctx, mediaRecord, opts.Width, opts.Height, opts.Method, opts.Animated, opts.Format)
 		if err != nil {
 			if !opts.RecordOnly && errors.Is(err, common.ErrMediaDimensionsTooSmall) {
 				var d io.ReadSeekCloser
@@ -0,0 +1,68 @@
+package pipeline_upload
+
+import (
+	"github.com/getsentry/sentry-go"
+	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/limits"
+	"github.com/t2bot/matrix-media-repo/notifier"
+	"github.com/t2bot/matrix-media-repo/pipelines/_steps/meta"
+	"github.com/t2bot/matrix-media-repo/pipelines/_steps/quota"
+	"github.com/t2bot/matrix-media-repo/pipelines/_steps/upload"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+// ExecuteClone creates a new media record on the origin, owned by userId, which shares the source media's stored
+// object instead of uploading the bytes again. The clone will be referenced by each of the roomIds.
+func ExecuteClone(ctx rcontext.RequestContext, origin string, source *database.DbMedia, userId string, roomIds []string) (*database.DbMedia, error) {
+	// Step 1: Don't spread quarantined media
+	if source.Quarantined {
+		return nil, common.ErrMediaQuarantined
+	}
+	if err := upload.CheckQuarantineStatus(ctx, source.Sha256Hash); err != nil {
+		return nil, err
+	}
+
+	// Step 2: Ensure user can upload within quota and rate limits, as the clone counts against them
+	if err := quota.CanUpload(ctx, userId, source.SizeBytes); err != nil {
+		return nil, err
+	}
+	if err := limits.CheckUpload(ctx, userId, origin, source.SizeBytes); err != nil {
+		return nil, err
+	}
+
+	// Step 3: Create a media ID
+	mediaId, err := upload.GenerateMediaId(ctx, origin)
+	if err != nil {
+		return nil, err
+	}
+
+	// Step 4: Persist the new record, pointing at the same object
+	newRecord := &database.DbMedia{
+		Origin:             origin,
+		MediaId:            mediaId,
+		UploadName:         source.UploadName,
+		OriginalUploadName: source.OriginalUploadName,
+		ContentType:        source.ContentType,
+		UserId:             userId,
+		SizeBytes:          source.SizeBytes,
+		CreationTs:         util.NowMillis(),
+		Quarantined:        false,
+		Locatable: &database.Locatable{
+			Sha256Hash:  source.Sha256Hash,
+			DatastoreId: source.DatastoreId,
+			Location:    source.Location,
+		},
+	}
+	if err = upload.PersistMedia(ctx, newRecord, roomIds); err != nil {
+		return nil, err
+	}
+
+	meta.FlagAccess(ctx, newRecord.Sha256Hash, 0) // upload time is zero here to skip metrics gathering
+	if err = notifier.UploadDone(ctx, newRecord); err != nil {
+		ctx.Log.Warn("Non-fatal error notifying about completed upload: ", err)
+		sentry.CaptureException(err)
+	}
+	return newRecord, nil
+}
@@ -0,0 +1,45 @@
+package pipeline_upload
+
+import (
+	"net/url"
+
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/pipelines/_steps/upload"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+// ExecuteExternal registers a media ID on the origin whose content is fetched from externalUrl the first time it is
+// downloaded. Once fetched, the media is stored as though userId uploaded it, and referenced by each of the roomIds.
+func ExecuteExternal(ctx rcontext.RequestContext, origin string, userId string, externalUrl *url.URL, contentType string, fileName string, roomIds []string) (*database.DbExternalMedia, error) {
+	// Step 1: Ensure we're allowed to fetch from the URL
+	if err := upload.CheckExternalUrl(ctx, externalUrl); err != nil {
+		return nil, err
+	}
+
+	// Step 2: Create a media ID
+	mediaId, err := upload.GenerateMediaId(ctx, origin)
+	if err != nil {
+		return nil, err
+	}
+
+	// Step 3: Record where the media comes from
+	if roomIds == nil {
+		roomIds = make([]string, 0)
+	}
+	record := &database.DbExternalMedia{
+		Origin:      origin,
+		MediaId:     mediaId,
+		UserId:      userId,
+		Url:         externalUrl.String(),
+		ContentType: contentType,
+		UploadName:  fileName,
+		RoomIds:     roomIds,
+		CreationTs:  util.NowMillis(),
+	}
+	if err = database.GetInstance().ExternalMedia.Prepare(ctx).Insert(record); err != nil {
+		return nil, err
+	}
+
+	return record, nil
+}
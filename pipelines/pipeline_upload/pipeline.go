@@ -1,108 +1,111 @@
 package pipeline_upload
 
 import (
-	"errors"
 	"io"
 
 	"github.com/getsentry/sentry-go"
-	"github.com/t2bot/matrix-media-repo/common"
-	"github.com/t2bot/matrix-media-repo/common/config"
 	"github.com/t2bot/matrix-media-repo/common/rcontext"
 	"github.com/t2bot/matrix-media-repo/database"
 	"github.com/t2bot/matrix-media-repo/datastores"
-	"github.com/t2bot/matrix-media-repo/notifier"
-	"github.com/t2bot/matrix-media-repo/pipelines/_steps/meta"
-	"github.com/t2bot/matrix-media-repo/pipelines/_steps/quota"
 	"github.com/t2bot/matrix-media-repo/pipelines/_steps/upload"
-	"github.com/t2bot/matrix-media-repo/restrictions"
+	"github.com/t2bot/matrix-media-repo/preferences"
 	"github.com/t2bot/matrix-media-repo/util"
 	"github.com/t2bot/matrix-media-repo/util/readers"
 )
 
-// Execute Media upload. If mediaId is an empty string, one will be generated.
-func Execute(ctx rcontext.RequestContext, origin string, mediaId string, r io.ReadCloser, contentType string, fileName string, userId string, kind datastores.Kind) (*database.DbMedia, error) {
-	uploadDone := func(record *database.DbMedia) {
-		meta.FlagAccess(ctx, record.Sha256Hash, 0) // upload time is zero here to skip metrics gathering
-		if err := notifier.UploadDone(ctx, record); err != nil {
-			ctx.Log.Warn("Non-fatal error notifying about completed upload: ", err)
-			sentry.CaptureException(err)
-		}
-	}
-
-	// Step 1: Limit the stream's length
-	if kind == datastores.LocalMediaKind {
-		r = upload.LimitStream(ctx, r)
+// Execute Media upload. If mediaId is an empty string, one will be generated. The media will be referenced by
+// each of the roomIds once uploaded.
+//
+// The upload runs through the registered stages (see RegisterStage) in phase order. Stages can be disabled per
+// domain with `uploads.disabledStages`.
+func Execute(ctx rcontext.RequestContext, origin string, mediaId string, r io.ReadCloser, contentType string, fileName string, userId string, kind datastores.Kind, roomIds []string) (*database.DbMedia, error) {
+	state := &State{
+		Ctx:            ctx,
+		Origin:         origin,
+		MediaId:        mediaId,
+		UserId:         userId,
+		ContentType:    contentType,
+		FileName:       fileName,
+		Kind:           kind,
+		RoomIds:        roomIds,
+		Reader:         r,
+		Preferences:    preferences.Default(),
+		mustUseMediaId: true,
+	}
+
+	// Step 0: Clean up the filename, keeping the original if it changed
+	if sanitized := util.SanitizeUploadName(fileName); sanitized != fileName {
+		state.OriginalFileName = fileName
+		state.FileName = sanitized
+	}
+
+	// Step 1: Prepare the stream
+	if err := runStages(state, PhasePrepare); err != nil {
+		return nil, err
 	}
 
 	// Step 2: Create a media ID (if needed)
-	mustUseMediaId := true
-	if mediaId == "" {
+	if state.MediaId == "" {
 		var err error
-		mediaId, err = upload.GenerateMediaId(ctx, origin)
+		state.MediaId, err = upload.GenerateMediaId(ctx, origin)
 		if err != nil {
 			return nil, err
 		}
-		mustUseMediaId = false
+		state.mustUseMediaId = false
 	}
 
-	// Step 3: Pick a datastore
+	// Step 3: Pick a datastore, making sure the disks have room for the upload
+	if err := datastores.CheckDiskSpace(ctx, kind); err != nil {
+		return nil, err
+	}
 	dsConf, err := datastores.Pick(ctx, kind)
 	if err != nil {
 		return nil, err
 	}
-
-	// Step 4: Buffer to the datastore's temporary path, and check for spam
-	spamR, spamW := io.Pipe()
-	spamTee := io.TeeReader(r, spamW)
-	spamChan := upload.CheckSpamAsync(ctx, spamR, upload.FileMetadata{
-		Name:        fileName,
-		ContentType: contentType,
-		UserId:      userId,
-		Origin:      origin,
-		MediaId:     mediaId,
-	})
-	sha256hash, sizeBytes, reader, err := datastores.BufferTemp(dsConf, readers.NewCancelCloser(io.NopCloser(spamTee), func() {
-		r.Close()
+	state.datastore = dsConf
+
+	// Step 4: Buffer to the datastore's temporary path, feeding the scanners along the way
+	scanStages := stagesFor(state, PhaseScan)
+	scanWriters := make([]*io.PipeWriter, 0, len(scanStages))
+	teeTargets := make([]io.Writer, 0, len(scanStages))
+	scanResults := make([]func() error, 0, len(scanStages))
+	for _, s := range scanStages {
+		scanR, scanW := io.Pipe()
+		scanWriters = append(scanWriters, scanW)
+		teeTargets = append(teeTargets, scanW)
+		scanResults = append(scanResults, s.Scan(state, scanR))
+	}
+	input := state.Reader
+	sha256hash, sizeBytes, reader, err := datastores.BufferTemp(dsConf, readers.NewCancelCloser(io.NopCloser(io.TeeReader(input, io.MultiWriter(teeTargets...))), func() {
+		input.Close()
 	}))
 	if err != nil {
+		for _, w := range scanWriters {
+			_ = w.CloseWithError(err)
+		}
 		return nil, err
 	}
-	if err = spamW.Close(); err != nil {
-		ctx.Log.Warn("Failed to close writer for spam checker: ", err)
-		spamChan <- upload.SpamResponse{Err: errors.New("failed to close")}
+	for _, w := range scanWriters {
+		if err = w.Close(); err != nil {
+			ctx.Log.Warn("Failed to close writer for upload scanner: ", err)
+		}
 	}
 	defer reader.Close()
-	spam := <-spamChan
-	if spam.Err != nil {
-		return nil, err
-	}
-	if spam.IsSpam {
-		return nil, common.ErrMediaQuarantined
+	state.Sha256Hash = sha256hash
+	state.SizeBytes = sizeBytes
+	state.buffer = reader
+	for _, result := range scanResults {
+		if err = result(); err != nil {
+			return nil, err
+		}
 	}
 
-	// Step 5: Split the buffer to populate cache later
-	cacheR, cacheW := io.Pipe()
-	allWriters := io.MultiWriter(cacheW)
-	tee := io.TeeReader(reader, allWriters)
-
-	defer func(cacheW *io.PipeWriter, err error) {
-		_ = cacheW.CloseWithError(err)
-	}(cacheW, errors.New("failed to finish write"))
-
-	// Step 6: Check quarantine
-	if err = upload.CheckQuarantineStatus(ctx, sha256hash); err != nil {
+	// Step 5: Check the buffered upload can be accepted
+	if err = runStages(state, PhaseCheck); err != nil {
 		return nil, err
 	}
 
-	// Step 7: Ensure user can upload within quota
-	if userId != "" && !config.Runtime.IsImportProcess {
-		err = quota.CanUpload(ctx, userId, sizeBytes)
-		if err != nil {
-			return nil, err
-		}
-	}
-
-	// Step 8: Acquire a lock on the media hash for uploading
+	// Step 6: Acquire a lock on the media hash for uploading
 	unlockFn, err := upload.LockForUpload(ctx, sha256hash)
 	if err != nil {
 		return nil, err
@@ -110,80 +113,36 @@ func Execute(ctx rcontext.RequestContext, origin string, mediaId string, r io.Re
 	//goland:noinspection GoUnhandledErrorResult
 	defer unlockFn()
 
-	// Step 9: Pull all upload records (to check if an upload has already happened)
-	newRecord := &database.DbMedia{
-		Origin:      origin,
-		MediaId:     mediaId,
-		UploadName:  fileName,
-		ContentType: contentType,
-		UserId:      userId,
-		SizeBytes:   sizeBytes,
-		CreationTs:  util.NowMillis(),
-		Quarantined: false,
+	// Step 7: Store the media
+	state.Record = &database.DbMedia{
+		Origin:             origin,
+		MediaId:            state.MediaId,
+		UploadName:         state.FileName,
+		OriginalUploadName: state.OriginalFileName,
+		ContentType:        contentType,
+		UserId:             userId,
+		SizeBytes:          sizeBytes,
+		CreationTs:         util.NowMillis(),
+		Quarantined:        state.Quarantine,
 		Locatable: &database.Locatable{
 			Sha256Hash:  sha256hash,
 			DatastoreId: "", // Populated later
 			Location:    "", // Populated later
 		},
 	}
-	record, perfect, err := upload.FindRecord(ctx, sha256hash, userId, contentType, fileName)
-	if err != nil {
+	if err = runStages(state, PhaseStore); err != nil {
 		return nil, err
 	}
-	if record != nil {
-		// We already had this record in some capacity
-		if perfect && !mustUseMediaId {
-			// Exact match - deduplicate, skip upload to datastore
-			return record, nil
-		} else {
-			// We already uploaded it somewhere else - use the datastore ID and location
-			newRecord.Quarantined = record.Quarantined // just in case (shouldn't be a different value by here)
-			newRecord.DatastoreId = record.DatastoreId
-			newRecord.Location = record.Location
-			if err = database.GetInstance().Media.Prepare(ctx).Insert(newRecord); err != nil {
-				return nil, err
-			}
-			if config.Get().General.FreezeUnauthenticatedMedia {
-				if err = restrictions.SetMediaRequiresAuth(ctx, newRecord.Origin, newRecord.MediaId); err != nil {
-					return nil, err
-				}
-			}
-			uploadDone(newRecord)
-			return newRecord, nil
-		}
+	if state.Deduplicated {
+		return state.Record, nil
 	}
 
-	// Step 11: Asynchronously upload to cache
-	cacheChan := upload.PopulateCacheAsync(ctx, cacheR, sizeBytes, sha256hash)
-
-	// Step 12: Since we didn't find a duplicate, upload it to the datastore
-	dsLocation, err := datastores.Upload(ctx, dsConf, io.NopCloser(tee), sizeBytes, contentType, sha256hash)
-	if err != nil {
-		return nil, err
-	}
-	if err = cacheW.Close(); err != nil {
-		ctx.Log.Warn("Failed to close writer for cache layer: ", err)
-		close(cacheChan)
-	}
-
-	// Step 13: Wait for channels
-	<-cacheChan
-
-	// Step 14: Everything finally looks good - return some stuff
-	newRecord.DatastoreId = dsConf.Id
-	newRecord.Location = dsLocation
-	if err = database.GetInstance().Media.Prepare(ctx).Insert(newRecord); err != nil {
-		if err2 := datastores.Remove(ctx, dsConf, dsLocation); err2 != nil {
-			sentry.CaptureException(err2)
-			ctx.Log.Warn("Error deleting upload (delete attempted due to persistence error): ", err2)
-		}
-		return nil, err
-	}
-	if config.Get().General.FreezeUnauthenticatedMedia {
-		if err = restrictions.SetMediaRequiresAuth(ctx, newRecord.Origin, newRecord.MediaId); err != nil {
-			return nil, err
+	// Step 8: Everything finally looks good - finish up and return the record
+	for _, s := range stagesFor(state, PhaseComplete) {
+		if err = s.Run(state); err != nil {
+			ctx.Log.Warnf("Non-fatal error in upload stage %s: %v", s.Name, err)
+			sentry.CaptureException(err)
 		}
 	}
-	uploadDone(newRecord)
-	return newRecord, nil
+	return state.Record, nil
 }
@@ -4,13 +4,16 @@ import (
 	"io"
 
 	"github.com/getsentry/sentry-go"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/t2bot/matrix-media-repo/common"
 	"github.com/t2bot/matrix-media-repo/common/rcontext"
 	"github.com/t2bot/matrix-media-repo/database"
 	"github.com/t2bot/matrix-media-repo/datastores"
+	"github.com/t2bot/matrix-media-repo/metrics"
+	"github.com/t2bot/matrix-media-repo/util"
 )
 
-func ExecutePut(ctx rcontext.RequestContext, origin string, mediaId string, r io.ReadCloser, contentType string, fileName string, userId string) (*database.DbMedia, error) {
+func ExecutePut(ctx rcontext.RequestContext, origin string, mediaId string, r io.ReadCloser, contentType string, fileName string, userId string, roomIds []string) (*database.DbMedia, error) {
 	// Step 1: Do we already have a media record for this?
 	mediaDb := database.GetInstance().Media.Prepare(ctx)
 	mediaRecord, err := mediaDb.GetById(origin, mediaId)
@@ -38,12 +41,21 @@ func ExecutePut(ctx rcontext.RequestContext, origin string, mediaId string, r io
 		return nil, common.ErrWrongUser
 	}
 
-	// Step 5: Do the upload
-	newRecord, err := Execute(ctx, origin, mediaId, r, contentType, fileName, userId, datastores.LocalMediaKind)
+	// Step 5: Do the upload, referencing the rooms from both the creation and upload requests
+	for _, roomId := range roomIds {
+		if !util.ArrayContains(record.RoomIds, roomId) {
+			record.RoomIds = append(record.RoomIds, roomId)
+		}
+	}
+	newRecord, err := Execute(ctx, origin, mediaId, r, contentType, fileName, userId, datastores.LocalMediaKind, record.RoomIds)
 	if err != nil {
 		return nil, err
 	}
 
+	if record.CreatedTs > 0 {
+		metrics.AsyncUploadCompleteTime.With(prometheus.Labels{"origin": origin}).Observe(float64(util.NowMillis()-record.CreatedTs) / 1000.0)
+	}
+
 	// Step 6: Delete the holding record
 	if err2 := expiringDb.Delete(origin, mediaId); err2 != nil {
 		ctx.Log.Warn("Non-fatal error while deleting expiring media record: " + err2.Error())
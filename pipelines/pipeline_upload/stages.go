@@ -0,0 +1,144 @@
+package pipeline_upload
+
+import (
+	"io"
+	"sync"
+
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/datastores"
+	"github.com/t2bot/matrix-media-repo/preferences"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+// Phase is the point in the upload at which a Stage runs. Stages run in phase order, and in registration order within
+// a phase.
+type Phase int
+
+const (
+	// PhasePrepare stages run before the upload is buffered, and may replace State.Reader.
+	PhasePrepare Phase = iota
+	// PhaseScan stages observe the upload's bytes while it is buffered.
+	PhaseScan
+	// PhaseCheck stages run once the upload is buffered and its hash and size are known. They may reject the upload.
+	PhaseCheck
+	// PhaseStore stages store the upload, populating State.Record. The upload's hash is locked during this phase.
+	PhaseStore
+	// PhaseComplete stages run after the media is stored. Their errors are logged rather than failing the upload.
+	PhaseComplete
+)
+
+// State is shared between the stages of a single upload.
+type State struct {
+	Ctx              rcontext.RequestContext
+	Origin           string
+	MediaId          string
+	UserId           string
+	ContentType      string
+	FileName         string
+	OriginalFileName string
+	Kind             datastores.Kind
+	RoomIds          []string
+
+	// Reader is the upload's byte stream, before it is buffered.
+	Reader io.ReadCloser
+
+	// Preferences are the uploader's media preferences, or the defaults if they have none.
+	Preferences *preferences.Preferences
+
+	// Sha256Hash and SizeBytes are populated once the upload is buffered.
+	Sha256Hash string
+	SizeBytes  int64
+
+	// Quarantine is set by stages which want the media stored as quarantined rather than rejected.
+	Quarantine bool
+	IsEmoji    bool
+	NsfwScore  *float64
+
+	// Record is the media record being stored. It is populated before the PhaseStore stages run.
+	Record *database.DbMedia
+	// Deduplicated is set when an existing record was reused as-is. The remaining stages are skipped.
+	Deduplicated bool
+
+	mustUseMediaId bool
+	datastore      config.DatastoreConfig
+	buffer         io.Reader
+}
+
+// Stage is a single step of the upload pipeline.
+type Stage struct {
+	Name  string
+	Phase Phase
+	// Required stages run even if they are listed in `uploads.disabledStages`.
+	Required bool
+	// Applies reports whether the stage should run for the upload. If nil, the stage always runs.
+	Applies func(s *State) bool
+	// Run performs the stage. Used by every phase except PhaseScan.
+	Run func(s *State) error
+	// Scan is called for PhaseScan stages before the upload is buffered. The reader must be read to the end. The
+	// returned function is called once buffering has finished, and returns the outcome of the scan.
+	Scan func(s *State, r io.Reader) func() error
+}
+
+var stagesLock = &sync.RWMutex{}
+
+// RegisterStage adds the stage to the end of its phase. Panics if a stage with the same name already exists.
+func RegisterStage(stage *Stage) {
+	stagesLock.Lock()
+	defer stagesLock.Unlock()
+	for _, s := range stages {
+		if s.Name == stage.Name {
+			panic("upload stage already registered: " + stage.Name)
+		}
+	}
+	stages = append(stages, stage)
+}
+
+// StageNames returns the names of all registered stages, in the order they run.
+func StageNames() []string {
+	stagesLock.RLock()
+	defer stagesLock.RUnlock()
+	names := make([]string, 0, len(stages))
+	for phase := PhasePrepare; phase <= PhaseComplete; phase++ {
+		for _, s := range stages {
+			if s.Phase == phase {
+				names = append(names, s.Name)
+			}
+		}
+	}
+	return names
+}
+
+// stagesFor returns the stages of the phase which should run for the upload.
+func stagesFor(state *State, phase Phase) []*Stage {
+	stagesLock.RLock()
+	defer stagesLock.RUnlock()
+	disabled := state.Ctx.Config.Uploads.DisabledStages
+	result := make([]*Stage, 0)
+	for _, s := range stages {
+		if s.Phase != phase {
+			continue
+		}
+		if !s.Required && util.ArrayContains(disabled, s.Name) {
+			continue
+		}
+		if s.Applies != nil && !s.Applies(state) {
+			continue
+		}
+		result = append(result, s)
+	}
+	return result
+}
+
+func runStages(state *State, phase Phase) error {
+	for _, s := range stagesFor(state, phase) {
+		if state.Deduplicated {
+			return nil
+		}
+		if err := s.Run(state); err != nil {
+			return err
+		}
+	}
+	return nil
+}
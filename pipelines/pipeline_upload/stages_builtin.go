@@ -0,0 +1,324 @@
+package pipeline_upload
+
+import (
+	"errors"
+	"io"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/t2bot/matrix-media-repo/antivirus"
+	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/datastores"
+	"github.com/t2bot/matrix-media-repo/hashmatch"
+	"github.com/t2bot/matrix-media-repo/limits"
+	"github.com/t2bot/matrix-media-repo/moderation"
+	"github.com/t2bot/matrix-media-repo/notifier"
+	"github.com/t2bot/matrix-media-repo/nsfw"
+	"github.com/t2bot/matrix-media-repo/pipelines/_steps/meta"
+	"github.com/t2bot/matrix-media-repo/pipelines/_steps/quota"
+	"github.com/t2bot/matrix-media-repo/pipelines/_steps/upload"
+	"github.com/t2bot/matrix-media-repo/preferences"
+)
+
+func isLocal(s *State) bool {
+	return s.Kind == datastores.LocalMediaKind
+}
+
+// stages are the registered upload stages. The built-in stages come first.
+var stages = []*Stage{
+	// Prepare: limit the stream's length, apply the uploader's preferences, and remove identifying metadata (unless
+	// it's an emoji, which is kept exact)
+	{
+		Name:  "size_limit",
+		Phase: PhasePrepare,
+		Applies: func(s *State) bool {
+			return isLocal(s) && !upload.IsReplica(s.Ctx)
+		},
+		Run: func(s *State) error {
+			s.Reader = upload.LimitStream(s.Ctx, s.Reader)
+			return nil
+		},
+	},
+	{
+		Name:    "sniff_emoji",
+		Phase:   PhasePrepare,
+		Applies: isLocal,
+		Run: func(s *State) error {
+			s.Reader, s.IsEmoji = upload.DetectEmoji(s.Ctx, s.Reader, s.ContentType)
+			return nil
+		},
+	},
+	{
+		Name:  "user_preferences",
+		Phase: PhasePrepare,
+		Applies: func(s *State) bool {
+			return isLocal(s) && s.UserId != "" && preferences.IsEnabled() && !config.Runtime.IsImportProcess && !upload.IsReplica(s.Ctx)
+		},
+		Run: func(s *State) error {
+			prefs, err := preferences.Get(s.Ctx, s.UserId)
+			if err != nil {
+				return err
+			}
+			s.Preferences = prefs
+			if prefs.DefaultVisibility == preferences.VisibilityAuthenticated {
+				s.Ctx = upload.FlagRequiresAuth(s.Ctx)
+			}
+			return nil
+		},
+	},
+	{
+		Name:  "compress",
+		Phase: PhasePrepare,
+		Applies: func(s *State) bool {
+			return isLocal(s) && !s.IsEmoji && s.Preferences.AutoCompress
+		},
+		Run: func(s *State) error {
+			var err error
+			s.Reader, err = upload.Compress(s.Ctx, s.Reader, s.ContentType)
+			return err
+		},
+	},
+	{
+		Name:  "strip_metadata",
+		Phase: PhasePrepare,
+		Applies: func(s *State) bool {
+			return isLocal(s) && !s.IsEmoji
+		},
+		Run: func(s *State) error {
+			s.Reader = upload.StripMetadata(s.Ctx, s.Reader, s.ContentType, s.UserId, s.Preferences.StripMetadata)
+			return nil
+		},
+	},
+
+	// Scan: check for spam, viruses, and hash list matches while buffering
+	{
+		Name:  "spam",
+		Phase: PhaseScan,
+		Scan: func(s *State, r io.Reader) func() error {
+			ch := upload.CheckSpamAsync(s.Ctx, r, upload.FileMetadata{
+				Name:        s.FileName,
+				ContentType: s.ContentType,
+				UserId:      s.UserId,
+				Origin:      s.Origin,
+				MediaId:     s.MediaId,
+			})
+			return func() error {
+				res := <-ch
+				if res.Err != nil {
+					return res.Err
+				}
+				if res.IsSpam {
+					return common.ErrMediaQuarantined
+				}
+				return nil
+			}
+		},
+	},
+	{
+		Name:     "antivirus",
+		Phase:    PhaseScan,
+		Required: true,
+		Applies: func(s *State) bool {
+			return antivirus.IsEnabled()
+		},
+		Scan: func(s *State, r io.Reader) func() error {
+			ch := upload.ScanAsync(s.Ctx, r)
+			return func() error {
+				quarantine, err := upload.ApplyScanResult(s.Ctx, s.Sha256Hash, <-ch)
+				s.Quarantine = s.Quarantine || quarantine
+				return err
+			}
+		},
+	},
+	{
+		Name:     "hashmatch",
+		Phase:    PhaseScan,
+		Required: true,
+		Applies: func(s *State) bool {
+			return hashmatch.IsEnabled(s.Kind == datastores.RemoteMediaKind)
+		},
+		Scan: func(s *State, r io.Reader) func() error {
+			ch := upload.ComputeHashesAsync(s.Ctx, r, s.ContentType)
+			return func() error {
+				matched, err := upload.ApplyHashMatch(s.Ctx, s.Origin, s.MediaId, s.UserId, s.Sha256Hash, <-ch)
+				s.Quarantine = s.Quarantine || matched
+				return err
+			}
+		},
+	},
+	{
+		Name:  "nsfw",
+		Phase: PhaseScan,
+		Applies: func(s *State) bool {
+			return nsfw.IsEnabled(s.Kind == datastores.RemoteMediaKind)
+		},
+		Scan: func(s *State, r io.Reader) func() error {
+			ch := upload.ClassifyAsync(s.Ctx, r, s.ContentType)
+			return func() error {
+				res := <-ch
+				s.NsfwScore = res.Score
+				s.Quarantine = upload.ApplyNsfwScore(s.Ctx, res) || s.Quarantine
+				return nil
+			}
+		},
+	},
+
+	// Check: refuse quarantined content, large uploads without an attestation, and ensure the user can upload within
+	// quota and rate limits
+	{
+		Name:     "quarantine",
+		Phase:    PhaseCheck,
+		Required: true,
+		Run: func(s *State) error {
+			return upload.CheckQuarantineStatus(s.Ctx, s.Sha256Hash)
+		},
+	},
+	{
+		Name:     "attestation",
+		Phase:    PhaseCheck,
+		Required: true,
+		Applies: func(s *State) bool {
+			return isLocal(s) && !config.Runtime.IsImportProcess && !upload.IsReplica(s.Ctx)
+		},
+		Run: func(s *State) error {
+			return upload.CheckAttestation(s.Ctx, s.SizeBytes, s.Sha256Hash)
+		},
+	},
+	{
+		Name:     "quota",
+		Phase:    PhaseCheck,
+		Required: true,
+		Applies: func(s *State) bool {
+			return s.UserId != "" && !config.Runtime.IsImportProcess && !upload.IsReplica(s.Ctx)
+		},
+		Run: func(s *State) error {
+			if err := quota.CanUpload(s.Ctx, s.UserId, s.SizeBytes); err != nil {
+				return err
+			}
+			return limits.CheckUpload(s.Ctx, s.UserId, s.Origin, s.SizeBytes)
+		},
+	},
+
+	// Store: reuse existing uploads of the same content where possible, otherwise upload to the datastore
+	{
+		Name:  "dedupe",
+		Phase: PhaseStore,
+		Run: func(s *State) error {
+			record, perfect, err := upload.FindRecord(s.Ctx, s.Sha256Hash, s.UserId, s.ContentType, s.FileName)
+			if err != nil || record == nil {
+				return err
+			}
+			if perfect && !s.mustUseMediaId && !s.Quarantine {
+				// Exact match - deduplicate, skip upload to datastore
+				if err = upload.AddReferences(s.Ctx, record.Origin, record.MediaId, s.RoomIds); err != nil {
+					return err
+				}
+				s.Record = record
+				s.Deduplicated = true
+				return nil
+			}
+			// We already uploaded it somewhere else - use the datastore ID and location
+			s.Record.Quarantined = record.Quarantined || s.Quarantine // just in case (shouldn't be a different value by here)
+			s.Record.DatastoreId = record.DatastoreId
+			s.Record.Location = record.Location
+			return nil
+		},
+	},
+	{
+		Name:     "persist",
+		Phase:    PhaseStore,
+		Required: true,
+		Run: func(s *State) error {
+			if s.Record.Location != "" {
+				return upload.PersistMedia(s.Ctx, s.Record, s.RoomIds)
+			}
+
+			// Split the buffer to populate the cache while uploading to the datastore
+			cacheR, cacheW := io.Pipe()
+			defer func(cacheW *io.PipeWriter, err error) {
+				_ = cacheW.CloseWithError(err)
+			}(cacheW, errors.New("failed to finish write"))
+			tee := io.TeeReader(s.buffer, cacheW)
+			cacheChan := upload.PopulateCacheAsync(s.Ctx, cacheR, s.SizeBytes, s.Sha256Hash)
+
+			// Upload to the datastore, failing over to others if needed
+			dsConf := s.datastore
+			dsLocation, err := datastores.Upload(s.Ctx, dsConf, io.NopCloser(tee), s.SizeBytes, s.ContentType, s.Sha256Hash)
+			if err != nil {
+				_ = cacheW.CloseWithError(err) // the cache only saw part of the upload
+				dsConf, dsLocation, err = upload.FailoverUpload(s.Ctx, s.Kind, dsConf, err, s.buffer, s.SizeBytes, s.ContentType, s.Sha256Hash)
+				if err != nil {
+					return err
+				}
+			}
+			if err = cacheW.Close(); err != nil {
+				s.Ctx.Log.Warn("Failed to close writer for cache layer: ", err)
+				close(cacheChan)
+			}
+			<-cacheChan
+
+			s.Record.DatastoreId = dsConf.Id
+			s.Record.Location = dsLocation
+			if err = upload.PersistMedia(s.Ctx, s.Record, s.RoomIds); err != nil {
+				if err2 := datastores.Remove(s.Ctx, dsConf, dsLocation); err2 != nil {
+					sentry.CaptureException(err2)
+					s.Ctx.Log.Warn("Error deleting upload (delete attempted due to persistence error): ", err2)
+				}
+				return err
+			}
+			return nil
+		},
+	},
+
+	// Complete: record what was learned about the media, and tell interested parties about it
+	{
+		Name:  "mark_emoji",
+		Phase: PhaseComplete,
+		Run: func(s *State) error {
+			if s.Kind == datastores.RemoteMediaKind {
+				s.IsEmoji = upload.LooksLikeEmoji(s.ContentType, s.SizeBytes)
+			}
+			if s.IsEmoji {
+				upload.MarkEmoji(s.Ctx, s.Record.Origin, s.Record.MediaId)
+			}
+			return nil
+		},
+	},
+	{
+		Name:  "nsfw_score",
+		Phase: PhaseComplete,
+		Applies: func(s *State) bool {
+			return s.NsfwScore != nil
+		},
+		Run: func(s *State) error {
+			return database.GetInstance().Media.Prepare(s.Ctx).SetNsfwScore(s.Record.Origin, s.Record.MediaId, *s.NsfwScore)
+		},
+	},
+	{
+		Name:  "flag_access",
+		Phase: PhaseComplete,
+		Run: func(s *State) error {
+			meta.FlagAccess(s.Ctx, s.Record.Sha256Hash, 0) // upload time is zero here to skip metrics gathering
+			return nil
+		},
+	},
+	{
+		Name:  "moderation",
+		Phase: PhaseComplete,
+		Applies: func(s *State) bool {
+			return moderation.ShouldModerate(s.Kind == datastores.RemoteMediaKind)
+		},
+		Run: func(s *State) error {
+			moderation.Enqueue(s.Ctx, s.Record)
+			return nil
+		},
+	},
+	{
+		Name:  "notify",
+		Phase: PhaseComplete,
+		Run: func(s *State) error {
+			return notifier.UploadDone(s.Ctx, s.Record)
+		},
+	},
+}
@@ -0,0 +1,145 @@
+package preferences
+
+import (
+	"errors"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/matrix"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+const (
+	// VisibilityPublic media can be downloaded by anyone, subject to the server's own restrictions.
+	VisibilityPublic = "public"
+	// VisibilityAuthenticated media can only be downloaded using authenticated media endpoints.
+	VisibilityAuthenticated = "authenticated"
+)
+
+// Preferences are a user's media settings. They are also the content of the user's account data, so clients can
+// read and change them without the media repo.
+type Preferences struct {
+	AutoCompress      bool   `json:"auto_compress"`
+	StripMetadata     bool   `json:"strip_metadata"`
+	DefaultVisibility string `json:"default_visibility"`
+}
+
+var ErrInvalidVisibility = errors.New("default_visibility must be 'public' or 'authenticated'")
+
+func Default() *Preferences {
+	return &Preferences{
+		AutoCompress:      false,
+		StripMetadata:     false,
+		DefaultVisibility: VisibilityPublic,
+	}
+}
+
+func IsEnabled() bool {
+	return config.Get().UserPreferences.Enabled
+}
+
+// Validate fills in missing values, returning ErrInvalidVisibility if the visibility is not understood.
+func (p *Preferences) Validate() error {
+	if p.DefaultVisibility == "" {
+		p.DefaultVisibility = VisibilityPublic
+	}
+	if p.DefaultVisibility != VisibilityPublic && p.DefaultVisibility != VisibilityAuthenticated {
+		return ErrInvalidVisibility
+	}
+	return nil
+}
+
+// Get returns the user's stored preferences, or the defaults if the user has none or preferences are disabled.
+func Get(ctx rcontext.RequestContext, userId string) (*Preferences, error) {
+	if !IsEnabled() || userId == "" {
+		return Default(), nil
+	}
+	record, err := database.GetInstance().UserPreferences.Prepare(ctx).Get(userId)
+	if err != nil || record == nil {
+		return Default(), err
+	}
+	return &Preferences{
+		AutoCompress:      record.AutoCompress,
+		StripMetadata:     record.StripMetadata,
+		DefaultVisibility: record.DefaultVisibility,
+	}, nil
+}
+
+// Set stores the user's preferences, and copies them to the user's account data on their homeserver so they follow
+// the user to other clients. Failing to update the account data is not fatal.
+func Set(ctx rcontext.RequestContext, userId string, accessToken string, prefs *Preferences) error {
+	if err := prefs.Validate(); err != nil {
+		return err
+	}
+	if err := store(ctx, userId, prefs); err != nil {
+		return err
+	}
+
+	dataType := config.Get().UserPreferences.AccountDataType
+	if dataType == "" || accessToken == "" || ctx.Request == nil {
+		return nil
+	}
+	if err := matrix.SetAccountData(ctx, ctx.Request.Host, accessToken, ctx.Request.RemoteAddr, userId, dataType, prefs); err != nil {
+		ctx.Log.Warn("Non-fatal error copying preferences to account data: ", err)
+		sentry.CaptureException(err)
+	}
+	return nil
+}
+
+// Refresh updates the user's stored preferences from their account data, if they haven't been updated recently.
+// Errors are logged and otherwise ignored, leaving the stored preferences in place.
+func Refresh(ctx rcontext.RequestContext, userId string, accessToken string) {
+	conf := config.Get().UserPreferences
+	if !conf.Enabled || conf.AccountDataType == "" || userId == "" || accessToken == "" || ctx.Request == nil {
+		return
+	}
+
+	record, err := database.GetInstance().UserPreferences.Prepare(ctx).Get(userId)
+	if err != nil {
+		ctx.Log.Warn("Non-fatal error checking stored preferences: ", err)
+		sentry.CaptureException(err)
+		return
+	}
+	if record != nil && util.NowMillis()-record.SyncedTs < (time.Duration(conf.RefreshMinutes)*time.Minute).Milliseconds() {
+		return
+	}
+
+	prefs := Default()
+	err = matrix.GetAccountData(ctx, ctx.Request.Host, accessToken, ctx.Request.RemoteAddr, userId, conf.AccountDataType, prefs)
+	var mtxErr *matrix.ErrorResponse
+	if errors.As(err, &mtxErr) && mtxErr.ErrorCode == common.ErrCodeNotFound {
+		if record != nil {
+			// The account data hasn't been created yet, so keep what the user set through the media repo
+			prefs.AutoCompress = record.AutoCompress
+			prefs.StripMetadata = record.StripMetadata
+			prefs.DefaultVisibility = record.DefaultVisibility
+		}
+		err = nil
+	}
+	if err != nil {
+		ctx.Log.Warn("Non-fatal error fetching preferences from account data: ", err)
+		return
+	}
+	if err = prefs.Validate(); err != nil {
+		ctx.Log.Warn("Ignoring invalid preferences in account data: ", err)
+		prefs.DefaultVisibility = VisibilityPublic
+	}
+	if err = store(ctx, userId, prefs); err != nil {
+		ctx.Log.Warn("Non-fatal error storing preferences from account data: ", err)
+		sentry.CaptureException(err)
+	}
+}
+
+func store(ctx rcontext.RequestContext, userId string, prefs *Preferences) error {
+	return database.GetInstance().UserPreferences.Prepare(ctx).Upsert(&database.DbUserPreferences{
+		UserId:            userId,
+		AutoCompress:      prefs.AutoCompress,
+		StripMetadata:     prefs.StripMetadata,
+		DefaultVisibility: prefs.DefaultVisibility,
+		SyncedTs:          util.NowMillis(),
+	})
+}
@@ -5,6 +5,9 @@ import (
 	"context"
 	"errors"
 	"io"
+	"regexp"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/getsentry/sentry-go"
@@ -18,6 +21,8 @@ const appendBufferSize = 32 * 1024 // 32kb
 const mediaExpirationTime = 15 * time.Minute
 const redisMaxValueSize = 512 * 1024 * 1024 // 512mb
 
+var mediaKeyRegex = regexp.MustCompile("^[a-f0-9]{64}$")
+
 func StoreMedia(ctx rcontext.RequestContext, hash string, content io.Reader, size int64) error {
 	makeConnection()
 	if ring == nil {
@@ -108,7 +113,83 @@ func DeleteMedia(ctx rcontext.RequestContext, hash string) error {
 		return nil
 	}
 
-	return ring.ForEachShard(ctx, func(ctx2 context.Context, client *redis.Client) error {
-		return client.Del(ctx2, hash).Err()
+	removed := &atomic.Bool{}
+	err := ring.ForEachShard(ctx, func(ctx2 context.Context, client *redis.Client) error {
+		res := client.Del(ctx2, hash)
+		if res.Val() > 0 {
+			removed.Store(true)
+		}
+		return res.Err()
+	})
+	if removed.Load() {
+		metrics.CacheEvictions.With(prometheus.Labels{"cache": "media"}).Inc()
+	}
+	return err
+}
+
+type CachedMedia struct {
+	Sha256Hash string
+	SizeBytes  int64
+	AgeSeconds int64
+}
+
+// ListMedia returns up to limit media objects currently in the cache. Entries are de-duplicated across shards.
+func ListMedia(ctx rcontext.RequestContext, limit int) ([]*CachedMedia, error) {
+	makeConnection()
+	if ring == nil {
+		return nil, nil
+	}
+
+	lock := &sync.Mutex{}
+	found := make(map[string]*CachedMedia)
+	err := ring.ForEachShard(ctx, func(ctx2 context.Context, client *redis.Client) error {
+		iter := client.Scan(ctx2, 0, "*", 0).Iterator()
+		for iter.Next(ctx2) {
+			hash := iter.Val()
+			if !mediaKeyRegex.MatchString(hash) {
+				continue // not a media object
+			}
+
+			lock.Lock()
+			_, seen := found[hash]
+			full := len(found) >= limit
+			lock.Unlock()
+			if full {
+				break
+			}
+			if seen {
+				continue
+			}
+
+			size, err := client.StrLen(ctx2, hash).Result()
+			if err != nil {
+				return err
+			}
+			ttl, err := client.TTL(ctx2, hash).Result()
+			if err != nil {
+				return err
+			}
+			if ttl < 0 {
+				continue // expired between the scan and now, or not one of ours
+			}
+
+			lock.Lock()
+			found[hash] = &CachedMedia{
+				Sha256Hash: hash,
+				SizeBytes:  size,
+				AgeSeconds: int64((mediaExpirationTime - ttl).Seconds()),
+			}
+			lock.Unlock()
+		}
+		return iter.Err()
 	})
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]*CachedMedia, 0, len(found))
+	for _, m := range found {
+		results = append(results, m)
+	}
+	return results, nil
 }
@@ -0,0 +1,32 @@
+package redislib
+
+import (
+	"context"
+	"time"
+
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+)
+
+// IncrementCounter adds to the counter at key, creating it with the given expiration if needed. Returns the new value
+// of the counter, or false if Redis is not enabled.
+func IncrementCounter(ctx rcontext.RequestContext, key string, by int64, expiration time.Duration) (int64, bool, error) {
+	makeConnection()
+	if ring == nil {
+		return 0, false, nil
+	}
+
+	timeoutCtx, cancel := context.WithTimeout(ctx.Context, 10*time.Second)
+	defer cancel()
+
+	val, err := ring.IncrBy(timeoutCtx, key, by).Result()
+	if err != nil {
+		return 0, true, err
+	}
+	if val == by {
+		// We created the counter, so set it to expire
+		if err = ring.PExpire(timeoutCtx, key, expiration).Err(); err != nil {
+			return 0, true, err
+		}
+	}
+	return val, true, nil
+}
@@ -0,0 +1,76 @@
+package redislib
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+)
+
+// ErrNotConnected is returned by queue operations when Redis is not enabled or has no connections.
+var ErrNotConnected = errors.New("redis is not connected")
+
+// PushQueue adds the payload to the end of the named queue, optionally expiring the queue after the given duration.
+func PushQueue(ctx rcontext.RequestContext, queue string, payload string, expiration time.Duration) error {
+	makeConnection()
+	if ring == nil {
+		return ErrNotConnected
+	}
+
+	timeoutCtx, cancel := context.WithTimeout(ctx.Context, 10*time.Second)
+	defer cancel()
+
+	if err := ring.LPush(timeoutCtx, queue, payload).Err(); err != nil {
+		return err
+	}
+	if expiration > 0 {
+		return ring.PExpire(timeoutCtx, queue, expiration).Err()
+	}
+	return nil
+}
+
+// PopQueue waits up to the timeout for a payload on the named queue. Returns an empty string if nothing arrived in
+// time.
+func PopQueue(ctx rcontext.RequestContext, queue string, timeout time.Duration) (string, error) {
+	makeConnection()
+	if ring == nil {
+		return "", ErrNotConnected
+	}
+
+	// Give the server a bit longer than the blocking timeout to respond
+	timeoutCtx, cancel := context.WithTimeout(ctx.Context, timeout+10*time.Second)
+	defer cancel()
+
+	vals, err := ring.BRPop(timeoutCtx, timeout, queue).Result()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return "", nil
+		}
+		return "", err
+	}
+	// BRPOP returns the queue name followed by the value
+	return vals[1], nil
+}
+
+// PopQueueBatch takes up to count payloads from the named queue without waiting. Returns an empty slice if the queue
+// is empty.
+func PopQueueBatch(ctx rcontext.RequestContext, queue string, count int) ([]string, error) {
+	makeConnection()
+	if ring == nil {
+		return nil, ErrNotConnected
+	}
+
+	timeoutCtx, cancel := context.WithTimeout(ctx.Context, 10*time.Second)
+	defer cancel()
+
+	vals, err := ring.RPopCount(timeoutCtx, queue, count).Result()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return make([]string, 0), nil
+		}
+		return nil, err
+	}
+	return vals, nil
+}
@@ -0,0 +1,159 @@
+package references
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/matrix"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+type RoomManifestEntry struct {
+	MxcUri      string `json:"mxc"`
+	Sha256      string `json:"sha256"`
+	SizeBytes   int64  `json:"size"`
+	ContentType string `json:"content_type,omitempty"`
+}
+
+// RoomManifest summarizes the media referenced by a room, for clients to reconcile their galleries against.
+type RoomManifest struct {
+	RoomId      string               `json:"room_id"`
+	Media       []*RoomManifestEntry `json:"media"`
+	Count       int                  `json:"count"`
+	Truncated   bool                 `json:"truncated,omitempty"`
+	GeneratedTs int64                `json:"generated_ts"`
+}
+
+// publishedManifests tracks the digest of each room's last published manifest, so unchanged rooms can be skipped.
+var publishedManifests = &sync.Map{}
+
+// BuildRoomManifest lists the media referenced by the room, oldest reference first. Quarantined and unknown media
+// are left out.
+func BuildRoomManifest(ctx rcontext.RequestContext, roomId string) (*RoomManifest, error) {
+	refs, err := database.GetInstance().MediaReferences.Prepare(ctx).GetForRoom(roomId)
+	if err != nil {
+		return nil, err
+	}
+
+	mediaDb := database.GetInstance().Media.Prepare(ctx)
+	manifest := &RoomManifest{
+		RoomId:      roomId,
+		Media:       make([]*RoomManifestEntry, 0),
+		GeneratedTs: util.NowMillis(),
+	}
+	seen := make(map[string]bool)
+	for _, ref := range refs {
+		mxc := util.MxcUri(ref.Origin, ref.MediaId)
+		if seen[mxc] {
+			continue
+		}
+		seen[mxc] = true
+		record, err := mediaDb.GetById(ref.Origin, ref.MediaId)
+		if err != nil {
+			return nil, err
+		}
+		if record == nil || record.Quarantined {
+			continue
+		}
+		manifest.Media = append(manifest.Media, &RoomManifestEntry{
+			MxcUri:      mxc,
+			Sha256:      record.Sha256Hash,
+			SizeBytes:   record.SizeBytes,
+			ContentType: record.ContentType,
+		})
+	}
+	manifest.Count = len(manifest.Media)
+	return manifest, nil
+}
+
+// PublishRoomManifest sends the room's manifest to the configured room state event and webhook. If onlyChanged is
+// true, the manifest is only published if it differs from the last one published by this process. Returns the
+// manifest and whether it was published.
+func PublishRoomManifest(ctx rcontext.RequestContext, roomId string, onlyChanged bool) (*RoomManifest, bool, error) {
+	conf := config.Get().RoomManifests
+	if !conf.Enabled {
+		return nil, false, errors.New("room manifests are not enabled")
+	}
+
+	manifest, err := BuildRoomManifest(ctx, roomId)
+	if err != nil {
+		return nil, false, err
+	}
+
+	digest, err := manifestDigest(manifest)
+	if err != nil {
+		return nil, false, err
+	}
+	if onlyChanged {
+		if last, ok := publishedManifests.Load(roomId); ok && last.(string) == digest {
+			return manifest, false, nil
+		}
+	}
+
+	if conf.Homeserver != "" && conf.AccessToken != "" {
+		stateManifest := *manifest
+		if conf.MaxStateEntries > 0 && len(stateManifest.Media) > conf.MaxStateEntries {
+			// State events are limited to 64kb, so large rooms only get the newest entries in state
+			stateManifest.Media = stateManifest.Media[len(stateManifest.Media)-conf.MaxStateEntries:]
+			stateManifest.Truncated = true
+		}
+		if _, err = matrix.SendStateEvent(ctx, conf.Homeserver, conf.AccessToken, roomId, conf.EventType, "", &stateManifest); err != nil {
+			return nil, false, errors.Join(errors.New("error sending manifest state event"), err)
+		}
+	}
+	if conf.WebhookUrl != "" {
+		if err = postManifestWebhook(ctx, conf, manifest); err != nil {
+			return nil, false, errors.Join(errors.New("error sending manifest webhook"), err)
+		}
+	}
+
+	publishedManifests.Store(roomId, digest)
+	return manifest, true, nil
+}
+
+func manifestDigest(manifest *RoomManifest) (string, error) {
+	b, err := json.Marshal(manifest.Media)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256(b)
+	return hex.EncodeToString(hash[:]), nil
+}
+
+func postManifestWebhook(ctx rcontext.RequestContext, conf config.RoomManifestsConfig, manifest *RoomManifest) error {
+	b, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, conf.WebhookUrl, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", "matrix-media-repo")
+	req.Header.Set("Content-Type", "application/json")
+	if conf.WebhookSecret != "" {
+		req.Header.Set("Authorization", "Bearer "+conf.WebhookSecret)
+	}
+	client := &http.Client{
+		Timeout: time.Duration(conf.TimeoutSeconds) * time.Second,
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status code %d", res.StatusCode)
+	}
+	return nil
+}
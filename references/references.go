@@ -0,0 +1,110 @@
+package references
+
+import (
+	"database/sql"
+
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+func AddMediaReference(ctx rcontext.RequestContext, origin string, mediaId string, roomId string, eventId string) error {
+	return AddMediaReferenceTx(ctx, nil, origin, mediaId, roomId, eventId)
+}
+
+// AddMediaReferenceTx is like AddMediaReference, but runs within the given transaction (if not nil).
+func AddMediaReferenceTx(ctx rcontext.RequestContext, tx *sql.Tx, origin string, mediaId string, roomId string, eventId string) error {
+	err := database.GetInstance().MediaReferences.PrepareTx(ctx, tx).Insert(&database.DbMediaReference{
+		Origin:     origin,
+		MediaId:    mediaId,
+		RoomId:     roomId,
+		EventId:    eventId,
+		CreationTs: util.NowMillis(),
+	})
+	if err != nil {
+		return err
+	}
+
+	// The media is referenced again, so make sure the garbage collector leaves it alone
+	return database.GetInstance().Unreferenced.PrepareTx(ctx, tx).Delete(origin, mediaId)
+}
+
+// RemoveMediaReference drops all of the room's references to the media. If the media is left without any
+// references, it is flagged for the garbage collector. Returns false if the room did not reference the media.
+func RemoveMediaReference(ctx rcontext.RequestContext, origin string, mediaId string, roomId string) (bool, error) {
+	removed, err := database.GetInstance().MediaReferences.Prepare(ctx).DeleteForRoom(origin, mediaId, roomId)
+	if err != nil || removed == 0 {
+		return false, err
+	}
+	return true, flagIfUnreferenced(ctx, origin, mediaId)
+}
+
+// RemoveEventReference is like RemoveMediaReference, but only drops the reference made by the given event.
+func RemoveEventReference(ctx rcontext.RequestContext, origin string, mediaId string, roomId string, eventId string) (bool, error) {
+	removed, err := database.GetInstance().MediaReferences.Prepare(ctx).Delete(origin, mediaId, roomId, eventId)
+	if err != nil || removed == 0 {
+		return false, err
+	}
+	return true, flagIfUnreferenced(ctx, origin, mediaId)
+}
+
+// flagIfUnreferenced flags the media for the garbage collector if it no longer has any references.
+func flagIfUnreferenced(ctx rcontext.RequestContext, origin string, mediaId string) error {
+	referenced, err := IsMediaReferenced(ctx, origin, mediaId)
+	if err != nil {
+		return err
+	}
+	if !referenced {
+		return database.GetInstance().Unreferenced.Prepare(ctx).Upsert(origin, mediaId, util.NowMillis())
+	}
+	return nil
+}
+
+func IsMediaReferenced(ctx rcontext.RequestContext, origin string, mediaId string) (bool, error) {
+	count, err := database.GetInstance().MediaReferences.Prepare(ctx).CountForMedia(origin, mediaId)
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// RemoveRoom drops every reference held by the room, such as when the room has been forgotten or left by all local
+// users. Media left without any references is flagged for the garbage collector, and returned as MXC URIs.
+func RemoveRoom(ctx rcontext.RequestContext, roomId string) ([]string, error) {
+	unreferenced := make([]string, 0)
+	err := database.GetInstance().WithTransaction(ctx, func(tx *sql.Tx) error {
+		refsDb := database.GetInstance().MediaReferences.PrepareTx(ctx, tx)
+		refs, err := refsDb.GetForRoom(roomId)
+		if err != nil {
+			return err
+		}
+		if err = refsDb.DeleteAllForRoom(roomId); err != nil {
+			return err
+		}
+
+		unreferencedDb := database.GetInstance().Unreferenced.PrepareTx(ctx, tx)
+		now := util.NowMillis()
+		for _, ref := range refs {
+			mxc := util.MxcUri(ref.Origin, ref.MediaId)
+			if util.ArrayContains(unreferenced, mxc) {
+				continue
+			}
+			count, err := refsDb.CountForMedia(ref.Origin, ref.MediaId)
+			if err != nil {
+				return err
+			}
+			if count > 0 {
+				continue
+			}
+			if err = unreferencedDb.Upsert(ref.Origin, ref.MediaId, now); err != nil {
+				return err
+			}
+			unreferenced = append(unreferenced, mxc)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return unreferenced, nil
+}
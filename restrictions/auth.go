@@ -1,6 +1,8 @@
 package restrictions
 
 import (
+	"database/sql"
+
 	"github.com/t2bot/matrix-media-repo/common/rcontext"
 	"github.com/t2bot/matrix-media-repo/database"
 )
@@ -19,5 +21,10 @@ func DoesMediaRequireAuth(ctx rcontext.RequestContext, origin string, mediaId st
 }
 
 func SetMediaRequiresAuth(ctx rcontext.RequestContext, origin string, mediaId string) error {
-	return database.GetInstance().RestrictedMedia.Prepare(ctx).Insert(origin, mediaId, database.RestrictedRequiresAuth, "true")
+	return SetMediaRequiresAuthTx(ctx, nil, origin, mediaId)
+}
+
+// SetMediaRequiresAuthTx is like SetMediaRequiresAuth, but runs within the given transaction (if not nil).
+func SetMediaRequiresAuthTx(ctx rcontext.RequestContext, tx *sql.Tx, origin string, mediaId string) error {
+	return database.GetInstance().RestrictedMedia.PrepareTx(ctx, tx).Insert(origin, mediaId, database.RestrictedRequiresAuth, "true")
 }
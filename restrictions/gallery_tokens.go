@@ -0,0 +1,139 @@
+package restrictions
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+const galleryTokenVersion = "g1"
+
+var ErrGalleryLinksDisabled = errors.New("gallery links are not enabled")
+var ErrInvalidGalleryToken = errors.New("invalid gallery token")
+var ErrExpiredGalleryToken = errors.New("gallery token has expired")
+var ErrRevokedGalleryToken = errors.New("gallery token has been revoked")
+
+// IsRejectedGalleryToken returns true if the error means the gallery token doesn't grant access, rather than that it
+// couldn't be checked.
+func IsRejectedGalleryToken(err error) bool {
+	return errors.Is(err, ErrGalleryLinksDisabled) || errors.Is(err, ErrInvalidGalleryToken) || errors.Is(err, ErrExpiredGalleryToken) || errors.Is(err, ErrRevokedGalleryToken)
+}
+
+// GalleryToken grants read access to all media referenced by a room until it expires.
+type GalleryToken struct {
+	RoomId    string `json:"r"`
+	IssuedBy  string `json:"i"`
+	ExpiresTs int64  `json:"e"`
+
+	// Id is a short identifier for the token, derived from its signature. It is safe to show publicly, and is
+	// populated when the token is minted or verified.
+	Id string `json:"-"`
+}
+
+func gallerySecret() ([]byte, error) {
+	conf := config.Get().GalleryLinks
+	if !conf.Enabled || conf.Secret == "" {
+		return nil, ErrGalleryLinksDisabled
+	}
+	return []byte(conf.Secret), nil
+}
+
+// MintGalleryToken signs a gallery token for the room and records it so it can be revoked, populating its Id.
+// Changing galleryLinks.secret invalidates all tokens at once.
+func MintGalleryToken(ctx rcontext.RequestContext, token *GalleryToken) (string, error) {
+	secret, err := gallerySecret()
+	if err != nil {
+		return "", err
+	}
+	b, err := json.Marshal(token)
+	if err != nil {
+		return "", err
+	}
+	payload := galleryTokenVersion + "." + base64.RawURLEncoding.EncodeToString(b)
+	sig := signGalleryPayload(secret, payload)
+	token.Id = galleryTokenId(sig)
+
+	db := database.GetInstance().GalleryLinks.Prepare(ctx)
+	if err = db.DeleteExpired(util.NowMillis()); err != nil {
+		ctx.Log.Warn("Non-fatal error removing expired gallery links: ", err)
+		sentry.CaptureException(err)
+	}
+	err = db.Insert(&database.DbGalleryLink{
+		TokenId:    token.Id,
+		RoomId:     token.RoomId,
+		IssuedBy:   token.IssuedBy,
+		CreationTs: util.NowMillis(),
+		ExpiresTs:  token.ExpiresTs,
+	})
+	if err != nil {
+		return "", err
+	}
+	return payload + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// RevokeGalleryToken stops the room's gallery token with the given Id from granting access. Returns false if the room
+// has no such token.
+func RevokeGalleryToken(ctx rcontext.RequestContext, roomId string, tokenId string) (bool, error) {
+	return database.GetInstance().GalleryLinks.Prepare(ctx).Delete(tokenId, roomId)
+}
+
+// VerifyGalleryToken checks the token's signature and expiry, and that it hasn't been revoked, returning what it
+// grants access to.
+func VerifyGalleryToken(ctx rcontext.RequestContext, token string) (*GalleryToken, error) {
+	secret, err := gallerySecret()
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != galleryTokenVersion {
+		return nil, ErrInvalidGalleryToken
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidGalleryToken
+	}
+	if !hmac.Equal(sig, signGalleryPayload(secret, parts[0]+"."+parts[1])) {
+		return nil, ErrInvalidGalleryToken
+	}
+	b, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrInvalidGalleryToken
+	}
+	val := &GalleryToken{}
+	if err = json.Unmarshal(b, val); err != nil || val.RoomId == "" {
+		return nil, ErrInvalidGalleryToken
+	}
+	if val.ExpiresTs <= util.NowMillis() {
+		return nil, ErrExpiredGalleryToken
+	}
+	val.Id = galleryTokenId(sig)
+
+	record, err := database.GetInstance().GalleryLinks.Prepare(ctx).Get(val.Id)
+	if err != nil {
+		return nil, err
+	}
+	if record == nil || record.RoomId != val.RoomId {
+		return nil, ErrRevokedGalleryToken
+	}
+	return val, nil
+}
+
+func galleryTokenId(sig []byte) string {
+	return hex.EncodeToString(sig[:6])
+}
+
+func signGalleryPayload(secret []byte, payload string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,63 @@
+package restrictions
+
+import (
+	"slices"
+
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+// IsPublicRoom returns true if the room has been flagged as public, either in the domain's config or with the admin
+// API. Media referenced by public rooms can be downloaded by anyone.
+func IsPublicRoom(ctx rcontext.RequestContext, roomId string) (bool, error) {
+	if slices.Contains(ctx.Config.Downloads.PublicRooms, roomId) {
+		return true, nil
+	}
+	record, err := database.GetInstance().PublicRooms.Prepare(ctx).Get(roomId)
+	if err != nil {
+		return false, err
+	}
+	return record != nil, nil
+}
+
+// CanAccessWithoutAuth returns true if the media may be downloaded by an unauthenticated requester because it is
+// referenced by a public room, or by the room the requester's gallery token is for.
+func CanAccessWithoutAuth(ctx rcontext.RequestContext, origin string, mediaId string, requester *Requester) (bool, error) {
+	refs, err := database.GetInstance().MediaReferences.Prepare(ctx).GetForMedia(origin, mediaId)
+	if err != nil {
+		return false, err
+	}
+	if requester != nil && requester.GalleryRoomId != "" {
+		for _, ref := range refs {
+			if ref.RoomId == requester.GalleryRoomId {
+				return true, nil
+			}
+		}
+	}
+	return anyPublicRoom(ctx, refs)
+}
+
+func anyPublicRoom(ctx rcontext.RequestContext, refs []*database.DbMediaReference) (bool, error) {
+	for _, ref := range refs {
+		if public, err := IsPublicRoom(ctx, ref.RoomId); err != nil {
+			return false, err
+		} else if public {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// SetRoomPublic flags (or unflags) the room as public. Rooms made public by config are not affected.
+func SetRoomPublic(ctx rcontext.RequestContext, roomId string, setBy string, public bool) error {
+	db := database.GetInstance().PublicRooms.Prepare(ctx)
+	if !public {
+		return db.Delete(roomId)
+	}
+	return db.Insert(&database.DbPublicRoom{
+		RoomId:     roomId,
+		SetBy:      setBy,
+		CreationTs: util.NowMillis(),
+	})
+}
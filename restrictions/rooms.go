@@ -0,0 +1,160 @@
+package restrictions
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/patrickmn/go-cache"
+	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/matrix"
+	"github.com/t2bot/matrix-media-repo/notifier"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+var membershipCache = cache.New(cache.NoExpiration, 30*time.Second)
+var subscribeOnce = &sync.Once{}
+
+// Requester describes who is asking for media, for the purposes of room access control. Exactly one
+// of UserId or ServerName is expected to be set.
+type Requester struct {
+	UserId      string
+	AccessToken string
+	ServerName  string // set for federation requests
+	IsShared    bool   // set when authenticated with the shared secret, which bypasses room access checks
+
+	// GalleryRoomId is the room a verified gallery token grants access to, if any.
+	GalleryRoomId string
+}
+
+// CheckRoomAccess returns nil if the requester may access the media under the domain's room access
+// rules. Media which is not referenced by any rooms, or is referenced by a public room, is always
+// accessible, as is media in the room of the requester's gallery token. Global admins and shared secret callers may
+// access everything. Returns common.ErrRestrictedAuth if the requester is anonymous, and
+// common.ErrRestrictedRoomMembership if they are not joined to any referencing room.
+func CheckRoomAccess(ctx rcontext.RequestContext, origin string, mediaId string, requester Requester) error {
+	if !ctx.Config.Downloads.RoomAccess.Enabled {
+		return nil
+	}
+	if requester.IsShared || (requester.UserId != "" && util.IsGlobalAdmin(requester.UserId)) {
+		return nil
+	}
+
+	refs, err := database.GetInstance().MediaReferences.Prepare(ctx).GetForMedia(origin, mediaId)
+	if err != nil {
+		return err
+	}
+	if len(refs) == 0 {
+		return nil
+	}
+	if public, err := anyPublicRoom(ctx, refs); err != nil {
+		return err
+	} else if public {
+		return nil
+	}
+	if requester.GalleryRoomId != "" {
+		for _, ref := range refs {
+			if ref.RoomId == requester.GalleryRoomId {
+				return nil
+			}
+		}
+	}
+
+	if requester.UserId == "" {
+		if requester.ServerName == "" {
+			return common.ErrRestrictedAuth
+		}
+		if ctx.Config.Downloads.RoomAccess.AllowFederation {
+			return nil
+		}
+		return common.ErrRestrictedRoomMembership
+	}
+
+	joined, err := getJoinedRooms(ctx, requester)
+	if err != nil {
+		return err
+	}
+	for _, ref := range refs {
+		if _, ok := joined[ref.RoomId]; ok {
+			return nil
+		}
+	}
+	return common.ErrRestrictedRoomMembership
+}
+
+// IsJoined returns true if the user is joined to the room. Memberships are cached the same way as for CheckRoomAccess.
+func IsJoined(ctx rcontext.RequestContext, requester Requester, roomId string) (bool, error) {
+	joined, err := getJoinedRooms(ctx, requester)
+	if err != nil {
+		return false, err
+	}
+	_, ok := joined[roomId]
+	return ok, nil
+}
+
+func getJoinedRooms(ctx rcontext.RequestContext, requester Requester) (map[string]struct{}, error) {
+	subscribeOnce.Do(subscribeToMemberships)
+
+	// The requester's access token has already been validated, so memberships are cached by user rather than token.
+	// This lets the user's other devices benefit from the cache too.
+	cacheKey := requester.UserId
+	if val, ok := membershipCache.Get(cacheKey); ok {
+		return val.(map[string]struct{}), nil
+	}
+
+	if ctx.Request == nil {
+		return nil, errors.New("invalid context - missing request")
+	}
+	roomIds, err := matrix.GetJoinedRooms(ctx, ctx.Request.Host, requester.AccessToken, ctx.Request.RemoteAddr)
+	if err != nil {
+		return nil, err
+	}
+	joined := make(map[string]struct{}, len(roomIds))
+	for _, roomId := range roomIds {
+		joined[roomId] = struct{}{}
+	}
+
+	cacheSeconds := ctx.Config.Downloads.RoomAccess.MembershipCacheSeconds
+	if cacheSeconds > 0 {
+		membershipCache.Set(cacheKey, joined, time.Duration(cacheSeconds)*time.Second)
+	}
+	return joined, nil
+}
+
+// InvalidateMembership drops the cached memberships for the user, or for every user known to be joined to the room
+// if userId is empty. Other media repo instances are told to do the same.
+func InvalidateMembership(ctx rcontext.RequestContext, roomId string, userId string) {
+	change := notifier.MembershipChange{RoomId: roomId, UserId: userId}
+	applyMembershipChange(change)
+	if err := notifier.MembershipChanged(ctx, change); err != nil {
+		ctx.Log.Warn("Non-fatal error broadcasting membership change: ", err)
+		sentry.CaptureException(err)
+	}
+}
+
+func applyMembershipChange(change notifier.MembershipChange) {
+	if change.UserId != "" {
+		membershipCache.Delete(change.UserId)
+		return
+	}
+	for userId, item := range membershipCache.Items() {
+		if _, ok := item.Object.(map[string]struct{})[change.RoomId]; ok {
+			membershipCache.Delete(userId)
+		}
+	}
+}
+
+func subscribeToMemberships() {
+	ch := notifier.SubscribeToMemberships()
+	if ch == nil {
+		return
+	}
+	go func() {
+		for change := range ch {
+			applyMembershipChange(change)
+		}
+	}()
+}
@@ -1,20 +1,61 @@
 package tasks
 
 import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-media-repo/common/config"
 	"github.com/t2bot/matrix-media-repo/tasks/task_runner"
 )
 
 func StartAll() {
+	if config.Get().Deployment.IsDownloadsOnly() {
+		logrus.Info("Not starting recurring tasks: this instance only serves downloads")
+		return
+	}
+
+	task_runner.ClearInterrupt()
 	executeEnable()
 
 	scheduleHourly(RecurringTaskPurgeRemoteMedia, task_runner.PurgeRemoteMedia)
+	scheduleHourly(RecurringTaskPurgeOriginCache, task_runner.PurgeOriginCacheOverages)
+	scheduleHourly(RecurringTaskPurgeUnusedRemote, task_runner.PurgeUnusedRemoteMedia)
 	scheduleHourly(RecurringTaskPurgeThumbnails, task_runner.PurgeThumbnails)
 	scheduleHourly(RecurringTaskPurgePreviews, task_runner.PurgePreviews)
 	scheduleHourly(RecurringTaskPurgeHeldMediaIds, task_runner.PurgeHeldMediaIds)
+	scheduleHourly(RecurringTaskPurgeUnreferenced, task_runner.PurgeUnreferencedMedia)
+	scheduleHourly(RecurringTaskPurgeIdempotency, task_runner.PurgeIdempotencyKeys)
+	scheduleHourly(RecurringTaskPurgeReplication, task_runner.PurgeReplicationEvents)
+	scheduleHourly(RecurringTaskSyncHashBanLists, task_runner.SyncHashBanLists)
+	scheduleHourly(RecurringTaskTierOldMedia, task_runner.TierOldMedia)
+	scheduleEvery(RecurringTaskAsyncMetrics, 1*time.Minute, task_runner.UpdateAsyncMediaMetrics)
+	scheduleEvery(RecurringTaskStorageMetrics, 5*time.Minute, task_runner.UpdateStorageMetrics)
+	scheduleEvery(RecurringTaskModerateMedia, 30*time.Second, task_runner.ModerateQueuedMedia)
+	if config.Get().Redis.Enabled {
+		scheduleEvery(RecurringTaskSaveAccesses, 10*time.Second, task_runner.SaveQueuedAccesses)
+	}
+	if interval := config.Get().PolicyRooms.SyncIntervalMinutes; interval > 0 {
+		scheduleEvery(RecurringTaskSyncPolicyRooms, time.Duration(interval)*time.Minute, task_runner.SyncPolicyRooms)
+	}
+	if interval := config.Get().RoomManifests.SyncIntervalMinutes; interval > 0 {
+		scheduleEvery(RecurringTaskRoomManifests, time.Duration(interval)*time.Minute, task_runner.SyncRoomManifests)
+	}
+	if interval := config.Get().DiskWatermarks.CheckIntervalSeconds; interval > 0 {
+		scheduleEvery(RecurringTaskDiskWatermarks, time.Duration(interval)*time.Second, task_runner.CheckDiskWatermarks)
+	}
+	if conf := config.Get().Replication; conf.Enabled && conf.IntervalSeconds > 0 {
+		scheduleEvery(RecurringTaskReplicateMedia, time.Duration(conf.IntervalSeconds)*time.Second, task_runner.ReplicateMedia)
+	}
 
 	scheduleUnfinished()
 }
 
 func StopAll() {
 	stopRecurring()
+
+	// Give long-running tasks a chance to save a checkpoint. They are resumed by scheduleUnfinished on the next start.
+	grace := time.Duration(config.Get().General.ShutdownGraceSeconds) * time.Second
+	if !interruptRunning(grace) {
+		logrus.Warn("Some background tasks did not stop in time and may restart from an earlier checkpoint")
+	}
 }
@@ -2,6 +2,7 @@ package tasks
 
 import (
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/getsentry/sentry-go"
@@ -17,6 +18,12 @@ import (
 
 var notiferCh <-chan notifier.TaskId
 
+// runningTasks tracks the one-off tasks running on this machine, so they aren't started twice and can be waited on
+// during shutdown.
+var runningTasks = make(map[int]bool)
+var runningTasksLock = new(sync.Mutex)
+var runningTasksWg = new(sync.WaitGroup)
+
 func executeEnable() {
 	if notiferCh != nil {
 		return
@@ -64,18 +71,39 @@ func beginTask(task *database.DbTask) {
 	runnerCtx := rcontext.Initial().LogWithFields(logrus.Fields{"task_id": task.TaskId})
 
 	oneHourAgo := util.NowMillis() - (60 * 60 * 1000)
-	if task.StartTs < oneHourAgo {
+	if task.StartTs < oneHourAgo && !resumableTasks[TaskName(task.Name)] {
 		runnerCtx.Log.Warn("Not starting task because it is more than 1 hour old.")
 		return
 	}
 
+	runningTasksLock.Lock()
+	if runningTasks[task.TaskId] {
+		runningTasksLock.Unlock()
+		runnerCtx.Log.Debug("Task is already running")
+		return
+	}
+	runningTasks[task.TaskId] = true
+	runningTasksWg.Add(1)
+	runningTasksLock.Unlock()
+	finishRunning := func() {
+		runningTasksLock.Lock()
+		defer runningTasksLock.Unlock()
+		delete(runningTasks, task.TaskId)
+		runningTasksWg.Done()
+	}
+
 	if err := pool.TaskQueue.Schedule(func() {
+		defer finishRunning()
 		if task.Name == string(TaskDatastoreMigrate) {
 			task_runner.DatastoreMigrate(runnerCtx, task)
 		} else if task.Name == string(TaskExportData) {
 			task_runner.ExportData(runnerCtx, task)
 		} else if task.Name == string(TaskImportData) {
 			task_runner.ImportData(runnerCtx, task)
+		} else if task.Name == string(TaskImportSynapse) {
+			task_runner.ImportSynapseMediaStore(runnerCtx, task)
+		} else if task.Name == string(TaskRepairReferences) {
+			task_runner.RepairReferences(runnerCtx, task)
 		} else {
 			m := fmt.Sprintf("Received unknown task to run %s (ID: %d)", task.Name, task.TaskId)
 			runnerCtx.Log.Warn(m)
@@ -85,8 +113,26 @@ func beginTask(task *database.DbTask) {
 		m := fmt.Sprintf("Error trying to schedule task %s (ID: %d): %s", task.Name, task.TaskId, err.Error())
 		runnerCtx.Log.Warn(m)
 		sentry.CaptureMessage(m)
+		finishRunning()
 		time.AfterFunc(15*time.Second, func() {
 			beginTask(task)
 		})
 	}
 }
+
+// interruptRunning asks running tasks to checkpoint and stop, waiting up to the given duration for them to do so.
+// Returns false if tasks were still running when the time ran out.
+func interruptRunning(wait time.Duration) bool {
+	task_runner.Interrupt()
+	ch := make(chan bool)
+	go func() {
+		runningTasksWg.Wait()
+		close(ch)
+	}()
+	select {
+	case <-ch:
+		return true
+	case <-time.After(wait):
+		return false
+	}
+}
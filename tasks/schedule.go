@@ -22,14 +22,39 @@ const (
 	TaskDatastoreMigrate TaskName = "storage_migration"
 	TaskExportData       TaskName = "export_data"
 	TaskImportData       TaskName = "import_data"
+	TaskImportSynapse    TaskName = "import_synapse_media_store"
+	TaskRepairReferences TaskName = "repair_references"
 )
 const (
 	RecurringTaskPurgeThumbnails   RecurringTaskName = "recurring_purge_thumbnails"
 	RecurringTaskPurgePreviews     RecurringTaskName = "recurring_purge_previews"
 	RecurringTaskPurgeRemoteMedia  RecurringTaskName = "recurring_purge_remote_media"
 	RecurringTaskPurgeHeldMediaIds RecurringTaskName = "recurring_purge_held_media_ids"
+	RecurringTaskPurgeUnreferenced RecurringTaskName = "recurring_purge_unreferenced_media"
+	RecurringTaskPurgeIdempotency  RecurringTaskName = "recurring_purge_idempotency_keys"
+	RecurringTaskSyncHashBanLists  RecurringTaskName = "recurring_sync_hash_ban_lists"
+	RecurringTaskSyncPolicyRooms   RecurringTaskName = "recurring_sync_policy_rooms"
+	RecurringTaskPurgeOriginCache  RecurringTaskName = "recurring_purge_origin_cache"
+	RecurringTaskTierOldMedia      RecurringTaskName = "recurring_tier_old_media"
+	RecurringTaskDiskWatermarks    RecurringTaskName = "recurring_disk_watermarks"
+	RecurringTaskPurgeUnusedRemote RecurringTaskName = "recurring_purge_unused_remote_media"
+	RecurringTaskAsyncMetrics      RecurringTaskName = "recurring_async_media_metrics"
+	RecurringTaskRoomManifests     RecurringTaskName = "recurring_sync_room_manifests"
+	RecurringTaskStorageMetrics    RecurringTaskName = "recurring_storage_metrics"
+	RecurringTaskModerateMedia     RecurringTaskName = "recurring_moderate_media"
+	RecurringTaskReplicateMedia    RecurringTaskName = "recurring_replicate_media"
+	RecurringTaskSaveAccesses      RecurringTaskName = "recurring_save_queued_accesses"
+	RecurringTaskPurgeReplication  RecurringTaskName = "recurring_purge_replication_events"
 )
 
+// resumableTasks can safely be restarted, no matter how long ago they were started. They either start again from the
+// beginning or continue from their last checkpoint.
+var resumableTasks = map[TaskName]bool{
+	TaskDatastoreMigrate: true,
+	TaskExportData:       true,
+	TaskImportSynapse:    true,
+}
+
 const ExecutingMachineId = int64(0)
 
 type RecurringTaskFn func(ctx rcontext.RequestContext)
@@ -62,11 +87,15 @@ func scheduleTask(ctx rcontext.RequestContext, name TaskName, params interface{}
 }
 
 func scheduleHourly(name RecurringTaskName, workFn RecurringTaskFn) {
+	scheduleEvery(name, (1*time.Hour)+(time.Duration(localRand.Intn(15))*time.Minute), workFn)
+}
+
+func scheduleEvery(name RecurringTaskName, interval time.Duration, workFn RecurringTaskFn) {
 	if ids.GetMachineId() != ExecutingMachineId {
 		return // don't run tasks on this machine
 	}
 
-	ticker := time.NewTicker((1 * time.Hour) + (time.Duration(localRand.Intn(15)) * time.Minute))
+	ticker := time.NewTicker(interval)
 	ch := make(chan bool)
 	ctx := rcontext.Initial().LogWithFields(logrus.Fields{"task": name})
 	recurLock.Lock()
@@ -128,12 +157,8 @@ func scheduleUnfinished() {
 	}
 }
 
-func RunDatastoreMigration(ctx rcontext.RequestContext, sourceDsId string, targetDsId string, beforeTs int64) (*database.DbTask, error) {
-	return scheduleTask(ctx, TaskDatastoreMigrate, task_runner.DatastoreMigrateParams{
-		SourceDsId: sourceDsId,
-		TargetDsId: targetDsId,
-		BeforeTs:   beforeTs,
-	})
+func RunDatastoreMigration(ctx rcontext.RequestContext, params task_runner.DatastoreMigrateParams) (*database.DbTask, error) {
+	return scheduleTask(ctx, TaskDatastoreMigrate, params)
 }
 
 func RunUserExport(ctx rcontext.RequestContext, userId string, includeS3Urls bool) (*database.DbTask, string, error) {
@@ -152,6 +177,14 @@ func RunServerExport(ctx rcontext.RequestContext, serverName string, includeS3Ur
 	})
 }
 
+func RunRoomExport(ctx rcontext.RequestContext, roomId string, includeS3Urls bool) (*database.DbTask, string, error) {
+	return runExport(ctx, task_runner.ExportDataParams{
+		RoomId:        roomId,
+		IncludeS3Urls: includeS3Urls,
+		//ExportId:      "", // populated by runExport
+	})
+}
+
 func runExport(ctx rcontext.RequestContext, paramsTemplate task_runner.ExportDataParams) (*database.DbTask, string, error) {
 	exportId, err := ids.NewUniqueId()
 	if err != nil {
@@ -172,3 +205,11 @@ func RunImport(ctx rcontext.RequestContext) (*database.DbTask, string, error) {
 	})
 	return task, importId, err
 }
+
+func RunReferenceRepair(ctx rcontext.RequestContext, params task_runner.RepairReferencesParams) (*database.DbTask, error) {
+	return scheduleTask(ctx, TaskRepairReferences, params)
+}
+
+func RunSynapseMediaStoreImport(ctx rcontext.RequestContext, params task_runner.ImportSynapseMediaStoreParams) (*database.DbTask, error) {
+	return scheduleTask(ctx, TaskImportSynapse, params)
+}
@@ -24,3 +24,16 @@ func markError(ctx rcontext.RequestContext, task *database.DbTask, errVal error)
 	}
 	ctx.Log.Debugf("Task '%s' flagged with error", task.Name)
 }
+
+func markProgress(ctx rcontext.RequestContext, task *database.DbTask, progress interface{}) {
+	val := &database.AnonymousJson{}
+	if err := val.ApplyFrom(progress); err != nil {
+		ctx.Log.Warn("Error encoding task progress: ", err)
+		return
+	}
+	taskDb := database.GetInstance().Tasks.Prepare(ctx)
+	if err := taskDb.SetProgress(task.TaskId, val); err != nil {
+		ctx.Log.Warn("Error updating task progress: ", err)
+		sentry.CaptureException(err)
+	}
+}
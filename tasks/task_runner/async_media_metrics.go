@@ -0,0 +1,36 @@
+package task_runner
+
+import (
+	"github.com/getsentry/sentry-go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/metrics"
+)
+
+// UpdateAsyncMediaMetrics removes async media placeholders which expired without being uploaded, and updates the
+// metrics for pending and expired placeholders.
+func UpdateAsyncMediaMetrics(ctx rcontext.RequestContext) {
+	db := database.GetInstance().ExpiringMedia.Prepare(ctx)
+
+	expired, err := db.DeleteExpired()
+	if err != nil {
+		ctx.Log.Error("Error removing expired async media: ", err)
+		sentry.CaptureException(err)
+	} else {
+		for origin, count := range expired {
+			metrics.AsyncMediaExpired.With(prometheus.Labels{"origin": origin}).Add(float64(count))
+		}
+	}
+
+	pending, err := db.CountPendingByOrigin()
+	if err != nil {
+		ctx.Log.Error("Error counting pending async media: ", err)
+		sentry.CaptureException(err)
+		return
+	}
+	metrics.AsyncMediaPending.Reset()
+	for origin, count := range pending {
+		metrics.AsyncMediaPending.With(prometheus.Labels{"origin": origin}).Set(float64(count))
+	}
+}
@@ -0,0 +1,59 @@
+package task_runner
+
+import (
+	"errors"
+	"sync/atomic"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+)
+
+// ErrInterrupted is used by tasks which stopped early because Interrupt was called. The task is left unfinished so
+// it can be resumed from its checkpoint.
+var ErrInterrupted = errors.New("task interrupted")
+
+var interrupted = &atomic.Bool{}
+
+// Interrupt asks long-running tasks to save a checkpoint and stop at the next safe point. Interrupted tasks are not
+// marked as done, so they are resumed when unfinished tasks are next scheduled.
+func Interrupt() {
+	interrupted.Store(true)
+}
+
+// ClearInterrupt allows tasks to run to completion again after a call to Interrupt.
+func ClearInterrupt() {
+	interrupted.Store(false)
+}
+
+func isInterrupted() bool {
+	return interrupted.Load()
+}
+
+func saveCheckpoint(ctx rcontext.RequestContext, task *database.DbTask, checkpoint interface{}) {
+	val := &database.AnonymousJson{}
+	if err := val.ApplyFrom(checkpoint); err != nil {
+		ctx.Log.Warn("Error encoding task checkpoint: ", err)
+		sentry.CaptureException(err)
+		return
+	}
+	taskDb := database.GetInstance().Tasks.Prepare(ctx)
+	if err := taskDb.SetCheckpoint(task.TaskId, val); err != nil {
+		ctx.Log.Warn("Error saving task checkpoint: ", err)
+		sentry.CaptureException(err)
+		return
+	}
+	task.Checkpoint = val
+}
+
+// loadCheckpoint decodes the task's last checkpoint into the given value. Returns false if the task has not saved a
+// checkpoint yet.
+func loadCheckpoint(task *database.DbTask, into interface{}) (bool, error) {
+	if task.Checkpoint == nil || len(*task.Checkpoint) == 0 {
+		return false, nil
+	}
+	if err := task.Checkpoint.ApplyTo(into); err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -3,6 +3,7 @@ package task_runner
 import (
 	"errors"
 	"fmt"
+	"time"
 
 	"github.com/getsentry/sentry-go"
 	"github.com/sirupsen/logrus"
@@ -13,13 +14,53 @@ import (
 )
 
 type DatastoreMigrateParams struct {
-	SourceDsId string `json:"source_datastore_id"`
-	TargetDsId string `json:"target_datastore_id"`
-	BeforeTs   int64  `json:"before_ts"`
+	SourceDsId        string `json:"source_datastore_id"`
+	TargetDsId        string `json:"target_datastore_id"`
+	BeforeTs          int64  `json:"before_ts"`
+	UserId            string `json:"user_id,omitempty"`
+	MinSizeBytes      int64  `json:"min_size_bytes,omitempty"`
+	MaxSizeBytes      int64  `json:"max_size_bytes,omitempty"`
+	MaxBytesPerSecond int64  `json:"max_bytes_per_second,omitempty"`
+}
+
+// DatastoreMigrateProgress is stored on the task as the migration runs. If the migration is resumed after a
+// restart, the totals include the objects moved before the restart.
+type DatastoreMigrateProgress struct {
+	TotalObjects  int64 `json:"total_objects"`
+	TotalBytes    int64 `json:"total_bytes"`
+	MovedObjects  int64 `json:"moved_objects"`
+	MovedBytes    int64 `json:"moved_bytes"`
+	FailedObjects int64 `json:"failed_objects"`
+}
+
+// DatastoreMigrateCheckpoint is the work done by the migration so far. Objects which were moved are no longer in
+// the source datastore, so only the counts need to be carried over when resuming.
+type DatastoreMigrateCheckpoint struct {
+	MovedObjects int64 `json:"moved_objects"`
+	MovedBytes   int64 `json:"moved_bytes"`
+}
+
+const migrateProgressInterval = 5 * time.Second
+
+type datastoreMover struct {
+	task       *database.DbTask
+	sourceDs   config.DatastoreConfig
+	targetDs   config.DatastoreConfig
+	bytesPerS  int64
+	progress   *DatastoreMigrateProgress
+	done       map[string]bool
+	startTime  time.Time
+	startBytes int64
+	lastReport time.Time
 }
 
 func DatastoreMigrate(ctx rcontext.RequestContext, task *database.DbTask) {
-	defer markDone(ctx, task)
+	finished := true
+	defer func() {
+		if finished {
+			markDone(ctx, task)
+		}
+	}()
 
 	params := DatastoreMigrateParams{}
 	if err := task.Params.ApplyTo(&params); err != nil {
@@ -50,71 +91,133 @@ func DatastoreMigrate(ctx rcontext.RequestContext, task *database.DbTask) {
 	}
 
 	db := database.GetInstance().MetadataView.Prepare(ctx)
+	filter := database.DatastoreObjectFilter{
+		UserId:       params.UserId,
+		MinSizeBytes: params.MinSizeBytes,
+		MaxSizeBytes: params.MaxSizeBytes,
+	}
 
-	if records, err := db.GetMediaForDatastoreByLastAccess(params.SourceDsId, params.BeforeTs); err != nil {
+	// Only objects still in the source datastore are found, so a resumed migration picks up where it left off
+	media, err := db.GetMediaForDatastoreByLastAccess(params.SourceDsId, params.BeforeTs, filter)
+	if err != nil {
 		markError(ctx, task, errors.Join(errors.New("error in locate"), err))
 		ctx.Log.Error("Error getting movable media: ", err)
 		sentry.CaptureException(err)
 		return
-	} else {
-		moveDatastoreObjects(ctx, records, sourceDs, targetDs)
 	}
-
-	if records, err := db.GetThumbnailsForDatastoreByLastAccess(params.SourceDsId, params.BeforeTs); err != nil {
+	thumbs, err := db.GetThumbnailsForDatastoreByLastAccess(params.SourceDsId, params.BeforeTs, filter)
+	if err != nil {
 		markError(ctx, task, errors.Join(errors.New("error in thumbnails"), err))
 		ctx.Log.Error("Error getting movable thumbnails: ", err)
 		sentry.CaptureException(err)
 		return
-	} else {
-		moveDatastoreObjects(ctx, records, sourceDs, targetDs)
 	}
-}
 
-func moveDatastoreObjects(ctx rcontext.RequestContext, records []*database.VirtLastAccess, sourceDs config.DatastoreConfig, targetDs config.DatastoreConfig) {
-	mediaDb := database.GetInstance().Media.Prepare(ctx)
-	thumbsDb := database.GetInstance().Thumbnails.Prepare(ctx)
-	done := make(map[string]bool)
-	for _, record := range records {
-		doneId := fmt.Sprintf("%s/%s", record.DatastoreId, record.Location)
-		if _, ok := done[doneId]; ok {
-			continue
+	checkpoint := DatastoreMigrateCheckpoint{}
+	if resumed, err := loadCheckpoint(task, &checkpoint); err != nil {
+		ctx.Log.Warn("Error decoding checkpoint - progress will restart from zero: ", err)
+		sentry.CaptureException(err)
+	} else if resumed {
+		ctx.Log.Infof("Resuming migration after %d objects were moved", checkpoint.MovedObjects)
+	}
+
+	mover := &datastoreMover{
+		task:      task,
+		sourceDs:  sourceDs,
+		targetDs:  targetDs,
+		bytesPerS: params.MaxBytesPerSecond,
+		progress: &DatastoreMigrateProgress{
+			TotalObjects: checkpoint.MovedObjects,
+			TotalBytes:   checkpoint.MovedBytes,
+			MovedObjects: checkpoint.MovedObjects,
+			MovedBytes:   checkpoint.MovedBytes,
+		},
+		done:       make(map[string]bool),
+		startTime:  time.Now(),
+		startBytes: checkpoint.MovedBytes,
+	}
+	counted := make(map[string]bool)
+	for _, record := range append(media, thumbs...) {
+		if id := objectId(record); !counted[id] {
+			counted[id] = true
+			mover.progress.TotalObjects++
+			mover.progress.TotalBytes += record.SizeBytes
 		}
+	}
+	markProgress(ctx, task, mover.progress)
 
-		recordCtx := ctx.LogWithFields(logrus.Fields{"sha256": record.Sha256Hash, "dsId": record.DatastoreId, "location": record.Location})
-		recordCtx.Log.Debug("Moving record")
+	err = mover.moveAll(ctx, media)
+	if err == nil {
+		err = mover.moveAll(ctx, thumbs)
+	}
+	markProgress(ctx, task, mover.progress)
+	mover.checkpoint(ctx)
+	if errors.Is(err, ErrInterrupted) {
+		ctx.Log.Info("Migration interrupted - it will resume from its checkpoint")
+		finished = false
+	}
+}
 
-		sourceStream, err := datastores.Download(recordCtx, sourceDs, record.Location)
-		if err != nil {
-			recordCtx.Log.Error("Failed to start download from source: ", err)
-			sentry.CaptureException(err)
-			continue
-		}
+func objectId(record *database.VirtLastAccess) string {
+	return fmt.Sprintf("%s/%s", record.DatastoreId, record.Location)
+}
 
-		newLocation, err := datastores.Upload(recordCtx, targetDs, sourceStream, record.SizeBytes, record.ContentType, record.Sha256Hash)
-		if err != nil {
-			recordCtx.Log.Error("Failed to upload to target: ", err)
-			sentry.CaptureException(err)
-			continue
+func (m *datastoreMover) moveAll(ctx rcontext.RequestContext, records []*database.VirtLastAccess) error {
+	for _, record := range records {
+		if isInterrupted() {
+			return ErrInterrupted
 		}
 
-		if err = mediaDb.UpdateLocation(record.DatastoreId, record.Location, targetDs.Id, newLocation); err != nil {
-			recordCtx.Log.Error("Failed to update media table with new datastore and location: ", err)
-			sentry.CaptureException(err)
+		doneId := objectId(record)
+		if _, ok := m.done[doneId]; ok {
 			continue
 		}
+		m.done[doneId] = true
 
-		if err = thumbsDb.UpdateLocation(record.DatastoreId, record.Location, targetDs.Id, newLocation); err != nil {
-			recordCtx.Log.Error("Failed to update thumbnails table with new datastore and location: ", err)
-			sentry.CaptureException(err)
-			continue
+		if err := moveDatastoreObject(ctx, record, m.sourceDs, m.targetDs); err != nil {
+			m.progress.FailedObjects++
+		} else {
+			m.progress.MovedObjects++
+			m.progress.MovedBytes += record.SizeBytes
 		}
 
-		if err = datastores.Remove(recordCtx, sourceDs, record.Location); err != nil {
-			recordCtx.Log.Error("Failed to remove source object from datastore: ", err)
-			sentry.CaptureException(err)
-			continue
+		if time.Since(m.lastReport) >= migrateProgressInterval {
+			markProgress(ctx, m.task, m.progress)
+			m.checkpoint(ctx)
+			m.lastReport = time.Now()
 		}
+		m.throttle()
+	}
+	return nil
+}
 
-		done[doneId] = true
+func (m *datastoreMover) checkpoint(ctx rcontext.RequestContext) {
+	saveCheckpoint(ctx, m.task, &DatastoreMigrateCheckpoint{
+		MovedObjects: m.progress.MovedObjects,
+		MovedBytes:   m.progress.MovedBytes,
+	})
+}
+
+// throttle sleeps long enough to keep the average transfer rate under the configured limit.
+func (m *datastoreMover) throttle() {
+	if m.bytesPerS <= 0 {
+		return
+	}
+	expected := time.Duration(float64(m.progress.MovedBytes-m.startBytes) / float64(m.bytesPerS) * float64(time.Second))
+	if wait := expected - time.Since(m.startTime); wait > 0 {
+		time.Sleep(wait)
 	}
 }
+
+func moveDatastoreObject(ctx rcontext.RequestContext, record *database.VirtLastAccess, sourceDs config.DatastoreConfig, targetDs config.DatastoreConfig) error {
+	recordCtx := ctx.LogWithFields(logrus.Fields{"sha256": record.Sha256Hash, "dsId": record.DatastoreId, "location": record.Location})
+	recordCtx.Log.Debug("Moving record")
+
+	if _, err := datastores.Move(recordCtx, sourceDs, targetDs, record.Location, record.SizeBytes, record.ContentType, record.Sha256Hash); err != nil {
+		recordCtx.Log.Error("Failed to move record: ", err)
+		sentry.CaptureException(err)
+		return err
+	}
+
+	return nil
+}
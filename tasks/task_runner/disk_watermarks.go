@@ -0,0 +1,71 @@
+package task_runner
+
+import (
+	"github.com/getsentry/sentry-go"
+	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/datastores"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+const emergencyPurgeBatchSize = 100
+const emergencyPurgeMaxBatches = 50
+
+func CheckDiskWatermarks(ctx rcontext.RequestContext) {
+	// dev note: don't use ctx for config lookup to avoid misreading it
+
+	if !config.Get().DiskWatermarks.Enabled {
+		return
+	}
+
+	for _, ds := range config.Get().DataStores {
+		above, used, err := datastores.AboveSoftWatermark(ctx, ds)
+		if err != nil {
+			ctx.Log.Warnf("Unable to determine disk usage of datastore %s: %v", ds.Id, err)
+			continue
+		}
+		if !above {
+			continue
+		}
+
+		dsCtx := ctx.LogWithFields(logrus.Fields{"dsId": ds.Id, "usedPercent": used})
+		dsCtx.Log.Warn("Datastore disk is above the soft watermark - purging least recently accessed remote media")
+		if err = emergencyPurge(dsCtx, ds); err != nil {
+			dsCtx.Log.Error("Error during emergency purge: ", err)
+			sentry.CaptureException(err)
+		}
+	}
+}
+
+// emergencyPurge removes the least recently accessed remote media from the datastore in batches, until the disk is
+// back under the soft watermark or there's nothing left to purge.
+func emergencyPurge(ctx rcontext.RequestContext, ds config.DatastoreConfig) error {
+	mediaDb := database.GetInstance().Media.Prepare(ctx)
+	total := 0
+	for i := 0; i < emergencyPurgeMaxBatches; i++ {
+		records, err := mediaDb.GetRemoteLeastRecentlyAccessed(ds.Id, util.GetOurDomains(), emergencyPurgeBatchSize)
+		if err != nil {
+			return err
+		}
+		removed, err := doPurge(ctx.AsBackground(), records, &purgeConfig{IncludeQuarantined: false})
+		if err != nil {
+			return err
+		}
+		total += len(removed)
+		if len(removed) == 0 {
+			break // everything left is pinned, or there's nothing left
+		}
+
+		above, _, err := datastores.AboveSoftWatermark(ctx, ds)
+		if err != nil {
+			return err
+		}
+		if !above {
+			break
+		}
+	}
+	ctx.Log.Infof("Emergency purge removed %d media records", total)
+	return nil
+}
@@ -6,6 +6,7 @@ import (
 
 	"github.com/getsentry/sentry-go"
 	"github.com/t2bot/matrix-media-repo/archival"
+	"github.com/t2bot/matrix-media-repo/archival/v2archive"
 	"github.com/t2bot/matrix-media-repo/common/rcontext"
 	"github.com/t2bot/matrix-media-repo/database"
 	"github.com/t2bot/matrix-media-repo/datastores"
@@ -14,12 +15,18 @@ import (
 type ExportDataParams struct {
 	UserId        string `json:"user_id,omitempty"`
 	ServerName    string `json:"server_name,omitempty"`
+	RoomId        string `json:"room_id,omitempty"`
 	ExportId      string `json:"export_id"`
 	IncludeS3Urls bool   `json:"include_s3_urls"`
 }
 
 func ExportData(ctx rcontext.RequestContext, task *database.DbTask) {
-	defer markDone(ctx, task)
+	finished := true
+	defer func() {
+		if finished {
+			markDone(ctx, task)
+		}
+	}()
 
 	params := ExportDataParams{}
 	if err := task.Params.ApplyTo(&params); err != nil {
@@ -36,17 +43,29 @@ func ExportData(ctx rcontext.RequestContext, task *database.DbTask) {
 		return
 	}
 
-	exportDb := database.GetInstance().Exports.Prepare(ctx)
-	if existingEntity, err := exportDb.GetEntity(params.ExportId); err != nil {
-		markError(ctx, task, errors.Join(errors.New("error in validate"), err))
-		ctx.Log.Error("Error checking export ID: ", err)
+	checkpoint := &v2archive.ArchiveState{}
+	resumed, err := loadCheckpoint(task, checkpoint)
+	if err != nil {
+		markError(ctx, task, errors.Join(errors.New("error in checkpoint"), err))
+		ctx.Log.Error("Error decoding checkpoint: ", err)
 		sentry.CaptureException(err)
 		return
-	} else if existingEntity != "" {
-		markError(ctx, task, errors.New("export id already in use"))
-		ctx.Log.Error("Export ID already in use")
-		sentry.CaptureMessage("Export ID already in use")
-		return
+	}
+
+	// A resumed export has already claimed its export ID
+	exportDb := database.GetInstance().Exports.Prepare(ctx)
+	if !resumed {
+		if existingEntity, err := exportDb.GetEntity(params.ExportId); err != nil {
+			markError(ctx, task, errors.Join(errors.New("error in validate"), err))
+			ctx.Log.Error("Error checking export ID: ", err)
+			sentry.CaptureException(err)
+			return
+		} else if existingEntity != "" {
+			markError(ctx, task, errors.New("export id already in use"))
+			ctx.Log.Error("Export ID already in use")
+			sentry.CaptureMessage("Export ID already in use")
+			return
+		}
 	}
 
 	entityId := params.UserId
@@ -55,6 +74,14 @@ func ExportData(ctx rcontext.RequestContext, task *database.DbTask) {
 		ctx.Log.Error("Invalid user ID")
 		sentry.CaptureMessage("Invalid user ID")
 		return
+	} else if entityId == "" && params.RoomId != "" {
+		if params.RoomId[0] != '!' {
+			markError(ctx, task, errors.New("invalid room id"))
+			ctx.Log.Error("Invalid room ID")
+			sentry.CaptureMessage("Invalid room ID")
+			return
+		}
+		entityId = params.RoomId
 	} else if entityId == "" {
 		entityId = params.ServerName
 	}
@@ -65,11 +92,15 @@ func ExportData(ctx rcontext.RequestContext, task *database.DbTask) {
 		return
 	}
 
-	if err := exportDb.Insert(params.ExportId, entityId); err != nil {
-		markError(ctx, task, errors.Join(errors.New("error in persist"), err))
-		ctx.Log.Error("Error persisting export ID: ", err)
-		sentry.CaptureException(err)
-		return
+	if !resumed {
+		if err := exportDb.Insert(params.ExportId, entityId); err != nil {
+			markError(ctx, task, errors.Join(errors.New("error in persist"), err))
+			ctx.Log.Error("Error persisting export ID: ", err)
+			sentry.CaptureException(err)
+			return
+		}
+		// Save an empty checkpoint so a restart knows the export ID is ours
+		saveCheckpoint(ctx, task, &v2archive.ArchiveState{Part: 0, Media: make(map[string]*v2archive.ManifestRecord)})
 	}
 
 	partsDb := database.GetInstance().ExportParts.Prepare(ctx)
@@ -99,7 +130,21 @@ func ExportData(ctx rcontext.RequestContext, task *database.DbTask) {
 		return nil
 	}
 
-	if err := archival.ExportEntityData(ctx, params.ExportId, entityId, params.IncludeS3Urls, persistPart); err != nil {
+	checkpointer := &archival.ExportCheckpointer{
+		Save: func(state *v2archive.ArchiveState) {
+			saveCheckpoint(ctx, task, state)
+		},
+		Interrupted: isInterrupted,
+	}
+	if resumed {
+		checkpointer.State = checkpoint
+	}
+	err = archival.ExportEntityDataResumable(ctx, params.ExportId, entityId, params.IncludeS3Urls, persistPart, checkpointer)
+	if errors.Is(err, archival.ErrExportInterrupted) {
+		ctx.Log.Info("Export interrupted - it will resume from its checkpoint")
+		finished = false
+		return
+	} else if err != nil {
 		markError(ctx, task, errors.Join(errors.New("error in archival"), err))
 		ctx.Log.Error("Error during export: ", err)
 		sentry.CaptureException(err)
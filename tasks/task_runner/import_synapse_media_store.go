@@ -0,0 +1,158 @@
+package task_runner
+
+import (
+	"errors"
+	"os"
+
+	"github.com/gabriel-vasile/mimetype"
+	"github.com/getsentry/sentry-go"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/datastores"
+	"github.com/t2bot/matrix-media-repo/homeserver_interop/synapse"
+	"github.com/t2bot/matrix-media-repo/pipelines/pipeline_upload"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+// synapseImportCheckpointEvery is the number of files to process between checkpoints
+const synapseImportCheckpointEvery = 100
+
+type ImportSynapseMediaStoreParams struct {
+	ServerName     string `json:"server_name"`
+	MediaStorePath string `json:"media_store_path"`
+	// SynapseDatabase is an optional connection string for Synapse's database, used to recover the upload name,
+	// content type, and uploader of each file.
+	SynapseDatabase string `json:"synapse_database,omitempty"`
+}
+
+type SynapseImportProgress struct {
+	LastMediaId string `json:"last_media_id"`
+	Imported    int    `json:"imported"`
+	Skipped     int    `json:"skipped"`
+}
+
+func ImportSynapseMediaStore(ctx rcontext.RequestContext, task *database.DbTask) {
+	finished := true
+	defer func() {
+		if finished {
+			markDone(ctx, task)
+		}
+	}()
+
+	params := ImportSynapseMediaStoreParams{}
+	if err := task.Params.ApplyTo(&params); err != nil {
+		markError(ctx, task, errors.Join(errors.New("error in decode"), err))
+		ctx.Log.Error("Error decoding params: ", err)
+		sentry.CaptureException(err)
+		return
+	}
+
+	progress := &SynapseImportProgress{}
+	if resumed, err := loadCheckpoint(task, progress); err != nil {
+		ctx.Log.Warn("Error decoding checkpoint - import will restart from the beginning: ", err)
+		progress = &SynapseImportProgress{}
+	} else if resumed {
+		ctx.Log.Infof("Resuming import after %s", progress.LastMediaId)
+	}
+
+	err := ImportFromSynapseMediaStore(ctx, params, progress, func(p *SynapseImportProgress) {
+		saveCheckpoint(ctx, task, p)
+	}, isInterrupted)
+	if errors.Is(err, ErrInterrupted) {
+		ctx.Log.Info("Import interrupted - it will resume from its checkpoint")
+		finished = false
+		return
+	} else if err != nil {
+		markError(ctx, task, errors.Join(errors.New("error in import"), err))
+		ctx.Log.Error("Error importing media store: ", err)
+		sentry.CaptureException(err)
+		return
+	}
+}
+
+// ImportFromSynapseMediaStore ingests the local media in a Synapse media_store_path, keeping each file's media ID.
+// Media which the media repo already has is skipped. The progress is updated as files are processed, and passed to
+// checkpointFn periodically. If interruptFn returns true, the import stops at the next file with ErrInterrupted.
+func ImportFromSynapseMediaStore(ctx rcontext.RequestContext, params ImportSynapseMediaStoreParams, progress *SynapseImportProgress, checkpointFn func(p *SynapseImportProgress), interruptFn func() bool) error {
+	if params.ServerName == "" || params.MediaStorePath == "" {
+		return errors.New("server name and media store path are required")
+	}
+
+	synMedia := make(map[string]*synapse.LocalMedia)
+	if params.SynapseDatabase != "" {
+		ctx.Log.Debug("Reading media from Synapse's database")
+		hsDb, err := synapse.OpenDatabase(params.SynapseDatabase)
+		if err != nil {
+			return err
+		}
+		records, err := hsDb.GetAllMedia()
+		if err != nil {
+			return err
+		}
+		for _, r := range records {
+			synMedia[r.MediaId] = r
+		}
+	}
+
+	mediaDb := database.GetInstance().Media.Prepare(ctx)
+	processed := 0
+	err := synapse.WalkLocalMediaStore(params.MediaStorePath, func(mediaId string, filePath string) error {
+		if progress.LastMediaId != "" && mediaId <= progress.LastMediaId {
+			return nil // handled before a restart
+		}
+		if interruptFn != nil && interruptFn() {
+			return ErrInterrupted
+		}
+
+		processed++
+		if processed%synapseImportCheckpointEvery == 0 && checkpointFn != nil {
+			checkpointFn(progress)
+		}
+
+		mxc := util.MxcUri(params.ServerName, mediaId)
+		record, err := mediaDb.GetById(params.ServerName, mediaId)
+		if err != nil {
+			return err
+		}
+		if record != nil {
+			ctx.Log.Debugf("Skipping %s - already imported", mxc)
+			progress.Skipped++
+			progress.LastMediaId = mediaId
+			return nil
+		}
+
+		contentType := "application/octet-stream"
+		uploadName := ""
+		userId := ""
+		if r, ok := synMedia[mediaId]; ok {
+			contentType = r.ContentType
+			uploadName = r.UploadName
+			userId = r.UserId
+		} else if mime, err := mimetype.DetectFile(filePath); err == nil {
+			contentType = mime.String()
+		}
+
+		f, err := os.Open(filePath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		ctx.Log.Info("Importing " + mxc)
+		if _, err = pipeline_upload.Execute(ctx, params.ServerName, mediaId, f, contentType, uploadName, userId, datastores.LocalMediaKind, nil); err != nil {
+			return errors.Join(errors.New("error importing "+mxc), err)
+		}
+		progress.Imported++
+		progress.LastMediaId = mediaId
+		return nil
+	})
+	if checkpointFn != nil {
+		checkpointFn(progress)
+	}
+	if err != nil {
+		return err
+	}
+
+	ctx.Log.Infof("Imported %d files from the media store, skipping %d which were already imported", progress.Imported, progress.Skipped)
+	return nil
+}
@@ -0,0 +1,170 @@
+package task_runner
+
+import (
+	"errors"
+	"io"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/moderation"
+	"github.com/t2bot/matrix-media-repo/pipelines/_steps/download"
+	"github.com/t2bot/matrix-media-repo/thumbnailing"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+// moderationBatchSize limits how many queued media are checked per run, so a backlog doesn't hold up the task.
+const moderationBatchSize = 100
+
+const moderationThumbnailSize = 320
+
+// maxModerationRetryDelay caps the exponential backoff between attempts.
+const maxModerationRetryDelay = 6 * time.Hour
+
+// ModerateQueuedMedia asks the moderation policy about media queued after upload, applying its decisions.
+func ModerateQueuedMedia(ctx rcontext.RequestContext) {
+	// dev note: don't use ctx for config lookup to avoid misreading it
+
+	conf := config.Get().Moderation
+	if !conf.Enabled {
+		return
+	}
+
+	queueDb := database.GetInstance().ModerationQueue.Prepare(ctx)
+	items, err := queueDb.GetDue(util.NowMillis(), moderationBatchSize)
+	if err != nil {
+		ctx.Log.Error("Error getting moderation queue: ", err)
+		sentry.CaptureException(err)
+		return
+	}
+
+	policy := moderation.GetPolicy()
+	for _, item := range items {
+		itemCtx := ctx.LogWithFields(logrus.Fields{
+			"origin":  item.Origin,
+			"mediaId": item.MediaId,
+		})
+		if err = moderateQueuedMedia(itemCtx, conf, policy, item); err != nil {
+			itemCtx.Log.Error("Error moderating media: ", err)
+			sentry.CaptureException(err)
+		}
+	}
+}
+
+func moderateQueuedMedia(ctx rcontext.RequestContext, conf config.ModerationConfig, policy moderation.Policy, item *database.DbModerationQueueItem) error {
+	queueDb := database.GetInstance().ModerationQueue.Prepare(ctx)
+	record, err := database.GetInstance().Media.Prepare(ctx).GetById(item.Origin, item.MediaId)
+	if err != nil {
+		return err
+	}
+	if record == nil || record.Quarantined {
+		// Nothing left to moderate
+		return queueDb.Delete(item.Origin, item.MediaId)
+	}
+
+	req := &moderation.Request{
+		Origin:      record.Origin,
+		MediaId:     record.MediaId,
+		UserId:      record.UserId,
+		ContentType: record.ContentType,
+		SizeBytes:   record.SizeBytes,
+		Sha256Hash:  record.Sha256Hash,
+		IsRemote:    !util.IsServerOurs(record.Origin),
+	}
+	if conf.SendThumbnail {
+		addModerationThumbnail(ctx, record, req)
+	}
+
+	attempts := item.Attempts + 1
+	decision, err := policy.Check(ctx, req)
+	if err != nil {
+		if attempts < conf.MaxAttempts {
+			delay := time.Duration(conf.RetryDelaySeconds) * time.Second * time.Duration(1<<min(item.Attempts, 16))
+			delay = min(delay, maxModerationRetryDelay)
+			ctx.Log.Warnf("Moderation attempt %d failed, retrying in %s: %s", attempts, delay, err)
+			return queueDb.SetRetry(item.Origin, item.MediaId, attempts, util.NowMillis()+delay.Milliseconds(), err.Error())
+		}
+
+		ctx.Log.Warnf("Moderation failed after %d attempts - applying fail action '%s': %s", attempts, conf.FailAction, err)
+		if err2 := recordModerationDecision(ctx, policy, record, moderation.ActionFailed, err.Error(), attempts); err2 != nil {
+			return err2
+		}
+		decision = &moderation.Decision{Action: moderation.Action(conf.FailAction), Reason: "moderation failed"}
+		if !moderation.IsAction(decision.Action) {
+			decision.Action = moderation.ActionAllow
+		}
+	} else if err = recordModerationDecision(ctx, policy, record, decision.Action, decision.Reason, attempts); err != nil {
+		return err
+	}
+
+	if err = applyModerationDecision(ctx, record, decision); err != nil {
+		return err
+	}
+	return queueDb.Delete(item.Origin, item.MediaId)
+}
+
+func addModerationThumbnail(ctx rcontext.RequestContext, record *database.DbMedia, req *moderation.Request) {
+	if !thumbnailing.IsSupported(record.ContentType) {
+		return
+	}
+	stream, err := download.OpenStream(ctx, record.Locatable)
+	if err != nil {
+		ctx.Log.Warn("Non-fatal error opening media for moderation thumbnail: ", err)
+		sentry.CaptureException(err)
+		return
+	}
+	thumb, err := thumbnailing.GenerateThumbnail(stream, record.ContentType, moderationThumbnailSize, moderationThumbnailSize, "scale", false, ctx)
+	if err != nil {
+		if !errors.Is(err, thumbnailing.ErrUnsupported) && !errors.Is(err, common.ErrMediaTooLarge) && !errors.Is(err, common.ErrMediaDimensionsTooSmall) {
+			ctx.Log.Warn("Non-fatal error generating moderation thumbnail: ", err)
+			sentry.CaptureException(err)
+		}
+		return
+	}
+	defer thumb.Reader.Close()
+	b, err := io.ReadAll(thumb.Reader)
+	if err != nil {
+		ctx.Log.Warn("Non-fatal error reading moderation thumbnail: ", err)
+		sentry.CaptureException(err)
+		return
+	}
+	req.Thumbnail = b
+	req.ThumbnailContentType = thumb.ContentType
+}
+
+func recordModerationDecision(ctx rcontext.RequestContext, policy moderation.Policy, record *database.DbMedia, action moderation.Action, reason string, attempts int) error {
+	return database.GetInstance().ModerationLog.Prepare(ctx).Insert(&database.DbModerationDecision{
+		Origin:     record.Origin,
+		MediaId:    record.MediaId,
+		Sha256Hash: record.Sha256Hash,
+		Policy:     policy.Name(),
+		Action:     string(action),
+		Reason:     reason,
+		Attempts:   attempts,
+		DecidedTs:  util.NowMillis(),
+	})
+}
+
+func applyModerationDecision(ctx rcontext.RequestContext, record *database.DbMedia, decision *moderation.Decision) error {
+	ctx = ctx.LogWithFields(logrus.Fields{
+		"action": decision.Action,
+		"reason": decision.Reason,
+	})
+	switch decision.Action {
+	case moderation.ActionQuarantine:
+		count, err := QuarantineMedia(ctx, "", &QuarantineThis{DbMedia: []*database.DbMedia{record}, Reason: decision.Reason})
+		ctx.Log.Infof("Quarantined %d media records due to moderation decision", count)
+		return err
+	case moderation.ActionDelete:
+		removed, err := PurgeMedia(ctx, &PurgeAuthContext{}, []*QuarantineThis{{DbMedia: []*database.DbMedia{record}}})
+		ctx.Log.Infof("Purged %d media records due to moderation decision", len(removed))
+		return err
+	default:
+		ctx.Log.Debug("Media allowed by moderation policy")
+		return nil
+	}
+}
@@ -8,11 +8,21 @@ import (
 	"github.com/t2bot/matrix-media-repo/common/rcontext"
 	"github.com/t2bot/matrix-media-repo/database"
 	"github.com/t2bot/matrix-media-repo/datastores"
+	"github.com/t2bot/matrix-media-repo/events"
+	"github.com/t2bot/matrix-media-repo/pipelines/_steps/download"
 	"github.com/t2bot/matrix-media-repo/util"
 )
 
 type purgeConfig struct {
 	IncludeQuarantined bool
+	// Retention is set by automatic retention purges, which don't remove emoji
+	Retention bool
+	// DryRun works out what would be purged without changing anything
+	DryRun bool
+	// FreedBytes is populated with the size of the datastore files which were (or would be) deleted
+	FreedBytes int64
+	// FreedBytesByDatastore breaks FreedBytes down by datastore ID
+	FreedBytesByDatastore map[string]int64
 }
 
 type PurgeAuthContext struct {
@@ -31,12 +41,19 @@ func (c *PurgeAuthContext) canAffect(media *database.DbMedia) bool {
 }
 
 func PurgeMedia(ctx rcontext.RequestContext, authContext *PurgeAuthContext, toHandles []*QuarantineThis) ([]string, error) {
+	mxcs, _, err := PurgeMediaWithReport(ctx, authContext, toHandles, false)
+	return mxcs, err
+}
+
+// PurgeMediaWithReport is like PurgeMedia, but also returns the number of bytes freed from the datastores. When
+// dryRun is true, nothing is purged and the results describe what would have been purged instead.
+func PurgeMediaWithReport(ctx rcontext.RequestContext, authContext *PurgeAuthContext, toHandles []*QuarantineThis, dryRun bool) ([]string, int64, error) {
 	records := make([]*database.DbMedia, 0)
 
 	for _, toHandle := range toHandles {
 		record, err := resolveMedia(ctx, "", toHandle)
 		if err != nil {
-			return nil, err
+			return nil, 0, err
 		}
 
 		records = append(records, record...)
@@ -45,12 +62,14 @@ func PurgeMedia(ctx rcontext.RequestContext, authContext *PurgeAuthContext, toHa
 	// Check auth on all records before actually processing them
 	for _, r := range records {
 		if !authContext.canAffect(r) {
-			return nil, common.ErrWrongUser
+			return nil, 0, common.ErrWrongUser
 		}
 	}
 
 	// Now we process all the records
-	return doPurge(ctx.AsBackground(), records, &purgeConfig{IncludeQuarantined: true})
+	conf := &purgeConfig{IncludeQuarantined: true, DryRun: dryRun}
+	removed, err := doPurge(ctx.AsBackground(), records, conf)
+	return removed, conf.FreedBytes, err
 }
 
 func doPurge(ctx rcontext.RequestContext, records []*database.DbMedia, config *purgeConfig) ([]string, error) {
@@ -73,6 +92,9 @@ func doPurge(ctx rcontext.RequestContext, records []*database.DbMedia, config *p
 		if attrs != nil && attrs.Purpose == database.PurposePinned {
 			continue
 		}
+		if attrs != nil && attrs.Purpose == database.PurposeEmoji && config.Retention {
+			continue
+		}
 
 		records2 = append(records2, r)
 	}
@@ -172,7 +194,7 @@ func doPurge(ctx rcontext.RequestContext, records []*database.DbMedia, config *p
 	ctx.Log.Debug("Stage 3 of purge")
 	deletedLocations := make(map[string]bool)
 	removedMxcs := make([]string, 0)
-	tryRemoveDsFile := func(datastoreId string, location string) error {
+	tryRemoveDsFile := func(datastoreId string, location string, sizeBytes int64) error {
 		locationId := fmt.Sprintf("%s/%s", datastoreId, location)
 		if _, ok := deletedLocations[locationId]; ok {
 			return nil // already deleted/handled
@@ -188,19 +210,35 @@ func doPurge(ctx rcontext.RequestContext, records []*database.DbMedia, config *p
 		}
 
 		// Try deleting the file
-		err := datastores.RemoveWithDsId(ctx, datastoreId, location)
-		if err != nil {
-			return err
+		if !config.DryRun {
+			err := datastores.RemoveWithDsId(ctx, datastoreId, location)
+			if err != nil {
+				return err
+			}
 		}
 		deletedLocations[locationId] = true
+		config.FreedBytes += sizeBytes
+		if config.FreedBytesByDatastore == nil {
+			config.FreedBytesByDatastore = make(map[string]int64)
+		}
+		config.FreedBytesByDatastore[datastoreId] += sizeBytes
 		return nil
 	}
 	for _, r := range records {
 		mxc := util.MxcUri(r.Origin, r.MediaId)
 
-		if err := tryRemoveDsFile(r.DatastoreId, r.Location); err != nil {
+		if err := tryRemoveDsFile(r.DatastoreId, r.Location, r.SizeBytes); err != nil {
 			return nil, err
 		}
+		if config.DryRun {
+			removedMxcs = append(removedMxcs, mxc)
+			for _, t := range thumbsMap[mxc] {
+				if err := tryRemoveDsFile(t.DatastoreId, t.Location, t.SizeBytes); err != nil {
+					return nil, err
+				}
+			}
+			continue
+		}
 		if util.IsServerOurs(r.Origin) {
 			if err := reservedDb.InsertNoConflict(r.Origin, r.MediaId, "purged / deleted"); err != nil {
 				return nil, err
@@ -212,13 +250,15 @@ func doPurge(ctx rcontext.RequestContext, records []*database.DbMedia, config *p
 			}
 		}
 		removedMxcs = append(removedMxcs, mxc)
+		events.Emit(ctx, events.MediaPurged, r)
+		download.InvalidateMedia(ctx, r.Origin, r.MediaId, r.Sha256Hash)
 
 		// Remove the thumbnails too
 		if thumbs, ok := thumbsMap[mxc]; !ok {
 			return nil, errors.New("logic error: missing thumbnails for MXC URI in third step")
 		} else {
 			for _, t := range thumbs {
-				if err := tryRemoveDsFile(t.DatastoreId, t.Location); err != nil {
+				if err := tryRemoveDsFile(t.DatastoreId, t.Location, t.SizeBytes); err != nil {
 					return nil, err
 				}
 				if err := thumbsDb.Delete(t); err != nil {
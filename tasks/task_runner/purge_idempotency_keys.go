@@ -0,0 +1,54 @@
+package task_runner
+
+import (
+	"os"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/pipelines/_steps/upload"
+)
+
+func PurgeIdempotencyKeys(ctx rcontext.RequestContext) {
+	// dev note: don't use ctx for config lookup to avoid misreading it
+
+	db := database.GetInstance().IdempotencyKeys.Prepare(ctx)
+
+	if err := db.DeleteExpired(); err != nil {
+		ctx.Log.Error("Error deleting expired idempotency keys: ", err)
+		sentry.CaptureException(err)
+	}
+
+	partialsDb := database.GetInstance().UploadPartials.Prepare(ctx)
+	partials, err := partialsDb.GetExpired()
+	if err != nil {
+		ctx.Log.Error("Error getting expired partial uploads: ", err)
+		sentry.CaptureException(err)
+		return
+	}
+	for _, partial := range partials {
+		// The file may live on another instance's disk, in which case that instance's sweep below cleans it up
+		if err = os.Remove(partial.Location); err != nil && !os.IsNotExist(err) {
+			ctx.Log.Warn("Error deleting expired partial upload: ", err)
+			sentry.CaptureException(err)
+			continue
+		}
+		if err = partialsDb.Delete(partial.UserId, partial.Key); err != nil {
+			ctx.Log.Error("Error deleting expired partial upload record: ", err)
+			sentry.CaptureException(err)
+		}
+	}
+
+	// Never sweep recently written files, in case resumable uploads were disabled while one was in progress
+	window := time.Duration(config.Get().Uploads.IdempotencySeconds) * time.Second
+	if window < time.Hour {
+		window = time.Hour
+	}
+	before := time.Now().Add(-1 * window)
+	if err = upload.PurgeStalePartialFiles(before); err != nil {
+		ctx.Log.Error("Error deleting stale partial upload files: ", err)
+		sentry.CaptureException(err)
+	}
+}
@@ -0,0 +1,79 @@
+package task_runner
+
+import (
+	"github.com/getsentry/sentry-go"
+	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+func PurgeOriginCacheOverages(ctx rcontext.RequestContext) {
+	// dev note: don't use ctx for config lookup to avoid misreading it
+
+	limits := config.Get().Downloads.PerOriginCache
+	if limits.MaxBytes <= 0 && len(limits.Overrides) == 0 {
+		return
+	}
+
+	usage, err := database.GetInstance().MetadataView.Prepare(ctx).RemoteOriginUsage(util.GetOurDomains())
+	if err != nil {
+		ctx.Log.Error("Error getting remote origin usage: ", err)
+		sentry.CaptureException(err)
+		return
+	}
+
+	for _, u := range usage {
+		limit := limits.LimitFor(u.Origin)
+		if limit <= 0 || u.SizeBytes <= limit {
+			continue
+		}
+
+		octx := ctx.LogWithFields(logrus.Fields{"origin": u.Origin, "usedBytes": u.SizeBytes, "limitBytes": limit})
+		count, err := PurgeOriginLeastRecentlyUsed(octx, u.Origin, u.SizeBytes-limit)
+		if err != nil {
+			octx.Log.Error("Error purging media for origin over its cache limit: ", err)
+			sentry.CaptureException(err)
+			continue
+		}
+		octx.Log.Infof("Purged %d media records to bring origin under its cache limit", count)
+	}
+}
+
+// PurgeOriginLeastRecentlyUsed purges the least recently accessed media for an origin until at least excessBytes
+// of media records are removed. Quarantined, pinned, and emoji media are never purged. Returns (count affected, error).
+func PurgeOriginLeastRecentlyUsed(ctx rcontext.RequestContext, origin string, excessBytes int64) (int, error) {
+	mediaDb := database.GetInstance().Media.Prepare(ctx)
+	attrsDb := database.GetInstance().MediaAttributes.Prepare(ctx)
+
+	candidates, err := mediaDb.GetByOriginLeastRecentlyAccessed(origin)
+	if err != nil {
+		return 0, err
+	}
+
+	records := make([]*database.DbMedia, 0)
+	selectedBytes := int64(0)
+	for _, r := range candidates {
+		if selectedBytes >= excessBytes {
+			break
+		}
+		// doPurge skips pinned media and emoji too, but we need to know about it here so we don't undercount
+		attrs, err := attrsDb.Get(r.Origin, r.MediaId)
+		if err != nil {
+			return 0, err
+		}
+		if attrs != nil && (attrs.Purpose == database.PurposePinned || attrs.Purpose == database.PurposeEmoji) {
+			continue
+		}
+		records = append(records, r)
+		selectedBytes += r.SizeBytes
+	}
+
+	removed, err := doPurge(ctx.AsBackground(), records, &purgeConfig{IncludeQuarantined: false, Retention: true})
+	if err != nil {
+		return 0, err
+	}
+
+	return len(removed), nil
+}
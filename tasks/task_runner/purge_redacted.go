@@ -0,0 +1,92 @@
+package task_runner
+
+import (
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/references"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+// PurgeRedactedMedia drops the references held by the redacted event, then purges (or quarantines) any media
+// which is no longer referenced elsewhere. Caller-supplied MXC URIs without any recorded references (such as media
+// uploaded before references were tracked) are never purged: they are quarantined instead, so a redaction can't
+// delete media the repo knows nothing about. Returns the affected MXC URIs.
+func PurgeRedactedMedia(ctx rcontext.RequestContext, roomId string, eventId string, mxcs []string, quarantine bool) ([]string, error) {
+	refsDb := database.GetInstance().MediaReferences.Prepare(ctx)
+
+	refs, err := refsDb.GetForEvent(roomId, eventId)
+	if err != nil {
+		return nil, err
+	}
+	candidates := make([]string, 0)
+	for _, ref := range refs {
+		candidates = append(candidates, util.MxcUri(ref.Origin, ref.MediaId))
+	}
+	unrecorded := make([]string, 0)
+	for _, mxc := range mxcs {
+		origin, mediaId, err := util.SplitMxc(mxc)
+		if err != nil {
+			return nil, err
+		}
+		if util.ArrayContains(candidates, mxc) || util.ArrayContains(unrecorded, mxc) {
+			continue
+		}
+		// Media referenced elsewhere stays referenced after this event's references are dropped, so only media
+		// without any references at all needs handling.
+		referenced, err := references.IsMediaReferenced(ctx, origin, mediaId)
+		if err != nil {
+			return nil, err
+		}
+		if !referenced {
+			ctx.Log.Infof("No references recorded for %s - quarantining instead of purging", mxc)
+			unrecorded = append(unrecorded, mxc)
+		}
+	}
+
+	if err = refsDb.DeleteForEvent(roomId, eventId); err != nil {
+		return nil, err
+	}
+
+	unreferenced := make([]string, 0)
+	for _, mxc := range candidates {
+		if util.ArrayContains(unreferenced, mxc) {
+			continue
+		}
+		origin, mediaId, _ := util.SplitMxc(mxc)
+		referenced, err := references.IsMediaReferenced(ctx, origin, mediaId)
+		if err != nil {
+			return nil, err
+		}
+		if !referenced {
+			unreferenced = append(unreferenced, mxc)
+		}
+	}
+
+	if quarantine {
+		unreferenced = append(unreferenced, unrecorded...)
+		unrecorded = nil
+	}
+	if len(unrecorded) > 0 {
+		_, err = QuarantineMedia(ctx, "", &QuarantineThis{MxcUris: unrecorded, Reason: "redacted"})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(unreferenced) == 0 {
+		return unrecorded, nil
+	}
+
+	if quarantine {
+		_, err = QuarantineMedia(ctx, "", &QuarantineThis{MxcUris: unreferenced, Reason: "redacted"})
+		if err != nil {
+			return nil, err
+		}
+		return unreferenced, nil
+	}
+
+	purged, err := PurgeMedia(ctx, &PurgeAuthContext{}, []*QuarantineThis{{MxcUris: unreferenced}})
+	if err != nil {
+		return nil, err
+	}
+	return append(purged, unrecorded...), nil
+}
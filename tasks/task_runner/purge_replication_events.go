@@ -0,0 +1,22 @@
+package task_runner
+
+import (
+	"github.com/getsentry/sentry-go"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+// PurgeReplicationEvents drops changes which are older than replicas are expected to fall behind by.
+func PurgeReplicationEvents(ctx rcontext.RequestContext) {
+	days := config.Get().Replication.KeepChangesDays
+	if days <= 0 {
+		return
+	}
+	beforeTs := util.NowMillis() - int64(days)*24*60*60*1000
+	if err := database.GetInstance().ReplicationLog.Prepare(ctx).DeleteOlderThan(beforeTs); err != nil {
+		ctx.Log.Error("Error deleting old replication events: ", err)
+		sentry.CaptureException(err)
+	}
+}
@@ -0,0 +1,84 @@
+package task_runner
+
+import (
+	"github.com/getsentry/sentry-go"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/references"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+func PurgeUnreferencedMedia(ctx rcontext.RequestContext) {
+	// dev note: don't use ctx for config lookup to avoid misreading it
+
+	if config.Get().References.PurgeUnreferencedAfterHours <= 0 {
+		return
+	}
+
+	beforeTs := util.NowMillis() - int64(config.Get().References.PurgeUnreferencedAfterHours*60*60*1000)
+	_, err := PurgeUnreferencedMediaBefore(ctx, beforeTs)
+	if err != nil {
+		ctx.Log.Error("Error purging unreferenced media: ", err)
+		sentry.CaptureException(err)
+	}
+}
+
+// ListPurgeableUnreferencedMedia returns the MXC URIs which PurgeUnreferencedMediaBefore would purge, without
+// changing anything.
+func ListPurgeableUnreferencedMedia(ctx rcontext.RequestContext, beforeTs int64) ([]string, error) {
+	_, mxcs, err := findPurgeableUnreferencedMedia(ctx, beforeTs)
+	return mxcs, err
+}
+
+// PurgeUnreferencedMediaBefore returns (count affected, error)
+func PurgeUnreferencedMediaBefore(ctx rcontext.RequestContext, beforeTs int64) (int, error) {
+	records, mxcs, err := findPurgeableUnreferencedMedia(ctx, beforeTs)
+	if err != nil {
+		return 0, err
+	}
+
+	removed, err := PurgeMedia(ctx, &PurgeAuthContext{}, []*QuarantineThis{{MxcUris: mxcs}})
+	if err != nil {
+		return 0, err
+	}
+
+	unreferencedDb := database.GetInstance().Unreferenced.Prepare(ctx)
+	for _, r := range records {
+		if err = unreferencedDb.Delete(r.Origin, r.MediaId); err != nil {
+			return len(removed), err
+		}
+	}
+
+	return len(removed), nil
+}
+
+func findPurgeableUnreferencedMedia(ctx rcontext.RequestContext, beforeTs int64) ([]*database.DbUnreferencedMedia, []string, error) {
+	records, err := database.GetInstance().Unreferenced.Prepare(ctx).GetOlderThan(beforeTs)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	attrsDb := database.GetInstance().MediaAttributes.Prepare(ctx)
+	mxcs := make([]string, 0)
+	for _, r := range records {
+		// Emoji are often only referenced by room state, so are exempt from retention
+		attrs, err := attrsDb.Get(r.Origin, r.MediaId)
+		if err != nil {
+			return nil, nil, err
+		}
+		if attrs != nil && attrs.Purpose == database.PurposeEmoji {
+			continue
+		}
+
+		// The media might have picked up a new reference since it was flagged
+		referenced, err := references.IsMediaReferenced(ctx, r.Origin, r.MediaId)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !referenced {
+			mxcs = append(mxcs, util.MxcUri(r.Origin, r.MediaId))
+		}
+	}
+	return records, mxcs, nil
+}
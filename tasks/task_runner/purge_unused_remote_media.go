@@ -0,0 +1,57 @@
+package task_runner
+
+import (
+	"github.com/getsentry/sentry-go"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+type RemotePurgeReport struct {
+	Affected              []string         `json:"affected"`
+	FreedBytes            int64            `json:"freed_bytes"`
+	FreedBytesByDatastore map[string]int64 `json:"freed_bytes_by_datastore"`
+}
+
+func PurgeUnusedRemoteMedia(ctx rcontext.RequestContext) {
+	// dev note: don't use ctx for config lookup to avoid misreading it
+
+	if config.Get().Downloads.ExpireNotAccessedDays <= 0 {
+		return
+	}
+
+	accessedBeforeTs := util.NowMillis() - int64(config.Get().Downloads.ExpireNotAccessedDays*24*60*60*1000)
+	report, err := PurgeRemoteMediaNotAccessedSince(ctx, accessedBeforeTs, false)
+	if err != nil {
+		ctx.Log.Error("Error purging media: ", err)
+		sentry.CaptureException(err)
+		return
+	}
+	for datastoreId, freed := range report.FreedBytesByDatastore {
+		ctx.Log.Infof("Reclaimed %d bytes from datastore %s by purging unused remote media", freed, datastoreId)
+	}
+}
+
+// PurgeRemoteMediaNotAccessedSince purges cached remote media which hasn't been accessed since accessedBeforeTs. When
+// dryRun is true, nothing is purged and the report describes what would have been purged instead.
+func PurgeRemoteMediaNotAccessedSince(ctx rcontext.RequestContext, accessedBeforeTs int64, dryRun bool) (*RemotePurgeReport, error) {
+	mediaDb := database.GetInstance().Media.Prepare(ctx)
+
+	records, err := mediaDb.GetRemoteNotAccessedSince(util.GetOurDomains(), accessedBeforeTs)
+	if err != nil {
+		return nil, err
+	}
+
+	conf := &purgeConfig{IncludeQuarantined: false, Retention: true, DryRun: dryRun, FreedBytesByDatastore: make(map[string]int64)}
+	removed, err := doPurge(ctx.AsBackground(), records, conf)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RemotePurgeReport{
+		Affected:              removed,
+		FreedBytes:            conf.FreedBytes,
+		FreedBytesByDatastore: conf.FreedBytesByDatastore,
+	}, nil
+}
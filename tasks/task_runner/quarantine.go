@@ -4,6 +4,8 @@ import (
 	"github.com/getsentry/sentry-go"
 	"github.com/t2bot/matrix-media-repo/common/rcontext"
 	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/events"
+	"github.com/t2bot/matrix-media-repo/pipelines/_steps/download"
 	"github.com/t2bot/matrix-media-repo/redislib"
 	"github.com/t2bot/matrix-media-repo/util"
 )
@@ -17,8 +19,18 @@ type QuarantineThis struct {
 	MxcUris []string
 	Single  *QuarantineRecord
 	DbMedia []*database.DbMedia
+
+	// Actor is the user ID who requested the action, or empty if the media repo decided on its own.
+	Actor  string
+	Reason string
 }
 
+const (
+	QuarantineActionQuarantine = "quarantine"
+	QuarantineActionApprove    = "approve"
+	QuarantineActionPurge      = "purge"
+)
+
 // QuarantineMedia returns (count quarantined, error)
 func QuarantineMedia(ctx rcontext.RequestContext, onlyHost string, toHandle *QuarantineThis) (int64, error) {
 	records, err := resolveMedia(ctx, onlyHost, toHandle) // records are roughly safe to rely on host-wise
@@ -43,6 +55,9 @@ func QuarantineMedia(ctx rcontext.RequestContext, onlyHost string, toHandle *Qua
 		if err != nil {
 			return total, err
 		}
+		events.Emit(ctx, events.MediaQuarantined, r)
+		download.InvalidateMedia(ctx, r.Origin, r.MediaId, r.Sha256Hash)
+		RecordQuarantineAction(ctx, r, QuarantineActionQuarantine, toHandle.Actor, toHandle.Reason)
 
 		err = redislib.DeleteMedia(ctx, r.Sha256Hash)
 		if err != nil {
@@ -54,6 +69,55 @@ func QuarantineMedia(ctx rcontext.RequestContext, onlyHost string, toHandle *Qua
 	return total, nil
 }
 
+// UnquarantineMedia lifts the quarantine from the media (and anything sharing its hash), returning the count of
+// records released. Banned hashes are not unbanned, so future uploads of the same content are still quarantined.
+func UnquarantineMedia(ctx rcontext.RequestContext, onlyHost string, toHandle *QuarantineThis) (int64, error) {
+	records, err := resolveMedia(ctx, onlyHost, toHandle)
+	if err != nil {
+		return 0, err
+	}
+
+	metadataDb := database.GetInstance().MetadataView.Prepare(ctx)
+	total := int64(0)
+	for _, r := range records {
+		if onlyHost != "" && onlyHost != r.Origin {
+			continue
+		}
+
+		count := int64(0)
+		if onlyHost != "" {
+			count, err = metadataDb.UpdateQuarantineByHashAndOrigin(r.Origin, r.Sha256Hash, false)
+		} else {
+			count, err = metadataDb.UpdateQuarantineByHash(r.Sha256Hash, false)
+		}
+		total += count
+		if err != nil {
+			return total, err
+		}
+		RecordQuarantineAction(ctx, r, QuarantineActionApprove, toHandle.Actor, toHandle.Reason)
+	}
+
+	return total, nil
+}
+
+// RecordQuarantineAction adds the action to the media's quarantine history. Failures are logged, but not returned,
+// as the action itself has already happened.
+func RecordQuarantineAction(ctx rcontext.RequestContext, record *database.DbMedia, action string, actor string, reason string) {
+	err := database.GetInstance().QuarantineLog.Prepare(ctx).Insert(&database.DbQuarantineAction{
+		Origin:     record.Origin,
+		MediaId:    record.MediaId,
+		Sha256Hash: record.Sha256Hash,
+		Action:     action,
+		Reason:     reason,
+		Actor:      actor,
+		ActionTs:   util.NowMillis(),
+	})
+	if err != nil {
+		ctx.Log.Warn("Non-fatal error recording quarantine action: ", err)
+		sentry.CaptureException(err)
+	}
+}
+
 func resolveMedia(ctx rcontext.RequestContext, onlyHost string, toHandle *QuarantineThis) ([]*database.DbMedia, error) {
 	db := database.GetInstance().Media.Prepare(ctx)
 
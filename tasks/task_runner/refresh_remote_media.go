@@ -0,0 +1,92 @@
+package task_runner
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/datastores"
+	"github.com/t2bot/matrix-media-repo/errcache"
+	"github.com/t2bot/matrix-media-repo/pipelines/_steps/download"
+	"github.com/t2bot/matrix-media-repo/redislib"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+// RefreshRemoteMedia downloads the remote media from its origin again, replacing the local copy. Thumbnails of the
+// media are removed so they are generated from the new copy. If the origin can't provide the media, the existing
+// copy is kept and the error is returned.
+func RefreshRemoteMedia(ctx rcontext.RequestContext, record *database.DbMedia) (*database.DbMedia, error) {
+	if util.IsServerOurs(record.Origin) {
+		return nil, errors.New("cannot refresh local media")
+	}
+	if record.Quarantined {
+		return nil, common.ErrMediaQuarantined
+	}
+
+	mediaDb := database.GetInstance().Media.Prepare(ctx)
+	thumbsDb := database.GetInstance().Thumbnails.Prepare(ctx)
+
+	// Forget any earlier failure so the origin is asked again
+	errcache.DownloadErrors.Delete(fmt.Sprintf("%s/%s", record.Origin, record.MediaId))
+
+	// The download stores a new record under the same media ID, so the old one has to go first. The old file stays
+	// in place until the new copy is stored, in case it has to be restored.
+	if err := mediaDb.Delete(record.Origin, record.MediaId); err != nil {
+		return nil, err
+	}
+	newRecord, stream, err := download.TryDownload(ctx, record.Origin, record.MediaId)
+	if err != nil {
+		ctx.Log.Warn("Error re-downloading media - restoring the old copy: ", err)
+		if err2 := mediaDb.Insert(record); err2 != nil {
+			ctx.Log.Error("Error restoring media record: ", err2)
+			sentry.CaptureException(err2)
+			return nil, errors.Join(err, err2)
+		}
+		return nil, err
+	}
+	_ = stream.Close()
+
+	thumbs, err := thumbsDb.GetForMedia(record.Origin, record.MediaId)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range thumbs {
+		if err = thumbsDb.Delete(t); err != nil {
+			return nil, err
+		}
+		if err = removeIfUnused(ctx, t.DatastoreId, t.Location); err != nil {
+			return nil, err
+		}
+	}
+	if newRecord.DatastoreId != record.DatastoreId || newRecord.Location != record.Location {
+		if err = removeIfUnused(ctx, record.DatastoreId, record.Location); err != nil {
+			return nil, err
+		}
+	}
+
+	// The cache is keyed by hash, so the old content only needs evicting if the content changed
+	if newRecord.Sha256Hash != record.Sha256Hash {
+		if err = redislib.DeleteMedia(ctx, record.Sha256Hash); err != nil {
+			ctx.Log.Warn("Non-fatal error evicting old media from the cache: ", err)
+			sentry.CaptureException(err)
+		}
+	}
+
+	return newRecord, nil
+}
+
+// removeIfUnused deletes the datastore file if no media or thumbnails still use it.
+func removeIfUnused(ctx rcontext.RequestContext, datastoreId string, location string) error {
+	exists, err := database.GetInstance().Media.Prepare(ctx).LocationExists(datastoreId, location)
+	if err != nil || exists {
+		return err
+	}
+	exists, err = database.GetInstance().Thumbnails.Prepare(ctx).LocationExists(datastoreId, location)
+	if err != nil || exists {
+		return err
+	}
+	return datastores.RemoveWithDsId(ctx, datastoreId, location)
+}
@@ -0,0 +1,141 @@
+package task_runner
+
+import (
+	"errors"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+// maxReportedMxcs limits how many MXC URIs are listed in each section of the report. The counts are always complete.
+const maxReportedMxcs = 100
+
+type RepairReferencesParams struct {
+	// DryRun reports problems without changing anything.
+	DryRun bool `json:"dry_run"`
+	// FlagUnreferenced flags local media which has never been referenced for the garbage collector.
+	FlagUnreferenced bool `json:"flag_unreferenced"`
+}
+
+// RepairReferencesReport is stored as the task's progress.
+type RepairReferencesReport struct {
+	DryRun bool `json:"dry_run"`
+
+	// References to local media which doesn't exist, and isn't waiting to be uploaded. These are removed.
+	DanglingReferences int      `json:"dangling_references"`
+	DanglingMedia      []string `json:"dangling_media"`
+
+	// Media flagged for the garbage collector which has been referenced again, or no longer exists. The flags are
+	// removed.
+	StaleFlags     int      `json:"stale_flags"`
+	StaleFlagMedia []string `json:"stale_flag_media"`
+
+	// Local media without any references which isn't flagged for the garbage collector. These are only flagged if
+	// requested.
+	UnflaggedMedia      int      `json:"unflagged_media"`
+	UnflaggedMediaMxcs  []string `json:"unflagged_media_mxcs"`
+	FlaggedUnreferenced bool     `json:"flagged_unreferenced"`
+}
+
+func RepairReferences(ctx rcontext.RequestContext, task *database.DbTask) {
+	defer markDone(ctx, task)
+
+	params := RepairReferencesParams{}
+	if err := task.Params.ApplyTo(&params); err != nil {
+		markError(ctx, task, errors.Join(errors.New("error in decode"), err))
+		ctx.Log.Error("Error decoding params: ", err)
+		sentry.CaptureException(err)
+		return
+	}
+
+	report, err := RepairReferenceIntegrity(ctx, params)
+	if report != nil {
+		markProgress(ctx, task, report)
+	}
+	if err != nil {
+		markError(ctx, task, errors.Join(errors.New("error in repair"), err))
+		ctx.Log.Error("Error repairing references: ", err)
+		sentry.CaptureException(err)
+		return
+	}
+	ctx.Log.Infof("Reference integrity: %d dangling references, %d stale flags, %d unflagged media (dry run: %t)", report.DanglingReferences, report.StaleFlags, report.UnflaggedMedia, report.DryRun)
+}
+
+// RepairReferenceIntegrity finds (and unless it's a dry run, repairs) references and garbage collector flags which
+// don't agree with the media which exists. The report is returned even if an error is encountered partway through.
+func RepairReferenceIntegrity(ctx rcontext.RequestContext, params RepairReferencesParams) (*RepairReferencesReport, error) {
+	report := &RepairReferencesReport{
+		DryRun:             params.DryRun,
+		DanglingMedia:      make([]string, 0),
+		StaleFlagMedia:     make([]string, 0),
+		UnflaggedMediaMxcs: make([]string, 0),
+	}
+	origins := util.GetOurDomains()
+	refsDb := database.GetInstance().MediaReferences.Prepare(ctx)
+	unreferencedDb := database.GetInstance().Unreferenced.Prepare(ctx)
+
+	// Step 1: References to media which doesn't exist
+	dangling, err := refsDb.GetDangling(origins)
+	if err != nil {
+		return report, err
+	}
+	report.DanglingReferences = len(dangling)
+	seen := make(map[string]bool)
+	for _, ref := range dangling {
+		mxc := util.MxcUri(ref.Origin, ref.MediaId)
+		if seen[mxc] {
+			continue
+		}
+		seen[mxc] = true
+		if len(report.DanglingMedia) < maxReportedMxcs {
+			report.DanglingMedia = append(report.DanglingMedia, mxc)
+		}
+		if !params.DryRun {
+			if _, err = refsDb.DeleteAllForMedia(ref.Origin, ref.MediaId); err != nil {
+				return report, err
+			}
+		}
+	}
+
+	// Step 2: Garbage collector flags which no longer apply
+	stale, err := unreferencedDb.GetStale()
+	if err != nil {
+		return report, err
+	}
+	report.StaleFlags = len(stale)
+	for _, record := range stale {
+		if len(report.StaleFlagMedia) < maxReportedMxcs {
+			report.StaleFlagMedia = append(report.StaleFlagMedia, util.MxcUri(record.Origin, record.MediaId))
+		}
+		if !params.DryRun {
+			if err = unreferencedDb.Delete(record.Origin, record.MediaId); err != nil {
+				return report, err
+			}
+		}
+	}
+
+	// Step 3: Media without references which the garbage collector doesn't know about
+	unflagged, err := unreferencedDb.GetUnflagged(origins)
+	if err != nil {
+		return report, err
+	}
+	report.UnflaggedMedia = len(unflagged)
+	for _, record := range unflagged {
+		if len(report.UnflaggedMediaMxcs) < maxReportedMxcs {
+			report.UnflaggedMediaMxcs = append(report.UnflaggedMediaMxcs, util.MxcUri(record.Origin, record.MediaId))
+		}
+	}
+	if params.FlagUnreferenced && !params.DryRun {
+		now := util.NowMillis()
+		for _, record := range unflagged {
+			if err = unreferencedDb.Upsert(record.Origin, record.MediaId, now); err != nil {
+				return report, err
+			}
+		}
+		report.FlaggedUnreferenced = true
+	}
+
+	return report, nil
+}
@@ -0,0 +1,281 @@
+package task_runner
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/datastores"
+	"github.com/t2bot/matrix-media-repo/pipelines/_steps/upload"
+	"github.com/t2bot/matrix-media-repo/pipelines/pipeline_upload"
+	"github.com/t2bot/matrix-media-repo/references"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+// MaxReplicationBatchSize is the most media records the primary returns in one batch.
+const MaxReplicationBatchSize = 1000
+
+// ReplicationMedia is a media record as served by the primary's replication API.
+type ReplicationMedia struct {
+	Origin             string `json:"origin"`
+	MediaId            string `json:"media_id"`
+	UploadName         string `json:"upload_name"`
+	OriginalUploadName string `json:"original_upload_name,omitempty"`
+	ContentType        string `json:"content_type"`
+	UserId             string `json:"user_id"`
+	Sha256Hash         string `json:"sha256_hash"`
+	SizeBytes          int64  `json:"size_bytes"`
+	CreationTs         int64  `json:"creation_ts"`
+	Quarantined        bool   `json:"quarantined"`
+}
+
+// NewReplicationMedia converts a media record for the replication API.
+func NewReplicationMedia(record *database.DbMedia) *ReplicationMedia {
+	return &ReplicationMedia{
+		Origin:             record.Origin,
+		MediaId:            record.MediaId,
+		UploadName:         record.UploadName,
+		OriginalUploadName: record.OriginalUploadName,
+		ContentType:        record.ContentType,
+		UserId:             record.UserId,
+		Sha256Hash:         record.Sha256Hash,
+		SizeBytes:          record.SizeBytes,
+		CreationTs:         record.CreationTs,
+		Quarantined:        record.Quarantined,
+	}
+}
+
+// ReplicationEvent is a change to existing media on the primary, such as a deletion, a quarantine, or a room
+// reference being added or removed. Type is one of the database.ReplicationEvent* constants.
+type ReplicationEvent struct {
+	Type    string `json:"type"`
+	Origin  string `json:"origin"`
+	MediaId string `json:"media_id"`
+	RoomId  string `json:"room_id,omitempty"`
+	EventId string `json:"event_id,omitempty"`
+	// Media is included when media is released from quarantine, so replicas which skipped it can copy it now.
+	Media *ReplicationMedia `json:"media,omitempty"`
+}
+
+// ReplicationBatch is a page of media records and changes from the primary. NextBatch is passed as the `since`
+// parameter to get the following page.
+type ReplicationBatch struct {
+	Media     []*ReplicationMedia `json:"media"`
+	Events    []*ReplicationEvent `json:"events"`
+	NextBatch string              `json:"next_batch"`
+}
+
+// ReplicateMedia copies local media created on the configured primary media repo since the last run, then applies
+// the changes made to existing media on the primary, keeping this instance as a warm standby. Records which already
+// exist here are not copied again.
+func ReplicateMedia(ctx rcontext.RequestContext) {
+	conf := config.Get().Replication
+	if !conf.Enabled || conf.PrimaryUrl == "" {
+		return
+	}
+	ctx = ctx.LogWithFields(logrus.Fields{"primary": conf.PrimaryUrl})
+
+	stateDb := database.GetInstance().Replication.Prepare(ctx)
+	since, err := stateDb.GetSinceToken(conf.PrimaryUrl)
+	if err != nil {
+		ctx.Log.Error("Error getting replication position: ", err)
+		sentry.CaptureException(err)
+		return
+	}
+
+	client := &http.Client{
+		Timeout: time.Duration(conf.TimeoutSeconds) * time.Second,
+	}
+	batchSize := min(max(1, conf.BatchSize), MaxReplicationBatchSize)
+	replicated := 0
+	changed := 0
+	for !isInterrupted() {
+		batch, err := fetchReplicationBatch(ctx, client, conf, since, batchSize)
+		if err != nil {
+			ctx.Log.Error("Error fetching media from primary: ", err)
+			sentry.CaptureException(err)
+			return
+		}
+		for _, record := range batch.Media {
+			copied, err := replicateRecord(ctx, client, conf, record)
+			if err != nil {
+				// Stop without moving the position forward, so the record is retried on the next run
+				ctx.Log.Errorf("Error replicating %s: %v", util.MxcUri(record.Origin, record.MediaId), err)
+				sentry.CaptureException(err)
+				return
+			}
+			if copied {
+				replicated++
+			}
+		}
+		for _, event := range batch.Events {
+			if err = applyReplicationEvent(ctx, client, conf, event); err != nil {
+				// As above, the event is retried on the next run
+				ctx.Log.Errorf("Error applying %s to %s: %v", event.Type, util.MxcUri(event.Origin, event.MediaId), err)
+				sentry.CaptureException(err)
+				return
+			}
+			changed++
+		}
+		if batch.NextBatch != "" && batch.NextBatch != since {
+			if err = stateDb.SetSinceToken(conf.PrimaryUrl, batch.NextBatch); err != nil {
+				ctx.Log.Error("Error saving replication position: ", err)
+				sentry.CaptureException(err)
+				return
+			}
+			since = batch.NextBatch
+		}
+		if len(batch.Media) < batchSize && len(batch.Events) < batchSize {
+			break // caught up
+		}
+	}
+	if replicated > 0 || changed > 0 {
+		ctx.Log.Infof("Replicated %d media records and %d changes from the primary", replicated, changed)
+	}
+}
+
+func replicationRequest(ctx rcontext.RequestContext, client *http.Client, conf config.ReplicationConfig, path string, qs url.Values) (*http.Response, error) {
+	reqUrl := strings.TrimSuffix(conf.PrimaryUrl, "/") + "/_matrix/media/unstable/admin/replication/" + path
+	if len(qs) > 0 {
+		reqUrl += "?" + qs.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, reqUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+conf.AccessToken)
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		_ = res.Body.Close()
+		return nil, fmt.Errorf("unexpected status code %d from %s", res.StatusCode, path)
+	}
+	return res, nil
+}
+
+func fetchReplicationBatch(ctx rcontext.RequestContext, client *http.Client, conf config.ReplicationConfig, since string, batchSize int) (*ReplicationBatch, error) {
+	qs := url.Values{"limit": []string{strconv.Itoa(batchSize)}}
+	if since != "" {
+		qs.Set("since", since)
+	}
+	res, err := replicationRequest(ctx, client, conf, "media", qs)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	batch := &ReplicationBatch{}
+	if err = json.NewDecoder(res.Body).Decode(batch); err != nil {
+		return nil, err
+	}
+	return batch, nil
+}
+
+// replicateRecord copies a single media record and its object from the primary. Returns false if there was nothing
+// to copy.
+func replicateRecord(ctx rcontext.RequestContext, client *http.Client, conf config.ReplicationConfig, record *ReplicationMedia) (bool, error) {
+	ctx = ctx.LogWithFields(logrus.Fields{
+		"origin":  record.Origin,
+		"mediaId": record.MediaId,
+	})
+
+	if record.Quarantined {
+		ctx.Log.Debug("Media is quarantined on the primary - skipping")
+		return false, nil
+	}
+	if !util.IsServerOurs(record.Origin) {
+		ctx.Log.Warn("Media is for a homeserver which isn't configured here - skipping")
+		return false, nil
+	}
+	exists, err := database.GetInstance().Media.Prepare(ctx).IdExists(record.Origin, record.MediaId)
+	if err != nil {
+		return false, err
+	}
+	if exists {
+		ctx.Log.Debug("Already replicated - skipping")
+		return false, nil
+	}
+
+	res, err := replicationRequest(ctx, client, conf, "media/"+url.PathEscape(record.Origin)+"/"+url.PathEscape(record.MediaId)+"/content", nil)
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+
+	fileName := record.UploadName
+	if record.OriginalUploadName != "" {
+		fileName = record.OriginalUploadName
+	}
+	media, err := pipeline_upload.Execute(upload.FlagReplica(ctx), record.Origin, record.MediaId, io.NopCloser(res.Body), record.ContentType, fileName, record.UserId, datastores.LocalMediaKind, nil)
+	if err != nil {
+		return false, err
+	}
+	if media.Sha256Hash != record.Sha256Hash {
+		ctx.Log.Warnf("Hash mismatch! Expected %s but got %s", record.Sha256Hash, media.Sha256Hash)
+	}
+	return true, nil
+}
+
+// applyReplicationEvent makes the same change to this instance as was made on the primary. Changes to media which
+// doesn't exist here are ignored.
+func applyReplicationEvent(ctx rcontext.RequestContext, client *http.Client, conf config.ReplicationConfig, event *ReplicationEvent) error {
+	ctx = ctx.LogWithFields(logrus.Fields{
+		"origin":  event.Origin,
+		"mediaId": event.MediaId,
+		"change":  event.Type,
+	})
+	if !util.IsServerOurs(event.Origin) {
+		ctx.Log.Warn("Media is for a homeserver which isn't configured here - skipping")
+		return nil
+	}
+
+	single := &QuarantineThis{
+		Single: &QuarantineRecord{Origin: event.Origin, MediaId: event.MediaId},
+		Reason: "Replicated from the primary",
+	}
+	switch event.Type {
+	case database.ReplicationEventMediaDeleted:
+		record, err := database.GetInstance().Media.Prepare(ctx).GetById(event.Origin, event.MediaId)
+		if err != nil || record == nil {
+			return err
+		}
+		_, err = doPurge(ctx, []*database.DbMedia{record}, &purgeConfig{IncludeQuarantined: true})
+		return err
+	case database.ReplicationEventMediaQuarantined:
+		_, err := QuarantineMedia(ctx, event.Origin, single)
+		return err
+	case database.ReplicationEventMediaUnquarantined:
+		exists, err := database.GetInstance().Media.Prepare(ctx).IdExists(event.Origin, event.MediaId)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			// The media was quarantined before it could be copied, so copy it now
+			if event.Media != nil {
+				_, err = replicateRecord(ctx, client, conf, event.Media)
+			}
+			return err
+		}
+		_, err = UnquarantineMedia(ctx, event.Origin, single)
+		return err
+	case database.ReplicationEventReferenceAdded:
+		return references.AddMediaReference(ctx, event.Origin, event.MediaId, event.RoomId, event.EventId)
+	case database.ReplicationEventReferenceRemoved:
+		_, err := references.RemoveEventReference(ctx, event.Origin, event.MediaId, event.RoomId, event.EventId)
+		return err
+	default:
+		ctx.Log.Warn("Unknown change type - skipping")
+		return nil
+	}
+}
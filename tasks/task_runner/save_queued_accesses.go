@@ -0,0 +1,25 @@
+package task_runner
+
+import (
+	"errors"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/pipelines/_steps/meta"
+	"github.com/t2bot/matrix-media-repo/redislib"
+)
+
+// SaveQueuedAccesses writes the last access times queued by download instances to the database.
+func SaveQueuedAccesses(ctx rcontext.RequestContext) {
+	saved, err := meta.SaveQueuedAccesses(ctx)
+	if errors.Is(err, redislib.ErrNotConnected) {
+		return // no download instances to hear from
+	}
+	if err != nil {
+		ctx.Log.Error("Error saving queued media accesses: ", err)
+		sentry.CaptureException(err)
+	}
+	if saved > 0 {
+		ctx.Log.Debugf("Saved %d queued media accesses", saved)
+	}
+}
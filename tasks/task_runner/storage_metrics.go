@@ -0,0 +1,98 @@
+package task_runner
+
+import (
+	"strconv"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/metrics"
+	"github.com/t2bot/matrix-media-repo/pipelines/_steps/quota"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+// userStorageBuckets are the upper bounds of the per-user storage distribution. Users over the last bound are only
+// counted in the "+Inf" bucket.
+var userStorageBuckets = []int64{
+	1048576,      // 1mb
+	10485760,     // 10mb
+	104857600,    // 100mb
+	1073741824,   // 1gb
+	10737418240,  // 10gb
+	107374182400, // 100gb
+}
+
+var quotaUsageFractions = []float64{0.5, 0.8, 0.9, 1}
+
+// UpdateStorageMetrics updates the gauges for per-user storage, quota usage, and media references.
+func UpdateStorageMetrics(ctx rcontext.RequestContext) {
+	updateUserStorageMetrics(ctx)
+	updateReferenceMetrics(ctx)
+}
+
+func updateUserStorageMetrics(ctx rcontext.RequestContext) {
+	stats, err := database.GetInstance().UserStats.Prepare(ctx).GetAllWithUploads()
+	if err != nil {
+		ctx.Log.Error("Error listing user stats: ", err)
+		sentry.CaptureException(err)
+		return
+	}
+
+	bucketCounts := make([]int, len(userStorageBuckets))
+	fractionCounts := make([]int, len(quotaUsageFractions))
+	for _, stat := range stats {
+		for i, bound := range userStorageBuckets {
+			if stat.UploadedBytes <= bound {
+				bucketCounts[i]++
+			}
+		}
+
+		_, domain, err := util.SplitUserId(stat.UserId)
+		if err != nil {
+			continue
+		}
+		domainConf := config.GetDomain(domain)
+		if domainConf == nil {
+			continue
+		}
+		limit, err := quota.LimitFromStats(domainConf, stat.UserId, stat, quota.MaxBytes)
+		if err != nil || limit <= 0 {
+			continue
+		}
+		for i, fraction := range quotaUsageFractions {
+			if float64(stat.UploadedBytes) >= float64(limit)*fraction {
+				fractionCounts[i]++
+			}
+		}
+	}
+
+	for i, bound := range userStorageBuckets {
+		metrics.UserStorageUsers.With(prometheus.Labels{"max_bytes": strconv.FormatInt(bound, 10)}).Set(float64(bucketCounts[i]))
+	}
+	metrics.UserStorageUsers.With(prometheus.Labels{"max_bytes": "+Inf"}).Set(float64(len(stats)))
+	for i, fraction := range quotaUsageFractions {
+		metrics.UserQuotaUsers.With(prometheus.Labels{"used_fraction": strconv.FormatFloat(fraction, 'f', -1, 64)}).Set(float64(fractionCounts[i]))
+	}
+}
+
+func updateReferenceMetrics(ctx rcontext.RequestContext) {
+	references, media, rooms, err := database.GetInstance().MediaReferences.Prepare(ctx).GetStats()
+	if err != nil {
+		ctx.Log.Error("Error counting media references: ", err)
+		sentry.CaptureException(err)
+	} else {
+		metrics.MediaReferences.Set(float64(references))
+		metrics.ReferencedMedia.Set(float64(media))
+		metrics.ReferencingRooms.Set(float64(rooms))
+	}
+
+	unreferenced, err := database.GetInstance().Unreferenced.Prepare(ctx).Count()
+	if err != nil {
+		ctx.Log.Error("Error counting unreferenced media: ", err)
+		sentry.CaptureException(err)
+		return
+	}
+	metrics.UnreferencedMedia.Set(float64(unreferenced))
+}
@@ -0,0 +1,21 @@
+package task_runner
+
+import (
+	"github.com/getsentry/sentry-go"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/hashbans"
+)
+
+func SyncHashBanLists(ctx rcontext.RequestContext) {
+	// dev note: don't use ctx for config lookup to avoid misreading it
+
+	if len(config.Get().HashBans.RemoteLists) == 0 {
+		return
+	}
+
+	if err := hashbans.SyncRemoteLists(ctx); err != nil {
+		ctx.Log.Error("Error syncing hash ban lists: ", err)
+		sentry.CaptureException(err)
+	}
+}
@@ -0,0 +1,181 @@
+package task_runner
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/hashbans"
+	"github.com/t2bot/matrix-media-repo/matrix"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+// PolicyRuleMediaType is the state event type for media policy rules. The rule's entity is either a sha256 hash
+// (in hex) to ban, or an MXC URI to quarantine.
+const PolicyRuleMediaType = "io.t2bot.policy.rule.media"
+
+var policyRuleUserTypes = []string{"m.policy.rule.user", "m.room.rule.user", "org.matrix.mjolnir.rule.user"}
+
+// policyBanRecommendations are the recommendations which cause action to be taken. MSC4204 takedowns are
+// treated the same as bans.
+var policyBanRecommendations = []string{"m.ban", "m.takedown", "org.matrix.msc4204.takedown"}
+
+func SyncPolicyRooms(ctx rcontext.RequestContext) {
+	// dev note: don't use ctx for config lookup to avoid misreading it
+
+	if !config.Get().PolicyRooms.Enabled {
+		return
+	}
+	if config.GetDomain(config.Get().PolicyRooms.Homeserver) == nil {
+		ctx.Log.Errorf("Policy room homeserver %s is not a configured homeserver", config.Get().PolicyRooms.Homeserver)
+		return
+	}
+
+	for _, roomId := range config.Get().PolicyRooms.RoomIds {
+		roomCtx := ctx.LogWithFields(logrus.Fields{"policyRoomId": roomId})
+		if err := syncPolicyRoom(roomCtx, roomId); err != nil {
+			roomCtx.Log.Error("Error syncing policy room: ", err)
+			sentry.CaptureException(err)
+		}
+	}
+}
+
+// PolicyRoomSource returns the banned hash source for rules from the given policy room.
+func PolicyRoomSource(roomId string) string {
+	return "policy:" + roomId
+}
+
+func syncPolicyRoom(ctx rcontext.RequestContext, roomId string) error {
+	conf := config.Get().PolicyRooms
+	events, err := matrix.GetRoomState(ctx, conf.Homeserver, conf.AccessToken, roomId)
+	if err != nil {
+		return err
+	}
+
+	appliedDb := database.GetInstance().AppliedPolicies.Prepare(ctx)
+	hashes := make([]string, 0)
+	reasons := make(map[string]string)
+	for _, ev := range events {
+		entity, _ := ev.Content["entity"].(string)
+		recommendation, _ := ev.Content["recommendation"].(string)
+		reason, _ := ev.Content["reason"].(string)
+		if entity == "" || !slices.Contains(policyBanRecommendations, recommendation) {
+			continue // removed rule, or one we don't act upon
+		}
+
+		isUserRule := slices.Contains(policyRuleUserTypes, ev.Type)
+		isMediaRule := ev.Type == PolicyRuleMediaType
+		if !isUserRule && !isMediaRule {
+			continue
+		}
+
+		// Hash bans are kept in sync with the room, so they can be lifted again
+		if isMediaRule {
+			if hash, ok := hashbans.NormalizeHash(entity); ok {
+				if _, seen := reasons[hash]; !seen {
+					hashes = append(hashes, hash)
+				}
+				reasons[hash] = reason
+				continue
+			}
+		}
+
+		// Quarantines are only applied once, so media released by an admin is not quarantined again
+		applied, err := appliedDb.IsApplied(roomId, ev.EventId)
+		if err != nil {
+			return err
+		}
+		if applied {
+			continue
+		}
+
+		eventCtx := ctx.LogWithFields(logrus.Fields{"policyEventId": ev.EventId, "entity": entity})
+		if isMediaRule {
+			err = applyMediaPolicyRule(eventCtx, entity)
+		} else {
+			err = applyUserPolicyRule(eventCtx, entity)
+		}
+		if err != nil {
+			eventCtx.Log.Warn("Error applying policy rule: ", err)
+			continue
+		}
+		if err = appliedDb.Insert(roomId, ev.EventId, util.NowMillis()); err != nil {
+			return err
+		}
+	}
+
+	newHashes, err := hashbans.ReplaceBans(ctx, PolicyRoomSource(roomId), hashes, reasons)
+	if err != nil {
+		return err
+	}
+	hashbans.QuarantineExisting(ctx, newHashes)
+	ctx.Log.Infof("Synced policy room: %d banned hashes, %d new", len(hashes), len(newHashes))
+	return nil
+}
+
+func applyMediaPolicyRule(ctx rcontext.RequestContext, mxc string) error {
+	origin, mediaId, err := util.SplitMxc(mxc)
+	if err != nil {
+		return err
+	}
+	count, err := QuarantineMedia(ctx, "", &QuarantineThis{Single: &QuarantineRecord{Origin: origin, MediaId: mediaId}, Reason: "media policy rule"})
+	ctx.Log.Infof("Quarantined %d media records due to policy rule", count)
+	return err
+}
+
+func applyUserPolicyRule(ctx rcontext.RequestContext, userGlob string) error {
+	if !hasLiteralServerName(userGlob) {
+		// Skipped rather than failed, so the rule isn't retried (and logged) on every sync
+		ctx.Log.Warnf("Ignoring user policy rule for %s: rules must name a server without wildcards", userGlob)
+		return nil
+	}
+
+	mediaDb := database.GetInstance().Media.Prepare(ctx)
+	var records []*database.DbMedia
+	var err error
+	if strings.ContainsAny(userGlob, "*?") {
+		records, err = mediaDb.GetByUserIdPattern(globToLikePattern(userGlob))
+	} else {
+		records, err = mediaDb.GetByUserId(userGlob)
+	}
+	if err != nil {
+		return err
+	}
+
+	// A policy room shouldn't be able to take down this media repo's own admins
+	skippedAdmins := make(map[string]bool)
+	records = slices.DeleteFunc(records, func(record *database.DbMedia) bool {
+		if util.IsGlobalAdmin(record.UserId) {
+			skippedAdmins[record.UserId] = true
+			return true
+		}
+		return false
+	})
+	for userId := range skippedAdmins {
+		ctx.Log.Warnf("Not quarantining media uploaded by admin %s, which matches the user policy rule", userId)
+	}
+
+	if len(records) == 0 {
+		return nil
+	}
+	count, err := QuarantineMedia(ctx, "", &QuarantineThis{DbMedia: records, Reason: "user policy rule"})
+	ctx.Log.Infof("Quarantined %d media records due to policy rule", count)
+	return err
+}
+
+// hasLiteralServerName returns true if the user policy rule entity is a user ID (or glob) whose server name has no
+// wildcards, such as `@*:example.org`. Rules like `*` or `@*:*` would match every user, so are not applied.
+func hasLiteralServerName(userGlob string) bool {
+	localpart, serverName, found := strings.Cut(userGlob, ":")
+	return found && strings.HasPrefix(localpart, "@") && serverName != "" && !strings.ContainsAny(serverName, "*?")
+}
+
+// globToLikePattern converts a policy rule glob (using `*` and `?`) to a SQL LIKE pattern.
+func globToLikePattern(glob string) string {
+	pattern := strings.NewReplacer("\\", "\\\\", "%", "\\%", "_", "\\_").Replace(glob)
+	return strings.NewReplacer("*", "%", "?", "_").Replace(pattern)
+}
@@ -0,0 +1,40 @@
+package task_runner
+
+import (
+	"github.com/getsentry/sentry-go"
+	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/references"
+)
+
+func SyncRoomManifests(ctx rcontext.RequestContext) {
+	// dev note: don't use ctx for config lookup to avoid misreading it
+
+	if !config.Get().RoomManifests.Enabled {
+		return
+	}
+
+	roomIds, err := database.GetInstance().MediaReferences.Prepare(ctx).GetRoomIds()
+	if err != nil {
+		ctx.Log.Error("Error listing referenced rooms: ", err)
+		sentry.CaptureException(err)
+		return
+	}
+
+	published := 0
+	for _, roomId := range roomIds {
+		roomCtx := ctx.LogWithFields(logrus.Fields{"roomId": roomId})
+		_, changed, err := references.PublishRoomManifest(roomCtx, roomId, true)
+		if err != nil {
+			// Not every referenced room will have the manifest bot in it, so don't bother Sentry
+			roomCtx.Log.Warn("Error publishing room manifest: ", err)
+			continue
+		}
+		if changed {
+			published++
+		}
+	}
+	ctx.Log.Infof("Published %d changed room manifests (of %d rooms)", published, len(roomIds))
+}
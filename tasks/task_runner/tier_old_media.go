@@ -0,0 +1,69 @@
+package task_runner
+
+import (
+	"slices"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/datastores"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+func TierOldMedia(ctx rcontext.RequestContext) {
+	// dev note: don't use ctx for config lookup to avoid misreading it
+
+	conf := config.Get().Tiering
+	if !conf.Enabled || conf.AfterDays <= 0 {
+		return
+	}
+
+	archiveDs, ok := datastores.GetArchive(ctx)
+	if !ok {
+		ctx.Log.Warnf("Tiering is enabled but the archive datastore %s does not exist", conf.ArchiveDatastoreId)
+		return
+	}
+
+	beforeTs := util.NowMillis() - int64(conf.AfterDays*24*60*60*1000)
+	db := database.GetInstance().MetadataView.Prepare(ctx)
+	for _, sourceDs := range config.Get().DataStores {
+		if sourceDs.Id == archiveDs.Id {
+			continue
+		}
+		if len(conf.FromDatastoreIds) > 0 && !slices.Contains(conf.FromDatastoreIds, sourceDs.Id) {
+			continue
+		}
+
+		dsCtx := ctx.LogWithFields(logrus.Fields{"sourceDsId": sourceDs.Id, "archiveDsId": archiveDs.Id})
+		media, err := db.GetMediaForDatastoreByLastAccess(sourceDs.Id, beforeTs, database.DatastoreObjectFilter{})
+		if err != nil {
+			dsCtx.Log.Error("Error getting media to tier: ", err)
+			sentry.CaptureException(err)
+			continue
+		}
+		thumbs, err := db.GetThumbnailsForDatastoreByLastAccess(sourceDs.Id, beforeTs, database.DatastoreObjectFilter{})
+		if err != nil {
+			dsCtx.Log.Error("Error getting thumbnails to tier: ", err)
+			sentry.CaptureException(err)
+			continue
+		}
+
+		moved := 0
+		done := make(map[string]bool)
+		for _, record := range append(media, thumbs...) {
+			id := objectId(record)
+			if done[id] {
+				continue
+			}
+			done[id] = true
+			if err = moveDatastoreObject(dsCtx, record, sourceDs, archiveDs); err == nil {
+				moved++
+			}
+		}
+		if moved > 0 {
+			dsCtx.Log.Infof("Moved %d objects to the archive datastore", moved)
+		}
+	}
+}
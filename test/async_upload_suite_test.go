@@ -0,0 +1,194 @@
+package test
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/test/test_internals"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+type AsyncUploadTestSuite struct {
+	suite.Suite
+	deps *test_internals.ContainerDeps
+}
+
+func (s *AsyncUploadTestSuite) SetupSuite() {
+	deps, err := test_internals.MakeTestDepsWithOptions(test_internals.TestDepsOptions{
+		S3Redirects: true,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	s.deps = deps
+}
+
+func (s *AsyncUploadTestSuite) TearDownSuite() {
+	if s.deps != nil {
+		if s.T().Failed() {
+			s.deps.Debug()
+		}
+		s.deps.Teardown()
+	}
+}
+
+func (s *AsyncUploadTestSuite) downloadClient(machine int) *test_internals.MatrixClient {
+	return &test_internals.MatrixClient{
+		ClientServerUrl: s.deps.Machines[machine].HttpUrl,
+		ServerName:      s.deps.Homeservers[0].ServerName,
+		AccessToken:     "", // no auth for downloads
+		UserId:          "", // no auth for downloads
+	}
+}
+
+func (s *AsyncUploadTestSuite) TestCreateThenUpload() {
+	t := s.T()
+
+	client1 := s.deps.Homeservers[0].UnprivilegedUsers[0].WithCsUrl(s.deps.Machines[0].HttpUrl)
+	client2 := s.downloadClient(1) // deliberately the second machine
+
+	created, err := client1.Create()
+	assert.NoError(t, err)
+	assert.NotEmpty(t, created.MxcUri)
+	assert.Greater(t, created.ExpiresTs, util.NowMillis())
+
+	contentType, img, err := test_internals.MakeTestImage(512, 512)
+	assert.NoError(t, err)
+	err = client1.UploadAsync(created.MxcUri, "image"+util.ExtensionForContentType(contentType), contentType, img)
+	assert.NoError(t, err)
+
+	origin, mediaId, err := util.SplitMxc(created.MxcUri)
+	assert.NoError(t, err)
+	raw, err := client2.DoRaw("GET", fmt.Sprintf("/_matrix/media/v3/download/%s/%s", origin, mediaId), nil, "", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, raw.StatusCode)
+	test_internals.AssertIsTestImage(t, raw.Body)
+}
+
+func (s *AsyncUploadTestSuite) TestUploadTwice() {
+	t := s.T()
+
+	client1 := s.deps.Homeservers[0].UnprivilegedUsers[0].WithCsUrl(s.deps.Machines[0].HttpUrl)
+
+	created, err := client1.Create()
+	assert.NoError(t, err)
+	assert.NotEmpty(t, created.MxcUri)
+
+	contentType, img, err := test_internals.MakeTestImage(512, 512)
+	assert.NoError(t, err)
+	err = client1.UploadAsync(created.MxcUri, "image"+util.ExtensionForContentType(contentType), contentType, img)
+	assert.NoError(t, err)
+
+	origin, mediaId, err := util.SplitMxc(created.MxcUri)
+	assert.NoError(t, err)
+	contentType, img, err = test_internals.MakeTestImage(128, 128)
+	assert.NoError(t, err)
+	errRes, err := client1.DoExpectError("PUT", fmt.Sprintf("/_matrix/media/v3/upload/%s/%s", origin, mediaId), nil, contentType, img)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusConflict, errRes.InjectedStatusCode)
+	assert.Equal(t, common.ErrCodeCannotOverwrite, errRes.Code)
+}
+
+func (s *AsyncUploadTestSuite) TestDownloadBeforeUpload() {
+	t := s.T()
+
+	client1 := s.deps.Homeservers[0].UnprivilegedUsers[0].WithCsUrl(s.deps.Machines[0].HttpUrl)
+	client2 := s.downloadClient(1)
+
+	created, err := client1.Create()
+	assert.NoError(t, err)
+	assert.NotEmpty(t, created.MxcUri)
+
+	origin, mediaId, err := util.SplitMxc(created.MxcUri)
+	assert.NoError(t, err)
+	errRes, err := client2.DoExpectError("GET", fmt.Sprintf("/_matrix/media/v3/download/%s/%s", origin, mediaId), url.Values{"timeout_ms": []string{"1000"}}, "", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusGatewayTimeout, errRes.InjectedStatusCode)
+	assert.Equal(t, common.ErrCodeNotYetUploaded, errRes.Code)
+}
+
+func (s *AsyncUploadTestSuite) TestDownloadWaitsForUpload() {
+	t := s.T()
+
+	client1 := s.deps.Homeservers[0].UnprivilegedUsers[0].WithCsUrl(s.deps.Machines[0].HttpUrl)
+	client2 := s.downloadClient(1)
+
+	created, err := client1.Create()
+	assert.NoError(t, err)
+	assert.NotEmpty(t, created.MxcUri)
+	origin, mediaId, err := util.SplitMxc(created.MxcUri)
+	assert.NoError(t, err)
+
+	// Start the download first, on the other machine, so it has to wait for the upload
+	type downloadResult struct {
+		res *http.Response
+		err error
+	}
+	ch := make(chan downloadResult)
+	go func() {
+		res, err := client2.DoRaw("GET", fmt.Sprintf("/_matrix/media/v3/download/%s/%s", origin, mediaId), url.Values{"timeout_ms": []string{"20000"}}, "", nil)
+		ch <- downloadResult{res: res, err: err}
+	}()
+	time.Sleep(2 * time.Second)
+
+	contentType, img, err := test_internals.MakeTestImage(512, 512)
+	assert.NoError(t, err)
+	err = client1.UploadAsync(created.MxcUri, "image"+util.ExtensionForContentType(contentType), contentType, img)
+	assert.NoError(t, err)
+
+	select {
+	case dl := <-ch:
+		assert.NoError(t, dl.err)
+		assert.Equal(t, http.StatusOK, dl.res.StatusCode)
+		test_internals.AssertIsTestImage(t, dl.res.Body)
+	case <-time.After(30 * time.Second):
+		assert.Fail(t, "timed out waiting for the download to complete")
+	}
+}
+
+func (s *AsyncUploadTestSuite) TestRedirectDownload() {
+	t := s.T()
+
+	client1 := s.deps.Homeservers[0].UnprivilegedUsers[0].WithCsUrl(s.deps.Machines[0].HttpUrl)
+	client2 := s.downloadClient(1)
+	client2.NoFollowRedirects = true
+
+	created, err := client1.Create()
+	assert.NoError(t, err)
+	assert.NotEmpty(t, created.MxcUri)
+
+	contentType, img, err := test_internals.MakeTestImage(512, 512)
+	assert.NoError(t, err)
+	err = client1.UploadAsync(created.MxcUri, "image"+util.ExtensionForContentType(contentType), contentType, img)
+	assert.NoError(t, err)
+
+	origin, mediaId, err := util.SplitMxc(created.MxcUri)
+	assert.NoError(t, err)
+	endpoint := fmt.Sprintf("/_matrix/media/v3/download/%s/%s", origin, mediaId)
+
+	// Clients which allow redirects are sent to the datastore...
+	raw, err := client2.DoRaw("GET", endpoint, url.Values{"allow_redirect": []string{"true"}}, "", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusTemporaryRedirect, raw.StatusCode)
+	location, err := url.Parse(raw.Header.Get("Location"))
+	assert.NoError(t, err)
+	assert.Contains(t, location.Path, "/mybucket/")
+	assert.NotEmpty(t, location.Query().Get("X-Amz-Signature"))
+
+	// ... and everyone else gets the media directly
+	raw, err = client2.DoRaw("GET", endpoint, nil, "", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, raw.StatusCode)
+	test_internals.AssertIsTestImage(t, raw.Body)
+}
+
+func TestAsyncUploadTestSuite(t *testing.T) {
+	suite.Run(t, new(AsyncUploadTestSuite))
+}
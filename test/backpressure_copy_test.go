@@ -0,0 +1,74 @@
+package test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/util/readers"
+)
+
+type countingReader struct {
+	r    io.Reader
+	read int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.read += int64(n)
+	return n, err
+}
+
+// slowWriter accepts small writes, recording the furthest the source was read ahead of what was written.
+type slowWriter struct {
+	src       *countingReader
+	buf       bytes.Buffer
+	maxAhead  int64
+	flushes   int
+	chunkSize int
+}
+
+func (s *slowWriter) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		end := written + s.chunkSize
+		if end > len(p) {
+			end = len(p)
+		}
+		n, _ := s.buf.Write(p[written:end])
+		written += n
+		if ahead := s.src.read - int64(s.buf.Len()); ahead > s.maxAhead {
+			s.maxAhead = ahead
+		}
+	}
+	return written, nil
+}
+
+func (s *slowWriter) Flush() {
+	s.flushes++
+}
+
+func TestCopyWithBackpressureBoundsReadAhead(t *testing.T) {
+	const bufferSize = 4096
+	data := make([]byte, 1024*1024)
+	_, err := rand.Read(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	src := &countingReader{r: bytes.NewReader(data)}
+	dst := &slowWriter{src: src, chunkSize: 512}
+	written, err := readers.CopyWithBackpressure(dst, src, bufferSize)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(data)), written)
+	assert.Equal(t, data, dst.buf.Bytes())
+	assert.LessOrEqual(t, dst.maxAhead, int64(bufferSize))
+	assert.GreaterOrEqual(t, dst.flushes, len(data)/bufferSize)
+}
+
+func TestCopyWithBackpressureRejectsBadBufferSize(t *testing.T) {
+	_, err := readers.CopyWithBackpressure(io.Discard, bytes.NewReader([]byte("test")), 0)
+	assert.Error(t, err)
+}
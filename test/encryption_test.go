@@ -0,0 +1,86 @@
+package test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/encryption"
+	"github.com/t2bot/matrix-media-repo/util/readers"
+)
+
+func encryptForTest(t *testing.T, plaintext []byte, key []byte) []byte {
+	r, err := encryption.NewEncryptReader(bytes.NewReader(plaintext), key)
+	assert.NoError(t, err)
+	ciphertext, err := io.ReadAll(r)
+	assert.NoError(t, err)
+	return ciphertext
+}
+
+func TestEncryptionRoundTrip(t *testing.T) {
+	key := make([]byte, 32)
+	_, _ = rand.Read(key)
+
+	for _, size := range []int{0, 1, encryption.SegmentSize - 1, encryption.SegmentSize, encryption.SegmentSize*3 + 17} {
+		plaintext := make([]byte, size)
+		_, _ = rand.Read(plaintext)
+
+		ciphertext := encryptForTest(t, plaintext, key)
+		assert.Equal(t, encryption.EncryptedSize(int64(size)), int64(len(ciphertext)))
+		plainSize, err := encryption.PlaintextSize(int64(len(ciphertext)))
+		assert.NoError(t, err)
+		assert.Equal(t, int64(size), plainSize)
+
+		r, err := encryption.NewDecryptReader(readers.NopSeekCloser(bytes.NewReader(ciphertext)), key)
+		assert.NoError(t, err)
+		decrypted, err := io.ReadAll(r)
+		assert.NoError(t, err)
+		assert.Equal(t, plaintext, decrypted)
+	}
+}
+
+func TestEncryptionSeek(t *testing.T) {
+	key := make([]byte, 32)
+	_, _ = rand.Read(key)
+	plaintext := make([]byte, encryption.SegmentSize*2+100)
+	_, _ = rand.Read(plaintext)
+	ciphertext := encryptForTest(t, plaintext, key)
+
+	r, err := encryption.NewDecryptReader(readers.NopSeekCloser(bytes.NewReader(ciphertext)), key)
+	assert.NoError(t, err)
+
+	end, err := r.Seek(0, io.SeekEnd)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(plaintext)), end)
+
+	start := int64(encryption.SegmentSize - 10)
+	_, err = r.Seek(start, io.SeekStart)
+	assert.NoError(t, err)
+	buf := make([]byte, 50)
+	_, err = io.ReadFull(r, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, plaintext[start:start+50], buf)
+}
+
+func TestEncryptionDetectsTampering(t *testing.T) {
+	key := make([]byte, 32)
+	_, _ = rand.Read(key)
+	plaintext := make([]byte, encryption.SegmentSize*2)
+	ciphertext := encryptForTest(t, plaintext, key)
+
+	tampered := bytes.Clone(ciphertext)
+	tampered[len(tampered)-1] ^= 0x01
+	r, err := encryption.NewDecryptReader(readers.NopSeekCloser(bytes.NewReader(tampered)), key)
+	assert.NoError(t, err)
+	_, err = io.ReadAll(r)
+	assert.ErrorIs(t, err, encryption.ErrInvalidCiphertext)
+
+	// Dropping the final segment must not look like a shorter, valid object
+	truncated := ciphertext[:encryption.HeaderSize+encryption.SegmentSize+encryption.Overhead]
+	r, err = encryption.NewDecryptReader(readers.NopSeekCloser(bytes.NewReader(truncated)), key)
+	assert.NoError(t, err)
+	_, err = io.ReadAll(r)
+	assert.ErrorIs(t, err, encryption.ErrInvalidCiphertext)
+}
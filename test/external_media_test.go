@@ -0,0 +1,80 @@
+package test
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/errcache"
+	"github.com/t2bot/matrix-media-repo/pipelines/_steps/download"
+	"github.com/t2bot/matrix-media-repo/pipelines/_steps/upload"
+	"github.com/t2bot/matrix-media-repo/test/test_internals"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+func TestExternalMediaRefusesInternalAddresses(t *testing.T) {
+	test_internals.UseSqliteDatabase(t)
+	errcache.Init()
+
+	hits := atomic.Int32{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		_, _ = w.Write([]byte("external media"))
+	}))
+	defer server.Close()
+	serverUrl, err := url.Parse(server.URL)
+	assert.NoError(t, err)
+
+	domain := config.NewDefaultDomainConfig()
+	domain.Name = "external.test"
+	domain.Uploads.ExternalMedia.Enabled = true
+	domain.Uploads.ExternalMedia.AllowedHosts = []string{serverUrl.Hostname()}
+	config.AddDomainForTesting(domain.Name, &domain)
+
+	ctx := rcontext.Initial()
+	ctx.Config = domain
+
+	register := func(mediaId string) {
+		err := database.GetInstance().ExternalMedia.Prepare(ctx).Insert(&database.DbExternalMedia{
+			Origin:     domain.Name,
+			MediaId:    mediaId,
+			UserId:     "@bridge:external.test",
+			Url:        server.URL + "/media.txt",
+			RoomIds:    []string{},
+			CreationTs: util.NowMillis(),
+		})
+		assert.NoError(t, err)
+	}
+
+	// The hostname is allowed, but it resolves to a loopback address
+	register("loopback")
+	_, _, err = download.TryExternal(ctx, domain.Name, "loopback")
+	assert.ErrorIs(t, err, common.ErrHostNotAllowed)
+	assert.Equal(t, int32(0), hits.Load())
+
+	ctx.Config.Uploads.ExternalMedia.DisallowedNetworks = []string{}
+	register("allowed")
+	_, _, err = download.TryExternal(ctx, domain.Name, "allowed")
+	assert.NotErrorIs(t, err, common.ErrHostNotAllowed)
+	assert.Equal(t, int32(1), hits.Load())
+}
+
+func TestExternalMediaDefaultDisallowedNetworks(t *testing.T) {
+	ctx := rcontext.Initial()
+	ctx.Config = config.NewDefaultDomainConfig()
+
+	for _, addr := range []string{"0.0.0.0", "0.1.2.3", "127.0.0.1", "10.1.2.3", "172.16.0.1", "192.168.1.1", "100.64.0.1", "169.254.169.254", "::", "::1", "fe80::1", "fe80:1::1", "febf::1", "fd00::1"} {
+		assert.ErrorIs(t, upload.CheckExternalAddress(ctx, net.ParseIP(addr)), common.ErrHostNotAllowed, addr)
+	}
+	for _, addr := range []string{"1.1.1.1", "8.8.8.8", "2606:4700::1111"} {
+		assert.NoError(t, upload.CheckExternalAddress(ctx, net.ParseIP(addr)), addr)
+	}
+}
@@ -0,0 +1,32 @@
+package test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+func TestSanitizeFilename(t *testing.T) {
+	assert.Equal(t, "report.pdf", util.SanitizeFilename("report\r\n.pdf", 0))
+	assert.Equal(t, "_etc_passwd", util.SanitizeFilename("/etc/passwd", 0))
+	assert.Equal(t, "Отчёт 🎉.png", util.SanitizeFilename("Отчёт 🎉.png", 0))
+	assert.Equal(t, "Отчёт.png", util.SanitizeFilename("Отчёт 🎉.png", 10))
+	assert.Equal(t, "abcd", util.SanitizeFilename("abcd.verylongextension", 4))
+}
+
+func TestContentDisposition(t *testing.T) {
+	assert.Equal(t, "inline", util.ContentDisposition("inline", ""))
+	assert.Equal(t, `attachment; filename="my file.txt"`, util.ContentDisposition("attachment", "my file.txt"))
+	assert.Equal(t, `attachment; filename="say \"hi\".txt"`, util.ContentDisposition("attachment", `say "hi".txt`))
+	assert.Equal(t, `inline; filename="_____ _.png"; filename*=UTF-8''%D0%9E%D1%82%D1%87%D1%91%D1%82%20%F0%9F%8E%89.png`, util.ContentDisposition("inline", "Отчёт 🎉.png"))
+}
+
+func TestSanitizeUploadName(t *testing.T) {
+	assert.Equal(t, "caf\u00e9.txt", util.SanitizeUploadName("cafe\u0301.txt")) // NFD to NFC
+	assert.Equal(t, "photo.jpg", util.SanitizeUploadName(`C:\Users\alice\photo.jpg`))
+	assert.Equal(t, "photo.jpg", util.SanitizeUploadName("../../photo.jpg"))
+	assert.Equal(t, "bell.txt", util.SanitizeUploadName("bell\a.txt"))
+	assert.Equal(t, "", util.SanitizeUploadName(".."))
+	assert.Equal(t, "", util.SanitizeUploadName(""))
+}
@@ -0,0 +1,185 @@
+package test
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/api/_apimeta"
+	"github.com/t2bot/matrix-media-repo/api/_responses"
+	"github.com/t2bot/matrix-media-repo/api/_routers"
+	"github.com/t2bot/matrix-media-repo/api/unstable"
+	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/restrictions"
+	"github.com/t2bot/matrix-media-repo/test/test_internals"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+func useGalleryLinks(t *testing.T) {
+	test_internals.UseSqliteDatabase(t)
+
+	conf := config.Get().GalleryLinks
+	config.Get().GalleryLinks.Enabled = true
+	config.Get().GalleryLinks.Secret = "gallery_secret"
+	config.Get().GalleryLinks.MaxHours = 48
+	config.Get().GalleryLinks.MinPowerLevel = 50
+	t.Cleanup(func() {
+		config.Get().GalleryLinks = conf
+	})
+}
+
+func TestGalleryTokens(t *testing.T) {
+	useGalleryLinks(t)
+	ctx := rcontext.Initial()
+
+	gallery := &restrictions.GalleryToken{
+		RoomId:    "!room:gallery.test",
+		IssuedBy:  "@mod:gallery.test",
+		ExpiresTs: util.NowMillis() + 60000,
+	}
+	token, err := restrictions.MintGalleryToken(ctx, gallery)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, gallery.Id)
+
+	verified, err := restrictions.VerifyGalleryToken(ctx, token)
+	assert.NoError(t, err)
+	assert.Equal(t, gallery.RoomId, verified.RoomId)
+	assert.Equal(t, gallery.IssuedBy, verified.IssuedBy)
+	assert.Equal(t, gallery.Id, verified.Id)
+
+	// Pointing the token at another room invalidates the signature
+	parts := strings.Split(token, ".")
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	assert.NoError(t, err)
+	tampered := strings.Replace(string(payload), "!room:gallery.test", "!other:gallery.test", 1)
+	parts[1] = base64.RawURLEncoding.EncodeToString([]byte(tampered))
+	_, err = restrictions.VerifyGalleryToken(ctx, strings.Join(parts, "."))
+	assert.ErrorIs(t, err, restrictions.ErrInvalidGalleryToken)
+
+	for _, invalid := range []string{"", "g1", "g1.abc", "g2" + token[2:], token + "x", token[:len(token)-2]} {
+		_, err = restrictions.VerifyGalleryToken(ctx, invalid)
+		assert.ErrorIs(t, err, restrictions.ErrInvalidGalleryToken, invalid)
+	}
+
+	// Tokens signed with another secret are invalid
+	config.Get().GalleryLinks.Secret = "another_secret"
+	_, err = restrictions.VerifyGalleryToken(ctx, token)
+	assert.ErrorIs(t, err, restrictions.ErrInvalidGalleryToken)
+	config.Get().GalleryLinks.Secret = "gallery_secret"
+
+	config.Get().GalleryLinks.Enabled = false
+	_, err = restrictions.VerifyGalleryToken(ctx, token)
+	assert.ErrorIs(t, err, restrictions.ErrGalleryLinksDisabled)
+	config.Get().GalleryLinks.Enabled = true
+
+	expired := &restrictions.GalleryToken{
+		RoomId:    "!room:gallery.test",
+		IssuedBy:  "@mod:gallery.test",
+		ExpiresTs: util.NowMillis() - 1,
+	}
+	expiredToken, err := restrictions.MintGalleryToken(ctx, expired)
+	assert.NoError(t, err)
+	_, err = restrictions.VerifyGalleryToken(ctx, expiredToken)
+	assert.ErrorIs(t, err, restrictions.ErrExpiredGalleryToken)
+
+	// Tokens can only be revoked through the room they're for
+	revoked, err := restrictions.RevokeGalleryToken(ctx, "!other:gallery.test", gallery.Id)
+	assert.NoError(t, err)
+	assert.False(t, revoked)
+	revoked, err = restrictions.RevokeGalleryToken(ctx, gallery.RoomId, gallery.Id)
+	assert.NoError(t, err)
+	assert.True(t, revoked)
+	_, err = restrictions.VerifyGalleryToken(ctx, token)
+	assert.ErrorIs(t, err, restrictions.ErrRevokedGalleryToken)
+	assert.True(t, restrictions.IsRejectedGalleryToken(err))
+}
+
+func TestGalleryLinkPowerLevels(t *testing.T) {
+	useGalleryLinks(t)
+
+	const roomId = "!room:gallery.test"
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.TrimSuffix(r.URL.Path, "/") != "/_matrix/client/v3/rooms/"+roomId+"/state/m.room.power_levels" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Header.Get("Authorization") == "Bearer stranger_token" {
+			w.WriteHeader(http.StatusForbidden)
+			_ = json.NewEncoder(w).Encode(map[string]string{"errcode": "M_FORBIDDEN", "error": "not in room"})
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"users": map[string]int{
+				"@mod:gallery.test": 50,
+			},
+			"users_default": 0,
+		})
+	}))
+	defer hs.Close()
+
+	domain := config.NewDefaultDomainConfig()
+	domain.Name = "gallery.test"
+	domain.ClientServerApi = hs.URL
+	config.AddDomainForTesting(domain.Name, &domain)
+
+	admins := config.Get().Admins
+	config.Get().Admins = []string{"@admin:gallery.test"}
+	defer func() {
+		config.Get().Admins = admins
+	}()
+
+	ctx := rcontext.Initial()
+	ctx.Config = domain
+
+	create := func(user _apimeta.UserInfo, body string) interface{} {
+		r := httptest.NewRequest(http.MethodPost, "http://gallery.test/_matrix/media/unstable/room/"+roomId+"/gallery_link", strings.NewReader(body))
+		r = _routers.ForceSetParam("roomId", roomId, r)
+		return unstable.CreateGalleryLink(r, ctx, user)
+	}
+	revoke := func(user _apimeta.UserInfo, tokenId string) interface{} {
+		r := httptest.NewRequest(http.MethodDelete, "http://gallery.test/_matrix/media/unstable/room/"+roomId+"/gallery_link/"+tokenId, nil)
+		r = _routers.ForceSetParam("roomId", roomId, r)
+		r = _routers.ForceSetParam("tokenId", tokenId, r)
+		return unstable.RevokeGalleryLink(r, ctx, user)
+	}
+	assertForbidden := func(res interface{}) {
+		if assert.IsType(t, _responses.ErrorResponse{}, res) {
+			assert.Equal(t, common.ErrCodeForbidden, res.(_responses.ErrorResponse).Code)
+		}
+	}
+	mintedLink := func(res interface{}) *unstable.GalleryLinkResponse {
+		if !assert.IsType(t, &_responses.DoNotCacheResponse{}, res) {
+			return nil
+		}
+		link := res.(*_responses.DoNotCacheResponse).Payload.(*unstable.GalleryLinkResponse)
+		assert.Equal(t, roomId, link.RoomId)
+		return link
+	}
+
+	mod := _apimeta.UserInfo{UserId: "@mod:gallery.test", AccessToken: "mod_token"}
+	user := _apimeta.UserInfo{UserId: "@user:gallery.test", AccessToken: "user_token"}
+	stranger := _apimeta.UserInfo{UserId: "@stranger:gallery.test", AccessToken: "stranger_token"}
+	admin := _apimeta.UserInfo{UserId: "@admin:gallery.test", AccessToken: "admin_token"}
+
+	assertForbidden(create(user, ""))
+	assertForbidden(create(stranger, ""))
+	mintedLink(create(admin, ""))
+	link := mintedLink(create(mod, `{"hours": 2}`))
+	assert.IsType(t, &_responses.ErrorResponse{}, create(mod, `{"hours": 72}`))
+
+	// Only moderators can revoke links
+	assertForbidden(revoke(user, link.TokenId))
+	_, err := restrictions.VerifyGalleryToken(ctx, link.Token)
+	assert.NoError(t, err)
+
+	assert.IsType(t, &_responses.DoNotCacheResponse{}, revoke(mod, link.TokenId))
+	_, err = restrictions.VerifyGalleryToken(ctx, link.Token)
+	assert.ErrorIs(t, err, restrictions.ErrRevokedGalleryToken)
+	assert.IsType(t, &_responses.ErrorResponse{}, revoke(mod, link.TokenId))
+}
@@ -0,0 +1,36 @@
+package test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/hashbans"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+func TestVerifyRemoteHashBanList(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	pubB64 := util.EncodeUnpaddedBase64ToString(pub)
+
+	unsigned := map[string]interface{}{
+		"hashes": []map[string]string{{"sha256": "c2f1a7e3b5d4f6a8c0e2d4b6a8f0e2c4a6b8d0f2e4c6a8b0d2f4e6c8a0b2d4f6", "reason": "spam"}},
+	}
+	canonical, err := util.EncodeCanonicalJson(unsigned)
+	assert.NoError(t, err)
+	unsigned["signatures"] = map[string]string{"ed25519:a": util.EncodeUnpaddedBase64ToString(ed25519.Sign(priv, canonical))}
+	signed, err := json.Marshal(unsigned)
+	assert.NoError(t, err)
+
+	assert.NoError(t, hashbans.VerifyRemoteList(signed, "ed25519:a", pubB64))
+	assert.Error(t, hashbans.VerifyRemoteList(signed, "ed25519:b", pubB64))
+
+	// Tampering with the list must invalidate the signature
+	unsigned["hashes"] = []map[string]string{}
+	tampered, err := json.Marshal(unsigned)
+	assert.NoError(t, err)
+	assert.Error(t, hashbans.VerifyRemoteList(tampered, "ed25519:a", pubB64))
+}
@@ -0,0 +1,95 @@
+package test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/pipelines/_steps/upload"
+	"github.com/t2bot/matrix-media-repo/test/test_internals"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+func TestIdempotencyKeyReservationLease(t *testing.T) {
+	test_internals.UseSqliteDatabase(t)
+
+	domain := config.NewDefaultDomainConfig()
+	domain.Name = "idempotency.test"
+	domain.Uploads.IdempotencySeconds = 86400
+	config.AddDomainForTesting(domain.Name, &domain)
+
+	ctx := rcontext.Initial()
+	ctx.Config = domain
+	db := database.GetInstance().IdempotencyKeys.Prepare(ctx)
+
+	const userId = "@alice:idempotency.test"
+	const leaseMillis = upload.IdempotencyLeaseSeconds * 1000
+
+	// A reservation only holds the key for the lease, not the full idempotency window
+	reserved, existing, err := upload.ReserveIdempotencyKey(ctx, userId, "held")
+	assert.NoError(t, err)
+	assert.True(t, reserved)
+	assert.Nil(t, existing)
+	record, err := db.Get(userId, "held")
+	assert.NoError(t, err)
+	if assert.NotNil(t, record) {
+		assert.Equal(t, "", record.MediaId)
+		assert.LessOrEqual(t, record.ExpiresTs, util.NowMillis()+leaseMillis)
+	}
+
+	reserved, existing, err = upload.ReserveIdempotencyKey(ctx, userId, "held")
+	assert.NoError(t, err)
+	assert.False(t, reserved)
+	assert.Nil(t, existing)
+
+	// Renewing a pending reservation pushes the lease out
+	assert.NoError(t, db.RenewPending(userId, "held", util.NowMillis()+2*leaseMillis))
+	record, err = db.Get(userId, "held")
+	assert.NoError(t, err)
+	if assert.NotNil(t, record) {
+		assert.Greater(t, record.ExpiresTs, util.NowMillis()+leaseMillis)
+	}
+
+	// Recording the media keeps the key for the full window
+	media := &database.DbMedia{
+		Origin:      domain.Name,
+		MediaId:     "idempotent_media",
+		UploadName:  "file.txt",
+		ContentType: "text/plain",
+		UserId:      userId,
+		SizeBytes:   4,
+		CreationTs:  util.NowMillis(),
+		Locatable: &database.Locatable{
+			Sha256Hash:  "idempotent_hash",
+			DatastoreId: "ds",
+			Location:    "/idempotent",
+		},
+	}
+	assert.NoError(t, database.GetInstance().Media.Prepare(ctx).Insert(media))
+	assert.NoError(t, upload.RecordIdempotencyKey(ctx, userId, "held", media))
+	record, err = db.Get(userId, "held")
+	assert.NoError(t, err)
+	if assert.NotNil(t, record) {
+		assert.Equal(t, media.MediaId, record.MediaId)
+		assert.Greater(t, record.ExpiresTs, util.NowMillis()+(domain.Uploads.IdempotencySeconds-60)*1000)
+	}
+
+	// Renewing no longer applies once the media is recorded
+	assert.NoError(t, db.RenewPending(userId, "held", util.NowMillis()+leaseMillis))
+	record, err = db.Get(userId, "held")
+	assert.NoError(t, err)
+	if assert.NotNil(t, record) {
+		assert.Greater(t, record.ExpiresTs, util.NowMillis()+2*leaseMillis)
+	}
+
+	// An abandoned reservation can be taken over once its lease has run out
+	reserved, err = db.Reserve(userId, "abandoned", util.NowMillis()-1)
+	assert.NoError(t, err)
+	assert.True(t, reserved)
+	reserved, existing, err = upload.ReserveIdempotencyKey(ctx, userId, "abandoned")
+	assert.NoError(t, err)
+	assert.True(t, reserved)
+	assert.Nil(t, existing)
+}
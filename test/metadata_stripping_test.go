@@ -0,0 +1,110 @@
+package test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/metadata_stripping"
+	"github.com/t2bot/matrix-media-repo/thumbnailing/u"
+)
+
+func makeTestImage() image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, 8, 8))
+	for x := 0; x < 8; x++ {
+		for y := 0; y < 8; y++ {
+			img.Set(x, y, color.RGBA{R: uint8(x * 32), G: uint8(y * 32), B: 128, A: 255})
+		}
+	}
+	return img
+}
+
+// makeTestExif builds little endian EXIF data with an orientation and a (fake) GPS IFD pointer.
+func makeTestExif(orientation uint16) []byte {
+	b := []byte("II\x2a\x00\x08\x00\x00\x00")
+	b = binary.LittleEndian.AppendUint16(b, 2)
+	b = binary.LittleEndian.AppendUint16(b, 0x0112)
+	b = binary.LittleEndian.AppendUint16(b, 3)
+	b = binary.LittleEndian.AppendUint32(b, 1)
+	b = binary.LittleEndian.AppendUint32(b, uint32(orientation))
+	b = binary.LittleEndian.AppendUint16(b, 0x8825) // GPSInfo
+	b = binary.LittleEndian.AppendUint16(b, 4)
+	b = binary.LittleEndian.AppendUint32(b, 1)
+	b = binary.LittleEndian.AppendUint32(b, 0)
+	b = binary.LittleEndian.AppendUint32(b, 0)
+	return append(b, []byte("SECRET LOCATION")...)
+}
+
+func stripAll(t *testing.T, b []byte, contentType string) []byte {
+	r := metadata_stripping.Strip(io.NopCloser(bytes.NewReader(b)), contentType)
+	defer r.Close()
+	out, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestStripJpegMetadata(t *testing.T) {
+	buf := &bytes.Buffer{}
+	if err := jpeg.Encode(buf, makeTestImage(), nil); err != nil {
+		t.Fatal(err)
+	}
+	original := buf.Bytes()
+
+	exif := append([]byte("Exif\x00\x00"), makeTestExif(6)...)
+	app1 := []byte{0xFF, 0xE1, 0, 0}
+	binary.BigEndian.PutUint16(app1[2:], uint16(len(exif)+2))
+	comment := []byte{0xFF, 0xFE, 0x00, 0x0A, 'S', 'E', 'C', 'R', 'E', 'T', '!', '!'}
+	withExif := append(append(append(append([]byte{}, original[:2]...), app1...), exif...), comment...)
+	withExif = append(withExif, original[2:]...)
+
+	stripped := stripAll(t, withExif, "image/jpeg")
+	assert.False(t, bytes.Contains(stripped, []byte("SECRET")))
+
+	_, err := jpeg.Decode(bytes.NewReader(stripped))
+	assert.NoError(t, err)
+
+	orientation, err := u.GetExifOrientation(bytes.NewReader(stripped))
+	assert.NoError(t, err)
+	if assert.NotNil(t, orientation) {
+		assert.Equal(t, 270, orientation.RotateDegrees)
+	}
+}
+
+func TestStripPngMetadata(t *testing.T) {
+	buf := &bytes.Buffer{}
+	if err := png.Encode(buf, makeTestImage()); err != nil {
+		t.Fatal(err)
+	}
+	original := buf.Bytes()
+
+	chunk := func(chunkType string, data []byte) []byte {
+		b := binary.BigEndian.AppendUint32(nil, uint32(len(data)))
+		b = append(append(b, chunkType...), data...)
+		return binary.BigEndian.AppendUint32(b, crc32.ChecksumIEEE(b[4:]))
+	}
+	// Insert metadata after IHDR (8 byte signature + 25 byte chunk)
+	withMeta := append([]byte{}, original[:33]...)
+	withMeta = append(withMeta, chunk("tEXt", []byte("Comment\x00SECRET"))...)
+	withMeta = append(withMeta, chunk("eXIf", makeTestExif(1))...)
+	withMeta = append(withMeta, original[33:]...)
+
+	stripped := stripAll(t, withMeta, "image/png")
+	assert.False(t, bytes.Contains(stripped, []byte("SECRET")))
+	assert.Equal(t, original, stripped)
+}
+
+func TestStripPassesThroughMismatchedContent(t *testing.T) {
+	b := []byte("definitely not an image")
+	assert.Equal(t, b, stripAll(t, b, "image/jpeg"))
+	assert.Equal(t, b, stripAll(t, b, "image/png"))
+	assert.Equal(t, b, stripAll(t, b, "image/webp"))
+}
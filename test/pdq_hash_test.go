@@ -0,0 +1,83 @@
+package test
+
+import (
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/disintegration/imaging"
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/hashmatch"
+)
+
+func makePdqTestImage(width int, height int, fn func(x int, y int) (int, int, int)) image.Image {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			r, g, b := fn(x, y)
+			img.SetNRGBA(x, y, color.NRGBA{R: uint8(r), G: uint8(g), B: uint8(b), A: 255})
+		}
+	}
+	return img
+}
+
+func pdqChecker(x int, y int) (int, int, int) {
+	v := ((x/25+y/25)%2)*200 + x*50/300
+	return v, v, (v + y) % 256
+}
+
+func TestPdqHashKnownAnswers(t *testing.T) {
+	// Expected hashes were computed by following the reference hasher's float luma path (pdqhashing.cpp), in 32-bit
+	// floats as the reference does, for images of generated patterns
+	cases := []struct {
+		name    string
+		img     image.Image
+		hash    string
+		quality int
+	}{
+		{
+			name: "diagonals",
+			img: makePdqTestImage(97, 61, func(x int, y int) (int, int, int) {
+				return (x*3 + y*5) % 256, (x * y) % 256, (255 - x*2) % 256
+			}),
+			hash:    "3c6335c7e0c7c586a987438e0f4f1e0e7c7efad4601e00720aa21ff6ffb4ba01",
+			quality: 100,
+		},
+		{
+			name: "rings",
+			img: makePdqTestImage(160, 120, func(x int, y int) (int, int, int) {
+				v := (((x-80)*(x-80) + (y-60)*(y-60)) / 37) % 256
+				return v, (v + x) % 256, (v * 3) % 256
+			}),
+			hash:    "4961df5d4961da7549635b5461435977214349732d4b49e1b52bad4b54ad6da9",
+			quality: 100,
+		},
+		{
+			name:    "checker",
+			img:     makePdqTestImage(300, 200, pdqChecker),
+			hash:    "2dfd8f788ff80fff0ffb0fff0fff0fff70827002f004f000f000f0009355d220",
+			quality: 100,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			hash, quality := hashmatch.PdqHash(c.img)
+			assert.Equal(t, c.hash, hash)
+			assert.Equal(t, c.quality, quality)
+			assert.Equal(t, 0, hashmatch.PdqDistance(c.hash, hash))
+		})
+	}
+}
+
+func TestPdqHashDownsamples(t *testing.T) {
+	large := makePdqTestImage(3000, 2000, func(x int, y int) (int, int, int) {
+		return pdqChecker(x/10, y/10)
+	})
+	small := imaging.Fit(large, 512, 512, imaging.Box)
+	assert.Equal(t, 512, small.Bounds().Dx())
+
+	largeHash, largeQuality := hashmatch.PdqHash(large)
+	smallHash, smallQuality := hashmatch.PdqHash(small)
+	assert.Equal(t, smallHash, largeHash)
+	assert.Equal(t, smallQuality, largeQuality)
+}
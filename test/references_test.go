@@ -0,0 +1,129 @@
+package test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/api/_apimeta"
+	"github.com/t2bot/matrix-media-repo/api/_responses"
+	"github.com/t2bot/matrix-media-repo/api/_routers"
+	"github.com/t2bot/matrix-media-repo/api/unstable"
+	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/test/test_internals"
+)
+
+func TestDeleteMediaReferenceAuthorization(t *testing.T) {
+	test_internals.UseSqliteDatabase(t)
+
+	const roomId = "!gallery:references.test"
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		switch {
+		case r.URL.Path == "/_matrix/client/v3/joined_rooms":
+			joined := []string{"!other:references.test"}
+			if token == "member_token" {
+				joined = append(joined, roomId)
+			}
+			_ = json.NewEncoder(w).Encode(map[string][]string{"joined_rooms": joined})
+		case strings.TrimSuffix(r.URL.Path, "/") == "/_matrix/client/v3/rooms/"+roomId+"/state/m.room.power_levels":
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{
+				"users": map[string]int{
+					"@mod:references.test": 50,
+				},
+				"users_default": 0,
+			})
+		case strings.HasPrefix(r.URL.Path, "/_matrix/client/v3/admin/whois/") && token == "hsadmin_token":
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{})
+		default:
+			w.WriteHeader(http.StatusForbidden)
+			_ = json.NewEncoder(w).Encode(map[string]string{"errcode": "M_FORBIDDEN", "error": "forbidden"})
+		}
+	}))
+	defer hs.Close()
+
+	domain := config.NewDefaultDomainConfig()
+	domain.Name = "references.test"
+	domain.ClientServerApi = hs.URL
+	domain.Downloads.RoomAccess.MembershipCacheSeconds = 0
+	config.AddDomainForTesting(domain.Name, &domain)
+
+	admins := config.Get().Admins
+	config.Get().Admins = []string{"@admin:references.test"}
+	defer func() {
+		config.Get().Admins = admins
+	}()
+
+	ctx := rcontext.Initial()
+	ctx.Config = domain
+
+	const mediaId = "gallery_photo"
+	err := database.GetInstance().Media.Prepare(ctx).Insert(&database.DbMedia{
+		Origin:      domain.Name,
+		MediaId:     mediaId,
+		UploadName:  "photo.png",
+		ContentType: "image/png",
+		UserId:      "@uploader:references.test",
+		SizeBytes:   10,
+		CreationTs:  1,
+		Locatable: &database.Locatable{
+			Sha256Hash:  "photo_hash",
+			DatastoreId: "ds",
+			Location:    "/photo",
+		},
+	})
+	assert.NoError(t, err)
+	addReference := func() {
+		err := database.GetInstance().MediaReferences.Prepare(ctx).Insert(&database.DbMediaReference{
+			Origin:     domain.Name,
+			MediaId:    mediaId,
+			RoomId:     roomId,
+			EventId:    "$photo",
+			CreationTs: 1,
+		})
+		assert.NoError(t, err)
+	}
+
+	remove := func(user _apimeta.UserInfo) interface{} {
+		r := httptest.NewRequest(http.MethodDelete, "http://references.test/_matrix/media/unstable/reference/references.test/"+mediaId+"?room_id="+roomId, nil)
+		r = _routers.ForceSetParam("server", domain.Name, r)
+		r = _routers.ForceSetParam("mediaId", mediaId, r)
+		rctx := ctx
+		rctx.Request = r
+		return unstable.DeleteMediaReference(r, rctx, user)
+	}
+	assertRefused := func(res interface{}) {
+		if assert.IsType(t, &_responses.ErrorResponse{}, res) {
+			assert.Equal(t, common.ErrCodeUnknownToken, res.(*_responses.ErrorResponse).Code)
+		}
+	}
+	assertRemoved := func(res interface{}) {
+		assert.IsType(t, &_responses.DoNotCacheResponse{}, res)
+		count, err := database.GetInstance().MediaReferences.Prepare(ctx).CountForMedia(domain.Name, mediaId)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(0), count)
+	}
+
+	uploader := _apimeta.UserInfo{UserId: "@uploader:references.test", AccessToken: "uploader_token"}
+	hsAdmin := _apimeta.UserInfo{UserId: "@hsadmin:references.test", AccessToken: "hsadmin_token"}
+	member := _apimeta.UserInfo{UserId: "@member:references.test", AccessToken: "member_token"}
+	mod := _apimeta.UserInfo{UserId: "@mod:references.test", AccessToken: "mod_token"}
+	admin := _apimeta.UserInfo{UserId: "@admin:references.test", AccessToken: "admin_token"}
+
+	// Neither owning the media nor administering the homeserver is enough without being in the room
+	addReference()
+	assertRefused(remove(uploader))
+	assertRefused(remove(hsAdmin))
+
+	assertRemoved(remove(member))
+	addReference()
+	assertRemoved(remove(mod))
+	addReference()
+	assertRemoved(remove(admin))
+}
@@ -0,0 +1,151 @@
+package test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/datastores"
+	"github.com/t2bot/matrix-media-repo/pipelines/pipeline_upload"
+	"github.com/t2bot/matrix-media-repo/references"
+	"github.com/t2bot/matrix-media-repo/tasks/task_runner"
+	"github.com/t2bot/matrix-media-repo/test/test_internals"
+)
+
+func TestReplicationEventsRecordChanges(t *testing.T) {
+	test_internals.UseSqliteDatabase(t)
+	ctx := rcontext.Initial()
+	db := database.GetInstance()
+
+	insertSqliteTestMedia(t, ctx, "example.org", "a", "@alice:example.org", "image/png", 10, 1000)
+	insertSqliteTestMedia(t, ctx, "remote.org", "b", "@bob:remote.org", "image/png", 10, 1000)
+
+	assert.NoError(t, references.AddMediaReference(ctx, "example.org", "a", "!room:example.org", "$event"))
+	assert.NoError(t, references.AddMediaReference(ctx, "example.org", "a", "!room:example.org", "$event")) // no change
+	assert.NoError(t, references.AddMediaReference(ctx, "remote.org", "b", "!room:example.org", "$event"))
+	removed, err := references.RemoveEventReference(ctx, "example.org", "a", "!room:example.org", "$event")
+	assert.NoError(t, err)
+	assert.True(t, removed)
+	_, err = db.MetadataView.Prepare(ctx).UpdateQuarantineByHash("a_hash", true)
+	assert.NoError(t, err)
+	_, err = db.MetadataView.Prepare(ctx).UpdateQuarantineByHash("a_hash", false)
+	assert.NoError(t, err)
+	assert.NoError(t, db.Media.Prepare(ctx).Delete("example.org", "a"))
+	assert.NoError(t, db.Media.Prepare(ctx).Delete("remote.org", "b"))
+
+	changes, err := db.ReplicationLog.Prepare(ctx).GetSince([]string{"example.org"}, 0, 100)
+	assert.NoError(t, err)
+	if assert.Len(t, changes, 5) {
+		assert.Equal(t, database.ReplicationEventReferenceAdded, changes[0].EventType)
+		assert.Equal(t, "!room:example.org", changes[0].RoomId)
+		assert.Equal(t, "$event", changes[0].EventId)
+		assert.Equal(t, database.ReplicationEventReferenceRemoved, changes[1].EventType)
+		assert.Equal(t, database.ReplicationEventMediaQuarantined, changes[2].EventType)
+		assert.Equal(t, database.ReplicationEventMediaUnquarantined, changes[3].EventType)
+		assert.Equal(t, database.ReplicationEventMediaDeleted, changes[4].EventType)
+		for _, change := range changes {
+			assert.Equal(t, "a", change.MediaId)
+			assert.Greater(t, change.CreationTs, int64(0))
+		}
+
+		later, err := db.ReplicationLog.Prepare(ctx).GetSince([]string{"example.org"}, changes[2].StreamId, 100)
+		assert.NoError(t, err)
+		assert.Len(t, later, 2)
+	}
+
+	assert.NoError(t, db.ReplicationLog.Prepare(ctx).DeleteOlderThan(changes[0].CreationTs+60000))
+	changes, err = db.ReplicationLog.Prepare(ctx).GetSince([]string{"example.org", "remote.org"}, 0, 100)
+	assert.NoError(t, err)
+	assert.Empty(t, changes)
+}
+
+func TestReplicaAppliesChanges(t *testing.T) {
+	test_internals.UseSqliteDatabase(t)
+
+	domain := config.NewDefaultDomainConfig()
+	domain.Name = "replica.test"
+	domain.DataStores = []config.DatastoreConfig{{
+		Id:         "replica_test",
+		Type:       "file",
+		MediaKinds: []string{"all"},
+		Options:    map[string]string{"path": t.TempDir()},
+	}}
+	config.AddDomainForTesting(domain.Name, &domain)
+
+	ctx := rcontext.Initial()
+	ctx.Config = domain
+	db := database.GetInstance()
+
+	upload := func(content string, roomIds []string) *database.DbMedia {
+		media, err := pipeline_upload.Execute(ctx, domain.Name, "", io.NopCloser(bytes.NewReader([]byte(content))), "text/plain", "file.txt", "@alice:replica.test", datastores.LocalMediaKind, roomIds)
+		assert.NoError(t, err)
+		return media
+	}
+	kept := upload("kept on the primary", []string{"!old:replica.test"})
+	quarantined := upload("quarantined on the primary", nil)
+	deleted := upload("deleted on the primary", nil)
+
+	batch := &task_runner.ReplicationBatch{
+		Media: []*task_runner.ReplicationMedia{},
+		Events: []*task_runner.ReplicationEvent{
+			{Type: database.ReplicationEventReferenceAdded, Origin: domain.Name, MediaId: kept.MediaId, RoomId: "!new:replica.test", EventId: "$new"},
+			{Type: database.ReplicationEventReferenceRemoved, Origin: domain.Name, MediaId: kept.MediaId, RoomId: "!old:replica.test"},
+			{Type: database.ReplicationEventMediaQuarantined, Origin: domain.Name, MediaId: quarantined.MediaId},
+			{Type: database.ReplicationEventMediaDeleted, Origin: domain.Name, MediaId: deleted.MediaId},
+			{Type: database.ReplicationEventMediaDeleted, Origin: domain.Name, MediaId: "never_replicated"},
+			{Type: database.ReplicationEventMediaDeleted, Origin: "elsewhere.test", MediaId: kept.MediaId},
+		},
+		NextBatch: "next",
+	}
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/_matrix/media/unstable/admin/replication/media", r.URL.Path)
+		assert.Equal(t, "Bearer primary_token", r.Header.Get("Authorization"))
+		_ = json.NewEncoder(w).Encode(batch)
+	}))
+	defer primary.Close()
+
+	replication := config.Get().Replication
+	config.Get().Replication = config.ReplicationConfig{
+		Enabled:        true,
+		PrimaryUrl:     primary.URL,
+		AccessToken:    "primary_token",
+		BatchSize:      100,
+		TimeoutSeconds: 10,
+	}
+	defer func() {
+		config.Get().Replication = replication
+	}()
+
+	task_runner.ReplicateMedia(ctx)
+
+	refs, err := db.MediaReferences.Prepare(ctx).GetForMedia(domain.Name, kept.MediaId)
+	assert.NoError(t, err)
+	if assert.Len(t, refs, 1) {
+		assert.Equal(t, "!new:replica.test", refs[0].RoomId)
+		assert.Equal(t, "$new", refs[0].EventId)
+	}
+
+	record, err := db.Media.Prepare(ctx).GetById(domain.Name, quarantined.MediaId)
+	assert.NoError(t, err)
+	if assert.NotNil(t, record) {
+		assert.True(t, record.Quarantined)
+	}
+
+	record, err = db.Media.Prepare(ctx).GetById(domain.Name, deleted.MediaId)
+	assert.NoError(t, err)
+	assert.Nil(t, record)
+	record, err = db.Media.Prepare(ctx).GetById(domain.Name, kept.MediaId)
+	assert.NoError(t, err)
+	assert.NotNil(t, record)
+
+	since, err := db.Replication.Prepare(ctx).GetSinceToken(primary.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, "next", since)
+}
@@ -0,0 +1,78 @@
+package test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/restrictions"
+	"github.com/t2bot/matrix-media-repo/test/test_internals"
+)
+
+func TestCheckRoomAccess(t *testing.T) {
+	test_internals.UseSqliteDatabase(t)
+
+	const roomId = "!private:room-access.test"
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/_matrix/client/v3/joined_rooms" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		joined := []string{"!other:room-access.test"}
+		if r.Header.Get("Authorization") == "Bearer member_token" {
+			joined = append(joined, roomId)
+		}
+		_ = json.NewEncoder(w).Encode(map[string][]string{"joined_rooms": joined})
+	}))
+	defer hs.Close()
+
+	domain := config.NewDefaultDomainConfig()
+	domain.Name = "room-access.test"
+	domain.ClientServerApi = hs.URL
+	domain.Downloads.RoomAccess.Enabled = true
+	domain.Downloads.RoomAccess.MembershipCacheSeconds = 0
+	config.AddDomainForTesting(domain.Name, &domain)
+
+	admins := config.Get().Admins
+	config.Get().Admins = []string{"@admin:room-access.test"}
+	defer func() {
+		config.Get().Admins = admins
+	}()
+
+	ctx := rcontext.Initial()
+	ctx.Config = domain
+	ctx.Request = httptest.NewRequest(http.MethodGet, "http://room-access.test/_matrix/client/v1/media/download/room-access.test/referenced", nil)
+
+	err := database.GetInstance().MediaReferences.Prepare(ctx).Insert(&database.DbMediaReference{
+		Origin:     "room-access.test",
+		MediaId:    "referenced",
+		RoomId:     roomId,
+		EventId:    "$event",
+		CreationTs: 1,
+	})
+	assert.NoError(t, err)
+
+	check := func(mediaId string, requester restrictions.Requester) error {
+		return restrictions.CheckRoomAccess(ctx, "room-access.test", mediaId, requester)
+	}
+
+	// Media which isn't referenced by any rooms is always accessible
+	assert.NoError(t, check("unreferenced", restrictions.Requester{}))
+
+	assert.ErrorIs(t, check("referenced", restrictions.Requester{}), common.ErrRestrictedAuth)
+	assert.NoError(t, check("referenced", restrictions.Requester{UserId: "@member:room-access.test", AccessToken: "member_token"}))
+	assert.ErrorIs(t, check("referenced", restrictions.Requester{UserId: "@stranger:room-access.test", AccessToken: "stranger_token"}), common.ErrRestrictedRoomMembership)
+	assert.NoError(t, check("referenced", restrictions.Requester{UserId: "@admin:room-access.test", AccessToken: "admin_token"}))
+	assert.NoError(t, check("referenced", restrictions.Requester{UserId: "@sharedsecret", AccessToken: "shared_secret", IsShared: true}))
+
+	// Federation is refused unless allowed
+	assert.ErrorIs(t, check("referenced", restrictions.Requester{ServerName: "remote.test"}), common.ErrRestrictedRoomMembership)
+	ctx.Config.Downloads.RoomAccess.AllowFederation = true
+	assert.NoError(t, check("referenced", restrictions.Requester{ServerName: "remote.test"}))
+}
@@ -0,0 +1,181 @@
+package test
+
+import (
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/test/test_internals"
+)
+
+func insertSqliteTestMedia(t *testing.T, ctx rcontext.RequestContext, origin string, mediaId string, userId string, contentType string, sizeBytes int64, creationTs int64) {
+	err := database.GetInstance().Media.Prepare(ctx).Insert(&database.DbMedia{
+		Locatable: &database.Locatable{
+			Sha256Hash:  mediaId + "_hash",
+			DatastoreId: "ds",
+			Location:    "/" + mediaId,
+		},
+		Origin:      origin,
+		MediaId:     mediaId,
+		UploadName:  mediaId + ".bin",
+		ContentType: contentType,
+		UserId:      userId,
+		SizeBytes:   sizeBytes,
+		CreationTs:  creationTs,
+	})
+	assert.NoError(t, err)
+}
+
+func TestSqliteMediaQueries(t *testing.T) {
+	test_internals.UseSqliteDatabase(t)
+	ctx := rcontext.Initial()
+	db := database.GetInstance()
+
+	insertSqliteTestMedia(t, ctx, "example.org", "a", "@alice:example.org", "image/png", 10, 1000)
+	insertSqliteTestMedia(t, ctx, "example.org", "b", "@bob:example.org", "video/mp4", 20, 2000)
+	insertSqliteTestMedia(t, ctx, "remote.org", "c", "@carol:remote.org", "image/JPEG", 40, 3000)
+
+	media, err := db.Media.Prepare(ctx).GetByIds("example.org", []string{"a", "b", "c"})
+	assert.NoError(t, err)
+	assert.Len(t, media, 2)
+
+	media, err = db.Media.Prepare(ctx).GetByOriginUsers("example.org", []string{"@bob:example.org"})
+	assert.NoError(t, err)
+	if assert.Len(t, media, 1) {
+		assert.Equal(t, "b", media[0].MediaId)
+		assert.False(t, media[0].Quarantined)
+	}
+
+	media, err = db.Media.Prepare(ctx).GetOldExcluding([]string{"example.org"}, 5000)
+	assert.NoError(t, err)
+	if assert.Len(t, media, 1) {
+		assert.Equal(t, "c", media[0].MediaId)
+	}
+
+	media, err = db.Media.Prepare(ctx).GetForReplication([]string{"example.org", "remote.org"}, 1000, "example.org", "a", 5000, 10)
+	assert.NoError(t, err)
+	if assert.Len(t, media, 2) {
+		assert.Equal(t, "b", media[0].MediaId)
+		assert.Equal(t, "c", media[1].MediaId)
+	}
+
+	// User stats are kept up to date by triggers
+	uploaded, err := db.UserStats.Prepare(ctx).UserUploadedBytes("@alice:example.org")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(10), uploaded)
+	assert.NoError(t, db.Media.Prepare(ctx).Delete("example.org", "a"))
+	uploaded, err = db.UserStats.Prepare(ctx).UserUploadedBytes("@alice:example.org")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), uploaded)
+
+	// LIKE patterns are case-sensitive, as in PostgreSQL
+	candidates, err := db.MetadataView.Prepare(ctx).RetentionCandidates([]string{"example.org"}, "any", 5000, 5000, []string{"image/j%", "video/%"}, 0, false)
+	assert.NoError(t, err)
+	if assert.Len(t, candidates, 1) {
+		assert.Equal(t, "b", candidates[0].MediaId)
+	}
+	candidates, err = db.MetadataView.Prepare(ctx).RetentionCandidates([]string{"example.org"}, "remote", 5000, 5000, []string{}, 0, false)
+	assert.NoError(t, err)
+	if assert.Len(t, candidates, 1) {
+		assert.Equal(t, "c", candidates[0].MediaId)
+	}
+
+	report, err := db.MetadataView.Prepare(ctx).StorageReport([]string{"example.org"}, [4]int64{0, 0, 0, 0})
+	assert.NoError(t, err)
+	localBytes := int64(0)
+	for _, row := range report {
+		if row.IsLocal {
+			localBytes += row.SizeBytes
+		}
+	}
+	assert.Equal(t, int64(20), localBytes)
+}
+
+func TestSqliteArraysAndJson(t *testing.T) {
+	test_internals.UseSqliteDatabase(t)
+	ctx := rcontext.Initial()
+	db := database.GetInstance()
+
+	roomIds := []string{"!a:example.org", "!b,\"c\":example.org"}
+	assert.NoError(t, db.ExpiringMedia.Prepare(ctx).Insert("example.org", "pending", "@alice:example.org", 5000, roomIds))
+	pending, err := db.ExpiringMedia.Prepare(ctx).Get("example.org", "pending")
+	assert.NoError(t, err)
+	if assert.NotNil(t, pending) {
+		assert.Equal(t, roomIds, pending.RoomIds)
+	}
+
+	task, err := db.Tasks.Prepare(ctx).Insert("test_task", &database.AnonymousJson{"key": "value"}, 1000)
+	assert.NoError(t, err)
+	assert.NotZero(t, task.TaskId)
+	assert.NoError(t, db.Tasks.Prepare(ctx).SetProgress(task.TaskId, &database.AnonymousJson{"done": 1.0}))
+	task, err = db.Tasks.Prepare(ctx).Get(task.TaskId)
+	assert.NoError(t, err)
+	assert.Equal(t, "value", (*task.Params)["key"])
+	assert.Equal(t, 1.0, (*task.Progress)["done"])
+	assert.Empty(t, *task.Checkpoint)
+
+	assert.NoError(t, db.ExportParts.Prepare(ctx).Insert(&database.DbExportPart{ExportId: "export", PartNum: 2, SizeBytes: 10, FileName: "part2.tgz", DatastoreId: "ds", Location: "/part2"}))
+	part, err := db.ExportParts.Prepare(ctx).Get("export", 2)
+	assert.NoError(t, err)
+	if assert.NotNil(t, part) {
+		assert.Equal(t, "part2.tgz", part.FileName)
+	}
+}
+
+var migrationFileRegex = regexp.MustCompile(`^(\d+)_(.+)_(up|down)\.sql$`)
+
+func readMigrationNames(t *testing.T, dir string) map[int]string {
+	entries, err := os.ReadDir(dir)
+	if !assert.NoError(t, err) {
+		return nil
+	}
+	names := make(map[int]string)
+	for _, entry := range entries {
+		matches := migrationFileRegex.FindStringSubmatch(entry.Name())
+		if entry.IsDir() || matches == nil {
+			continue
+		}
+		num, err := strconv.Atoi(matches[1])
+		assert.NoError(t, err)
+		names[num] = matches[1] + "_" + matches[2]
+	}
+	return names
+}
+
+func TestSqliteMigrationsMatchPostgres(t *testing.T) {
+	postgres := readMigrationNames(t, "../migrations")
+	sqlite := readMigrationNames(t, "../migrations/sqlite")
+
+	// The first SQLite migration covers every PostgreSQL migration up to its number. Each later PostgreSQL migration
+	// needs a SQLite migration with the same name.
+	snapshot := -1
+	for num := range sqlite {
+		if snapshot < 0 || num < snapshot {
+			snapshot = num
+		}
+	}
+	if !assert.NotEmpty(t, postgres[snapshot], "no PostgreSQL migration %d", snapshot) {
+		return
+	}
+	for num, name := range postgres {
+		if num <= snapshot {
+			continue
+		}
+		if assert.Equal(t, name, sqlite[num], "PostgreSQL migration %s has no SQLite counterpart in migrations/sqlite", name) {
+			for _, direction := range []string{"up", "down"} {
+				_, err := os.Stat(path.Join("../migrations/sqlite", name+"_"+direction+".sql"))
+				assert.NoError(t, err)
+			}
+		}
+	}
+	for num, name := range sqlite {
+		if num != snapshot {
+			assert.Equal(t, postgres[num], name, "SQLite migration %s has no PostgreSQL counterpart", name)
+		}
+	}
+}
@@ -33,7 +33,18 @@ type ContainerDeps struct {
 	Machines    []*mmrContainer
 }
 
+// TestDepsOptions changes how the test dependencies are set up, for suites which need something other than the
+// defaults.
+type TestDepsOptions struct {
+	// S3Redirects makes the media repo redirect downloads to presigned S3 URLs when the client allows redirects.
+	S3Redirects bool
+}
+
 func MakeTestDeps() (*ContainerDeps, error) {
+	return MakeTestDepsWithOptions(TestDepsOptions{})
+}
+
+func MakeTestDepsWithOptions(opts TestDepsOptions) (*ContainerDeps, error) {
 	ctx := context.Background()
 
 	// Create a network
@@ -177,6 +188,7 @@ func MakeTestDeps() (*ContainerDeps, error) {
 		RedisAddr:          fmt.Sprintf("%s:%d", redisIp, 6379), // we're behind the network for redis
 		PgConnectionString: pgConnStr,
 		S3Endpoint:         minioDep.Endpoint,
+		S3Redirects:        opts.S3Redirects,
 	}
 	mmrs, err := makeMmrInstances(ctx, 2, depNet, tmplArgs)
 	if err != nil {
@@ -29,6 +29,7 @@ type mmrTmplArgs struct {
 	RedisAddr          string
 	PgConnectionString string
 	S3Endpoint         string
+	S3Redirects        bool
 }
 
 type mmrContainer struct {
@@ -8,14 +8,26 @@ import (
 	"log"
 	"net/http"
 	"net/url"
+
+	"github.com/t2bot/matrix-media-repo/util"
 )
 
+var noRedirectClient = &http.Client{
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
 type MatrixClient struct {
 	AccessToken        string
 	ClientServerUrl    string
 	UserId             string
 	ServerName         string
 	AuthHeaderOverride string
+	// NoFollowRedirects returns redirect responses to the caller instead of following them.
+	NoFollowRedirects bool
+	// Headers are added to every request.
+	Headers http.Header
 }
 
 func (c *MatrixClient) WithCsUrl(newUrl string) *MatrixClient {
@@ -33,6 +45,22 @@ func (c *MatrixClient) Upload(filename string, contentType string, body io.Reade
 	return val, err
 }
 
+// Create reserves a media ID for an asynchronous (MSC2246) upload.
+func (c *MatrixClient) Create() (*MatrixCreatedMediaResponse, error) {
+	val := new(MatrixCreatedMediaResponse)
+	err := c.DoReturnJson("POST", "/_matrix/media/v1/create", nil, "", nil, val)
+	return val, err
+}
+
+// UploadAsync uploads the content for a media ID reserved with Create.
+func (c *MatrixClient) UploadAsync(mxc string, filename string, contentType string, body io.Reader) error {
+	origin, mediaId, err := util.SplitMxc(mxc)
+	if err != nil {
+		return err
+	}
+	return c.DoReturnJson("PUT", fmt.Sprintf("/_matrix/media/v3/upload/%s/%s", origin, mediaId), url.Values{"filename": []string{filename}}, contentType, body, &struct{}{})
+}
+
 func (c *MatrixClient) DoReturnJson(method string, endpoint string, qs url.Values, contentType string, body io.Reader, retVal interface{}) error {
 	res, err := c.DoRaw(method, endpoint, qs, contentType, body)
 	if err != nil {
@@ -88,7 +116,15 @@ func (c *MatrixClient) DoRaw(method string, endpoint string, qs url.Values, cont
 	if c.AuthHeaderOverride != "" {
 		req.Header.Set("Authorization", c.AuthHeaderOverride)
 	}
+	for name, values := range c.Headers {
+		for _, v := range values {
+			req.Header.Add(name, v)
+		}
+	}
 
 	log.Printf("[HTTP] [Auth=%s] [Host=%s] %s %s", req.Header.Get("Authorization"), c.ServerName, req.Method, req.URL.String())
+	if c.NoFollowRedirects {
+		return noRedirectClient.Do(req)
+	}
 	return http.DefaultClient.Do(req)
 }
@@ -0,0 +1,20 @@
+package test_internals
+
+import (
+	"path"
+	"testing"
+
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/database"
+)
+
+// UseSqliteDatabase points the database package at a new SQLite database for the duration of the test, so code which
+// needs a database can be tested without the container dependencies.
+func UseSqliteDatabase(t *testing.T) {
+	config.Get().Database.Sqlite = path.Join(t.TempDir(), "media-repo.db")
+	config.Runtime.MigrationsPath = "../migrations"
+	database.Reload()
+	t.Cleanup(func() {
+		config.Get().Database.Sqlite = ""
+	})
+}
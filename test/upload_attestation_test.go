@@ -0,0 +1,132 @@
+package test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/pipelines/_steps/upload"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+func signAttestation(t *testing.T, key ed25519.PrivateKey, attestation *upload.Attestation) string {
+	b, err := json.Marshal(attestation)
+	assert.NoError(t, err)
+	payload := "a1." + base64.RawURLEncoding.EncodeToString(b)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(ed25519.Sign(key, []byte(payload)))
+}
+
+func makeAttestationContext(t *testing.T) (rcontext.RequestContext, ed25519.PrivateKey) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+
+	domain := config.NewDefaultDomainConfig()
+	domain.Name = "attestation.test"
+	domain.Uploads.Attestation = config.AttestationConfig{
+		Enabled:            true,
+		MinBytes:           100,
+		MaxLifetimeSeconds: 300,
+		TrustedKeys: map[string]string{
+			"test": util.EncodeUnpaddedBase64ToString(pub),
+		},
+	}
+
+	ctx := rcontext.Initial()
+	ctx.Config = domain
+	return ctx, priv
+}
+
+func TestUploadAttestationVerify(t *testing.T) {
+	ctx, key := makeAttestationContext(t)
+	const userId = "@alice:attestation.test"
+	valid := func() *upload.Attestation {
+		return &upload.Attestation{
+			KeyId:     "test",
+			UserId:    userId,
+			MaxBytes:  1000,
+			ExpiresTs: util.NowMillis() + 60000,
+		}
+	}
+
+	attestation := valid()
+	token := signAttestation(t, key, attestation)
+	verified, err := upload.VerifyAttestation(ctx, token, userId)
+	assert.NoError(t, err)
+	assert.Equal(t, attestation, verified)
+
+	// Attestations are only for the user they were issued to
+	_, err = upload.VerifyAttestation(ctx, token, "@bob:attestation.test")
+	assert.ErrorIs(t, err, common.ErrInvalidAttestation)
+
+	_, otherKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	_, err = upload.VerifyAttestation(ctx, signAttestation(t, otherKey, valid()), userId)
+	assert.ErrorIs(t, err, common.ErrInvalidAttestation)
+
+	// Raising the size limit invalidates the signature
+	raised := valid()
+	raised.MaxBytes = 1000000
+	parts := strings.Split(token, ".")
+	parts[1] = strings.Split(signAttestation(t, key, raised), ".")[1]
+	_, err = upload.VerifyAttestation(ctx, strings.Join(parts, "."), userId)
+	assert.ErrorIs(t, err, common.ErrInvalidAttestation)
+
+	untrusted := valid()
+	untrusted.KeyId = "other"
+	_, err = upload.VerifyAttestation(ctx, signAttestation(t, key, untrusted), userId)
+	assert.ErrorIs(t, err, common.ErrInvalidAttestation)
+
+	expired := valid()
+	expired.ExpiresTs = util.NowMillis() - 1
+	_, err = upload.VerifyAttestation(ctx, signAttestation(t, key, expired), userId)
+	assert.ErrorIs(t, err, common.ErrInvalidAttestation)
+
+	// The lifetime is limited to 5 minutes
+	longLived := valid()
+	longLived.ExpiresTs = util.NowMillis() + 3600000
+	_, err = upload.VerifyAttestation(ctx, signAttestation(t, key, longLived), userId)
+	assert.ErrorIs(t, err, common.ErrInvalidAttestation)
+
+	for _, invalid := range []string{"", "a1", "a1.abc", "a2" + token[2:], token + ".x", "a1.!!!." + parts[2]} {
+		_, err = upload.VerifyAttestation(ctx, invalid, userId)
+		assert.ErrorIs(t, err, common.ErrInvalidAttestation, invalid)
+	}
+}
+
+func TestUploadAttestationCheck(t *testing.T) {
+	ctx, _ := makeAttestationContext(t)
+	const hash = "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+	attestation := &upload.Attestation{
+		KeyId:     "test",
+		UserId:    "@alice:attestation.test",
+		MaxBytes:  1000,
+		ExpiresTs: util.NowMillis() + 60000,
+	}
+
+	// Uploads made by the media repo itself aren't flagged, and so aren't checked
+	assert.NoError(t, upload.CheckAttestation(ctx, 5000, hash))
+
+	unattested := upload.FlagAttestation(ctx, nil)
+	assert.NoError(t, upload.CheckAttestation(unattested, 99, hash))
+	assert.ErrorIs(t, upload.CheckAttestation(unattested, 100, hash), common.ErrAttestationRequired)
+
+	attested := upload.FlagAttestation(ctx, attestation)
+	assert.NoError(t, upload.CheckAttestation(attested, 1000, hash))
+	assert.ErrorIs(t, upload.CheckAttestation(attested, 1001, hash), common.ErrAttestationRequired)
+
+	// Attestations for specific content only cover uploads of that content
+	attestation.Sha256Hash = strings.ToUpper(hash)
+	assert.NoError(t, upload.CheckAttestation(attested, 1000, hash))
+	assert.NoError(t, upload.CheckAttestation(attested, 1000, ""))
+	assert.ErrorIs(t, upload.CheckAttestation(attested, 1000, "2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae"), common.ErrAttestationRequired)
+
+	ctx.Config.Uploads.Attestation.Enabled = false
+	assert.NoError(t, upload.CheckAttestation(upload.FlagAttestation(ctx, nil), 5000, hash))
+}
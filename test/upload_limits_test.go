@@ -0,0 +1,91 @@
+package test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/limits"
+)
+
+func uploadLimitsContext(serverName string, conf config.UploadRateLimits) rcontext.RequestContext {
+	domain := config.NewDefaultDomainConfig()
+	domain.Name = serverName
+	domain.Uploads.RateLimit = conf
+	config.AddDomainForTesting(domain.Name, &domain)
+
+	ctx := rcontext.Initial()
+	ctx.Config = domain
+	return ctx
+}
+
+func assertRateLimited(t *testing.T, err error, window time.Duration) {
+	assert.ErrorIs(t, err, common.ErrRateLimitExceeded)
+	var limitErr *limits.RateLimitError
+	if assert.ErrorAs(t, err, &limitErr) {
+		assert.Greater(t, limitErr.RetryAfter, time.Duration(0))
+		assert.LessOrEqual(t, limitErr.RetryAfter, window)
+	}
+}
+
+func TestUploadRateLimitsDisabledPerDomain(t *testing.T) {
+	ctx := uploadLimitsContext("limits-disabled.test", config.UploadRateLimits{
+		Enabled: false,
+		PerUser: config.UploadRateLimitConfig{UploadsPerMinute: 1, BytesPerHour: 1},
+	})
+
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, limits.CheckUploadStart(ctx, "@alice:limits-disabled.test", "limits-disabled.test", 100))
+		assert.NoError(t, limits.CheckUpload(ctx, "@alice:limits-disabled.test", "limits-disabled.test", 100))
+	}
+}
+
+func TestUploadRateLimitsUploadsPerMinute(t *testing.T) {
+	const serverName = "limits-count.test"
+	ctx := uploadLimitsContext(serverName, config.UploadRateLimits{
+		Enabled: true,
+		PerUser: config.UploadRateLimitConfig{UploadsPerMinute: 2},
+	})
+
+	// Checking before the body is read doesn't count the upload
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, limits.CheckUploadStart(ctx, "@alice:"+serverName, serverName, -1))
+	}
+
+	assert.NoError(t, limits.CheckUpload(ctx, "@alice:"+serverName, serverName, 10))
+	assert.NoError(t, limits.CheckUpload(ctx, "@alice:"+serverName, serverName, 10))
+	assertRateLimited(t, limits.CheckUploadStart(ctx, "@alice:"+serverName, serverName, -1), time.Minute)
+	assertRateLimited(t, limits.CheckUpload(ctx, "@alice:"+serverName, serverName, 10), time.Minute)
+
+	// Other users have their own limit
+	assert.NoError(t, limits.CheckUploadStart(ctx, "@bob:"+serverName, serverName, -1))
+	assert.NoError(t, limits.CheckUpload(ctx, "@bob:"+serverName, serverName, 10))
+}
+
+func TestUploadRateLimitsBytesPerHour(t *testing.T) {
+	const serverName = "limits-bytes.test"
+	ctx := uploadLimitsContext(serverName, config.UploadRateLimits{
+		Enabled:   true,
+		PerUser:   config.UploadRateLimitConfig{UploadsPerMinute: 3},
+		PerServer: config.UploadRateLimitConfig{BytesPerHour: 100},
+	})
+
+	// The declared Content-Length is checked before the body is read, if known
+	assertRateLimited(t, limits.CheckUploadStart(ctx, "@alice:"+serverName, serverName, 150), time.Hour)
+	assert.NoError(t, limits.CheckUploadStart(ctx, "@alice:"+serverName, serverName, -1))
+	assert.NoError(t, limits.CheckUploadStart(ctx, "@alice:"+serverName, serverName, 100))
+
+	assert.NoError(t, limits.CheckUpload(ctx, "@alice:"+serverName, serverName, 60))
+	assertRateLimited(t, limits.CheckUploadStart(ctx, "@bob:"+serverName, serverName, 50), time.Hour)
+	assert.NoError(t, limits.CheckUploadStart(ctx, "@bob:"+serverName, serverName, 40))
+
+	// A rejected upload isn't counted against any limit
+	assertRateLimited(t, limits.CheckUpload(ctx, "@alice:"+serverName, serverName, 50), time.Hour)
+	assertRateLimited(t, limits.CheckUpload(ctx, "@alice:"+serverName, serverName, 50), time.Hour)
+	assert.NoError(t, limits.CheckUpload(ctx, "@alice:"+serverName, serverName, 40))
+	assert.NoError(t, limits.CheckUploadStart(ctx, "@alice:"+serverName, serverName, -1))
+	assertRateLimited(t, limits.CheckUploadStart(ctx, "@alice:"+serverName, serverName, 1), time.Hour)
+}
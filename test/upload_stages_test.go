@@ -0,0 +1,58 @@
+package test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/datastores"
+	"github.com/t2bot/matrix-media-repo/pipelines/pipeline_upload"
+	"github.com/t2bot/matrix-media-repo/test/test_internals"
+)
+
+func TestUploadSafetyStagesCannotBeDisabled(t *testing.T) {
+	test_internals.UseSqliteDatabase(t)
+
+	domain := config.NewDefaultDomainConfig()
+	domain.Name = "stages.test"
+	domain.DataStores = []config.DatastoreConfig{{
+		Id:         "stages_test",
+		Type:       "file",
+		MediaKinds: []string{"all"},
+		Options:    map[string]string{"path": t.TempDir()},
+	}}
+	domain.Uploads.DisabledStages = []string{"antivirus", "hashmatch", "quarantine", "attestation", "quota"}
+	config.AddDomainForTesting(domain.Name, &domain)
+
+	ctx := rcontext.Initial()
+	ctx.Config = domain
+
+	content := []byte("quarantined content")
+	hash := sha256.Sum256(content)
+	err := database.GetInstance().Media.Prepare(ctx).Insert(&database.DbMedia{
+		Origin:      domain.Name,
+		MediaId:     "quarantined",
+		UploadName:  "bad.txt",
+		ContentType: "text/plain",
+		UserId:      "@alice:stages.test",
+		SizeBytes:   int64(len(content)),
+		CreationTs:  1,
+		Quarantined: true,
+		Locatable: &database.Locatable{
+			Sha256Hash:  hex.EncodeToString(hash[:]),
+			DatastoreId: "stages_test",
+			Location:    "/quarantined",
+		},
+	})
+	assert.NoError(t, err)
+
+	_, err = pipeline_upload.Execute(ctx, domain.Name, "", io.NopCloser(bytes.NewReader(content)), "text/plain", "bad.txt", "@alice:stages.test", datastores.LocalMediaKind, nil)
+	assert.ErrorIs(t, err, common.ErrMediaQuarantined)
+}
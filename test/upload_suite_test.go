@@ -1,6 +1,7 @@
 package test
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
 	"log"
@@ -342,6 +343,83 @@ func (s *UploadTestSuite) TestUploadAsyncExpiredFlow() {
 	assert.Equal(t, http.StatusNotFound, errRes.InjectedStatusCode)
 }
 
+func (s *UploadTestSuite) TestUploadIdempotencyConcurrent() {
+	t := s.T()
+	const concurrentUploads = 20
+
+	key, err := util.GenerateRandomString(32)
+	assert.NoError(t, err)
+	namePrefix, err := util.GenerateRandomString(32)
+	assert.NoError(t, err)
+
+	// Different images under the same key, so any duplicate upload would be stored as separate media
+	images := make([]io.Reader, concurrentUploads)
+	contentTypes := make([]string, concurrentUploads)
+	for i := 0; i < concurrentUploads; i++ {
+		c, img, err := test_internals.MakeTestImage(128+i, 128)
+		assert.NoError(t, err)
+		images[i] = img
+		contentTypes[i] = c
+	}
+
+	newClient := func(machine int) *test_internals.MatrixClient {
+		c := s.deps.Homeservers[0].UnprivilegedUsers[0].WithCsUrl(s.deps.Machines[machine].HttpUrl)
+		c.Headers = http.Header{"Idempotency-Key": []string{key}}
+		return c
+	}
+	client1 := newClient(0)
+
+	waiter := new(sync.WaitGroup)
+	waiter.Add(1)
+	uploadWaiter := new(sync.WaitGroup)
+	mxcs := new(sync.Map)
+	for i := 0; i < concurrentUploads; i++ {
+		uploadWaiter.Add(1)
+		go func(j int) {
+			defer uploadWaiter.Done()
+			client := newClient(j % len(s.deps.Machines))
+			waiter.Wait()
+
+			raw, err := client.DoRaw("POST", "/_matrix/media/v3/upload", url.Values{"filename": []string{namePrefix + util.ExtensionForContentType(contentTypes[j])}}, contentTypes[j], images[j])
+			assert.NoError(t, err)
+			if raw.StatusCode == http.StatusConflict {
+				return // another request holds the key
+			}
+			assert.Equal(t, http.StatusOK, raw.StatusCode)
+			res := new(test_internals.MatrixUploadResponse)
+			assert.NoError(t, json.NewDecoder(raw.Body).Decode(res))
+			assert.NotEmpty(t, res.MxcUri)
+			mxcs.Store(res.MxcUri, true)
+		}(i)
+	}
+	waiter.Done()
+	uploadWaiter.Wait()
+
+	// Every successful response points at the same media
+	uniqueMxcs := make([]string, 0)
+	mxcs.Range(func(key any, value any) bool {
+		uniqueMxcs = append(uniqueMxcs, key.(string))
+		return true
+	})
+	assert.Len(t, uniqueMxcs, 1)
+
+	// ... and only that media was stored
+	var count int
+	db := database.GetAccessorForTests()
+	err = db.QueryRow("SELECT COUNT(*) FROM media WHERE user_id = $1 AND upload_name LIKE $2;", client1.UserId, namePrefix+"%").Scan(&count)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	// Retrying once everything has finished returns the same media too
+	contentType, img, err := test_internals.MakeTestImage(64, 64)
+	assert.NoError(t, err)
+	res, err := client1.Upload(namePrefix+util.ExtensionForContentType(contentType), contentType, img)
+	assert.NoError(t, err)
+	if len(uniqueMxcs) > 0 {
+		assert.Equal(t, uniqueMxcs[0], res.MxcUri)
+	}
+}
+
 func TestUploadTestSuite(t *testing.T) {
 	suite.Run(t, new(UploadTestSuite))
 }
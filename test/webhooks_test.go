@@ -0,0 +1,124 @@
+package test
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/events"
+	"github.com/t2bot/matrix-media-repo/webhooks"
+)
+
+func TestWebhookSign(t *testing.T) {
+	body := []byte(`{"id":"abc","type":"media.uploaded"}`)
+
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write([]byte("1700000000000." + string(body)))
+	expected := "t=1700000000000,v1=" + hex.EncodeToString(mac.Sum(nil))
+
+	assert.Equal(t, expected, webhooks.Sign("s3cret", 1700000000000, body))
+	assert.NotEqual(t, expected, webhooks.Sign("other", 1700000000000, body))
+	assert.NotEqual(t, expected, webhooks.Sign("s3cret", 1700000000001, body))
+	assert.NotEqual(t, expected, webhooks.Sign("s3cret", 1700000000000, []byte(`{"id":"abd","type":"media.uploaded"}`)))
+}
+
+type receivedWebhook struct {
+	header http.Header
+	body   []byte
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	received := make(chan receivedWebhook, 10)
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- receivedWebhook{header: r.Header, body: body}
+	}))
+	defer fast.Close()
+
+	// An endpoint which never responds shouldn't hold up deliveries to the other endpoint
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer slow.Close()
+	defer close(release)
+
+	conf := config.Get().Webhooks
+	config.Get().Webhooks = config.WebhooksConfig{
+		QueueSize:      10,
+		TimeoutSeconds: 30,
+		MaxAttempts:    1,
+		Endpoints: []config.WebhookEndpointConfig{
+			{Url: slow.URL},
+			{Url: fast.URL, Secret: "s3cret", Events: []string{string(webhooks.MediaUploaded), string(webhooks.MediaDeleted)}},
+		},
+	}
+	defer func() {
+		config.Get().Webhooks = conf
+	}()
+
+	ctx := rcontext.Initial()
+	record := &database.DbMedia{
+		Origin:      "webhooks.test",
+		MediaId:     "abc123",
+		UserId:      "@alice:webhooks.test",
+		SizeBytes:   1024,
+		ContentType: "image/png",
+		Locatable:   &database.Locatable{Sha256Hash: "hash"},
+	}
+
+	receive := func(expected webhooks.EventType) {
+		select {
+		case r := <-received:
+			assert.Equal(t, "application/json", r.header.Get("Content-Type"))
+			assert.Equal(t, string(expected), r.header.Get(webhooks.EventHeader))
+
+			event := &webhooks.Event{}
+			assert.NoError(t, json.Unmarshal(r.body, event))
+			assert.Equal(t, expected, event.Type)
+			assert.Equal(t, event.Id, r.header.Get(webhooks.DeliveryHeader))
+			assert.Equal(t, &webhooks.EventMedia{
+				Origin:      record.Origin,
+				MediaId:     record.MediaId,
+				UserId:      record.UserId,
+				SizeBytes:   record.SizeBytes,
+				ContentType: record.ContentType,
+				Sha256Hash:  record.Sha256Hash,
+			}, event.Media)
+
+			signature := r.header.Get(webhooks.SignatureHeader)
+			tsStr, _, _ := strings.Cut(strings.TrimPrefix(signature, "t="), ",")
+			ts, err := strconv.ParseInt(tsStr, 10, 64)
+			assert.NoError(t, err)
+			assert.Equal(t, webhooks.Sign("s3cret", ts, r.body), signature)
+		case <-time.After(10 * time.Second):
+			assert.Failf(t, "webhook not delivered", "expected a %s event", expected)
+		}
+	}
+
+	// The fast endpoint doesn't want quarantine events, so the first event it receives is the upload
+	events.Emit(ctx, events.MediaQuarantined, record)
+	events.Emit(ctx, events.MediaUploaded, record)
+	receive(webhooks.MediaUploaded)
+
+	events.Emit(ctx, events.MediaPurged, record)
+	receive(webhooks.MediaDeleted)
+
+	select {
+	case r := <-received:
+		assert.Failf(t, "unexpected webhook", "received %s", r.header.Get(webhooks.EventHeader))
+	default:
+	}
+}
@@ -0,0 +1,48 @@
+package thumbnailing
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"io"
+
+	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/thumbnailing/u"
+)
+
+const blurhashThumbnailSize = 64
+
+// GenerateBlurhash computes a blurhash for the media, using the same generators (and limits) as thumbnails. Returns
+// ErrUnsupported if the media cannot be thumbnailed.
+func GenerateBlurhash(stream io.ReadCloser, contentType string, sizeBytes int64, ctx rcontext.RequestContext) (string, error) {
+	defer stream.Close()
+	if ctx.Config.Thumbnails.MaxSourceBytes > 0 && sizeBytes > ctx.Config.Thumbnails.MaxSourceBytes {
+		return "", common.ErrMediaTooLarge
+	}
+
+	// Buffer the source so small images can be decoded directly if they're too small to thumbnail
+	b, err := io.ReadAll(stream)
+	if err != nil {
+		return "", err
+	}
+
+	var img image.Image
+	thumb, err := GenerateThumbnail(io.NopCloser(bytes.NewReader(b)), contentType, blurhashThumbnailSize, blurhashThumbnailSize, "scale", false, ctx)
+	if errors.Is(err, common.ErrMediaDimensionsTooSmall) {
+		img, _, err = image.Decode(bytes.NewReader(b))
+		if err != nil {
+			return "", errors.New("error decoding small image: " + err.Error())
+		}
+	} else if err != nil {
+		return "", err
+	} else {
+		defer thumb.Reader.Close()
+		img, _, err = image.Decode(thumb.Reader)
+		if err != nil {
+			return "", errors.New("error decoding thumbnail: " + err.Error())
+		}
+	}
+
+	return u.EncodeBlurhash(img, 4, 3)
+}
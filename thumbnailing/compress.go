@@ -0,0 +1,39 @@
+package thumbnailing
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/jpeg"
+
+	"github.com/disintegration/imaging"
+	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+)
+
+// CompressJpeg re-encodes a JPEG at the given quality, shrinking it to fit within maxDimension pixels on its longest
+// side (if maxDimension is positive). The result is not guaranteed to be smaller than the input.
+func CompressJpeg(ctx rcontext.RequestContext, b []byte, maxDimension int, quality int) ([]byte, error) {
+	cfg, err := jpeg.DecodeConfig(bytes.NewReader(b))
+	if err != nil {
+		return nil, ErrUnsupported
+	}
+	if cfg.Width*cfg.Height >= ctx.Config.Thumbnails.MaxPixels {
+		return nil, common.ErrMediaTooLarge
+	}
+	src, err := imaging.Decode(bytes.NewReader(b), imaging.AutoOrientation(true))
+	if err != nil {
+		return nil, errors.New("compress: error decoding image: " + err.Error())
+	}
+
+	var img image.Image = src
+	if maxDimension > 0 && (src.Bounds().Dx() > maxDimension || src.Bounds().Dy() > maxDimension) {
+		img = imaging.Fit(src, maxDimension, maxDimension, imaging.Lanczos)
+	}
+
+	buf := &bytes.Buffer{}
+	if err = jpeg.Encode(buf, img, &jpeg.Options{Quality: quality}); err != nil {
+		return nil, errors.New("compress: error encoding image: " + err.Error())
+	}
+	return buf.Bytes(), nil
+}
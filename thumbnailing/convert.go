@@ -0,0 +1,104 @@
+package thumbnailing
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"strings"
+
+	"github.com/disintegration/imaging"
+	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/thumbnailing/m"
+)
+
+const (
+	FormatJpeg = "jpeg"
+	FormatPng  = "png"
+)
+
+// ConversionFormats are the formats media can be converted to on download.
+var ConversionFormats = []string{FormatJpeg, FormatPng, FormatWebP, FormatAvif}
+
+// ConversionContentType returns the content type produced by converting to the given format, or an empty string
+// if the format isn't supported.
+func ConversionContentType(format string) string {
+	switch format {
+	case FormatJpeg:
+		return "image/jpeg"
+	case FormatPng:
+		return "image/png"
+	default:
+		return FormatContentType(format)
+	}
+}
+
+// Convert decodes an image and re-encodes it in the given format. Only the first frame of animated images is kept.
+// Images larger than the thumbnailer's source limits return common.ErrMediaTooLarge, and media which can't be
+// decoded as an image returns ErrUnsupported. The stream is always consumed and closed.
+func Convert(ctx rcontext.RequestContext, imgStream io.ReadCloser, contentType string, format string) (*m.Thumbnail, error) {
+	defer imgStream.Close()
+	targetType := ConversionContentType(format)
+	if targetType == "" {
+		return nil, ErrFormatUnsupported
+	}
+	if !strings.HasPrefix(contentType, "image/") {
+		return nil, ErrUnsupported
+	}
+
+	b, err := io.ReadAll(io.LimitReader(imgStream, ctx.Config.Thumbnails.MaxSourceBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(b)) > ctx.Config.Thumbnails.MaxSourceBytes {
+		return nil, common.ErrMediaTooLarge
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(b))
+	if err != nil {
+		return nil, ErrUnsupported
+	}
+	if cfg.Width*cfg.Height >= ctx.Config.Thumbnails.MaxPixels {
+		return nil, common.ErrMediaTooLarge
+	}
+	src, err := imaging.Decode(bytes.NewReader(b), imaging.AutoOrientation(true))
+	if err != nil {
+		return nil, errors.New("convert: error decoding image: " + err.Error())
+	}
+
+	buf := &bytes.Buffer{}
+	if format == FormatJpeg {
+		// JPEG has no alpha channel, so flatten transparent areas onto white instead of black
+		bg := imaging.New(src.Bounds().Dx(), src.Bounds().Dy(), color.White)
+		err = jpeg.Encode(buf, imaging.Overlay(bg, src, image.Pt(0, 0), 1.0), &jpeg.Options{Quality: 90})
+	} else {
+		err = png.Encode(buf, src)
+	}
+	if err != nil {
+		return nil, errors.New("convert: error encoding image: " + err.Error())
+	}
+	if format == FormatJpeg || format == FormatPng {
+		return &m.Thumbnail{
+			Animated:    false,
+			ContentType: targetType,
+			Reader:      io.NopCloser(buf),
+		}, nil
+	}
+
+	// WebP and AVIF are encoded by ffmpeg, from a PNG
+	converted, err := Transcode(&m.Thumbnail{
+		Animated:    false,
+		ContentType: ConversionContentType(FormatPng),
+		Reader:      io.NopCloser(buf),
+	}, format, ctx)
+	if err != nil {
+		if converted != nil {
+			_ = converted.Reader.Close()
+		}
+		return nil, err
+	}
+	return converted, nil
+}
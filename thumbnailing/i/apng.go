@@ -49,6 +49,12 @@ func (d apngGenerator) GenerateThumbnail(b io.Reader, contentType string, width
 	// prepare a blank frame to use as swap space
 	frameImg := image.NewRGBA(p.Frames[0].Image.Bounds())
 
+	// Smart cropping each frame on its own would make the crop jump around, so frames are center cropped instead
+	frameMethod := method
+	if frameMethod == "smart" {
+		frameMethod = "crop"
+	}
+
 	for i, frame := range p.Frames {
 		img := frame.Image
 
@@ -70,7 +76,7 @@ func (d apngGenerator) GenerateThumbnail(b io.Reader, contentType string, width
 		draw.Draw(frameImg, image.Rect(frame.XOffset, frame.YOffset, frameImg.Rect.Max.X, frameImg.Rect.Max.Y), img, image.Point{X: 0, Y: 0}, draw.Src)
 
 		// Do the thumbnailing on the copied frame
-		frameThumb, err := u.MakeThumbnail(frameImg, method, width, height)
+		frameThumb, err := u.MakeThumbnail(frameImg, frameMethod, width, height)
 		if err != nil {
 			return nil, errors.New("apng: error generating thumbnail frame: " + err.Error())
 		}
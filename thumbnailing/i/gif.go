@@ -41,6 +41,12 @@ func (d gifGenerator) GenerateThumbnail(b io.Reader, contentType string, width i
 	// Prepare a blank frame to use as swap space
 	frameImg := image.NewRGBA(image.Rectangle{Min: image.Point{X: 0, Y: 0}, Max: image.Point{X: g.Config.Width, Y: g.Config.Height}})
 
+	// Smart cropping each frame on its own would make the crop jump around, so frames are center cropped instead
+	frameMethod := method
+	if frameMethod == "smart" {
+		frameMethod = "crop"
+	}
+
 	targetStaticFrame := int(math.Floor(math.Min(1, math.Max(0, float64(ctx.Config.Thumbnails.StillFrame))) * float64(len(g.Image))))
 
 	for i, img := range g.Image {
@@ -56,7 +62,7 @@ func (d gifGenerator) GenerateThumbnail(b io.Reader, contentType string, width i
 		draw.Draw(frameImg, frameImg.Bounds(), img, image.Point{X: 0, Y: 0}, draw.Over)
 
 		// Do the thumbnailing on the copied frame
-		frameThumb, err := u.MakeThumbnail(frameImg, method, width, height)
+		frameThumb, err := u.MakeThumbnail(frameImg, frameMethod, width, height)
 		if err != nil {
 			return nil, errors.New("gif: error generating thumbnail frame: " + err.Error())
 		}
@@ -0,0 +1,144 @@
+package i
+
+import (
+	"errors"
+	"io"
+	"math"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/thumbnailing/m"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+type videoGenerator struct {
+}
+
+func (d videoGenerator) supportedContentTypes() []string {
+	return []string{"video/mp4", "video/webm", "video/x-matroska", "video/quicktime"}
+}
+
+func (d videoGenerator) supportsAnimation() bool {
+	return false
+}
+
+func (d videoGenerator) matches(img io.Reader, contentType string) bool {
+	return util.ArrayContains(d.supportedContentTypes(), contentType)
+}
+
+func (d videoGenerator) GetOriginDimensions(b io.Reader, contentType string, ctx rcontext.RequestContext) (bool, int, int, error) {
+	return false, 0, 0, nil
+}
+
+func (d videoGenerator) GenerateThumbnail(b io.Reader, contentType string, width int, height int, method string, animated bool, ctx rcontext.RequestContext) (*m.Thumbnail, error) {
+	dir, err := os.MkdirTemp(os.TempDir(), "mmr-video")
+	if err != nil {
+		return nil, errors.New("video: error creating temporary directory: " + err.Error())
+	}
+
+	tempFile1 := path.Join(dir, "i"+util.ExtensionForContentType(contentType))
+	tempFile2 := path.Join(dir, "o.png")
+
+	defer os.Remove(tempFile1)
+	defer os.Remove(tempFile2)
+	defer os.Remove(dir)
+
+	f, err := os.OpenFile(tempFile1, os.O_RDWR|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, errors.New("video: error creating temp video file: " + err.Error())
+	}
+	_, err = io.Copy(f, b)
+	_ = f.Close()
+	if err != nil {
+		return nil, errors.New("video: error writing temp video file: " + err.Error())
+	}
+
+	// Try to use the configured still frame as the poster, falling back to the first frame if we can't seek
+	// there (short or unusually encoded videos, for example).
+	offset := d.posterFrameOffset(tempFile1, ctx)
+	err = d.extractFrame(tempFile1, tempFile2, offset, ctx)
+	if err != nil && offset > 0 {
+		ctx.Log.Debug("Error extracting poster frame, trying first frame instead: ", err)
+		err = d.extractFrame(tempFile1, tempFile2, 0, ctx)
+	}
+	if err != nil {
+		return nil, errors.New("video: error converting video file: " + err.Error())
+	}
+
+	f, err = os.OpenFile(tempFile2, os.O_RDONLY, 0640)
+	if err != nil {
+		return nil, errors.New("video: error reading temp png file: " + err.Error())
+	}
+	defer f.Close()
+
+	return pngGenerator{}.GenerateThumbnail(f, "image/png", width, height, method, false, ctx)
+}
+
+func (d videoGenerator) extractFrame(inFile string, outFile string, offset float64, ctx rcontext.RequestContext) error {
+	hwArgs := hwAccelArgs()
+	if len(hwArgs) > 0 {
+		err := d.runExtractFrame(inFile, outFile, offset, hwArgs, ctx)
+		if err == nil {
+			return nil
+		}
+		// Hardware decoders don't support every codec or profile, so fall back to software decoding
+		ctx.Log.Debug("Error extracting frame with hardware acceleration, trying software decoding: ", err)
+	}
+	return d.runExtractFrame(inFile, outFile, offset, nil, ctx)
+}
+
+func (d videoGenerator) runExtractFrame(inFile string, outFile string, offset float64, hwArgs []string, ctx rcontext.RequestContext) error {
+	args := make([]string, 0)
+	args = append(args, hwArgs...)
+	if offset > 0 {
+		args = append(args, "-ss", strconv.FormatFloat(offset, 'f', 3, 64))
+	}
+	args = append(args, "-i", inFile, "-frames:v", "1", "-y", outFile)
+	if err := exec.CommandContext(ctx.Context, "ffmpeg", args...).Run(); err != nil {
+		return err
+	}
+
+	// ffmpeg happily exits cleanly without writing a frame if we seek past the end
+	if info, err := os.Stat(outFile); err != nil {
+		return err
+	} else if info.Size() == 0 {
+		return errors.New("no frame extracted")
+	}
+	return nil
+}
+
+// hwAccelArgs returns the ffmpeg input arguments for the configured hardware acceleration, if any. Decoded frames are
+// copied back to system memory by ffmpeg, so the rest of the pipeline is unchanged.
+func hwAccelArgs() []string {
+	conf := config.Get().Ffmpeg
+	args := make([]string, 0)
+	if conf.HwAccel != "" {
+		args = append(args, "-hwaccel", conf.HwAccel)
+		if conf.HwAccelDevice != "" {
+			args = append(args, "-hwaccel_device", conf.HwAccelDevice)
+		}
+	}
+	return append(args, conf.ExtraInputArgs...)
+}
+
+func (d videoGenerator) posterFrameOffset(inFile string, ctx rcontext.RequestContext) float64 {
+	out, err := exec.CommandContext(ctx.Context, "ffprobe", "-v", "error", "-show_entries", "format=duration", "-of", "default=noprint_wrappers=1:nokey=1", inFile).Output()
+	if err != nil {
+		ctx.Log.Debug("Error probing video duration: ", err)
+		return 0
+	}
+	duration, err := strconv.ParseFloat(strings.TrimSpace(string(out)), 64)
+	if err != nil || duration <= 0 {
+		return 0
+	}
+	return duration * math.Min(1, math.Max(0, float64(ctx.Config.Thumbnails.StillFrame)))
+}
+
+func init() {
+	generators = append(generators, videoGenerator{})
+}
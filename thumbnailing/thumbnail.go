@@ -1,6 +1,7 @@
 package thumbnailing
 
 import (
+	"bytes"
 	"errors"
 	"io"
 	"reflect"
@@ -59,6 +60,19 @@ func GenerateThumbnail(imgStream io.ReadCloser, contentType string, width int, h
 		}
 	}
 
+	if canUseVips(ctx, contentType, animated) {
+		src, err := io.ReadAll(buffered.GetRewoundReader())
+		if err != nil {
+			return nil, err
+		}
+		thumb, err := generateWithVips(ctx, src, contentType, width, height, method)
+		if err == nil {
+			return thumb, nil
+		}
+		ctx.Log.Warn("Falling back to native thumbnailer: ", err)
+		return generator.GenerateThumbnail(bytes.NewReader(src), contentType, width, height, method, animated, ctx)
+	}
+
 	return generator.GenerateThumbnail(buffered.GetRewoundReader(), contentType, width, height, method, animated, ctx)
 }
 
@@ -70,3 +84,22 @@ func GetGenerator(imgStream io.Reader, contentType string, animated bool) (i.Gen
 
 	return generator, reconstructed, nil
 }
+
+// FitsWithin returns true if the image's dimensions are no larger than the given width and height, making it suitable
+// for use as its own thumbnail.
+func FitsWithin(imgStream io.ReadCloser, contentType string, width int, height int, ctx rcontext.RequestContext) (bool, error) {
+	defer imgStream.Close()
+	if !IsSupported(contentType) || !util.ArrayContains(ctx.Config.Thumbnails.Types, contentType) {
+		return false, ErrUnsupported
+	}
+
+	generator, reconstructed := i.GetGenerator(imgStream, contentType, false)
+	if generator == nil {
+		return false, ErrUnsupported
+	}
+	dimensional, w, h, err := generator.GetOriginDimensions(reconstructed, contentType, ctx)
+	if err != nil {
+		return false, errors.New("error getting dimensions: " + err.Error())
+	}
+	return dimensional && w <= width && h <= height, nil
+}
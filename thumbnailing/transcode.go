@@ -0,0 +1,121 @@
+package thumbnailing
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/thumbnailing/m"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+const (
+	FormatNative = ""
+	FormatWebP   = "webp"
+	FormatAvif   = "avif"
+)
+
+var ErrFormatUnsupported = errors.New("unsupported thumbnail format")
+
+// FormatContentType returns the content type produced by the given output format, or an empty string
+// for the native format.
+func FormatContentType(format string) string {
+	switch format {
+	case FormatWebP:
+		return "image/webp"
+	case FormatAvif:
+		return "image/avif"
+	default:
+		return ""
+	}
+}
+
+// IsFormatEnabled returns true if the given output format may be produced for the request's domain.
+func IsFormatEnabled(ctx rcontext.RequestContext, format string) bool {
+	switch format {
+	case FormatNative:
+		return true
+	case FormatWebP:
+		return ctx.Config.Thumbnails.Formats.WebP.Enabled
+	case FormatAvif:
+		return ctx.Config.Thumbnails.Formats.Avif.Enabled
+	default:
+		return false
+	}
+}
+
+// Transcode converts a generated thumbnail to the given output format. Animated thumbnails and thumbnails
+// which are already in the target format are returned as-is. If transcoding fails, a thumbnail in the
+// native format is returned alongside the error so the caller may fall back to it. The supplied
+// thumbnail's reader is always consumed and closed.
+func Transcode(thumb *m.Thumbnail, format string, ctx rcontext.RequestContext) (*m.Thumbnail, error) {
+	contentType := FormatContentType(format)
+	if contentType == "" || thumb.Animated || thumb.ContentType == contentType {
+		return thumb, nil
+	}
+	defer thumb.Reader.Close()
+
+	src, err := io.ReadAll(thumb.Reader)
+	if err != nil {
+		return nil, errors.New("transcode: error reading thumbnail: " + err.Error())
+	}
+	native := &m.Thumbnail{
+		Animated:    thumb.Animated,
+		ContentType: thumb.ContentType,
+		Reader:      io.NopCloser(bytes.NewReader(src)),
+	}
+
+	var args []string
+	switch format {
+	case FormatWebP:
+		quality := ctx.Config.Thumbnails.Formats.WebP.Quality
+		args = []string{"-c:v", "libwebp", "-quality", strconv.Itoa(quality)}
+	case FormatAvif:
+		// libaom uses a CRF scale of 0 (best) to 63 (worst), so invert our 0-100 quality scale
+		quality := ctx.Config.Thumbnails.Formats.Avif.Quality
+		crf := 63 - (util.MinInt(100, util.MaxInt(0, quality)) * 63 / 100)
+		args = []string{"-c:v", "libaom-av1", "-still-picture", "1", "-crf", strconv.Itoa(crf), "-b:v", "0"}
+	default:
+		return native, ErrFormatUnsupported
+	}
+
+	dir, err := os.MkdirTemp(os.TempDir(), "mmr-transcode")
+	if err != nil {
+		return native, errors.New("transcode: error creating temporary directory: " + err.Error())
+	}
+
+	tempFile1 := path.Join(dir, "i"+util.ExtensionForContentType(thumb.ContentType))
+	tempFile2 := path.Join(dir, "o."+format)
+
+	defer os.Remove(tempFile1)
+	defer os.Remove(tempFile2)
+	defer os.Remove(dir)
+
+	err = os.WriteFile(tempFile1, src, 0640)
+	if err != nil {
+		return native, errors.New("transcode: error writing temp input file: " + err.Error())
+	}
+
+	args = append([]string{"-i", tempFile1}, args...)
+	args = append(args, tempFile2)
+	err = exec.CommandContext(ctx.Context, "ffmpeg", args...).Run()
+	if err != nil {
+		return native, errors.New("transcode: error converting to " + format + ": " + err.Error())
+	}
+
+	b, err := os.ReadFile(tempFile2)
+	if err != nil {
+		return native, errors.New("transcode: error reading temp output file: " + err.Error())
+	}
+
+	return &m.Thumbnail{
+		Animated:    false,
+		ContentType: contentType,
+		Reader:      io.NopCloser(bytes.NewReader(b)),
+	}, nil
+}
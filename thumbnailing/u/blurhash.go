@@ -0,0 +1,123 @@
+package u
+
+import (
+	"errors"
+	"image"
+	"math"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+const base83Chars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+// blurhashSampleSize is the largest dimension the image is reduced to before encoding. Blurhashes only describe
+// the lowest frequencies of an image, so there's no benefit to sampling every pixel of the source.
+const blurhashSampleSize = 64
+
+// EncodeBlurhash computes the blurhash (https://blurha.sh) of the image using the given number of components on
+// each axis. Components must be between 1 and 9 inclusive.
+func EncodeBlurhash(img image.Image, xComponents int, yComponents int) (string, error) {
+	if xComponents < 1 || xComponents > 9 || yComponents < 1 || yComponents > 9 {
+		return "", errors.New("blurhash: components must be between 1 and 9")
+	}
+	if img.Bounds().Dx() <= 0 || img.Bounds().Dy() <= 0 {
+		return "", errors.New("blurhash: image has no pixels")
+	}
+
+	sample := imaging.Fit(img, blurhashSampleSize, blurhashSampleSize, imaging.Box)
+	width := sample.Bounds().Dx()
+	height := sample.Bounds().Dy()
+
+	// Convert to linear RGB once, rather than per component
+	linear := make([][3]float64, width*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			o := sample.PixOffset(x, y)
+			linear[y*width+x] = [3]float64{
+				srgbToLinear(sample.Pix[o]),
+				srgbToLinear(sample.Pix[o+1]),
+				srgbToLinear(sample.Pix[o+2]),
+			}
+		}
+	}
+
+	factors := make([][3]float64, xComponents*yComponents)
+	for j := 0; j < yComponents; j++ {
+		for i := 0; i < xComponents; i++ {
+			normalisation := 2.0
+			if i == 0 && j == 0 {
+				normalisation = 1.0
+			}
+			var r, g, b float64
+			for y := 0; y < height; y++ {
+				basisY := math.Cos(math.Pi * float64(j) * float64(y) / float64(height))
+				for x := 0; x < width; x++ {
+					basis := normalisation * math.Cos(math.Pi*float64(i)*float64(x)/float64(width)) * basisY
+					px := linear[y*width+x]
+					r += basis * px[0]
+					g += basis * px[1]
+					b += basis * px[2]
+				}
+			}
+			scale := 1.0 / float64(width*height)
+			factors[j*xComponents+i] = [3]float64{r * scale, g * scale, b * scale}
+		}
+	}
+
+	sb := &strings.Builder{}
+	writeBase83(sb, (xComponents-1)+(yComponents-1)*9, 1)
+
+	maximumValue := 1.0
+	if len(factors) > 1 {
+		actualMaximum := 0.0
+		for _, f := range factors[1:] {
+			actualMaximum = math.Max(actualMaximum, math.Max(math.Abs(f[0]), math.Max(math.Abs(f[1]), math.Abs(f[2]))))
+		}
+		quantisedMaximum := int(math.Max(0, math.Min(82, math.Floor(actualMaximum*166-0.5))))
+		maximumValue = float64(quantisedMaximum+1) / 166
+		writeBase83(sb, quantisedMaximum, 1)
+	} else {
+		writeBase83(sb, 0, 1)
+	}
+
+	dc := factors[0]
+	writeBase83(sb, (linearToSrgb(dc[0])<<16)+(linearToSrgb(dc[1])<<8)+linearToSrgb(dc[2]), 4)
+	for _, f := range factors[1:] {
+		quantR := quantiseAc(f[0], maximumValue)
+		quantG := quantiseAc(f[1], maximumValue)
+		quantB := quantiseAc(f[2], maximumValue)
+		writeBase83(sb, quantR*19*19+quantG*19+quantB, 2)
+	}
+
+	return sb.String(), nil
+}
+
+func writeBase83(sb *strings.Builder, value int, length int) {
+	for i := 1; i <= length; i++ {
+		digit := (value / int(math.Pow(83, float64(length-i)))) % 83
+		sb.WriteByte(base83Chars[digit])
+	}
+}
+
+func srgbToLinear(value uint8) float64 {
+	v := float64(value) / 255
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+func linearToSrgb(value float64) int {
+	v := math.Max(0, math.Min(1, value))
+	if v <= 0.0031308 {
+		return int(math.Round(v * 12.92 * 255))
+	}
+	return int(math.Round((1.055*math.Pow(v, 1/2.4) - 0.055) * 255))
+}
+
+func quantiseAc(value float64, maximumValue float64) int {
+	v := value / maximumValue
+	signPow := math.Copysign(math.Pow(math.Abs(v), 0.5), v)
+	return int(math.Max(0, math.Min(18, math.Floor(signPow*9+9.5))))
+}
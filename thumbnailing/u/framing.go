@@ -16,6 +16,8 @@ func MakeThumbnail(src image.Image, method string, width int, height int) (image
 		result = imaging.Fit(src, width, height, imaging.Linear)
 	} else if method == "crop" {
 		result = imaging.Fill(src, width, height, imaging.Center, imaging.Linear)
+	} else if method == "smart" {
+		result = SmartCrop(src, width, height)
 	} else {
 		return nil, errors.New("unrecognized method: " + method)
 	}
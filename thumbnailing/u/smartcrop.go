@@ -0,0 +1,153 @@
+package u
+
+import (
+	"image"
+	"math"
+
+	"github.com/disintegration/imaging"
+)
+
+// smartCropAnalysisSize is the largest dimension the image is reduced to before looking for salient regions.
+const smartCropAnalysisSize = 128
+
+// SmartCrop crops the image to the aspect ratio of width x height around its most interesting region, then resizes
+// it to width x height. Regions are scored by skin tones (a cheap stand-in for faces), edge detail, and saturation,
+// with a slight preference for the center of the image to break ties.
+func SmartCrop(src image.Image, width int, height int) image.Image {
+	bounds := src.Bounds()
+	srcWidth := bounds.Dx()
+	srcHeight := bounds.Dy()
+
+	// The crop is the largest region with the requested aspect ratio, so it only ever moves along one axis
+	cropWidth := srcWidth
+	cropHeight := int(math.Round(float64(srcWidth) * float64(height) / float64(width)))
+	if cropHeight > srcHeight {
+		cropHeight = srcHeight
+		cropWidth = int(math.Round(float64(srcHeight) * float64(width) / float64(height)))
+	}
+	if (cropWidth >= srcWidth && cropHeight >= srcHeight) || cropWidth < 1 || cropHeight < 1 {
+		return imaging.Fill(src, width, height, imaging.Center, imaging.Linear)
+	}
+
+	small := imaging.Fit(src, smartCropAnalysisSize, smartCropAnalysisSize, imaging.Box)
+	scale := float64(srcWidth) / float64(small.Bounds().Dx())
+	saliency := saliencyMap(small)
+
+	smallWidth := small.Bounds().Dx()
+	smallHeight := small.Bounds().Dy()
+	windowWidth := min(smallWidth, int(math.Round(float64(cropWidth)/scale)))
+	windowHeight := min(smallHeight, int(math.Round(float64(cropHeight)/scale)))
+
+	// Integral image so each candidate window can be scored in constant time
+	integral := make([]float64, (smallWidth+1)*(smallHeight+1))
+	for y := 0; y < smallHeight; y++ {
+		rowSum := 0.0
+		for x := 0; x < smallWidth; x++ {
+			rowSum += saliency[y*smallWidth+x]
+			integral[(y+1)*(smallWidth+1)+x+1] = integral[y*(smallWidth+1)+x+1] + rowSum
+		}
+	}
+	windowSum := func(x int, y int) float64 {
+		x2 := x + windowWidth
+		y2 := y + windowHeight
+		return integral[y2*(smallWidth+1)+x2] - integral[y*(smallWidth+1)+x2] - integral[y2*(smallWidth+1)+x] + integral[y*(smallWidth+1)+x]
+	}
+
+	total := integral[len(integral)-1]
+	maxX := smallWidth - windowWidth
+	maxY := smallHeight - windowHeight
+	bestX, bestY := maxX/2, maxY/2
+	bestScore := math.Inf(-1)
+	for y := 0; y <= maxY; y++ {
+		for x := 0; x <= maxX; x++ {
+			score := windowSum(x, y)
+			if total > 0 {
+				score /= total
+			}
+			// Prefer the center slightly, so featureless images are cropped like the regular method
+			offCenter := math.Abs(float64(x)-float64(maxX)/2)/float64(max(smallWidth, 1)) + math.Abs(float64(y)-float64(maxY)/2)/float64(max(smallHeight, 1))
+			score -= offCenter * 0.05
+			if score > bestScore {
+				bestScore = score
+				bestX = x
+				bestY = y
+			}
+		}
+	}
+
+	cropX := min(srcWidth-cropWidth, int(math.Round(float64(bestX)*scale)))
+	cropY := min(srcHeight-cropHeight, int(math.Round(float64(bestY)*scale)))
+	cropRect := image.Rect(cropX, cropY, cropX+cropWidth, cropY+cropHeight).Add(bounds.Min)
+	return imaging.Resize(imaging.Crop(src, cropRect), width, height, imaging.Linear)
+}
+
+// saliencyMap scores each pixel of the image by how likely it is to be part of the subject.
+func saliencyMap(img *image.NRGBA) []float64 {
+	w := img.Bounds().Dx()
+	h := img.Bounds().Dy()
+	lum := make([]float64, w*h)
+	result := make([]float64, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			i := y*img.Stride + x*4
+			r := float64(img.Pix[i]) / 255
+			g := float64(img.Pix[i+1]) / 255
+			b := float64(img.Pix[i+2]) / 255
+			a := float64(img.Pix[i+3]) / 255
+			l := 0.2126*r + 0.7152*g + 0.0722*b
+			lum[y*w+x] = l * a
+
+			result[y*w+x] = (1.8*skinScore(r, g, b, l) + 0.3*saturationScore(r, g, b, l)) * a
+		}
+	}
+
+	// Edge detail, from the laplacian of the luminance
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := lum[y*w+x]
+			detail := 4 * c
+			detail -= lum[y*w+max(x-1, 0)]
+			detail -= lum[y*w+min(x+1, w-1)]
+			detail -= lum[max(y-1, 0)*w+x]
+			detail -= lum[min(y+1, h-1)*w+x]
+			result[y*w+x] += math.Min(1, math.Abs(detail)*4)
+		}
+	}
+	return result
+}
+
+// skinScore returns how close the colour is to a typical skin tone, from 0 to 1.
+func skinScore(r float64, g float64, b float64, lum float64) float64 {
+	if lum < 0.1 || lum > 0.95 {
+		return 0
+	}
+	mag := math.Sqrt(r*r + g*g + b*b)
+	if mag == 0 {
+		return 0
+	}
+	dr := r/mag - 0.78
+	dg := g/mag - 0.57
+	db := b/mag - 0.44
+	dist := math.Sqrt(dr*dr + dg*dg + db*db)
+	if dist > 0.2 {
+		return 0
+	}
+	return 1 - dist/0.2
+}
+
+// saturationScore returns the HSL saturation of the colour, ignoring very dark and very bright colours.
+func saturationScore(r float64, g float64, b float64, lum float64) float64 {
+	if lum < 0.05 || lum > 0.9 {
+		return 0
+	}
+	maxC := math.Max(r, math.Max(g, b))
+	minC := math.Min(r, math.Min(g, b))
+	if maxC == minC {
+		return 0
+	}
+	l := (maxC + minC) / 2
+	if l > 0.5 {
+		return (maxC - minC) / (2 - maxC - minC)
+	}
+	return (maxC - minC) / (maxC + minC)
+}
@@ -0,0 +1,94 @@
+package thumbnailing
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/thumbnailing/m"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+const (
+	BackendNative = "native"
+	BackendVips   = "vips"
+)
+
+// vipsContentTypes are the still image types handed to libvips when it is the configured backend. Everything else,
+// including animated images, uses the native generators.
+var vipsContentTypes = []string{
+	"image/jpeg",
+	"image/jpg",
+	"image/png",
+	"image/webp",
+	"image/tiff",
+}
+
+func canUseVips(ctx rcontext.RequestContext, contentType string, animated bool) bool {
+	if ctx.Config.Thumbnails.Backend != BackendVips || !util.ArrayContains(vipsContentTypes, contentType) {
+		return false
+	}
+	// JPEG and TIFF are never animated, but PNG and WebP might be
+	return !animated || contentType == "image/jpeg" || contentType == "image/jpg" || contentType == "image/tiff"
+}
+
+// generateWithVips thumbnails the image using the `vipsthumbnail` command, which decodes large JPEGs at a reduced
+// size instead of holding the whole image in memory.
+func generateWithVips(ctx rcontext.RequestContext, src []byte, contentType string, width int, height int, method string) (*m.Thumbnail, error) {
+	dir, err := os.MkdirTemp(os.TempDir(), "mmr-vips")
+	if err != nil {
+		return nil, errors.New("vips: error creating temporary directory: " + err.Error())
+	}
+
+	outputType := "image/png"
+	outputOpts := "[compression=6,strip]"
+	if contentType == "image/jpeg" || contentType == "image/jpg" {
+		// Encode JPEG source with JPEG thumbnails to avoid returning larger thumbnails than what we started with
+		outputType = "image/jpeg"
+		outputOpts = "[Q=95,strip]"
+	}
+
+	tempFile1 := path.Join(dir, "i"+util.ExtensionForContentType(contentType))
+	tempFile2 := path.Join(dir, "o"+util.ExtensionForContentType(outputType))
+
+	defer os.Remove(tempFile1)
+	defer os.Remove(tempFile2)
+	defer os.Remove(dir)
+
+	if err = os.WriteFile(tempFile1, src, 0640); err != nil {
+		return nil, errors.New("vips: error writing temp input file: " + err.Error())
+	}
+
+	args := []string{tempFile1, "-o", tempFile2 + outputOpts}
+	switch method {
+	case "scale":
+		// Like the native thumbnailer, only shrink when fitting the image inside the box
+		args = append(args, "--size", strconv.Itoa(width)+"x"+strconv.Itoa(height)+">")
+	case "crop":
+		args = append(args, "--size", strconv.Itoa(width)+"x"+strconv.Itoa(height), "--smartcrop", "centre")
+	case "smart":
+		args = append(args, "--size", strconv.Itoa(width)+"x"+strconv.Itoa(height), "--smartcrop", "attention")
+	default:
+		return nil, errors.New("vips: unrecognized method: " + method)
+	}
+
+	if out, err := exec.CommandContext(ctx.Context, "vipsthumbnail", args...).CombinedOutput(); err != nil {
+		return nil, errors.New("vips: error generating thumbnail: " + err.Error() + ": " + string(bytes.TrimSpace(out)))
+	}
+
+	b, err := os.ReadFile(tempFile2)
+	if err != nil {
+		return nil, errors.New("vips: error reading temp output file: " + err.Error())
+	}
+
+	return &m.Thumbnail{
+		Animated:    false,
+		ContentType: outputType,
+		Reader:      io.NopCloser(bytes.NewReader(b)),
+	}, nil
+}
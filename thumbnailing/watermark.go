@@ -0,0 +1,87 @@
+package thumbnailing
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+
+	"github.com/fogleman/gg"
+	"github.com/golang/freetype/truetype"
+	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"golang.org/x/image/font/gofont/gomono"
+)
+
+// CanWatermark returns true if Watermark supports the content type.
+func CanWatermark(contentType string) bool {
+	return contentType == "image/png" || contentType == "image/jpeg"
+}
+
+// Watermark tiles a faint copy of label across a PNG or JPEG image, returning the re-encoded image.
+// Other content types return ErrUnsupported. The stream is always consumed and closed.
+func Watermark(ctx rcontext.RequestContext, imgStream io.ReadCloser, contentType string, label string, opacity float64) ([]byte, error) {
+	defer imgStream.Close()
+	if !CanWatermark(contentType) {
+		return nil, ErrUnsupported
+	}
+
+	b, err := io.ReadAll(io.LimitReader(imgStream, ctx.Config.Thumbnails.MaxSourceBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(b)) > ctx.Config.Thumbnails.MaxSourceBytes {
+		return nil, common.ErrMediaTooLarge
+	}
+
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Width*cfg.Height >= ctx.Config.Thumbnails.MaxPixels {
+		return nil, common.ErrMediaTooLarge
+	}
+	src, _, err := image.Decode(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := truetype.Parse(gomono.TTF)
+	if err != nil {
+		return nil, err
+	}
+
+	w := float64(src.Bounds().Dx())
+	h := float64(src.Bounds().Dy())
+	size := max(w, h) / 24
+	if size < 8 {
+		size = 8
+	}
+
+	c := gg.NewContextForImage(src)
+	c.SetFontFace(truetype.NewFace(f, &truetype.Options{Size: size}))
+	c.SetColor(color.NRGBA{R: 255, G: 255, B: 255, A: uint8(255 * opacity)})
+	c.RotateAbout(gg.Radians(-30), w/2, h/2)
+	lw, _ := c.MeasureString(label)
+	stepX := lw + size*3
+	stepY := size * 5
+	// Tile beyond the image edges so the rotated pattern still covers the corners
+	for y := -h; y < h*2; y += stepY {
+		for x := -w; x < w*2; x += stepX {
+			c.DrawStringAnchored(label, x, y, 0.5, 0.5)
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	if contentType == "image/png" {
+		err = png.Encode(buf, c.Image())
+	} else {
+		err = jpeg.Encode(buf, c.Image(), &jpeg.Options{Quality: 90})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,94 @@
+package util
+
+import (
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// SanitizeUploadName cleans up a filename supplied by a client for storage. The name is normalized to NFC, any
+// directories in it are removed, and control characters are stripped.
+func SanitizeUploadName(name string) string {
+	name = norm.NFC.String(strings.ToValidUTF8(name, ""))
+	if i := strings.LastIndexAny(name, "/\\"); i >= 0 {
+		name = name[i+1:]
+	}
+	name = SanitizeFilename(name, 0)
+	if name == "." || name == ".." {
+		return ""
+	}
+	return name
+}
+
+// SanitizeFilename removes control characters and path separators from a filename, and shortens it to at
+// most maxLength characters while keeping the extension. A maxLength of zero or less does not shorten the
+// name.
+func SanitizeFilename(name string, maxLength int) string {
+	name = strings.ToValidUTF8(name, "")
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || r == unicode.ReplacementChar {
+			return -1
+		}
+		if r == '/' || r == '\\' {
+			return '_'
+		}
+		return r
+	}, name)
+	name = strings.TrimSpace(name)
+
+	if maxLength <= 0 || utf8.RuneCountInString(name) <= maxLength {
+		return name
+	}
+
+	ext := filepath.Ext(name)
+	extLength := utf8.RuneCountInString(ext)
+	if extLength >= maxLength/2 {
+		ext = "" // extension is unreasonably long, so just cut the whole name
+		extLength = 0
+	}
+	base := []rune(strings.TrimSuffix(name, ext))
+	return strings.TrimSpace(string(base[:maxLength-extLength])) + ext
+}
+
+// ContentDisposition builds a Content-Disposition header value for the filename, as per RFC 6266. Non-ASCII
+// names are sent with an RFC 5987 `filename*` parameter alongside an ASCII approximation for older clients.
+func ContentDisposition(disposition string, filename string) string {
+	if filename == "" {
+		return disposition
+	}
+
+	fallback := strings.Map(func(r rune) rune {
+		if r > unicode.MaxASCII || !unicode.IsPrint(r) {
+			return '_'
+		}
+		return r
+	}, filename)
+	val := disposition + "; filename=" + quoteHeaderParam(fallback)
+	if fallback != filename {
+		val += "; filename*=UTF-8''" + encodeExtValue(filename)
+	}
+	return val
+}
+
+func quoteHeaderParam(s string) string {
+	return "\"" + strings.NewReplacer("\\", "\\\\", "\"", "\\\"").Replace(s) + "\""
+}
+
+// encodeExtValue percent-encodes everything except the RFC 5987 attr-char set.
+func encodeExtValue(s string) string {
+	const hex = "0123456789ABCDEF"
+	sb := strings.Builder{}
+	for _, b := range []byte(s) {
+		if (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z') || (b >= '0' && b <= '9') || strings.IndexByte("!#$&+-.^_`|~", b) >= 0 {
+			sb.WriteByte(b)
+		} else {
+			sb.WriteByte('%')
+			sb.WriteByte(hex[b>>4])
+			sb.WriteByte(hex[b&0x0F])
+		}
+	}
+	return sb.String()
+}
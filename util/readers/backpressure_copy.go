@@ -0,0 +1,41 @@
+package readers
+
+import (
+	"errors"
+	"io"
+	"net/http"
+)
+
+// CopyWithBackpressure copies src to dst through a single fixed-size buffer, flushing dst after every
+// write (if it supports flushing). Unlike io.Copy, this never reads ahead of what dst has accepted, so
+// at most bufferSize bytes are held in memory no matter how slowly dst consumes them.
+func CopyWithBackpressure(dst io.Writer, src io.Reader, bufferSize int) (int64, error) {
+	if bufferSize <= 0 {
+		return 0, errors.New("buffer size must be positive")
+	}
+	flusher, _ := dst.(http.Flusher)
+	buf := make([]byte, bufferSize)
+	var written int64
+	for {
+		nr, rerr := src.Read(buf)
+		if nr > 0 {
+			nw, werr := dst.Write(buf[:nr])
+			written += int64(nw)
+			if werr != nil {
+				return written, werr
+			}
+			if nw != nr {
+				return written, io.ErrShortWrite
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if rerr != nil {
+			if rerr == io.EOF {
+				return written, nil
+			}
+			return written, rerr
+		}
+	}
+}
@@ -0,0 +1,261 @@
+package webhooks
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/events"
+	"github.com/t2bot/matrix-media-repo/metrics"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+type EventType string
+
+const (
+	MediaUploaded    EventType = "media.uploaded"
+	MediaQuarantined EventType = "media.quarantined"
+	MediaDeleted     EventType = "media.deleted"
+	QuotaExceeded    EventType = "quota.exceeded"
+)
+
+const (
+	// SignatureHeader carries `t=<timestamp>,v1=<signature>`, where the signature is the hex-encoded HMAC-SHA256 of
+	// `<timestamp>.<body>` using the endpoint's secret.
+	SignatureHeader = "X-MMR-Signature"
+	EventHeader     = "X-MMR-Event"
+	DeliveryHeader  = "X-MMR-Delivery"
+)
+
+// Event is the JSON body POSTed to webhook endpoints.
+type Event struct {
+	Id    string      `json:"id"`
+	Type  EventType   `json:"type"`
+	Ts    int64       `json:"ts"`
+	Media *EventMedia `json:"media,omitempty"`
+	Quota *EventQuota `json:"quota,omitempty"`
+}
+
+type EventMedia struct {
+	Origin      string `json:"origin"`
+	MediaId     string `json:"media_id"`
+	UserId      string `json:"user_id,omitempty"`
+	SizeBytes   int64  `json:"size"`
+	ContentType string `json:"content_type,omitempty"`
+	Sha256Hash  string `json:"sha256"`
+}
+
+type EventQuota struct {
+	UserId string `json:"user_id"`
+	// Quota is one of "max_bytes", "max_pending", or "max_files".
+	Quota     string `json:"quota"`
+	Current   int64  `json:"current"`
+	Limit     int64  `json:"limit"`
+	Requested int64  `json:"requested,omitempty"`
+}
+
+// delivery is an event waiting to be sent to an endpoint.
+type delivery struct {
+	event *Event
+	body  []byte
+}
+
+// endpointWorker sends events to a single endpoint, so a slow or failing endpoint doesn't hold up the others.
+type endpointWorker struct {
+	url   string
+	queue chan *delivery
+}
+
+var workers = make(map[string]*endpointWorker) // endpoint URL -> worker
+var workersLock = &sync.Mutex{}
+
+func init() {
+	events.Subscribe(onMediaEvent)
+}
+
+// IsEnabled returns true if any webhook endpoints are configured.
+func IsEnabled() bool {
+	return len(config.Get().Webhooks.Endpoints) > 0
+}
+
+var mediaEventTypes = map[events.MediaEventType]EventType{
+	events.MediaUploaded:    MediaUploaded,
+	events.MediaQuarantined: MediaQuarantined,
+	events.MediaPurged:      MediaDeleted,
+}
+
+// onMediaEvent forwards media lifecycle events from the event stream to the configured webhooks.
+func onMediaEvent(ctx rcontext.RequestContext, mediaEvent *events.MediaEvent) {
+	eventType, ok := mediaEventTypes[mediaEvent.Type]
+	if !ok {
+		return
+	}
+	notify(ctx, &Event{
+		Type: eventType,
+		Media: &EventMedia{
+			Origin:      mediaEvent.Origin,
+			MediaId:     mediaEvent.MediaId,
+			UserId:      mediaEvent.UserId,
+			SizeBytes:   mediaEvent.SizeBytes,
+			ContentType: mediaEvent.ContentType,
+			Sha256Hash:  mediaEvent.Sha256Hash,
+		},
+	})
+}
+
+// NotifyQuotaExceeded queues a quota.exceeded event for delivery to the configured webhooks. Requested is the
+// number of bytes the user tried to upload, if known.
+func NotifyQuotaExceeded(ctx rcontext.RequestContext, userId string, quota string, current int64, limit int64, requested int64) {
+	notify(ctx, &Event{
+		Type: QuotaExceeded,
+		Quota: &EventQuota{
+			UserId:    userId,
+			Quota:     quota,
+			Current:   current,
+			Limit:     limit,
+			Requested: requested,
+		},
+	})
+}
+
+// notify queues the event for each endpoint which wants it, without blocking the caller. Events are dropped for
+// endpoints which can't keep up.
+func notify(ctx rcontext.RequestContext, event *Event) {
+	if !IsEnabled() {
+		return
+	}
+
+	id, err := util.GenerateRandomString(16)
+	if err != nil {
+		ctx.Log.Warn("Non-fatal error generating webhook delivery ID: ", err)
+		sentry.CaptureException(err)
+		return
+	}
+	event.Id = id
+	event.Ts = util.NowMillis()
+	body, err := json.Marshal(event)
+	if err != nil {
+		ctx.Log.Error("Error encoding webhook event: ", err)
+		sentry.CaptureException(err)
+		return
+	}
+
+	for _, endpoint := range config.Get().Webhooks.Endpoints {
+		if len(endpoint.Events) > 0 && !slices.Contains(endpoint.Events, string(event.Type)) {
+			continue
+		}
+		select {
+		case getWorker(endpoint.Url).queue <- &delivery{event: event, body: body}:
+		default:
+			metrics.WebhookDeliveries.With(prometheus.Labels{"type": string(event.Type), "result": "queue_full"}).Inc()
+			ctx.Log.Warnf("Webhook queue for %s is full - dropping %s event", endpoint.Url, event.Type)
+		}
+	}
+}
+
+// getWorker returns the worker for the endpoint URL, starting it if needed.
+func getWorker(url string) *endpointWorker {
+	workersLock.Lock()
+	defer workersLock.Unlock()
+
+	if w, ok := workers[url]; ok {
+		return w
+	}
+	w := &endpointWorker{
+		url:   url,
+		queue: make(chan *delivery, max(config.Get().Webhooks.QueueSize, 1)),
+	}
+	workers[url] = w
+	go w.deliverLoop()
+	return w
+}
+
+func (w *endpointWorker) deliverLoop() {
+	for d := range w.queue {
+		// Use the endpoint's current config, in case it changed since the event was queued
+		conf := config.Get().Webhooks
+		idx := slices.IndexFunc(conf.Endpoints, func(e config.WebhookEndpointConfig) bool {
+			return e.Url == w.url
+		})
+		if idx < 0 {
+			metrics.WebhookDeliveries.With(prometheus.Labels{"type": string(d.event.Type), "result": "failed"}).Inc()
+			logrus.Warnf("Dropping %s event for removed webhook endpoint %s", d.event.Type, w.url)
+			continue
+		}
+		client := &http.Client{
+			Timeout: time.Duration(conf.TimeoutSeconds) * time.Second,
+		}
+		deliver(client, conf, conf.Endpoints[idx], d.event, d.body)
+	}
+}
+
+// deliver POSTs the event to the endpoint, retrying with a growing delay if the endpoint fails. Failures are logged
+// rather than returned.
+func deliver(client *http.Client, conf config.WebhooksConfig, endpoint config.WebhookEndpointConfig, event *Event, body []byte) {
+	attempts := max(conf.MaxAttempts, 1)
+	var err error
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			time.Sleep(time.Duration(1<<(i-1)) * time.Second)
+		}
+		if err = post(client, endpoint, event, body); err == nil {
+			metrics.WebhookDeliveries.With(prometheus.Labels{"type": string(event.Type), "result": "delivered"}).Inc()
+			return
+		}
+	}
+	metrics.WebhookDeliveries.With(prometheus.Labels{"type": string(event.Type), "result": "failed"}).Inc()
+	logrus.WithFields(logrus.Fields{
+		"url":      endpoint.Url,
+		"event":    event.Type,
+		"delivery": event.Id,
+	}).Errorf("Error delivering webhook after %d attempts: %s", attempts, err)
+	sentry.CaptureException(err)
+}
+
+func post(client *http.Client, endpoint config.WebhookEndpointConfig, event *Event, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, endpoint.Url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", "matrix-media-repo")
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, string(event.Type))
+	req.Header.Set(DeliveryHeader, event.Id)
+	if endpoint.Secret != "" {
+		req.Header.Set(SignatureHeader, Sign(endpoint.Secret, util.NowMillis(), body))
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status code %d", res.StatusCode)
+	}
+	return nil
+}
+
+// Sign returns the signature header value for a body sent at the given time (in milliseconds). Receivers should
+// compute the same value to verify deliveries, and reject old timestamps to avoid replays.
+func Sign(secret string, ts int64, body []byte) string {
+	tsStr := strconv.FormatInt(ts, 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(tsStr))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "t=" + tsStr + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}